@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/yl2chen/cidranger"
+)
+
+// AccessAction type
+type AccessAction int
+
+const (
+	// ActionAllow allows the clients to make queries
+	ActionAllow AccessAction = iota
+	// ActionDeny denies the queries of the clients
+	ActionDeny
+	// ActionNoDNSSEC disables the DNSSEC validation for the clients
+	ActionNoDNSSEC
+	// ActionUpstream forwards the queries of the clients to an upstream group
+	ActionUpstream
+)
+
+var accessActions = map[string]AccessAction{
+	"allow":    ActionAllow,
+	"deny":     ActionDeny,
+	"nodnssec": ActionNoDNSSEC,
+	"upstream": ActionUpstream,
+}
+
+// String returns the name of the action
+func (a AccessAction) String() string {
+	for name, action := range accessActions {
+		if action == a {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// AccessEntry is an access list entry holding the action for the network
+type AccessEntry struct {
+	ipnet net.IPNet
+
+	Action   AccessAction
+	Upstream string
+
+	// NoRateLimit exempts the client from the rate limiting
+	NoRateLimit bool
+
+	// NoQTypeACL exempts the client from the query type policy
+	NoQTypeACL bool
+
+	// Client is the address of the client matched the entry
+	Client net.IP
+}
+
+// NewAccessEntry returns a new access list entry
+func NewAccessEntry(ipnet net.IPNet, action AccessAction, upstream string) *AccessEntry {
+	return &AccessEntry{ipnet: ipnet, Action: action, Upstream: upstream}
+}
+
+// Network returns the network of the entry
+func (e *AccessEntry) Network() net.IPNet {
+	return e.ipnet
+}
+
+type accessRule struct {
+	CIDR        string
+	Action      string
+	Upstream    string
+	NoRateLimit bool
+	NoQTypeACL  bool
+}
+
+// newAccessList returns a ranger from the plain access list and the access rules,
+// the rules override the plain access list entries on the same networks
+func newAccessList(list []string, rules []accessRule, groups map[string][]string) (cidranger.Ranger, error) {
+	ranger := cidranger.NewPCTrieRanger()
+
+	for _, cidr := range list {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("access list parse cidr failed: %s", err)
+		}
+
+		err = ranger.Insert(NewAccessEntry(*ipnet, ActionAllow, ""))
+		if err != nil {
+			return nil, fmt.Errorf("access list insert cidr failed: %s", err)
+		}
+	}
+
+	for _, rule := range rules {
+		_, ipnet, err := net.ParseCIDR(rule.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("access rule parse cidr failed: %s", err)
+		}
+
+		action, ok := accessActions[strings.ToLower(rule.Action)]
+		if !ok {
+			return nil, fmt.Errorf("access rule action unknown: %s", rule.Action)
+		}
+
+		if action == ActionUpstream {
+			if _, ok := groups[rule.Upstream]; !ok {
+				return nil, fmt.Errorf("access rule upstream group not found: %s", rule.Upstream)
+			}
+		}
+
+		entry := NewAccessEntry(*ipnet, action, rule.Upstream)
+		entry.NoRateLimit = rule.NoRateLimit
+		entry.NoQTypeACL = rule.NoQTypeACL
+
+		err = ranger.Insert(entry)
+		if err != nil {
+			return nil, fmt.Errorf("access rule insert cidr failed: %s", err)
+		}
+	}
+
+	return ranger, nil
+}
+
+// accessEntry returns the most specific access list entry for the client,
+// nil means the client isn't in the access list. The access list of the
+// listener used if given and overridden, the global one otherwise.
+func accessEntry(client string, listener ...string) *AccessEntry {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil
+	}
+
+	var ranger cidranger.Ranger
+	if p := listenerPolicyOf(listener); p != nil && p.access != nil {
+		ranger = p.access
+	} else {
+		accessListMu.RLock()
+		ranger = AccessList
+		accessListMu.RUnlock()
+	}
+
+	entries, err := ranger.ContainingNetworks(ip)
+
+	if err != nil {
+		return nil
+	}
+
+	var entry *AccessEntry
+	bestSize := -1
+
+	for _, e := range entries {
+		network := e.Network()
+		size, _ := network.Mask.Size()
+
+		if size <= bestSize {
+			continue
+		}
+
+		if ae, ok := e.(*AccessEntry); ok {
+			entry, bestSize = ae, size
+		} else {
+			entry, bestSize = NewAccessEntry(network, ActionAllow, ""), size
+		}
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	// the entries of the list are shared by the clients
+	e := *entry
+	e.Client = ip
+
+	return &e
+}
+
+const (
+	// accessDeniedRefused answers REFUSED to the denied clients
+	accessDeniedRefused = "refused"
+
+	// accessDeniedDrop drops the queries of the denied clients without answer
+	accessDeniedDrop = "drop"
+
+	// accessDeniedEDE answers REFUSED with the prohibited extended error
+	// explained
+	accessDeniedEDE = "ede"
+)
+
+var accessDeniedModes = map[string]bool{
+	accessDeniedRefused: true,
+	accessDeniedDrop:    true,
+	accessDeniedEDE:     true,
+}
+
+// accessDeniedMode returns the answer mode of the denied client, the entry nil
+// for the client matched no access list entry or rule. The configs without
+// the mode refuse the unmatched clients by the access default deny, drop the
+// others.
+func accessDeniedMode(entry *AccessEntry) string {
+	cfg := Config()
+	if cfg.AccessDeniedMode != "" {
+		return cfg.AccessDeniedMode
+	}
+
+	if entry == nil && cfg.AccessDefaultDeny {
+		return accessDeniedRefused
+	}
+
+	return accessDeniedDrop
+}
+
+// countAccessDenied returns the answer mode of the denied client and counts
+// the query in the metrics by the mode, used by all the transports
+func countAccessDenied(entry *AccessEntry, client, proto string) string {
+	mode := accessDeniedMode(entry)
+
+	metrics.AccessDenied.WithLabelValues(mode).Inc()
+
+	log.Debug("Client denied to make new query", "client", client, "net", proto, "mode", mode)
+
+	return mode
+}
+
+// accessDeniedMsg returns the refused answer of the query by the access denied
+// mode, the access denied explained in the ede mode
+func (h *DNSHandler) accessDeniedMsg(req *dns.Msg, mode string) *dns.Msg {
+	if mode == accessDeniedEDE {
+		return addExtendedError(h.handleFailed(req, dns.RcodeRefused, false), edeProhibited, "access denied")
+	}
+
+	return setExtendedError(h.handleFailed(req, dns.RcodeRefused, false), edeProhibited, "")
+}
+
+// accessDenied answers the query of the denied client by the access denied
+// mode, the dropped queries counted in the metrics too
+func (h *DNSHandler) accessDenied(proto string, w dns.ResponseWriter, req *dns.Msg, entry *AccessEntry, client string) {
+	mode := countAccessDenied(entry, client, proto)
+
+	if mode == accessDeniedDrop {
+		if proto == "tcp" {
+			w.Close()
+		}
+
+		return
+	}
+
+	h.writeReplyMsg(w, h.accessDeniedMsg(req, mode))
+}
+
+func allowedClient(client string) bool {
+	entry := accessEntry(client)
+
+	return entry != nil && entry.Action != ActionDeny
+}
+
+func newUpstreamGroups(groups map[string][]string) map[string]*cache.AuthServers {
+	list := make(map[string]*cache.AuthServers)
+	for name, hosts := range groups {
+		list[name] = &cache.AuthServers{List: newAuthServers(hosts)}
+	}
+
+	return list
+}
+
+func upstreamServers(name string) *cache.AuthServers {
+	upstreamGroupsMu.RLock()
+	defer upstreamGroupsMu.RUnlock()
+
+	return upstreamGroups[name]
+}
+
+// upstreamDown reports whether all servers of the upstream group removed from
+// rotation by the health checks
+func upstreamDown(name string) bool {
+	servers := upstreamServers(name)
+
+	return servers != nil && len(servers.List) > 0 && servers.Down()
+}
+
+// upstreamUnreachable reports whether the forward error means every server of
+// the group failed on the network, the health checks may be disabled or not
+// run yet
+func upstreamUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == errNoFamilyServers {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// forward sends the request to the upstream group servers without recursion
+func (h *DNSHandler) forward(proto string, req *dns.Msg, name string) (*dns.Msg, error) {
+	servers := upstreamServers(name)
+	if servers == nil || len(servers.List) == 0 {
+		return nil, errUpstreamGroup
+	}
+
+	resp, err := h.r.lookup(proto, req, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.RecursionAvailable = true
+	resp.Authoritative = false
+
+	return resp, nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/yl2chen/cidranger"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	assert.NoError(t, err)
+
+	return *ipnet
+}
+
+func Test_accessList(t *testing.T) {
+	rules := []accessRule{
+		{CIDR: "10.0.0.0/8", Action: "nodnssec"},
+		{CIDR: "10.1.0.0/16", Action: "upstream", Upstream: "internal"},
+		{CIDR: "10.1.2.0/24", Action: "deny"},
+		{CIDR: "0.0.0.0/0", Action: "Allow"},
+	}
+
+	groups := map[string][]string{"internal": {"127.0.0.1:53"}}
+
+	ranger, err := newAccessList([]string{"127.0.0.0/8"}, rules, groups)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+	}()
+
+	entry := accessEntry("10.9.0.1")
+	assert.NotNil(t, entry)
+	assert.Equal(t, ActionNoDNSSEC, entry.Action)
+
+	entry = accessEntry("10.1.9.1")
+	assert.NotNil(t, entry)
+	assert.Equal(t, ActionUpstream, entry.Action)
+	assert.Equal(t, "internal", entry.Upstream)
+
+	entry = accessEntry("10.1.2.3")
+	assert.NotNil(t, entry)
+	assert.Equal(t, ActionDeny, entry.Action)
+	assert.Equal(t, "deny", entry.Action.String())
+
+	assert.False(t, allowedClient("10.1.2.3"))
+	assert.True(t, allowedClient("127.0.0.1"))
+	assert.True(t, allowedClient("192.0.2.1"))
+	assert.False(t, allowedClient("::1"))
+	assert.False(t, allowedClient("bad"))
+
+	_, err = newAccessList([]string{"0.0.0.0/99"}, nil, nil)
+	assert.Error(t, err)
+
+	_, err = newAccessList(nil, []accessRule{{CIDR: "10.0.0.0/8", Action: "drop"}}, nil)
+	assert.Error(t, err)
+
+	_, err = newAccessList(nil, []accessRule{{CIDR: "10.0.0.0/8", Action: "upstream", Upstream: "none"}}, groups)
+	assert.Error(t, err)
+}
+
+func Test_accessEntryBasic(t *testing.T) {
+	ranger := cidranger.NewPCTrieRanger()
+
+	ipnet := mustParseCIDR(t, "192.0.2.0/24")
+	ranger.Insert(cidranger.NewBasicRangerEntry(ipnet))
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+	}()
+
+	entry := accessEntry("192.0.2.1")
+	assert.NotNil(t, entry)
+	assert.Equal(t, ActionAllow, entry.Action)
+
+	assert.Nil(t, accessEntry("198.51.100.1"))
+}
+
+func Test_HandlerUpstreamGroup(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"internal": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("internal.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "internal")
+
+	resp := handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+
+	entry.Upstream = "none"
+
+	resp = handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+}
+
+func Test_HandlerUpstreamGroupDown(t *testing.T) {
+	answer := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+
+			w.WriteMsg(m)
+		}
+	}
+
+	gs, groupAddr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = answer("192.0.2.1")
+	})
+	assert.NoError(t, err)
+	defer gs.Shutdown()
+
+	fs, forwardAddr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = answer("192.0.2.2")
+	})
+	assert.NoError(t, err)
+	defer fs.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{forwardAddr}}})
+	assert.NoError(t, err)
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"tenant": {groupAddr}})
+	upstreamGroupsMu.Unlock()
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	query := func(handler *DNSHandler, entry ...*AccessEntry) string {
+		req := new(dns.Msg)
+		req.SetQuestion("host.corp.internal.", dns.TypeA)
+
+		resp := handler.query("udp", req, entry...)
+		if !assert.Len(t, resp.Answer, 1) {
+			return ""
+		}
+
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	entry := NewAccessEntry(mustParseCIDR(t, "10.0.0.0/8"), ActionUpstream, "tenant")
+
+	// the answers of the group cached apart
+	handler := NewHandler()
+	assert.Equal(t, "192.0.2.1", query(handler, entry))
+	assert.Equal(t, "192.0.2.2", query(handler))
+	assert.Equal(t, "192.0.2.1", query(handler, entry))
+
+	upstreamServers("tenant").List[0].RecordCheck(false, 0, time.Minute, 1)
+
+	handler = NewHandler()
+	assert.Equal(t, "192.0.2.2", query(handler, entry))
+}
+
+func Test_HandlerUpstreamGroupUnreachable(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.HealthCheckInterval.Duration = 0 })()
+
+	fs, forwardAddr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.2")
+			m.Answer = append(m.Answer, rr)
+
+			w.WriteMsg(m)
+		})
+	})
+	assert.NoError(t, err)
+	defer fs.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{forwardAddr}}})
+	assert.NoError(t, err)
+
+	// no health checks, the servers of the group never marked down
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"tenant": {"127.0.0.1:1"}})
+	upstreamGroupsMu.Unlock()
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.corp.internal.", dns.TypeA)
+
+	entry := NewAccessEntry(mustParseCIDR(t, "10.0.0.0/8"), ActionUpstream, "tenant")
+
+	assert.False(t, upstreamDown("tenant"))
+
+	resp := NewHandler().query("udp", req, entry)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.0.2.2", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	assert.True(t, upstreamUnreachable(&net.OpError{Op: "read", Net: "udp", Err: errors.New("connection refused")}))
+	assert.False(t, upstreamUnreachable(errUpstreamGroup))
+	assert.False(t, upstreamUnreachable(nil))
+}
+
+// testWriter records the written message
+type testWriter struct {
+	dns.ResponseWriter
+
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func Test_AccessDefaultDeny(t *testing.T) {
+	ranger, err := newAccessList([]string{"10.0.0.0/8"}, nil, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+
+	// dropped without answer
+	handler.handle("udp", w, req.Copy())
+	assert.Nil(t, w.msg)
+
+	defer setConfig(func(cfg *config) { cfg.AccessDefaultDeny = true })()
+
+	handler.handle("udp", w, req.Copy())
+	if assert.NotNil(t, w.msg) {
+		assert.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+		assert.Equal(t, req.Id, w.msg.Id)
+	}
+}
+
+// accessDeniedCount returns the denied queries of the mode in the metrics
+func accessDeniedCount(mode string) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, `sdns_access_denied_total{mode="`+mode+`"}`) {
+			return strings.Fields(line)[1]
+		}
+	}
+
+	return "0"
+}
+
+func Test_AccessDeniedMode(t *testing.T) {
+	ranger, err := newAccessList([]string{"10.0.0.0/8"}, []accessRule{{CIDR: "10.1.0.0/16", Action: "deny"}}, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = false })()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, false)
+
+	query := func(client string) *dns.Msg {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		handler.handle("udp", w, req.Copy())
+
+		return w.msg
+	}
+
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedRefused })()
+	for _, client := range []string{"192.0.2.1", "10.1.2.3"} {
+		if msg := query(client); assert.NotNil(t, msg) {
+			assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+
+			_, _, ok := extendedError(msg)
+			assert.False(t, ok)
+		}
+	}
+
+	// the dropped queries counted
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedDrop })()
+	before := accessDeniedCount(accessDeniedDrop)
+	assert.Nil(t, query("10.1.2.3"))
+	assert.NotEqual(t, before, accessDeniedCount(accessDeniedDrop))
+
+	// explained even the extended errors disabled
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedEDE })()
+	if msg := query("192.0.2.1"); assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+		code, text, ok := extendedError(msg)
+		assert.True(t, ok)
+		assert.Equal(t, uint16(edeProhibited), code)
+		assert.Equal(t, "access denied", text)
+	}
+
+	// the allowed clients answered as before
+	assert.True(t, allowedClient("10.2.0.1"))
+}
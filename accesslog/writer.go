@@ -0,0 +1,151 @@
+package accesslog
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+
+	"github.com/semihalev/log"
+)
+
+// Writer appends the lines to a file from a buffer, the file rotated when it
+// grows over the maximum size and the rotated files kept up to the backups count
+type Writer struct {
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	bw   *bufio.Writer
+	size int64
+
+	lines chan []byte
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewWriter opens the file for append and returns a new writer which buffers
+// up to size lines, zero maxSize disables the rotation
+func NewWriter(path string, maxSize int64, backups, size int) (*Writer, error) {
+	w := &Writer{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+
+		lines: make(chan []byte, size),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// Write queues the line, returns false if the buffer is full and the line dropped
+func (w *Writer) Write(line []byte) bool {
+	select {
+	case w.lines <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close writes the buffered lines and closes the file
+func (w *Writer) Close() {
+	close(w.quit)
+	<-w.done
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.quit:
+			for len(w.lines) > 0 {
+				w.write(<-w.lines)
+			}
+
+			w.bw.Flush()
+			w.file.Close()
+
+			return
+		case line := <-w.lines:
+			err := w.write(line)
+			if err == nil && len(w.lines) == 0 {
+				err = w.bw.Flush()
+			}
+
+			if err != nil {
+				log.Warn("Query log write failed", "path", w.path, "error", err.Error())
+			}
+		}
+	}
+}
+
+func (w *Writer) write(line []byte) error {
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.bw.Write(line)
+	w.size += int64(n)
+
+	return err
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file, w.bw, w.size = file, bufio.NewWriter(file), info.Size()
+
+	return nil
+}
+
+// rotate renames the file to path.1 over the older files, the oldest removed
+func (w *Writer) rotate() error {
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+
+	w.file.Close()
+
+	var err error
+	if w.backups > 0 {
+		for i := w.backups - 1; i > 0; i-- {
+			os.Rename(w.backupPath(i), w.backupPath(i+1))
+		}
+
+		err = os.Rename(w.path, w.backupPath(1))
+	} else {
+		err = os.Remove(w.path)
+	}
+
+	// the file reopened even when the rename failed, appended further
+	if oerr := w.open(); oerr != nil {
+		return oerr
+	}
+
+	return err
+}
+
+func (w *Writer) backupPath(i int) string {
+	return w.path + "." + strconv.Itoa(i)
+}
@@ -0,0 +1,82 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Writer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_accesslog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+
+	w, err := NewWriter(path, 0, 0, 16)
+	assert.NoError(t, err)
+
+	assert.True(t, w.Write([]byte("first\n")))
+	assert.True(t, w.Write([]byte("second\n")))
+	w.Close()
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	// appended on the open
+	w, err = NewWriter(path, 0, 0, 16)
+	assert.NoError(t, err)
+	assert.True(t, w.Write([]byte("third\n")))
+	w.Close()
+
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	_, err = NewWriter(filepath.Join(dir, "notfound", "query.log"), 0, 0, 16)
+	assert.Error(t, err)
+}
+
+func Test_WriterRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_accesslog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+
+	w, err := NewWriter(path, 10, 2, 16)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"line-01\n", "line-02\n", "line-03\n", "line-04\n"} {
+		assert.True(t, w.Write([]byte(line)))
+	}
+	w.Close()
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "line-04\n", string(data))
+
+	data, err = ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, "line-03\n", string(data))
+
+	data, err = ioutil.ReadFile(path + ".2")
+	assert.NoError(t, err)
+	assert.Equal(t, "line-02\n", string(data))
+
+	// the oldest removed
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_WriterDrop(t *testing.T) {
+	w := &Writer{lines: make(chan []byte, 1)}
+
+	assert.True(t, w.Write([]byte("queued\n")))
+	assert.False(t, w.Write([]byte("dropped\n")))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// cacheNSEC3 stores the NSEC3 records of a negative response for the aggressive
+// negative caching (RFC 8198), only if the records signed by the zone which
+// the DS records given and the signatures verified.
+func (r *Resolver) cacheNSEC3(Net string, resp *dns.Msg, parentdsrr []dns.RR) {
+	if len(parentdsrr) == 0 || len(resp.Question) == 0 || resp.Question[0].Qtype == dns.TypeDNSKEY {
+		return
+	}
+
+	nsec3Set := extractRRSet(resp.Ns, "", dns.TypeNSEC3)
+	soaSet := extractRRSet(resp.Ns, "", dns.TypeSOA)
+	if len(nsec3Set) == 0 || len(soaSet) == 0 {
+		return
+	}
+
+	zone := strings.ToLower(soaSet[0].Header().Name)
+	if strings.ToLower(parentdsrr[0].Header().Name) != zone {
+		return
+	}
+
+	for _, rr := range nsec3Set {
+		if strings.ToLower(upperName(rr.Header().Name)) != zone {
+			return
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.Question = resp.Question
+	msg.Ns = extractRRSet(resp.Ns, "", dns.TypeNSEC3, dns.TypeSOA, dns.TypeRRSIG)
+
+	for _, rr := range extractRRSet(msg.Ns, "", dns.TypeRRSIG) {
+		if sig := rr.(*dns.RRSIG); strings.ToLower(sig.SignerName) != zone {
+			return
+		}
+	}
+
+	ok, err := r.verifyDNSSEC(Net, zone, zone, msg, parentdsrr)
+	if err != nil || !ok {
+		return
+	}
+
+	var nsec, soa []dns.RR
+	for _, rr := range msg.Ns {
+		switch t := rr.(type) {
+		case *dns.NSEC3:
+			nsec = append(nsec, rr)
+		case *dns.SOA:
+			soa = append(soa, rr)
+		case *dns.RRSIG:
+			if t.TypeCovered == dns.TypeNSEC3 {
+				nsec = append(nsec, rr)
+			} else if t.TypeCovered == dns.TypeSOA {
+				soa = append(soa, rr)
+			}
+		}
+	}
+
+	r.NSEC3cache.Set(zone, nsec, soa)
+}
+
+// synthesizeNegative returns a NXDOMAIN or NODATA answer for the request if the
+// cached NSEC3 chain of its closest enclosing zone proves it, otherwise nil.
+func (r *Resolver) synthesizeNegative(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	name := strings.ToLower(q.Name)
+
+	// DS records belongs to the parent zone
+	zone := name
+	if q.Qtype == dns.TypeDS {
+		if zone == rootzone {
+			return nil
+		}
+		zone = upperName(zone)
+	}
+
+	for {
+		if zone == "" {
+			zone = rootzone
+		}
+
+		records, soa := r.NSEC3cache.Get(zone)
+		if len(records) > 0 {
+			nsec3Set := extractRRSet(records, "", dns.TypeNSEC3)
+
+			rcode := dns.RcodeSuccess
+			proof, ok := proveNODATA(name, q.Qtype, nsec3Set)
+			if !ok {
+				rcode = dns.RcodeNameError
+				proof, ok = proveNameError(zone, name, nsec3Set)
+			}
+
+			if !ok {
+				return nil
+			}
+
+			msg := new(dns.Msg)
+			msg.SetRcode(req, rcode)
+			msg.RecursionAvailable = true
+			msg.AuthenticatedData = true
+			msg.Ns = append(msg.Ns, soa...)
+
+			seen := make(map[string]bool)
+			for _, n := range proof {
+				owner := strings.ToLower(n.Header().Name)
+				if seen[owner] {
+					continue
+				}
+				seen[owner] = true
+
+				msg.Ns = append(msg.Ns, n)
+				for _, rr := range extractRRSet(records, owner, dns.TypeRRSIG) {
+					if rr.(*dns.RRSIG).TypeCovered == dns.TypeNSEC3 {
+						msg.Ns = append(msg.Ns, rr)
+					}
+				}
+			}
+
+			opt := req.IsEdns0()
+			if opt != nil {
+				msg.Extra = append(msg.Extra, opt)
+			}
+
+			log.Debug("Negative answer synthesized from NSEC3 cache", "query", formatQuestion(q), "zone", zone, "rcode", dns.RcodeToString[rcode])
+
+			return msg
+		}
+
+		if zone == rootzone {
+			return nil
+		}
+
+		zone = upperName(zone)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	anyRefuse  = "refuse"
+	anyMinimal = "minimal"
+	anyNormal  = "normal"
+)
+
+var anyModes = map[string]bool{
+	anyRefuse:  true,
+	anyMinimal: true,
+	anyNormal:  true,
+}
+
+// anyReply returns the synthesized HINFO answer of the ANY query (RFC 8482
+// section 4.2), the answer is not signed so never marked as validated
+func anyReply(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	msg.RecursionAvailable = true
+	msg.AuthenticatedData = false
+
+	msg.Answer = append(msg.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  q.Qclass,
+			Ttl:    Config().Expire,
+		},
+		Cpu: "RFC8482",
+		Os:  "",
+	})
+
+	return msg
+}
+
+// minimalAny keeps only the first record type of the ANY query name and its
+// signatures in the answer, the records of other names left as is
+func minimalAny(req, msg *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypeANY || Config().AnyQueryMode != anyMinimal {
+		return msg
+	}
+
+	var rrtype uint16
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG && strings.EqualFold(rr.Header().Name, q.Name) {
+			rrtype = rr.Header().Rrtype
+			break
+		}
+	}
+
+	if rrtype == 0 {
+		return msg
+	}
+
+	answer := make([]dns.RR, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		if !strings.EqualFold(rr.Header().Name, q.Name) {
+			answer = append(answer, rr)
+			continue
+		}
+
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == rrtype {
+				answer = append(answer, rr)
+			}
+			continue
+		}
+
+		if rr.Header().Rrtype == rrtype {
+			answer = append(answer, rr)
+		}
+	}
+
+	msg.Answer = answer
+
+	return msg
+}
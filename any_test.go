@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_anyReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeANY)
+
+	msg := anyReply(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.False(t, msg.AuthenticatedData)
+	assert.True(t, msg.RecursionAvailable)
+
+	if assert.Len(t, msg.Answer, 1) {
+		hinfo := msg.Answer[0].(*dns.HINFO)
+		assert.Equal(t, "example.com.", hinfo.Hdr.Name)
+		assert.Equal(t, "RFC8482", hinfo.Cpu)
+		assert.Equal(t, "", hinfo.Os)
+	}
+}
+
+func Test_minimalAny(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.AnyQueryMode = anyMinimal })()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeANY)
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	for _, s := range []string{
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 1 example.com. AAAA",
+		"example.com. 300 IN AAAA 2001:db8::1",
+		"example.com. 300 IN RRSIG AAAA 8 2 300 20300101000000 20200101000000 1 example.com. AAAA",
+		"example.com. 300 IN MX 10 mail.example.com.",
+	} {
+		rr, err := dns.NewRR(s)
+		assert.NoError(t, err)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	answer := msg.Answer
+
+	msg = minimalAny(req, msg)
+	if assert.Len(t, msg.Answer, 3) {
+		assert.Equal(t, dns.TypeA, msg.Answer[0].Header().Rrtype)
+		assert.Equal(t, dns.TypeA, msg.Answer[1].Header().Rrtype)
+		assert.Equal(t, dns.TypeA, msg.Answer[2].(*dns.RRSIG).TypeCovered)
+	}
+
+	// the original answer untouched
+	assert.Len(t, answer, 6)
+
+	req.Question[0].Qtype = dns.TypeA
+	msg.Answer = answer
+	assert.Len(t, minimalAny(req, msg).Answer, 6)
+}
+
+func Test_HandlerAnyQuery(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		for _, s := range []string{" 60 IN TXT \"any\"", " 60 IN A 10.0.0.1", " 60 IN AAAA fd00::1"} {
+			rr, _ := dns.NewRR(req.Question[0].Name + s)
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.corp.internal.", dns.TypeANY)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	defer setConfig(func(cfg *config) { cfg.AnyQueryMode = anyRefuse })()
+
+	resp, status := handler.queryStatus("udp", req.Copy())
+	assert.Equal(t, statusLocal, status)
+	assert.False(t, resp.AuthenticatedData)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, dns.TypeHINFO, resp.Answer[0].Header().Rrtype)
+	}
+	if opt := resp.IsEdns0(); assert.NotNil(t, opt) {
+		assert.True(t, opt.Do())
+	}
+
+	// nothing cached for the refused query
+	_, _, err = handler.r.Qcache.Get(cache.Hash(req.Question[0]), req)
+	assert.Error(t, err)
+
+	defer setConfig(func(cfg *config) { cfg.AnyQueryMode = anyMinimal })()
+
+	resp, status = handler.queryStatus("udp", req.Copy())
+	assert.Equal(t, statusMiss, status)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, dns.TypeTXT, resp.Answer[0].Header().Rrtype)
+	}
+
+	// the cache holds the full answer, minimized on the hit
+	resp, status = handler.queryStatus("udp", req.Copy())
+	assert.Equal(t, statusHit, status)
+	assert.Len(t, resp.Answer, 1)
+
+	defer setConfig(func(cfg *config) { cfg.AnyQueryMode = anyNormal })()
+
+	resp, status = handler.queryStatus("udp", req.Copy())
+	assert.Equal(t, statusHit, status)
+	assert.Len(t, resp.Answer, 3)
+}
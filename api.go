@@ -1,19 +1,31 @@
 package main
 
 import (
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
 	"gopkg.in/gin-contrib/cors.v1"
 )
 
 // API type
 type API struct {
 	host string
+
+	resolver *Resolver
 }
 
 var debugpprof bool
@@ -40,10 +52,559 @@ func removeBlock(c *gin.Context) {
 }
 
 func setBlock(c *gin.Context) {
-	BlockList.Set(dns.Fqdn(c.Param("key")))
+	BlockList.SetManual(dns.Fqdn(c.Param("key")))
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func checkBlock(c *gin.Context) {
+	d := BlockList.Decide(dns.Fqdn(c.Param("key")))
+	c.JSON(http.StatusOK, gin.H{
+		"name":    dns.Fqdn(c.Param("key")),
+		"blocked": d.Blocked,
+		"block":   d.Block,
+		"allow":   d.Allow,
+		"manual":  d.Manual,
+		"runtime": d.Runtime,
+	})
+}
+
+type runtimeBlock struct {
+	Domain string `json:"domain" binding:"required"`
+	TTL    string `json:"ttl"`
+}
+
+func addRuntimeBlock(c *gin.Context) {
+	var b runtimeBlock
+	if err := c.ShouldBindJSON(&b); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ttl time.Duration
+	if b.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(b.TTL); err != nil || ttl < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl invalid: " + b.TTL})
+			return
+		}
+	}
+
+	BlockList.SetRuntime(dns.Fqdn(b.Domain), ttl)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func removeRuntimeBlock(c *gin.Context) {
+	if !BlockList.RemoveRuntime(dns.Fqdn(c.Param("key"))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": c.Param("key") + " not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func listRuntimeBlocks(c *gin.Context) {
+	list := []gin.H{}
+
+	for _, b := range BlockList.Runtime() {
+		entry := gin.H{"domain": b.Name}
+		if !b.Expire.IsZero() {
+			entry["expire"] = b.Expire
+		}
+
+		list = append(list, entry)
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func listBlocklistSources(c *gin.Context) {
+	list := []gin.H{}
+
+	for _, source := range blocklistSources() {
+		state := blocklistSourceState(source.URL)
+
+		entry := gin.H{
+			"url":      source.URL,
+			"format":   source.Format,
+			"failures": state.Failures,
+		}
+
+		if source.Category != "" {
+			entry["category"] = source.Category
+		}
+
+		if !state.LastSuccess.IsZero() {
+			entry["lastsuccess"] = state.LastSuccess
+		}
+
+		if !state.LastAttempt.IsZero() {
+			entry["lastattempt"] = state.LastAttempt
+		}
+
+		if state.Error != "" {
+			entry["error"] = state.Error
+			entry["nextretry"] = state.NextRetry
+		}
+
+		list = append(list, entry)
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// blocklistCategories returns the entries, the blocked queries and the state
+// of the categories of the loaded lists
+func blocklistCategories() []gin.H {
+	list := []gin.H{}
+
+	for _, category := range BlockList.Categories() {
+		list = append(list, gin.H{
+			"name":     category.Name,
+			"entries":  category.Entries,
+			"hits":     stats.categoryHitCount(category.Name),
+			"disabled": category.Disabled,
+		})
+	}
+
+	return list
+}
+
+func listCategories(c *gin.Context) {
+	c.JSON(http.StatusOK, blocklistCategories())
+}
+
+// setCategory disables or enables the blocking of a category of the remote
+// blocklists, the names listed only in the disabled categories allowed
+func setCategory(disable bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		category := strings.ToLower(c.Param("name"))
+		if !blocklistCategory(category) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "category not found: " + category})
+			return
+		}
+
+		if disable {
+			BlockList.DisableCategory(category)
+		} else {
+			BlockList.EnableCategory(category)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+func healthState(c *gin.Context) {
+	state := gin.H{}
+
+	for name, servers := range healthServers() {
+		list := []gin.H{}
+
+		servers.RLock()
+		for _, server := range servers.List {
+			h := server.Health()
+			list = append(list, gin.H{
+				"host":      h.Host,
+				"healthy":   h.Healthy,
+				"rtt":       h.Rtt.String(),
+				"failures":  h.Failures,
+				"lastcheck": h.LastCheck,
+				"nextcheck": h.NextCheck,
+			})
+		}
+		servers.RUnlock()
+
+		state[name] = list
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+func zoneStatus(s cache.ZoneStatus) gin.H {
+	status := gin.H{
+		"zone":    s.Zone,
+		"status":  s.Status,
+		"keys":    s.Keys,
+		"checked": s.Checked,
+		"expire":  s.Expire,
+	}
+
+	if s.Error != "" {
+		status["error"] = s.Error
+	}
+
+	return status
+}
+
+func listDNSSEC(c *gin.Context) {
+	list := []gin.H{}
+
+	for _, s := range TrustList.List() {
+		list = append(list, zoneStatus(s))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mode": Config().DNSSEC, "zones": list})
+}
+
+func getDNSSEC(c *gin.Context) {
+	s, ok := TrustList.Status(dns.Fqdn(c.Param("zone")))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": c.Param("zone") + " not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, zoneStatus(s))
+}
+
+type runtimeNTA struct {
+	Zone string `json:"zone" binding:"required"`
+	TTL  string `json:"ttl"`
+}
+
+func listNTAs(c *gin.Context) {
+	list := []gin.H{}
+
+	for _, n := range NegativeAnchors.List() {
+		entry := gin.H{"zone": n.Zone}
+		if !n.Expire.IsZero() {
+			entry["expire"] = n.Expire
+		}
+
+		list = append(list, entry)
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// addNTA adds a runtime negative trust anchor, the anchors expire after the
+// ttl; an hour without the ttl, a week at most
+func addNTA(c *gin.Context) {
+	var n runtimeNTA
+	if err := c.ShouldBindJSON(&n); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ttl := ntaDefaultTTL
+	if n.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(n.TTL); err != nil || ttl <= 0 || ttl > ntaMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl invalid: " + n.TTL})
+			return
+		}
+	}
+
+	if err := NegativeAnchors.Set(n.Zone, ttl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Info("Negative trust anchor added", "zone", dns.Fqdn(strings.ToLower(n.Zone)), "ttl", ttl.String())
+
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+func removeNTA(c *gin.Context) {
+	if !NegativeAnchors.Remove(c.Param("zone")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": c.Param("zone") + " not found"})
+		return
+	}
+
+	log.Info("Negative trust anchor removed", "zone", dns.Fqdn(strings.ToLower(c.Param("zone"))))
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func recordStrings(rrs []dns.RR) []string {
+	list := []string{}
+	for _, rr := range rrs {
+		list = append(list, rr.String())
+	}
+
+	return list
+}
+
+// getCache returns the cached entry of the name and type, the entries of the
+// client subnets and the upstream groups not looked up
+func (a *API) getCache(c *gin.Context) {
+	name := dns.Fqdn(c.Param("name"))
+
+	qtype, ok := dns.StringToType[strings.ToUpper(c.Param("type"))]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type unknown: " + c.Param("type")})
+		return
+	}
+
+	q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+
+	for _, cd := range []bool{false, true} {
+		key := cache.Hash(q, cd)
+
+		status := "positive"
+
+		e, ok := a.resolver.Qcache.Peek(key)
+		if ok && e.Stale {
+			status = "stale"
+		} else if !ok {
+			if e, ok = a.resolver.Negcache.Peek(key); !ok {
+				continue
+			}
+
+			status = "negative"
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"name":   name,
+			"type":   dns.TypeToString[qtype],
+			"cd":     cd,
+			"status": status,
+			"rcode":  dns.RcodeToString[e.Rcode],
+			"ttl":    e.TTL,
+			"answer": recordStrings(e.Answer),
+			"ns":     recordStrings(e.Ns),
+		})
+
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": name + " " + dns.TypeToString[qtype] + " not found"})
+}
+
+// purgeCache removes the cached entries of all types of the name
+func (a *API) purgeCache(c *gin.Context) {
+	name := dns.Fqdn(c.Param("name"))
+
+	removed := a.resolver.Qcache.PurgeName(name) + a.resolver.Negcache.PurgeName(name)
+
+	// the error cache has no names, removed by the keys of the types
+	for qtype := range dns.TypeToString {
+		q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+
+		a.resolver.Ecache.Remove(cache.Hash(q))
+		a.resolver.Ecache.Remove(cache.Hash(q, true))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "removed": removed})
+}
+
+// flushCache removes all cached entries
+func (a *API) flushCache(c *gin.Context) {
+	a.resolver.Qcache.Flush()
+	a.resolver.Negcache.Flush()
+	a.resolver.Ecache.Flush()
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// streamQueryLogs sends the client queries as server-sent events
+func streamQueryLogs(c *gin.Context) {
+	r := queryLogs.subscribe()
+	if r == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many query log readers"})
+		return
+	}
+	defer queryLogs.unsubscribe(r)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+
+	// the headers sent before the first query
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case l := <-r.ch:
+			c.SSEvent("query", l)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// getStats returns the snapshot of the counters since the start, lighter
+// than the metrics for a quick look
+func (a *API) getStats(c *gin.Context) {
+	now := time.Now()
+
+	queries := atomic.LoadInt64(&stats.queries)
+	hits := atomic.LoadInt64(&stats.cacheHits)
+	misses := atomic.LoadInt64(&stats.cacheMisses)
+	blocked := atomic.LoadInt64(&stats.blockHits)
+
+	entries := 0
+	var bytes int64
+	if a.resolver != nil {
+		entries = a.resolver.Qcache.Len() + a.resolver.Negcache.Len()
+		bytes = a.resolver.Qcache.Bytes() + a.resolver.Negcache.Bytes()
+	}
+
+	upstreams := []gin.H{}
+	for _, u := range stats.upstreamList() {
+		upstreams = append(upstreams, gin.H{
+			"server":  u.Server,
+			"queries": u.Queries,
+			"avgrtt":  u.AvgRtt.Round(time.Microsecond).String(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version":       Version,
+		"configversion": Config().Version,
+		"uptime":        now.Sub(stats.start).Round(time.Second).String(),
+		"queries":       queries,
+		"qps":           stats.qps(now),
+		"cache": gin.H{
+			"entries":  entries,
+			"bytes":    bytes,
+			"maxbytes": Config().CacheMaxBytes,
+			"hits":     hits,
+			"misses":   misses,
+			"hitratio": ratio(hits, hits+misses),
+		},
+		"blocklist": gin.H{
+			"entries":    BlockList.Size(),
+			"hits":       blocked,
+			"blockratio": ratio(blocked, queries),
+			"categories": blocklistCategories(),
+		},
+		"upstreams": upstreams,
+		"dnssec": gin.H{
+			"secure": atomic.LoadInt64(&stats.dnssecSecure),
+			"failed": atomic.LoadInt64(&stats.dnssecFailed),
+		},
+		"concurrency": gin.H{
+			"inflight": atomic.LoadInt64(&stats.inflight),
+			"limit":    Config().MaxConcurrentQueries,
+			"refused":  atomic.LoadInt64(&stats.overloaded),
+		},
+		"prewarm": gin.H{
+			"entries":   atomic.LoadInt64(&stats.prewarmEntries),
+			"succeeded": atomic.LoadInt64(&stats.prewarmSucceeded),
+			"failed":    atomic.LoadInt64(&stats.prewarmFailed),
+		},
+	})
+}
+
+// privateAPIAddr reports whether the API bound to a loopback or a private
+// address, the unspecified addresses listen on all the networks
+func privateAPIAddr(host string) bool {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+
+	if h == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(h)
+	if ip == nil || ip.IsUnspecified() {
+		return false
+	}
+
+	return isPrivateIP(ip)
+}
+
+// privateClient reports whether the client allowed to the private endpoints;
+// all the clients of the API bound to a private address, only the clients
+// from the private networks otherwise
+func (a *API) privateClient(c *gin.Context) bool {
+	if privateAPIAddr(a.host) {
+		return true
+	}
+
+	h, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+	ip := net.ParseIP(h)
+
+	return ip != nil && !ip.IsUnspecified() && isPrivateIP(ip)
+}
+
+// getInfo returns the build and the runtime info, the runtime values read at
+// every request. Readable only by the private clients.
+func (a *API) getInfo(c *gin.Context) {
+	if !a.privateClient(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "info only readable from the private networks"})
+		return
+	}
+
+	configPath, err := filepath.Abs(*ConfigPath)
+	if err != nil {
+		configPath = *ConfigPath
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version":       Version,
+		"configversion": Config().Version,
+		"goversion":     runtime.Version(),
+		"os":            runtime.GOOS,
+		"arch":          runtime.GOARCH,
+		"gomaxprocs":    runtime.GOMAXPROCS(0),
+		"goroutines":    runtime.NumGoroutine(),
+		"uptime":        time.Since(stats.start).Round(time.Second).String(),
+		"configpath":    configPath,
+	})
+}
+
+// getTrace resolves the name from the root servers and returns every step of
+// the resolution; the upstream queries, the referrals, the cache hits and the
+// DNSSEC validations with the timings. The trace runs on its own caches
+// unless cache=true given. Allowed only to the private clients.
+func (a *API) getTrace(c *gin.Context) {
+	if !a.privateClient(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "trace only allowed from the private networks"})
+		return
+	}
+
+	name := c.Query("name")
+	if _, ok := dns.IsDomainName(name); name == "" || !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name invalid: " + name})
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := c.Query("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "type unknown: " + t})
+			return
+		}
+	}
+
+	shared := false
+	if v := c.Query("cache"); v != "" {
+		var err error
+		if shared, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cache invalid: " + v})
+			return
+		}
+	}
+
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+
+	start := time.Now()
+	resp, trace, err := traceResolve(a.resolver, q, shared)
+
+	result := gin.H{
+		"name":        q.Name,
+		"type":        dns.TypeToString[qtype],
+		"cache":       shared,
+		"duration_ms": milliseconds(time.Since(start)),
+		"steps":       trace.steps(),
+	}
+
+	if err != nil {
+		result["error"] = err.Error()
+	} else {
+		result["rcode"] = dns.RcodeToString[resp.Rcode]
+		result["secure"] = resp.AuthenticatedData
+		result["answer"] = recordStrings(resp.Answer)
+		result["ns"] = recordStrings(resp.Ns)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
 // Run API server
 func (a *API) Run() {
 	if a.host == "" {
@@ -65,8 +626,51 @@ func (a *API) Run() {
 		block.GET("/get/:key", getBlock)
 		block.GET("/remove/:key", removeBlock)
 		block.GET("/set/:key", setBlock)
+		block.GET("/check/:key", checkBlock)
+
+		block.GET("/sources", listBlocklistSources)
+
+		block.GET("", listRuntimeBlocks)
+		block.POST("", addRuntimeBlock)
+		block.DELETE("/:key", removeRuntimeBlock)
+	}
+
+	categories := r.Group("/api/v1/categories")
+	{
+		categories.GET("", listCategories)
+		categories.POST("/:name/disable", setCategory(true))
+		categories.POST("/:name/enable", setCategory(false))
+	}
+
+	r.GET("/api/v1/health", healthState)
+
+	r.GET("/api/v1/dnssec", listDNSSEC)
+	r.GET("/api/v1/dnssec/:zone", getDNSSEC)
+
+	nta := r.Group("/api/v1/nta")
+	{
+		nta.GET("", listNTAs)
+		nta.POST("", addNTA)
+		nta.DELETE("/:zone", removeNTA)
 	}
 
+	r.GET("/api/v1/log/stream", streamQueryLogs)
+
+	if a.resolver != nil {
+		entries := r.Group("/api/v1/cache")
+		{
+			entries.GET("/:name/:type", a.getCache)
+			entries.DELETE("/:name", a.purgeCache)
+			entries.DELETE("", a.flushCache)
+		}
+
+		r.GET("/trace", a.getTrace)
+	}
+
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/stats", a.getStats)
+	r.GET("/version", a.getInfo)
+
 	go func() {
 		if err := r.Run(a.host); err != nil {
 			log.Crit("Start API server failed", "error", err.Error())
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_AllAPICalls(t *testing.T) {
@@ -19,7 +29,10 @@ func Test_AllAPICalls(t *testing.T) {
 		{"GET", "/api/v1/block/get/test.com", http.StatusOK},
 		{"GET", "/api/v1/block/get/test2.com", http.StatusOK},
 		{"GET", "/api/v1/block/exists/test.com", http.StatusOK},
+		{"GET", "/api/v1/block/check/test.com", http.StatusOK},
 		{"GET", "/api/v1/block/remove/test.com", http.StatusOK},
+		{"GET", "/api/v1/health", http.StatusOK},
+		{"GET", "/metrics", http.StatusOK},
 	}
 
 	w := httptest.NewRecorder()
@@ -38,3 +51,263 @@ func Test_AllAPICalls(t *testing.T) {
 		}
 	}
 }
+
+func Test_RuntimeBlockAPI(t *testing.T) {
+	routes := []struct {
+		Method         string
+		ReqURL         string
+		Body           string
+		ExpectedStatus int
+	}{
+		{"POST", "/api/v1/block", `{"domain":"runtime.example.com","ttl":"1h"}`, http.StatusOK},
+		{"POST", "/api/v1/block", `{"domain":"forever.example.com"}`, http.StatusOK},
+		{"POST", "/api/v1/block", `{"domain":"runtime.example.com","ttl":"soon"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/block", `{"ttl":"1h"}`, http.StatusBadRequest},
+		{"GET", "/api/v1/block", "", http.StatusOK},
+		{"DELETE", "/api/v1/block/runtime.example.com", "", http.StatusOK},
+		{"DELETE", "/api/v1/block/runtime.example.com", "", http.StatusNotFound},
+		{"DELETE", "/api/v1/block/forever.example.com", "", http.StatusOK},
+	}
+
+	for _, r := range routes {
+		request, err := http.NewRequest(r.Method, r.ReqURL, strings.NewReader(r.Body))
+		if err != nil {
+			t.Fatalf("couldn't create request: %v\n", err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ginr.ServeHTTP(w, request)
+
+		if w.Code != r.ExpectedStatus {
+			t.Fatalf("not expected status code: %d %s %s", w.Code, r.Method, r.ReqURL)
+		}
+
+		if r.Method == "GET" {
+			assert.Contains(t, w.Body.String(), `"domain":"forever.example.com."`)
+			assert.True(t, BlockList.Blocked("runtime.example.com."))
+		}
+	}
+
+	assert.False(t, BlockList.Blocked("runtime.example.com."))
+}
+
+func Test_NTAAPI(t *testing.T) {
+	defer NegativeAnchors.Remove("nta.example.com.")
+
+	routes := []struct {
+		Method         string
+		ReqURL         string
+		Body           string
+		ExpectedStatus int
+	}{
+		{"POST", "/api/v1/nta", `{"zone":"nta.example.com","ttl":"30m"}`, http.StatusOK},
+		{"POST", "/api/v1/nta", `{"zone":"nta.example.com","ttl":"336h"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/nta", `{"zone":"nta.example.com","ttl":"-1h"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/nta", `{"zone":"."}`, http.StatusBadRequest},
+		{"POST", "/api/v1/nta", `{"ttl":"1h"}`, http.StatusBadRequest},
+		{"GET", "/api/v1/nta", "", http.StatusOK},
+		{"DELETE", "/api/v1/nta/nta.example.com", "", http.StatusOK},
+		{"DELETE", "/api/v1/nta/nta.example.com", "", http.StatusNotFound},
+	}
+
+	for _, r := range routes {
+		request, err := http.NewRequest(r.Method, r.ReqURL, strings.NewReader(r.Body))
+		if err != nil {
+			t.Fatalf("couldn't create request: %v\n", err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		ginr.ServeHTTP(w, request)
+
+		if w.Code != r.ExpectedStatus {
+			t.Fatalf("not expected status code: %d %s %s %s", w.Code, r.Method, r.ReqURL, r.Body)
+		}
+
+		if r.Method == "GET" {
+			assert.Contains(t, w.Body.String(), `"zone":"nta.example.com."`)
+			assert.Contains(t, w.Body.String(), `"expire"`)
+		}
+	}
+
+	_, ok := NegativeAnchors.Covers("www.nta.example.com.")
+	assert.False(t, ok)
+}
+
+func Test_CacheAPI(t *testing.T) {
+	api := &API{resolver: &Resolver{
+		Qcache:   cache.NewQueryCache(1024, 0, 0),
+		Negcache: cache.NewNegativeCache(1024),
+		Ecache:   cache.NewErrorCache(1024, 10),
+	}}
+
+	r := gin.New()
+	r.GET("/api/v1/cache/:name/:type", api.getCache)
+	r.DELETE("/api/v1/cache/:name", api.purgeCache)
+	r.DELETE("/api/v1/cache", api.flushCache)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	api.resolver.Qcache.Set(cache.Hash(m.Question[0]), m)
+
+	nx := new(dns.Msg)
+	nx.SetQuestion("nx.example.com.", dns.TypeAAAA)
+	nx.Rcode = dns.RcodeNameError
+	api.resolver.Negcache.Set(cache.Hash(nx.Question[0]), nx, 60)
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		request, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+
+		r.ServeHTTP(w, request)
+
+		return w
+	}
+
+	var entry struct {
+		Status string
+		Rcode  string
+		TTL    uint32
+		Answer []string
+	}
+
+	w := serve("GET", "/api/v1/cache/www.example.com/a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, "positive", entry.Status)
+	assert.Equal(t, "NOERROR", entry.Rcode)
+	assert.True(t, entry.TTL > 0 && entry.TTL <= 300)
+	assert.Len(t, entry.Answer, 1)
+
+	w = serve("GET", "/api/v1/cache/nx.example.com/AAAA")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, "negative", entry.Status)
+	assert.Equal(t, "NXDOMAIN", entry.Rcode)
+
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/v1/cache/www.example.com/MX").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("GET", "/api/v1/cache/www.example.com/NOTYPE").Code)
+
+	w = serve("DELETE", "/api/v1/cache/www.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"removed":1`)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/v1/cache/www.example.com/A").Code)
+
+	assert.Equal(t, http.StatusOK, serve("DELETE", "/api/v1/cache").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/v1/cache/nx.example.com/AAAA").Code)
+}
+
+func Test_StatsAPI(t *testing.T) {
+	api := &API{resolver: &Resolver{
+		Qcache:   cache.NewQueryCache(1024, 0, 0),
+		Negcache: cache.NewNegativeCache(1024),
+	}}
+
+	r := gin.New()
+	r.GET("/stats", api.getStats)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	api.resolver.Qcache.Set(cache.Hash(m.Question[0]), m)
+
+	stats.upstream("192.0.2.53:53", 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/stats", nil)
+	assert.NoError(t, err)
+	r.ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var snapshot struct {
+		Version       string
+		ConfigVersion string
+		Uptime        string
+		Queries       int64
+		Cache         struct {
+			Entries int
+		}
+		Upstreams []struct {
+			Server  string
+			Queries int64
+			AvgRtt  string
+		}
+	}
+
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.Equal(t, Version, snapshot.Version)
+	assert.Equal(t, Config().Version, snapshot.ConfigVersion)
+	assert.Equal(t, 1, snapshot.Cache.Entries)
+
+	found := false
+	for _, u := range snapshot.Upstreams {
+		if u.Server == "192.0.2.53:53" {
+			found = true
+			assert.True(t, u.Queries >= 1)
+		}
+	}
+	assert.True(t, found)
+}
+
+func Test_InfoAPI(t *testing.T) {
+	serve := func(host, remote string) *httptest.ResponseRecorder {
+		api := &API{host: host}
+
+		r := gin.New()
+		r.GET("/version", api.getInfo)
+
+		w := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/version", nil)
+		assert.NoError(t, err)
+		request.RemoteAddr = remote
+		r.ServeHTTP(w, request)
+
+		return w
+	}
+
+	w := serve("127.0.0.1:8080", "192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var info struct {
+		Version       string
+		ConfigVersion string
+		GoVersion     string
+		OS            string
+		Arch          string
+		GOMAXPROCS    int
+		Goroutines    int
+		Uptime        string
+		ConfigPath    string
+	}
+
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, Version, info.Version)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, runtime.GOOS, info.OS)
+	assert.Equal(t, runtime.GOARCH, info.Arch)
+	assert.Equal(t, runtime.GOMAXPROCS(0), info.GOMAXPROCS)
+	assert.True(t, info.Goroutines > 0)
+	assert.True(t, filepath.IsAbs(info.ConfigPath))
+
+	// the public bound API only answers the private clients
+	assert.Equal(t, http.StatusForbidden, serve("0.0.0.0:8080", "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusForbidden, serve(":8080", "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusOK, serve("0.0.0.0:8080", "10.1.2.3:1234").Code)
+	assert.Equal(t, http.StatusOK, serve("[::]:8080", "[::1]:1234").Code)
+}
+
+func Test_privateAPIAddr(t *testing.T) {
+	assert.True(t, privateAPIAddr("127.0.0.1:8080"))
+	assert.True(t, privateAPIAddr("localhost:8080"))
+	assert.True(t, privateAPIAddr("192.168.1.1:8080"))
+	assert.True(t, privateAPIAddr("[::1]:8080"))
+	assert.False(t, privateAPIAddr(":8080"))
+	assert.False(t, privateAPIAddr("0.0.0.0:8080"))
+	assert.False(t, privateAPIAddr("198.51.100.1:8080"))
+	assert.False(t, privateAPIAddr("8080"))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	archiveNone = iota
+	archiveGzip
+	archiveZip
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+
+	errArchiveMembers = errors.New("zip archive must have a single member")
+)
+
+// archiveType returns the archive type of the file by the magic bytes, or by
+// the extension of the files without them
+func archiveType(file *os.File) (int, error) {
+	magic := make([]byte, len(zipMagic))
+
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return archiveNone, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return archiveNone, err
+	}
+
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return archiveGzip, nil
+	case bytes.HasPrefix(magic, zipMagic):
+		return archiveZip, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(file.Name())) {
+	case ".gz":
+		return archiveGzip, nil
+	case ".zip":
+		return archiveZip, nil
+	}
+
+	return archiveNone, nil
+}
+
+// archiveReader closes the decompressed member and the archive file
+type archiveReader struct {
+	io.Reader
+
+	closers []io.Closer
+}
+
+func (r *archiveReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// openBlocklist opens the blocklist file, the gzip and the single member zip
+// archives decompressed while reading without buffering the whole file.
+// Archived reports whether the file is an archive.
+func openBlocklist(path string) (rc io.ReadCloser, archived bool, err error) {
+	file, err := os.Open(filepath.FromSlash(path))
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening file: %s", err)
+	}
+
+	kind, err := archiveType(file)
+	if err != nil {
+		file.Close()
+		return nil, false, fmt.Errorf("error reading file: %s", err)
+	}
+
+	switch kind {
+	case archiveGzip:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, true, fmt.Errorf("error reading gzip archive: %s", err)
+		}
+
+		return &archiveReader{Reader: gz, closers: []io.Closer{gz, file}}, true, nil
+	case archiveZip:
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, true, fmt.Errorf("error reading file: %s", err)
+		}
+
+		zr, err := zip.NewReader(file, fi.Size())
+		if err != nil {
+			file.Close()
+			return nil, true, fmt.Errorf("error reading zip archive: %s", err)
+		}
+
+		var member *zip.File
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+
+			if member != nil {
+				file.Close()
+				return nil, true, errArchiveMembers
+			}
+			member = f
+		}
+
+		if member == nil {
+			file.Close()
+			return nil, true, errArchiveMembers
+		}
+
+		mr, err := member.Open()
+		if err != nil {
+			file.Close()
+			return nil, true, fmt.Errorf("error reading zip archive: %s", err)
+		}
+
+		return &archiveReader{Reader: mr, closers: []io.Closer{mr, file}}, true, nil
+	}
+
+	return file, false, nil
+}
+
+// verifyBlocklist reads the blocklist file through, the archives decompressed
+// to the end for the checksums
+func verifyBlocklist(path string) error {
+	rc, _, err := openBlocklist(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return scanHostFile(rc, func(string) {})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func zipData(t *testing.T, members map[string][]byte) []byte {
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+	for name, data := range members {
+		w, err := zw.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func Test_readBlocklistsArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	broken := gzipData(t, []byte("0.0.0.0 broken.example.com\n"))
+	broken[len(broken)-5]++ // the checksum mismatch
+
+	files := map[string][]byte{
+		"a.list.gz": gzipData(t, []byte("0.0.0.0 gzip.example.com\n")),
+		"b.list.zip": zipData(t, map[string][]byte{
+			"hosts": []byte("0.0.0.0 zip.example.com\n"),
+		}),
+		// the magic bytes detected without the extension
+		"c.list":     gzipData(t, []byte("0.0.0.0 magic.example.com\n")),
+		"d.list.gz":  broken,
+		"e.list.gz":  []byte("0.0.0.0 notgzip.example.com\n"),
+		"f.list.zip": zipData(t, map[string][]byte{"one": []byte("one.example.com\n"), "two": []byte("two.example.com\n")}),
+		"g.list":     []byte("0.0.0.0 plain.example.com\n"),
+	}
+
+	for name, data := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+
+	defer setConfig(func(cfg *config) {
+		cfg.BlockListURLs = nil
+		cfg.BlockLists = nil
+	})()
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	// the malformed archives skipped, the others loaded
+	assert.NoError(t, readBlocklists(dir))
+
+	assert.True(t, BlockList.Blocked("gzip.example.com."))
+	assert.True(t, BlockList.Blocked("zip.example.com."))
+	assert.True(t, BlockList.Blocked("magic.example.com."))
+	assert.True(t, BlockList.Blocked("plain.example.com."))
+	assert.False(t, BlockList.Blocked("broken.example.com."))
+	assert.False(t, BlockList.Blocked("notgzip.example.com."))
+	assert.False(t, BlockList.Blocked("one.example.com."))
+	assert.Equal(t, 4, BlockList.Size())
+}
+
+func Test_openBlocklistStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const size = 32 << 20
+
+	path := filepath.Join(dir, "large.gz")
+
+	file, err := os.Create(path)
+	assert.NoError(t, err)
+
+	zw := gzip.NewWriter(file)
+	line := []byte("# a comment line of the large blocklist\n")
+	for n := 0; n < size; n += len(line) {
+		zw.Write(line)
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, file.Close())
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	rc, archived, err := openBlocklist(path)
+	assert.NoError(t, err)
+	assert.True(t, archived)
+
+	n, err := io.Copy(ioutil.Discard, rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.True(t, n >= size)
+
+	runtime.ReadMemStats(&after)
+
+	// the archive decompressed in the stream, not buffered
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < size/8, after.TotalAlloc-before.TotalAlloc)
+}
+
+func Test_downloadBlocklistArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := gzipData(t, []byte("0.0.0.0 archived.example.com\n"))
+
+	var body atomic.Value
+	body.Store(data)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	name := blocklistFile(srv.URL)
+
+	changed, err := downloadBlocklist(srv.URL, dir, name)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	// the malformed archive download keeps the last good copy
+	body.Store(data[:len(data)/2])
+
+	changed, err = downloadBlocklist(srv.URL, dir, name)
+	assert.Error(t, err)
+	assert.False(t, changed)
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	assert.NoError(t, readBlocklists(dir))
+	assert.True(t, BlockList.Blocked("archived.example.com."))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// block response modes
+const (
+	blockNXDomain = "nxdomain"
+	blockZeroIP   = "zeroip"
+	blockRefused  = "refused"
+	blockNoData   = "nodata"
+)
+
+var blockResponses = map[string]bool{
+	blockNXDomain: true,
+	blockZeroIP:   true,
+	blockRefused:  true,
+	blockNoData:   true,
+}
+
+// blockResponse returns the synthesized response for a blocked query by the
+// block response mode, synthesized responses are never marked as validated.
+// The zeroip mode answers with the sinkhole addresses and the short sinkhole
+// TTL if a sinkhole set, no data for the family without one.
+func blockResponse(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	cfg := Config()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	m.AuthenticatedData = false
+	m.Authoritative = false
+	m.RecursionAvailable = true
+
+	switch cfg.BlockResponse {
+	case blockNXDomain:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, blockSOA(q.Name, cfg.BlockTTL))
+	case blockRefused:
+		m.Rcode = dns.RcodeRefused
+	case blockNoData:
+		m.Ns = append(m.Ns, blockSOA(q.Name, cfg.BlockTTL))
+	default:
+		if sinkholeEnabled() {
+			if rr := sinkholeRR(q.Name, q.Qtype, cfg.SinkholeTTL); rr != nil {
+				m.Answer = append(m.Answer, rr)
+			} else {
+				m.Ns = append(m.Ns, blockSOA(q.Name, cfg.SinkholeTTL))
+			}
+
+			break
+		}
+
+		rrHeader := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    cfg.BlockTTL,
+		}
+
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: net.ParseIP(cfg.Nullroute)})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: net.ParseIP(cfg.Nullroutev6)})
+		default:
+			m.Ns = append(m.Ns, blockSOA(q.Name, cfg.BlockTTL))
+		}
+	}
+
+	return m
+}
+
+func blockSOA(name string, ttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_blockResponse(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.BlockTTL = 60
+		cfg.BlockResponse = blockZeroIP
+	})()
+
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.example.com.", dns.TypeA)
+
+	m := blockResponse(req)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 1)
+	assert.Equal(t, "0.0.0.0", m.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+
+	req.SetQuestion("blocked.example.com.", dns.TypeAAAA)
+	m = blockResponse(req)
+	assert.Len(t, m.Answer, 1)
+	assert.Equal(t, "::", m.Answer[0].(*dns.AAAA).AAAA.String())
+
+	req.SetQuestion("blocked.example.com.", dns.TypeMX)
+	m = blockResponse(req)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 0)
+	assert.Len(t, m.Ns, 1)
+
+	req.SetQuestion("blocked.example.com.", dns.TypeA)
+
+	defer setConfig(func(cfg *config) { cfg.BlockResponse = blockNXDomain })()
+	m = blockResponse(req)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	assert.Len(t, m.Answer, 0)
+	assert.Equal(t, dns.TypeSOA, m.Ns[0].Header().Rrtype)
+
+	defer setConfig(func(cfg *config) { cfg.BlockResponse = blockRefused })()
+	m = blockResponse(req)
+	assert.Equal(t, dns.RcodeRefused, m.Rcode)
+	assert.Len(t, m.Ns, 0)
+
+	defer setConfig(func(cfg *config) { cfg.BlockResponse = blockNoData })()
+	m = blockResponse(req)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Len(t, m.Answer, 0)
+	assert.Equal(t, uint32(60), m.Ns[0].(*dns.SOA).Minttl)
+}
+
+func Test_HandlerBlocked(t *testing.T) {
+	BlockList.Set("blocked.example.com.")
+	defer BlockList.Remove("blocked.example.com.")
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+	req.SetEdns0(DefaultMsgSize, true)
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+	assert.False(t, resp.AuthenticatedData)
+	assert.True(t, resp.IsEdns0().Do())
+}
+
+func Test_readAllowlists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_allowlist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := "# allowed domains\nallowed.example.com\n0.0.0.0 hosts.example.com\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "allow.txt"), []byte(data), 0644))
+
+	BlockList.Set("ads.allowed.example.com.")
+	BlockList.Set("hosts.example.com.")
+	defer BlockList.Remove("ads.allowed.example.com.")
+	defer BlockList.Remove("hosts.example.com.")
+
+	assert.NoError(t, readAllowlists(dir))
+	defer BlockList.RemoveAllow("allowed.example.com.")
+	defer BlockList.RemoveAllow("hosts.example.com.")
+
+	assert.False(t, BlockList.Blocked("ads.allowed.example.com."))
+	assert.False(t, BlockList.Blocked("hosts.example.com."))
+
+	assert.NoError(t, readAllowlists(""))
+}
+
+func Test_readBlocklistsWildcardRegexp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := "*.wildcard.example.com\n/^ads[0-9]+\\.regexp\\.example\\.com$/\n/([a-z/\n0.0.0.0 exact.example.com\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "block.txt"), []byte(data), 0644))
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	assert.NoError(t, readBlocklists(dir))
+
+	assert.Equal(t, 1, BlockList.Length())
+	assert.Equal(t, 1, BlockList.WildcardLength())
+	assert.Equal(t, 1, BlockList.RegexpLength())
+
+	assert.True(t, BlockList.Blocked("exact.example.com."))
+	assert.True(t, BlockList.Blocked("a.b.wildcard.example.com."))
+	assert.False(t, BlockList.Blocked("wildcard.example.com."))
+	assert.True(t, BlockList.Blocked("ads1.regexp.example.com."))
+	assert.False(t, BlockList.Blocked("ads.regexp.example.com."))
+}
+
+func Test_downloadBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var fail, gets int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&gets, 1)
+
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("first.example.com\nsecond.example.com\n"))
+	}))
+	defer srv.Close()
+
+	name := blocklistFile(srv.URL)
+	assert.Equal(t, name, blocklistFile(srv.URL))
+
+	changed, err := downloadBlocklist(srv.URL, dir, name)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	changed, err = downloadBlocklist(srv.URL, dir, name)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	atomic.StoreInt32(&fail, 1)
+
+	changed, err = downloadBlocklist(srv.URL, dir, name)
+	assert.Error(t, err)
+	assert.False(t, changed)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	assert.NoError(t, err)
+	assert.Equal(t, "first.example.com\nsecond.example.com\n", string(data))
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	BlockList.SetManual("manual.example.com.")
+	BlockList.Set("stale.example.com.")
+
+	assert.NoError(t, readBlocklists(dir))
+	assert.True(t, BlockList.Blocked("first.example.com."))
+	assert.True(t, BlockList.Blocked("manual.example.com."))
+	assert.False(t, BlockList.Blocked("stale.example.com."))
+
+	assert.Error(t, readBlocklists(filepath.Join(dir, name, "missing")))
+	assert.True(t, BlockList.Blocked("second.example.com."))
+}
+
+func Test_fetchBlocklistRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(min time.Duration) {
+		blocklistRetryMin = min
+	}(blocklistRetryMin)
+
+	blocklistRetryMin = 50 * time.Millisecond
+
+	var state int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.LoadInt32(&state) {
+		case 0:
+			w.Write([]byte("first.retry.example.com\n"))
+		case 1:
+			// unreadable, the line longer than the scanner buffer
+			w.Write([]byte(strings.Repeat("a", 70000) + "\n"))
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("second.retry.example.com\n"))
+		}
+	}))
+	defer srv.Close()
+
+	defer setConfig(func(cfg *config) {
+		cfg.BlockListURLs = []blocklistSource{{URL: srv.URL, Format: blocklistDomains}}
+	})()
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	name := blocklistFile(srv.URL)
+
+	changed, err := fetchSource(srv.URL, dir, name)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, readBlocklists(dir))
+	assert.True(t, BlockList.Blocked("first.retry.example.com."))
+
+	success := blocklistSourceState(srv.URL).LastSuccess
+	assert.False(t, success.IsZero())
+
+	// the failed downloads keep the last good copy
+	for _, s := range []int32{1, 2} {
+		atomic.StoreInt32(&state, s)
+
+		_, err = fetchSource(srv.URL, dir, name)
+		assert.Error(t, err)
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, "first.retry.example.com\n", string(data))
+	}
+
+	st := blocklistSourceState(srv.URL)
+	assert.Equal(t, 2, st.Failures)
+	assert.Equal(t, success, st.LastSuccess)
+	assert.NotEmpty(t, st.Error)
+	assert.True(t, st.NextRetry.After(st.LastAttempt))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/block/sources", nil)
+	ginr.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"failures":2`)
+	assert.Contains(t, w.Body.String(), `"lastsuccess"`)
+
+	// the background retry reloads the lists once the source recovered
+	atomic.StoreInt32(&state, 3)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !BlockList.Blocked("second.retry.example.com.") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the reload of the retry finished
+	blocklistLoadMu.Lock()
+	blocklistLoadMu.Unlock()
+
+	assert.True(t, BlockList.Blocked("second.retry.example.com."))
+	assert.False(t, BlockList.Blocked("first.retry.example.com."))
+	assert.Equal(t, 0, blocklistSourceState(srv.URL).Failures)
+
+	assert.Equal(t, 100*time.Millisecond, blocklistRetryDelay(2))
+	assert.Equal(t, blocklistRetryMax, blocklistRetryDelay(100))
+}
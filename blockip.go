@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/yl2chen/cidranger"
+)
+
+var (
+	// BlockIPRanges are the networks the answers blocked with, nil if none
+	BlockIPRanges   cidranger.Ranger
+	blockIPRangesMu sync.RWMutex
+)
+
+// newBlockIPRanges returns a ranger of the blocked networks, nil for no networks
+func newBlockIPRanges(cidrs []string) (cidranger.Ranger, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	ranger := cidranger.NewPCTrieRanger()
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("block ip range parse cidr failed: %s", err)
+		}
+
+		if err := ranger.Insert(cidranger.NewBasicRangerEntry(*ipnet)); err != nil {
+			return nil, fmt.Errorf("block ip range insert cidr failed: %s", err)
+		}
+	}
+
+	return ranger, nil
+}
+
+// blockedAddress returns the first address of the answer in the blocked
+// networks, nil if none. The allowed and the whitelisted names not blocked.
+func blockedAddress(req, msg *dns.Msg) net.IP {
+	blockIPRangesMu.RLock()
+	ranger := BlockIPRanges
+	blockIPRangesMu.RUnlock()
+
+	if ranger == nil || msg == nil {
+		return nil
+	}
+
+	name := strings.ToLower(req.Question[0].Name)
+	if whitelist[name] || BlockList.Decide(name).Allow != "" {
+		return nil
+	}
+
+	for _, rr := range msg.Answer {
+		var ip net.IP
+
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		if ok, err := ranger.Contains(ip); err == nil && ok {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// blockAddressReply returns the block response of the query which answer
+// resolved into a blocked network
+func blockAddressReply(req *dns.Msg, ip net.IP, opt *dns.OPT, dsReq bool) *dns.Msg {
+	metrics.BlockHits.Inc()
+	atomic.AddInt64(&stats.blockHits, 1)
+
+	log.Debug("Answer address in blocked ip range", "query", formatQuestion(req.Question[0]), "addr", ip.String())
+
+	msg := blockResponse(req)
+
+	opt.SetDo(dsReq)
+	msg.Extra = append(msg.Extra, opt)
+
+	return setExtendedError(msg, edeBlocked, "")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newBlockIPRanges(t *testing.T) {
+	ranger, err := newBlockIPRanges(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, ranger)
+
+	_, err = newBlockIPRanges([]string{"192.0.2.0/33"})
+	assert.Error(t, err)
+
+	ranger, err = newBlockIPRanges([]string{"192.0.2.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+
+	ok, err := ranger.Contains(net.ParseIP("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func Test_blockedAddress(t *testing.T) {
+	ranger, err := newBlockIPRanges([]string{"192.0.2.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+
+	blockIPRangesMu.Lock()
+	BlockIPRanges = ranger
+	blockIPRangesMu.Unlock()
+
+	defer func() {
+		blockIPRangesMu.Lock()
+		BlockIPRanges = nil
+		blockIPRangesMu.Unlock()
+	}()
+
+	reply := func(name string, qtype uint16, records ...string) (*dns.Msg, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = newRRs(records...)
+
+		return req, m
+	}
+
+	req, m := reply("blocked.example.org.", dns.TypeA,
+		"blocked.example.org. 300 IN CNAME target.example.org.",
+		"target.example.org. 300 IN A 192.0.2.10")
+	assert.Equal(t, "192.0.2.10", blockedAddress(req, m).String())
+
+	req, m = reply("blocked.example.org.", dns.TypeAAAA, "blocked.example.org. 300 IN AAAA 2001:db8::10")
+	assert.Equal(t, "2001:db8::10", blockedAddress(req, m).String())
+
+	req, m = reply("clean.example.org.", dns.TypeA, "clean.example.org. 300 IN A 198.51.100.10")
+	assert.Nil(t, blockedAddress(req, m))
+
+	whitelist["allowed.example.org."] = true
+	defer delete(whitelist, "allowed.example.org.")
+
+	req, m = reply("allowed.example.org.", dns.TypeA, "allowed.example.org. 300 IN A 192.0.2.10")
+	assert.Nil(t, blockedAddress(req, m))
+
+	handler := NewHandler()
+
+	req, m = reply("blocked.example.org.", dns.TypeA, "blocked.example.org. 300 IN A 192.0.2.10")
+	handler.r.Qcache.Set(cache.Hash(req.Question[0]), m)
+
+	req, m = reply("clean.example.org.", dns.TypeA, "clean.example.org. 300 IN A 198.51.100.10")
+	handler.r.Qcache.Set(cache.Hash(req.Question[0]), m)
+
+	query := func(name string) (*dns.Msg, string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.RecursionDesired = true
+
+		entry := NewAccessEntry(mustParseCIDR(t, "0.0.0.0/0"), ActionAllow, "")
+		entry.Client = net.ParseIP("127.0.0.1")
+
+		return handler.queryStatus("udp", req, entry)
+	}
+
+	resp, status := query("blocked.example.org.")
+	assert.Equal(t, statusBlocked, status)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "0.0.0.0", resp.Answer[0].(*dns.A).A.String())
+
+	resp, status = query("clean.example.org.")
+	assert.Equal(t, statusHit, status)
+	assert.Equal(t, "198.51.100.10", resp.Answer[0].(*dns.A).A.String())
+}
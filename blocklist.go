@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	blocklistHosts   = "hosts"
+	blocklistDomains = "domains"
+	blocklistAdblock = "adblock"
+	blocklistUnbound = "unbound"
+)
+
+var blocklistFormats = map[string]bool{
+	blocklistHosts:   true,
+	blocklistDomains: true,
+	blocklistAdblock: true,
+	blocklistUnbound: true,
+}
+
+// unboundBlockZones are the local-zone types answering from the local data,
+// the subdomains never resolved
+var unboundBlockZones = map[string]bool{
+	"deny":            true,
+	"refuse":          true,
+	"static":          true,
+	"redirect":        true,
+	"inform_deny":     true,
+	"always_refuse":   true,
+	"always_nxdomain": true,
+	"always_null":     true,
+	"always_deny":     true,
+}
+
+type blocklistSource struct {
+	URL      string
+	Format   string
+	Category string
+}
+
+// checkBlocklistSources validates the sources, sets the default format and
+// lowercases the categories
+func checkBlocklistSources(sources []blocklistSource) error {
+	categories := make(map[string]bool)
+
+	for i := range sources {
+		s := &sources[i]
+
+		if s.URL == "" {
+			return fmt.Errorf("blocklist url invalid: %q", s.URL)
+		}
+
+		s.Format = strings.ToLower(s.Format)
+		if s.Format == "" {
+			s.Format = blocklistHosts
+		}
+
+		if !blocklistFormats[s.Format] {
+			return fmt.Errorf("blocklist format unknown: %s", s.Format)
+		}
+
+		s.Category = strings.ToLower(s.Category)
+		if s.Category == "" {
+			continue
+		}
+
+		if strings.ContainsAny(s.Category, " /") {
+			return fmt.Errorf("blocklist category invalid: %q", s.Category)
+		}
+
+		categories[s.Category] = true
+	}
+
+	if len(categories) > cache.MaxBlockCategories {
+		return fmt.Errorf("blocklist categories more than %d", cache.MaxBlockCategories)
+	}
+
+	return nil
+}
+
+// blocklistCategory reports whether the category of a remote blocklist
+func blocklistCategory(category string) bool {
+	for _, source := range blocklistSources() {
+		if source.Category != "" && source.Category == category {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blocklistSources returns the remote blocklists, the blocklists entries
+// are hosts-files
+func blocklistSources() []blocklistSource {
+	var sources []blocklistSource
+
+	for _, uri := range Config().BlockLists {
+		sources = append(sources, blocklistSource{URL: uri, Format: blocklistHosts})
+	}
+
+	return append(sources, Config().BlockListURLs...)
+}
+
+// scanBlocklist calls fn with the normalized entries of the list format, zone
+// reports whether the subdomains of the name blocked too
+func scanBlocklist(file io.Reader, format string, fn func(name string, zone bool)) error {
+	switch format {
+	case blocklistDomains:
+		return scanLines(file, "#", func(line string) {
+			if _, ok := regexpEntry(line); ok {
+				fn(line, false)
+				return
+			}
+
+			fn(dns.Fqdn(strings.Fields(line)[0]), false)
+		})
+	case blocklistAdblock:
+		return scanLines(file, "!", func(line string) {
+			if name, ok := adblockEntry(line); ok {
+				fn(name, true)
+			}
+		})
+	case blocklistUnbound:
+		return scanLines(file, "#", func(line string) {
+			if name, zone, ok := unboundEntry(line); ok {
+				fn(name, zone)
+			}
+		})
+	}
+
+	return scanHostFile(file, func(name string) { fn(name, false) })
+}
+
+// scanLines calls fn with the trimmed lines which are not empty or comments
+func scanLines(file io.Reader, comment string, fn func(line string)) error {
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line != "" && !strings.HasPrefix(line, comment) {
+			fn(line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error scanning blocklist: %s", err)
+	}
+
+	return nil
+}
+
+// adblockEntry returns the domain of a ||example.com^ rule, the exception,
+// cosmetic, path and option rules ignored except the important option
+func adblockEntry(line string) (string, bool) {
+	if !strings.HasPrefix(line, "||") {
+		return "", false
+	}
+
+	line = line[2:]
+
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		if line[i+1:] != "important" {
+			return "", false
+		}
+		line = line[:i]
+	}
+
+	if !strings.HasSuffix(line, "^") {
+		return "", false
+	}
+
+	name := line[:len(line)-1]
+	if name == "" || strings.ContainsAny(name, "/*|^#@:") {
+		return "", false
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+
+	return dns.Fqdn(strings.ToLower(name)), true
+}
+
+// unboundEntry returns the name of a local-zone or local-data line, zone
+// reports whether the subdomains blocked too
+func unboundEntry(line string) (name string, zone bool, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", false, false
+	}
+
+	switch fields[0] {
+	case "local-zone:":
+		if len(fields) < 3 || !unboundBlockZones[strings.ToLower(fields[2])] {
+			return "", false, false
+		}
+
+		name, zone = strings.Trim(fields[1], `"`), true
+	case "local-data:":
+		name = strings.Trim(fields[1], `"`)
+	default:
+		return "", false, false
+	}
+
+	if name == "" || name == "." {
+		return "", false, false
+	}
+
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false, false
+	}
+
+	return dns.Fqdn(strings.ToLower(name)), zone, true
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkBlocklistSources(t *testing.T) {
+	sources := []blocklistSource{{URL: "https://example.com/hosts"}, {URL: "https://example.com/list", Format: "AdBlock"}}
+	assert.NoError(t, checkBlocklistSources(sources))
+	assert.Equal(t, blocklistHosts, sources[0].Format)
+	assert.Equal(t, blocklistAdblock, sources[1].Format)
+
+	assert.Error(t, checkBlocklistSources([]blocklistSource{{URL: "https://example.com/list", Format: "rpz"}}))
+	assert.Error(t, checkBlocklistSources([]blocklistSource{{Format: blocklistHosts}}))
+
+	sources = []blocklistSource{{URL: "https://example.com/ads.txt", Category: "Ads"}}
+	assert.NoError(t, checkBlocklistSources(sources))
+	assert.Equal(t, "ads", sources[0].Category)
+
+	assert.Error(t, checkBlocklistSources([]blocklistSource{{URL: "https://example.com/ads.txt", Category: "ads/tracking"}}))
+
+	sources = nil
+	for i := 0; i <= cache.MaxBlockCategories; i++ {
+		sources = append(sources, blocklistSource{URL: "https://example.com/" + strconv.Itoa(i), Category: "c" + strconv.Itoa(i)})
+	}
+	assert.Error(t, checkBlocklistSources(sources))
+}
+
+func Test_adblockEntry(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		ok   bool
+	}{
+		{"||Ads.Example.com^", "ads.example.com.", true},
+		{"||ads.example.com^$important", "ads.example.com.", true},
+		{"||ads.example.com^$third-party", "", false},
+		{"||ads.example.com/banner^", "", false},
+		{"||ads.*.example.com^", "", false},
+		{"@@||ads.example.com^", "", false},
+		{"example.com##.banner", "", false},
+		{"##.ad-box", "", false},
+		{"/banner/ads/", "", false},
+		{"[Adblock Plus 2.0]", "", false},
+	}
+
+	for _, tt := range tests {
+		name, ok := adblockEntry(tt.line)
+		assert.Equal(t, tt.ok, ok, tt.line)
+		assert.Equal(t, tt.name, name, tt.line)
+	}
+}
+
+func Test_unboundEntry(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		zone bool
+		ok   bool
+	}{
+		{`local-zone: "ads.example.com" always_nxdomain`, "ads.example.com.", true, true},
+		{`local-zone: "ads.example.com." static`, "ads.example.com.", true, true},
+		{`local-zone: "example.com" transparent`, "", false, false},
+		{`local-data: "tracker.example.com A 0.0.0.0"`, "tracker.example.com.", false, true},
+		{`local-data: "tracker.example.com. IN A 0.0.0.0"`, "tracker.example.com.", false, true},
+		{`server:`, "", false, false},
+	}
+
+	for _, tt := range tests {
+		name, zone, ok := unboundEntry(tt.line)
+		assert.Equal(t, tt.ok, ok, tt.line)
+		assert.Equal(t, tt.zone, zone, tt.line)
+		assert.Equal(t, tt.name, name, tt.line)
+	}
+}
+
+func Test_readBlocklistsFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sources := []blocklistSource{
+		{URL: "https://example.com/adblock.txt", Format: blocklistAdblock},
+		{URL: "https://example.com/unbound.conf", Format: blocklistUnbound},
+		{URL: "https://example.com/domains.txt", Format: blocklistDomains},
+	}
+
+	files := []string{
+		"! adblock list\n||adblock.example.com^\nexample.com##.banner\n@@||allowed.example.com^\n",
+		"server:\nlocal-zone: \"unbound.example.com\" always_nxdomain\nlocal-data: \"data.example.com A 0.0.0.0\"\n",
+		"# domains\ndomains.example.com\nadblock.example.com\n",
+	}
+
+	for i, source := range sources {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, blocklistFile(source.URL)), []byte(files[i]), 0644))
+	}
+
+	defer setConfig(func(cfg *config) {
+		cfg.BlockListURLs = sources
+		cfg.BlockLists = nil
+	})()
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	assert.NoError(t, readBlocklists(dir))
+
+	assert.True(t, BlockList.Blocked("adblock.example.com."))
+	assert.True(t, BlockList.Blocked("sub.adblock.example.com."))
+	assert.True(t, BlockList.Blocked("unbound.example.com."))
+	assert.True(t, BlockList.Blocked("a.b.unbound.example.com."))
+	assert.True(t, BlockList.Blocked("data.example.com."))
+	assert.False(t, BlockList.Blocked("sub.data.example.com."))
+	assert.True(t, BlockList.Blocked("domains.example.com."))
+	assert.False(t, BlockList.Blocked("allowed.example.com."))
+
+	assert.Equal(t, 4, BlockList.Length())
+	assert.Equal(t, 2, BlockList.WildcardLength())
+}
+
+func Test_readBlocklistsLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.list"), []byte("0.0.0.0 a1.example.com\n0.0.0.0 a2.example.com\n0.0.0.0 a3.example.com\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.list"), []byte("0.0.0.0 b1.example.com\n"), 0644))
+
+	defer setConfig(func(cfg *config) {
+		cfg.BlockListURLs = nil
+		cfg.BlockLists = nil
+		cfg.BlockListMaxEntries = 2
+	})()
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	// the loading stopped at the limit, the files walked in lexical order
+	assert.NoError(t, readBlocklists(dir))
+	assert.Equal(t, 2, BlockList.Size())
+	assert.True(t, BlockList.Blocked("a1.example.com."))
+	assert.False(t, BlockList.Blocked("a3.example.com."))
+	assert.False(t, BlockList.Blocked("b1.example.com."))
+
+	defer setConfig(func(cfg *config) { cfg.BlockListMaxEntries = 0 })()
+
+	assert.NoError(t, readBlocklists(dir))
+	assert.Equal(t, 4, BlockList.Size())
+}
+
+func Test_blocklistCategories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_blocklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sources := []blocklistSource{
+		{URL: "https://example.com/ads.txt", Format: blocklistDomains, Category: "ads"},
+		{URL: "https://example.com/malware.txt", Format: blocklistDomains, Category: "malware"},
+	}
+
+	files := []string{
+		"ads.example.com\nshared.example.com\n",
+		"malware.example.com\nshared.example.com\n",
+	}
+
+	for i, source := range sources {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, blocklistFile(source.URL)), []byte(files[i]), 0644))
+	}
+
+	defer setConfig(func(cfg *config) {
+		cfg.BlockListURLs = sources
+		cfg.BlockLists = nil
+	})()
+
+	list := BlockList
+	BlockList = cache.NewBlockCache()
+	defer func() { BlockList = list }()
+
+	assert.NoError(t, readBlocklists(dir))
+
+	r := gin.New()
+	r.GET("/api/v1/categories", listCategories)
+	r.POST("/api/v1/categories/:name/disable", setCategory(true))
+	r.POST("/api/v1/categories/:name/enable", setCategory(false))
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		request, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		r.ServeHTTP(w, request)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, serve("POST", "/api/v1/categories/adult/disable").Code)
+	assert.Equal(t, http.StatusOK, serve("POST", "/api/v1/categories/Ads/disable").Code)
+
+	assert.False(t, BlockList.Blocked("ads.example.com."))
+	assert.True(t, BlockList.Blocked("shared.example.com."))
+	assert.True(t, BlockList.Blocked("malware.example.com."))
+
+	// the blocked queries counted into the enabled categories
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("shared.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	hits := stats.categoryHitCount("malware")
+	assert.Len(t, handler.query("udp", req).Answer, 1)
+	assert.Equal(t, hits+1, stats.categoryHitCount("malware"))
+
+	var categories []struct {
+		Name     string
+		Entries  int
+		Hits     int64
+		Disabled bool
+	}
+
+	w := serve("GET", "/api/v1/categories")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &categories))
+
+	// the categories in the load order of the files
+	if assert.Len(t, categories, 2) {
+		if categories[0].Name != "ads" {
+			categories[0], categories[1] = categories[1], categories[0]
+		}
+
+		assert.Equal(t, "ads", categories[0].Name)
+		assert.Equal(t, 2, categories[0].Entries)
+		assert.True(t, categories[0].Disabled)
+		assert.Equal(t, "malware", categories[1].Name)
+		assert.Equal(t, hits+1, categories[1].Hits)
+		assert.False(t, categories[1].Disabled)
+	}
+
+	// the disabled category kept over the reloads
+	assert.NoError(t, readBlocklists(dir))
+	assert.False(t, BlockList.Blocked("ads.example.com."))
+
+	assert.Equal(t, http.StatusOK, serve("POST", "/api/v1/categories/ads/enable").Code)
+	assert.True(t, BlockList.Blocked("ads.example.com."))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// bootstrapMinTTL is the lowest cache time of the bootstrapped addresses
+const bootstrapMinTTL = 60 * time.Second
+
+var errBootstrapFailed = errors.New("upstream host bootstrap failed")
+
+// bootstrapEntry is the cached addresses of an upstream host
+type bootstrapEntry struct {
+	v4, v6 []net.IP
+	expire time.Time
+}
+
+// bootstrapResolver resolves the hostnames of the encrypted upstreams over the
+// plain bootstrap servers, the answers cached apart from the query cache
+type bootstrapResolver struct {
+	mu      sync.Mutex
+	servers []string
+	hosts   map[string]*bootstrapEntry
+}
+
+var bootstrap = &bootstrapResolver{hosts: make(map[string]*bootstrapEntry)}
+
+// setupBootstrap sets the bootstrap servers of the config, the cached
+// addresses dropped. Empty list leaves the hostnames to the system resolver.
+func setupBootstrap(cfg *config) error {
+	servers, err := parseBootstrapServers(cfg.BootstrapServers)
+	if err != nil {
+		return err
+	}
+
+	setBootstrapServers(servers)
+
+	return nil
+}
+
+// setBootstrapServers replaces the parsed bootstrap servers, the cached
+// addresses dropped
+func setBootstrapServers(servers []string) {
+	bootstrap.mu.Lock()
+	bootstrap.servers = servers
+	bootstrap.hosts = make(map[string]*bootstrapEntry)
+	bootstrap.mu.Unlock()
+}
+
+// parseBootstrapServers returns the addresses of the bootstrap servers, the
+// port 53 used for the bare ips
+func parseBootstrapServers(list []string) ([]string, error) {
+	var servers []string
+
+	for _, s := range list {
+		addr := s
+		if net.ParseIP(addr) != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) == nil || port == "" {
+			return nil, fmt.Errorf("bootstrap server invalid: %s", s)
+		}
+
+		servers = append(servers, addr)
+	}
+
+	return servers, nil
+}
+
+// dial resolves the host of the address over the bootstrap servers then dials
+// the addresses in order, the connection stays on the dialed address so the
+// address pinned for the connection lifetime. The addresses dialed from the
+// outbound source address of their family.
+func (b *bootstrapResolver) dial(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil || !b.enabled() {
+		return dialOutbound(ctx, d, network, addr)
+	}
+
+	ips, err := b.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialOutbound(ctx, d, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (b *bootstrapResolver) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.servers) > 0
+}
+
+// lookup returns the addresses of the host in the dial order of the ipv6 mode
+func (b *bootstrapResolver) lookup(host string) ([]net.IP, error) {
+	host = strings.ToLower(dns.Fqdn(host))
+
+	b.mu.Lock()
+	e, ok := b.hosts[host]
+	servers := b.servers
+	b.mu.Unlock()
+
+	if !ok || time.Now().After(e.expire) {
+		var err error
+		if e, err = b.resolve(servers, host); err != nil {
+			return nil, err
+		}
+
+		b.mu.Lock()
+		b.hosts[host] = e
+		b.mu.Unlock()
+	}
+
+	var ips []net.IP
+	if useIPv4() {
+		ips = append(ips, e.v4...)
+	}
+
+	if useIPv6() {
+		if Config().IPv6 == ipv6Prefer {
+			ips = append(e.v6[:len(e.v6):len(e.v6)], ips...)
+		} else {
+			ips = append(ips, e.v6...)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, errBootstrapFailed
+	}
+
+	return ips, nil
+}
+
+// resolve queries the A and AAAA records of the host, the servers tried in
+// order until an answer
+func (b *bootstrapResolver) resolve(servers []string, host string) (*bootstrapEntry, error) {
+	e := &bootstrapEntry{}
+	ttl := uint32(0)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := b.exchange(servers, host, qtype)
+		if err != nil {
+			log.Warn("Bootstrap query failed", "host", host, "qtype", dns.TypeToString[qtype], "error", err.Error())
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				e.v4 = append(e.v4, rr.A)
+			case *dns.AAAA:
+				e.v6 = append(e.v6, rr.AAAA)
+			default:
+				continue
+			}
+
+			if ttl == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+
+	if len(e.v4) == 0 && len(e.v6) == 0 {
+		return nil, errBootstrapFailed
+	}
+
+	expire := time.Duration(ttl) * time.Second
+	if expire < bootstrapMinTTL {
+		expire = bootstrapMinTTL
+	}
+
+	e.expire = time.Now().Add(expire)
+
+	return e, nil
+}
+
+func (b *bootstrapResolver) exchange(servers []string, host string, qtype uint16) (resp *dns.Msg, err error) {
+	req := new(dns.Msg)
+	req.SetQuestion(host, qtype)
+	req.SetEdns0(DefaultMsgSize, false)
+
+	timeout, connect := upstreamTimeouts("udp")
+
+	c := &dns.Client{
+		Net:          "udp",
+		Dialer:       &net.Dialer{Timeout: connect},
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+
+	err = errBootstrapFailed
+
+	for _, server := range servers {
+		resp, _, err = c.Exchange(req, server)
+		if err == dns.ErrTruncated {
+			timeout, connect := upstreamTimeouts("tcp")
+
+			tc := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: connect}, ReadTimeout: timeout, WriteTimeout: timeout}
+			resp, _, err = tc.Exchange(req, server)
+		}
+
+		if err == nil && resp.Rcode == dns.RcodeSuccess {
+			return resp, nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("bootstrap server %s answered %s", server, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setupBootstrap(t *testing.T) {
+	defer setupBootstrap(&config{})
+
+	assert.NoError(t, setupBootstrap(&config{BootstrapServers: []string{"9.9.9.9", "[2620:fe::fe]:53", "127.0.0.1:5353"}}))
+	assert.Equal(t, []string{"9.9.9.9:53", "[2620:fe::fe]:53", "127.0.0.1:5353"}, bootstrap.servers)
+	assert.True(t, bootstrap.enabled())
+
+	assert.Error(t, setupBootstrap(&config{BootstrapServers: []string{"dns.quad9.net:53"}}))
+	assert.Error(t, setupBootstrap(&config{BootstrapServers: []string{"9.9.9.9:"}}))
+
+	assert.NoError(t, setupBootstrap(&config{}))
+	assert.False(t, bootstrap.enabled())
+}
+
+func Test_bootstrapDial(t *testing.T) {
+	var queries int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		if req.Question[0].Name == "dot.test." && req.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR("dot.test. 300 IN A 127.0.0.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, setupBootstrap(&config{BootstrapServers: []string{addrstr}}))
+	defer setupBootstrap(&config{})
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	dialer := &net.Dialer{Timeout: time.Second}
+
+	conn, err := bootstrap.dial(context.Background(), dialer, "tcp", net.JoinHostPort("dot.test", port))
+	if assert.NoError(t, err) {
+		assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+
+	// the A and AAAA queries
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// the addresses answered from the bootstrap cache
+	conn, err = bootstrap.dial(context.Background(), dialer, "tcp", net.JoinHostPort("DOT.test.", port))
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	_, err = bootstrap.lookup("nothere.test")
+	assert.Error(t, err)
+
+	s.Shutdown()
+
+	// the upstream fails when the bootstrap servers unreachable
+	bootstrap.mu.Lock()
+	bootstrap.hosts["dot.test."].expire = time.Now().Add(-time.Second)
+	bootstrap.mu.Unlock()
+
+	_, err = bootstrap.dial(context.Background(), dialer, "tcp", net.JoinHostPort("dot.test", port))
+	assert.Error(t, err)
+
+	// the ip addresses dialed without the bootstrap
+	conn, err = bootstrap.dial(context.Background(), dialer, "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
@@ -1,4 +1,4 @@
 #!/bin/sh
 
-go get -v github.com/mitchellh/gox
+go install github.com/mitchellh/gox@latest
 ${HOME}/go/bin/gox -osarch="linux/amd64 netbsd/amd64 darwin/amd64 freebsd/amd64 windows/amd64" -output="sdns_{{.OS}}_{{.Arch}}" -ldflags="-s -w"
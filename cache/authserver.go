@@ -1,24 +1,230 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// The upstream protocols of the servers
+const (
+	ProtocolPlain = "plain"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+)
+
+var (
+	errAuthServerInvalid = errors.New("server address invalid")
+	errPinInvalid        = errors.New("server pin invalid, sha256/<base64> expected")
+)
+
+const pinPrefix = "sha256/"
+
+// MaxHealthBackoff is the maximum wait before a down server probed again
+var MaxHealthBackoff = 10 * time.Minute
+
+// RttWeighting lowers the weights of the servers by their smoothed rtt, a
+// spiking server sheds its load to the others
+var RttWeighting = false
+
+// minRttFactor keeps the slowest servers in the rotation
+const minRttFactor = 0.05
+
+// The capability flags of the servers, learned from their FORMERR and NOTIMP
+// answers to the queries with EDNS
+const (
+	// CapNoCookie is the server failing the queries with the cookie option
+	CapNoCookie uint32 = 1 << iota
+	// CapNoEDNS is the server failing the queries with EDNS
+	CapNoEDNS
+)
+
+// CapabilityTTL is how long the capability flags of a server kept, the
+// server probed with the full EDNS again after
+var CapabilityTTL = time.Hour
+
 // AuthServer type
 type AuthServer struct {
 	Host  string
 	Rtt   int64
 	Count int64
+
+	// Protocol is the transport of the server, Addr is the address dialed
+	// for tls and the url for https. ServerName is the certificate name
+	// verified and Pins are the base64 sha256 of the certificate public keys
+	// verified instead when set, any of them matches for the rotation.
+	Protocol   string
+	Addr       string
+	ServerName string
+	Pins       []string
+
+	// Weight is the share of the server in the weighted round-robin, zero
+	// when not configured. Srtt is the smoothed rtt in nanoseconds.
+	Weight int
+	Srtt   int64
+
+	// current weight of the smooth weighted round-robin
+	current float64
+
+	mu        sync.RWMutex
+	lastCheck time.Time
+	nextCheck time.Time
+	checkRtt  time.Duration
+	failures  int
+	down      bool
+
+	caps       uint32
+	capsExpire time.Time
+}
+
+// AuthServerHealth is the health state of a server
+type AuthServerHealth struct {
+	Host      string
+	Healthy   bool
+	Rtt       time.Duration
+	Failures  int
+	LastCheck time.Time
+	NextCheck time.Time
 }
 
-// NewAuthServer return a server
+// NewAuthServer return a server, the host can be prefixed with tls:// or
+// https:// for the encrypted upstreams. The invalid encrypted addresses
+// handled as plain, use ParseAuthServer to validate them.
 func NewAuthServer(host string) *AuthServer {
-	return &AuthServer{
-		Host: host,
+	a, err := ParseAuthServer(host)
+	if err != nil {
+		return &AuthServer{Host: host, Protocol: ProtocolPlain, Addr: host}
 	}
+
+	return a
+}
+
+// ParseAuthServer parses a server address like "1.1.1.1:53",
+// "tls://1.1.1.1:853?name=cloudflare-dns.com" or "https://dns.google/dns-query",
+// the name and the pin query parameters set the verified certificate. The
+// address can be suffixed with "|weight=3" for the weighted round-robin and
+// with "|pin=sha256/<base64>" for the public key pins of the encrypted servers,
+// repeated for the pin rotation.
+func ParseAuthServer(host string) (*AuthServer, error) {
+	weight := 0
+	var pins []string
+
+	if i := strings.IndexByte(host, '|'); i >= 0 {
+		for _, option := range strings.Split(host[i+1:], "|") {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 {
+				return nil, errAuthServerInvalid
+			}
+
+			switch kv[0] {
+			case "weight":
+				w, err := strconv.Atoi(kv[1])
+				if err != nil || w < 1 {
+					return nil, errAuthServerInvalid
+				}
+
+				weight = w
+			case "pin":
+				pin, err := parsePin(kv[1])
+				if err != nil {
+					return nil, err
+				}
+
+				pins = append(pins, pin)
+			default:
+				return nil, errAuthServerInvalid
+			}
+		}
+
+		host = host[:i]
+	}
+
+	a, err := parseAuthServer(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pins) > 0 && !a.Encrypted() {
+		return nil, errAuthServerInvalid
+	}
+
+	a.Weight = weight
+	a.Pins = append(a.Pins, pins...)
+
+	return a, nil
+}
+
+// parsePin returns the base64 of the "sha256/<base64>" spki pin
+func parsePin(s string) (string, error) {
+	if !strings.HasPrefix(s, pinPrefix) {
+		return "", errPinInvalid
+	}
+
+	pin := s[len(pinPrefix):]
+
+	sum, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(sum) != sha256.Size {
+		return "", errPinInvalid
+	}
+
+	return pin, nil
+}
+
+func parseAuthServer(host string) (*AuthServer, error) {
+	a := &AuthServer{Host: host, Protocol: ProtocolPlain, Addr: host}
+
+	if !strings.Contains(host, "://") {
+		return a, nil
+	}
+
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" {
+		return nil, errAuthServerInvalid
+	}
+
+	query := u.Query()
+	a.ServerName = query.Get("name")
+	// unescaped plus signs of the base64 pin decoded as spaces
+	for _, pin := range query["pin"] {
+		a.Pins = append(a.Pins, strings.Replace(pin, " ", "+", -1))
+	}
+
+	query.Del("name")
+	query.Del("pin")
+	u.RawQuery = query.Encode()
+
+	switch u.Scheme {
+	case ProtocolTLS:
+		a.Protocol = ProtocolTLS
+		a.Addr = u.Host
+		if u.Port() == "" {
+			a.Addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+	case ProtocolHTTPS:
+		a.Protocol = ProtocolHTTPS
+		a.Addr = u.String()
+	default:
+		return nil, errAuthServerInvalid
+	}
+
+	if a.ServerName == "" {
+		a.ServerName = u.Hostname()
+	}
+
+	return a, nil
+}
+
+// Encrypted returns whether or not the server is a tls or https upstream
+func (a *AuthServer) Encrypted() bool {
+	return a.Protocol == ProtocolTLS || a.Protocol == ProtocolHTTPS
 }
 
 func (a *AuthServer) String() string {
@@ -29,6 +235,144 @@ func (a *AuthServer) String() string {
 	return "host:" + a.Host + " rtt:" + (time.Duration(a.Rtt) / time.Duration(a.Count)).Round(time.Millisecond).String()
 }
 
+// UpdateRtt updates the smoothed rtt of the server (RFC 6298 alpha)
+func (a *AuthServer) UpdateRtt(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&a.Srtt)
+
+		srtt := rtt.Nanoseconds()
+		if old > 0 {
+			srtt = old + (srtt-old)/8
+		}
+
+		if atomic.CompareAndSwapInt64(&a.Srtt, old, srtt) {
+			return
+		}
+	}
+}
+
+// weight returns the effective weight of the server, lowered by the smoothed
+// rtt against the fastest server when RttWeighting enabled
+func (a *AuthServer) weight(fastest int64) float64 {
+	w := float64(a.Weight)
+	if w == 0 {
+		w = 1
+	}
+
+	if !RttWeighting || fastest == 0 {
+		return w
+	}
+
+	srtt := atomic.LoadInt64(&a.Srtt)
+	if srtt == 0 {
+		return w
+	}
+
+	factor := float64(fastest) / float64(srtt)
+	if factor < minRttFactor {
+		factor = minRttFactor
+	}
+
+	return w * factor
+}
+
+// Healthy returns whether or not the server in rotation
+func (a *AuthServer) Healthy() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return !a.down
+}
+
+// NeedsCheck returns whether or not the server due to a health check
+func (a *AuthServer) NeedsCheck() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return !WallClock.Now().Before(a.nextCheck)
+}
+
+// RecordCheck records a health check result, the server removed from rotation
+// after the given consecutive failures and probed again with backoff
+func (a *AuthServer) RecordCheck(ok bool, rtt, interval time.Duration, failures int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := WallClock.Now()
+	a.lastCheck = now
+
+	if ok {
+		a.checkRtt = rtt
+		a.failures = 0
+		a.down = false
+		a.nextCheck = now.Add(interval)
+
+		atomic.AddInt64(&a.Rtt, rtt.Nanoseconds())
+		atomic.AddInt64(&a.Count, 1)
+
+		return
+	}
+
+	a.failures++
+	a.down = a.failures >= failures
+
+	wait := interval
+	if a.down {
+		for i := failures; i < a.failures && wait < MaxHealthBackoff; i++ {
+			wait *= 2
+		}
+
+		if wait > MaxHealthBackoff {
+			wait = MaxHealthBackoff
+		}
+	}
+
+	a.nextCheck = now.Add(wait)
+}
+
+// Capabilities returns the capability flags of the server, none after the
+// capability ttl
+func (a *AuthServer) Capabilities() uint32 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !WallClock.Now().Before(a.capsExpire) {
+		return 0
+	}
+
+	return a.caps
+}
+
+// SetCapability adds the capability flag of the server, the flags kept for
+// the capability ttl from the first one
+func (a *AuthServer) SetCapability(flag uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := WallClock.Now()
+	if !now.Before(a.capsExpire) {
+		a.caps = 0
+		a.capsExpire = now.Add(CapabilityTTL)
+	}
+
+	a.caps |= flag
+}
+
+// Health returns the health state of the server
+func (a *AuthServer) Health() AuthServerHealth {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return AuthServerHealth{
+		Host:      a.Host,
+		Healthy:   !a.down,
+		Rtt:       a.checkRtt,
+		Failures:  a.failures,
+		LastCheck: a.lastCheck,
+		NextCheck: a.nextCheck,
+	}
+}
+
 // AuthServers type
 type AuthServers struct {
 	sync.RWMutex
@@ -50,10 +394,116 @@ func (s *AuthServers) TrySort() {
 				s.Count = 1
 			}
 		}
-		sort.Slice(s.List, func(i, j int) bool {
+		sort.SliceStable(s.List, func(i, j int) bool {
+			hi, hj := s.List[i].Healthy(), s.List[j].Healthy()
+			if hi != hj {
+				return hi
+			}
 			return s.List[i].Rtt < s.List[j].Rtt
 		})
 		s.Unlock()
 		atomic.StoreInt32(&s.called, 0)
 	}
 }
+
+// Available returns the healthy servers, or all servers if none healthy
+func (s *AuthServers) Available() []*AuthServer {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]*AuthServer, 0, len(s.List))
+	for _, a := range s.List {
+		if a.Healthy() {
+			list = append(list, a)
+		}
+	}
+
+	if len(list) == 0 {
+		list = append(list, s.List...)
+	}
+
+	return list
+}
+
+// Down returns whether or not all of the servers out of rotation
+func (s *AuthServers) Down() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, a := range s.List {
+		if a.Healthy() {
+			return false
+		}
+	}
+
+	return len(s.List) > 0
+}
+
+// Weighted returns whether or not any of the servers has a weight
+func (s *AuthServers) Weighted() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, a := range s.List {
+		if a.Weight > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Next returns the available servers, the first one picked by the smooth
+// weighted round-robin and the others kept in order for the failover
+func (s *AuthServers) Next() []*AuthServer {
+	list := s.Available()
+	if len(list) < 2 {
+		return list
+	}
+
+	var fastest int64
+	for _, a := range list {
+		if srtt := atomic.LoadInt64(&a.Srtt); srtt > 0 && (fastest == 0 || srtt < fastest) {
+			fastest = srtt
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var total float64
+	best := 0
+
+	for i, a := range list {
+		w := a.weight(fastest)
+		a.current += w
+		total += w
+
+		if a.current > list[best].current {
+			best = i
+		}
+	}
+
+	list[best].current -= total
+
+	out := make([]*AuthServer, 0, len(list))
+	out = append(out, list[best])
+	out = append(out, list[:best]...)
+	out = append(out, list[best+1:]...)
+
+	return out
+}
+
+// Encrypted returns whether or not any of the servers encrypted
+func (s *AuthServers) Encrypted() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, a := range s.List {
+		if a.Encrypted() {
+			return true
+		}
+	}
+
+	return false
+}
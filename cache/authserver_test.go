@@ -1,8 +1,11 @@
 package cache
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,3 +22,244 @@ func Test_TrySort(t *testing.T) {
 
 	assert.Equal(t, int64(1), s.List[0].Count)
 }
+
+func Test_AuthServerHealth(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	a := NewAuthServer("0.0.0.0:53")
+	assert.True(t, a.Healthy())
+	assert.True(t, a.NeedsCheck())
+
+	a.RecordCheck(true, 10*time.Millisecond, time.Minute, 2)
+	assert.True(t, a.Healthy())
+	assert.False(t, a.NeedsCheck())
+	assert.Equal(t, 10*time.Millisecond, a.Health().Rtt)
+
+	a.RecordCheck(false, 0, time.Minute, 2)
+	assert.True(t, a.Healthy())
+	assert.Equal(t, fakeClock.Now().Add(time.Minute), a.Health().NextCheck)
+
+	a.RecordCheck(false, 0, time.Minute, 2)
+	assert.False(t, a.Healthy())
+	assert.Equal(t, 2, a.Health().Failures)
+	assert.Equal(t, fakeClock.Now().Add(time.Minute), a.Health().NextCheck)
+
+	a.RecordCheck(false, 0, time.Minute, 2)
+	assert.Equal(t, fakeClock.Now().Add(2*time.Minute), a.Health().NextCheck)
+
+	for i := 0; i < 10; i++ {
+		a.RecordCheck(false, 0, time.Minute, 2)
+	}
+	assert.Equal(t, fakeClock.Now().Add(MaxHealthBackoff), a.Health().NextCheck)
+
+	fakeClock.Advance(MaxHealthBackoff)
+	assert.True(t, a.NeedsCheck())
+
+	a.RecordCheck(true, 5*time.Millisecond, time.Minute, 2)
+	assert.True(t, a.Healthy())
+	assert.Equal(t, 0, a.Health().Failures)
+}
+
+func Test_AuthServersAvailable(t *testing.T) {
+	s := &AuthServers{
+		List: []*AuthServer{NewAuthServer("0.0.0.0:53"), NewAuthServer("0.0.0.1:53")},
+	}
+
+	assert.Len(t, s.Available(), 2)
+	assert.False(t, s.Down())
+
+	s.List[0].RecordCheck(false, 0, time.Minute, 1)
+	assert.False(t, s.Down())
+
+	list := s.Available()
+	assert.Len(t, list, 1)
+	assert.Equal(t, "0.0.0.1:53", list[0].Host)
+
+	for i := 0; i < 20; i++ {
+		s.TrySort()
+	}
+	assert.Equal(t, "0.0.0.1:53", s.List[0].Host)
+
+	s.List[0].RecordCheck(false, 0, time.Minute, 1)
+	assert.Len(t, s.Available(), 2)
+	assert.True(t, s.Down())
+
+	assert.False(t, (&AuthServers{}).Down())
+}
+
+func Test_ParseAuthServer(t *testing.T) {
+	a, err := ParseAuthServer("192.0.2.1:53")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolPlain, a.Protocol)
+	assert.Equal(t, "192.0.2.1:53", a.Addr)
+	assert.False(t, a.Encrypted())
+
+	a, err = ParseAuthServer("tls://1.1.1.1?name=cloudflare-dns.com")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolTLS, a.Protocol)
+	assert.Equal(t, "1.1.1.1:853", a.Addr)
+	assert.Equal(t, "cloudflare-dns.com", a.ServerName)
+	assert.Equal(t, "tls://1.1.1.1?name=cloudflare-dns.com", a.Host)
+	assert.True(t, a.Encrypted())
+
+	a, err = ParseAuthServer("https://dns.google/dns-query?pin=abc%3D")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolHTTPS, a.Protocol)
+	assert.Equal(t, "https://dns.google/dns-query", a.Addr)
+	assert.Equal(t, "dns.google", a.ServerName)
+	assert.Equal(t, []string{"abc="}, a.Pins)
+
+	_, err = ParseAuthServer("quic://dns.example.com")
+	assert.Error(t, err)
+
+	_, err = ParseAuthServer("tls://")
+	assert.Error(t, err)
+
+	assert.Equal(t, ProtocolPlain, NewAuthServer("quic://dns.example.com").Protocol)
+
+	s := &AuthServers{List: []*AuthServer{NewAuthServer("192.0.2.1:53")}}
+	assert.False(t, s.Encrypted())
+
+	s.List = append(s.List, NewAuthServer("tls://1.1.1.1:853"))
+	assert.True(t, s.Encrypted())
+}
+
+func Test_ParseAuthServerWeight(t *testing.T) {
+	a, err := ParseAuthServer("1.1.1.1:53|weight=3")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1:53", a.Host)
+	assert.Equal(t, "1.1.1.1:53", a.Addr)
+	assert.Equal(t, 3, a.Weight)
+
+	a, err = ParseAuthServer("tls://1.1.1.1?name=cloudflare-dns.com|weight=2")
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolTLS, a.Protocol)
+	assert.Equal(t, "1.1.1.1:853", a.Addr)
+	assert.Equal(t, "cloudflare-dns.com", a.ServerName)
+	assert.Equal(t, 2, a.Weight)
+
+	a, err = ParseAuthServer("1.1.1.1:53")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, a.Weight)
+
+	for _, host := range []string{"1.1.1.1:53|weight=0", "1.1.1.1:53|weight=x", "1.1.1.1:53|rtt=1"} {
+		_, err = ParseAuthServer(host)
+		assert.Error(t, err, host)
+	}
+}
+
+func Test_ParseAuthServerPins(t *testing.T) {
+	pin1 := "sha256/" + strings.Repeat("A", 43) + "="
+	pin2 := "sha256/" + strings.Repeat("B", 43) + "="
+
+	a, err := ParseAuthServer("tls://9.9.9.9:853|pin=" + pin1 + "|pin=" + pin2 + "|weight=2")
+	assert.NoError(t, err)
+	assert.Equal(t, "tls://9.9.9.9:853", a.Host)
+	assert.Equal(t, "9.9.9.9:853", a.Addr)
+	assert.Equal(t, []string{strings.Repeat("A", 43) + "=", strings.Repeat("B", 43) + "="}, a.Pins)
+	assert.Equal(t, 2, a.Weight)
+
+	a, err = ParseAuthServer("https://dns.quad9.net/dns-query?pin=abc%3D|pin=" + pin1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abc=", strings.Repeat("A", 43) + "="}, a.Pins)
+
+	for _, host := range []string{
+		"tls://9.9.9.9:853|pin=" + strings.Repeat("A", 43) + "=",
+		"tls://9.9.9.9:853|pin=sha256/AAAA",
+		"tls://9.9.9.9:853|pin=sha256/!!",
+		"9.9.9.9:53|pin=" + pin1,
+	} {
+		_, err = ParseAuthServer(host)
+		assert.Error(t, err, host)
+	}
+}
+
+func Test_AuthServersWeighted(t *testing.T) {
+	s := &AuthServers{
+		List: []*AuthServer{
+			NewAuthServer("0.0.0.1:53|weight=3"),
+			NewAuthServer("0.0.0.2:53|weight=1"),
+			NewAuthServer("0.0.0.3:53"),
+		},
+	}
+
+	assert.True(t, s.Weighted())
+	assert.False(t, (&AuthServers{List: []*AuthServer{NewAuthServer("0.0.0.1:53")}}).Weighted())
+
+	const rounds = 10000
+
+	count := make(map[string]int)
+	for i := 0; i < rounds; i++ {
+		list := s.Next()
+		assert.Len(t, list, 3)
+		count[list[0].Host]++
+	}
+
+	assert.InDelta(t, rounds*3/5, count["0.0.0.1:53"], rounds*0.01)
+	assert.InDelta(t, rounds/5, count["0.0.0.2:53"], rounds*0.01)
+	assert.InDelta(t, rounds/5, count["0.0.0.3:53"], rounds*0.01)
+
+	// the down servers out of the rotation
+	s.List[0].RecordCheck(false, 0, time.Minute, 1)
+
+	count = make(map[string]int)
+	for i := 0; i < rounds; i++ {
+		count[s.Next()[0].Host]++
+	}
+
+	assert.Equal(t, 0, count["0.0.0.1:53"])
+	assert.InDelta(t, rounds/2, count["0.0.0.2:53"], rounds*0.01)
+}
+
+func Test_AuthServersRttWeighting(t *testing.T) {
+	defer func(v bool) { RttWeighting = v }(RttWeighting)
+	RttWeighting = true
+
+	s := &AuthServers{
+		List: []*AuthServer{
+			NewAuthServer("0.0.0.1:53|weight=1"),
+			NewAuthServer("0.0.0.2:53|weight=1"),
+		},
+	}
+
+	s.List[0].UpdateRtt(10 * time.Millisecond)
+	s.List[1].UpdateRtt(10 * time.Millisecond)
+
+	// spiking server
+	for i := 0; i < 20; i++ {
+		s.List[1].UpdateRtt(100 * time.Millisecond)
+	}
+
+	assert.InDelta(t, float64(100*time.Millisecond), float64(s.List[1].Srtt), float64(10*time.Millisecond))
+
+	const rounds = 10000
+
+	count := make(map[string]int)
+	for i := 0; i < rounds; i++ {
+		count[s.Next()[0].Host]++
+	}
+
+	assert.True(t, count["0.0.0.2:53"] > 0)
+	assert.True(t, count["0.0.0.1:53"] > count["0.0.0.2:53"]*8, count)
+}
+
+func Test_AuthServerCapabilities(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	a := NewAuthServer("192.0.2.1:53")
+	assert.Equal(t, uint32(0), a.Capabilities())
+
+	a.SetCapability(CapNoCookie)
+	fakeClock.Advance(CapabilityTTL / 2)
+	a.SetCapability(CapNoEDNS)
+	assert.Equal(t, CapNoCookie|CapNoEDNS, a.Capabilities())
+
+	// probed with the full edns again after the ttl of the first flag
+	fakeClock.Advance(CapabilityTTL / 2)
+	assert.Equal(t, uint32(0), a.Capabilities())
+
+	a.SetCapability(CapNoEDNS)
+	assert.Equal(t, CapNoEDNS, a.Capabilities())
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Backend is the storage of the query cache entries. The entries of the
+// shared backends serialized, the hits and the rate limiters of the entries
+// kept on the node.
+type Backend interface {
+	Get(key uint64) (*Query, bool)
+	Set(key uint64, q *Query)
+	Remove(key uint64)
+	Len() int
+}
+
+// Purger is implemented by the backends removing the entries which the
+// function reports true for, returns the removed count
+type Purger interface {
+	RemoveFunc(fn func(q *Query) bool) int
+}
+
+// memoryBackend is the in-memory storage of the entries, the default one and
+// the fallback of the shared backends
+type memoryBackend struct {
+	shards shards
+}
+
+func newMemoryBackend(size, count int) *memoryBackend {
+	return &memoryBackend{shards: newShards(size, count)}
+}
+
+// Get returns the entry of the key
+func (b *memoryBackend) Get(key uint64) (*Query, bool) {
+	el, ok := b.shards.shard(key).Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	q, ok := el.(*Query)
+
+	return q, ok
+}
+
+// Set sets the entry of the key
+func (b *memoryBackend) Set(key uint64, q *Query) {
+	b.shards.shard(key).SetSized(key, q, q.Item.size())
+}
+
+// Remove removes the entry of the key
+func (b *memoryBackend) Remove(key uint64) {
+	b.shards.shard(key).Remove(key)
+}
+
+// Len returns the entry count
+func (b *memoryBackend) Len() int {
+	return b.shards.Len()
+}
+
+// RemoveFunc removes the entries which the function reports true for
+func (b *memoryBackend) RemoveFunc(fn func(q *Query) bool) int {
+	return b.shards.RemoveFunc(func(el interface{}) bool {
+		q, ok := el.(*Query)
+		return ok && fn(q)
+	})
+}
+
+// queryBlobVersion is the version of the serialized entries
+const queryBlobVersion = 1
+
+// queryBlobHeader is the version and the store, the expire and the evict
+// times of a serialized entry
+const queryBlobHeader = 1 + 3*8
+
+// ErrCacheBlob error
+var ErrCacheBlob = errors.New("cache entry blob invalid")
+
+// encodeQuery serializes the entry, the times in seconds followed by the
+// message in wire format
+func encodeQuery(q *Query) ([]byte, error) {
+	packed, err := q.Item.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, queryBlobHeader, queryBlobHeader+len(packed))
+	buf[0] = queryBlobVersion
+	binary.BigEndian.PutUint64(buf[1:], uint64(q.StoreTime.Unix()))
+	binary.BigEndian.PutUint64(buf[9:], uint64(q.ExpireTime.Unix()))
+	binary.BigEndian.PutUint64(buf[17:], uint64(q.EvictTime.Unix()))
+
+	return append(buf, packed...), nil
+}
+
+// decodeQuery returns the entry of the serialized one, without the rate
+// limiter
+func decodeQuery(buf []byte) (*Query, error) {
+	if len(buf) < queryBlobHeader || buf[0] != queryBlobVersion {
+		return nil, ErrCacheBlob
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf[queryBlobHeader:]); err != nil {
+		return nil, ErrCacheBlob
+	}
+
+	return &Query{
+		Item:       newItem(msg),
+		StoreTime:  time.Unix(int64(binary.BigEndian.Uint64(buf[1:])), 0),
+		ExpireTime: time.Unix(int64(binary.BigEndian.Uint64(buf[9:])), 0),
+		EvictTime:  time.Unix(int64(binary.BigEndian.Uint64(buf[17:])), 0),
+	}, nil
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_encodeQuery(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.AuthenticatedData = true
+	m.RecursionAvailable = true
+	m.SetEdns0(4096, true)
+
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	rr, _ = dns.NewRR("example.com. 300 IN NS ns1.example.com.")
+	m.Ns = append(m.Ns, rr)
+
+	now := WallClock.Now().Truncate(time.Second)
+	q := &Query{
+		Item:       newItem(m),
+		StoreTime:  now,
+		ExpireTime: now.Add(300 * time.Second),
+		EvictTime:  now.Add(time.Hour),
+	}
+
+	blob, err := encodeQuery(q)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	q2, err := decodeQuery(blob)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, q.StoreTime.Equal(q2.StoreTime))
+	assert.True(t, q.ExpireTime.Equal(q2.ExpireTime))
+	assert.True(t, q.EvictTime.Equal(q2.EvictTime))
+	assert.Nil(t, q2.RateLimit)
+
+	assert.Equal(t, q.Item.Question, q2.Item.Question)
+	assert.True(t, q2.Item.AuthenticatedData)
+	assert.True(t, q2.Item.RecursionAvailable)
+	assert.Equal(t, dns.RcodeSuccess, q2.Item.Rcode)
+
+	if assert.Len(t, q2.Item.Answer, 1) && assert.Len(t, q2.Item.Ns, 1) && assert.Len(t, q2.Item.Extra, 1) {
+		assert.Equal(t, q.Item.Answer[0].String(), q2.Item.Answer[0].String())
+		assert.Equal(t, q.Item.Ns[0].String(), q2.Item.Ns[0].String())
+		assert.Equal(t, dns.TypeOPT, q2.Item.Extra[0].Header().Rrtype)
+	}
+
+	_, err = decodeQuery(blob[:queryBlobHeader-1])
+	assert.Equal(t, ErrCacheBlob, err)
+
+	_, err = decodeQuery(blob[:queryBlobHeader+4])
+	assert.Equal(t, ErrCacheBlob, err)
+
+	blob[0] = queryBlobVersion + 1
+	_, err = decodeQuery(blob)
+	assert.Equal(t, ErrCacheBlob, err)
+}
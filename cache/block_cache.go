@@ -2,21 +2,100 @@ package cache
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
+// MaxBlockCategories is the most categories of the list sources, the
+// categories of an entry kept in bits
+const MaxBlockCategories = 16
+
 // BlockCache type
 type BlockCache struct {
 	mu sync.RWMutex
 
-	m map[string]bool
+	// the list entries kept packed, the lists can have millions of names
+	m      *nameSet
+	manual map[string]bool
+	allow  map[string]bool
+
+	// wildcard entries match the subdomains of the names in any depth,
+	// regexps matched against the names without the trailing dot
+	wildcard *nameSet
+	regexps  []*regexp.Regexp
+
+	// sources are the list sources of the entries by the tags less one,
+	// the entries set tagged with the current source
+	sources    []string
+	source     uint16
+	regexpTags []uint16
+
+	// categories are the list categories by the bits, the entries set with
+	// the category of the current source. The entries listed only in the
+	// disabled categories not blocked, the disabled categories kept by the
+	// names over the list reloads.
+	categories []string
+	category   uint16
+	regexpCats []uint16
+	disabled   map[string]bool
+	off        uint16
+
+	// filter holds the exact and wildcard entries of the loaded lists, the
+	// names not in it skip the exact checks. Nil until the lists loaded.
+	filter *bloomFilter
+
+	// runtime is the overlay of the blocks added on runtime, kept apart
+	// from the list entries, zero time never expires
+	runtime map[string]time.Time
+}
+
+// RuntimeBlock is a block added on runtime
+type RuntimeBlock struct {
+	Name   string
+	Expire time.Time
+}
+
+// Decision is the effective block decision of a name
+type Decision struct {
+	// Blocked reports whether the name is blocked
+	Blocked bool
+	// Block is the matched block entry, empty if none
+	Block string
+	// Allow is the most specific matched allow entry, empty if none
+	Allow string
+	// Manual reports whether the matched block entry added manually
+	Manual bool
+	// Runtime reports whether the matched block entry added on runtime
+	Runtime bool
+	// Source is the list source of the matched block entry, empty for the
+	// manual and runtime entries
+	Source string
+	// Categories are the enabled categories of the matched block entry
+	Categories []string
+}
+
+// CategoryStats is the entries count and the state of a list category
+type CategoryStats struct {
+	Name     string
+	Entries  int
+	Disabled bool
 }
 
 // NewBlockCache returns a new blockcache
 func NewBlockCache() *BlockCache {
 	return &BlockCache{
-		m: make(map[string]bool),
+		m:        newNameSet(),
+		manual:   make(map[string]bool),
+		allow:    make(map[string]bool),
+		wildcard: newNameSet(),
+		runtime:  make(map[string]time.Time),
+		disabled: make(map[string]bool),
 	}
 }
 
@@ -26,13 +105,12 @@ func (c *BlockCache) Get(key string) (bool, error) {
 	defer c.mu.RUnlock()
 
 	key = strings.ToLower(key)
-	val, ok := c.m[key]
 
-	if !ok {
+	if c.filtered(key) || !c.m.has(key) {
 		return false, errors.New("block not found")
 	}
 
-	return val, nil
+	return true, nil
 }
 
 // Remove removes an entry from the cache
@@ -41,7 +119,8 @@ func (c *BlockCache) Remove(key string) {
 	defer c.mu.Unlock()
 
 	key = strings.ToLower(key)
-	delete(c.m, key)
+	c.m.remove(key)
+	delete(c.manual, key)
 }
 
 // Set sets a value in the BlockCache
@@ -50,7 +129,168 @@ func (c *BlockCache) Set(key string) {
 	defer c.mu.Unlock()
 
 	key = strings.ToLower(key)
-	c.m[key] = true
+	c.m.addTag(key, c.source, c.category)
+	c.filterAdd(key)
+}
+
+// SetSource sets the list source of the entries set after it, the first
+// source of an entry kept
+func (c *BlockCache) SetSource(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, s := range c.sources {
+		if s == source {
+			c.source = uint16(i + 1)
+			return
+		}
+	}
+
+	c.sources = append(c.sources, source)
+	c.source = uint16(len(c.sources))
+}
+
+// SetCategory sets the category of the entries set after it, empty for none.
+// The categories of an entry listed in more sources joined.
+func (c *BlockCache) SetCategory(category string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if category == "" {
+		c.category = 0
+		return nil
+	}
+
+	for i, name := range c.categories {
+		if name == category {
+			c.category = 1 << uint(i)
+			return nil
+		}
+	}
+
+	if len(c.categories) >= MaxBlockCategories {
+		return fmt.Errorf("blocklist categories more than %d", MaxBlockCategories)
+	}
+
+	c.categories = append(c.categories, category)
+	c.category = 1 << uint(len(c.categories)-1)
+	c.setOff()
+
+	return nil
+}
+
+// DisableCategory disables the blocking of the category, the entries listed
+// only in the disabled categories allowed
+func (c *BlockCache) DisableCategory(category string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disabled[category] = true
+	c.setOff()
+}
+
+// EnableCategory enables the blocking of the category again
+func (c *BlockCache) EnableCategory(category string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.disabled, category)
+	c.setOff()
+}
+
+// CategoryDisabled reports whether the category disabled
+func (c *BlockCache) CategoryDisabled(category string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.disabled[category]
+}
+
+// Categories returns the entries count and the state of the categories of
+// the loaded lists in the load order, an entry counted in all its categories
+func (c *BlockCache) Categories() []CategoryStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make([]int, len(c.categories))
+	count := func(cats uint16) {
+		for i := range counts {
+			if cats&(1<<uint(i)) != 0 {
+				counts[i]++
+			}
+		}
+	}
+
+	if len(counts) > 0 {
+		c.m.eachCategories(count)
+		c.wildcard.eachCategories(count)
+
+		for _, cats := range c.regexpCats {
+			count(cats)
+		}
+	}
+
+	list := make([]CategoryStats, 0, len(c.categories))
+	for i, name := range c.categories {
+		list = append(list, CategoryStats{Name: name, Entries: counts[i], Disabled: c.disabled[name]})
+	}
+
+	return list
+}
+
+// setOff sets the bits of the disabled categories
+func (c *BlockCache) setOff() {
+	c.off = 0
+
+	for i, name := range c.categories {
+		if c.disabled[name] {
+			c.off |= 1 << uint(i)
+		}
+	}
+}
+
+// blocking reports whether the entry of the category bits blocks, the
+// entries without a category always block
+func (c *BlockCache) blocking(cats uint16) bool {
+	return cats == 0 || cats&^c.off != 0
+}
+
+// categoryNames returns the enabled categories of the bits
+func (c *BlockCache) categoryNames(cats uint16) []string {
+	cats &^= c.off
+	if cats == 0 {
+		return nil
+	}
+
+	var names []string
+	for i, name := range c.categories {
+		if cats&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// sourceName returns the list source of the tag, empty for none
+func (c *BlockCache) sourceName(tag uint16) string {
+	if tag == 0 || int(tag) > len(c.sources) {
+		return ""
+	}
+
+	return c.sources[tag-1]
+}
+
+// SetManual sets a manual entry in the BlockCache, manual entries
+// more specific than the matched allow entry still blocked
+func (c *BlockCache) SetManual(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = strings.ToLower(key)
+	c.m.add(key)
+	c.manual[key] = true
+	c.filterAdd(key)
 }
 
 // Exists returns whether or not a key exists in the cache
@@ -59,9 +299,8 @@ func (c *BlockCache) Exists(key string) bool {
 	defer c.mu.RUnlock()
 
 	key = strings.ToLower(key)
-	_, ok := c.m[key]
 
-	return ok
+	return !c.filtered(key) && c.m.has(key)
 }
 
 // Length returns the caches length
@@ -69,5 +308,333 @@ func (c *BlockCache) Length() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return len(c.m)
+	return c.m.len()
+}
+
+// Size returns the list entries length, the exact, wildcard and regexp
+// entries together
+func (c *BlockCache) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.m.len() + c.wildcard.len() + len(c.regexps)
+}
+
+// SetWildcard sets a wildcard entry, the subdomains of the key blocked
+// in any depth but the key itself
+func (c *BlockCache) SetWildcard(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = strings.ToLower(key)
+	c.wildcard.addTag(key, c.source, c.category)
+	c.filterAdd(key)
+}
+
+func (c *BlockCache) filterAdd(key string) {
+	if c.filter != nil {
+		c.filter.add(key)
+	}
+}
+
+// filtered reports the key not in the exact and wildcard entries
+func (c *BlockCache) filtered(key string) bool {
+	return c.filter != nil && !c.filter.has(key)
+}
+
+// SetRegexp compiles and sets a regexp entry, the names matched without the
+// trailing dot
+func (c *BlockCache) SetRegexp(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, r := range c.regexps {
+		if r.String() == pattern {
+			c.regexpCats[i] |= c.category
+			return nil
+		}
+	}
+
+	c.regexps = append(c.regexps, re)
+	c.regexpTags = append(c.regexpTags, c.source)
+	c.regexpCats = append(c.regexpCats, c.category)
+
+	return nil
+}
+
+// WildcardLength returns the wildcard entries length
+func (c *BlockCache) WildcardLength() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.wildcard.len()
+}
+
+// RegexpLength returns the regexp entries length
+func (c *BlockCache) RegexpLength() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.regexps)
+}
+
+// Replace replaces the list entries, exact, wildcard and regexp entries, with
+// the entries of the given cache. The manual, runtime and allow entries kept.
+// Returns the added and removed entries count.
+func (c *BlockCache) Replace(list *BlockCache) (added, removed int) {
+	// the additions of the list merged on the copy
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := list.m.clone()
+	m.each(func(key string) bool {
+		if !c.m.has(key) {
+			added++
+		}
+		return true
+	})
+
+	c.m.each(func(key string) bool {
+		if !m.has(key) && !c.manual[key] {
+			removed++
+		}
+		return true
+	})
+
+	for key := range c.manual {
+		m.add(key)
+	}
+
+	wildcard := list.wildcard.clone()
+	wildcard.each(func(key string) bool {
+		if !c.wildcard.has(key) {
+			added++
+		}
+		return true
+	})
+
+	c.wildcard.each(func(key string) bool {
+		if !wildcard.has(key) {
+			removed++
+		}
+		return true
+	})
+
+	patterns := make(map[string]bool, len(c.regexps))
+	for _, re := range c.regexps {
+		patterns[re.String()] = true
+	}
+
+	for _, re := range list.regexps {
+		if !patterns[re.String()] {
+			added++
+		}
+		delete(patterns, re.String())
+	}
+
+	removed += len(patterns)
+
+	// the filter sized for the loaded entries
+	filter := newBloomFilter(m.len() + wildcard.len())
+	m.each(func(key string) bool {
+		filter.add(key)
+		return true
+	})
+	wildcard.each(func(key string) bool {
+		filter.add(key)
+		return true
+	})
+
+	c.m = m
+	c.wildcard = wildcard
+	c.regexps = append([]*regexp.Regexp(nil), list.regexps...)
+	c.regexpTags = append([]uint16(nil), list.regexpTags...)
+	c.regexpCats = append([]uint16(nil), list.regexpCats...)
+	c.sources = append([]string(nil), list.sources...)
+	c.categories = append([]string(nil), list.categories...)
+	c.filter = filter
+	c.setOff()
+
+	return added, removed
+}
+
+// Allow sets an allow entry, the entry also allows its subdomains
+func (c *BlockCache) Allow(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = strings.ToLower(key)
+	c.allow[key] = true
+}
+
+// RemoveAllow removes an allow entry
+func (c *BlockCache) RemoveAllow(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = strings.ToLower(key)
+	delete(c.allow, key)
+}
+
+// AllowLength returns the allow entries length
+func (c *BlockCache) AllowLength() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.allow)
+}
+
+// SetRuntime sets a runtime block which expires after the ttl, zero ttl never
+// expires. Runtime blocks handled like the manual entries.
+func (c *BlockCache) SetRuntime(key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expire time.Time
+	if ttl > 0 {
+		expire = WallClock.Now().Add(ttl)
+	}
+
+	key = strings.ToLower(key)
+	c.runtime[key] = expire
+}
+
+// RemoveRuntime removes a runtime block, returns false if not exists
+func (c *BlockCache) RemoveRuntime(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = strings.ToLower(key)
+	_, ok := c.runtime[key]
+	delete(c.runtime, key)
+
+	return ok
+}
+
+// Runtime returns the active runtime blocks sorted by name, the expired
+// blocks removed
+func (c *BlockCache) Runtime() []RuntimeBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := WallClock.Now()
+
+	list := []RuntimeBlock{}
+	for key, expire := range c.runtime {
+		if !expire.IsZero() && !now.Before(expire) {
+			delete(c.runtime, key)
+			continue
+		}
+
+		list = append(list, RuntimeBlock{Name: key, Expire: expire})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+func (c *BlockCache) runtimeBlocked(key string) bool {
+	expire, ok := c.runtime[key]
+	if !ok {
+		return false
+	}
+
+	return expire.IsZero() || WallClock.Now().Before(expire)
+}
+
+// Blocked returns whether or not a name blocked after the allow entries applied
+func (c *BlockCache) Blocked(key string) bool {
+	return c.Decide(key).Blocked
+}
+
+// Decide returns the effective block decision of a name. The block entry
+// matched in order; the exact entries, the runtime blocks, the most specific
+// wildcard entry and the regexp entries. A matching allow entry, the name
+// itself or one of its parents, overrides the block entry unless the block
+// entry added manually or on runtime and more specific than the allow entry.
+func (c *BlockCache) Decide(key string) Decision {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key = strings.ToLower(key)
+
+	var d Decision
+
+	if !c.filtered(key) && c.m.has(key) {
+		manual := c.manual[key]
+
+		if cats := c.m.categories(key); manual || c.blocking(cats) {
+			d.Block = key
+			d.Manual = manual
+
+			if !manual {
+				d.Source = c.sourceName(c.m.tag(key))
+				d.Categories = c.categoryNames(cats)
+			}
+		}
+	}
+
+	if c.runtimeBlocked(key) {
+		d.Block = key
+		d.Manual = true
+		d.Runtime = true
+		d.Source = ""
+		d.Categories = nil
+	}
+
+	if d.Block == "" && c.wildcard.len() > 0 {
+		for off, end := dns.NextLabel(key, 0); !end; off, end = dns.NextLabel(key, off) {
+			if !c.filtered(key[off:]) && c.wildcard.has(key[off:]) {
+				cats := c.wildcard.categories(key[off:])
+				if !c.blocking(cats) {
+					continue
+				}
+
+				d.Block = "*." + key[off:]
+				d.Source = c.sourceName(c.wildcard.tag(key[off:]))
+				d.Categories = c.categoryNames(cats)
+				break
+			}
+		}
+	}
+
+	if d.Block == "" && len(c.regexps) > 0 {
+		name := strings.TrimSuffix(key, ".")
+		for i, re := range c.regexps {
+			if c.blocking(c.regexpCats[i]) && re.MatchString(name) {
+				d.Block = "/" + re.String() + "/"
+				d.Source = c.sourceName(c.regexpTags[i])
+				d.Categories = c.categoryNames(c.regexpCats[i])
+				break
+			}
+		}
+	}
+
+	if len(c.allow) > 0 {
+		for off, end := 0, false; !end; off, end = dns.NextLabel(key, off) {
+			if c.allow[key[off:]] {
+				d.Allow = key[off:]
+				break
+			}
+		}
+	}
+
+	switch {
+	case d.Block == "":
+	case d.Allow == "":
+		d.Blocked = true
+	case d.Manual && d.Allow != key:
+		d.Blocked = true
+	}
+
+	return d
 }
@@ -2,9 +2,12 @@ package cache
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +38,268 @@ func Test_BlockCache(t *testing.T) {
 	_, err = cache.Get(testDomain)
 	assert.Error(t, err)
 }
+
+func Test_BlockCacheAllow(t *testing.T) {
+	cache := NewBlockCache()
+
+	cache.Set("example.com.")
+	cache.Set("ads.example.com.")
+	cache.SetManual("tracker.example.com.")
+	cache.SetManual("manual.example.org.")
+	cache.Set("blocked.org.")
+
+	assert.True(t, cache.Blocked("ads.example.com."))
+
+	cache.Allow("Example.com.")
+	cache.Allow("manual.example.org.")
+	assert.Equal(t, 2, cache.AllowLength())
+
+	assert.False(t, cache.Blocked("example.com."))
+	assert.False(t, cache.Blocked("ads.example.com."))
+	assert.True(t, cache.Blocked("tracker.example.com."))
+	assert.False(t, cache.Blocked("manual.example.org."))
+	assert.True(t, cache.Blocked("blocked.org."))
+	assert.False(t, cache.Blocked("notblocked.org."))
+
+	d := cache.Decide("ADS.example.com.")
+	assert.Equal(t, Decision{Block: "ads.example.com.", Allow: "example.com."}, d)
+
+	d = cache.Decide("tracker.example.com.")
+	assert.Equal(t, Decision{Blocked: true, Block: "tracker.example.com.", Allow: "example.com.", Manual: true}, d)
+
+	d = cache.Decide("www.example.com.")
+	assert.Equal(t, Decision{Allow: "example.com."}, d)
+
+	cache.RemoveAllow("example.com.")
+	assert.True(t, cache.Blocked("ads.example.com."))
+}
+
+func Test_BlockCacheRuntime(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	c := NewBlockCache()
+	c.Set("list.example.com.")
+	c.Allow("example.com.")
+
+	c.SetRuntime("Ads.Example.com.", time.Hour)
+	c.SetRuntime("tracker.test.", 0)
+
+	d := c.Decide("ads.example.com.")
+	assert.True(t, d.Blocked)
+	assert.True(t, d.Runtime)
+	assert.Equal(t, "example.com.", d.Allow)
+
+	assert.True(t, c.Blocked("tracker.test."))
+	assert.False(t, c.Blocked("list.example.com."))
+	assert.False(t, c.Exists("ads.example.com."))
+
+	list := c.Runtime()
+	assert.Len(t, list, 2)
+	assert.Equal(t, "ads.example.com.", list[0].Name)
+	assert.Equal(t, fakeClock.Now().Add(time.Hour), list[0].Expire)
+	assert.True(t, list[1].Expire.IsZero())
+
+	fakeClock.Advance(time.Hour)
+
+	assert.False(t, c.Blocked("ads.example.com."))
+	assert.Len(t, c.Runtime(), 1)
+
+	assert.True(t, c.RemoveRuntime("tracker.test."))
+	assert.False(t, c.RemoveRuntime("tracker.test."))
+	assert.False(t, c.Blocked("tracker.test."))
+	assert.Equal(t, 1, c.Length())
+}
+
+func Test_BlockCacheWildcardRegexp(t *testing.T) {
+	c := NewBlockCache()
+	c.Set("exact.doubleclick.net.")
+	c.SetWildcard("DoubleClick.net.")
+	assert.NoError(t, c.SetRegexp(`^ads[0-9]+\.`))
+	assert.NoError(t, c.SetRegexp(`^ads[0-9]+\.`))
+	assert.Error(t, c.SetRegexp(`([a-z`))
+
+	assert.Equal(t, 1, c.WildcardLength())
+	assert.Equal(t, 1, c.RegexpLength())
+
+	d := c.Decide("exact.doubleclick.net.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, "exact.doubleclick.net.", d.Block)
+
+	d = c.Decide("a.b.c.doubleclick.net.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, "*.doubleclick.net.", d.Block)
+
+	assert.False(t, c.Blocked("doubleclick.net."))
+
+	d = c.Decide("ads42.example.com.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, `/^ads[0-9]+\./`, d.Block)
+
+	assert.False(t, c.Blocked("ads.example.com."))
+
+	c.Allow("example.com.")
+	assert.False(t, c.Blocked("ads42.example.com."))
+}
+
+func Test_BlockCacheReplace(t *testing.T) {
+	c := NewBlockCache()
+	c.Set("old.example.com.")
+	c.Set("kept.example.com.")
+	c.SetManual("manual.example.com.")
+	c.SetWildcard("old.test.")
+	assert.NoError(t, c.SetRegexp(`^older`))
+	c.SetRuntime("runtime.example.com.", 0)
+
+	list := NewBlockCache()
+	list.Set("kept.example.com.")
+	list.Set("new.example.com.")
+	list.SetWildcard("new.test.")
+	assert.NoError(t, list.SetRegexp(`^older`))
+
+	added, removed := c.Replace(list)
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 2, removed)
+
+	assert.False(t, c.Blocked("old.example.com."))
+	assert.True(t, c.Blocked("kept.example.com."))
+	assert.True(t, c.Blocked("new.example.com."))
+	assert.True(t, c.Blocked("manual.example.com."))
+	assert.True(t, c.Blocked("runtime.example.com."))
+	assert.True(t, c.Blocked("a.new.test."))
+	assert.False(t, c.Blocked("a.old.test."))
+	assert.True(t, c.Blocked("older.example.com."))
+	assert.Equal(t, 3, c.Length())
+}
+
+func Test_BlockCacheSource(t *testing.T) {
+	list := NewBlockCache()
+
+	list.SetSource("https://example.com/ads.txt")
+	list.Set("ads.example.com.")
+	list.SetWildcard("tracker.test.")
+
+	list.SetSource("/etc/sdns/local.txt")
+	list.Set("ads.example.com.")
+	list.Set("local.example.com.")
+	assert.NoError(t, list.SetRegexp(`^ad[0-9]+\.`))
+
+	c := NewBlockCache()
+	c.SetManual("manual.example.com.")
+	c.SetRuntime("runtime.example.com.", 0)
+	c.Replace(list)
+
+	assert.Equal(t, "https://example.com/ads.txt", c.Decide("ads.example.com.").Source)
+	assert.Equal(t, "https://example.com/ads.txt", c.Decide("a.tracker.test.").Source)
+	assert.Equal(t, "/etc/sdns/local.txt", c.Decide("local.example.com.").Source)
+	assert.Equal(t, "/etc/sdns/local.txt", c.Decide("ad1.example.org.").Source)
+
+	d := c.Decide("manual.example.com.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, "", d.Source)
+
+	d = c.Decide("runtime.example.com.")
+	assert.True(t, d.Runtime)
+	assert.Equal(t, "", d.Source)
+}
+
+func Test_BlockCacheCategories(t *testing.T) {
+	list := NewBlockCache()
+
+	assert.NoError(t, list.SetCategory("ads"))
+	list.Set("ads.example.com.")
+	list.Set("both.example.com.")
+	list.SetWildcard("ads.test.")
+	assert.NoError(t, list.SetRegexp(`^ad[0-9]+\.`))
+
+	assert.NoError(t, list.SetCategory("tracking"))
+	list.Set("tracker.example.com.")
+	list.Set("both.example.com.")
+	list.SetWildcard("tracker.ads.test.")
+
+	assert.NoError(t, list.SetCategory(""))
+	list.Set("plain.example.com.")
+
+	c := NewBlockCache()
+	c.SetManual("manual.example.com.")
+	c.DisableCategory("ads")
+	c.Replace(list)
+
+	// the disabled category kept over the reloads
+	assert.True(t, c.CategoryDisabled("ads"))
+	assert.False(t, c.Blocked("ads.example.com."))
+	assert.False(t, c.Blocked("a.ads.test."))
+	assert.False(t, c.Blocked("ad1.example.org."))
+
+	// the names also in an enabled category or without a category blocked
+	d := c.Decide("both.example.com.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, []string{"tracking"}, d.Categories)
+
+	d = c.Decide("a.tracker.ads.test.")
+	assert.True(t, d.Blocked)
+	assert.Equal(t, "*.tracker.ads.test.", d.Block)
+
+	assert.True(t, c.Blocked("plain.example.com."))
+	assert.Nil(t, c.Decide("plain.example.com.").Categories)
+
+	c.SetManual("ads.example.com.")
+	assert.True(t, c.Blocked("ads.example.com."))
+	c.Remove("ads.example.com.")
+
+	c.EnableCategory("ads")
+	assert.False(t, c.CategoryDisabled("ads"))
+	assert.True(t, c.Blocked("a.ads.test."))
+	assert.True(t, c.Blocked("ad1.example.org."))
+	assert.Equal(t, []string{"ads", "tracking"}, c.Decide("both.example.com.").Categories)
+
+	c.DisableCategory("tracking")
+
+	assert.Equal(t, []CategoryStats{
+		{Name: "ads", Entries: 3, Disabled: false},
+		{Name: "tracking", Entries: 3, Disabled: true},
+	}, c.Categories())
+
+	for i := 0; i < MaxBlockCategories-2; i++ {
+		assert.NoError(t, list.SetCategory("category"+strconv.Itoa(i)))
+	}
+	assert.NoError(t, list.SetCategory("ads"))
+	assert.Error(t, list.SetCategory("more"))
+}
+
+// benchmarkBlockCacheLookup looks up the names not blocked in the list of the
+// million entries, the common case of the queries
+func benchmarkBlockCacheLookup(b *testing.B, filter bool) {
+	list := NewBlockCache()
+	for i := 0; i < 2000000; i++ {
+		list.Set("ads" + strconv.Itoa(i) + ".tracker-example.com.")
+	}
+
+	c := NewBlockCache()
+	c.Replace(list)
+
+	if !filter {
+		c.filter = nil
+	}
+
+	names := make([]string, 1024)
+	for i := range names {
+		names[i] = "www" + strconv.Itoa(i) + ".example.org."
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if c.Blocked(names[i%len(names)]) {
+			b.Fatal("blocked")
+		}
+	}
+}
+
+func BenchmarkBlockCacheFiltered(b *testing.B) {
+	benchmarkBlockCacheLookup(b, true)
+}
+
+func BenchmarkBlockCacheUnfiltered(b *testing.B) {
+	benchmarkBlockCacheLookup(b, false)
+}
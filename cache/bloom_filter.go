@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"math"
+)
+
+// bloomFalsePositive is the false positive rate the filters sized for
+const bloomFalsePositive = 0.01
+
+// bloomFilter is the probabilistic set of the names, a negative answer exact
+// and a positive one may be false. The names not removable, the filter not
+// safe for the concurrent changes.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+// newBloomFilter returns a filter sized for the entries count
+func newBloomFilter(entries int) *bloomFilter {
+	if entries < 1 {
+		entries = 1
+	}
+
+	n := float64(entries)
+	size := uint64(math.Ceil(-n * math.Log(bloomFalsePositive) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Round(float64(size) / n * math.Ln2))
+
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	words := (size + 63) / 64
+
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		size:   words * 64,
+		hashes: hashes,
+	}
+}
+
+// bloomHash returns the fnv-1a hash of the key, not allocated unlike the
+// hash package
+func bloomHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// add sets the bits of the key, the bit indexes derived from the two halves
+// of the hash
+func (f *bloomFilter) add(key string) {
+	h := bloomHash(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) has(key string) bool {
+	h := bloomHash(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
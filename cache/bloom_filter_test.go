@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_bloomFilter(t *testing.T) {
+	count := 100000
+
+	f := newBloomFilter(count)
+	assert.True(t, f.hashes > 1)
+
+	for i := 0; i < count; i++ {
+		f.add("ads" + strconv.Itoa(i) + ".example.com.")
+	}
+
+	for i := 0; i < count; i++ {
+		assert.True(t, f.has("ads"+strconv.Itoa(i)+".example.com."))
+	}
+
+	positives := 0
+	for i := 0; i < count; i++ {
+		if f.has("www" + strconv.Itoa(i) + ".example.org.") {
+			positives++
+		}
+	}
+
+	// the false positives near the sized rate
+	assert.True(t, float64(positives)/float64(count) < 2*bloomFalsePositive, strconv.Itoa(positives))
+}
+
+func Test_BlockCacheFilter(t *testing.T) {
+	list := NewBlockCache()
+	list.Set("ads.example.com.")
+	list.SetWildcard("tracker.test.")
+
+	c := NewBlockCache()
+	c.Replace(list)
+	assert.NotNil(t, c.filter)
+
+	assert.True(t, c.Blocked("ADS.example.com."))
+	assert.True(t, c.Exists("ads.example.com."))
+	assert.True(t, c.Blocked("a.b.tracker.test."))
+	assert.False(t, c.Blocked("www.example.com."))
+
+	// the entries set after the load added into the filter
+	c.Set("late.example.com.")
+	c.SetWildcard("late.test.")
+	assert.True(t, c.Blocked("late.example.com."))
+	assert.True(t, c.Blocked("a.late.test."))
+
+	// the removed entries left in the filter, checked exactly
+	c.Remove("ads.example.com.")
+	assert.False(t, c.Blocked("ads.example.com."))
+}
@@ -14,4 +14,8 @@ var (
 	ErrCacheNotFound = errors.New("cache not found")
 	// ErrCacheExpired error
 	ErrCacheExpired = errors.New("cache expired")
+	// ErrCacheDump error
+	ErrCacheDump = errors.New("cache dump invalid")
+	// ErrFlightTimeout error
+	ErrFlightTimeout = errors.New("shared lookup timed out")
 )
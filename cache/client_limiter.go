@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit results of the ClientLimiter
+const (
+	// LimitAllow means the client under the rate
+	LimitAllow = iota
+	// LimitSlip means the client over the rate, answer should be truncated
+	LimitSlip
+	// LimitDrop means the client over the hard cap, query should be dropped
+	LimitDrop
+)
+
+// ClientLimiter is a token bucket rate limiter per client, the least
+// recently used buckets evicted when the size reached
+type ClientLimiter struct {
+	mu sync.Mutex
+
+	rate  float64
+	burst float64
+	hard  float64
+	size  int
+
+	ll *list.List
+	m  map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	hard   float64
+	last   time.Time
+}
+
+// NewClientLimiter returns a new limiter with the rate and burst per second,
+// the hard cap is the rate which the queries dropped above, 0 for never drop
+func NewClientLimiter(rate, burst, hard, size int) *ClientLimiter {
+	if burst < rate {
+		burst = rate
+	}
+
+	return &ClientLimiter{
+		rate:  float64(rate),
+		burst: float64(burst),
+		hard:  float64(hard),
+		size:  size,
+		ll:    list.New(),
+		m:     make(map[string]*list.Element),
+	}
+}
+
+// Limit takes a token from the bucket of the client and returns the limit result
+func (l *ClientLimiter) Limit(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := WallClock.Now()
+
+	var b *bucket
+	if el, ok := l.m[key]; ok {
+		l.ll.MoveToFront(el)
+		b = el.Value.(*bucket)
+
+		elapsed := now.Sub(b.last).Seconds()
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.hard = math.Min(l.hardBurst(), b.hard+elapsed*l.hard)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, hard: l.hardBurst(), last: now}
+		l.m[key] = l.ll.PushFront(b)
+
+		if l.ll.Len() > l.size {
+			el := l.ll.Back()
+			l.ll.Remove(el)
+			delete(l.m, el.Value.(*bucket).key)
+		}
+	}
+
+	if l.hard > 0 {
+		if b.hard < 1 {
+			return LimitDrop
+		}
+		b.hard--
+	}
+
+	if b.tokens < 1 {
+		return LimitSlip
+	}
+	b.tokens--
+
+	return LimitAllow
+}
+
+// Len returns the number of the tracked clients
+func (l *ClientLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ll.Len()
+}
+
+func (l *ClientLimiter) hardBurst() float64 {
+	if l.hard > l.burst {
+		return l.hard
+	}
+
+	return l.burst
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClientLimiter(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	l := NewClientLimiter(2, 4, 0, 10)
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+	}
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.2"))
+
+	fakeClock.Advance(time.Second)
+
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.1"))
+
+	fakeClock.Advance(time.Hour)
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+	}
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.1"))
+}
+
+func Test_ClientLimiterHard(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	l := NewClientLimiter(1, 1, 3, 10)
+
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.1"))
+	assert.Equal(t, LimitDrop, l.Limit("192.0.2.1"))
+
+	fakeClock.Advance(time.Second)
+
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.1"))
+}
+
+func Test_ClientLimiterEvict(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	l := NewClientLimiter(1, 1, 0, 3)
+
+	for i := 0; i < 5; i++ {
+		l.Limit(fmt.Sprintf("192.0.2.%d", i))
+	}
+	assert.Equal(t, 3, l.Len())
+
+	// least recently used evicted, the bucket starts full again
+	assert.Equal(t, LimitAllow, l.Limit("192.0.2.0"))
+	assert.Equal(t, LimitSlip, l.Limit("192.0.2.4"))
+}
@@ -6,34 +6,27 @@ import (
 
 // ErrorCache type
 type ErrorCache struct {
-	shards [shardSize]*shard
+	shards shards
 	ttl    uint32
 }
 
-// NewErrorCache return new cache
-func NewErrorCache(size int, ttl uint32) *ErrorCache {
-	ssize := size / shardSize
-	if ssize < 4 {
-		ssize = 4
+// NewErrorCache return new cache, the entries spread over the
+// shard count, DefaultShards if not given
+func NewErrorCache(size int, ttl uint32, shards ...int) *ErrorCache {
+	count := 0
+	if len(shards) > 0 {
+		count = shards[0]
 	}
 
-	c := &ErrorCache{
-		ttl: ttl,
+	return &ErrorCache{
+		shards: newShards(size, count),
+		ttl:    ttl,
 	}
-
-	// Initialize all the shards
-	for i := 0; i < shardSize; i++ {
-		c.shards[i] = newShard(ssize)
-	}
-
-	return c
 }
 
 // Get returns the entry for a key or an error
 func (c *ErrorCache) Get(key uint64) error {
-	shard := key & (shardSize - 1)
-
-	el, ok := c.shards[shard].Get(key)
+	el, ok := c.shards.shard(key).Get(key)
 
 	if !ok {
 		return ErrCacheNotFound
@@ -58,23 +51,17 @@ func (c *ErrorCache) Get(key uint64) error {
 
 // Set sets a keys value to a error cache
 func (c *ErrorCache) Set(key uint64) error {
-	shard := key & (shardSize - 1)
-	c.shards[shard].Set(key, WallClock.Now().Truncate(time.Second))
+	c.shards.shard(key).Set(key, WallClock.Now().Truncate(time.Second))
 
 	return nil
 }
 
 // Remove removes an entry from the cache
 func (c *ErrorCache) Remove(key uint64) {
-	shard := key & (shardSize - 1)
-	c.shards[shard].Remove(key)
+	c.shards.shard(key).Remove(key)
 }
 
 // Len returns the caches length
 func (c *ErrorCache) Len() int {
-	l := 0
-	for _, s := range c.shards {
-		l += s.Len()
-	}
-	return l
+	return c.shards.Len()
 }
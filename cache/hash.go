@@ -31,3 +31,16 @@ func Hash(q dns.Question, cd ...bool) uint64 {
 
 	return h.Sum64()
 }
+
+// HashScope returns a new hash of the key within the scope
+func HashScope(key uint64, scope string) uint64 {
+	h := fnv.New64()
+	buf := bytes.NewBuffer(nil)
+
+	binary.Write(buf, binary.BigEndian, key)
+	buf.WriteString(scope)
+
+	h.Write(buf.Bytes())
+
+	return h.Sum64()
+}
@@ -20,6 +20,16 @@ func Test_Hash(t *testing.T) {
 	assert.NotEqual(t, asset, uint64(3399771970408683746))
 }
 
+func Test_HashScope(t *testing.T) {
+	q := dns.Question{Name: "goOgle.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}
+
+	key := Hash(q)
+
+	assert.NotEqual(t, key, HashScope(key, "203.0.113.0/24/0"))
+	assert.Equal(t, HashScope(key, "203.0.113.0/24/0"), HashScope(key, "203.0.113.0/24/0"))
+	assert.NotEqual(t, HashScope(key, "203.0.113.0/24/0"), HashScope(key, "198.51.100.0/24/0"))
+}
+
 func Benchmark_Hash(b *testing.B) {
 	q := dns.Question{Name: "goOgle.com.", Qtype: dns.TypeA, Qclass: dns.ClassANY}
 
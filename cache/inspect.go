@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Entry is the state of a cache entry for the inspection
+type Entry struct {
+	Rcode  int
+	Answer []dns.RR
+	Ns     []dns.RR
+
+	// TTL is the remaining seconds to the expiry, zero for the stale entries
+	TTL   uint32
+	Stale bool
+}
+
+func newEntry(i *item, store, expire, now time.Time) *Entry {
+	elapsed := uint32(now.Sub(store).Seconds())
+
+	e := &Entry{
+		Rcode:  i.Rcode,
+		Answer: make([]dns.RR, len(i.Answer)),
+		Ns:     make([]dns.RR, len(i.Ns)),
+		Stale:  !now.Before(expire),
+	}
+
+	if !e.Stale {
+		e.TTL = uint32(expire.Sub(now).Seconds())
+	}
+
+	for j, r := range i.Answer {
+		e.Answer[j] = dns.Copy(r)
+		decreaseTTL(e.Answer[j], elapsed, 0, 0)
+	}
+	for j, r := range i.Ns {
+		e.Ns[j] = dns.Copy(r)
+		decreaseTTL(e.Ns[j], elapsed, 0, 0)
+	}
+
+	return e
+}
+
+// hasName reports whether the item cached for the name
+func (i *item) hasName(name string) bool {
+	return len(i.Question) > 0 && strings.EqualFold(i.Question[0].Name, name)
+}
+
+// Peek returns the entry for a key without counting a hit, the stale
+// entries returned too
+func (c *QueryCache) Peek(key uint64) (*Entry, bool) {
+	query, now, err := c.get(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return newEntry(query.Item, query.StoreTime, query.ExpireTime, now), true
+}
+
+// PurgeName removes the entries of all types and scopes of the name,
+// returns the removed count
+func (c *QueryCache) PurgeName(name string) int {
+	return c.removeFunc(func(query *Query) bool {
+		return query.Item.hasName(name)
+	})
+}
+
+// Flush removes all entries
+func (c *QueryCache) Flush() {
+	if c.backend == Backend(c.local) {
+		c.local.shards.Clear()
+		return
+	}
+
+	c.removeFunc(func(*Query) bool { return true })
+}
+
+// removeFunc removes the entries of the backend which the function reports
+// true for, the local entries only if the backend can't
+func (c *QueryCache) removeFunc(fn func(query *Query) bool) int {
+	if p, ok := c.backend.(Purger); ok {
+		return p.RemoveFunc(fn)
+	}
+
+	return c.local.RemoveFunc(fn)
+}
+
+// Peek returns the negative answer for a key
+func (c *NegativeCache) Peek(key uint64) (*Entry, bool) {
+	el, ok := c.shards.shard(key).Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	neg, ok := el.(*negative)
+	if !ok {
+		return nil, false
+	}
+
+	now := WallClock.Now().Truncate(time.Second)
+	if !now.Before(neg.ExpireTime) {
+		return nil, false
+	}
+
+	return newEntry(neg.Item, neg.StoreTime, neg.ExpireTime, now), true
+}
+
+// PurgeName removes the negative answers of all types and scopes of the
+// name, returns the removed count
+func (c *NegativeCache) PurgeName(name string) int {
+	return c.shards.RemoveFunc(func(el interface{}) bool {
+		neg, ok := el.(*negative)
+		return ok && neg.Item.hasName(name)
+	})
+}
+
+// Flush removes all entries
+func (c *NegativeCache) Flush() {
+	c.shards.Clear()
+}
+
+// Flush removes all entries
+func (c *ErrorCache) Flush() {
+	c.shards.Clear()
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_QueryCacheInspect(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	c := NewQueryCache(1024, 0, time.Hour)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	key := Hash(m.Question[0])
+	assert.NoError(t, c.Set(key, m))
+
+	aaaa := m.Copy()
+	aaaa.Question[0].Qtype = dns.TypeAAAA
+	assert.NoError(t, c.Set(Hash(aaaa.Question[0]), aaaa))
+	assert.NoError(t, c.Set(HashScope(key, "192.0.2.0/24/0"), m))
+
+	other := m.Copy()
+	other.Question[0].Name = "example.com."
+	assert.NoError(t, c.Set(Hash(other.Question[0]), other))
+
+	fakeClock.Advance(100 * time.Second)
+
+	e, ok := c.Peek(key)
+	assert.True(t, ok)
+	assert.False(t, e.Stale)
+	assert.Equal(t, uint32(200), e.TTL)
+	if assert.Len(t, e.Answer, 1) {
+		assert.Equal(t, uint32(200), e.Answer[0].Header().Ttl)
+	}
+
+	fakeClock.Advance(300 * time.Second)
+
+	e, ok = c.Peek(key)
+	assert.True(t, ok)
+	assert.True(t, e.Stale)
+	assert.Equal(t, uint32(0), e.TTL)
+
+	_, ok = c.Peek(Hash(dns.Question{Name: "notfound.", Qtype: dns.TypeA}))
+	assert.False(t, ok)
+
+	assert.Equal(t, 3, c.PurgeName("WWW.example.com."))
+	assert.Equal(t, 1, c.Len())
+
+	c.Flush()
+	assert.Equal(t, 0, c.Len())
+}
+
+func Test_NegativeCacheInspect(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	c := NewNegativeCache(1024)
+
+	m := new(dns.Msg)
+	m.SetQuestion("nx.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 60")
+	m.Ns = append(m.Ns, soa)
+
+	key := Hash(m.Question[0])
+	assert.NoError(t, c.Set(key, m, 60))
+
+	e, ok := c.Peek(key)
+	assert.True(t, ok)
+	assert.Equal(t, dns.RcodeNameError, e.Rcode)
+	assert.Equal(t, uint32(60), e.TTL)
+	assert.Len(t, e.Ns, 1)
+
+	assert.Equal(t, 0, c.PurgeName("example.com."))
+	assert.Equal(t, 1, c.PurgeName("nx.example.com."))
+
+	_, ok = c.Peek(key)
+	assert.False(t, ok)
+
+	assert.NoError(t, c.Set(key, m, 60))
+	c.Flush()
+	assert.Equal(t, 0, c.Len())
+}
+
+func Test_QueryCachePurgeConcurrent(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	c := NewQueryCache(1024, 0, 0)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	key := Hash(m.Question[0])
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				c.Set(key, m)
+				c.Get(key, m)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				c.PurgeName("www.example.com.")
+				c.Flush()
+			}
+		}()
+	}
+
+	wg.Wait()
+}
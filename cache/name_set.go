@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"sort"
+)
+
+// nameSetMinMerge is the least additions merged into the packed names at once
+const nameSetMinMerge = 1 << 14
+
+// nameSet is the memory compact set of the names for the large lists, the
+// names packed sorted into one buffer and searched binary. The additions
+// kept in a map until merged into the buffer, the set not safe for the
+// concurrent changes.
+type nameSet struct {
+	data    []byte
+	offsets []uint32
+
+	// tags are the source tags of the packed names, zero for none; cats
+	// the category bits of the sources the names listed in
+	tags []uint16
+	cats []uint16
+
+	added map[string]nameTags
+}
+
+// nameTags are the source tag and the category bits of a name
+type nameTags struct {
+	tag  uint16
+	cats uint16
+}
+
+func newNameSet() *nameSet {
+	return &nameSet{added: make(map[string]nameTags)}
+}
+
+// at returns the packed name of the index, the conversions of it in the
+// comparisons not allocated
+func (s *nameSet) at(i int) []byte {
+	end := len(s.data)
+	if i+1 < len(s.offsets) {
+		end = int(s.offsets[i+1])
+	}
+
+	return s.data[s.offsets[i]:end]
+}
+
+// search returns the index of the packed name, false if not packed
+func (s *nameSet) search(key string) (int, bool) {
+	i := sort.Search(len(s.offsets), func(i int) bool { return string(s.at(i)) >= key })
+
+	return i, i < len(s.offsets) && string(s.at(i)) == key
+}
+
+func (s *nameSet) has(key string) bool {
+	if _, ok := s.added[key]; ok {
+		return true
+	}
+
+	_, ok := s.search(key)
+
+	return ok
+}
+
+// tag returns the source tag of the name, zero if none or not in the set
+func (s *nameSet) tag(key string) uint16 {
+	if t, ok := s.added[key]; ok {
+		return t.tag
+	}
+
+	if i, ok := s.search(key); ok {
+		return s.tags[i]
+	}
+
+	return 0
+}
+
+// categories returns the category bits of the name, zero if none or not in
+// the set
+func (s *nameSet) categories(key string) uint16 {
+	if t, ok := s.added[key]; ok {
+		return t.cats
+	}
+
+	if i, ok := s.search(key); ok {
+		return s.cats[i]
+	}
+
+	return 0
+}
+
+func (s *nameSet) add(key string) {
+	s.addTag(key, 0, 0)
+}
+
+// addTag adds the name with the source tag and the category bits, the tag of
+// the names already in the set kept and the categories joined
+func (s *nameSet) addTag(key string, tag, cats uint16) {
+	if t, ok := s.added[key]; ok {
+		t.cats |= cats
+		s.added[key] = t
+		return
+	}
+
+	if i, ok := s.search(key); ok {
+		s.cats[i] |= cats
+		return
+	}
+
+	s.added[key] = nameTags{tag: tag, cats: cats}
+
+	if len(s.added) >= nameSetMinMerge && len(s.added) >= len(s.offsets)/4 {
+		s.merge()
+	}
+}
+
+// remove removes the name, the packed names copied without it
+func (s *nameSet) remove(key string) {
+	if _, ok := s.added[key]; ok {
+		delete(s.added, key)
+		return
+	}
+
+	i, ok := s.search(key)
+	if !ok {
+		return
+	}
+
+	size := uint32(len(key))
+
+	data := make([]byte, 0, len(s.data)-len(key))
+	data = append(data, s.data[:s.offsets[i]]...)
+	data = append(data, s.data[int(s.offsets[i])+len(key):]...)
+
+	offsets := make([]uint32, 0, len(s.offsets)-1)
+	offsets = append(offsets, s.offsets[:i]...)
+	for _, off := range s.offsets[i+1:] {
+		offsets = append(offsets, off-size)
+	}
+
+	tags := make([]uint16, 0, len(s.tags)-1)
+	tags = append(tags, s.tags[:i]...)
+	tags = append(tags, s.tags[i+1:]...)
+
+	cats := make([]uint16, 0, len(s.cats)-1)
+	cats = append(cats, s.cats[:i]...)
+	cats = append(cats, s.cats[i+1:]...)
+
+	s.data, s.offsets, s.tags, s.cats = data, offsets, tags, cats
+}
+
+func (s *nameSet) len() int {
+	return len(s.offsets) + len(s.added)
+}
+
+// merge packs the additions into the sorted names
+func (s *nameSet) merge() {
+	if len(s.added) == 0 {
+		return
+	}
+
+	added := make([]string, 0, len(s.added))
+	size := 0
+	for key := range s.added {
+		added = append(added, key)
+		size += len(key)
+	}
+	sort.Strings(added)
+
+	data := make([]byte, 0, len(s.data)+size)
+	offsets := make([]uint32, 0, len(s.offsets)+len(added))
+	tags := make([]uint16, 0, len(s.offsets)+len(added))
+	cats := make([]uint16, 0, len(s.offsets)+len(added))
+
+	i, j := 0, 0
+	for i < len(s.offsets) || j < len(added) {
+		offsets = append(offsets, uint32(len(data)))
+
+		if j == len(added) || (i < len(s.offsets) && string(s.at(i)) < added[j]) {
+			data = append(data, s.at(i)...)
+			tags = append(tags, s.tags[i])
+			cats = append(cats, s.cats[i])
+			i++
+		} else {
+			data = append(data, added[j]...)
+			t := s.added[added[j]]
+			tags = append(tags, t.tag)
+			cats = append(cats, t.cats)
+			j++
+		}
+	}
+
+	s.data, s.offsets, s.tags, s.cats = data, offsets, tags, cats
+	s.added = make(map[string]nameTags)
+}
+
+// clone returns the copy of the set with the additions merged
+func (s *nameSet) clone() *nameSet {
+	s.merge()
+
+	return &nameSet{
+		data:    append([]byte(nil), s.data...),
+		offsets: append([]uint32(nil), s.offsets...),
+		tags:    append([]uint16(nil), s.tags...),
+		cats:    append([]uint16(nil), s.cats...),
+		added:   make(map[string]nameTags),
+	}
+}
+
+// each calls fn with the names until it returns false
+func (s *nameSet) each(fn func(key string) bool) {
+	for i := range s.offsets {
+		if !fn(string(s.at(i))) {
+			return
+		}
+	}
+
+	for key := range s.added {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+// eachCategories calls fn with the category bits of the names
+func (s *nameSet) eachCategories(fn func(cats uint16)) {
+	for _, cats := range s.cats {
+		fn(cats)
+	}
+
+	for _, t := range s.added {
+		fn(t.cats)
+	}
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nameSet(t *testing.T) {
+	s := newNameSet()
+
+	s.add("b.example.com.")
+	s.add("a.example.com.")
+	s.add("a.example.com.")
+	assert.Equal(t, 2, s.len())
+
+	s.merge()
+	assert.Equal(t, 2, s.len())
+	assert.True(t, s.has("a.example.com."))
+	assert.True(t, s.has("b.example.com."))
+	assert.False(t, s.has("example.com."))
+
+	s.add("c.example.com.")
+	s.remove("a.example.com.")
+	s.remove("c.example.com.")
+	assert.Equal(t, 1, s.len())
+	assert.False(t, s.has("a.example.com."))
+	assert.True(t, s.has("b.example.com."))
+
+	var names []string
+	s.each(func(key string) bool {
+		names = append(names, key)
+		return true
+	})
+	assert.Equal(t, []string{"b.example.com."}, names)
+}
+
+func Test_nameSetMerge(t *testing.T) {
+	s := newNameSet()
+
+	count := 3 * nameSetMinMerge
+	for i := count - 1; i >= 0; i-- {
+		s.add("host" + strconv.Itoa(i) + ".example.com.")
+	}
+
+	// the additions merged into the packed names on the way
+	assert.True(t, len(s.offsets) >= nameSetMinMerge)
+	assert.Equal(t, count, s.len())
+
+	c := s.clone()
+	assert.Len(t, c.added, 0)
+	assert.Equal(t, count, c.len())
+
+	for i := 0; i < count; i++ {
+		assert.True(t, c.has("host"+strconv.Itoa(i)+".example.com."))
+	}
+
+	for i := 1; i < len(c.offsets); i++ {
+		assert.True(t, string(c.at(i-1)) < string(c.at(i)))
+	}
+
+	c.remove("host0.example.com.")
+	assert.False(t, c.has("host0.example.com."))
+	assert.True(t, c.has("host1.example.com."))
+	assert.Equal(t, count-1, c.len())
+}
+
+func Test_nameSetTags(t *testing.T) {
+	s := newNameSet()
+
+	s.addTag("b.example.com.", 2, 0)
+	s.addTag("a.example.com.", 1, 1)
+	s.addTag("a.example.com.", 3, 4)
+	s.add("c.example.com.")
+
+	assert.Equal(t, uint16(1), s.tag("a.example.com."))
+
+	s.merge()
+	assert.Equal(t, uint16(1), s.tag("a.example.com."))
+	assert.Equal(t, uint16(2), s.tag("b.example.com."))
+	assert.Equal(t, uint16(0), s.tag("c.example.com."))
+	assert.Equal(t, uint16(0), s.tag("d.example.com."))
+
+	// the categories of the sources joined, the packed names too
+	assert.Equal(t, uint16(5), s.categories("a.example.com."))
+	s.addTag("b.example.com.", 3, 2)
+	assert.Equal(t, uint16(2), s.categories("b.example.com."))
+	assert.Equal(t, uint16(2), s.tag("b.example.com."))
+	assert.Equal(t, uint16(0), s.categories("d.example.com."))
+
+	c := s.clone()
+	c.remove("a.example.com.")
+	assert.Equal(t, uint16(2), c.tag("b.example.com."))
+	assert.Equal(t, uint16(2), c.categories("b.example.com."))
+	assert.Equal(t, uint16(1), s.tag("a.example.com."))
+}
+
+func benchmarkNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "ads" + strconv.Itoa(i) + ".tracker-example.com."
+	}
+
+	return names
+}
+
+// heapBytesPerEntry reports the heap growth per entry of the set filled
+func heapBytesPerEntry(b *testing.B, fill func(names []string) interface{}) {
+	names := benchmarkNames(100000)
+
+	var before, after runtime.MemStats
+	var keep interface{}
+
+	for i := 0; i < b.N; i++ {
+		keep = nil
+
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		// the names allocated apart as the list loading does, the set keeps
+		// them or its own copy
+		copies := make([]string, len(names))
+		for j, name := range names {
+			copies[j] = string([]byte(name))
+		}
+
+		keep = fill(copies)
+		copies = nil
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+	}
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(names)), "bytes/entry")
+	runtime.KeepAlive(keep)
+}
+
+func Benchmark_BlockMapMemory(b *testing.B) {
+	heapBytesPerEntry(b, func(names []string) interface{} {
+		m := make(map[string]bool)
+		for _, name := range names {
+			m[name] = true
+		}
+		return m
+	})
+}
+
+func Benchmark_BlockNameSetMemory(b *testing.B) {
+	heapBytesPerEntry(b, func(names []string) interface{} {
+		s := newNameSet()
+		for _, name := range names {
+			s.add(name)
+		}
+		s.merge()
+		return s
+	})
+}
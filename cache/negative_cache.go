@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type negative struct {
+	Item *item
+
+	StoreTime  time.Time
+	ExpireTime time.Time
+}
+
+// NegativeCache type, keeps the NXDOMAIN and NODATA answers apart
+// from the positive answers
+type NegativeCache struct {
+	shards shards
+}
+
+// NewNegativeCache return new cache, the entries spread over the
+// shard count, DefaultShards if not given
+func NewNegativeCache(size int, shards ...int) *NegativeCache {
+	count := 0
+	if len(shards) > 0 {
+		count = shards[0]
+	}
+
+	return &NegativeCache{shards: newShards(size, count)}
+}
+
+// Get returns the negative answer for a key or an error
+func (c *NegativeCache) Get(key uint64, req *dns.Msg) (*dns.Msg, error) {
+	el, ok := c.shards.shard(key).Get(key)
+
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+
+	neg, ok := el.(*negative)
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	if !now.Before(neg.ExpireTime) {
+		c.Remove(key)
+		return nil, ErrCacheExpired
+	}
+
+	elapsed := uint32(now.Sub(neg.StoreTime).Seconds())
+
+	return neg.Item.toMsg(req, elapsed, 1, 0), nil
+}
+
+// Set sets a keys value to a negative answer for ttl seconds, the
+// authority records TTLs lowered to the ttl
+func (c *NegativeCache) Set(key uint64, msg *dns.Msg, ttl uint32) error {
+	now := WallClock.Now().Truncate(time.Second)
+
+	i := newItem(msg)
+	for _, rr := range i.Ns {
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+	}
+
+	c.shards.shard(key).SetSized(key, &negative{
+		Item:       i,
+		StoreTime:  now,
+		ExpireTime: now.Add(time.Duration(ttl) * time.Second),
+	}, i.size())
+
+	return nil
+}
+
+// Ancestor returns the negative answer of the name or of its closest ancestor
+// below the root with the name of the entry, the keys of the names given by
+// the key function
+func (c *NegativeCache) Ancestor(name string, req *dns.Msg, key func(name string) uint64) (*dns.Msg, string, error) {
+	if name == "." || name == "" {
+		return nil, "", ErrCacheNotFound
+	}
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if msg, err := c.Get(key(name[off:]), req); err == nil {
+			return msg, name[off:], nil
+		}
+	}
+
+	return nil, "", ErrCacheNotFound
+}
+
+// Remove removes an entry from the cache
+func (c *NegativeCache) Remove(key uint64) {
+	c.shards.shard(key).Remove(key)
+}
+
+// Len returns the caches length
+func (c *NegativeCache) Len() int {
+	return c.shards.Len()
+}
+
+// Bytes returns the estimated memory of the entries in bytes
+func (c *NegativeCache) Bytes() int64 {
+	return c.shards.Bytes()
+}
+
+// SetMaxBytes limits the estimated memory of the entries, zero for no limit
+func (c *NegativeCache) SetMaxBytes(max int64) {
+	c.shards.setMaxBytes(max)
+}
+
+// IsNegative returns whether the message is a NXDOMAIN or NODATA answer
+func IsNegative(m *dns.Msg) bool {
+	if m.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	return m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0
+}
+
+// NegativeTTL returns the TTL of a negative answer, the lower of the SOA
+// record TTL and its MINIMUM field (RFC 2308)
+func NegativeTTL(m *dns.Msg) (uint32, bool) {
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Header().Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		return ttl, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NegativeCache(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Rcode = dns.RcodeNameError
+
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	assert.NoError(t, err)
+	m.Ns = append(m.Ns, soa)
+
+	assert.True(t, IsNegative(m))
+
+	ttl, ok := NegativeTTL(m)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+
+	c := NewNegativeCache(1)
+	key := Hash(req.Question[0])
+
+	_, err = c.Get(key, req)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	assert.NoError(t, c.Set(key, m, ttl))
+	assert.Equal(t, 1, c.Len())
+
+	fakeClock.Advance(100 * time.Second)
+
+	msg, err := c.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Equal(t, uint32(200), msg.Ns[0].Header().Ttl)
+
+	// the cached entry is a copy
+	assert.Equal(t, uint32(3600), soa.Header().Ttl)
+
+	fakeClock.Advance(200 * time.Second)
+
+	_, err = c.Get(key, req)
+	assert.Equal(t, ErrCacheExpired, err)
+	assert.Equal(t, 0, c.Len())
+
+	c.Set(key, m, 60)
+	c.Remove(key)
+	assert.Equal(t, 0, c.Len())
+}
+
+func Test_NegativeTTL(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeAAAA)
+
+	_, ok := NegativeTTL(m)
+	assert.False(t, ok)
+	assert.True(t, IsNegative(m))
+
+	soa, _ := dns.NewRR("example.com. 120 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	m.Ns = append(m.Ns, soa)
+
+	ttl, ok := NegativeTTL(m)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(120), ttl)
+
+	rr, _ := dns.NewRR("example.com. 60 IN AAAA ::1")
+	m.Answer = append(m.Answer, rr)
+	assert.False(t, IsNegative(m))
+
+	m.Rcode = dns.RcodeServerFailure
+	m.Answer = nil
+	assert.False(t, IsNegative(m))
+}
+
+func Test_NegativeCacheAncestor(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	key := func(name string) uint64 {
+		return Hash(dns.Question{Name: name, Qtype: dns.TypeNone, Qclass: dns.ClassINET})
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("nx.example.com.", dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Rcode = dns.RcodeNameError
+
+	c := NewNegativeCache(1)
+	assert.NoError(t, c.Set(key("nx.example.com."), m, 60))
+
+	req.SetQuestion("a.b.nx.example.com.", dns.TypeAAAA)
+
+	msg, cut, err := c.Ancestor("a.b.nx.example.com.", req, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "nx.example.com.", cut)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Equal(t, "a.b.nx.example.com.", msg.Question[0].Name)
+
+	msg, cut, err = c.Ancestor("nx.example.com.", req, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "nx.example.com.", cut)
+
+	// the siblings and the parents not covered
+	_, _, err = c.Ancestor("other.example.com.", req, key)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	_, _, err = c.Ancestor("example.com.", req, key)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	_, _, err = c.Ancestor(".", req, key)
+	assert.Equal(t, ErrCacheNotFound, err)
+}
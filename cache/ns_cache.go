@@ -12,6 +12,7 @@ type NS struct {
 	Servers    *AuthServers
 	Network    string
 	DSRR       []dns.RR
+	Names      []string
 	TTL        uint32
 	UpdateTime time.Time
 
@@ -23,12 +24,15 @@ type NSCache struct {
 	mu sync.RWMutex
 
 	m map[uint64]*NS
+
+	done chan struct{}
 }
 
 // NewNSCache return new cache
 func NewNSCache() *NSCache {
 	c := &NSCache{
-		m: make(map[uint64]*NS),
+		m:    make(map[uint64]*NS),
+		done: make(chan struct{}),
 	}
 
 	go c.run()
@@ -63,8 +67,8 @@ func (c *NSCache) Get(key uint64) (*NS, error) {
 	return ns, nil
 }
 
-// Set sets a keys value to a NS
-func (c *NSCache) Set(key uint64, dsRR []dns.RR, ttl uint32, servers *AuthServers) {
+// Set sets a keys value to a NS, names are the name server names of the zone
+func (c *NSCache) Set(key uint64, dsRR []dns.RR, ttl uint32, servers *AuthServers, names ...string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -72,6 +76,7 @@ func (c *NSCache) Set(key uint64, dsRR []dns.RR, ttl uint32, servers *AuthServer
 		Servers:    servers,
 		Network:    "v4",
 		DSRR:       dsRR,
+		Names:      names,
 		TTL:        ttl,
 		UpdateTime: WallClock.Now().Truncate(time.Second),
 	}
@@ -122,10 +127,22 @@ func (c *NSCache) clear() {
 	}
 }
 
+// Stop ends the cleaning of the expired entries, called once when the cache
+// not used anymore
+func (c *NSCache) Stop() {
+	close(c.done)
+}
+
 func (c *NSCache) run() {
 	ticker := time.NewTicker(time.Hour)
-
-	for range ticker.C {
-		c.clear()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.clear()
+		case <-c.done:
+			return
+		}
 	}
 }
@@ -56,4 +56,5 @@ func Test_NSCache(t *testing.T) {
 	cache.clear()
 	assert.Equal(t, cache.Length(), 0)
 
+	cache.Stop()
 }
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MaxNSECRecords is the maximum number of the NSEC3 owners kept per zone
+const MaxNSECRecords = 4096
+
+// NSECCache type, keeps the validated NSEC3 chains by zone
+type NSECCache struct {
+	mu sync.RWMutex
+
+	m map[string]*nsecZone
+
+	done chan struct{}
+}
+
+type nsecZone struct {
+	soa    []dns.RR
+	expire time.Time
+
+	records map[string]*nsecRecord
+}
+
+type nsecRecord struct {
+	rrs    []dns.RR
+	expire time.Time
+}
+
+// NewNSECCache return new cache
+func NewNSECCache() *NSECCache {
+	c := &NSECCache{
+		m:    make(map[string]*nsecZone),
+		done: make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Set adds the NSEC3 records with their signatures to the zone chain,
+// records are kept no longer than the SOA minimum TTL
+func (c *NSECCache) Set(zone string, nsec, soa []dns.RR) {
+	var limit uint32
+
+	for _, rr := range soa {
+		if s, ok := rr.(*dns.SOA); ok {
+			limit = lowerTTL(s.Header().Ttl, s.Minttl)
+			break
+		}
+	}
+
+	if limit == 0 {
+		return
+	}
+
+	owners := make(map[string][]dns.RR)
+	for _, rr := range nsec {
+		owner := strings.ToLower(rr.Header().Name)
+		owners[owner] = append(owners[owner], dns.Copy(rr))
+	}
+
+	zone = strings.ToLower(zone)
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z, ok := c.m[zone]
+	if !ok {
+		z = &nsecZone{records: make(map[string]*nsecRecord)}
+		c.m[zone] = z
+	}
+
+	z.soa = copyRRs(soa)
+	z.expire = now.Add(time.Duration(limit) * time.Second)
+
+	for owner, rrs := range owners {
+		if _, ok := z.records[owner]; !ok && len(z.records) >= MaxNSECRecords {
+			continue
+		}
+
+		ttl := limit
+		for _, rr := range rrs {
+			ttl = lowerTTL(ttl, rr.Header().Ttl)
+		}
+
+		z.records[owner] = &nsecRecord{rrs: rrs, expire: now.Add(time.Duration(ttl) * time.Second)}
+	}
+}
+
+// Get returns the unexpired NSEC3 records with their signatures and
+// the SOA records of the zone, TTLs are set to the remaining lifetime
+func (c *NSECCache) Get(zone string) (nsec, soa []dns.RR) {
+	zone = strings.ToLower(zone)
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	z, ok := c.m[zone]
+	if !ok {
+		return nil, nil
+	}
+
+	if !now.Before(z.expire) {
+		delete(c.m, zone)
+		return nil, nil
+	}
+
+	for owner, r := range z.records {
+		if !now.Before(r.expire) {
+			delete(z.records, owner)
+			continue
+		}
+
+		ttl := uint32(r.expire.Sub(now).Seconds())
+		for _, rr := range r.rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			nsec = append(nsec, rr)
+		}
+	}
+
+	if len(nsec) == 0 {
+		delete(c.m, zone)
+		return nil, nil
+	}
+
+	ttl := uint32(z.expire.Sub(now).Seconds())
+	for _, rr := range z.soa {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		soa = append(soa, rr)
+	}
+
+	return nsec, soa
+}
+
+// Remove removes a zone from the cache
+func (c *NSECCache) Remove(zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, strings.ToLower(zone))
+}
+
+// Length returns the caches length, total NSEC3 owners of all zones
+func (c *NSECCache) Length() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var n int
+	for _, z := range c.m {
+		n += len(z.records)
+	}
+
+	return n
+}
+
+func (c *NSECCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	for zone, z := range c.m {
+		if !now.Before(z.expire) {
+			delete(c.m, zone)
+			continue
+		}
+
+		for owner, r := range z.records {
+			if !now.Before(r.expire) {
+				delete(z.records, owner)
+			}
+		}
+	}
+}
+
+// Stop ends the cleaning of the expired entries, called once when the cache
+// not used anymore
+func (c *NSECCache) Stop() {
+	close(c.done)
+}
+
+func (c *NSECCache) run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.clear()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, dns.Copy(rr))
+	}
+
+	return out
+}
+
+func lowerTTL(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
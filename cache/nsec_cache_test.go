@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NSECCache(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	c := NewNSECCache()
+
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	nsec, _ := dns.NewRR("9ja6br7hm1fb0u4jpdbrgc3ov6qe5ah8.example.com. 3600 IN NSEC3 1 0 0 - k0kqcl8qgv0gujjf9h5m1r0pm1bqm5as A RRSIG")
+	sig, _ := dns.NewRR("9ja6br7hm1fb0u4jpdbrgc3ov6qe5ah8.example.com. 3600 IN RRSIG NSEC3 8 3 3600 20300101000000 20180101000000 12345 example.com. dGVzdA==")
+
+	c.Set("Example.com.", []dns.RR{nsec, sig}, []dns.RR{soa})
+	assert.Equal(t, 1, c.Length())
+
+	records, soaSet := c.Get("example.com.")
+	assert.Len(t, records, 2)
+	assert.Len(t, soaSet, 1)
+	assert.Equal(t, uint32(300), records[0].Header().Ttl)
+	assert.Equal(t, uint32(3600), nsec.Header().Ttl)
+
+	fakeClock.Advance(100 * time.Second)
+
+	records, soaSet = c.Get("example.com.")
+	assert.Len(t, records, 2)
+	assert.Equal(t, uint32(200), soaSet[0].Header().Ttl)
+
+	records, _ = c.Get("example.org.")
+	assert.Len(t, records, 0)
+
+	fakeClock.Advance(200 * time.Second)
+
+	records, _ = c.Get("example.com.")
+	assert.Len(t, records, 0)
+	assert.Equal(t, 0, c.Length())
+
+	c.Set("example.com.", []dns.RR{nsec}, nil)
+	assert.Equal(t, 0, c.Length())
+
+	c.Set("example.com.", []dns.RR{nsec}, []dns.RR{soa})
+	c.clear()
+	assert.Equal(t, 1, c.Length())
+
+	c.Remove("example.com.")
+	assert.Equal(t, 0, c.Length())
+}
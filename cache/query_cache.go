@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"math"
 	"sync"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 )
 
 type item struct {
+	Question           []dns.Question
 	Rcode              int
 	Authoritative      bool
 	AuthenticatedData  bool
@@ -20,113 +22,189 @@ type item struct {
 
 // Query represents a cache entry
 type Query struct {
-	Item       *item
-	RateLimit  *rl.RateLimiter
-	UpdateTime time.Time
+	Item      *item
+	RateLimit *rl.RateLimiter
+
+	// StoreTime is when the entry inserted, ExpireTime is when the
+	// lowest TTL elapsed and EvictTime is when the entry removed.
+	StoreTime  time.Time
+	ExpireTime time.Time
+	EvictTime  time.Time
+
+	// Hits is how many times the entry returned, LastAccess is when
+	// the entry returned last time
+	Hits       int64
+	LastAccess time.Time
 
 	mu sync.Mutex
 }
 
+// prefetchPercent is the remaining TTL percentage for prefetching
+const prefetchPercent = 10
+
 // QueryCache type
 type QueryCache struct {
-	shards [shardSize]*shard
-	rate   int
+	local   *memoryBackend
+	backend Backend
+	rate    int
+	stale   time.Duration
 }
 
-// NewQueryCache return new cache
-func NewQueryCache(size int, ratelimit int) *QueryCache {
-	ssize := size / shardSize
-	if ssize < 4 {
-		ssize = 4
+// NewQueryCache return new cache, expired entries kept for
+// the stale duration before eviction. The entries spread over
+// the shard count, DefaultShards if not given.
+func NewQueryCache(size int, ratelimit int, stale time.Duration, shards ...int) *QueryCache {
+	count := 0
+	if len(shards) > 0 {
+		count = shards[0]
+	}
+
+	local := newMemoryBackend(size, count)
+
+	return &QueryCache{
+		local:   local,
+		backend: local,
+		rate:    ratelimit,
+		stale:   stale,
 	}
+}
+
+// Local returns the in-memory backend of the cache, the fallback of the
+// shared backends
+func (c *QueryCache) Local() Backend {
+	return c.local
+}
+
+// SetBackend sets the storage of the entries, the in-memory backend by
+// default. Set before the cache used.
+func (c *QueryCache) SetBackend(b Backend) {
+	c.backend = b
+}
 
-	c := &QueryCache{
-		rate: ratelimit,
+func (c *QueryCache) get(key uint64) (*Query, time.Time, error) {
+	query, ok := c.backend.Get(key)
+	if !ok {
+		return nil, time.Time{}, ErrCacheNotFound
 	}
 
-	// Initialize all the shards
-	for i := 0; i < shardSize; i++ {
-		c.shards[i] = newShard(ssize)
+	now := WallClock.Now().Truncate(time.Second)
+
+	if now.After(query.EvictTime) {
+		c.Remove(key)
+		return nil, time.Time{}, ErrCacheExpired
 	}
 
-	return c
+	return query, now, nil
 }
 
 // Get returns the entry for a key or an error
 func (c *QueryCache) Get(key uint64, req *dns.Msg) (*dns.Msg, *rl.RateLimiter, error) {
-	shard := key & (shardSize - 1)
-	el, ok := c.shards[shard].Get(key)
+	query, now, err := c.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if !ok {
-		return nil, nil, ErrCacheNotFound
+	if now.After(query.ExpireTime) {
+		return nil, nil, ErrCacheExpired
 	}
 
-	query, ok := el.(*Query)
-	if !ok {
-		return nil, nil, ErrCacheNotFound
+	query.mu.Lock()
+	query.Hits++
+	query.LastAccess = WallClock.Now()
+	// the entries of the shared backends come without the limiter
+	if query.RateLimit == nil {
+		query.RateLimit = rl.New(c.rate, time.Second)
+	}
+	limiter := query.RateLimit
+	query.mu.Unlock()
+
+	elapsed := uint32(now.Sub(query.StoreTime).Seconds())
+
+	return query.Item.toMsg(req, elapsed, 1, 0), limiter, nil
+}
+
+// NeedPrefetch returns whether the entry returned more than threshold times
+// and it is in the last percentage of its TTL
+func (c *QueryCache) NeedPrefetch(key uint64, threshold int64) bool {
+	query, now, err := c.get(key)
+	if err != nil {
+		return false
 	}
 
 	query.mu.Lock()
+	hits := query.Hits
+	query.mu.Unlock()
 
-	now := WallClock.Now().Truncate(time.Second)
-	elapsed := uint32(now.Sub(query.UpdateTime).Seconds())
-	query.UpdateTime = now
-
-	for _, answer := range query.Item.Answer {
-		if elapsed > answer.Header().Ttl {
-			query.mu.Unlock()
-			c.Remove(key)
-			return nil, nil, ErrCacheExpired
-		}
-		answer.Header().Ttl -= elapsed
+	if hits <= threshold {
+		return false
 	}
 
-	for _, ns := range query.Item.Ns {
-		if elapsed > ns.Header().Ttl {
-			query.mu.Unlock()
-			c.Remove(key)
-			return nil, nil, ErrCacheExpired
-		}
-		ns.Header().Ttl -= elapsed
+	ttl := query.ExpireTime.Sub(query.StoreTime)
+	left := query.ExpireTime.Sub(now)
+
+	return left >= 0 && left*100 <= ttl*prefetchPercent
+}
+
+// GetStale returns an expired entry which is still in the stale window,
+// the TTLs of the records are capped with the given ttl
+func (c *QueryCache) GetStale(key uint64, req *dns.Msg, ttl uint32) (*dns.Msg, error) {
+	query, now, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !now.After(query.ExpireTime) {
+		return nil, ErrCacheNotFound
 	}
 
-	defer query.mu.Unlock()
+	elapsed := uint32(now.Sub(query.StoreTime).Seconds())
 
-	return query.Item.toMsg(req), query.RateLimit, nil
+	return query.Item.toMsg(req, elapsed, 0, ttl), nil
 }
 
 // Set sets a keys value to a Mesg
 func (c *QueryCache) Set(key uint64, msg *dns.Msg) error {
-	shard := key & (shardSize - 1)
+	now := WallClock.Now().Truncate(time.Second)
+	expire := now.Add(time.Duration(minTTL(msg)) * time.Second)
 
 	q := &Query{
 		Item:       newItem(msg),
 		RateLimit:  rl.New(c.rate, time.Second),
-		UpdateTime: WallClock.Now().Truncate(time.Second),
+		StoreTime:  now,
+		ExpireTime: expire,
+		EvictTime:  expire.Add(c.stale),
 	}
 
-	c.shards[shard].Set(key, q)
+	c.backend.Set(key, q)
 
 	return nil
 }
 
 // Remove removes an entry from the cache
 func (c *QueryCache) Remove(key uint64) {
-	shard := key & (shardSize - 1)
-	c.shards[shard].Remove(key)
+	c.backend.Remove(key)
 }
 
 // Len returns the caches length
 func (c *QueryCache) Len() int {
-	l := 0
-	for _, s := range c.shards {
-		l += s.Len()
-	}
-	return l
+	return c.backend.Len()
+}
+
+// Bytes returns the estimated memory of the entries in bytes, the local
+// entries of the shared backends
+func (c *QueryCache) Bytes() int64 {
+	return c.local.shards.Bytes()
+}
+
+// SetMaxBytes limits the estimated memory of the entries, the least recently
+// used entries evicted over it as over the size. Zero for no limit.
+func (c *QueryCache) SetMaxBytes(max int64) {
+	c.local.shards.setMaxBytes(max)
 }
 
 func newItem(m *dns.Msg) *item {
 	i := new(item)
+	i.Question = append([]dns.Question(nil), m.Question...)
 	i.Rcode = m.Rcode
 	i.Authoritative = m.Authoritative
 	i.AuthenticatedData = m.AuthenticatedData
@@ -148,7 +226,49 @@ func newItem(m *dns.Msg) *item {
 	return i
 }
 
-func (i *item) toMsg(m *dns.Msg) *dns.Msg {
+// size returns the estimated memory of the item, the wire size of the
+// question and the records
+func (i *item) size() int64 {
+	var n int
+
+	for _, q := range i.Question {
+		n += len(q.Name) + 4
+	}
+	for _, r := range i.Answer {
+		n += dns.Len(r)
+	}
+	for _, r := range i.Ns {
+		n += dns.Len(r)
+	}
+	for _, r := range i.Extra {
+		n += dns.Len(r)
+	}
+
+	return int64(n)
+}
+
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32 = math.MaxUint32
+
+	for _, r := range m.Answer {
+		if r.Header().Ttl < ttl {
+			ttl = r.Header().Ttl
+		}
+	}
+	for _, r := range m.Ns {
+		if r.Header().Ttl < ttl {
+			ttl = r.Header().Ttl
+		}
+	}
+
+	return ttl
+}
+
+// toMsg returns a copy of the item as a reply of m, the record TTLs of all
+// sections are decreased by elapsed seconds not below the floor and capped by
+// the limit if it is not zero. The OPT records kept as is, their TTL field holds
+// the flags.
+func (i *item) toMsg(m *dns.Msg, elapsed, floor, limit uint32) *dns.Msg {
 	m1 := new(dns.Msg)
 	m1.SetReply(m)
 
@@ -163,12 +283,37 @@ func (i *item) toMsg(m *dns.Msg) *dns.Msg {
 
 	for j, r := range i.Answer {
 		m1.Answer[j] = dns.Copy(r)
+		decreaseTTL(m1.Answer[j], elapsed, floor, limit)
 	}
 	for j, r := range i.Ns {
 		m1.Ns[j] = dns.Copy(r)
+		decreaseTTL(m1.Ns[j], elapsed, floor, limit)
 	}
 	for j, r := range i.Extra {
 		m1.Extra[j] = dns.Copy(r)
+		if r.Header().Rrtype != dns.TypeOPT {
+			decreaseTTL(m1.Extra[j], elapsed, floor, limit)
+		}
 	}
 	return m1
 }
+
+// decreaseTTL decreases the TTL of the record by elapsed seconds not below the
+// floor, 1 for the fresh entries and 0 for the stale entries
+func decreaseTTL(r dns.RR, elapsed, floor, limit uint32) {
+	h := r.Header()
+
+	if elapsed < h.Ttl {
+		h.Ttl -= elapsed
+	} else {
+		h.Ttl = 0
+	}
+
+	if h.Ttl < floor {
+		h.Ttl = floor
+	}
+
+	if limit > 0 && (h.Ttl == 0 || h.Ttl > limit) {
+		h.Ttl = limit
+	}
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func Test_Cache(t *testing.T) {
-	cache := NewQueryCache(1024, 0)
+	cache := NewQueryCache(1024, 0, 0)
 	WallClock = clockwork.NewFakeClock()
 
 	m := new(dns.Msg)
@@ -52,7 +52,7 @@ func Test_CacheTTL(t *testing.T) {
 
 	fakeClock := clockwork.NewFakeClock()
 	WallClock = fakeClock
-	cache := NewQueryCache(1024, 0)
+	cache := NewQueryCache(1024, 0, 0)
 
 	req := new(dns.Msg)
 	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
@@ -156,7 +156,7 @@ func Test_CacheTTL(t *testing.T) {
 	for _, answer := range msg.Answer {
 		switch answer.Header().Rrtype {
 		case dns.TypeA:
-			assert.Equal(t, uint32(0), answer.Header().Ttl, "TTL should be zero")
+			assert.Equal(t, uint32(1), answer.Header().Ttl, "TTL should be floored")
 		case dns.TypeAAAA:
 			assert.Equal(t, aaaattl-10, answer.Header().Ttl, "TTL should be decreased")
 		default:
@@ -167,7 +167,7 @@ func Test_CacheTTL(t *testing.T) {
 	for _, ns := range msg.Ns {
 		switch ns.Header().Rrtype {
 		case dns.TypeNS:
-			assert.Equal(t, uint32(0), ns.Header().Ttl, "TTL should be zero")
+			assert.Equal(t, uint32(1), ns.Header().Ttl, "TTL should be floored")
 		default:
 			t.Error("Unexpected RR type")
 		}
@@ -197,7 +197,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 
 	fakeClock := clockwork.NewFakeClock()
 	WallClock = fakeClock
-	cache := NewQueryCache(1024, 0)
+	cache := NewQueryCache(1024, 0, 0)
 
 	req := new(dns.Msg)
 	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
@@ -254,7 +254,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 
 	assert.Equal(t, attl-5, msg.Answer[0].Header().Ttl, "TTL should be decreased")
 
-	assert.Equal(t, nsttl-5, msg.Ns[0].Header().Ttl, "TTL should be decreased")
+	assert.Equal(t, uint32(1), msg.Ns[0].Header().Ttl, "TTL should be floored")
 
 	fakeClock.Advance(1 * time.Second)
 
@@ -267,7 +267,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 func Test_CacheEvict(t *testing.T) {
 	fakeClock := clockwork.NewFakeClock()
 	WallClock = fakeClock
-	cache := NewQueryCache(0, 0)
+	cache := NewQueryCache(0, 0, 0)
 
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
@@ -280,3 +280,182 @@ func Test_CacheEvict(t *testing.T) {
 
 	assert.Equal(t, 1024, cache.Len())
 }
+
+func Test_CacheStale(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+	cache := NewQueryCache(1024, 0, 10*time.Second)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Rcode = dns.RcodeSuccess
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   testDomain,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    5,
+		},
+		A: net.ParseIP("127.0.0.1")}
+	m.Answer = append(m.Answer, a)
+
+	key := Hash(m.Question[0])
+
+	err := cache.Set(key, m)
+	assert.NoError(t, err)
+
+	_, err = cache.GetStale(key, req, 30)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	fakeClock.Advance(6 * time.Second)
+
+	_, _, err = cache.Get(key, req)
+	assert.Equal(t, ErrCacheExpired, err)
+
+	msg, err := cache.GetStale(key, req, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Equal(t, uint32(30), msg.Answer[0].Header().Ttl)
+
+	fakeClock.Advance(10 * time.Second)
+
+	_, err = cache.GetStale(key, req, 30)
+	assert.Equal(t, ErrCacheExpired, err)
+
+	_, err = cache.GetStale(key, req, 30)
+	assert.Equal(t, ErrCacheNotFound, err)
+}
+
+func Test_CachePrefetch(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+	cache := NewQueryCache(1024, 0, 0)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   testDomain,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    100,
+		},
+		A: net.ParseIP("127.0.0.1")}
+	m.Answer = append(m.Answer, a)
+
+	key := Hash(m.Question[0])
+
+	err := cache.Set(key, m)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, _, err = cache.Get(key, req)
+		assert.NoError(t, err)
+	}
+
+	assert.False(t, cache.NeedPrefetch(key, 2))
+
+	fakeClock.Advance(91 * time.Second)
+
+	assert.True(t, cache.NeedPrefetch(key, 2))
+	assert.False(t, cache.NeedPrefetch(key, 10))
+
+	fakeClock.Advance(10 * time.Second)
+
+	assert.False(t, cache.NeedPrefetch(key, 2))
+}
+
+func Test_CacheTTLSections(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+	cache := NewQueryCache(1024, 0, 10*time.Second)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		assert.NoError(t, err)
+		return r
+	}
+
+	m.Answer = append(m.Answer, rr("example.com. 60 IN A 192.0.2.1"))
+	m.Ns = append(m.Ns, rr("example.com. 120 IN NS ns.example.com."))
+	m.Extra = append(m.Extra, rr("ns.example.com. 30 IN A 192.0.2.53"))
+	m.SetEdns0(4096, true)
+
+	key := Hash(req.Question[0])
+	assert.NoError(t, cache.Set(key, m))
+
+	ttls := func(msg *dns.Msg) []uint32 {
+		return []uint32{msg.Answer[0].Header().Ttl, msg.Ns[0].Header().Ttl, msg.Extra[0].Header().Ttl}
+	}
+
+	fakeClock.Advance(20 * time.Second)
+
+	msg, _, err := cache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{40, 100, 10}, ttls(msg))
+
+	// the OPT record flags kept
+	if opt := msg.IsEdns0(); assert.NotNil(t, opt) {
+		assert.True(t, opt.Do())
+		assert.Equal(t, uint16(4096), opt.UDPSize())
+	}
+
+	// the records shorter than the entry floored at 1
+	fakeClock.Advance(30 * time.Second)
+
+	msg, _, err = cache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{10, 70, 1}, ttls(msg))
+
+	fakeClock.Advance(10 * time.Second)
+
+	msg, _, err = cache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1, 60, 1}, ttls(msg))
+
+	// the expired records of the stale entries zero without the limit
+	fakeClock.Advance(time.Second)
+
+	msg, err = cache.GetStale(key, req, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{0, 59, 0}, ttls(msg))
+}
+
+func Test_CacheMaxBytes(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+	cache := NewQueryCache(1024, 0, time.Hour, 1)
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	rr, _ := dns.NewRR(testDomain + ". 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	size := newItem(m).size()
+	assert.Equal(t, int64(len(m.Question[0].Name)+4+dns.Len(rr)), size)
+
+	cache.SetMaxBytes(10 * size)
+
+	for i := uint64(0); i < 20; i++ {
+		assert.NoError(t, cache.Set(i, m))
+	}
+
+	assert.Equal(t, 10, cache.Len())
+	assert.Equal(t, 10*size, cache.Bytes())
+
+	cache.Remove(19)
+	assert.Equal(t, 9*size, cache.Bytes())
+}
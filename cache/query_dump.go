@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+	"time"
+
+	rl "github.com/bsm/ratelimit"
+	"github.com/miekg/dns"
+)
+
+const dumpVersion = 1
+
+type dumpHeader struct {
+	Version int
+}
+
+// dumpEntry is a cache entry on the disk, the message packed in wire format
+type dumpEntry struct {
+	Key        uint64
+	Msg        []byte
+	StoreTime  int64
+	ExpireTime int64
+}
+
+// Dump writes the unexpired entries to w, returns the written entry count.
+// The local entries written, of the shared backends too.
+func (c *QueryCache) Dump(w io.Writer) (int, error) {
+	enc := gob.NewEncoder(w)
+
+	if err := enc.Encode(dumpHeader{Version: dumpVersion}); err != nil {
+		return 0, err
+	}
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	count := 0
+	for _, s := range c.local.shards.list {
+		var entries []dumpEntry
+
+		s.RLock()
+		for key, el := range s.items {
+			query, ok := el.value.(*Query)
+			if !ok || !now.Before(query.ExpireTime) {
+				continue
+			}
+
+			packed, err := query.Item.pack()
+			if err != nil {
+				continue
+			}
+
+			entries = append(entries, dumpEntry{
+				Key:        key,
+				Msg:        packed,
+				StoreTime:  query.StoreTime.Unix(),
+				ExpireTime: query.ExpireTime.Unix(),
+			})
+		}
+		s.RUnlock()
+
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Load reads the dumped entries from r, the entries expired in the meantime
+// dropped and nothing loaded when the dump is corrupted. Returns the loaded
+// entry count.
+func (c *QueryCache) Load(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+
+	var header dumpHeader
+	if err := dec.Decode(&header); err != nil || header.Version != dumpVersion {
+		return 0, ErrCacheDump
+	}
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	var queries []*Query
+	var keys []uint64
+
+	for {
+		var e dumpEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, ErrCacheDump
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			return 0, ErrCacheDump
+		}
+
+		expire := time.Unix(e.ExpireTime, 0)
+		if !now.Before(expire) {
+			continue
+		}
+
+		keys = append(keys, e.Key)
+		queries = append(queries, &Query{
+			Item:       newItem(msg),
+			RateLimit:  rl.New(c.rate, time.Second),
+			StoreTime:  time.Unix(e.StoreTime, 0),
+			ExpireTime: expire,
+			EvictTime:  expire.Add(c.stale),
+		})
+	}
+
+	for i, key := range keys {
+		c.backend.Set(key, queries[i])
+	}
+
+	return len(keys), nil
+}
+
+func (i *item) pack() ([]byte, error) {
+	m := new(dns.Msg)
+	m.Compress = true
+	m.Question = i.Question
+	m.Rcode = i.Rcode
+	m.Authoritative = i.Authoritative
+	m.AuthenticatedData = i.AuthenticatedData
+	m.RecursionAvailable = i.RecursionAvailable
+	m.Answer = i.Answer
+	m.Ns = i.Ns
+	m.Extra = i.Extra
+
+	return m.Pack()
+}
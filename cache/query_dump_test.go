@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_QueryCacheDump(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	c := NewQueryCache(1024, 0, time.Hour)
+
+	short := new(dns.Msg)
+	short.SetQuestion("short.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("short.example.com. 60 IN A 192.0.2.1")
+	short.Answer = append(short.Answer, rr)
+
+	long := new(dns.Msg)
+	long.SetQuestion("long.example.com.", dns.TypeAAAA)
+	rr, _ = dns.NewRR("long.example.com. 3600 IN AAAA 2001:db8::1")
+	long.Answer = append(long.Answer, rr)
+	long.AuthenticatedData = true
+
+	c.Set(Hash(short.Question[0]), short)
+	c.Set(Hash(long.Question[0]), long)
+
+	fakeClock.Advance(10 * time.Second)
+
+	var buf bytes.Buffer
+	count, err := c.Dump(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// the short entry expires in the downtime
+	fakeClock.Advance(100 * time.Second)
+
+	c = NewQueryCache(1024, 0, time.Hour)
+	count, err = c.Load(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, _, err = c.Get(Hash(short.Question[0]), short)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	msg, _, err := c.Get(Hash(long.Question[0]), long)
+	assert.NoError(t, err)
+	assert.True(t, msg.AuthenticatedData)
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, uint32(3490), msg.Answer[0].Header().Ttl)
+}
+
+func Test_QueryCacheLoadCorrupt(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	c := NewQueryCache(1024, 0, 0)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	c.Set(Hash(m.Question[0]), m)
+
+	var buf bytes.Buffer
+	_, err := c.Dump(&buf)
+	assert.NoError(t, err)
+
+	c = NewQueryCache(1024, 0, 0)
+
+	_, err = c.Load(bytes.NewReader(buf.Bytes()[:buf.Len()-5]))
+	assert.Equal(t, ErrCacheDump, err)
+	assert.Equal(t, 0, c.Len())
+
+	_, err = c.Load(bytes.NewReader([]byte("not a cache dump")))
+	assert.Equal(t, ErrCacheDump, err)
+
+	_, err = c.Load(bytes.NewReader(nil))
+	assert.Equal(t, ErrCacheDump, err)
+	assert.Equal(t, 0, c.Len())
+}
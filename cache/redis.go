@@ -0,0 +1,436 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRedisTimeout is the timeout of the redis commands when not given
+	DefaultRedisTimeout = 200 * time.Millisecond
+
+	// DefaultRedisPool is the idle connection count kept when not given
+	DefaultRedisPool = 16
+
+	// redisRetry is how long the local fallback used after a redis failure
+	redisRetry = 5 * time.Second
+
+	// redisScanCount is the keys asked per scan of the purges
+	redisScanCount = 512
+)
+
+// errRedisProtocol error
+var errRedisProtocol = errors.New("redis: protocol error")
+
+// redisError is an error reply of the redis server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// RedisOptions are the options of the redis backend
+type RedisOptions struct {
+	Addr     string
+	Password string
+	DB       int
+
+	// Prefix is prepended to the keys of the entries
+	Prefix string
+
+	Timeout time.Duration
+	Pool    int
+}
+
+// RedisBackend stores the entries on a redis server shared by the nodes, the
+// expiry of the keys at the evict time of the entries. The entries read kept
+// in the local backend too, the hits and the rate limiter of the node stay
+// with them; the local backend answers alone while the server unreachable.
+type RedisBackend struct {
+	opts  RedisOptions
+	local Backend
+
+	pool chan *redisConn
+
+	// retry is the unix nanos the server tried again after a failure
+	retry int64
+}
+
+// NewRedisBackend returns the redis backend of the options, the local backend
+// used as the fallback. No connection made until the first command.
+func NewRedisBackend(opts RedisOptions, local Backend) *RedisBackend {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRedisTimeout
+	}
+
+	if opts.Pool <= 0 {
+		opts.Pool = DefaultRedisPool
+	}
+
+	return &RedisBackend{
+		opts:  opts,
+		local: local,
+		pool:  make(chan *redisConn, opts.Pool),
+	}
+}
+
+// Available reports whether the server used, false for a while after a
+// failure
+func (r *RedisBackend) Available() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&r.retry)
+}
+
+func (r *RedisBackend) key(key uint64) string {
+	return r.opts.Prefix + strconv.FormatUint(key, 16)
+}
+
+// failed switches to the local backend for a while on the connection
+// failures, the error replies of the server not
+func (r *RedisBackend) failed(err error) {
+	if _, ok := err.(redisError); ok {
+		return
+	}
+
+	atomic.StoreInt64(&r.retry, time.Now().Add(redisRetry).UnixNano())
+}
+
+// Get returns the entry of the key from the server, from the local backend
+// while the server unreachable
+func (r *RedisBackend) Get(key uint64) (*Query, bool) {
+	if !r.Available() {
+		return r.local.Get(key)
+	}
+
+	reply, err := r.do("GET", r.key(key))
+	if err != nil {
+		r.failed(err)
+		return r.local.Get(key)
+	}
+
+	blob, ok := reply.([]byte)
+	if !ok {
+		// removed or expired by another node
+		r.local.Remove(key)
+		return nil, false
+	}
+
+	q, err := decodeQuery(blob)
+	if err != nil {
+		return nil, false
+	}
+
+	if lq, ok := r.local.Get(key); ok && lq.StoreTime.Equal(q.StoreTime) {
+		return lq, true
+	}
+
+	r.local.Set(key, q)
+
+	return q, true
+}
+
+// Set sets the entry of the key on the local backend and the server
+func (r *RedisBackend) Set(key uint64, q *Query) {
+	r.local.Set(key, q)
+
+	if !r.Available() {
+		return
+	}
+
+	ttl := q.EvictTime.Sub(WallClock.Now())
+	if ttl < time.Millisecond {
+		return
+	}
+
+	blob, err := encodeQuery(q)
+	if err != nil {
+		return
+	}
+
+	if _, err := r.do("SET", r.key(key), string(blob), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10)); err != nil {
+		r.failed(err)
+	}
+}
+
+// Remove removes the entry of the key from the local backend and the server
+func (r *RedisBackend) Remove(key uint64) {
+	r.local.Remove(key)
+
+	if !r.Available() {
+		return
+	}
+
+	if _, err := r.do("DEL", r.key(key)); err != nil {
+		r.failed(err)
+	}
+}
+
+// Len returns the key count of the prefix on the server, the keys of the
+// other users of a shared database not counted. The local entry count
+// returned while the server unreachable.
+func (r *RedisBackend) Len() int {
+	if r.Available() {
+		n := 0
+		err := r.scan(func(string) error {
+			n++
+			return nil
+		})
+		if err == nil {
+			return n
+		}
+
+		r.failed(err)
+	}
+
+	return r.local.Len()
+}
+
+// RemoveFunc removes the entries which the function reports true for from the
+// local backend and the server, the keys of the prefix scanned. Returns the
+// removed count of the server, of the local backend while unreachable.
+func (r *RedisBackend) RemoveFunc(fn func(q *Query) bool) int {
+	n := 0
+	if p, ok := r.local.(Purger); ok {
+		n = p.RemoveFunc(fn)
+	}
+
+	if !r.Available() {
+		return n
+	}
+
+	removed, err := r.removeFunc(fn)
+	if err != nil {
+		r.failed(err)
+		return n
+	}
+
+	return removed
+}
+
+func (r *RedisBackend) removeFunc(fn func(q *Query) bool) (int, error) {
+	n := 0
+
+	err := r.scan(func(name string) error {
+		reply, err := r.do("GET", name)
+		if err != nil {
+			return err
+		}
+
+		blob, ok := reply.([]byte)
+		if !ok {
+			return nil
+		}
+
+		if q, err := decodeQuery(blob); err == nil && fn(q) {
+			if _, err := r.do("DEL", name); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// scan calls the function for each key of the prefix on the server, stops at
+// the first error
+func (r *RedisBackend) scan(fn func(name string) error) error {
+	cursor := "0"
+
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", r.opts.Prefix+"*", "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return err
+		}
+
+		list, ok := reply.([]interface{})
+		if !ok || len(list) != 2 {
+			return errRedisProtocol
+		}
+
+		next, _ := list[0].([]byte)
+		keys, _ := list[1].([]interface{})
+
+		for _, k := range keys {
+			name, ok := k.([]byte)
+			if !ok {
+				continue
+			}
+
+			if err := fn(string(name)); err != nil {
+				return err
+			}
+		}
+
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Close closes the idle connections
+func (r *RedisBackend) Close() {
+	for {
+		select {
+		case c := <-r.pool:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do sends the command on an idle connection or a new one, the connection
+// kept for the next commands unless failed
+func (r *RedisBackend) do(args ...string) (interface{}, error) {
+	var c *redisConn
+
+	select {
+	case c = <-r.pool:
+	default:
+		var err error
+		if c, err = r.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(r.opts.Timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case r.pool <- c:
+	default:
+		c.Close()
+	}
+
+	return reply, err
+}
+
+func (r *RedisBackend) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.opts.Addr, r.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{Conn: conn, rd: bufio.NewReader(conn)}
+
+	if r.opts.Password != "" {
+		if _, err := c.do(r.opts.Timeout, "AUTH", r.opts.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("redis auth failed: %s", err)
+		}
+	}
+
+	if r.opts.DB > 0 {
+		if _, err := c.do(r.opts.Timeout, "SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("redis select failed: %s", err)
+		}
+	}
+
+	return c, nil
+}
+
+// redisConn is a connection of the redis protocol (RESP)
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// do writes the command and reads its reply; the strings, the integers, the
+// bulk strings as bytes, nil for the null replies and the lists of them
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, data); err != nil {
+			return nil, err
+		}
+
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = c.read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+
+		return list, nil
+	}
+
+	return nil, errRedisProtocol
+}
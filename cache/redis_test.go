@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis is a redis server of the commands used by the backend, the
+// expiry of the keys not applied
+type fakeRedis struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	keys map[string]string
+	ttls map[string]string
+	auth string
+}
+
+func runFakeRedis(t *testing.T, auth string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeRedis{ln: ln, keys: make(map[string]string), ttls: make(map[string]string), auth: auth}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := &redisConn{Conn: conn, rd: bufio.NewReader(conn)}
+	authed := s.auth == ""
+
+	for {
+		req, err := c.read()
+		if err != nil {
+			return
+		}
+
+		list, _ := req.([]interface{})
+
+		var args []string
+		for _, arg := range list {
+			b, _ := arg.([]byte)
+			args = append(args, string(b))
+		}
+
+		if len(args) == 0 {
+			return
+		}
+
+		cmd := strings.ToUpper(args[0])
+
+		if !authed && cmd != "AUTH" {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+
+		s.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			authed = args[1] == s.auth
+			if authed {
+				conn.Write([]byte("+OK\r\n"))
+			} else {
+				conn.Write([]byte("-ERR invalid password\r\n"))
+			}
+		case "SELECT":
+			conn.Write([]byte("+OK\r\n"))
+		case "GET":
+			if v, ok := s.keys[args[1]]; ok {
+				conn.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+			} else {
+				conn.Write([]byte("$-1\r\n"))
+			}
+		case "SET":
+			s.keys[args[1]] = args[2]
+			s.ttls[args[1]] = args[4]
+			conn.Write([]byte("+OK\r\n"))
+		case "DEL":
+			_, ok := s.keys[args[1]]
+			delete(s.keys, args[1])
+			if ok {
+				conn.Write([]byte(":1\r\n"))
+			} else {
+				conn.Write([]byte(":0\r\n"))
+			}
+		case "SCAN":
+			prefix := strings.TrimSuffix(args[3], "*")
+			reply := ""
+			n := 0
+			for k := range s.keys {
+				if strings.HasPrefix(k, prefix) {
+					reply += "$" + strconv.Itoa(len(k)) + "\r\n" + k + "\r\n"
+					n++
+				}
+			}
+			conn.Write([]byte("*2\r\n$1\r\n0\r\n*" + strconv.Itoa(n) + "\r\n" + reply))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *fakeRedis) Close() { s.ln.Close() }
+
+func (s *fakeRedis) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.keys)
+}
+
+func newRedisQueryCache(addr, password string) (*QueryCache, *RedisBackend) {
+	c := NewQueryCache(1024, 10, time.Hour)
+
+	r := NewRedisBackend(RedisOptions{Addr: addr, Password: password, Prefix: "sdns:", Timeout: time.Second}, c.Local())
+	c.SetBackend(r)
+
+	return c, r
+}
+
+func Test_RedisBackend(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	s := runFakeRedis(t, "secret")
+	defer s.Close()
+
+	node1, r1 := newRedisQueryCache(s.ln.Addr().String(), "secret")
+	defer r1.Close()
+
+	node2, r2 := newRedisQueryCache(s.ln.Addr().String(), "secret")
+	defer r2.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	key := Hash(m.Question[0])
+
+	assert.NoError(t, node1.Set(key, m))
+	assert.Equal(t, 1, s.Len())
+
+	// the key expires at the evict time of the entry
+	s.mu.Lock()
+	assert.Equal(t, "3900000", s.ttls["sdns:"+strconv.FormatUint(key, 16)])
+	s.mu.Unlock()
+
+	fakeClock.Advance(10 * time.Second)
+
+	// the entry of the other node shared
+	msg, limiter, err := node2.Get(key, m)
+	if assert.NoError(t, err) && assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, uint32(290), msg.Answer[0].Header().Ttl)
+		assert.NotNil(t, limiter)
+	}
+
+	// the local entry of the node kept with its hits
+	_, limiter2, err := node2.Get(key, m)
+	assert.NoError(t, err)
+	assert.True(t, limiter == limiter2)
+	assert.Equal(t, 1, node2.Len())
+
+	// the keys of the other users of the server not counted
+	s.mu.Lock()
+	s.keys["other:key"] = "value"
+	s.mu.Unlock()
+
+	assert.Equal(t, 1, node2.Len())
+
+	s.mu.Lock()
+	delete(s.keys, "other:key")
+	s.mu.Unlock()
+
+	node2.Remove(key)
+	assert.Equal(t, 0, s.Len())
+
+	_, _, err = node1.Get(key, m)
+	assert.Equal(t, ErrCacheNotFound, err)
+	assert.Equal(t, 0, node1.Local().Len())
+
+	node1.Set(key, m)
+	assert.Equal(t, 1, node2.PurgeName("EXAMPLE.com."))
+	assert.Equal(t, 0, s.Len())
+
+	node1.Set(key, m)
+	node2.Flush()
+	assert.Equal(t, 0, s.Len())
+
+	// the local fallback answers while the server unreachable
+	node1.Set(key, m)
+	s.Close()
+	r1.Close()
+
+	msg, _, err = node1.Get(key, m)
+	if assert.NoError(t, err) {
+		assert.Len(t, msg.Answer, 1)
+	}
+	assert.False(t, r1.Available())
+	assert.Equal(t, 1, node1.Len())
+
+	other := m.Copy()
+	other.Question[0].Name = "other.example.com."
+	assert.NoError(t, node1.Set(Hash(other.Question[0]), other))
+
+	_, _, err = node1.Get(Hash(other.Question[0]), other)
+	assert.NoError(t, err)
+}
+
+func Test_RedisBackendAuth(t *testing.T) {
+	WallClock = clockwork.NewFakeClock()
+
+	s := runFakeRedis(t, "secret")
+	defer s.Close()
+
+	c, r := newRedisQueryCache(s.ln.Addr().String(), "wrong")
+	defer r.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	// refused by the server, the query answered locally
+	assert.NoError(t, c.Set(Hash(m.Question[0]), m))
+	assert.Equal(t, 0, s.Len())
+	assert.False(t, r.Available())
+
+	_, _, err := c.Get(Hash(m.Question[0]), m)
+	assert.NoError(t, err)
+}
@@ -1,65 +1,154 @@
 package cache
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
-// shard is a cache with random eviction.
+// DefaultShards is the shard count of the caches when not given
+const DefaultShards = 256
+
+// evictSamples is the count of the entries sampled for an eviction
+const evictSamples = 5
+
+// shardItem is an entry of a shard with its last access tick and its
+// estimated size in bytes
+type shardItem struct {
+	access uint64
+	value  interface{}
+	size   int64
+}
+
+// shard is a cache with approximated LRU eviction.
 type shard struct {
-	items map[uint64]interface{}
+	// tick is the logical clock of the accesses
+	tick uint64
+
+	items map[uint64]*shardItem
 	size  int
 
+	// bytes is the estimated size of the elements, maxBytes is the limit of
+	// it, zero for none
+	bytes    int64
+	maxBytes int64
+
 	sync.RWMutex
 }
 
 // newShard returns a new shard with size.
-func newShard(size int) *shard { return &shard{items: make(map[uint64]interface{}), size: size} }
+func newShard(size int) *shard { return &shard{items: make(map[uint64]*shardItem), size: size} }
 
 // Set adds element indexed by key into the cache. Any existing element is overwritten
 func (s *shard) Set(key uint64, el interface{}) {
-	l := s.Len()
-	if l+1 > s.size {
-		s.Evict()
-	}
+	s.SetSized(key, el, 0)
+}
+
+// SetSized adds element indexed by key with its estimated size in bytes, the
+// elements evicted while the shard over the byte limit. A single element
+// kept even if larger than the limit.
+func (s *shard) SetSized(key uint64, el interface{}, size int64) {
+	item := &shardItem{access: atomic.AddUint64(&s.tick, 1), value: el, size: size}
 
 	s.Lock()
-	s.items[key] = el
+	if old, ok := s.items[key]; ok {
+		delete(s.items, key)
+		s.bytes -= old.size
+	} else if len(s.items) >= s.size {
+		s.evict()
+	}
+
+	for s.maxBytes > 0 && len(s.items) > 0 && s.bytes+size > s.maxBytes {
+		s.evict()
+	}
+
+	s.items[key] = item
+	s.bytes += size
 	s.Unlock()
 }
 
 // Remove removes the element indexed by key from the cache.
 func (s *shard) Remove(key uint64) {
 	s.Lock()
-	delete(s.items, key)
+	if item, ok := s.items[key]; ok {
+		delete(s.items, key)
+		s.bytes -= item.size
+	}
 	s.Unlock()
 }
 
-// Evict removes a random element from the cache.
+// Evict removes the least recently used element of a few random elements from the cache.
 func (s *shard) Evict() {
-	hasKey := false
-	var key uint64
+	s.Lock()
+	s.evict()
+	s.Unlock()
+}
 
-	s.RLock()
-	for k := range s.items {
-		key = k
-		hasKey = true
-		break
-	}
-	s.RUnlock()
+// evict removes the oldest of the sampled elements, the lock should be held
+func (s *shard) evict() {
+	var (
+		victim uint64
+		oldest uint64
+		found  bool
+	)
 
-	if !hasKey {
-		// empty cache
-		return
+	n := 0
+	for k, item := range s.items {
+		access := atomic.LoadUint64(&item.access)
+		if !found || access < oldest {
+			victim, oldest, found = k, access, true
+		}
+
+		n++
+		if n >= evictSamples {
+			break
+		}
 	}
 
-	// If this item is gone between the RUnlock and Lock race we don't care.
-	s.Remove(key)
+	if found {
+		s.bytes -= s.items[victim].size
+		delete(s.items, victim)
+	}
 }
 
 // Get looks up the element indexed under key.
 func (s *shard) Get(key uint64) (interface{}, bool) {
 	s.RLock()
-	el, found := s.items[key]
+	item, found := s.items[key]
 	s.RUnlock()
-	return el, found
+
+	if !found {
+		return nil, false
+	}
+
+	atomic.StoreUint64(&item.access, atomic.AddUint64(&s.tick, 1))
+
+	return item.value, true
+}
+
+// RemoveFunc removes the elements which the function reports true for,
+// returns the removed count.
+func (s *shard) RemoveFunc(fn func(el interface{}) bool) int {
+	s.Lock()
+	defer s.Unlock()
+
+	n := 0
+	for key, item := range s.items {
+		if fn(item.value) {
+			delete(s.items, key)
+			s.bytes -= item.size
+			n++
+		}
+	}
+
+	return n
+}
+
+// Clear removes all elements from the cache.
+func (s *shard) Clear() {
+	s.Lock()
+	s.items = make(map[uint64]*shardItem)
+	s.bytes = 0
+	s.Unlock()
 }
 
 // Len returns the current length of the cache.
@@ -70,4 +159,106 @@ func (s *shard) Len() int {
 	return l
 }
 
-const shardSize = 256
+// Bytes returns the estimated size of the elements in bytes.
+func (s *shard) Bytes() int64 {
+	s.RLock()
+	b := s.bytes
+	s.RUnlock()
+	return b
+}
+
+// setMaxBytes sets the byte limit, the elements over it evicted.
+func (s *shard) setMaxBytes(max int64) {
+	s.Lock()
+	s.maxBytes = max
+	for max > 0 && len(s.items) > 1 && s.bytes > max {
+		s.evict()
+	}
+	s.Unlock()
+}
+
+// shards is a set of the shards selected by the key
+type shards struct {
+	list []*shard
+	mask uint64
+}
+
+// newShards returns count shards sharing the size, count rounded up to a
+// power of two
+func newShards(size, count int) shards {
+	if count < 1 {
+		count = DefaultShards
+	}
+
+	n := 1
+	for n < count {
+		n <<= 1
+	}
+
+	ssize := size / n
+	if ssize < 4 {
+		ssize = 4
+	}
+
+	s := shards{list: make([]*shard, n), mask: uint64(n - 1)}
+
+	// Initialize all the shards
+	for i := range s.list {
+		s.list[i] = newShard(ssize)
+	}
+
+	return s
+}
+
+// shard returns the shard of the key
+func (s shards) shard(key uint64) *shard {
+	// the high bits mixed in, the low bits of similar keys may collide
+	return s.list[(key^key>>32)&s.mask]
+}
+
+// RemoveFunc removes the elements of the shards which the function reports
+// true for, returns the removed count
+func (s shards) RemoveFunc(fn func(el interface{}) bool) int {
+	n := 0
+	for _, sh := range s.list {
+		n += sh.RemoveFunc(fn)
+	}
+	return n
+}
+
+// Clear removes all elements of the shards
+func (s shards) Clear() {
+	for _, sh := range s.list {
+		sh.Clear()
+	}
+}
+
+// Len returns the total length of the shards
+func (s shards) Len() int {
+	l := 0
+	for _, sh := range s.list {
+		l += sh.Len()
+	}
+	return l
+}
+
+// Bytes returns the total estimated size of the shards in bytes
+func (s shards) Bytes() int64 {
+	var b int64
+	for _, sh := range s.list {
+		b += sh.Bytes()
+	}
+	return b
+}
+
+// setMaxBytes shares the byte limit between the shards, zero for none
+func (s shards) setMaxBytes(max int64) {
+	per := max / int64(len(s.list))
+	if max > 0 && per < 1 {
+		per = 1
+	}
+
+	for _, sh := range s.list {
+		sh.setMaxBytes(per)
+	}
+}
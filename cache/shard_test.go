@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_shardEvict(t *testing.T) {
+	s := newShard(4)
+
+	for i := uint64(1); i <= 4; i++ {
+		s.Set(i, i)
+	}
+
+	// the old entries kept hot
+	_, ok := s.Get(1)
+	assert.True(t, ok)
+	_, ok = s.Get(2)
+	assert.True(t, ok)
+
+	s.Set(5, uint64(5))
+	assert.Equal(t, 4, s.Len())
+
+	_, ok = s.Get(3)
+	assert.False(t, ok)
+
+	for _, key := range []uint64{1, 2, 4, 5} {
+		_, ok = s.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// overwrite without eviction
+	s.Set(5, uint64(6))
+	assert.Equal(t, 4, s.Len())
+
+	el, _ := s.Get(5)
+	assert.Equal(t, uint64(6), el)
+
+	s.Evict()
+	assert.Equal(t, 3, s.Len())
+}
+
+func Test_newShards(t *testing.T) {
+	s := newShards(1024, 0)
+	assert.Len(t, s.list, DefaultShards)
+	assert.Equal(t, 4, s.list[0].size)
+
+	s = newShards(1024, 3)
+	assert.Len(t, s.list, 4)
+	assert.Equal(t, uint64(3), s.mask)
+	assert.Equal(t, 256, s.list[0].size)
+
+	s = newShards(1024, 1)
+	for i := uint64(0); i < 16; i++ {
+		s.shard(i).Set(i, i)
+	}
+	assert.Equal(t, 16, s.Len())
+}
+
+func Test_shardsSpread(t *testing.T) {
+	s := newShards(1<<16, 16)
+
+	for i := 0; i < 1<<12; i++ {
+		key := HashScope(uint64(i), strconv.Itoa(i))
+		s.shard(key).Set(key, i)
+	}
+
+	for _, sh := range s.list {
+		assert.True(t, sh.Len() > 128, sh.Len())
+	}
+}
+
+func benchmarkShards(b *testing.B, count int) {
+	c := NewErrorCache(1<<16, 60, count)
+
+	keys := make([]uint64, 1<<12)
+	for i := range keys {
+		keys[i] = HashScope(uint64(i), "bench")
+		c.Set(keys[i])
+	}
+
+	var seed int64
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+
+		for pb.Next() {
+			key := keys[r.Intn(len(keys))]
+
+			// one write for every four reads
+			if r.Intn(4) == 0 {
+				c.Set(key)
+			} else {
+				c.Get(key)
+			}
+		}
+	})
+}
+
+func Benchmark_Shards1(b *testing.B) { benchmarkShards(b, 1) }
+
+func Benchmark_Shards16(b *testing.B) { benchmarkShards(b, 16) }
+
+func Benchmark_Shards256(b *testing.B) { benchmarkShards(b, 256) }
+
+func Test_shardMaxBytes(t *testing.T) {
+	s := newShard(16)
+	s.setMaxBytes(100)
+
+	for i := uint64(1); i <= 4; i++ {
+		s.SetSized(i, i, 25)
+	}
+	assert.Equal(t, int64(100), s.Bytes())
+
+	_, ok := s.Get(1)
+	assert.True(t, ok)
+
+	// the least recently used entry evicted for the room
+	s.SetSized(5, uint64(5), 25)
+	assert.Equal(t, 4, s.Len())
+	assert.Equal(t, int64(100), s.Bytes())
+
+	_, ok = s.Get(2)
+	assert.False(t, ok)
+
+	// the overwritten size replaced
+	s.SetSized(5, uint64(5), 10)
+	assert.Equal(t, int64(85), s.Bytes())
+
+	s.Remove(5)
+	assert.Equal(t, int64(75), s.Bytes())
+
+	// an entry larger than the limit kept alone
+	s.SetSized(6, uint64(6), 150)
+	assert.Equal(t, 1, s.Len())
+	assert.Equal(t, int64(150), s.Bytes())
+
+	s.Clear()
+	assert.Equal(t, int64(0), s.Bytes())
+
+	// the lowered limit applied to the kept entries
+	s.setMaxBytes(0)
+	for i := uint64(1); i <= 4; i++ {
+		s.SetSized(i, i, 50)
+	}
+	assert.Equal(t, 4, s.Len())
+
+	s.setMaxBytes(100)
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, int64(100), s.Bytes())
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Flight type shares one running lookup between the concurrent callers of
+// the same key
+type Flight struct {
+	mu sync.Mutex
+
+	calls map[uint64]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+
+	msg *dns.Msg
+	err error
+}
+
+// NewFlight func
+func NewFlight() *Flight {
+	return &Flight{
+		calls: make(map[uint64]*flightCall),
+	}
+}
+
+// Do runs the lookup of the key once for the concurrent callers and returns
+// its result to all of them, shared reports the result of another caller.
+// The waiters give up after the timeout with ErrFlightTimeout, the result
+// not kept after the lookup returns.
+func (f *Flight) Do(key uint64, timeout time.Duration, lookup func() (*dns.Msg, error)) (msg *dns.Msg, shared bool, err error) {
+	f.mu.Lock()
+
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+
+		select {
+		case <-c.done:
+			return c.msg, true, c.err
+		case <-time.After(timeout):
+			return nil, true, ErrFlightTimeout
+		}
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+
+		close(c.done)
+	}()
+
+	c.msg, c.err = lookup()
+
+	return c.msg, false, c.err
+}
+
+// Len returns the count of the running lookups
+func (f *Flight) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.calls)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_flightShared(t *testing.T) {
+	flight := NewFlight()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	key := Hash(m.Question[0])
+
+	var calls, shares int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			msg, shared, err := flight.Do(key, time.Minute, func() (*dns.Msg, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return m, nil
+			})
+
+			assert.NoError(t, err)
+			assert.Equal(t, m, msg)
+
+			if shared {
+				atomic.AddInt32(&shares, 1)
+			}
+		}()
+	}
+
+	for flight.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(9), atomic.LoadInt32(&shares))
+	assert.Equal(t, 0, flight.Len())
+}
+
+func Test_flightError(t *testing.T) {
+	flight := NewFlight()
+	errLookup := errors.New("lookup failed")
+
+	release := make(chan struct{})
+	result := make(chan error)
+
+	go func() {
+		_, _, err := flight.Do(1, time.Minute, func() (*dns.Msg, error) {
+			<-release
+			return nil, errLookup
+		})
+		result <- err
+	}()
+
+	for flight.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		_, shared, err := flight.Do(1, time.Minute, nil)
+		assert.True(t, shared)
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	assert.Equal(t, errLookup, <-result)
+	assert.Equal(t, errLookup, <-result)
+
+	// the failed result not kept for the next lookup
+	msg, shared, err := flight.Do(1, time.Minute, func() (*dns.Msg, error) {
+		return new(dns.Msg), nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, shared)
+	assert.NotNil(t, msg)
+}
+
+func Test_flightTimeout(t *testing.T) {
+	flight := NewFlight()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	go flight.Do(1, time.Minute, func() (*dns.Msg, error) {
+		<-release
+		return nil, nil
+	})
+
+	for flight.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, shared, err := flight.Do(1, 100*time.Millisecond, nil)
+	assert.True(t, shared)
+	assert.Equal(t, ErrFlightTimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
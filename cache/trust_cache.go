@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// StatusSecure is the status of a zone which keys validated
+	StatusSecure = "secure"
+	// StatusBogus is the status of a zone which validation failed
+	StatusBogus = "bogus"
+
+	// BogusTTL is how long the bogus status of a zone kept
+	BogusTTL = 5 * time.Minute
+)
+
+// TrustCache type, keeps the DNSKEY sets validated against the DS records
+// of their parents by zone
+type TrustCache struct {
+	mu sync.RWMutex
+
+	m map[string]*trustZone
+}
+
+type trustZone struct {
+	keys    map[uint16]*dns.DNSKEY
+	ds      string
+	status  string
+	err     string
+	checked time.Time
+	expire  time.Time
+}
+
+// ZoneStatus is the validation status of a zone
+type ZoneStatus struct {
+	Zone    string
+	Status  string
+	Error   string
+	Keys    int
+	Checked time.Time
+	Expire  time.Time
+}
+
+// NewTrustCache return new cache
+func NewTrustCache() *TrustCache {
+	c := &TrustCache{
+		m: make(map[string]*trustZone),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Get returns the validated keys of the zone, the DS records should be
+// the same which the keys validated with
+func (c *TrustCache) Get(zone string, ds []dns.RR) map[uint16]*dns.DNSKEY {
+	zone = strings.ToLower(zone)
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	z, ok := c.m[zone]
+	if !ok || z.status != StatusSecure || !now.Before(z.expire) {
+		return nil
+	}
+
+	if z.ds != dsKey(ds) {
+		return nil
+	}
+
+	return z.keys
+}
+
+// Set sets the validated keys of the zone, kept no longer than the lowest
+// TTL of the keys and the DS records
+func (c *TrustCache) Set(zone string, keys map[uint16]*dns.DNSKEY, ds []dns.RR) {
+	var ttl uint32
+
+	for _, k := range keys {
+		if ttl == 0 || k.Header().Ttl < ttl {
+			ttl = k.Header().Ttl
+		}
+	}
+
+	for _, rr := range ds {
+		ttl = lowerTTL(ttl, rr.Header().Ttl)
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	list := make(map[uint16]*dns.DNSKEY, len(keys))
+	for tag, k := range keys {
+		list[tag] = dns.Copy(k).(*dns.DNSKEY)
+	}
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.m[strings.ToLower(zone)] = &trustZone{
+		keys:    list,
+		ds:      dsKey(ds),
+		status:  StatusSecure,
+		checked: now,
+		expire:  now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// SetBogus sets the bogus status of the zone, the validated keys removed
+func (c *TrustCache) SetBogus(zone string, err error) {
+	now := WallClock.Now().Truncate(time.Second)
+
+	z := &trustZone{
+		status:  StatusBogus,
+		checked: now,
+		expire:  now.Add(BogusTTL),
+	}
+
+	if err != nil {
+		z.err = err.Error()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.m[strings.ToLower(zone)] = z
+}
+
+// Status returns the validation status of a zone
+func (c *TrustCache) Status(zone string) (ZoneStatus, bool) {
+	zone = strings.ToLower(zone)
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	z, ok := c.m[zone]
+	if !ok || !now.Before(z.expire) {
+		return ZoneStatus{}, false
+	}
+
+	return z.zoneStatus(zone), true
+}
+
+// List returns the validation status of the unexpired zones sorted by name
+func (c *TrustCache) List() []ZoneStatus {
+	now := WallClock.Now().Truncate(time.Second)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	list := []ZoneStatus{}
+	for zone, z := range c.m {
+		if now.Before(z.expire) {
+			list = append(list, z.zoneStatus(zone))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Zone < list[j].Zone })
+
+	return list
+}
+
+// Remove removes a zone from the cache
+func (c *TrustCache) Remove(zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, strings.ToLower(zone))
+}
+
+// Length returns the caches length
+func (c *TrustCache) Length() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.m)
+}
+
+func (z *trustZone) zoneStatus(zone string) ZoneStatus {
+	return ZoneStatus{
+		Zone:    zone,
+		Status:  z.status,
+		Error:   z.err,
+		Keys:    len(z.keys),
+		Checked: z.checked,
+		Expire:  z.expire,
+	}
+}
+
+func (c *TrustCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := WallClock.Now().Truncate(time.Second)
+
+	for zone, z := range c.m {
+		if !now.Before(z.expire) {
+			delete(c.m, zone)
+		}
+	}
+}
+
+func (c *TrustCache) run() {
+	ticker := time.NewTicker(time.Hour)
+
+	for range ticker.C {
+		c.clear()
+	}
+}
+
+// dsKey returns the DS records in a comparable form
+func dsKey(ds []dns.RR) string {
+	list := make([]string, 0, len(ds))
+	for _, rr := range ds {
+		if d, ok := rr.(*dns.DS); ok {
+			list = append(list, strconv.Itoa(int(d.KeyTag))+" "+strconv.Itoa(int(d.DigestType))+" "+strings.ToLower(d.Digest))
+		}
+	}
+
+	sort.Strings(list)
+
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TrustCache(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	c := NewTrustCache()
+
+	rr, _ := dns.NewRR("example.com. 3600 IN DNSKEY 257 3 8 AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQbSEW0O8gcCjFFVQUTf6v58fLjwBd0YI0EzrAcQqBGCzh/RStIoO8g0NfnfL2MTJRkxoXbfDaUeVPQuYEhg37NZWAJQ9VnMVDxP/VHL496M/QZxkjf5/Efucp2gaDX6RS6CXpoY68LsvPVjR0ZSwzz1apAzvN9dlzEheX7ICJBBtuA6G3LQpzW5hOA2hzCTMjJPJ8LbqF6dsV6DoBQzgul0sGIcGOYl7OyQdXfZ57relSQageu+ipAdTTJ25AsRTAoub8ONGcLmqrAmRLKBP1dfwhYB4N7knNnulqQxA+Uk1ihz0=")
+	key := rr.(*dns.DNSKEY)
+	keys := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+
+	ds := []dns.RR{key.ToDS(dns.SHA256)}
+	ds[0].Header().Ttl = 600
+
+	assert.Nil(t, c.Get("example.com.", ds))
+
+	c.Set("Example.com.", keys, ds)
+	assert.Len(t, c.Get("example.com.", ds), 1)
+	assert.Nil(t, c.Get("example.com.", []dns.RR{key.ToDS(dns.SHA1)}))
+
+	status, ok := c.Status("example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, StatusSecure, status.Status)
+	assert.Equal(t, 1, status.Keys)
+	assert.Equal(t, fakeClock.Now().Add(600*time.Second), status.Expire)
+
+	fakeClock.Advance(600 * time.Second)
+	assert.Nil(t, c.Get("example.com.", ds))
+	assert.Len(t, c.List(), 0)
+
+	c.Set("example.com.", keys, ds)
+	c.SetBogus("example.com.", errors.New("signature expired"))
+	assert.Nil(t, c.Get("example.com.", ds))
+
+	list := c.List()
+	assert.Len(t, list, 1)
+	assert.Equal(t, StatusBogus, list[0].Status)
+	assert.Equal(t, "signature expired", list[0].Error)
+
+	fakeClock.Advance(BogusTTL)
+	c.clear()
+	assert.Equal(t, 0, c.Length())
+
+	c.Set("example.com.", keys, ds)
+	c.Remove("example.com.")
+	assert.Equal(t, 0, c.Length())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	// cacheBackendMemory keeps the answers in the memory of the node
+	cacheBackendMemory = "memory"
+
+	// cacheBackendRedis shares the answers between the nodes on a redis
+	// server, the memory of the node answers while the server unreachable
+	cacheBackendRedis = "redis"
+
+	// DefaultRedisAddr is the address of the redis server when not given
+	DefaultRedisAddr = "127.0.0.1:6379"
+
+	// DefaultRedisPrefix is the prefix of the redis keys when not given
+	DefaultRedisPrefix = "sdns:"
+)
+
+var cacheBackends = map[string]bool{
+	cacheBackendMemory: true,
+	cacheBackendRedis:  true,
+}
+
+// setCacheBackend sets the storage of the answer cache by the config, the
+// in-memory backend left as is
+func setCacheBackend(c *cache.QueryCache, cfg *config) {
+	if cfg.CacheBackend != cacheBackendRedis {
+		return
+	}
+
+	c.SetBackend(cache.NewRedisBackend(cache.RedisOptions{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+		Prefix:   cfg.RedisPrefix,
+	}, c.Local()))
+}
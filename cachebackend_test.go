@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setCacheBackend(t *testing.T) {
+	// a closed port, the redis backend falls back to the memory
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := cache.NewQueryCache(1024, 0, time.Hour)
+	setCacheBackend(c, &config{CacheBackend: cacheBackendRedis, RedisAddr: addr, RedisPrefix: DefaultRedisPrefix})
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	key := cache.Hash(m.Question[0])
+	assert.NoError(t, c.Set(key, m))
+
+	msg, _, err := c.Get(key, m)
+	if assert.NoError(t, err) {
+		assert.Len(t, msg.Answer, 1)
+	}
+
+	assert.Equal(t, 1, c.Local().Len())
+}
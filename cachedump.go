@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// loadCache fills the cache from the dump file, a corrupted dump removed
+func loadCache(c *cache.QueryCache, path string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("Cache dump open failed", "path", path, "error", err.Error())
+		}
+		return
+	}
+	defer f.Close()
+
+	count, err := c.Load(bufio.NewReader(f))
+	if err != nil {
+		log.Warn("Cache dump corrupted, starting with empty cache", "path", path, "error", err.Error())
+
+		os.Remove(path)
+		return
+	}
+
+	log.Info("Cache loaded from dump", "path", path, "entries", count)
+}
+
+// dumpCache writes the cache entries to the dump file over a temporary file,
+// an interrupted dump keeps the previous one
+func dumpCache(c *cache.QueryCache, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp"))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	count, err := c.Dump(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	log.Info("Cache dumped", "path", path, "entries", count)
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dumpCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.dump")
+
+	c := cache.NewQueryCache(1024, 0, time.Hour)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("example.com. 600 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	c.Set(cache.Hash(m.Question[0]), m)
+
+	assert.NoError(t, dumpCache(c, path))
+	assert.NoError(t, dumpCache(c, ""))
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+
+	c = cache.NewQueryCache(1024, 0, time.Hour)
+	loadCache(c, path)
+	assert.Equal(t, 1, c.Len())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("corrupted"), 0644))
+
+	c = cache.NewQueryCache(1024, 0, time.Hour)
+	loadCache(c, path)
+	assert.Equal(t, 0, c.Len())
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	loadCache(c, path)
+	assert.Equal(t, 0, c.Len())
+}
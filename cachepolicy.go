@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	zoneCachePolicies   = map[string]*cachePolicy{}
+	zoneCachePoliciesMu sync.RWMutex
+)
+
+type zoneCachePolicy struct {
+	Zone    string
+	TTL     uint32
+	NoCache bool
+}
+
+// cachePolicy is the cache ttl override or the cache bypass of a zone
+type cachePolicy struct {
+	zone    string
+	ttl     uint32
+	noCache bool
+}
+
+// newZoneCachePolicies returns the cache policies by the lower case fqdn of the zones
+func newZoneCachePolicies(zones []zoneCachePolicy) (map[string]*cachePolicy, error) {
+	list := make(map[string]*cachePolicy)
+
+	for _, z := range zones {
+		if z.Zone == "" || (z.TTL == 0 && !z.NoCache) {
+			return nil, fmt.Errorf("zone cache policy invalid: %q", z.Zone)
+		}
+
+		p := &cachePolicy{
+			zone:    dns.Fqdn(strings.ToLower(z.Zone)),
+			ttl:     z.TTL,
+			noCache: z.NoCache,
+		}
+
+		list[p.zone] = p
+	}
+
+	return list, nil
+}
+
+// matchCachePolicy returns the cache policy of the longest zone of the name
+func matchCachePolicy(name string) *cachePolicy {
+	zoneCachePoliciesMu.RLock()
+	defer zoneCachePoliciesMu.RUnlock()
+
+	if len(zoneCachePolicies) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if p, ok := zoneCachePolicies[name[off:]]; ok {
+			return p
+		}
+	}
+
+	return zoneCachePolicies["."]
+}
+
+// noCacheName reports the answers of the name never cached
+func noCacheName(name string) bool {
+	p := matchCachePolicy(name)
+
+	return p != nil && p.noCache
+}
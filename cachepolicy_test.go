@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newZoneCachePolicies(t *testing.T) {
+	policies, err := newZoneCachePolicies([]zoneCachePolicy{
+		{Zone: "Example.com", TTL: 30},
+		{Zone: "dyn.example.com", NoCache: true},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, policies, 2)
+
+	zoneCachePoliciesMu.Lock()
+	zoneCachePolicies = policies
+	zoneCachePoliciesMu.Unlock()
+
+	defer func() {
+		zoneCachePoliciesMu.Lock()
+		zoneCachePolicies = map[string]*cachePolicy{}
+		zoneCachePoliciesMu.Unlock()
+	}()
+
+	if p := matchCachePolicy("www.EXAMPLE.com."); assert.NotNil(t, p) {
+		assert.Equal(t, "example.com.", p.zone)
+		assert.Equal(t, uint32(30), p.ttl)
+	}
+
+	assert.True(t, noCacheName("host.dyn.example.com."))
+	assert.True(t, noCacheName("dyn.example.com"))
+	assert.False(t, noCacheName("xdyn.example.com."))
+	assert.Nil(t, matchCachePolicy("example.org."))
+
+	for _, z := range []zoneCachePolicy{{TTL: 30}, {Zone: "example.com"}} {
+		_, err := newZoneCachePolicies([]zoneCachePolicy{z})
+		assert.Error(t, err, z.Zone)
+	}
+}
+
+func Test_HandlerZoneCachePolicy(t *testing.T) {
+	var count int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		q := req.Question[0]
+		switch q.Name {
+		case "host.dyn.policy.internal.", "www.policy.internal.":
+			rr, _ := dns.NewRR(q.Name + " 3600 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		default:
+			m.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("policy.internal. 3600 IN SOA ns.policy.internal. hostmaster.policy.internal. 1 3600 600 86400 3600")
+			m.Ns = append(m.Ns, soa)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "policy.internal", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	policies, err := newZoneCachePolicies([]zoneCachePolicy{
+		{Zone: "policy.internal", TTL: 30},
+		{Zone: "dyn.policy.internal", NoCache: true},
+	})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	zoneCachePoliciesMu.Lock()
+	zoneCachePolicies = policies
+	zoneCachePoliciesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+
+		zoneCachePoliciesMu.Lock()
+		zoneCachePolicies = map[string]*cachePolicy{}
+		zoneCachePoliciesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	// the no-cache names always resolved
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("host.dyn.policy.internal.", dns.TypeA)
+
+		resp, status := handler.queryStatus("udp", req)
+		assert.Equal(t, statusMiss, status)
+		assert.Len(t, resp.Answer, 1)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// the positive and negative answers cached with the ttl override
+	for _, name := range []string{"www.policy.internal.", "nx.policy.internal."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		_, status := handler.queryStatus("udp", req)
+		assert.Equal(t, statusMiss, status)
+
+		resp, status := handler.queryStatus("udp", req)
+		assert.Equal(t, statusHit, status)
+
+		for _, rr := range append(resp.Answer, resp.Ns...) {
+			assert.True(t, rr.Header().Ttl <= 30, rr.String())
+		}
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&count))
+
+	api := &API{resolver: handler.r}
+
+	r := gin.New()
+	r.GET("/api/v1/cache/:name/:type", api.getCache)
+
+	serve := func(url string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		r.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, serve("/api/v1/cache/host.dyn.policy.internal/A"))
+	assert.Equal(t, http.StatusOK, serve("/api/v1/cache/www.policy.internal/A"))
+	assert.Equal(t, http.StatusOK, serve("/api/v1/cache/nx.policy.internal/A"))
+}
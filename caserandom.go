@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+const (
+	// maxCaseNormalizers limits the noted servers which normalize the query name case
+	maxCaseNormalizers = 10000
+)
+
+var (
+	// CaseNormalizerTTL is the time a server which normalizes the query name
+	// case queried without the case randomization
+	CaseNormalizerTTL = time.Hour
+
+	errCaseMismatch = errors.New("query name of the response mismatch")
+
+	caseNormalizers = newCaseNormalizerList()
+)
+
+// caseNormalizerList keeps the servers which normalize the query name case,
+// the servers noted for a while and retried with randomization after
+type caseNormalizerList struct {
+	mu sync.RWMutex
+
+	servers map[string]time.Time
+}
+
+func newCaseNormalizerList() *caseNormalizerList {
+	return &caseNormalizerList{servers: make(map[string]time.Time)}
+}
+
+func (l *caseNormalizerList) has(host string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	noted, ok := l.servers[host]
+
+	return ok && time.Since(noted) < CaseNormalizerTTL
+}
+
+func (l *caseNormalizerList) add(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.servers[host]; !ok && len(l.servers) >= maxCaseNormalizers {
+		l.servers = make(map[string]time.Time)
+	}
+
+	l.servers[host] = time.Now()
+}
+
+// randomizeCase returns the name with the letters in random case (0x20 encoding),
+// the bits from the crypto random source
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name)/8+1)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		} else if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+
+	return string(b)
+}
+
+// randomizeQuery returns a copy of the request with the query name case
+// randomized, the request returned unchanged if randomization not applies to
+// the server
+func randomizeQuery(req *dns.Msg, host string) (*dns.Msg, bool) {
+	if !Config().CaseRandomization || len(req.Question) == 0 || caseNormalizers.has(host) {
+		return req, false
+	}
+
+	sent := req.Copy()
+	sent.Question[0].Name = randomizeCase(req.Question[0].Name)
+
+	return sent, true
+}
+
+// checkCase verifies the query name of the response echoed byte for byte as
+// sent and restores the original case. The server which echoed the name in
+// another case noted as a case normalizer, normalized reported true.
+func checkCase(resp, sent, req *dns.Msg, host string) (normalized bool, err error) {
+	if len(resp.Question) == 0 {
+		// the errors sent without the question
+		return false, nil
+	}
+
+	name, want := resp.Question[0].Name, sent.Question[0].Name
+	if name != want {
+		if !strings.EqualFold(name, want) {
+			log.Debug("Query name of the response mismatch", "query", formatQuestion(sent.Question[0]), "server", host, "name", name)
+			return false, errCaseMismatch
+		}
+
+		caseNormalizers.add(host)
+		log.Info("Upstream normalizes the query name case, case randomization disabled for the server", "server", host, "ttl", CaseNormalizerTTL.String())
+
+		return true, nil
+	}
+
+	orig := req.Question[0].Name
+	resp.Question[0].Name = orig
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == want {
+				rr.Header().Name = orig
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_randomizeCase(t *testing.T) {
+	name := "abcdefghijklmnopqrstuvwxyz0123456789.example.com."
+
+	randomized := false
+	for i := 0; i < 8; i++ {
+		r := randomizeCase(name)
+		assert.True(t, strings.EqualFold(name, r))
+		assert.Equal(t, len(name), len(r))
+
+		if r != name {
+			randomized = true
+		}
+	}
+
+	assert.True(t, randomized)
+	assert.Equal(t, ".", randomizeCase("."))
+}
+
+func Test_exchangeCaseRandomization(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.CaseRandomization = true })()
+
+	var mu sync.Mutex
+	var received []string
+	var servers []*dns.Server
+
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	run := func(name func(string) string) string {
+		s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+			srv.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				mu.Lock()
+				received = append(received, req.Question[0].Name)
+				mu.Unlock()
+
+				m := new(dns.Msg)
+				m.SetReply(req)
+				m.Question[0].Name = name(req.Question[0].Name)
+				m.Answer = newRRs(m.Question[0].Name + " 300 IN A 192.0.2.1")
+				w.WriteMsg(m)
+			})
+		})
+		assert.NoError(t, err)
+		servers = append(servers, s)
+
+		return addrstr
+	}
+
+	echo := run(func(name string) string { return name })
+	normalize := run(strings.ToLower)
+	bogus := run(func(string) string { return "other.example.com." })
+
+	r := NewResolver()
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{Timeout: time.Second}, ReadTimeout: 2 * time.Second}
+
+	qname := "abcdefghijklmnopqrstuvwxyz.example.com."
+
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeA)
+
+	// the echoed case restored in the response
+	resp, err := r.exchange(cache.NewAuthServer(echo), req, c)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, qname, resp.Question[0].Name)
+		assert.Equal(t, qname, resp.Answer[0].Header().Name)
+	}
+	assert.Equal(t, qname, req.Question[0].Name)
+
+	mu.Lock()
+	assert.NotEqual(t, qname, received[0])
+	assert.True(t, strings.EqualFold(qname, received[0]))
+	received = nil
+	mu.Unlock()
+
+	// the normalizing server noted and queried without randomization
+	resp, err = r.exchange(cache.NewAuthServer(normalize), req, c)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, qname, resp.Question[0].Name)
+	}
+	assert.True(t, caseNormalizers.has(normalize))
+
+	_, err = r.exchange(cache.NewAuthServer(normalize), req, c)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	assert.Len(t, received, 3)
+	assert.Equal(t, []string{qname, qname}, received[1:])
+	mu.Unlock()
+
+	// the response of another name rejected
+	_, err = r.exchange(cache.NewAuthServer(bogus), req, c)
+	assert.Equal(t, errCaseMismatch, err)
+
+	// the cache keys of the cases same
+	upper := dns.Question{Name: strings.ToUpper(qname), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	assert.Equal(t, cache.Hash(req.Question[0]), cache.Hash(upper))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/semihalev/log"
+)
+
+// CertCheckInterval is the least interval the modification times of the
+// certificate files checked on the handshakes
+var CertCheckInterval = 10 * time.Second
+
+// certStore serves the certificate of the tls listeners, reloaded when the
+// modification times of the files changed. The new connections get the
+// reloaded certificate while the existing connections kept.
+type certStore struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// tlsListening reports whether any listener of the config serves over tls,
+// the certificate needed only then
+func tlsListening(cfg *config) bool {
+	return cfg.BindTLS != "" || cfg.BindDOH != "" || cfg.BindDOQ != "" || cfg.BindGRPC != ""
+}
+
+// newCertStore returns the store of the certificate files, an error returned
+// when the files can not be loaded
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	s := &certStore{certFile: certFile, keyFile: keyFile}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the current certificate, the files checked for the
+// changes at most once in the check interval
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	cert, checked := s.cert, s.checked
+	s.mu.RUnlock()
+
+	if time.Since(checked) < CertCheckInterval {
+		return cert, nil
+	}
+
+	s.mu.Lock()
+	s.checked = time.Now()
+	s.mu.Unlock()
+
+	if s.modified() {
+		if err := s.reload(); err != nil {
+			log.Error("TLS certificate reload failed, keeping the old certificate", "cert", s.certFile, "error", err.Error())
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert, nil
+}
+
+// modified reports any of the files changed since the last load
+func (s *certStore) modified() bool {
+	certMod, keyMod, err := s.modTimes()
+	if err != nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return !certMod.Equal(s.certMod) || !keyMod.Equal(s.keyMod)
+}
+
+func (s *certStore) modTimes() (time.Time, time.Time, error) {
+	cfi, err := os.Stat(s.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	kfi, err := os.Stat(s.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return cfi.ModTime(), kfi.ModTime(), nil
+}
+
+// reload loads the certificate and the key, the pair validated before
+// swapping and the current certificate kept on the failure
+func (s *certStore) reload() error {
+	certMod, keyMod, err := s.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("certificate invalid: %s", err)
+	}
+	cert.Leaf = leaf
+
+	s.mu.Lock()
+	reloaded := s.cert != nil
+	s.cert = &cert
+	s.certMod, s.keyMod = certMod, keyMod
+	s.checked = time.Now()
+	s.mu.Unlock()
+
+	if reloaded {
+		log.Info("TLS certificate reloaded", "cert", s.certFile, "subject", leaf.Subject.String(), "expire", leaf.NotAfter)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_certStoreReload(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	defer func(interval time.Duration) {
+		CertCheckInterval = interval
+	}(CertCheckInterval)
+
+	CertCheckInterval = 0
+
+	_, err = newCertStore("test.cert", "missing.key")
+	assert.Error(t, err)
+
+	certs, err := newCertStore("test.cert", "test.key")
+	assert.NoError(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig(certs, []string{"dot"}))
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	peer := func() []byte {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", ln.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"dot"}})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	touch := func(d time.Duration) {
+		mod := time.Now().Add(d)
+		assert.NoError(t, os.Chtimes("test.cert", mod, mod))
+		assert.NoError(t, os.Chtimes("test.key", mod, mod))
+	}
+
+	old := peer()
+	assert.Equal(t, old, peer())
+
+	// the renewed certificate served to the new connections
+	assert.NoError(t, generateCertificate())
+	touch(time.Minute)
+
+	renewed := peer()
+	assert.NotEqual(t, old, renewed)
+
+	// the broken pair rejected, the current certificate kept
+	assert.NoError(t, ioutil.WriteFile("test.key", []byte("broken"), 0600))
+	touch(2 * time.Minute)
+
+	assert.Equal(t, renewed, peer())
+	assert.Error(t, certs.reload())
+
+	// the forced reload of the fixed files
+	assert.NoError(t, generateCertificate())
+	assert.NoError(t, certs.reload())
+
+	cert, err := certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, renewed, cert.Certificate[0])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The CHAOS class names of the server identity (RFC 4892)
+var (
+	chaosVersionNames = map[string]bool{
+		"version.bind.":   true,
+		"version.server.": true,
+	}
+
+	chaosIDNames = map[string]bool{
+		"hostname.bind.": true,
+		"id.server.":     true,
+	}
+)
+
+// chaosText returns the text of the CHAOS class identity name, false when the
+// name unknown or the disclosure disabled
+func chaosText(name string) (string, bool) {
+	cfg := Config()
+	if !cfg.Chaos {
+		return "", false
+	}
+
+	name = strings.ToLower(name)
+
+	switch {
+	case chaosVersionNames[name]:
+		if cfg.ChaosVersion != "" {
+			return cfg.ChaosVersion, true
+		}
+
+		return "sdns " + Version, true
+	case chaosIDNames[name]:
+		if cfg.ChaosID != "" {
+			return cfg.ChaosID, true
+		}
+
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", false
+		}
+
+		return hostname, true
+	}
+
+	return "", false
+}
+
+// chaos answers the CHAOS class queries locally, other names refused
+func (h *DNSHandler) chaos(req *dns.Msg, opt *dns.OPT, dsReq bool) *dns.Msg {
+	q := req.Question[0]
+
+	text, ok := chaosText(q.Name)
+	if !ok {
+		return h.handleFailed(req, dns.RcodeRefused, dsReq)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	if q.Qtype == dns.TypeTXT {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{text},
+		})
+	}
+
+	opt.SetDo(dsReq)
+	msg.Extra = append(msg.Extra, opt)
+
+	return msg
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_handlerChaos(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.Chaos = true
+		cfg.ChaosVersion = ""
+		cfg.ChaosID = "ns1.example.com"
+	})()
+
+	handler := NewHandler()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		req.RecursionDesired = true
+
+		return handler.query("udp", req)
+	}
+
+	resp := query("version.bind.", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"sdns " + Version}, resp.Answer[0].(*dns.TXT).Txt)
+		assert.Equal(t, uint16(dns.ClassCHAOS), resp.Answer[0].Header().Class)
+	}
+
+	defer setConfig(func(cfg *config) { cfg.ChaosVersion = "hidden" })()
+
+	resp = query("VERSION.SERVER.", dns.TypeTXT)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"hidden"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	resp = query("id.server.", dns.TypeTXT)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"ns1.example.com"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	resp = query("hostname.bind.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+
+	resp = query("authors.bind.", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	defer setConfig(func(cfg *config) { cfg.Chaos = false })()
+
+	resp = query("version.bind.", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+
+	assert.Equal(t, 0, handler.r.Qcache.Len())
+}
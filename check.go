@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/rpz"
+)
+
+// CheckConfig validates the config file and exits without starting the servers
+var CheckConfig = flag.Bool("check", false, "validate the config file and exit, non-zero exit status on problems")
+
+// checkConfig returns the problems of the config file, nothing bound or
+// replaced. The missing config file is not generated.
+func checkConfig(path string) []error {
+	if _, err := os.Stat(path); err != nil {
+		return []error{fmt.Errorf("config file not found: %s", path)}
+	}
+
+	cfg := new(config)
+
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return []error{fmt.Errorf("could not load config: %s", err)}
+	}
+
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := log.LvlFromString(cfg.LogLevel); err != nil {
+		add(fmt.Errorf("log verbosity level unknown: %s", cfg.LogLevel))
+	}
+
+	errs = append(errs, validateConfig(cfg)...)
+
+	_, err := parseRootKeys(cfg.RootKeys)
+	add(err)
+
+	_, err = parseBootstrapServers(cfg.BootstrapServers)
+	add(err)
+
+	_, err = newAccessList(cfg.AccessList, cfg.AccessRules, cfg.UpstreamGroups)
+	add(err)
+
+	_, err = newListenerPolicies(cfg.Listeners, cfg.UpstreamGroups)
+	add(err)
+
+	_, err = newBlockIPRanges(cfg.BlockIPRanges)
+	add(err)
+
+	_, err = newTrustedProxies(cfg.TrustedProxies)
+	add(err)
+
+	_, err = parseNTAs(cfg.NegativeTrustAnchors)
+	add(err)
+
+	_, err = newForwardZones(cfg.ForwardZones)
+	add(err)
+
+	_, err = newRewriteRules(cfg.RewriteRules)
+	add(err)
+
+	_, err = newQueryChain(cfg.Middleware)
+	add(err)
+
+	_, err = newZoneCachePolicies(cfg.ZoneCachePolicy)
+	add(err)
+
+	_, err = newForceTCPTypes(cfg.ForceTCPTypes)
+	add(err)
+
+	_, err = newQTypeACL(cfg.AllowedQTypes, cfg.DeniedQTypes)
+	add(err)
+
+	_, err = newSortNets(cfg.SortList)
+	add(err)
+
+	_, err = newOutboundAddrs(cfg.OutboundIPs, cfg.OutboundInterface)
+	add(err)
+
+	_, err = newPrivateReverseExcludes(cfg.PrivateReverseExclude)
+	add(err)
+
+	_, err = newDNS64State(cfg)
+	add(err)
+
+	add(NewHosts().Load(cfg.HostsFile))
+	add(rpz.New().Load(cfg.RPZFiles...))
+	add(NewZones().Load(cfg.LocalZones))
+
+	binds := map[string]string{
+		"bind":     cfg.Bind,
+		"bindtls":  cfg.BindTLS,
+		"binddoh":  cfg.BindDOH,
+		"binddoq":  cfg.BindDOQ,
+		"bindgrpc": cfg.BindGRPC,
+		"api":      cfg.API,
+	}
+
+	for _, key := range []string{"bind", "bindtls", "binddoh", "binddoq", "bindgrpc", "api"} {
+		if addr := binds[key]; addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				add(fmt.Errorf("%s address invalid: %s", key, addr))
+			}
+		}
+	}
+
+	if tlsListening(cfg) {
+		if _, err := newCertStore(cfg.TLSCertificate, cfg.TLSPrivateKey); err != nil {
+			add(fmt.Errorf("tls certificate invalid: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// runCheck writes the report of the config file, returns the exit status
+func runCheck(w io.Writer, path string) int {
+	errs := checkConfig(path)
+	if len(errs) == 0 {
+		fmt.Fprintf(w, "%s: config ok\n", path)
+		return 0
+	}
+
+	fmt.Fprintf(w, "%s: %d problem(s) found\n", path, len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(w, "  - %s\n", err)
+	}
+
+	return 1
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCheckConfig(t *testing.T, dir string, replace ...string) string {
+	body := fmt.Sprintf(defaultConfig, ConfigVersion)
+	for i := 0; i+1 < len(replace); i += 2 {
+		assert.Contains(t, body, replace[i])
+		body = strings.Replace(body, replace[i], replace[i+1], 1)
+	}
+
+	path := filepath.Join(dir, "sdns.toml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(body), 0644))
+
+	return path
+}
+
+func Test_checkConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_check")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeCheckConfig(t, dir)
+	assert.Empty(t, checkConfig(path))
+
+	// the missing config not generated
+	missing := filepath.Join(dir, "missing.toml")
+	assert.Len(t, checkConfig(missing), 1)
+	_, err = os.Stat(missing)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("bind = \":53\"\nloglevel = \n"), 0644))
+	errs := checkConfig(path)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "could not load config")
+
+	path = writeCheckConfig(t, dir,
+		`accesslist = [`, `accesslist = ["10.0.0.0/33",`,
+		`rootkeys = [`, `rootkeys = ["not a record",`)
+
+	errs = checkConfig(path)
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "root keys invalid")
+	assert.Contains(t, errs[1].Error(), "10.0.0.0/33")
+
+	// the problems reported together
+	path = writeCheckConfig(t, dir,
+		`loglevel = "info"`, `loglevel = "loud"`,
+		`bind = ":53"`, `bind = "53"`,
+		`accesslist = [`, `accesslist = ["10.0.0.0/33",`)
+
+	errs = checkConfig(path)
+	assert.Len(t, errs, 3)
+}
+
+func Test_runCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_check")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+
+	path := writeCheckConfig(t, dir)
+	assert.Equal(t, 0, runCheck(&out, path))
+	assert.Contains(t, out.String(), "config ok")
+
+	out.Reset()
+
+	path = writeCheckConfig(t, dir, `rootkeys = [`, `rootkeys = ["not a record",`)
+	assert.Equal(t, 1, runCheck(&out, path))
+	assert.Contains(t, out.String(), "1 problem(s) found")
+	assert.Contains(t, out.String(), "root keys invalid")
+}
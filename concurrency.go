@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// queryLimiter bounds the udp and tcp client queries in progress, the udp
+// and the tcp queries share the budget or budgeted apart. The https, quic and
+// grpc queries use the tcp budget.
+type queryLimiter struct {
+	limit int
+	wait  time.Duration
+
+	udp chan struct{}
+	tcp chan struct{}
+}
+
+var (
+	queryLimit   *queryLimiter
+	queryLimitMu sync.RWMutex
+)
+
+func newQueryLimiter(limit int, wait time.Duration, perProto bool) *queryLimiter {
+	l := &queryLimiter{
+		limit: limit,
+		wait:  wait,
+		udp:   make(chan struct{}, limit),
+	}
+
+	l.tcp = l.udp
+	if perProto {
+		l.tcp = make(chan struct{}, limit)
+	}
+
+	return l
+}
+
+// setupQueryLimiter replaces the query limiter, disabled if the limit is 0.
+// The queries in progress release the slots of the old limiter.
+func setupQueryLimiter(cfg *config) {
+	var l *queryLimiter
+	if cfg.MaxConcurrentQueries > 0 {
+		l = newQueryLimiter(cfg.MaxConcurrentQueries, cfg.ConcurrencyWait.Duration, cfg.ConcurrencyPerProto)
+	}
+
+	queryLimitMu.Lock()
+	queryLimit = l
+	queryLimitMu.Unlock()
+}
+
+func currentQueryLimiter() *queryLimiter {
+	queryLimitMu.RLock()
+	defer queryLimitMu.RUnlock()
+
+	return queryLimit
+}
+
+// acquire takes a slot of the protocol, waits for a free one up to the wait
+// duration. The release must be called once the query done.
+func (l *queryLimiter) acquire(proto string) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+
+	sem := l.udp
+	if proto != "udp" {
+		sem = l.tcp
+	}
+
+	release = func() { <-sem }
+
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if l.wait <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case sem <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// overloaded refuses the query above the concurrency limit
+func (h *DNSHandler) overloaded(proto string, w dns.ResponseWriter, req *dns.Msg) {
+	countOverloaded(h.remoteAddr(w), proto)
+
+	h.writeReplyMsg(w, h.handleFailed(req, dns.RcodeRefused, false))
+}
+
+// countOverloaded counts the query refused by the concurrency limit
+func countOverloaded(client, proto string) {
+	atomic.AddInt64(&stats.overloaded, 1)
+
+	log.Debug("Query refused by concurrency limit", "client", client, "net", proto)
+}
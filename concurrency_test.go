@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_queryLimiter(t *testing.T) {
+	var l *queryLimiter
+
+	_, ok := l.acquire("udp")
+	assert.True(t, ok)
+
+	l = newQueryLimiter(1, 0, false)
+
+	release, ok := l.acquire("udp")
+	assert.True(t, ok)
+
+	// the budget shared by the protocols
+	_, ok = l.acquire("tcp")
+	assert.False(t, ok)
+
+	release()
+
+	release, ok = l.acquire("tcp")
+	assert.True(t, ok)
+	release()
+
+	l = newQueryLimiter(1, 0, true)
+
+	release, ok = l.acquire("udp")
+	assert.True(t, ok)
+
+	tcpRelease, ok := l.acquire("tcp")
+	assert.True(t, ok)
+	tcpRelease()
+
+	_, ok = l.acquire("udp")
+	assert.False(t, ok)
+
+	// the waiting query takes the released slot
+	l.wait = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+
+	release, ok = l.acquire("udp")
+	assert.True(t, ok)
+	release()
+}
+
+func Test_HandlerConcurrencyLimit(t *testing.T) {
+	defer func() {
+		setupQueryLimiter(Config())
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.MaxConcurrentQueries = 1 })()
+	setupQueryLimiter(Config())
+
+	handler := NewHandler()
+
+	release, ok := currentQueryLimiter().acquire("udp")
+	assert.True(t, ok)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}}
+
+	overloaded := stats.overloaded
+
+	handler.UDP(w, req.Copy())
+	assert.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeRefused, w.msg.Rcode)
+	assert.Equal(t, overloaded+1, stats.overloaded)
+
+	release()
+
+	w = &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}}
+
+	req.SetQuestion("localhost.", dns.TypeA)
+	handler.UDP(w, req.Copy())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, handler.wait(ctx))
+	assert.NotNil(t, w.msg)
+	assert.NotEqual(t, dns.RcodeRefused, w.msg.Rcode)
+
+	// the slot released after the query
+	release, ok = currentQueryLimiter().acquire("udp")
+	assert.True(t, ok)
+	release()
+
+	// the https queries refused alike
+	release, ok = currentQueryLimiter().acquire("tcp")
+	assert.True(t, ok)
+
+	data, err := req.Pack()
+	assert.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, overloaded+2, stats.overloaded)
+
+	release()
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,33 +14,159 @@ import (
 )
 
 type config struct {
-	Version         string
-	BlockLists      []string
-	BlockListDir    string
-	RootServers     []string
-	Root6Servers    []string
-	RootKeys        []string
-	FallbackServers []string
-	AccessList      []string
-	Log             string
-	LogLevel        string
-	Bind            string
-	BindTLS         string
-	BindDOH         string
-	TLSCertificate  string
-	TLSPrivateKey   string
-	API             string
-	Nullroute       string
-	Nullroutev6     string
-	OutboundIPs     []string
-	Timeout         duration
-	ConnectTimeout  duration
-	Expire          uint32
-	CacheSize       int
-	Maxdepth        int
-	RateLimit       int
-	Blocklist       []string
-	Whitelist       []string
+	Version               string
+	BlockLists            []string
+	BlockListURLs         []blocklistSource
+	BlockListDir          string
+	BlockListRefresh      duration
+	BlockListMaxEntries   int
+	AllowListDir          string
+	HostsFile             string
+	BlockPrivateReverse   bool
+	PrivateReverseHosts   bool
+	PrivateReverseExclude []string
+	RPZFiles              []string
+	RootServers           []string
+	Root6Servers          []string
+	PrimeRoots            bool
+	IPv6                  string
+	RootKeys              []string
+	TrustAnchorFile       string
+	FallbackServers       []string
+	BootstrapServers      []string
+	AccessList            []string
+	AccessDefaultDeny     bool
+	AccessDeniedMode      string
+	AccessRules           []accessRule
+	UpstreamGroups        map[string][]string
+	Listeners             map[string]listenerConfig
+	ForwardZones          []forwardZone
+	RewriteRules          []rewriteRule
+	ZoneCachePolicy       []zoneCachePolicy
+	LocalZones            map[string]string
+	DnstapSocket          string
+	QueryLogFile          string
+	QueryLogFormat        string
+	QueryLogMaxSizeMB     int
+	QueryLogBackups       int
+	LogBlockedOnly        bool
+	Log                   string
+	LogLevel              string
+	Bind                  string
+	BindTLS               string
+	BindDOH               string
+	TrustedProxies        []string
+	TrustedProxyHeader    string
+	BindDOQ               string
+	BindGRPC              string
+	TLSCertificate        string
+	TLSPrivateKey         string
+	TLSMinVersion         string
+	TLSCipherSuites       []string
+	TLSNoSessionTickets   bool
+	DOTALPN               []string
+	DOHALPN               []string
+	API                   string
+	Nullroute             string
+	Nullroutev6           string
+	BlockResponse         string
+	BlockTTL              uint32
+	SinkholeIP            string
+	SinkholeIPv6          string
+	SinkholeZone          string
+	SinkholeTTL           uint32
+	OutboundIPs           []string
+	OutboundInterface     string
+	Timeout               duration
+	ConnectTimeout        duration
+	UDPTimeout            duration
+	TCPTimeout            duration
+	TLSTimeout            duration
+	DOHTimeout            duration
+	UDPConnectTimeout     duration
+	TCPConnectTimeout     duration
+	TLSConnectTimeout     duration
+	DOHConnectTimeout     duration
+	ParallelQueries       int
+	RetryOnServfail       int
+	ShutdownTimeout       duration
+	UpstreamMaxConns      int
+	UpstreamIdleTimeout   duration
+	MaxConcurrentQueries  int
+	ConcurrencyWait       duration
+	ConcurrencyPerProto   bool
+	Expire                uint32
+	NegativeTTL           uint32
+	MinTTL                uint32
+	MaxTTL                uint32
+	CacheSize             int
+	CacheShards           int
+	CacheMaxBytes         int64
+	CacheBackend          string
+	RedisAddr             string
+	RedisPassword         string
+	RedisDB               int
+	RedisPrefix           string
+	CacheDumpPath         string
+	PrewarmFile           string
+	PrewarmConcurrency    int
+	ServeStale            bool
+	ServeStaleTTL         duration
+	Prefetch              bool
+	PrefetchThreshold     int
+	EDNSClientSubnet      bool
+	ECSPrefix             int
+	ECSPrefixv6           int
+	DNSSEC                string
+	NegativeTrustAnchors  []string
+	AggressiveNSEC        bool
+	HardenBelowNXDOMAIN   bool
+	HealthCheckInterval   duration
+	HealthCheckFailures   int
+	HealthCheckName       string
+	RttWeighting          bool
+	QnameMinimization     string
+	AnyQueryMode          string
+	AllowedQTypes         []string
+	DeniedQTypes          []string
+	DNS64                 bool
+	DNS64Prefix           string
+	DNS64Exclude          []string
+	Maxdepth              int
+	MaxCNAMEDepth         int
+	MaxRecursionDepth     int
+	RateLimit             int
+	ClientRateLimit       int
+	ClientRateLimitBurst  int
+	ClientRateLimitHard   int
+	Cookies               bool
+	CaseRandomization     bool
+	Padding               bool
+	PaddingBlockSize      int
+	UDPMinSize            int
+	UDPMaxSize            int
+	MaxAnswerRecords      int
+	UpstreamUDPSize       int
+	UpstreamTransport     string
+	ForceTCPTypes         []string
+	TCPFastOpen           bool
+	Chaos                 bool
+	ChaosVersion          string
+	ChaosID               string
+	NSID                  string
+	EDNSExpire            bool
+	ExtendedErrors        bool
+	MinimalResponses      bool
+	RoundRobin            bool
+	SortList              []string
+	SortListProbe         bool
+	SortListProbePort     int
+	SortListProbeTTL      duration
+	Middleware            []string
+	Blocklist             []string
+	Whitelist             []string
+	AllowList             []string
+	BlockIPRanges         []string
 }
 
 type duration struct {
@@ -67,9 +194,25 @@ blocklists = [
 "https://raw.githubusercontent.com/quidsup/notrack/master/trackers.txt"
 ]
 
+# remote blocklists with the list format; hosts, domains, adblock (||example.com^ rules) or unbound (local-zone and local-data lines)
+# the optional category, like ads, tracking, malware or adult, disabled and enabled on the HTTP API (/api/v1/categories)
+# [[blocklisturls]]
+# url = "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt"
+# format = "adblock"
+# category = "ads"
+
 # list of locations to recursively read blocklists from (warning, every file found is assumed to be a hosts-file or domain list)
 blocklistdir = "blocklist"
 
+# interval of downloading and reloading the remote blocklists, unchanged lists are not downloaded again, 0 disables
+blocklistrefresh = "24h"
+
+# maximum entries loaded from the blocklists against the memory exhaustion, the remaining entries skipped, 0 for no limit
+blocklistmaxentries = 0
+
+# list of locations to recursively read allowlists from, allowed domains and their subdomains override the blocklists
+# allowlistdir = "allowlist"
+
 # what kind of information should be logged, Log verbosity level [crit,error,warn,info,debug]
 loglevel = "info"
 
@@ -82,16 +225,53 @@ bind = ":53"
 # address to bind to for the DNS-over-HTTPS server
 # binddoh = ":8053"
 
-# tls certificate file
+# proxies the client address header of the DNS-over-HTTPS queries honored from, cidrs or addresses
+# the access list, the client rate limit, the client subnet and the query logs use the forwarded client address
+# trustedproxies = ["127.0.0.1", "10.0.0.0/8"]
+
+# header the trusted proxies write the client address to [x-forwarded-for,forwarded], the other header ignored
+# trustedproxyheader = "x-forwarded-for"
+
+# address to bind to for the DNS-over-QUIC server
+# binddoq = ":853"
+
+# address to bind to for the gRPC server of the wire format queries
+# bindgrpc = ":8553"
+
+# tls certificate file, reloaded when the certificate or the key file changes
 # tlscertificate = "server.crt"
 
 # tls private key file
 # tlsprivatekey = "server.key"
 
-# outbound ip addresses, if you set multiple, sdns can use random outbound ip address 
+# minimum tls version of the DNS-over-TLS, DNS-over-HTTPS and gRPC servers: 1.0, 1.1, 1.2 or 1.3
+tlsminversion = "1.2"
+
+# tls 1.2 cipher suites of the servers in the go names, the secure suites used if empty
+# tlsciphersuites = ["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"]
+tlsciphersuites = []
+
+# disable the session tickets, the reconnecting clients resume their sessions without a full handshake otherwise
+tlsnosessiontickets = false
+
+# alpn protocols of the DNS-over-TLS server
+dotalpn = ["dot"]
+
+# alpn protocols of the DNS-over-HTTPS server, the http/2 disabled without h2
+dohalpn = ["h2", "http/1.1"]
+
+# outbound ip addresses of the plain upstream queries, the ipv4 and the ipv6 addresses used for the servers of
+# their family, a random one if you set multiple of a family
 outboundips = []
 
-# root servers
+# outbound interface name, its addresses used like the outbound ip addresses
+# outboundinterface = "eth1"
+
+# root servers, tls:// and https:// prefixed encrypted resolvers can be used instead of the root servers
+# the certificate name verified, name query parameter overrides it or pin parameter verifies the base64 sha256 public key
+# like "tls://1.1.1.1:853?name=cloudflare-dns.com" or "https://dns.google/dns-query"
+# a |pin=sha256/<base64> suffix pins the sha256 of the certificate public key, repeated for the pin rotation,
+# the servers presented other keys refused and taken out of rotation like "tls://9.9.9.9:853|pin=sha256/..."
 rootservers = [
 "192.5.5.241:53",
 "198.41.0.4:53",
@@ -125,18 +305,35 @@ root6servers = [
 "[2001:dc3::35]:53"
 ]
 
+# replace the root servers above by the root name servers and their addresses asked to them on startup and hourly,
+# the answer validated if the dnssec enabled; the servers above kept if the priming fails
+primeroots = true
+
+# ipv6 transport of the upstream queries: auto, prefer, only or off
+# auto and prefer race the ipv6 and ipv4 servers with an ipv6 head start, auto demotes ipv6 after repeated failures
+ipv6 = "auto"
+
 # root keys for dnssec
 rootkeys = [
 ".			172800	IN	DNSKEY	257 3 8 AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQbSEW0O8gcCjFFVQUTf6v58fLjwBd0YI0EzrAcQqBGCzh/RStIoO8g0NfnfL2MTJRkxoXbfDaUeVPQuYEhg37NZWAJQ9VnMVDxP/VHL496M/QZxkjf5/Efucp2gaDX6RS6CXpoY68LsvPVjR0ZSwzz1apAzvN9dlzEheX7ICJBBtuA6G3LQpzW5hOA2hzCTMjJPJ8LbqF6dsV6DoBQzgul0sGIcGOYl7OyQdXfZ57relSQageu+ipAdTTJ25AsRTAoub8ONGcLmqrAmRLKBP1dfwhYB4N7knNnulqQxA+Uk1ihz0=",
 ".			172800	IN	DNSKEY	256 3 8 AwEAAdp440E6Mz7c+Vl4sPd0lTv2Qnc85dTW64j0RDD7sS/zwxWDJ3QRES2VKDO0OXLMqVJSs2YCCSDKuZXpDPuf++YfAu0j7lzYYdWTGwyNZhEaXtMQJIKYB96pW6cRkiG2Dn8S2vvo/PxW9PKQsyLbtd8PcwWglHgReBVp7kEv/Dd+3b3YMukt4jnWgDUddAySg558Zld+c9eGWkgWoOiuhg4rQRkFstMX1pRyOSHcZuH38o1WcsT4y3eT0U/SR6TOSLIB/8Ftirux/h297oS7tCcwSPt0wwry5OFNTlfMo8v7WGurogfk8hPipf7TTKHIi20LWen5RCsvYsQBkYGpF78="
 ]
 
-# fallback servers
+# root trust anchors file maintained by RFC 5011, initialized from the rootkeys, the rootkeys ignored once the file used
+# trustanchorfile = "root.anchors"
+
+# fallback servers, also used when the encrypted root servers down
+# a |weight=N suffix (8.8.8.8:53|weight=3) distributes the queries by weighted round-robin instead of the fastest first
 fallbackservers = [
 "8.8.8.8:53",
 "8.8.4.4:53"
 ]
 
+# plain ip resolvers used only for the hostnames of the tls:// and https:// servers, cached apart from the query cache
+# the system resolver used for the hostnames if empty, dialed addresses kept for the connection lifetime
+# bootstrapservers = ["9.9.9.9:53", "149.112.112.112:53"]
+bootstrapservers = []
+
 # address to bind to for the http API server disable for left blank
 api = "127.0.0.1:8080"
 
@@ -146,54 +343,451 @@ nullroute = "0.0.0.0"
 # ipv6 address to forward blocked queries to
 nullroutev6 = "0:0:0:0:0:0:0:0"
 
+# response mode for the blocked queries: zeroip (nullroute addresses), nxdomain, refused or nodata
+blockresponse = "zeroip"
+
+# ttl of the synthesized responses for the blocked queries in seconds
+blockttl = 60
+
+# ipv4 and ipv6 addresses of the block page server answered instead of the nullroute addresses in the zeroip mode
+# the queries of the family without a sinkhole answered with no data
+# sinkholeip = "192.168.1.2"
+# sinkholeipv6 = "fd00::2"
+sinkholeip = ""
+sinkholeipv6 = ""
+
+# every name at and below the zone answered locally with the sinkhole addresses, empty for none
+# sinkholezone = "blocked.mynet"
+sinkholezone = ""
+
+# ttl of the sinkhole answers in seconds, short for the unblocked names resolved again soon
+sinkholettl = 10
+
 # which clients allowed to make queries
 accesslist = [
 "0.0.0.0/0",
 "::0/0"
 ]
 
+# answer refused to the clients matched no access list entry or access rule, their queries dropped without answer if disabled;
+# only used if accessdeniedmode left blank
+accessdefaultdeny = false
+
+# answer mode of the clients matched no access list entry or the deny access rules: refused, drop (no answer)
+# or ede (refused with the access denied extended error); the dns-over-https clients refused with 403 and the gRPC
+# clients with PermissionDenied. The configs without the key keep the old drop behaviour, see accessdefaultdeny
+accessdeniedmode = "refused"
+
 # query timeout for dns lookups in duration
 timeout = "5s"
 
 # connect timeout for dns lookups in duration
 connecttimeout = "2s"
 
+# query and connect timeouts of the udp, tcp, tls and https upstreams in duration, the timeout and the
+# connecttimeout above used for the unset ones
+# udptimeout = "2s"
+# tcptimeout = "5s"
+# tlstimeout = "5s"
+# dohtimeout = "5s"
+# udpconnecttimeout = "1s"
+# tcpconnecttimeout = "2s"
+# tlsconnecttimeout = "2s"
+# dohconnecttimeout = "2s"
+
+# servers queried at once at each resolution step, the first valid answer wins and the failed servers
+# replaced by the next ones within the query timeout, 0 or 1 for one server at a time
+parallelqueries = 0
+
+# other servers asked after the SERVFAIL answers of a query within the query timeout, the name errors and
+# the validation failures reported by the upstreams never asked again, negative for disable
+retryonservfail = 2
+
+# how long the active queries waited on shutdown in duration, the remaining connections force closed
+shutdowntimeout = "10s"
+
+# idle tcp and tls connections kept per upstream server for the reuse
+upstreammaxconns = 4
+
+# how long an idle upstream connection reused in duration, lowered by the edns-tcp-keepalive timeout of the server (RFC 7828)
+upstreamidletimeout = "10s"
+
+# udp and tcp client queries in progress at once, the queries above refused, 0 for unlimited
+maxconcurrentqueries = 0
+
+# how long a query above the limit waits for a free slot in duration before refused, 0 for refuse at once
+concurrencywait = "10ms"
+
+# the udp and tcp queries budgeted apart, each protocol limited to maxconcurrentqueries
+concurrencyperproto = false
+
 # default cache TTL in seconds
 expire = 600
 
+# maximum cache TTL in seconds of the negative answers, the TTL taken from the SOA record (RFC 2308)
+negativettl = 3600
+
+# minimum TTL in seconds of the cached records, 0 for disable
+minttl = 0
+
+# maximum TTL in seconds of the cached records, 0 for disable
+maxttl = 0
+
 # cache size (total records in cache)
 cachesize = 256000
 
+# cache shard count (power of two), each shard locked apart for less lock contention at high query rates
+cacheshards = 256
+
+# estimated memory limit of the cache in bytes by the wire size of the records, 0 for only the cachesize
+# the positive and the negative answer caches limited apart like the cachesize, the least recently used entries evicted first
+cachemaxbytes = 0
+
+# storage of the answer cache: memory or redis
+# redis shares the answers between the nodes, the memory of the node answers while the redis server unreachable
+cachebackend = "memory"
+
+# address, password and database of the redis server of the redis cache backend
+redisaddr = "127.0.0.1:6379"
+redispassword = ""
+redisdb = 0
+
+# prefix of the redis keys of the answers
+redisprefix = "sdns:"
+
+# cache dump file, the cache saved on shutdown and loaded on startup, disabled for left blank
+# cachedumppath = "/var/lib/sdns/cache.dump"
+
+# names resolved into the cache in background on startup, a name and an optional type (A if left out) on each line, disabled for left blank
+# prewarmfile = "/etc/sdns/prewarm.txt"
+
+# prewarm queries resolved at once
+prewarmconcurrency = 4
+
+# serve expired cache entries when the upstream servers are unreachable
+servestale = false
+
+# how long the expired cache entries kept for serve-stale in duration
+servestalettl = "1h"
+
+# refresh the popular cache entries in background before they expire
+prefetch = false
+
+# how many times a cache entry must be queried before it is prefetched
+prefetchthreshold = 10
+
+# forward the client subnet to the upstream servers with edns0 client subnet option
+ednsclientsubnet = false
+
+# ipv4 source prefix length of the forwarded client subnet
+ecsprefix = 24
+
+# ipv6 source prefix length of the forwarded client subnet
+ecsprefixv6 = 56
+
+# dnssec mode: off, validate or validate-permissive, the bogus answers fail with servfail on validate and answered without the AD flag on validate-permissive
+dnssec = "validate"
+
+# negative trust anchors, the zones and the names below them answered without the validation and the AD flag (RFC 7646)
+# negativetrustanchors = ["example.com.", "broken.example.org."]
+negativetrustanchors = []
+
+# synthesize the negative answers from the validated NSEC3 records in cache (RFC 8198)
+aggressivensec = false
+
+# answer the names below a cached NXDOMAIN answer with NXDOMAIN without asking the upstream servers (RFC 8020)
+hardenbelownxdomain = false
+
+# send only the minimal labels of the query names to the upstream servers (RFC 9156): strict or relaxed, empty for disable
+# relaxed mode sends the full name if a server answers a minimized query with an error
+qnameminimization = ""
+
+# answer of the ANY queries (RFC 8482): refuse, minimal or normal
+# refuse answers a single synthesized HINFO without recursion, minimal answers only one record type of the name
+anyquerymode = "refuse"
+
+# query types answered to the clients, empty for all; the others refused with the prohibited extended error
+# allowedqtypes = ["A", "AAAA", "CNAME", "MX"]
+allowedqtypes = []
+
+# query types refused to the clients, over the allowedqtypes; the access rules with noqtypeacl bypass both
+# deniedqtypes = ["ANY", "AXFR"]
+deniedqtypes = []
+
+# synthesize the AAAA answers from the A records for the ipv6-only clients behind a NAT64 translator (RFC 6147)
+dns64 = false
+
+# translator prefix of the synthesized AAAA records, the private ipv4 addresses not translated with the well-known prefix
+dns64prefix = "64:ff9b::/96"
+
+# names and their subdomains never synthesized
+# dns64exclude = ["example.com"]
+dns64exclude = []
+
+# health check interval of the root, fallback and upstream group servers in duration, 0s for disable
+# the lowest-latency healthy server preferred
+healthcheckinterval = "30s"
+
+# consecutive health check failures before a server removed from rotation, down servers re-probed with backoff
+healthcheckfailures = 3
+
+# name answered with the "ok" TXT record while any upstream healthy, SERVFAIL otherwise, disabled if empty
+# healthcheckname = "health.sdns.local"
+
+# lower the weights of the weighted servers (1.1.1.1:53|weight=3) by their smoothed rtt, a spiking server sheds its load
+rttweighting = false
+
 # maximum recursion depth for nameservers
 maxdepth = 30
 
+# maximum depth of the delegations and the nested nameserver lookups followed for a query,
+# the deeper and looping delegations answered with SERVFAIL
+maxrecursiondepth = 64
+
+# maximum CNAME chain length followed for an answer, the longer and looping chains answered with SERVFAIL
+maxcnamedepth = 10
+
 # query based ratelimit per second, 0 for disable
 ratelimit = 0
 
+# client ip based ratelimit per second with token bucket, clients over the limit get truncated answers over udp, 0 for disable
+clientratelimit = 0
+
+# token bucket size of the client ip based ratelimit, default is the ratelimit
+clientratelimitburst = 0
+
+# queries per second a client ip dropped above, 0 for never drop
+clientratelimithard = 0
+
+# dns cookies (RFC 7873) for the clients and the upstream servers, clients sent a valid server cookie not rate limited
+cookies = true
+
+# query name case randomization (0x20 encoding) toward the upstream servers, the servers normalize the case queried without
+caserandomization = false
+
+# edns0 padding (RFC 7830) for the responses over the encrypted transports, applied only if the client asked
+padding = true
+
+# padding block size of the responses, default is 468 bytes (RFC 8467)
+paddingblocksize = 468
+
+# udp response size limits, the edns0 buffer size of the clients clamped between them and the larger responses truncated
+# the clients without edns0 get 512 bytes responses, 1232 bytes avoids the ip fragmentation (DNS flag day 2020)
+udpminsize = 512
+udpmaxsize = 1232
+
+# most answer records of the udp responses, the larger answers cut with the TC bit so the clients query again over tcp, 0 for no limit
+maxanswerrecords = 0
+
+# edns0 buffer size advertised to the upstream servers, clamped between 512 and 1452 bytes of the link mtu
+# the truncated upstream answers queried again over tcp
+upstreamudpsize = 1232
+
+# first transport of the upstream queries: auto or udp
+# auto sends the forcetcptypes queries and the questions which answers came truncated recently over tcp, saving the truncated udp roundtrip
+# udp always tries udp first, only the truncated answers queried again over tcp
+upstreamtransport = "auto"
+
+# query types sent over tcp to the upstream servers without trying udp first on the auto transport
+# forcetcptypes = ["TXT", "ANY", "DNSKEY"]
+forcetcptypes = []
+
+# tcp fast open (RFC 7413) of the upstream tcp and tls connections, the first query sent in the syn on linux and freebsd, others connect as usual
+tcpfastopen = false
+
+# answer the CHAOS class version.bind, version.server, hostname.bind and id.server queries, refused if disabled
+chaos = true
+
+# version text of the CHAOS queries instead of the sdns version
+# chaosversion = ""
+
+# server identity of the CHAOS queries instead of the hostname
+# chaosid = ""
+
+# server identifier of the EDNS0 NSID option (RFC 5001) for the queries asked with it, the option omitted if empty
+# nsid = ""
+
+# pass the EDNS0 EXPIRE option (RFC 7314) of the SOA queries to the upstream servers and the expire timer of the answers to the clients, the SOA queries asked with it never cached
+ednsexpire = false
+
+# extended DNS error options (RFC 8914) of the failed, stale, blocked and filtered answers to the EDNS clients
+# some middleboxes drop the responses with the unknown options
+extendederrors = false
+
+# omit the authority and additional records of the responses not needed by the clients, the authority of the
+# negative answers and the referrals, the glue of the referrals and the OPT record kept
+minimalresponses = false
+
+# rotate the address records of the answers on every response, the cached answers kept in order
+roundrobin = false
+
+# the address records of the answers ordered by the networks, the addresses of the first network first and the others last
+# only the order inside the record sets changed on the way out, the cached answers and the signatures not affected
+# sortlist = ["192.0.2.0/24", "2001:db8::/32"]
+sortlist = []
+
+# order the addresses of the same network by the tcp connect rtt from the server, probed in the background
+# the addresses not probed yet after the measured ones and the unreachable ones last
+sortlistprobe = false
+
+# tcp port of the address probes
+sortlistprobeport = 443
+
+# how long a probe result used before probed again
+sortlistprobettl = "1m"
+
+# query processing middlewares in order, the cache and the recursion answer the queries passed through all of them
+# blocklist: the blocked names answered, rpz: the qname and client-ip rules of the response policy zones
+middleware = ["blocklist", "rpz"]
+
 # manual blocklist entries
 blocklist = []
 
 # manual whitelist entries
 whitelist = []
+
+# manual allowlist entries, also allows the subdomains
+allowlist = []
+
+# networks the answers blocked with, an answer address in the networks replaced by the block response
+# the allowed and the whitelisted names not blocked
+# blockipranges = ["192.0.2.0/24", "2001:db8::/32"]
+
+# hosts file for the local name overrides, wildcards like *.internal supported
+# hostsfile = "/etc/sdns/hosts"
+
+# answer the reverse queries of the private networks locally (RFC 6303), the RFC 1918 networks and the unique local
+# and link local ipv6 networks; a name error for the addresses unknown, never sent to the upstreams
+blockprivatereverse = true
+
+# answer the private reverse queries with the PTR records of the hosts file addresses
+privatereversehosts = false
+
+# the delegated private networks resolved as usual, the forward zones of the private reverse zones also resolved
+# privatereverseexclude = ["10.20.0.0/16", "fd12:3456::/32"]
+privatereverseexclude = []
+
+# response policy zone files in the BIND RPZ format, the first zone has the highest precedence
+# rpzfiles = ["/etc/sdns/rpz.zone"]
+
+# dnstap collector socket for the query logs, unix socket path or tcp://host:port
+# dnstapsocket = "/tmp/dnstap.sock"
+
+# query log file, one line per client query, disabled for left blank
+# querylogfile = "/var/log/sdns/query.log"
+
+# query log file format, text or json
+querylogformat = "text"
+
+# query log file rotated over this size in megabytes, 0 for disable
+querylogmaxsizemb = 100
+
+# rotated query log files kept as querylogfile.1, querylogfile.2 and so on
+querylogbackups = 5
+
+# write only the blocked queries into the query log file with the matched list, the block lines end with the list column
+logblockedonly = false
+
+# access rules for the client networks, the most specific network wins
+# actions: allow, deny, nodnssec (disable dnssec validation), upstream (forward to an upstream group)
+# [[accessrules]]
+# cidr = "10.0.0.0/8"
+# action = "upstream"
+# upstream = "internal"
+# noratelimit = true (bypass the client ip based ratelimit)
+# noqtypeacl = true (bypass the allowedqtypes and the deniedqtypes)
+
+# access lists and client rate limits of the listeners overriding the global ones;
+# dns (bind), tls (bindtls), doh (binddoh), doq (binddoq) and grpc (bindgrpc)
+# the listeners without an accesslist or accessrules use the global access list,
+# the ones without a clientratelimit the global rate limit, -1 disables the rate limit of the listener
+# [listeners.doh]
+# accesslist = ["0.0.0.0/0", "::0/0"]
+# clientratelimit = 10
+# clientratelimitburst = 20
+#
+# [[listeners.dns.accessrules]]
+# cidr = "10.0.0.0/8"
+# action = "allow"
+
+# upstream server groups for the access rules, cached apart per group
+# the queries resolved from the root servers while all servers of the group down or unreachable
+# [upstreamgroups]
+# internal = ["10.0.0.1:53", "10.0.0.2:53"]
+
+# forward the queries of a zone and its subdomains to the servers instead of recursion, the longest zone matches
+# protocol is plain or tls, tlsservername defaults to the host of the first server
+# [[forwardzones]]
+# zone = "corp.internal"
+# servers = ["10.0.0.53:53"]
+# protocol = "plain"
+#
+# [[forwardzones]]
+# zone = "example.org"
+# servers = ["192.0.2.53:853"]
+# protocol = "tls"
+# tlsservername = "dns.example.org"
+
+# rewrite rules of the query names by the exact name or the suffix, the first rule of each action applies
+# actions: name (resolve the target name instead), flatten (the cname chain replaced with its final records),
+# ip (the answer addresses in the cidr replaced with the ip)
+# [[rewriterules]]
+# name = "www.example.com"
+# match = "exact"
+# action = "flatten"
+#
+# [[rewriterules]]
+# name = "corp.example.com"
+# match = "suffix"
+# action = "name"
+# target = "corp.internal"
+#
+# [[rewriterules]]
+# name = "example.net"
+# match = "suffix"
+# action = "ip"
+# cidr = "192.0.2.0/24"
+# ip = "10.0.0.1"
+
+# cache policy of a zone and its subdomains for the positive and negative answers, the longest zone matches
+# ttl overrides the cache TTL in seconds, the answers of the nocache zones never cached and always resolved
+# [[zonecachepolicy]]
+# zone = "dyn.example.com"
+# ttl = 30
+#
+# [[zonecachepolicy]]
+# zone = "ddns.example.net"
+# nocache = true
+
+# authoritative local zones by the zone origin, answered from the zone files without the recursion,
+# the cache and the blocklists, the longest origin matches and the files reloaded with SIGHUP
+# [localzones]
+# "home.arpa" = "/etc/sdns/home.arpa.zone"
+# "lab.home.arpa" = "/etc/sdns/lab.home.arpa.zone"
 `
 
 // LoadConfig loads the given config file
-func LoadConfig(path string) error {
+func LoadConfig(path string) (*config, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		if err := generateConfig(path); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if _, err := toml.DecodeFile(path, &Config); err != nil {
-		return fmt.Errorf("could not load config: %s", err)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load config: %s", err)
 	}
 
-	if Config.Version != ConfigVersion {
-		log.Warn("Config file sdns.toml is out of date!")
+	cfg := new(config)
+
+	if _, err := toml.Decode(string(data), cfg); err != nil {
+		return nil, fmt.Errorf("could not load config: %s", err)
 	}
 
-	return nil
+	checkConfigVersion(path, data, cfg.Version)
+
+	return cfg, nil
 }
 
 func generateConfig(path string) error {
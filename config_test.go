@@ -15,7 +15,7 @@ func Test_config(t *testing.T) {
 
 	ConfigVersion = "0.0.0"
 
-	err = LoadConfig(configFile)
+	_, err = LoadConfig(configFile)
 	assert.NoError(t, err)
 
 	os.Remove(configFile)
@@ -24,6 +24,6 @@ func Test_config(t *testing.T) {
 func Test_configError(t *testing.T) {
 	const configFile = ""
 
-	err := LoadConfig(configFile)
+	_, err := LoadConfig(configFile)
 	assert.Error(t, err)
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/semihalev/log"
+)
+
+// MigrateConfig writes the migrated copy of the config file and exits
+var MigrateConfig = flag.Bool("migrate-config", false, "write the migrated copy of an out of date config file next to it and exit")
+
+var (
+	versionLine = regexp.MustCompile(`(?m)^version\s*=.*$`)
+	tableLine   = regexp.MustCompile(`(?m)^\s*\[`)
+)
+
+// compareVersions compares the dotted versions by the numbers, the missing
+// version is the oldest
+func compareVersions(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	}
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// configChanges returns the keys of the defaults missing in the config file
+// and the keys of the file unknown to this version
+func configChanges(data []byte, defaults string) (added, unknown []string, err error) {
+	var def map[string]interface{}
+	dmd, err := toml.Decode(defaults, &def)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := new(config)
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, key := range dmd.Keys() {
+		if len(key) == 1 && !md.IsDefined(key[0]) {
+			added = append(added, key[0])
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range md.Undecoded() {
+		if !seen[key[0]] {
+			seen[key[0]] = true
+			unknown = append(unknown, key[0])
+		}
+	}
+
+	return added, unknown, nil
+}
+
+// defaultBlock returns the lines of the key in the defaults with the comments
+// above it
+func defaultBlock(lines []string, key string) []string {
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, key+" =") || strings.HasPrefix(line, key+"=") {
+			start = i
+			break
+		}
+	}
+
+	if start < 0 {
+		return nil
+	}
+
+	end := start + 1
+	if strings.HasSuffix(strings.TrimSpace(lines[start]), "[") {
+		for end < len(lines) && strings.TrimSpace(lines[end-1]) != "]" {
+			end++
+		}
+	}
+
+	first := start
+	for first > 0 && strings.HasPrefix(lines[first-1], "#") {
+		first--
+	}
+
+	return lines[first:end]
+}
+
+// migrateConfig returns the config file with the missing keys filled by the
+// defaults of the version, the values and the comments of the file kept.
+// The added keys placed before the first table of the file.
+func migrateConfig(data []byte, defaults, version string) ([]byte, []string, error) {
+	added, _, err := configChanges(data, defaults)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := strings.Split(defaults, "\n")
+
+	var blocks []string
+	for _, key := range added {
+		if key == "version" {
+			continue
+		}
+
+		if block := defaultBlock(lines, key); block != nil {
+			blocks = append(blocks, strings.Join(block, "\n"))
+		}
+	}
+
+	out := string(data)
+
+	if len(blocks) > 0 {
+		insert := fmt.Sprintf("# added by the migration to version %s\n%s\n\n", version, strings.Join(blocks, "\n\n"))
+
+		table := tableLine.FindStringIndex(out)
+		if table == nil {
+			if !strings.HasSuffix(out, "\n") {
+				out += "\n"
+			}
+			out += "\n" + strings.TrimSuffix(insert, "\n")
+		} else {
+			out = out[:table[0]] + insert + out[table[0]:]
+		}
+	}
+
+	v := fmt.Sprintf("version = %q", version)
+	if versionLine.MatchString(out) {
+		out = versionLine.ReplaceAllLiteralString(out, v)
+	} else {
+		out = v + "\n" + out
+	}
+
+	return []byte(out), added, nil
+}
+
+// checkConfigVersion warns about the config file older or newer than this
+// version with the changed keys
+func checkConfigVersion(path string, data []byte, version string) {
+	switch compareVersions(version, ConfigVersion) {
+	case 0:
+		return
+	case 1:
+		log.Warn("Config file newer than this version", "config", path, "version", version, "current", ConfigVersion)
+		return
+	}
+
+	added, unknown, err := configChanges(data, fmt.Sprintf(defaultConfig, ConfigVersion))
+	if err != nil {
+		return
+	}
+
+	log.Warn("Config file out of date, migrate with -migrate-config", "config", path, "version", version, "current", ConfigVersion,
+		"added", strings.Join(added, ","), "unknown", strings.Join(unknown, ","))
+}
+
+// writeMigratedConfig writes the migrated copy of the config file to the
+// path with the .migrated suffix, returns the path written
+func writeMigratedConfig(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read config: %s", err)
+	}
+
+	out, _, err := migrateConfig(data, fmt.Sprintf(defaultConfig, ConfigVersion), ConfigVersion)
+	if err != nil {
+		return "", fmt.Errorf("could not migrate config: %s", err)
+	}
+
+	target := path + ".migrated"
+	if err := ioutil.WriteFile(target, out, 0644); err != nil {
+		return "", fmt.Errorf("could not write config: %s", err)
+	}
+
+	return target, nil
+}
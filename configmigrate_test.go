@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("0.2.2", "0.2.2"))
+	assert.Equal(t, -1, compareVersions("0.2.1", "0.2.2"))
+	assert.Equal(t, -1, compareVersions("0.2.9", "0.10.0"))
+	assert.Equal(t, 1, compareVersions("1.0", "0.9.9"))
+	assert.Equal(t, 0, compareVersions("0.2", "0.2.0"))
+	assert.Equal(t, -1, compareVersions("", "0.0.0"))
+	assert.Equal(t, 1, compareVersions("0.0.1", ""))
+}
+
+const (
+	migrateDefaultsV1 = `
+version = "%s"
+
+# address to bind to for the DNS server
+bind = ":53"
+
+# cache size (total records in cache)
+cachesize = 256000
+`
+
+	migrateDefaultsV2 = migrateDefaultsV1 + `
+# maximum cache TTL in seconds of the negative answers
+negativettl = 3600
+
+# list of the fallback servers
+fallbackservers = [
+"8.8.8.8:53",
+"8.8.4.4:53"
+]
+`
+
+	migrateDefaultsV3 = migrateDefaultsV2 + `
+# serve expired cache entries when the upstreams failed
+servestale = false
+`
+)
+
+func Test_migrateConfigSteps(t *testing.T) {
+	// the file of the first version without the version field
+	data := []byte(`# my resolver
+bind = ":5300" # local port
+cachesize = 1024
+
+[[accessrules]]
+cidr = "10.0.0.0/8"
+action = "allow"
+`)
+
+	added, unknown, err := configChanges(data, fmt.Sprintf(migrateDefaultsV2, "0.1.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"version", "negativettl", "fallbackservers"}, added)
+	assert.Empty(t, unknown)
+
+	out, added, err := migrateConfig(data, fmt.Sprintf(migrateDefaultsV2, "0.1.1"), "0.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"version", "negativettl", "fallbackservers"}, added)
+
+	out, added, err = migrateConfig(out, fmt.Sprintf(migrateDefaultsV3, "0.1.2"), "0.1.2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"servestale"}, added)
+
+	text := string(out)
+	assert.True(t, strings.HasPrefix(text, "version = \"0.1.2\"\n# my resolver\n"))
+	assert.Contains(t, text, `bind = ":5300" # local port`)
+	assert.Contains(t, text, "# added by the migration to version 0.1.1\n# maximum cache TTL")
+	assert.Contains(t, text, "# added by the migration to version 0.1.2\n# serve expired")
+	assert.Equal(t, 1, strings.Count(text, "version ="))
+
+	// the added keys stay out of the tables
+	assert.True(t, strings.Index(text, "servestale") < strings.Index(text, "[[accessrules]]"))
+
+	cfg := new(config)
+	_, err = toml.Decode(text, cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "0.1.2", cfg.Version)
+	assert.Equal(t, ":5300", cfg.Bind)
+	assert.Equal(t, 1024, cfg.CacheSize)
+	assert.Equal(t, uint32(3600), cfg.NegativeTTL)
+	assert.Equal(t, []string{"8.8.8.8:53", "8.8.4.4:53"}, cfg.FallbackServers)
+	assert.Len(t, cfg.AccessRules, 1)
+
+	// the migrated file up to date
+	added, _, err = configChanges(out, fmt.Sprintf(migrateDefaultsV3, "0.1.2"))
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+}
+
+func Test_writeMigratedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sdns.toml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("version = \"0.0.1\"\nbind = \":5300\"\noldkey = true\n"), 0644))
+
+	_, unknown, err := configChanges([]byte("oldkey = true\n"), fmt.Sprintf(defaultConfig, ConfigVersion))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"oldkey"}, unknown)
+
+	target, err := writeMigratedConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, path+".migrated", target)
+
+	cfg, err := LoadConfig(target)
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigVersion, cfg.Version)
+	assert.Equal(t, ":5300", cfg.Bind)
+	assert.Equal(t, 256000, cfg.CacheSize)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 8
+
+	// maxCookieServers limits the learned server cookies of the upstream servers
+	maxCookieServers = 10000
+)
+
+var (
+	// CookieRotation is the lifetime of a server cookie secret, the previous
+	// secret still accepted for a rotation period
+	CookieRotation = time.Hour
+
+	errCookieMalformed = errors.New("malformed cookie")
+	errCookieMismatch  = errors.New("client cookie mismatch")
+	errCookieMissing   = errors.New("server cookie missing")
+
+	serverSecrets = &cookieSecrets{}
+	clientCookies = newCookieJar()
+)
+
+// cookieSecrets keeps the rotating secrets of the server cookies
+type cookieSecrets struct {
+	mu sync.Mutex
+
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+func (s *cookieSecrets) get() (current, previous []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil || time.Since(s.rotated) >= CookieRotation {
+		s.previous = s.current
+		s.current = newCookieSecret()
+		s.rotated = time.Now()
+	}
+
+	return s.current, s.previous
+}
+
+func newCookieSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("cookie secret: " + err.Error())
+	}
+
+	return secret
+}
+
+func cookieHash(secret []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+func serverCookie(secret, client []byte, ip net.IP) []byte {
+	return cookieHash(secret, client, ip.To16())[:serverCookieLen]
+}
+
+// cookieState is the client cookie of a request
+type cookieState struct {
+	client []byte
+	ip     net.IP
+
+	// valid reports whether the request has a valid server cookie
+	valid bool
+}
+
+// parseCookie returns the cookie of the request, nil if the request has no cookie
+func parseCookie(req *dns.Msg, ip net.IP) (*cookieState, error) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil, nil
+	}
+
+	for _, option := range opt.Option {
+		c, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		b, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(b) < clientCookieLen ||
+			(len(b) > clientCookieLen && len(b) < 16) || len(b) > 40 {
+			return nil, errCookieMalformed
+		}
+
+		state := &cookieState{client: b[:clientCookieLen], ip: ip}
+
+		if len(b) == clientCookieLen+serverCookieLen {
+			current, previous := serverSecrets.get()
+			for _, secret := range [][]byte{current, previous} {
+				if secret != nil && hmac.Equal(serverCookie(secret, state.client, ip), b[clientCookieLen:]) {
+					state.valid = true
+					break
+				}
+			}
+		}
+
+		return state, nil
+	}
+
+	return nil, nil
+}
+
+// set adds the client cookie with a fresh server cookie to the response
+func (c *cookieState) set(msg *dns.Msg) {
+	if c == nil || msg == nil {
+		return
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	removeCookie(opt)
+
+	current, _ := serverSecrets.get()
+	cookie := append(append([]byte{}, c.client...), serverCookie(current, c.client, c.ip)...)
+
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+}
+
+func removeCookie(opt *dns.OPT) {
+	options := opt.Option[:0:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0COOKIE {
+			options = append(options, option)
+		}
+	}
+
+	opt.Option = options
+}
+
+// cookieJar keeps the client cookie secret and the learned server cookies of the upstream servers
+type cookieJar struct {
+	mu sync.RWMutex
+
+	secret  []byte
+	servers map[string][]byte
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{
+		secret:  newCookieSecret(),
+		servers: make(map[string][]byte),
+	}
+}
+
+func (j *cookieJar) client(host string) []byte {
+	return cookieHash(j.secret, []byte(host))[:clientCookieLen]
+}
+
+func (j *cookieJar) server(host string) []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.servers[host]
+}
+
+func (j *cookieJar) learn(host string, cookie []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.servers[host]; !ok && len(j.servers) >= maxCookieServers {
+		j.servers = make(map[string][]byte)
+	}
+
+	j.servers[host] = cookie
+}
+
+// prepare returns a copy of the request with the cookie of the server
+func (j *cookieJar) prepare(req *dns.Msg, host string) *dns.Msg {
+	req = req.Copy()
+
+	opt := req.IsEdns0()
+	removeCookie(opt)
+
+	cookie := append(j.client(host), j.server(host)...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+
+	return req
+}
+
+// check verifies the cookie of the response and learns the server cookie. Over
+// udp, responses without cookie rejected from the servers which had sent a cookie.
+func (j *cookieJar) check(resp *dns.Msg, host, network string) error {
+	var cookie *dns.EDNS0_COOKIE
+
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if c, ok := option.(*dns.EDNS0_COOKIE); ok {
+				cookie = c
+				break
+			}
+		}
+	}
+
+	if cookie == nil {
+		if network == "udp" && j.server(host) != nil {
+			return errCookieMissing
+		}
+
+		return nil
+	}
+
+	b, err := hex.DecodeString(cookie.Cookie)
+	if err != nil || len(b) < 16 || len(b) > 40 {
+		return errCookieMalformed
+	}
+
+	if !hmac.Equal(b[:clientCookieLen], j.client(host)) {
+		return errCookieMismatch
+	}
+
+	j.learn(host, b[clientCookieLen:])
+
+	return nil
+}
+
+// isBadCookie returns whether or not the response rcode is BADCOOKIE
+func isBadCookie(resp *dns.Msg) bool {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	return int(opt.Hdr.Ttl>>24)<<4|resp.Rcode == dns.RcodeBadCookie
+}
+
+// exchangeCookie exchanges the request with the cookie of the server, a
+// BADCOOKIE answer retried once with the learned server cookie, then over tcp
+func exchangeCookie(c *dns.Client, req *dns.Msg, host string) (resp *dns.Msg, rtt time.Duration, err error) {
+	for i := 0; i < 2; i++ {
+		resp, rtt, err = c.Exchange(clientCookies.prepare(req, host), host)
+		if err != nil && err != dns.ErrTruncated {
+			return
+		}
+
+		if cerr := clientCookies.check(resp, host, c.Net); cerr != nil {
+			return nil, rtt, cerr
+		}
+
+		if !isBadCookie(resp) {
+			return
+		}
+	}
+
+	if c.Net == "udp" {
+		dialer := &net.Dialer{}
+		if c.Dialer != nil {
+			dialer.Timeout = c.Dialer.Timeout
+			if addr, ok := c.Dialer.LocalAddr.(*net.UDPAddr); ok {
+				dialer.LocalAddr = &net.TCPAddr{IP: addr.IP}
+			}
+		}
+
+		tc := &dns.Client{
+			Net:          "tcp",
+			Dialer:       dialer,
+			ReadTimeout:  c.ReadTimeout,
+			WriteTimeout: c.WriteTimeout,
+		}
+
+		return tc.Exchange(clientCookies.prepare(req, host), host)
+	}
+
+	return
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func cookieMsg(cookie string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, false)
+
+	if cookie != "" {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+
+	return req
+}
+
+func responseCookie(msg *dns.Msg) string {
+	for _, option := range msg.IsEdns0().Option {
+		if c, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+
+	return ""
+}
+
+func Test_serverCookie(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+
+	state, err := parseCookie(cookieMsg(""), ip)
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	_, err = parseCookie(cookieMsg("0102030405"), ip)
+	assert.Equal(t, errCookieMalformed, err)
+
+	_, err = parseCookie(cookieMsg("0102030405060708090a"), ip)
+	assert.Equal(t, errCookieMalformed, err)
+
+	state, err = parseCookie(cookieMsg("0102030405060708"), ip)
+	assert.NoError(t, err)
+	assert.False(t, state.valid)
+
+	resp := cookieMsg("")
+	state.set(resp)
+
+	cookie := responseCookie(resp)
+	assert.Len(t, cookie, 32)
+	assert.Equal(t, "0102030405060708", cookie[:16])
+
+	state, err = parseCookie(cookieMsg(cookie), ip)
+	assert.NoError(t, err)
+	assert.True(t, state.valid)
+
+	state, err = parseCookie(cookieMsg(cookie), net.ParseIP("192.0.2.2"))
+	assert.NoError(t, err)
+	assert.False(t, state.valid)
+
+	// previous secret still accepted after a rotation
+	serverSecrets.mu.Lock()
+	serverSecrets.rotated = time.Now().Add(-CookieRotation)
+	serverSecrets.mu.Unlock()
+
+	state, err = parseCookie(cookieMsg(cookie), ip)
+	assert.NoError(t, err)
+	assert.True(t, state.valid)
+
+	var nilState *cookieState
+	nilState.set(resp)
+}
+
+func Test_cookieJar(t *testing.T) {
+	j := newCookieJar()
+	host := "192.0.2.53:53"
+
+	req := j.prepare(cookieMsg(""), host)
+	cookie := responseCookie(req)
+	assert.Equal(t, hex.EncodeToString(j.client(host)), cookie)
+
+	resp := cookieMsg("")
+	assert.NoError(t, j.check(resp, host, "udp"))
+
+	resp = cookieMsg("0102030405060708a1a2a3a4a5a6a7a8")
+	assert.Equal(t, errCookieMismatch, j.check(resp, host, "udp"))
+
+	resp = cookieMsg(cookie + "a1a2a3a4a5a6a7a8")
+	assert.NoError(t, j.check(resp, host, "udp"))
+	assert.Equal(t, cookie+"a1a2a3a4a5a6a7a8", responseCookie(j.prepare(cookieMsg(""), host)))
+
+	assert.Equal(t, errCookieMissing, j.check(cookieMsg(""), host, "udp"))
+	assert.NoError(t, j.check(cookieMsg(""), host, "tcp"))
+}
+
+func Test_exchangeCookie(t *testing.T) {
+	const server = "b1b2b3b4b5b6b7b8"
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.SetEdns0(DefaultMsgSize, false)
+
+		cookie := responseCookie(req)
+
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie[:16] + server})
+
+		if cookie[16:] != server {
+			// BADCOOKIE, upper bits in the OPT ttl
+			m.Rcode = dns.RcodeBadCookie & 0xF
+			opt.Hdr.Ttl |= uint32(dns.RcodeBadCookie>>4) << 24
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	c := &dns.Client{Net: "udp"}
+
+	resp, _, err := exchangeCookie(c, cookieMsg(""), addrstr)
+	assert.NoError(t, err)
+	assert.False(t, isBadCookie(resp))
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, server, hex.EncodeToString(clientCookies.server(addrstr)))
+}
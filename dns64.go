@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// DefaultDNS64Prefix is the well-known prefix of the IPv4/IPv6 translators (RFC 6052)
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// dns64State is the prefix and the excluded names of the synthesis
+type dns64State struct {
+	prefix  *net.IPNet
+	wkp     bool
+	exclude []string
+}
+
+var (
+	dns64   *dns64State
+	dns64Mu sync.RWMutex
+)
+
+// dns64Prefixes are the valid prefix lengths (RFC 6052 section 2.2)
+var dns64Prefixes = map[int]bool{32: true, 40: true, 48: true, 56: true, 64: true, 96: true}
+
+// dns64GlobalNets are the IPv4 networks never translated with the well-known
+// prefix (RFC 6052 section 3.1), the networks in the dns64LocalNets never
+// translated with any prefix
+var (
+	dns64GlobalNets = parseNets("10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24",
+		"192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24")
+	dns64LocalNets = parseNets("0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4", "240.0.0.0/4")
+)
+
+// the ipv4-mapped AAAA records not counted as the real AAAA records (RFC 6147 section 5.1.4)
+var ipv4Mapped = parseNets("::ffff:0:0/96")[0]
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// setupDNS64 parses the dns64 settings of the config, nil state disables the synthesis
+func setupDNS64(cfg *config) error {
+	state, err := newDNS64State(cfg)
+	if err != nil {
+		return err
+	}
+
+	dns64Mu.Lock()
+	dns64 = state
+	dns64Mu.Unlock()
+
+	return nil
+}
+
+// newDNS64State returns the synthesis state of the config, nil if disabled
+func newDNS64State(cfg *config) (*dns64State, error) {
+	if !cfg.DNS64 {
+		return nil, nil
+	}
+
+	ip, prefix, err := net.ParseCIDR(cfg.DNS64Prefix)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("dns64 prefix invalid: %s", cfg.DNS64Prefix)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	if !dns64Prefixes[ones] || (ones > 64 && prefix.IP[8] != 0) {
+		return nil, fmt.Errorf("dns64 prefix invalid: %s", cfg.DNS64Prefix)
+	}
+
+	_, wkp, _ := net.ParseCIDR(DefaultDNS64Prefix)
+
+	state := &dns64State{prefix: prefix, wkp: prefix.String() == wkp.String()}
+
+	for _, name := range cfg.DNS64Exclude {
+		state.exclude = append(state.exclude, strings.ToLower(dns.Fqdn(name)))
+	}
+
+	return state, nil
+}
+
+// synthesize embeds the ipv4 address into the prefix (RFC 6052 section 2.2),
+// the u octet skipped
+func (s *dns64State) synthesize(ip net.IP) net.IP {
+	ones, _ := s.prefix.Mask.Size()
+
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, s.prefix.IP.To16()[:ones/8])
+
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+
+		addr[pos] = b
+		pos++
+	}
+
+	return addr
+}
+
+// translatable reports the ipv4 address can be reached over the translator
+func (s *dns64State) translatable(ip net.IP) bool {
+	for _, n := range dns64LocalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if s.wkp {
+		for _, n := range dns64GlobalNets {
+			if n.Contains(ip) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (s *dns64State) excluded(name string) bool {
+	for _, zone := range s.exclude {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dns64Answer synthesizes the AAAA records from the A records of the name when
+// the AAAA query answered without an AAAA record (RFC 6147). The synthesized
+// answer is not validated, the TTL is the lower of the A records and the
+// negative answer.
+func (h *DNSHandler) dns64Answer(proto string, req, msg *dns.Msg, dsReq bool, upstream string) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || msg.Rcode != dns.RcodeSuccess {
+		return msg
+	}
+
+	dns64Mu.RLock()
+	state := dns64
+	dns64Mu.RUnlock()
+
+	name := strings.ToLower(q.Name)
+	if state == nil || state.excluded(name) {
+		return msg
+	}
+
+	// the validating clients synthesize themselves (RFC 6147 section 5.5)
+	if req.CheckingDisabled && dsReq {
+		return msg
+	}
+
+	// the end of the cname chain
+	for range msg.Answer {
+		next := ""
+		for _, rr := range msg.Answer {
+			if strings.ToLower(rr.Header().Name) != name {
+				continue
+			}
+
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				if !ipv4Mapped.Contains(rr.AAAA) {
+					return msg
+				}
+			case *dns.CNAME:
+				next = strings.ToLower(rr.Target)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		name = next
+	}
+
+	aReq := new(dns.Msg)
+	aReq.SetQuestion(name, dns.TypeA)
+	aReq.SetEdns0(DefaultMsgSize, true)
+	aReq.RecursionDesired = true
+	aReq.CheckingDisabled = req.CheckingDisabled
+
+	key := ntaKey(cache.Hash(aReq.Question[0], aReq.CheckingDisabled), name, aReq.CheckingDisabled)
+	if upstream != "" {
+		key = cache.HashScope(key, "upstream:"+upstream)
+	}
+
+	resp, _, err := h.r.Qcache.Get(key, aReq)
+	if err != nil {
+		if _, err := h.r.Negcache.Get(key, aReq); err == nil {
+			return msg
+		}
+
+		resp, err = h.resolve(proto, aReq, upstream)
+		if err != nil {
+			log.Debug("DNS64 A query failed", "query", formatQuestion(aReq.Question[0]), "error", err.Error())
+			return msg
+		}
+
+		h.setCache(key, resp, upstream)
+	}
+
+	ttl, negative := cache.NegativeTTL(msg)
+
+	// the ipv4-mapped records left out of the answer
+	answer := make([]dns.RR, 0, len(msg.Answer)+len(resp.Answer))
+	for _, rr := range msg.Answer {
+		if _, ok := rr.(*dns.AAAA); !ok {
+			answer = append(answer, rr)
+		}
+	}
+
+	synthesized := 0
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, dns.Copy(rr))
+		case *dns.A:
+			if !state.translatable(rr.A) {
+				continue
+			}
+
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if negative && ttl < hdr.Ttl {
+				hdr.Ttl = ttl
+			}
+
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: state.synthesize(rr.A)})
+			synthesized++
+		}
+	}
+
+	if synthesized == 0 {
+		return msg
+	}
+
+	log.Debug("DNS64 answer synthesized", "query", formatQuestion(q))
+
+	synth := new(dns.Msg)
+	*synth = *msg
+
+	synth.AuthenticatedData = false
+	synth.Answer = answer
+	synth.Ns = nil
+
+	return synth
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dns64Synthesize(t *testing.T) {
+	// RFC 6052 section 2.4
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+
+	for _, tt := range tests {
+		_, prefix, err := net.ParseCIDR(tt.prefix)
+		assert.NoError(t, err)
+
+		s := &dns64State{prefix: prefix}
+		assert.Equal(t, tt.want, s.synthesize(net.ParseIP("192.0.2.33")).String(), tt.prefix)
+	}
+}
+
+func Test_setupDNS64(t *testing.T) {
+	defer setupDNS64(&config{})
+
+	cfg := &config{DNS64: true, DNS64Prefix: DefaultDNS64Prefix, DNS64Exclude: []string{"Example.com"}}
+	assert.NoError(t, setupDNS64(cfg))
+	if assert.NotNil(t, dns64) {
+		assert.True(t, dns64.wkp)
+		assert.True(t, dns64.excluded("www.example.com."))
+		assert.False(t, dns64.excluded("example.org."))
+
+		assert.False(t, dns64.translatable(net.ParseIP("10.0.0.1")))
+		assert.False(t, dns64.translatable(net.ParseIP("127.0.0.1")))
+		assert.True(t, dns64.translatable(net.ParseIP("93.184.216.34")))
+	}
+
+	cfg.DNS64Prefix = "2001:db8:64::/96"
+	assert.NoError(t, setupDNS64(cfg))
+	if assert.NotNil(t, dns64) {
+		assert.False(t, dns64.wkp)
+
+		// the private networks translated with the network-specific prefix
+		assert.True(t, dns64.translatable(net.ParseIP("10.0.0.1")))
+		assert.False(t, dns64.translatable(net.ParseIP("127.0.0.1")))
+	}
+
+	for _, prefix := range []string{"", "64:ff9b::/80", "10.0.0.0/8", "2001:db8:0:0:ff00::/96"} {
+		cfg.DNS64Prefix = prefix
+		assert.Error(t, setupDNS64(cfg), prefix)
+	}
+
+	assert.NoError(t, setupDNS64(&config{}))
+	assert.Nil(t, dns64)
+}
+
+func Test_HandlerDNS64(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		var records []string
+		switch {
+		case q.Name == "dual.corp.internal." && q.Qtype == dns.TypeAAAA:
+			records = []string{"dual.corp.internal. 300 IN AAAA 2001:db8::1"}
+		case q.Name == "alias.corp.internal.":
+			records = []string{"alias.corp.internal. 300 IN CNAME v4only.corp.internal."}
+			if q.Qtype == dns.TypeA {
+				records = append(records, "v4only.corp.internal. 300 IN A 93.184.216.34")
+			}
+		case q.Qtype == dns.TypeA && q.Name != "nothing.corp.internal.":
+			records = []string{q.Name + " 300 IN A 93.184.216.34", q.Name + " 300 IN A 10.0.0.1"}
+		}
+
+		for _, s := range records {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+
+		if len(m.Answer) == 0 || m.Answer[len(m.Answer)-1].Header().Rrtype == dns.TypeCNAME {
+			soa, _ := dns.NewRR("corp.internal. 3600 IN SOA ns.corp.internal. hostmaster.corp.internal. 1 3600 600 86400 60")
+			m.Ns = append(m.Ns, soa)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+
+		setupDNS64(&config{})
+	}()
+
+	assert.NoError(t, setupDNS64(&config{DNS64: true, DNS64Prefix: DefaultDNS64Prefix, DNS64Exclude: []string{"excluded.corp.internal"}}))
+
+	handler := NewHandler()
+
+	query := func(name string) (*dns.Msg, string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeAAAA)
+		req.SetEdns0(DefaultMsgSize, true)
+
+		return handler.queryStatus("udp", req)
+	}
+
+	// the miss and the negative cache hit
+	for _, want := range []string{statusMiss, statusHit} {
+		resp, status := query("v4only.corp.internal.")
+		assert.Equal(t, want, status)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.False(t, resp.AuthenticatedData)
+		assert.Empty(t, resp.Ns)
+
+		// the private address not translated with the well-known prefix
+		if assert.Len(t, resp.Answer, 1) {
+			aaaa := resp.Answer[0].(*dns.AAAA)
+			assert.Equal(t, "64:ff9b::5db8:d822", aaaa.AAAA.String())
+			assert.True(t, aaaa.Hdr.Ttl <= 60)
+		}
+	}
+
+	resp, _ := query("dual.corp.internal.")
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "2001:db8::1", resp.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	resp, _ = query("alias.corp.internal.")
+	if assert.Len(t, resp.Answer, 2) {
+		assert.Equal(t, dns.TypeCNAME, resp.Answer[0].Header().Rrtype)
+		assert.Equal(t, "v4only.corp.internal.", resp.Answer[1].Header().Name)
+		assert.Equal(t, dns.TypeAAAA, resp.Answer[1].Header().Rrtype)
+	}
+
+	resp, _ = query("excluded.corp.internal.")
+	assert.Empty(t, resp.Answer)
+
+	resp, _ = query("nothing.corp.internal.")
+	assert.Empty(t, resp.Answer)
+	assert.NotEmpty(t, resp.Ns)
+
+	// the validating clients get the real answer
+	req := new(dns.Msg)
+	req.SetQuestion("v4only.corp.internal.", dns.TypeAAAA)
+	req.SetEdns0(DefaultMsgSize, true)
+	req.CheckingDisabled = true
+
+	resp, _ = handler.queryStatus("udp", req)
+	assert.Empty(t, resp.Answer)
+}
@@ -0,0 +1,187 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: dns.proto
+
+package dnspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	DnsService_Resolve_FullMethodName = "/sdns.DnsService/Resolve"
+	DnsService_Stream_FullMethodName  = "/sdns.DnsService/Stream"
+)
+
+// DnsServiceClient is the client API for DnsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DnsServiceClient interface {
+	// Resolve answers a single query
+	Resolve(ctx context.Context, in *DnsRequest, opts ...grpc.CallOption) (*DnsResponse, error)
+	// Stream answers the queries of the stream, the responses sent in the
+	// order they resolved and matched to the queries by the message id. The
+	// malformed queries and the dropped ones not answered.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (DnsService_StreamClient, error)
+}
+
+type dnsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDnsServiceClient(cc grpc.ClientConnInterface) DnsServiceClient {
+	return &dnsServiceClient{cc}
+}
+
+func (c *dnsServiceClient) Resolve(ctx context.Context, in *DnsRequest, opts ...grpc.CallOption) (*DnsResponse, error) {
+	out := new(DnsResponse)
+	err := c.cc.Invoke(ctx, DnsService_Resolve_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dnsServiceClient) Stream(ctx context.Context, opts ...grpc.CallOption) (DnsService_StreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DnsService_ServiceDesc.Streams[0], DnsService_Stream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dnsServiceStreamClient{stream}
+	return x, nil
+}
+
+type DnsService_StreamClient interface {
+	Send(*DnsRequest) error
+	Recv() (*DnsResponse, error)
+	grpc.ClientStream
+}
+
+type dnsServiceStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *dnsServiceStreamClient) Send(m *DnsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *dnsServiceStreamClient) Recv() (*DnsResponse, error) {
+	m := new(DnsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DnsServiceServer is the server API for DnsService service.
+// All implementations must embed UnimplementedDnsServiceServer
+// for forward compatibility
+type DnsServiceServer interface {
+	// Resolve answers a single query
+	Resolve(context.Context, *DnsRequest) (*DnsResponse, error)
+	// Stream answers the queries of the stream, the responses sent in the
+	// order they resolved and matched to the queries by the message id. The
+	// malformed queries and the dropped ones not answered.
+	Stream(DnsService_StreamServer) error
+	mustEmbedUnimplementedDnsServiceServer()
+}
+
+// UnimplementedDnsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedDnsServiceServer struct {
+}
+
+func (UnimplementedDnsServiceServer) Resolve(context.Context, *DnsRequest) (*DnsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resolve not implemented")
+}
+func (UnimplementedDnsServiceServer) Stream(DnsService_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedDnsServiceServer) mustEmbedUnimplementedDnsServiceServer() {}
+
+// UnsafeDnsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DnsServiceServer will
+// result in compilation errors.
+type UnsafeDnsServiceServer interface {
+	mustEmbedUnimplementedDnsServiceServer()
+}
+
+func RegisterDnsServiceServer(s grpc.ServiceRegistrar, srv DnsServiceServer) {
+	s.RegisterService(&DnsService_ServiceDesc, srv)
+}
+
+func _DnsService_Resolve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DnsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DnsServiceServer).Resolve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DnsService_Resolve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DnsServiceServer).Resolve(ctx, req.(*DnsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DnsService_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DnsServiceServer).Stream(&dnsServiceStreamServer{stream})
+}
+
+type DnsService_StreamServer interface {
+	Send(*DnsResponse) error
+	Recv() (*DnsRequest, error)
+	grpc.ServerStream
+}
+
+type dnsServiceStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *dnsServiceStreamServer) Send(m *DnsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *dnsServiceStreamServer) Recv() (*DnsRequest, error) {
+	m := new(DnsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DnsService_ServiceDesc is the grpc.ServiceDesc for DnsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DnsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sdns.DnsService",
+	HandlerType: (*DnsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Resolve",
+			Handler:    _DnsService_Resolve_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _DnsService_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "dns.proto",
+}
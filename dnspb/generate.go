@@ -0,0 +1,4 @@
+// Package dnspb is the gRPC service of the DNS queries in the wire format
+package dnspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative dns.proto
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecOff        = "off"
+	dnssecValidate   = "validate"
+	dnssecPermissive = "validate-permissive"
+)
+
+var dnssecModes = map[string]bool{
+	dnssecOff:        true,
+	dnssecValidate:   true,
+	dnssecPermissive: true,
+}
+
+// validating reports whether the responses of the request validated, the
+// checking disabled requests never validated
+func validating(req *dns.Msg) bool {
+	return Config().DNSSEC != dnssecOff && !req.CheckingDisabled
+}
+
+// bogus returns the validation error in the validate mode, the permissive
+// mode answers without the AD flag instead of failing
+func bogus(err error) error {
+	if Config().DNSSEC == dnssecPermissive {
+		return nil
+	}
+
+	return err
+}
+
+// unvalidated clears the AD flag of the forwarded responses, the flag only
+// set on the responses validated here
+func unvalidated(resp *dns.Msg, err error) (*dns.Msg, error) {
+	if resp != nil {
+		resp.AuthenticatedData = false
+	}
+
+	return resp, err
+}
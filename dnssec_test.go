@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dnssecMode(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	err := errors.New("bogus")
+
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecValidate })()
+	assert.True(t, validating(req))
+	assert.Equal(t, err, bogus(err))
+
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecPermissive })()
+	assert.True(t, validating(req))
+	assert.NoError(t, bogus(err))
+
+	req.CheckingDisabled = true
+	assert.False(t, validating(req))
+
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecOff })()
+	req.CheckingDisabled = false
+	assert.False(t, validating(req))
+
+	resp := new(dns.Msg)
+	resp.AuthenticatedData = true
+
+	resp, err = unvalidated(resp, nil)
+	assert.NoError(t, err)
+	assert.False(t, resp.AuthenticatedData)
+
+	resp, _ = unvalidated(nil, err)
+	assert.Nil(t, resp)
+}
+
+func Test_verifyDNSSECTrustList(t *testing.T) {
+	const zone = "trust.example."
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	assert.NoError(t, err)
+
+	a, _ := dns.NewRR("www." + zone + " 300 IN A 192.0.2.1")
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.NoError(t, sig.Sign(priv.(crypto.Signer), []dns.RR{a}))
+
+	keyReq := new(dns.Msg)
+	keyReq.SetQuestion(zone, dns.TypeDNSKEY)
+
+	keyResp := new(dns.Msg)
+	keyResp.SetReply(keyReq)
+	keyResp.Answer = []dns.RR{key}
+
+	r := &Resolver{Qcache: cache.NewQueryCache(64, 0, 0)}
+	r.Qcache.Set(cache.Hash(keyReq.Question[0]), keyResp)
+
+	ds := []dns.RR{key.ToDS(dns.SHA256)}
+	ds[0].Header().Ttl = 3600
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("www."+zone, dns.TypeA)
+	resp.Answer = []dns.RR{a, sig}
+
+	defer TrustList.Remove(zone)
+
+	ok, err := r.verifyDNSSEC("udp", zone, "www."+zone, resp, ds)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	status, found := TrustList.Status(zone)
+	assert.True(t, found)
+	assert.Equal(t, cache.StatusSecure, status.Status)
+	assert.Equal(t, 1, status.Keys)
+
+	// the keys not fetched again
+	r.Qcache.Remove(cache.Hash(keyReq.Question[0]))
+
+	ok, err = r.verifyDNSSEC("udp", zone, "www."+zone, resp, ds)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/dnssec/"+zone, nil)
+	ginr.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"secure"`)
+
+	bad := resp.Copy()
+	bad.Answer[0].(*dns.A).A = []byte{192, 0, 2, 2}
+
+	_, err = r.verifyDNSSEC("udp", zone, "www."+zone, bad, ds)
+	assert.Error(t, err)
+
+	status, _ = TrustList.Status(zone)
+	assert.Equal(t, cache.StatusBogus, status.Status)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/dnssec", nil)
+	ginr.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"bogus"`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/dnssec/missing.example.", nil)
+	ginr.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
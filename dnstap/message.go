@@ -0,0 +1,145 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// MessageType is the type of the dnstap message
+type MessageType uint64
+
+// Message types described at dnstap.proto
+const (
+	MessageClientQuery    MessageType = 5
+	MessageClientResponse MessageType = 6
+)
+
+// SocketProtocol is the transport protocol of the message
+type SocketProtocol uint64
+
+// Socket protocols described at dnstap.proto
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDOT SocketProtocol = 3
+	ProtocolDOH SocketProtocol = 4
+	ProtocolDOQ SocketProtocol = 7
+)
+
+const (
+	familyINET  = 1
+	familyINET6 = 2
+
+	dnstapTypeMessage = 1
+)
+
+// Message is a dnstap message of a client query or response
+type Message struct {
+	Type     MessageType
+	Protocol SocketProtocol
+
+	QueryAddress net.IP
+	QueryPort    uint32
+
+	QueryTime    time.Time
+	ResponseTime time.Time
+
+	QueryMessage    []byte
+	ResponseMessage []byte
+}
+
+// Marshal encodes the message with the dnstap envelope in protobuf wire format
+func (m *Message) Marshal(identity, version []byte) []byte {
+	var msg []byte
+
+	msg = appendVarint(msg, 1, uint64(m.Type))
+
+	address := m.QueryAddress.To4()
+	if address != nil {
+		msg = appendVarint(msg, 2, familyINET)
+	} else if address = m.QueryAddress.To16(); address != nil {
+		msg = appendVarint(msg, 2, familyINET6)
+	}
+
+	if m.Protocol > 0 {
+		msg = appendVarint(msg, 3, uint64(m.Protocol))
+	}
+
+	if address != nil {
+		msg = appendBytes(msg, 4, address)
+	}
+
+	if m.QueryPort > 0 {
+		msg = appendVarint(msg, 6, uint64(m.QueryPort))
+	}
+
+	if !m.QueryTime.IsZero() {
+		msg = appendVarint(msg, 8, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32(msg, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+
+	if m.QueryMessage != nil {
+		msg = appendBytes(msg, 10, m.QueryMessage)
+	}
+
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarint(msg, 12, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32(msg, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+
+	if m.ResponseMessage != nil {
+		msg = appendBytes(msg, 14, m.ResponseMessage)
+	}
+
+	var buf []byte
+
+	if identity != nil {
+		buf = appendBytes(buf, 1, identity)
+	}
+
+	if version != nil {
+		buf = appendBytes(buf, 2, version)
+	}
+
+	buf = appendBytes(buf, 14, msg)
+	buf = appendVarint(buf, 15, dnstapTypeMessage)
+
+	return buf
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendKey(buf []byte, field, wire uint64) []byte {
+	return appendUvarint(buf, field<<3|wire)
+}
+
+func appendVarint(buf []byte, field, v uint64) []byte {
+	buf = appendKey(buf, field, wireVarint)
+	return appendUvarint(buf, v)
+}
+
+func appendBytes(buf []byte, field uint64, b []byte) []byte {
+	buf = appendKey(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendFixed32(buf []byte, field uint64, v uint32) []byte {
+	buf = appendKey(buf, field, wireFixed32)
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
@@ -0,0 +1,45 @@
+package dnstap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MessageMarshal(t *testing.T) {
+	m := &Message{
+		Type:            MessageClientResponse,
+		Protocol:        ProtocolUDP,
+		QueryAddress:    net.ParseIP("127.0.0.1"),
+		QueryPort:       5353,
+		QueryTime:       time.Unix(1500000000, 0),
+		ResponseTime:    time.Unix(1500000000, 1000),
+		QueryMessage:    []byte{1, 2},
+		ResponseMessage: []byte{3, 4},
+	}
+
+	buf := m.Marshal([]byte("sdns"), nil)
+
+	// identity
+	assert.True(t, bytes.HasPrefix(buf, []byte{0x0a, 4, 's', 'd', 'n', 's'}))
+	// dnstap type message
+	assert.True(t, bytes.HasSuffix(buf, []byte{0x78, 0x01}))
+
+	// message type, socket family, protocol and address
+	assert.True(t, bytes.Contains(buf, []byte{0x08, 0x06, 0x10, 0x01, 0x18, 0x01, 0x22, 0x04, 127, 0, 0, 1}))
+	// query port
+	assert.True(t, bytes.Contains(buf, []byte{0x30, 0xe9, 0x29}))
+	// response time nsec
+	assert.True(t, bytes.Contains(buf, []byte{0x6d, 0xe8, 0x03, 0x00, 0x00}))
+	// query and response messages
+	assert.True(t, bytes.Contains(buf, []byte{0x52, 0x02, 1, 2}))
+	assert.True(t, bytes.Contains(buf, []byte{0x72, 0x02, 3, 4}))
+
+	m.QueryAddress = net.ParseIP("::1")
+	buf = m.Marshal(nil, nil)
+
+	assert.True(t, bytes.Contains(buf, []byte{0x10, 0x02, 0x18, 0x01, 0x22, 0x10}))
+}
@@ -0,0 +1,260 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/semihalev/log"
+)
+
+// ContentType of the dnstap frames
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// frame streams control frame types
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+
+	maxControlSize = 512
+)
+
+var (
+	// DialTimeout for connect to the collector
+	DialTimeout = 2 * time.Second
+
+	// HandshakeTimeout for the frame streams handshake and the stop sequence
+	HandshakeTimeout = 2 * time.Second
+
+	// MaxBackoff is the maximum wait time between the reconnect attempts
+	MaxBackoff = 30 * time.Second
+
+	errUnexpectedControl = errors.New("unexpected control frame")
+	errControlSize       = errors.New("control frame too big")
+)
+
+// Writer sends the frames to a dnstap collector with the bidirectional frame streams
+// protocol, frames are buffered and the connection reestablished when the collector goes away
+type Writer struct {
+	network string
+	addr    string
+
+	frames chan []byte
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewWriter returns a new writer which buffers up to size frames
+func NewWriter(network, addr string, size int) *Writer {
+	w := &Writer{
+		network: network,
+		addr:    addr,
+
+		frames: make(chan []byte, size),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// Write queues the frame, returns false if the buffer is full and the frame dropped
+func (w *Writer) Write(frame []byte) bool {
+	select {
+	case w.frames <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close sends the buffered frames and stops the writer
+func (w *Writer) Close() {
+	close(w.quit)
+	<-w.done
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	var (
+		conn    net.Conn
+		bw      *bufio.Writer
+		backoff time.Duration
+	)
+
+	for {
+		if conn == nil {
+			c, err := w.connect()
+			if err != nil {
+				if backoff == 0 {
+					log.Warn("Dnstap collector connect failed", "addr", w.addr, "error", err.Error())
+				}
+
+				backoff = nextBackoff(backoff)
+
+				select {
+				case <-w.quit:
+					return
+				case <-time.After(backoff):
+				}
+
+				continue
+			}
+
+			if backoff > 0 {
+				log.Info("Dnstap collector connected", "addr", w.addr)
+			}
+
+			conn, bw, backoff = c, bufio.NewWriter(c), 0
+		}
+
+		select {
+		case <-w.quit:
+			w.stop(conn, bw)
+			return
+		case frame := <-w.frames:
+			err := writeFrame(bw, frame)
+			if err == nil && len(w.frames) == 0 {
+				err = bw.Flush()
+			}
+
+			if err != nil {
+				log.Warn("Dnstap collector write failed", "addr", w.addr, "error", err.Error())
+
+				conn.Close()
+				conn = nil
+
+				w.Write(frame)
+			}
+		}
+	}
+}
+
+func (w *Writer) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(w.network, w.addr, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	if err := writeControl(conn, controlReady); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if typ, err := readControl(conn); err != nil || typ != controlAccept {
+		conn.Close()
+		if err == nil {
+			err = errUnexpectedControl
+		}
+		return nil, err
+	}
+
+	if err := writeControl(conn, controlStart); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (w *Writer) stop(conn net.Conn, bw *bufio.Writer) {
+	defer conn.Close()
+
+	for len(w.frames) > 0 {
+		if err := writeFrame(bw, <-w.frames); err != nil {
+			return
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+
+	if err := writeControl(conn, controlStop); err != nil {
+		return
+	}
+
+	readControl(conn)
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Second
+	}
+
+	backoff *= 2
+	if backoff > MaxBackoff {
+		backoff = MaxBackoff
+	}
+
+	return backoff
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+func writeControl(w io.Writer, typ uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, typ)
+
+	if typ == controlReady || typ == controlAccept || typ == controlStart {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field, controlFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(ContentType)))
+
+		payload = append(payload, field...)
+		payload = append(payload, ContentType...)
+	}
+
+	// escape sequence and the control frame length
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(payload)))
+
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errUnexpectedControl
+	}
+
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > maxControlSize {
+		return 0, errControlSize
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(payload[:4]), nil
+}
@@ -0,0 +1,165 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type collector struct {
+	ln     net.Listener
+	frames chan []byte
+	conns  chan net.Conn
+}
+
+func newCollector(t *testing.T, path string) *collector {
+	ln, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+
+	c := &collector{ln: ln, frames: make(chan []byte, 16), conns: make(chan net.Conn, 4)}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			c.conns <- conn
+
+			go c.serve(conn)
+		}
+	}()
+
+	return c
+}
+
+func (c *collector) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if typ, err := readControl(conn); err != nil || typ != controlReady {
+		return
+	}
+
+	if err := writeControl(conn, controlAccept); err != nil {
+		return
+	}
+
+	if typ, err := readControl(conn); err != nil || typ != controlStart {
+		return
+	}
+
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		size := binary.BigEndian.Uint32(length[:])
+		if size == 0 {
+			// control frame
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+
+			payload := make([]byte, binary.BigEndian.Uint32(length[:]))
+			io.ReadFull(conn, payload)
+
+			if binary.BigEndian.Uint32(payload[:4]) == controlStop {
+				writeControl(conn, controlFinish)
+			}
+
+			return
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+
+		c.frames <- frame
+	}
+}
+
+func (c *collector) receive(t *testing.T) []byte {
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame not received")
+	}
+
+	return nil
+}
+
+func Test_Writer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dnstap.sock")
+
+	c := newCollector(t, path)
+	defer c.ln.Close()
+
+	w := NewWriter("unix", path, 16)
+
+	assert.True(t, w.Write([]byte("frame1")))
+	assert.Equal(t, "frame1", string(c.receive(t)))
+
+	// collector goes away, writer should reconnect
+	conn := <-c.conns
+	conn.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(c.conns) == 0 && time.Now().Before(deadline) {
+		w.Write([]byte("frame2"))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, "frame2", string(c.receive(t)))
+
+	w.Write([]byte("frame3"))
+	w.Close()
+
+	for frame := range drain(c.frames) {
+		if string(frame) == "frame3" {
+			return
+		}
+	}
+
+	t.Fatal("buffered frame not sent on close")
+}
+
+func Test_WriterBuffer(t *testing.T) {
+	w := NewWriter("unix", "/nonexistent/dnstap.sock", 1)
+	defer w.Close()
+
+	assert.True(t, w.Write([]byte("frame1")))
+	assert.False(t, w.Write([]byte("frame2")))
+}
+
+func drain(frames chan []byte) chan []byte {
+	out := make(chan []byte, len(frames)+1)
+
+	for {
+		select {
+		case frame := <-frames:
+			out <- frame
+			continue
+		case <-time.After(time.Second):
+		}
+		break
+	}
+
+	close(out)
+
+	return out
+}
@@ -4,174 +4,425 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
 	"github.com/semihalev/sdns/doh"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/yl2chen/cidranger"
 )
 
-func (h *DNSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	client, _, _ := net.SplitHostPort(r.RemoteAddr)
-	allowed, _ := AccessList.Contains(net.ParseIP(client))
-	if !allowed {
-		log.Debug("Client denied to make new query", "client", client, "net", "https")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
+// The response formats of the DNS-over-HTTPS queries
+const (
+	dohWire = "wire"
+	dohJSON = "json"
+)
 
-	var f func(http.ResponseWriter, *http.Request)
-	if r.Method == http.MethodGet && r.URL.Query().Get("dns") == "" {
-		f = h.handleJSON()
-	} else {
-		f = h.handleWireFormat()
-	}
+// dohMaxMessageSize is the largest DNS message of the POST bodies
+const dohMaxMessageSize = dns.MaxMsgSize
+
+// The headers the trusted proxies write the client addresses to, only the
+// configured one read, the client may send the other one through the proxy
+const (
+	proxyHeaderXFF       = "x-forwarded-for"
+	proxyHeaderForwarded = "forwarded"
+)
 
-	f(w, r)
+var proxyHeaders = map[string]bool{
+	proxyHeaderXFF:       true,
+	proxyHeaderForwarded: true,
 }
 
-func (h *DNSHandler) handleWireFormat() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			buf []byte
-			err error
-		)
-
-		switch r.Method {
-		case http.MethodGet:
-			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
-			if len(buf) == 0 || err != nil {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
-		case http.MethodPost:
-			if r.Header.Get("Content-Type") != "application/dns-message" {
-				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
-				return
+var (
+	// TrustedProxies are the proxies the client address header of the
+	// DNS-over-HTTPS queries honored from, nil if none
+	TrustedProxies   cidranger.Ranger
+	trustedProxiesMu sync.RWMutex
+)
+
+// newTrustedProxies returns a ranger of the proxy networks, the addresses
+// without the prefix length are single hosts. Nil for no proxies.
+func newTrustedProxies(proxies []string) (cidranger.Ranger, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	ranger := cidranger.NewPCTrieRanger()
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy invalid: %s", proxy)
 			}
 
-			buf, err = ioutil.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
+			if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
 			}
-			defer r.Body.Close()
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-			return
 		}
 
-		req := new(dns.Msg)
-		if err := req.Unpack(buf); err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy parse cidr failed: %s", err)
+		}
+
+		if err := ranger.Insert(cidranger.NewBasicRangerEntry(*ipnet)); err != nil {
+			return nil, fmt.Errorf("trusted proxy insert cidr failed: %s", err)
 		}
+	}
 
-		msg := h.query("https", req)
+	return ranger, nil
+}
 
-		packed, err := msg.Pack()
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Server", "SDNS/"+Version)
-		w.Header().Set("Content-Type", "application/dns-message")
-		w.Write(packed)
+func trustedProxy(ranger cidranger.Ranger, ip net.IP) bool {
+	if ranger == nil || ip == nil {
+		return false
 	}
+
+	ok, err := ranger.Contains(ip)
+	return err == nil && ok
 }
 
-func (h *DNSHandler) handleJSON() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		name := r.URL.Query().Get("name")
-		if name == "" {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+// dohClient returns the client ip and the remote address of the query. The
+// proxy header honored only from the trusted proxies, the client is the last
+// address not a trusted proxy.
+func dohClient(r *http.Request) (client, remoteAddr string) {
+	client, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+	trustedProxiesMu.RLock()
+	ranger := TrustedProxies
+	trustedProxiesMu.RUnlock()
+
+	if !trustedProxy(ranger, net.ParseIP(client)) {
+		return client, r.RemoteAddr
+	}
+
+	hops := forwardedHops(r.Header, Config().TrustedProxyHeader)
+
+	forwarded := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
 		}
-		if !strings.HasSuffix(name, ".") {
-			buf := bytes.NewBufferString(name)
-			buf.WriteString(".")
-			name = buf.String()
+
+		forwarded = ip.String()
+		if !trustedProxy(ranger, ip) {
+			break
 		}
+	}
+
+	if forwarded == "" {
+		return client, r.RemoteAddr
+	}
+
+	return forwarded, net.JoinHostPort(forwarded, "0")
+}
+
+// forwardedHops returns the client addresses of the proxy chain in order from
+// the proxy header, the for parameters of the Forwarded header (RFC 7239) or
+// the X-Forwarded-For header. The obfuscated and unknown hops kept as is.
+func forwardedHops(header http.Header, name string) []string {
+	var hops []string
+
+	if name == proxyHeaderForwarded {
+		for _, value := range header["Forwarded"] {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+						continue
+					}
 
-		qtype := doh.ParseQTYPE(r.URL.Query().Get("type"))
-		if qtype == dns.TypeNone {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+					hops = append(hops, forwardedNode(strings.Trim(pair[4:], `"`)))
+				}
+			}
 		}
 
-		req := new(dns.Msg)
-		req.RecursionDesired = true
+		return hops
+	}
 
-		if r.URL.Query().Get("cd") == "true" {
-			req.CheckingDisabled = true
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
 		}
+	}
 
-		req.Question = []dns.Question{
-			dns.Question{
-				Name:   name,
-				Qtype:  qtype,
-				Qclass: dns.ClassINET,
-			},
+	return hops
+}
+
+// forwardedNode returns the address of the node without the port, the ipv6
+// addresses of the Forwarded header are in the brackets
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
 		}
 
-		opt := &dns.OPT{
-			Hdr: dns.RR_Header{
-				Name:   ".",
-				Class:  dns.DefaultMsgSize,
-				Rrtype: dns.TypeOPT,
-			},
+		return node
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return node
+}
+
+func (h *DNSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.begin()
+	defer h.end()
+
+	client, remoteAddr := dohClient(r)
+
+	entry := accessEntry(client, listenerDOH)
+	if entry == nil || entry.Action == ActionDeny {
+		switch countAccessDenied(entry, client, "https") {
+		case accessDeniedDrop:
+			// the connection closed or the stream reset without an answer
+			panic(http.ErrAbortHandler)
+		case accessDeniedEDE:
+			http.Error(w, "access denied", http.StatusForbidden)
+		default:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		}
 
-		if r.URL.Query().Get("do") == "true" {
-			opt.SetDo()
+		return
+	}
+
+	// over https the truncated answers not asked again, only the hard cap applied
+	if !entry.NoRateLimit && limitClient(client, listenerDOH) == cache.LimitDrop {
+		metrics.RateLimited.WithLabelValues("drop").Inc()
+		log.Debug("Client query dropped by rate limit", "client", client, "net", "https")
+
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	release, ok := currentQueryLimiter().acquire("tcp")
+	if !ok {
+		countOverloaded(client, "https")
+
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	req, code := dohRequest(r)
+	if req == nil {
+		if code == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, POST")
 		}
 
-		if ecs := r.URL.Query().Get("edns_client_subnet"); ecs != "" {
-			_, subnet, err := net.ParseCIDR(ecs)
-			if err != nil {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
-			}
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
 
-			mask, bits := subnet.Mask.Size()
-			var af uint16
-			if bits == 32 {
-				af = 1
-			} else {
-				af = 2
-			}
+	event := newQueryEvent("https", remoteAddr, req, entry)
+
+	setClientSubnet(req, net.ParseIP(client))
+
+	pad := shouldPad(req)
+
+	msg, status := h.queryStatus("https", req, entry)
+
+	event.Done(msg, status)
+
+	// the dropped queries, the DNS errors answered with 200 (RFC 8484)
+	if msg == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Server", "SDNS/"+Version)
+
+	if dohFormat(r) == dohJSON {
+		writeJSON(w, r, msg)
+		return
+	}
+
+	if pad {
+		padMsg(msg, Config().PaddingBlockSize)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(packed)
+}
+
+// dohFormat returns the response format of the query, the Accept header
+// overrides the format of the query shape
+func dohFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+
+	switch {
+	case strings.Contains(accept, "application/dns-message"):
+		return dohWire
+	case strings.Contains(accept, "application/dns-json"), strings.Contains(accept, "application/json"):
+		return dohJSON
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("dns") == "" {
+		return dohJSON
+	}
 
-			opt.Option = []dns.EDNS0{
-				&dns.EDNS0_SUBNET{
-					Code:          dns.EDNS0SUBNET,
-					Family:        af,
-					SourceNetmask: uint8(mask),
-					SourceScope:   0,
-					Address:       subnet.IP,
-				},
+	return dohWire
+}
+
+// dohRequest returns the DNS request of the http request; the RFC 8484 GET
+// and POST queries or the JSON API GET queries. The http status of the
+// failure returned with a nil request.
+func dohRequest(r *http.Request) (*dns.Msg, int) {
+	var buf []byte
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+
+		if query.Get("dns") == "" {
+			if _, ok := query["dns"]; ok || query.Get("name") == "" {
+				return nil, http.StatusBadRequest
 			}
+
+			return jsonRequest(r)
 		}
 
-		req.Extra = append(req.Extra, opt)
+		var err error
+		buf, err = base64.RawURLEncoding.DecodeString(query.Get("dns"))
+		if len(buf) == 0 || err != nil {
+			return nil, http.StatusBadRequest
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			return nil, http.StatusUnsupportedMediaType
+		}
+		defer r.Body.Close()
 
-		msg := h.query("https", req)
+		var err error
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dohMaxMessageSize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest
+		}
+
+		if len(buf) > dohMaxMessageSize {
+			return nil, http.StatusRequestEntityTooLarge
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || len(req.Question) == 0 {
+		return nil, http.StatusBadRequest
+	}
+
+	return req, http.StatusOK
+}
+
+// jsonRequest returns the DNS request of the JSON API query parameters
+func jsonRequest(r *http.Request) (*dns.Msg, int) {
+	name := r.URL.Query().Get("name")
+	if !strings.HasSuffix(name, ".") {
+		buf := bytes.NewBufferString(name)
+		buf.WriteString(".")
+		name = buf.String()
+	}
+
+	qtype := doh.ParseQTYPE(r.URL.Query().Get("type"))
+	if qtype == dns.TypeNone {
+		return nil, http.StatusBadRequest
+	}
+
+	req := new(dns.Msg)
+	req.RecursionDesired = true
+
+	if r.URL.Query().Get("cd") == "true" {
+		req.CheckingDisabled = true
+	}
+
+	req.Question = []dns.Question{
+		dns.Question{
+			Name:   name,
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		},
+	}
 
-		json, err := json.Marshal(doh.NewMsg(msg))
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Class:  dns.DefaultMsgSize,
+			Rrtype: dns.TypeOPT,
+		},
+	}
+
+	if r.URL.Query().Get("do") == "true" {
+		opt.SetDo()
+	}
+
+	if ecs := r.URL.Query().Get("edns_client_subnet"); ecs != "" {
+		_, subnet, err := net.ParseCIDR(ecs)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+			return nil, http.StatusBadRequest
 		}
-		w.Header().Set("Server", "SDNS/"+Version)
 
-		if strings.Contains(r.Header.Get("Accept"), "text/html") {
-			w.Header().Set("Content-Type", "application/x-javascript")
+		mask, bits := subnet.Mask.Size()
+		var af uint16
+		if bits == 32 {
+			af = 1
 		} else {
-			w.Header().Set("Content-Type", "application/dns-json")
+			af = 2
 		}
 
-		w.Write(json)
+		opt.Option = []dns.EDNS0{
+			&dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        af,
+				SourceNetmask: uint8(mask),
+				SourceScope:   0,
+				Address:       subnet.IP,
+			},
+		}
+	}
+
+	req.Extra = append(req.Extra, opt)
+
+	return req, http.StatusOK
+}
+
+// writeJSON writes the JSON API answer of the message
+func writeJSON(w http.ResponseWriter, r *http.Request, msg *dns.Msg) {
+	data, err := json.Marshal(doh.NewMsg(msg))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+
+	accept := r.Header.Get("Accept")
+
+	switch {
+	case strings.Contains(accept, "text/html"):
+		w.Header().Set("Content-Type", "application/x-javascript")
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		w.Header().Set("Content-Type", "application/dns-json")
+	}
+
+	w.Write(data)
 }
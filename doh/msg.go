@@ -23,15 +23,16 @@ type RR struct {
 
 // Msg struct
 type Msg struct {
-	Status    int
-	TC        bool
-	RD        bool
-	RA        bool
-	AD        bool
-	CD        bool
-	Question  []Question
-	Answer    []RR `json:",omitempty"`
-	Authority []RR `json:",omitempty"`
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []Question
+	Answer     []RR `json:",omitempty"`
+	Authority  []RR `json:",omitempty"`
+	Additional []RR `json:",omitempty"`
 }
 
 // NewMsg function
@@ -74,5 +75,19 @@ func NewMsg(m *dns.Msg) *Msg {
 		}
 	}
 
+	// the OPT record is not a record of the answer
+	for _, a := range m.Extra {
+		if a.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		msg.Additional = append(msg.Additional, RR{
+			Name: a.Header().Name,
+			Type: a.Header().Rrtype,
+			TTL:  a.Header().Ttl,
+			Data: strings.TrimPrefix(a.String(), a.Header().String()),
+		})
+	}
+
 	return msg
 }
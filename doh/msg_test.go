@@ -28,4 +28,13 @@ func Test_Msg(t *testing.T) {
 
 	assert.Equal(t, m.Answer[0].Data, msg.Answer[0].(*dns.NS).Ns)
 	assert.Equal(t, m.Authority[0].Data, msg.Ns[0].(*dns.A).A.String())
+
+	rr, err = dns.NewRR("a.root-servers.net.	518400	IN	A	198.41.0.4")
+	assert.NoError(t, err)
+	msg.Extra = append(msg.Extra, rr)
+	msg.SetEdns0(4096, true)
+
+	m = NewMsg(msg)
+	assert.Len(t, m.Additional, 1)
+	assert.Equal(t, "198.41.0.4", m.Additional[0].Data)
 }
@@ -62,6 +62,8 @@ var qtype = map[string]uint16{
 	"CDS":        dns.TypeCDS,
 	"CDNSKEY":    dns.TypeCDNSKEY,
 	"OPENPGPKEY": dns.TypeOPENPGPKEY,
+	"SVCB":       64,
+	"HTTPS":      65,
 	"CSYNC":      dns.TypeCSYNC,
 	"SPF":        dns.TypeSPF,
 	"UINFO":      dns.TypeUINFO,
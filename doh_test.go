@@ -214,3 +214,311 @@ func Test_dohWirePOST(t *testing.T) {
 
 	assert.Equal(t, len(msg.Answer) > 0, true)
 }
+
+func Test_dohClient(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	assert.NoError(t, err)
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	defer func() {
+		trustedProxiesMu.Lock()
+		TrustedProxies = nil
+		trustedProxiesMu.Unlock()
+	}()
+
+	client := func(remote string, forwarded ...string) (string, string) {
+		r, _ := http.NewRequest("GET", "/dns-query", nil)
+		r.RemoteAddr = remote
+		for _, f := range forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+
+		return dohClient(r)
+	}
+
+	ip, addr := client("127.0.0.1:4000", "198.51.100.7, 10.0.0.2")
+	assert.Equal(t, "198.51.100.7", ip)
+	assert.Equal(t, "198.51.100.7:0", addr)
+
+	// the spoofed addresses before the first untrusted hop ignored
+	ip, _ = client("127.0.0.1:4000", "192.0.2.1", "198.51.100.7")
+	assert.Equal(t, "198.51.100.7", ip)
+
+	// the header of the untrusted clients ignored
+	ip, addr = client("192.0.2.9:4000", "198.51.100.7")
+	assert.Equal(t, "192.0.2.9", ip)
+	assert.Equal(t, "192.0.2.9:4000", addr)
+
+	ip, _ = client("127.0.0.1:4000")
+	assert.Equal(t, "127.0.0.1", ip)
+
+	ip, _ = client("127.0.0.1:4000", "not an ip")
+	assert.Equal(t, "127.0.0.1", ip)
+
+	// the chained proxies trusted on the way back to the client
+	ip, _ = client("127.0.0.1:4000", "203.0.113.5, 198.51.100.7, 10.1.1.1, 10.2.2.2")
+	assert.Equal(t, "198.51.100.7", ip)
+
+	// all the hops trusted, the first hop is the client
+	ip, _ = client("127.0.0.1:4000", "10.1.1.1, 10.2.2.2")
+	assert.Equal(t, "10.1.1.1", ip)
+
+	_, err = newTrustedProxies([]string{"proxy.example.com"})
+	assert.Error(t, err)
+
+	_, err = newTrustedProxies([]string{"10.0.0.0/99"})
+	assert.Error(t, err)
+}
+
+func Test_forwardedHops(t *testing.T) {
+	header := http.Header{}
+	header.Add("Forwarded", `for=192.0.2.60;proto=https;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`)
+	header.Add("Forwarded", "for=198.51.100.7:8443")
+	header.Add("X-Forwarded-For", "203.0.113.9")
+
+	// only the configured header read
+	assert.Equal(t, []string{"192.0.2.60", "2001:db8:cafe::17", "198.51.100.7"}, forwardedHops(header, proxyHeaderForwarded))
+	assert.Equal(t, []string{"203.0.113.9"}, forwardedHops(header, proxyHeaderXFF))
+
+	header.Del("X-Forwarded-For")
+	assert.Nil(t, forwardedHops(header, proxyHeaderXFF))
+
+	header = http.Header{}
+	header.Add("Forwarded", "for=unknown, for=_hidden")
+	assert.Equal(t, []string{"unknown", "_hidden"}, forwardedHops(header, proxyHeaderForwarded))
+
+	defer setConfig(func(cfg *config) { cfg.TrustedProxyHeader = proxyHeaderForwarded })()
+
+	proxies, _ := newTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	defer func() {
+		trustedProxiesMu.Lock()
+		TrustedProxies = nil
+		trustedProxiesMu.Unlock()
+	}()
+
+	r, _ := http.NewRequest("GET", "/dns-query", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Add("Forwarded", `for="[2001:db8::1]:5353", for=10.0.0.9`)
+
+	ip, addr := dohClient(r)
+	assert.Equal(t, "2001:db8::1", ip)
+	assert.Equal(t, "[2001:db8::1]:0", addr)
+
+	// the unknown hop ends the chain, the proxy is the client
+	r.Header.Set("Forwarded", "for=unknown")
+
+	ip, _ = dohClient(r)
+	assert.Equal(t, "127.0.0.1", ip)
+}
+
+func Test_dohClientSpoofedForwarded(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.TrustedProxyHeader = proxyHeaderXFF })()
+
+	proxies, _ := newTrustedProxies([]string{"127.0.0.1"})
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	defer func() {
+		trustedProxiesMu.Lock()
+		TrustedProxies = nil
+		trustedProxiesMu.Unlock()
+	}()
+
+	// the client sent the Forwarded header, the proxy appended the peer to
+	// the X-Forwarded-For header and passed the other one through
+	r, _ := http.NewRequest("GET", "/dns-query", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Set("Forwarded", "for=10.9.9.9")
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	ip, _ := dohClient(r)
+	assert.Equal(t, "198.51.100.7", ip)
+
+	// no X-Forwarded-For, the spoofed Forwarded header not used either
+	r.Header.Del("X-Forwarded-For")
+
+	ip, _ = dohClient(r)
+	assert.Equal(t, "127.0.0.1", ip)
+}
+
+func Test_dohRateLimitForwarded(t *testing.T) {
+	defer setupClientLimiter(&config{})
+	setupClientLimiter(&config{ClientRateLimit: 1, ClientRateLimitHard: 2})
+
+	proxies, _ := newTrustedProxies([]string{"127.0.0.1"})
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	defer func() {
+		trustedProxiesMu.Lock()
+		TrustedProxies = nil
+		trustedProxiesMu.Unlock()
+	}()
+
+	h := NewHandler()
+
+	serve := func(forwarded string) int {
+		w := httptest.NewRecorder()
+
+		request, _ := http.NewRequest("GET", "/dns-query?name=version.bind&type=txt", nil)
+		request.RemoteAddr = "127.0.0.1:0"
+		request.Header.Set("X-Forwarded-For", forwarded)
+
+		h.ServeHTTP(w, request)
+
+		return w.Code
+	}
+
+	// the slipped queries answered over https
+	assert.Equal(t, http.StatusOK, serve("198.51.100.7"))
+	assert.Equal(t, http.StatusOK, serve("198.51.100.7"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("198.51.100.7"))
+
+	// the other clients behind the proxy limited apart
+	assert.Equal(t, http.StatusOK, serve("198.51.100.8"))
+}
+
+func Test_dohDeniedForwarded(t *testing.T) {
+	ranger, err := newAccessList([]string{"0.0.0.0/0"}, []accessRule{{CIDR: "198.51.100.0/24", Action: "deny"}}, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	proxies, _ := newTrustedProxies([]string{"127.0.0.1"})
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+
+		trustedProxiesMu.Lock()
+		TrustedProxies = nil
+		trustedProxiesMu.Unlock()
+	}()
+
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+
+	request, err := http.NewRequest("GET", "/dns-query?name=version.bind&type=txt", nil)
+	assert.NoError(t, err)
+
+	request.RemoteAddr = "127.0.0.1:0"
+	request.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedRefused })()
+
+	h.ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the access denied explained
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedEDE })()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "access denied\n", w.Body.String())
+
+	// the request aborted without an answer, counted like the others
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedDrop })()
+
+	before := accessDeniedCount(accessDeniedDrop)
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(httptest.NewRecorder(), request)
+	})
+
+	assert.NotEqual(t, before, accessDeniedCount(accessDeniedDrop))
+}
+
+func Test_dohFormat(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.Chaos = true })()
+
+	h := NewHandler()
+
+	serve := func(method, url, accept string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+
+		request, err := http.NewRequest(method, url, bytes.NewReader(body))
+		assert.NoError(t, err)
+
+		request.RemoteAddr = "127.0.0.1:0"
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		if method == "POST" {
+			request.Header.Set("Content-Type", "application/dns-message")
+		}
+
+		h.ServeHTTP(w, request)
+
+		return w
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+
+	data, err := req.Pack()
+	assert.NoError(t, err)
+
+	// the wire query answered in json
+	w := serve("POST", "/dns-query", "application/dns-json", data)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/dns-json", w.Header().Get("Content-Type"))
+
+	var dm doh.Msg
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &dm))
+	assert.Len(t, dm.Answer, 1)
+
+	w = serve("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), "application/json", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	// the json query answered in the wire format
+	w = serve("GET", "/dns-query?name=localhost&type=a", "application/dns-message", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/dns-message", w.Header().Get("Content-Type"))
+
+	msg := new(dns.Msg)
+	assert.NoError(t, msg.Unpack(w.Body.Bytes()))
+	assert.Equal(t, "localhost.", msg.Question[0].Name)
+
+	w = serve("GET", "/dns-query", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve("PUT", "/dns-query", "", data)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, POST", w.Header().Get("Allow"))
+
+	w = serve("POST", "/dns-query", "", make([]byte, dohMaxMessageSize+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/dns-query", bytes.NewReader(data))
+	request.RemoteAddr = "127.0.0.1:0"
+	request.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
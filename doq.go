@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+)
+
+const (
+	// DOQIdleTimeout closes the DNS-over-QUIC connections which idle longer
+	DOQIdleTimeout = 30 * time.Second
+
+	// DOQReadTimeout for read a query from the DNS-over-QUIC stream
+	DOQReadTimeout = 5 * time.Second
+)
+
+// DNS-over-QUIC error codes described at RFC 9250
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+// ServeQUIC serves a DNS-over-QUIC connection, every stream carries a single query
+func (h *DNSHandler) ServeQUIC(conn quic.Connection) {
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	// the queries of the denied clients answered refused on their streams,
+	// the connection closed silently in the drop mode
+	entry := accessEntry(client, listenerDOQ)
+	if (entry == nil || entry.Action == ActionDeny) && accessDeniedMode(entry) == accessDeniedDrop {
+		countAccessDenied(entry, client, "quic")
+		conn.CloseWithError(doqNoError, "")
+		return
+	}
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			logQUICError("Client quic connection closed", client, err)
+			return
+		}
+
+		release, ok := currentQueryLimiter().acquire("tcp")
+		if !ok {
+			countOverloaded(client, "quic")
+
+			stream.CancelRead(doqNoError)
+			stream.CancelWrite(doqNoError)
+			continue
+		}
+
+		h.begin()
+		go func() {
+			defer h.end()
+			defer release()
+
+			h.handleStream(conn, stream, client, entry)
+		}()
+	}
+}
+
+func (h *DNSHandler) handleStream(conn quic.Connection, stream quic.Stream, client string, entry *AccessEntry) {
+	denied := entry == nil || entry.Action == ActionDeny
+
+	// over quic the truncated answers not asked again, only the hard cap applied
+	if !denied && !entry.NoRateLimit && limitClient(client, listenerDOQ) == cache.LimitDrop {
+		metrics.RateLimited.WithLabelValues("drop").Inc()
+		log.Debug("Client query dropped by rate limit", "client", client, "net", "quic")
+
+		stream.CancelRead(doqNoError)
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(DOQReadTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		logQUICError("Client quic stream read failed", client, err)
+		stream.CancelRead(doqNoError)
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		logQUICError("Client quic stream read failed", client, err)
+		stream.CancelRead(doqNoError)
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || req.Id != 0 || len(req.Question) == 0 {
+		log.Debug("Client sent malformed query", "client", client, "net", "quic")
+		conn.CloseWithError(doqProtocolError, "malformed query")
+		return
+	}
+
+	if denied {
+		mode := countAccessDenied(entry, client, "quic")
+		if mode == accessDeniedDrop {
+			stream.CancelWrite(doqNoError)
+			return
+		}
+
+		writeQUICMsg(stream, client, h.accessDeniedMsg(req, mode))
+		return
+	}
+
+	event := newQueryEvent("quic", conn.RemoteAddr().String(), req, entry)
+
+	setClientSubnet(req, net.ParseIP(client))
+
+	pad := shouldPad(req)
+
+	msg, status := h.queryStatus("tcp", req, entry)
+
+	event.Done(msg, status)
+
+	if msg == nil {
+		// dropped by the response policy
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	if pad {
+		padMsg(msg, Config().PaddingBlockSize)
+	}
+
+	writeQUICMsg(stream, client, msg)
+}
+
+// writeQUICMsg writes the answer to the stream with the length prefix and
+// closes it, the stream reset when the answer can not be written
+func writeQUICMsg(stream quic.Stream, client string, msg *dns.Msg) {
+	packed, err := msg.Pack()
+	if err != nil {
+		log.Warn("Pack message failed", "net", "quic", "error", err.Error())
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+
+	out := make([]byte, 2, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+
+	if _, err := stream.Write(append(out, packed...)); err != nil {
+		logQUICError("Client quic stream write failed", client, err)
+		stream.CancelWrite(doqNoError)
+		return
+	}
+
+	stream.Close()
+}
+
+func logQUICError(msg, client string, err error) {
+	switch e := err.(type) {
+	case *quic.IdleTimeoutError:
+		return
+	case *quic.ApplicationError:
+		if e.ErrorCode == doqNoError {
+			return
+		}
+	case *quic.StreamError:
+		log.Debug(msg, "client", client, "net", "quic", "error", "stream reset")
+		return
+	}
+
+	if err == io.EOF {
+		return
+	}
+
+	log.Debug(msg, "client", client, "net", "quic", "error", err.Error())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func doqExchange(conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+
+	if _, err := stream.Write(append(buf, packed...)); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	msg := new(dns.Msg)
+	err = msg.Unpack(data[2:])
+
+	return msg, err
+}
+
+func Test_serverDOQ(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	s := &Server{
+		doqHost:        "127.0.0.1:0",
+		tlsCertificate: "test.cert",
+		tlsPrivateKey:  "test.key",
+	}
+
+	s.handler = NewHandler()
+	assert.NoError(t, s.runDOQ(s.doqHost))
+	defer s.closeDOQ()
+
+	req := new(dns.Msg)
+	req.SetQuestion("doq.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+	req.Id = 0
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, err := dns.NewRR("doq.example.com. 10 IN A 127.0.0.1")
+	assert.NoError(t, err)
+	m.Answer = append(m.Answer, rr)
+
+	s.handler.r.Qcache.Set(cache.Hash(req.Question[0], req.CheckingDisabled), m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}
+
+	conn, err := quic.DialAddr(ctx, s.doqServer.Addr().String(), tlsConfig, nil)
+	assert.NoError(t, err)
+
+	// reset stream should not break the connection
+	stream, err := conn.OpenStreamSync(ctx)
+	assert.NoError(t, err)
+	stream.Write([]byte{0})
+	stream.CancelWrite(doqNoError)
+
+	resp, err := doqExchange(conn, req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0), resp.Id)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+
+	// message id must be zero
+	req.Id = 1
+	_, err = doqExchange(conn, req)
+	assert.Error(t, err)
+
+	// the streams over the rate limit of the listener reset
+	setListenerPolicies(t, map[string]listenerConfig{listenerDOQ: {ClientRateLimit: 1, ClientRateLimitHard: 1}})
+	defer setListenerPolicies(t, nil)
+
+	// the connection closed by the malformed query
+	conn, err = quic.DialAddr(ctx, s.doqServer.Addr().String(), tlsConfig, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req.Id = 0
+	_, err = doqExchange(conn, req)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = doqExchange(conn, req)
+		assert.Error(t, err)
+	}
+
+	setListenerPolicies(t, nil)
+
+	// the streams over the concurrency limit reset
+	defer func() {
+		setupQueryLimiter(Config())
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.MaxConcurrentQueries = 1 })()
+	setupQueryLimiter(Config())
+
+	release, ok := currentQueryLimiter().acquire("tcp")
+	assert.True(t, ok)
+
+	_, err = doqExchange(conn, req)
+	assert.Error(t, err)
+
+	release()
+
+	_, err = doqExchange(conn, req)
+	assert.NoError(t, err)
+
+	conn.CloseWithError(doqNoError, "")
+
+	// the queries of the denied clients refused on their streams
+	setListenerPolicies(t, map[string]listenerConfig{listenerDOQ: {AccessRules: []accessRule{{CIDR: "127.0.0.0/8", Action: "deny"}}}})
+
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedEDE })()
+
+	conn, err = quic.DialAddr(ctx, s.doqServer.Addr().String(), tlsConfig, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	denied := req.Copy()
+	denied.SetEdns0(DefaultMsgSize, false)
+
+	resp, err = doqExchange(conn, denied)
+	if assert.NoError(t, err) {
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+		assert.Empty(t, resp.Answer)
+
+		code, text, ok := extendedError(resp)
+		assert.True(t, ok)
+		assert.Equal(t, uint16(edeProhibited), code)
+		assert.Equal(t, "access denied", text)
+	}
+
+	conn.CloseWithError(doqNoError, "")
+
+	// the connections of the denied clients closed silently, counted too
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedDrop })()
+
+	before := accessDeniedCount(accessDeniedDrop)
+
+	conn, err = quic.DialAddr(ctx, s.doqServer.Addr().String(), tlsConfig, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = doqExchange(conn, req)
+	assert.Error(t, err)
+	assert.NotEqual(t, before, accessDeniedCount(accessDeniedDrop))
+}
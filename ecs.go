@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setClientSubnet replaces the EDNS0 client subnet option of the request with
+// the normalized subnet of the client, the option is omitted for the
+// private and loopback addresses
+func setClientSubnet(req *dns.Msg, client net.IP) {
+	cfg := Config()
+	if !cfg.EDNSClientSubnet {
+		return
+	}
+
+	var subnet *dns.EDNS0_SUBNET
+
+	opt := req.IsEdns0()
+	if opt != nil {
+		options := []dns.EDNS0{}
+		for _, option := range opt.Option {
+			if s, ok := option.(*dns.EDNS0_SUBNET); ok {
+				subnet = s
+				continue
+			}
+			options = append(options, option)
+		}
+		opt.Option = options
+	}
+
+	ip, mask := client, -1
+	if subnet != nil {
+		if subnet.SourceNetmask == 0 {
+			// client doesn't want to reveal its subnet
+			opt.Option = append(opt.Option, subnet)
+			return
+		}
+
+		ip, mask = subnet.Address, int(subnet.SourceNetmask)
+	}
+
+	if ip == nil || isPrivateIP(ip) {
+		return
+	}
+
+	family, bits, prefix := uint16(1), 32, cfg.ECSPrefix
+	if ip.To4() == nil {
+		family, bits, prefix = 2, 128, cfg.ECSPrefixv6
+	} else {
+		ip = ip.To4()
+	}
+
+	if mask < 0 || mask > prefix {
+		mask = prefix
+	}
+
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(DefaultMsgSize)
+
+		req.Extra = append(req.Extra, opt)
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(mask),
+		SourceScope:   0,
+		Address:       ip.Mask(net.CIDRMask(mask, bits)),
+	})
+}
+
+// subnetKey returns the cache key scoped with the client subnet of the request
+func subnetKey(key uint64, req *dns.Msg) uint64 {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return key
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask > 0 {
+			return cache.HashScope(key, subnet.String())
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func clientSubnetOf(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+func Test_setClientSubnet(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.ECSPrefix = 24
+		cfg.ECSPrefixv6 = 56
+	})()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	setClientSubnet(req, net.ParseIP("203.0.113.45"))
+	assert.Nil(t, req.IsEdns0())
+
+	defer setConfig(func(cfg *config) { cfg.EDNSClientSubnet = true })()
+
+	setClientSubnet(req, net.ParseIP("203.0.113.45"))
+	subnet := clientSubnetOf(req)
+	assert.NotNil(t, subnet)
+	assert.Equal(t, uint16(1), subnet.Family)
+	assert.Equal(t, uint8(24), subnet.SourceNetmask)
+	assert.Equal(t, "203.0.113.0", subnet.Address.String())
+
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	setClientSubnet(req, net.ParseIP("2001:db8:abcd:12ff::1"))
+	subnet = clientSubnetOf(req)
+	assert.NotNil(t, subnet)
+	assert.Equal(t, uint16(2), subnet.Family)
+	assert.Equal(t, uint8(56), subnet.SourceNetmask)
+	assert.Equal(t, "2001:db8:abcd:1200::", subnet.Address.String())
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "::1", "fd00::1"} {
+		req = new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		setClientSubnet(req, net.ParseIP(ip))
+		assert.Nil(t, clientSubnetOf(req), ip)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 32,
+		Address:       net.ParseIP("198.51.100.77").To4(),
+	})
+
+	setClientSubnet(req, net.ParseIP("127.0.0.1"))
+	subnet = clientSubnetOf(req)
+	assert.NotNil(t, subnet)
+	assert.Equal(t, uint8(24), subnet.SourceNetmask)
+	assert.Equal(t, "198.51.100.0", subnet.Address.String())
+	assert.Len(t, opt.Option, 1)
+
+	subnet.Address = net.ParseIP("10.0.0.1").To4()
+	setClientSubnet(req, net.ParseIP("203.0.113.45"))
+	assert.Nil(t, clientSubnetOf(req))
+
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:   dns.EDNS0SUBNET,
+		Family: 1,
+	})
+	setClientSubnet(req, net.ParseIP("203.0.113.45"))
+	subnet = clientSubnetOf(req)
+	assert.NotNil(t, subnet)
+	assert.Equal(t, uint8(0), subnet.SourceNetmask)
+}
+
+func Test_subnetKey(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.EDNSClientSubnet = true
+		cfg.ECSPrefix = 24
+	})()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	key := cache.Hash(req.Question[0])
+	assert.Equal(t, key, subnetKey(key, req))
+
+	req1 := req.Copy()
+	setClientSubnet(req1, net.ParseIP("203.0.113.45"))
+
+	req2 := req.Copy()
+	setClientSubnet(req2, net.ParseIP("203.0.113.99"))
+
+	req3 := req.Copy()
+	setClientSubnet(req3, net.ParseIP("198.51.100.1"))
+
+	assert.NotEqual(t, key, subnetKey(key, req1))
+	assert.Equal(t, subnetKey(key, req1), subnetKey(key, req2))
+	assert.NotEqual(t, subnetKey(key, req1), subnetKey(key, req3))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+// edeOption is the extended DNS error option code, the vendored dns package
+// has no type of it
+const edeOption = 15
+
+// The extended DNS error info codes (RFC 8914)
+const (
+	edeOther                = 0
+	edeStaleAnswer          = 3
+	edeForgedAnswer         = 4
+	edeDNSSECIndeterminate  = 5
+	edeDNSSECBogus          = 6
+	edeNSECMissing          = 12
+	edeCachedError          = 13
+	edeBlocked              = 15
+	edeProhibited           = 18
+	edeNotAuthoritative     = 20
+	edeNoReachableAuthority = 22
+	edeNetworkError         = 23
+)
+
+// bogusError is the DNSSEC validation failure of a resolution
+type bogusError struct {
+	err error
+}
+
+func (e *bogusError) Error() string {
+	return e.err.Error()
+}
+
+// resolveErrorCode returns the extended error info code of the failed resolution
+func resolveErrorCode(err error) uint16 {
+	var bogusErr *bogusError
+	if errors.As(err, &bogusErr) {
+		return edeDNSSECBogus
+	}
+
+	if err == errNoReachableAuthority || err == errUpstreamGroup || err == errForwardZone ||
+		err == errNoFamilyServers || err == cache.ErrFlightTimeout {
+		return edeNoReachableAuthority
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return edeNoReachableAuthority
+		}
+
+		return edeNetworkError
+	}
+
+	return edeOther
+}
+
+// setExtendedError adds the extended error of the info code and the extra
+// text to the response if the extended errors enabled
+func setExtendedError(msg *dns.Msg, code uint16, text string) *dns.Msg {
+	if !Config().ExtendedErrors {
+		return msg
+	}
+
+	return addExtendedError(msg, code, text)
+}
+
+// addExtendedError adds the extended error of the info code and the extra
+// text to the OPT record of the response, the OPT record copied since it
+// shared with the request. The responses without EDNS left as is.
+func addExtendedError(msg *dns.Msg, code uint16, text string) *dns.Msg {
+	for i, rr := range msg.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+
+		o := &dns.OPT{Hdr: opt.Hdr}
+		for _, option := range opt.Option {
+			if option.Option() != edeOption {
+				o.Option = append(o.Option, option)
+			}
+		}
+
+		data := make([]byte, 2, 2+len(text))
+		binary.BigEndian.PutUint16(data, code)
+		data = append(data, text...)
+
+		o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: edeOption, Data: data})
+
+		extra := make([]dns.RR, len(msg.Extra))
+		copy(extra, msg.Extra)
+		extra[i] = o
+
+		msg.Extra = extra
+	}
+
+	return msg
+}
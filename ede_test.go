@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// extendedError returns the extended error info code and extra text of the response
+func extendedError(msg *dns.Msg) (uint16, string, bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return 0, "", false
+	}
+
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == edeOption && len(local.Data) >= 2 {
+			return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+		}
+	}
+
+	return 0, "", false
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_resolveErrorCode(t *testing.T) {
+	assert.Equal(t, uint16(edeDNSSECBogus), resolveErrorCode(&bogusError{errDSRecords}))
+	assert.Equal(t, uint16(edeNoReachableAuthority), resolveErrorCode(errNoReachableAuthority))
+	assert.Equal(t, uint16(edeNoReachableAuthority), resolveErrorCode(&net.OpError{Op: "read", Net: "udp", Err: timeoutError{}}))
+	assert.Equal(t, uint16(edeNetworkError), resolveErrorCode(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}))
+	assert.Equal(t, uint16(edeOther), resolveErrorCode(errMaxDepth))
+}
+
+func Test_setExtendedError(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeServerFailure)
+	msg.Extra = req.Extra
+
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = false })()
+	_, _, ok := extendedError(setExtendedError(msg, edeDNSSECBogus, "bogus"))
+	assert.False(t, ok)
+
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+	code, text, ok := extendedError(setExtendedError(msg, edeDNSSECBogus, "bogus"))
+	assert.True(t, ok)
+	assert.Equal(t, uint16(edeDNSSECBogus), code)
+	assert.Equal(t, "bogus", text)
+
+	// the shared OPT record of the request left as is
+	assert.Len(t, req.IsEdns0().Option, 0)
+
+	// the option packed and unpacked alike
+	buf, err := msg.Pack()
+	assert.NoError(t, err)
+
+	resp := new(dns.Msg)
+	assert.NoError(t, resp.Unpack(buf))
+
+	code, _, ok = extendedError(resp)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(edeDNSSECBogus), code)
+
+	// the responses without EDNS left as is
+	plain := new(dns.Msg)
+	plain.SetRcode(req, dns.RcodeServerFailure)
+	assert.Len(t, setExtendedError(plain, edeOther, "").Extra, 0)
+}
+
+func Test_HandlerExtendedErrors(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "ede.internal", Servers: []string{"127.0.0.1:1"}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	BlockList.Set("blocked.ede.internal.")
+	defer BlockList.Remove("blocked.ede.internal.")
+
+	handler := NewHandler()
+
+	query := func(name string, rd bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(DefaultMsgSize, false)
+		req.RecursionDesired = rd
+
+		return handler.query("udp", req)
+	}
+
+	for _, tt := range []struct {
+		name string
+		rd   bool
+		code uint16
+	}{
+		{"blocked.ede.internal.", true, edeBlocked},
+		{"host.ede.internal.", false, edeNotAuthoritative},
+		{"host.ede.internal.", true, edeNetworkError},
+		{"host.ede.internal.", true, edeCachedError},
+	} {
+		resp := query(tt.name, tt.rd)
+
+		code, _, ok := extendedError(resp)
+		assert.True(t, ok, tt.name)
+		assert.Equal(t, tt.code, code, tt.name)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The cache statuses of the client queries
+const (
+	statusMiss    = "miss"
+	statusHit     = "hit"
+	statusStale   = "stale"
+	statusBlocked = "blocked"
+	statusLocal   = "local"
+	statusPolicy  = "policy"
+)
+
+// queryEvent follows a client query until its response, the finished query
+// passed to the metrics, the dnstap writer, the query log stream and the query
+// log file
+type queryEvent struct {
+	tap   *clientTap
+	entry *AccessEntry
+
+	start  time.Time
+	proto  string
+	client string
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// newQueryEvent must be called before the query, the handler modifies the request
+func newQueryEvent(proto, remoteAddr string, req *dns.Msg, entry ...*AccessEntry) *queryEvent {
+	e := &queryEvent{
+		tap:    newClientTap(proto, remoteAddr, req),
+		start:  time.Now(),
+		proto:  proto,
+		client: remoteAddr,
+	}
+
+	if len(req.Question) > 0 {
+		e.name = req.Question[0].Name
+		e.qtype = req.Question[0].Qtype
+		e.qclass = req.Question[0].Qclass
+	}
+
+	if len(entry) > 0 {
+		e.entry = entry[0]
+	}
+
+	countQuery(req)
+
+	return e
+}
+
+// Done records the response of the query with its cache status
+func (e *queryEvent) Done(msg *dns.Msg, status string) {
+	e.tap.Done(msg)
+
+	queryLogs.publish(e, msg, status)
+
+	writeQueryLog(e, msg, status)
+}
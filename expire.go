@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/middleware"
+)
+
+// expireKey marks the SOA queries asking for the zone expire timer
+const expireKey = "edns.expire"
+
+// requestsExpire reports the SOA request asks for the expire timer of the zone
+// (RFC 7314) and the option passed through, callers must check it before the
+// query, the handler strips the request options
+func requestsExpire(req *dns.Msg) bool {
+	if !Config().EDNSExpire || len(req.Question) == 0 || req.Question[0].Qtype != dns.TypeSOA {
+		return false
+	}
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0EXPIRE {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expireRequested reports whether the query marked for the expire timer
+func expireRequested(req *middleware.Request) bool {
+	v, _ := req.Get(expireKey)
+	expire, _ := v.(bool)
+
+	return expire
+}
+
+// expireOption returns the expire option of the upstream answer, nil if none.
+// The empty options of the requests not returned.
+func expireOption(msg *dns.Msg) *dns.EDNS0_LOCAL {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_LOCAL); ok && e.Code == dns.EDNS0EXPIRE && len(e.Data) == 4 {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// withExpire returns a copy of the OPT record with the expire option
+func withExpire(opt *dns.OPT, expire *dns.EDNS0_LOCAL) *dns.OPT {
+	o := &dns.OPT{Hdr: opt.Hdr}
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0EXPIRE {
+			o.Option = append(o.Option, option)
+		}
+	}
+
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE, Data: expire.Data})
+
+	return o
+}
+
+// expireAnswer resolves the SOA query with the expire option, the answers not
+// cached since the timer counts down. The expire timer of the upstream answer
+// passed to the client.
+func (h *DNSHandler) expireAnswer(r *middleware.Request, resolverProto, upstream string, passthru bool) (*dns.Msg, string) {
+	proto, req, opt, dsReq := r.Proto, r.Msg, r.OPT, r.DO
+
+	expireReq := req.Copy()
+	o := expireReq.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE})
+
+	mesg, err := h.resolve(resolverProto, expireReq, upstream)
+	if err == nil && mesg.Truncated && resolverProto == "udp" {
+		mesg, err = h.resolve("tcp", expireReq, upstream)
+	}
+
+	if err != nil {
+		log.Warn("Resolve query failed", "query", formatQuestion(req.Question[0]), "error", err.Error())
+
+		return setExtendedError(h.handleFailed(req, dns.RcodeServerFailure, dsReq), resolveErrorCode(err), ""), statusMiss
+	}
+
+	expire := expireOption(mesg)
+
+	msg := new(dns.Msg)
+	*msg = *mesg
+
+	msg.Id = req.Id
+
+	if !dsReq {
+		msg = clearDNSSEC(msg)
+	}
+
+	msg = clearOPT(msg)
+
+	opt.SetDo(dsReq)
+	if expire != nil {
+		opt = withExpire(opt, expire)
+
+		log.Debug("Upstream expire timer passed", "query", formatQuestion(req.Question[0]), "expire", binary.BigEndian.Uint32(expire.Data))
+	}
+
+	msg.Extra = append(msg.Extra, opt)
+
+	return h.responsePolicy(proto, req, msg, opt, dsReq, passthru, statusMiss)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EDNSExpire(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.EDNSExpire = true })()
+
+	var mu sync.Mutex
+	calls, asked := 0, false
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		calls++
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		rr, _ := dns.NewRR("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+		m.Answer = append(m.Answer, rr)
+
+		m.SetEdns0(DefaultMsgSize, false)
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_LOCAL); ok && e.Code == dns.EDNS0EXPIRE {
+					asked = len(e.Data) == 0
+					m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE, Data: []byte{0, 0, 0x0e, 0x10}})
+				}
+			}
+		}
+		mu.Unlock()
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"expire": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "expire")
+
+	query := func(qtype uint16, option bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qtype)
+		req.RecursionDesired = true
+		req.SetEdns0(DefaultMsgSize, false)
+
+		if option {
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE})
+		}
+
+		return handler.query("udp", req, entry)
+	}
+
+	expire := func(msg *dns.Msg) *dns.EDNS0_LOCAL {
+		for _, o := range msg.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_LOCAL); ok && e.Code == dns.EDNS0EXPIRE {
+				return e
+			}
+		}
+
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := query(dns.TypeSOA, true)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+
+		e := expire(resp)
+		if assert.NotNil(t, e) {
+			assert.Equal(t, []byte{0, 0, 0x0e, 0x10}, e.Data)
+		}
+	}
+
+	mu.Lock()
+	assert.True(t, asked)
+	// the expire queries never cached
+	assert.Equal(t, 2, calls)
+	asked = false
+	mu.Unlock()
+
+	// the option not forwarded without asked and for the other types
+	resp := query(dns.TypeSOA, false)
+	assert.Nil(t, expire(resp))
+
+	resp = query(dns.TypeA, true)
+	assert.Nil(t, expire(resp))
+
+	// the option ignored while disabled
+	defer setConfig(func(cfg *config) { cfg.EDNSExpire = false })()
+
+	handler = NewHandler()
+	resp = query(dns.TypeSOA, true)
+	assert.Nil(t, expire(resp))
+
+	mu.Lock()
+	assert.False(t, asked)
+	mu.Unlock()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	forwardPlain = "plain"
+	forwardTLS   = "tls"
+)
+
+var (
+	forwardZones   = map[string]*forwarder{}
+	forwardZonesMu sync.RWMutex
+
+	errForwardZone = errors.New("forward zone has no servers")
+)
+
+type forwardZone struct {
+	Zone          string
+	Servers       []string
+	Protocol      string
+	TLSServerName string
+}
+
+// forwarder sends the queries of a zone to its servers
+type forwarder struct {
+	zone      string
+	protocol  string
+	tlsConfig *tls.Config
+	servers   *cache.AuthServers
+}
+
+// newForwardZones returns the forwarders by the lower case fqdn of the zones
+func newForwardZones(zones []forwardZone) (map[string]*forwarder, error) {
+	list := make(map[string]*forwarder)
+
+	for _, z := range zones {
+		if z.Zone == "" || len(z.Servers) == 0 {
+			return nil, fmt.Errorf("forward zone invalid: %q", z.Zone)
+		}
+
+		f := &forwarder{
+			zone:     dns.Fqdn(strings.ToLower(z.Zone)),
+			protocol: strings.ToLower(z.Protocol),
+			servers:  &cache.AuthServers{List: newAuthServers(z.Servers)},
+		}
+
+		switch f.protocol {
+		case "", forwardPlain:
+			f.protocol = forwardPlain
+		case forwardTLS:
+			serverName := z.TLSServerName
+			if serverName == "" {
+				serverName, _, _ = net.SplitHostPort(z.Servers[0])
+			}
+
+			f.tlsConfig = &tls.Config{ServerName: serverName}
+		default:
+			return nil, fmt.Errorf("forward zone protocol unknown: %s", z.Protocol)
+		}
+
+		list[f.zone] = f
+	}
+
+	return list, nil
+}
+
+// matchForwardZone returns the forwarder of the longest zone suffix of the name
+func matchForwardZone(name string) *forwarder {
+	forwardZonesMu.RLock()
+	defer forwardZonesMu.RUnlock()
+
+	if len(forwardZones) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if f, ok := forwardZones[name[off:]]; ok {
+			return f
+		}
+	}
+
+	return forwardZones["."]
+}
+
+// forwardZone sends the request to the servers of the forward zone
+func (h *DNSHandler) forwardZone(proto string, req *dns.Msg, f *forwarder) (*dns.Msg, error) {
+	if len(f.servers.List) == 0 {
+		return nil, errForwardZone
+	}
+
+	if f.protocol == forwardTLS {
+		proto = "tcp-tls"
+	}
+
+	c := h.r.newClient(proto)
+	c.TLSConfig = f.tlsConfig
+
+	resp, err := h.r.lookupClient(c, req, f.servers)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.RecursionAvailable = true
+	resp.Authoritative = false
+
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newForwardZones(t *testing.T) {
+	zones, err := newForwardZones([]forwardZone{
+		{Zone: "Corp.Internal", Servers: []string{"10.0.0.53:53"}},
+		{Zone: "example.org.", Servers: []string{"192.0.2.53:853"}, Protocol: "TLS"},
+		{Zone: "secure.example.org", Servers: []string{"192.0.2.54:853"}, Protocol: "tls", TLSServerName: "dns.example.org"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, zones, 3)
+
+	f := zones["corp.internal."]
+	assert.NotNil(t, f)
+	assert.Equal(t, forwardPlain, f.protocol)
+	assert.Nil(t, f.tlsConfig)
+
+	assert.Equal(t, forwardTLS, zones["example.org."].protocol)
+	assert.Equal(t, "192.0.2.53", zones["example.org."].tlsConfig.ServerName)
+	assert.Equal(t, "dns.example.org", zones["secure.example.org."].tlsConfig.ServerName)
+
+	_, err = newForwardZones([]forwardZone{{Zone: "corp.internal"}})
+	assert.Error(t, err)
+
+	_, err = newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{"10.0.0.53:53"}, Protocol: "quic"}})
+	assert.Error(t, err)
+}
+
+func Test_matchForwardZone(t *testing.T) {
+	zones, err := newForwardZones([]forwardZone{
+		{Zone: "corp.internal", Servers: []string{"10.0.0.53:53"}},
+		{Zone: "lab.corp.internal", Servers: []string{"10.1.0.53:53"}},
+	})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	assert.Equal(t, "corp.internal.", matchForwardZone("corp.internal.").zone)
+	assert.Equal(t, "corp.internal.", matchForwardZone("WWW.Corp.Internal.").zone)
+	assert.Equal(t, "lab.corp.internal.", matchForwardZone("host.lab.corp.internal.").zone)
+	assert.Nil(t, matchForwardZone("notcorp.internal."))
+	assert.Nil(t, matchForwardZone("example.com."))
+}
+
+func Test_HandlerForwardZone(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.AuthenticatedData = true
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.corp.internal.", dns.TypeA)
+	req.RecursionDesired = true
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.RecursionAvailable)
+	assert.False(t, resp.Authoritative)
+	assert.False(t, resp.AuthenticatedData)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+}
@@ -1,30 +1,60 @@
 module github.com/semihalev/sdns
 
+go 1.21
+
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/bsm/ratelimit v2.0.0+incompatible
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gin-contrib/pprof v0.0.0-20180827024024-a27513940d36
-	github.com/gin-contrib/sse v0.0.0-20170109093832-22d885f9ecc7 // indirect
 	github.com/gin-gonic/gin v1.3.0
-	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/jonboulle/clockwork v0.1.0
+	github.com/miekg/dns v1.0.14-0.20181015071231-17c1bc6792fd
+	github.com/prometheus/client_golang v0.9.0
+	github.com/quic-go/quic-go v0.42.0
+	github.com/semihalev/log v0.0.0-20180629090546-6475db4d55c6
+	github.com/stretchr/testify v1.6.1
+	github.com/yl2chen/cidranger v0.0.0-20180214081945-928b519e5268
+	golang.org/x/sys v0.8.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/gin-contrib/cors.v1 v1.0.0-20170318125340-cf4846e6a636
+)
+
+require (
+	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gin-contrib/sse v0.0.0-20170109093832-22d885f9ecc7 // indirect
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.5 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
 	github.com/mattn/go-colorable v0.0.9 // indirect
 	github.com/mattn/go-isatty v0.0.4 // indirect
-	github.com/miekg/dns v1.0.14-0.20181015071231-17c1bc6792fd
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
-	github.com/onsi/gomega v1.4.2 // indirect
+	github.com/onsi/ginkgo v1.6.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/semihalev/log v0.0.0-20180629090546-6475db4d55c6
-	github.com/stretchr/testify v1.2.2
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910 // indirect
+	github.com/prometheus/common v0.0.0-20181020173914-7e9e6cabbd39 // indirect
+	github.com/prometheus/procfs v0.0.0-20181005140218-185b4288413d // indirect
 	github.com/ugorji/go v1.1.1 // indirect
-	github.com/yl2chen/cidranger v0.0.0-20180214081945-928b519e5268
-	golang.org/x/crypto v0.0.0-20181001203147-e3636079e1a4 // indirect
-	golang.org/x/net v0.0.0-20181004194319-68fc911561ed // indirect
-	golang.org/x/sys v0.0.0-20181004145325-8469e314837c // indirect
-	gopkg.in/gin-contrib/cors.v1 v1.0.0-20170318125340-cf4846e6a636
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v2 v2.2.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
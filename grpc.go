@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/dnspb"
+	"github.com/semihalev/sdns/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// GRPCMaxConcurrentStreams limits the concurrent calls of a gRPC connection,
+	// the client waits for a call to finish before starting another one
+	GRPCMaxConcurrentStreams uint32 = 256
+
+	// GRPCStreamQueries limits the queries of a gRPC stream resolving at once,
+	// the stream not read more until one of them answered
+	GRPCStreamQueries = 64
+)
+
+// grpcService serves the DNS queries of the gRPC clients
+type grpcService struct {
+	dnspb.UnimplementedDnsServiceServer
+
+	handler *DNSHandler
+}
+
+// Resolve answers a single query
+func (s *grpcService) Resolve(ctx context.Context, in *dnspb.DnsRequest) (*dnspb.DnsResponse, error) {
+	remoteAddr, entry, err := grpcAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.handler.begin()
+	defer s.handler.end()
+
+	return s.handler.resolveGRPC(remoteAddr, entry, in.GetMessage())
+}
+
+// Stream answers the queries of the stream as they resolved, the malformed
+// queries and the dropped ones not answered
+func (s *grpcService) Stream(stream dnspb.DnsService_StreamServer) error {
+	remoteAddr, entry, err := grpcAccess(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sendMu  sync.Mutex
+		sendErr error
+	)
+
+	sem := make(chan struct{}, GRPCStreamQueries)
+
+	for {
+		in, err := stream.Recv()
+		if err != nil {
+			wg.Wait()
+
+			if err == io.EOF {
+				err = nil
+			}
+
+			sendMu.Lock()
+			if sendErr != nil {
+				err = sendErr
+			}
+			sendMu.Unlock()
+
+			return err
+		}
+
+		sem <- struct{}{}
+
+		wg.Add(1)
+		s.handler.begin()
+
+		go func(buf []byte) {
+			defer func() {
+				s.handler.end()
+				<-sem
+				wg.Done()
+			}()
+
+			resp, err := s.handler.resolveGRPC(remoteAddr, entry, buf)
+			if err != nil {
+				return
+			}
+
+			sendMu.Lock()
+			defer sendMu.Unlock()
+
+			if sendErr != nil {
+				return
+			}
+
+			if err := stream.Send(resp); err != nil {
+				sendErr = err
+			}
+		}(in.GetMessage())
+	}
+}
+
+// grpcAccess returns the remote address and the access entry of the peer
+func grpcAccess(ctx context.Context) (string, *AccessEntry, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", nil, status.Error(codes.Internal, "peer address missing")
+	}
+
+	remoteAddr := p.Addr.String()
+	client, _, _ := net.SplitHostPort(remoteAddr)
+
+	entry := accessEntry(client, listenerGRPC)
+	if entry == nil || entry.Action == ActionDeny {
+		switch countAccessDenied(entry, client, "grpc") {
+		case accessDeniedDrop:
+			// the call can not end without a status, answered like a server
+			// not serving
+			return "", nil, status.Error(codes.Unavailable, "")
+		case accessDeniedEDE:
+			return "", nil, status.Error(codes.PermissionDenied, "access denied")
+		default:
+			return "", nil, status.Error(codes.PermissionDenied, "client denied")
+		}
+	}
+
+	return remoteAddr, entry, nil
+}
+
+// resolveGRPC answers the wire format query like the DNS-over-HTTPS POST requests
+func (h *DNSHandler) resolveGRPC(remoteAddr string, entry *AccessEntry, buf []byte) (*dnspb.DnsResponse, error) {
+	client, _, _ := net.SplitHostPort(remoteAddr)
+
+	// like the https queries only the hard cap applied
+	if !entry.NoRateLimit && limitClient(client, listenerGRPC) == cache.LimitDrop {
+		metrics.RateLimited.WithLabelValues("drop").Inc()
+		log.Debug("Client query dropped by rate limit", "client", client, "net", "grpc")
+
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+
+	release, ok := currentQueryLimiter().acquire("tcp")
+	if !ok {
+		countOverloaded(client, "grpc")
+
+		return nil, status.Error(codes.ResourceExhausted, "too many queries")
+	}
+	defer release()
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || len(req.Question) == 0 {
+		log.Debug("Client sent malformed query", "addr", remoteAddr, "net", "grpc")
+		return nil, status.Error(codes.InvalidArgument, "malformed query")
+	}
+
+	event := newQueryEvent("grpc", remoteAddr, req, entry)
+
+	setClientSubnet(req, net.ParseIP(client))
+
+	pad := shouldPad(req)
+
+	msg, st := h.queryStatus("https", req, entry)
+
+	event.Done(msg, st)
+
+	if msg == nil {
+		// dropped by the response policy
+		return nil, status.Error(codes.Unavailable, "query dropped")
+	}
+
+	if pad {
+		padMsg(msg, Config().PaddingBlockSize)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		log.Warn("Pack message failed", "net", "grpc", "error", err.Error())
+		return nil, status.Error(codes.Internal, "pack message failed")
+	}
+
+	return &dnspb.DnsResponse{Message: packed}, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/dnspb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func Test_serverGRPC(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	s := &Server{
+		grpcHost:       "127.0.0.1:0",
+		tlsCertificate: "test.cert",
+		tlsPrivateKey:  "test.key",
+	}
+
+	s.handler = NewHandler()
+	assert.NoError(t, s.runGRPC(s.grpcHost))
+	defer s.grpcServer.Stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion("grpc.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, err := dns.NewRR("grpc.example.com. 10 IN A 127.0.0.1")
+	assert.NoError(t, err)
+	m.Answer = append(m.Answer, rr)
+
+	s.handler.r.Qcache.Set(cache.Hash(req.Question[0], req.CheckingDisabled), m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+
+	conn, err := grpc.DialContext(ctx, s.grpcAddr, grpc.WithTransportCredentials(creds))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	client := dnspb.NewDnsServiceClient(conn)
+
+	packed, err := req.Pack()
+	assert.NoError(t, err)
+
+	out, err := client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.NoError(t, err)
+
+	resp := new(dns.Msg)
+	assert.NoError(t, resp.Unpack(out.GetMessage()))
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+
+	// malformed query
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: []byte{0}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the stream answers the valid queries only
+	stream, err := client.Stream(ctx)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		req.Id = uint16(i + 1)
+		packed, err := req.Pack()
+		assert.NoError(t, err)
+
+		assert.NoError(t, stream.Send(&dnspb.DnsRequest{Message: packed}))
+	}
+	assert.NoError(t, stream.Send(&dnspb.DnsRequest{Message: []byte{0}}))
+	assert.NoError(t, stream.CloseSend())
+
+	ids := map[uint16]bool{}
+	for {
+		out, err := stream.Recv()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+
+		resp := new(dns.Msg)
+		assert.NoError(t, resp.Unpack(out.GetMessage()))
+		assert.Len(t, resp.Answer, 1)
+		ids[resp.Id] = true
+	}
+	assert.Equal(t, map[uint16]bool{1: true, 2: true, 3: true}, ids)
+
+	// the queries over the rate limit of the listener refused
+	setListenerPolicies(t, map[string]listenerConfig{listenerGRPC: {ClientRateLimit: 1, ClientRateLimitHard: 1}})
+	defer setListenerPolicies(t, nil)
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.NoError(t, err)
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	setListenerPolicies(t, nil)
+
+	// the queries over the concurrency limit refused
+	defer func() {
+		setupQueryLimiter(Config())
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.MaxConcurrentQueries = 1 })()
+	setupQueryLimiter(Config())
+
+	release, ok := currentQueryLimiter().acquire("tcp")
+	assert.True(t, ok)
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	release()
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.NoError(t, err)
+
+	// the access list applied by the peer address
+	ranger, err := newAccessList([]string{"10.0.0.0/8"}, nil, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedRefused })()
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the dropped calls answered like a server not serving, counted too
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedDrop })()
+
+	before := accessDeniedCount(accessDeniedDrop)
+
+	_, err = client.Resolve(ctx, &dnspb.DnsRequest{Message: packed})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.NotEqual(t, before, accessDeniedCount(accessDeniedDrop))
+}
@@ -1,23 +1,43 @@
 package main
 
 import (
+	"context"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
 	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/semihalev/sdns/middleware"
+	"github.com/semihalev/sdns/rpz"
 )
 
 const (
 	// DefaultMsgSize EDNS0 message size
 	DefaultMsgSize = 1536
+
+	// staleTTL is the TTL of stale answers
+	staleTTL = 30
 )
 
 // DNSHandler type
 type DNSHandler struct {
 	r *Resolver
+
+	mu         sync.Mutex
+	refreshing map[uint64]struct{}
+
+	// refreshes waits for the background refreshes in progress
+	refreshes sync.WaitGroup
+
+	// active counts the client queries in progress
+	active int64
 }
 
 var debugns bool
@@ -29,43 +49,222 @@ func init() {
 // NewHandler returns a new DNSHandler
 func NewHandler() *DNSHandler {
 	return &DNSHandler{
-		r: NewResolver(),
+		r:          NewResolver(),
+		refreshing: make(map[uint64]struct{}),
 	}
 }
 
 // TCP begins a tcp query
 func (h *DNSHandler) TCP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.handle("tcp", w, req)
+	h.serve("tcp", listenerDNS, w, req)
 }
 
 // UDP begins a udp query
 func (h *DNSHandler) UDP(w dns.ResponseWriter, req *dns.Msg) {
-	go h.handle("udp", w, req)
+	h.serve("udp", listenerDNS, w, req)
+}
+
+// TLS begins a tls query, a tcp query by the access policy of the tls
+// listener
+func (h *DNSHandler) TLS(w dns.ResponseWriter, req *dns.Msg) {
+	h.serve("tcp", listenerTLS, w, req)
+}
+
+func (h *DNSHandler) serve(proto, listener string, w dns.ResponseWriter, req *dns.Msg) {
+	release, ok := currentQueryLimiter().acquire(proto)
+	if !ok {
+		h.overloaded(proto, w, req)
+		return
+	}
+
+	h.begin()
+	go func() {
+		defer h.end()
+		defer release()
+
+		h.handle(proto, w, req, listener)
+	}()
+}
+
+func (h *DNSHandler) begin() {
+	atomic.AddInt64(&h.active, 1)
+	atomic.AddInt64(&stats.inflight, 1)
+}
+
+func (h *DNSHandler) end() {
+	atomic.AddInt64(&h.active, -1)
+	atomic.AddInt64(&stats.inflight, -1)
+}
+
+// wait waits for the active client queries until the context done
+func (h *DNSHandler) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&h.active) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
 }
 
-func (h *DNSHandler) handle(proto string, w dns.ResponseWriter, req *dns.Msg) {
-	client, _, _ := net.SplitHostPort(h.remoteAddr(w))
-	allowed, _ := AccessList.Contains(net.ParseIP(client))
+// handle answers the query by the access policy of the listener if given,
+// the global policy otherwise
+func (h *DNSHandler) handle(proto string, w dns.ResponseWriter, req *dns.Msg, listener ...string) {
+	remoteAddr := h.remoteAddr(w)
+	client, _, _ := net.SplitHostPort(remoteAddr)
 
-	if !allowed {
-		log.Debug("Client denied to make new query", "client", client, "net", proto)
+	entry := accessEntry(client, listener...)
+	if entry == nil || entry.Action == ActionDeny {
+		h.accessDenied(proto, w, req, entry, client)
 		return
 	}
 
-	msg := h.query(proto, req)
+	ip := net.ParseIP(client)
+
+	var cookie *cookieState
+	if Config().Cookies {
+		var err error
+		if cookie, err = parseCookie(req, ip); err != nil {
+			log.Debug("Client cookie malformed", "client", client, "net", proto)
+
+			h.writeReplyMsg(w, h.handleFailed(req, dns.RcodeFormatError, false))
+			return
+		}
+	}
+
+	// clients sent a valid server cookie are not spoofed
+	if cookie != nil && cookie.valid && !entry.NoRateLimit {
+		e := *entry
+		e.NoRateLimit = true
+		entry = &e
+	}
+
+	if !entry.NoRateLimit {
+		switch limitClient(client, listener...) {
+		case cache.LimitDrop:
+			metrics.RateLimited.WithLabelValues("drop").Inc()
+			log.Debug("Client query dropped by rate limit", "client", client, "net", proto)
+
+			if proto == "tcp" {
+				w.Close()
+			}
+			return
+		case cache.LimitSlip:
+			if proto == "udp" {
+				metrics.RateLimited.WithLabelValues("truncate").Inc()
+
+				msg := truncatedReply(req)
+				cookie.set(msg)
+
+				h.writeReplyMsg(w, msg)
+				return
+			}
+		}
+	}
+
+	event := newQueryEvent(proto, remoteAddr, req, entry)
+
+	setClientSubnet(req, ip)
+
+	msg, status := h.queryStatus(proto, req, entry)
+
+	cookie.set(msg)
+
+	event.Done(msg, status)
+
+	if msg == nil {
+		// dropped by the response policy
+		if proto == "tcp" {
+			w.Close()
+		}
+		return
+	}
 
 	h.writeReplyMsg(w, msg)
 }
 
-func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
+func countQuery(req *dns.Msg) {
+	if len(req.Question) == 0 {
+		return
+	}
+
+	metrics.Queries.Inc()
+	stats.query(time.Now())
+	metrics.QueriesByType.WithLabelValues(dns.Type(req.Question[0].Qtype).String()).Inc()
+}
+
+func (h *DNSHandler) query(proto string, req *dns.Msg, entry ...*AccessEntry) *dns.Msg {
+	msg, _ := h.queryStatus(proto, req, entry...)
+	return msg
+}
+
+// queryStatus returns the response and its cache status, the response is nil
+// when the query dropped by the response policy
+func (h *DNSHandler) queryStatus(proto string, req *dns.Msg, entry ...*AccessEntry) (*dns.Msg, string) {
+	nsid := requestsNSID(req)
+
+	var msg *dns.Msg
+	var status string
+
+	if rules := matchRewrites(req.Question[0].Name); rules != nil {
+		msg, status = h.rewriteQuery(proto, req, rules, entry...)
+	} else {
+		msg, status = h.lookupStatus(proto, req, entry...)
+	}
+
+	if msg != nil && Config().RoundRobin {
+		msg = roundRobin(msg)
+	}
+
+	// after the rotation, the rotated order kept within the same ranks
+	if msg != nil {
+		msg = sortAddresses(msg)
+	}
+
+	if msg != nil && Config().MinimalResponses {
+		msg = minimalResponse(msg)
+	}
+
+	if nsid && msg != nil {
+		msg = setNSID(msg)
+	}
+
+	return msg, status
+}
+
+// lookupStatus answers the query as asked, the rewrite rules applied by the caller
+func (h *DNSHandler) lookupStatus(proto string, req *dns.Msg, entry ...*AccessEntry) (*dns.Msg, string) {
 	q := req.Question[0]
 
+	upstream := ""
+	noRateLimit := false
+	var client net.IP
+	var aclEntry *AccessEntry
+	if len(entry) > 0 && entry[0] != nil {
+		aclEntry = entry[0]
+		noRateLimit = entry[0].NoRateLimit
+		client = entry[0].Client
+
+		switch entry[0].Action {
+		case ActionNoDNSSEC:
+			req.CheckingDisabled = true
+		case ActionUpstream:
+			upstream = entry[0].Upstream
+		}
+	}
+
 	resolverProto := proto
 	if proto == "https" {
 		resolverProto = "udp"
 	}
 
 	dsReq := false
+	expire := requestsExpire(req)
 
 	opt := req.IsEdns0()
 	if opt != nil {
@@ -75,7 +274,7 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 			opt.SetVersion(0)
 			opt.SetExtendedRcode(dns.RcodeBadVers)
 
-			return h.handleFailed(req, dns.RcodeBadVers, dsReq)
+			return h.handleFailed(req, dns.RcodeBadVers, dsReq), statusMiss
 		}
 
 		ops := opt.Option
@@ -102,8 +301,80 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 		req.Extra = append(req.Extra, opt)
 	}
 
-	if q.Qtype == dns.TypeANY {
-		return h.handleFailed(req, dns.RcodeNotImplemented, dsReq)
+	// the query types out of the policy refused before anything answered
+	if !qtypeAllowed(q.Qtype, aclEntry) {
+		log.Debug("Query type denied", "query", formatQuestion(q), "client", client)
+
+		return setExtendedError(h.handleFailed(req, dns.RcodeRefused, dsReq), edeProhibited, "query type denied"), statusLocal
+	}
+
+	// the identity queries never resolved or cached
+	if q.Qclass == dns.ClassCHAOS {
+		return h.chaos(req, opt, dsReq), statusLocal
+	}
+
+	// the liveness probes answered before the recursion, the cache and the blocklist
+	if q.Qclass == dns.ClassINET && isHealthCheckName(q.Name) {
+		msg := healthCheckReply(req)
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		if msg.Rcode == dns.RcodeServerFailure {
+			msg = setExtendedError(msg, edeNoReachableAuthority, "")
+		}
+
+		return msg, statusLocal
+	}
+
+	// the ANY queries answered without recursion (RFC 8482)
+	if q.Qtype == dns.TypeANY && Config().AnyQueryMode == anyRefuse {
+		msg := anyReply(req)
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		return msg, statusLocal
+	}
+
+	if msg := LocalHosts.Answer(req); msg != nil {
+		log.Debug("Found in hosts file", "query", formatQuestion(q))
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		return msg, statusLocal
+	}
+
+	if msg := LocalZones.Answer(req); msg != nil {
+		log.Debug("Found in local zone", "query", formatQuestion(q))
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		return msg, statusLocal
+	}
+
+	// the names of the sinkhole zone pointed at the block page server
+	if msg := sinkholeAnswer(req); msg != nil {
+		log.Debug("Answered in sinkhole zone", "query", formatQuestion(q))
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		return msg, statusLocal
+	}
+
+	// the reverse queries of the private networks never leave
+	if Config().BlockPrivateReverse {
+		if msg := privateReverseAnswer(req); msg != nil {
+			log.Debug("Answered in private reverse zone", "query", formatQuestion(q))
+
+			opt.SetDo(dsReq)
+			msg.Extra = append(msg.Extra, opt)
+
+			return msg, statusLocal
+		}
 	}
 
 	// debug ns information
@@ -130,7 +401,7 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 			}
 			rootservers.RUnlock()
 		} else {
-			nsKey := cache.Hash(dns.Question{Name: q.Name, Qtype: dns.TypeNS, Qclass: dns.ClassINET})
+			nsKey := ntaKey(cache.Hash(dns.Question{Name: q.Name, Qtype: dns.TypeNS, Qclass: dns.ClassINET}), q.Name, false)
 			ns, err := h.r.Ncache.Get(nsKey)
 			if err == nil {
 				rrHeader := dns.RR_Header{
@@ -149,27 +420,66 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 			}
 		}
 
-		return msg
+		return msg, statusMiss
 	}
 
 	if q.Name != rootzone && req.RecursionDesired == false {
-		return h.handleFailed(req, dns.RcodeServerFailure, dsReq)
+		return setExtendedError(h.handleFailed(req, dns.RcodeServerFailure, dsReq), edeNotAuthoritative, ""), statusMiss
+	}
+
+	request := &middleware.Request{Proto: proto, Msg: req, Client: client, OPT: opt, DO: dsReq}
+	if expire {
+		request.Set(expireKey, true)
 	}
 
+	currentQueryChain().Serve(context.Background(), request, middleware.HandlerFunc(func(ctx context.Context, r *middleware.Request) {
+		r.Write(h.resolveStatus(r, resolverProto, upstream, noRateLimit, entry...))
+	}))
+
+	return request.Response, request.Status
+}
+
+// resolveStatus answers the query passed through the middlewares from the
+// cache or by the recursion
+func (h *DNSHandler) resolveStatus(r *middleware.Request, resolverProto, upstream string, noRateLimit bool, entry ...*AccessEntry) (*dns.Msg, string) {
+	proto, req, opt, dsReq := r.Proto, r.Msg, r.OPT, r.DO
+	passthru := policyPassthru(r)
+
+	q := req.Question[0]
+
 	log.Debug("Lookup", "query", formatQuestion(q), "dsreq", dsReq)
 
-	key := cache.Hash(q, req.CheckingDisabled)
+	// the answers always resolved and cached with the signatures, the DO bit
+	// not in the key; the signatures stripped for the clients not asked them
+	key := subnetKey(cache.Hash(q, req.CheckingDisabled), req)
+	key = ntaKey(key, q.Name, req.CheckingDisabled)
+	if upstream != "" {
+		key = cache.HashScope(key, "upstream:"+upstream)
+	}
 
-	h.r.Lqueue.Wait(key)
+	// the expire timer counts down, never answered from the cache
+	if expireRequested(r) {
+		return h.expireAnswer(r, resolverProto, upstream, passthru)
+	}
 
 	mesg, rl, err := h.r.Qcache.Get(key, req)
 	if err == nil {
+		metrics.CacheHits.Inc()
+		atomic.AddInt64(&stats.cacheHits, 1)
+
 		log.Debug("Cache hit", "key", key, "query", formatQuestion(q))
 
-		if Config.RateLimit > 0 && rl.Limit() {
+		if Config().RateLimit > 0 && !noRateLimit && rl.Limit() {
 			log.Info("Query rate limited", "query", formatQuestion(q))
 
-			return h.handleFailed(req, dns.RcodeServerFailure, dsReq)
+			return h.handleFailed(req, dns.RcodeServerFailure, dsReq), statusMiss
+		}
+
+		if cfg := Config(); cfg.Prefetch && h.r.Qcache.NeedPrefetch(key, int64(cfg.PrefetchThreshold)) {
+			log.Debug("Prefetching cache entry", "key", key, "query", formatQuestion(q))
+
+			h.refreshes.Add(1)
+			go h.refresh(resolverProto, req.Copy(), key, upstream)
 		}
 
 		// we need this copy against concurrent modification of Id
@@ -177,7 +487,16 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 		*msg = *mesg
 
 		msg.Id = req.Id
-		msg = h.additionalAnswer(resolverProto, req, msg)
+
+		if msg, err = h.additionalAnswer(resolverProto, req, msg); err != nil {
+			log.Info("CNAME chain failed", "query", formatQuestion(q), "error", err.Error())
+
+			return setExtendedError(h.handleFailed(req, dns.RcodeServerFailure, dsReq), edeOther, err.Error()), statusMiss
+		}
+
+		msg = h.dns64Answer(resolverProto, req, msg, dsReq, upstream)
+		msg = h.svcbAnswer(resolverProto, req, msg, upstream)
+		msg = minimalAny(req, msg)
 
 		if !dsReq {
 			msg = clearDNSSEC(msg)
@@ -188,106 +507,321 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 		opt.SetDo(dsReq)
 		msg.Extra = append(msg.Extra, opt)
 
-		return msg
+		return h.responsePolicy(proto, req, msg, opt, dsReq, passthru, statusHit)
 	}
 
-	err = h.r.Ecache.Get(key)
-	if err == nil {
-		log.Debug("Error cache hit", "key", key, "query", formatQuestion(q))
+	if msg, err := h.r.Negcache.Get(key, req); err == nil {
+		metrics.CacheHits.Inc()
+		atomic.AddInt64(&stats.cacheHits, 1)
+
+		log.Debug("Negative cache hit", "key", key, "query", formatQuestion(q))
+
+		msg = h.dns64Answer(resolverProto, req, msg, dsReq, upstream)
 
-		return h.handleFailed(req, dns.RcodeServerFailure, dsReq)
+		if !dsReq {
+			msg = clearDNSSEC(msg)
+		}
+
+		msg = clearOPT(msg)
+
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
+
+		return h.responsePolicy(proto, req, msg, opt, dsReq, passthru, statusHit)
 	}
 
-	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		if BlockList.Exists(q.Name) {
-			m := new(dns.Msg)
-			m.SetReply(req)
+	if msg := h.nxdomainCut(req, upstream); msg != nil {
+		metrics.CacheHits.Inc()
+		atomic.AddInt64(&stats.cacheHits, 1)
 
-			nullroute := net.ParseIP(Config.Nullroute)
-			nullroutev6 := net.ParseIP(Config.Nullroutev6)
+		if !dsReq {
+			msg = clearDNSSEC(msg)
+		}
 
-			switch q.Qtype {
-			case dns.TypeA:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    Config.Expire,
-				}
-				a := &dns.A{Hdr: rrHeader, A: nullroute}
-				m.Answer = append(m.Answer, a)
-			case dns.TypeAAAA:
-				rrHeader := dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    Config.Expire,
-				}
-				a := &dns.AAAA{Hdr: rrHeader, AAAA: nullroutev6}
-				m.Answer = append(m.Answer, a)
-			}
+		msg = clearOPT(msg)
 
-			m.AuthenticatedData = true
-			m.Authoritative = false
-			m.RecursionAvailable = true
+		opt.SetDo(dsReq)
+		msg.Extra = append(msg.Extra, opt)
 
-			log.Debug("Found in blocklist", "name", q.Name)
+		return h.responsePolicy(proto, req, msg, opt, dsReq, passthru, statusHit)
+	}
 
-			h.r.Qcache.Set(key, m)
+	metrics.CacheMisses.Inc()
+	atomic.AddInt64(&stats.cacheMisses, 1)
 
-			return m
+	err = h.r.Ecache.Get(key)
+	if err == nil {
+		log.Debug("Error cache hit", "key", key, "query", formatQuestion(q))
+
+		if msg := h.serveStale(resolverProto, req, key, opt, dsReq, upstream); msg != nil {
+			return msg, statusStale
 		}
+
+		return setExtendedError(h.handleFailed(req, dns.RcodeServerFailure, dsReq), edeCachedError, ""), statusMiss
 	}
 
-	h.r.Lqueue.Add(key)
-	defer h.r.Lqueue.Done(key)
+	mesg, shared, err := h.r.Flight.Do(key, Config().Timeout.Duration, func() (*dns.Msg, error) {
+		return h.lookup(resolverProto, req, key, upstream)
+	})
+
+	// the truncated answer of a shared udp lookup resolved again
+	if err == nil && shared && mesg.Truncated && resolverProto == "tcp" {
+		mesg, err = h.lookup(resolverProto, req, key, upstream)
+	}
 
-	depth := Config.Maxdepth
-	mesg, err = h.r.Resolve(resolverProto, req, rootservers, true, depth, 0, false, nil)
 	if err != nil {
 		log.Warn("Resolve query failed", "query", formatQuestion(q), "error", err.Error())
 
-		h.r.Ecache.Set(key)
+		if msg := h.serveStale(resolverProto, req, key, opt, dsReq, upstream); msg != nil {
+			return msg, statusStale
+		}
+
+		msg := h.handleFailed(req, dns.RcodeServerFailure, dsReq)
 
-		return h.handleFailed(req, dns.RcodeServerFailure, dsReq)
+		// the validation failures and the recursion guards explained by the extra text
+		code := resolveErrorCode(err)
+		if code == edeDNSSECBogus || recursionGuarded(err) {
+			return setExtendedError(msg, code, err.Error()), statusMiss
+		}
+
+		return setExtendedError(msg, code, ""), statusMiss
+	}
+
+	if shared {
+		log.Debug("Shared lookup answered", "query", formatQuestion(q))
 	}
 
 	if mesg.Truncated && proto == "udp" {
-		return mesg
+		msg := new(dns.Msg)
+		*msg = *mesg
+		msg.Id = req.Id
+
+		return msg, statusMiss
 	} else if mesg.Truncated && proto == "https" {
 		opt.SetDo(dsReq)
 
-		h.r.Lqueue.Done(key)
-		return h.query("tcp", req)
+		return h.lookupStatus("tcp", req, entry...)
+	}
+
+	if mesg.Rcode != dns.RcodeSuccess &&
+		len(mesg.Answer) == 0 && len(mesg.Ns) == 0 {
+
+		return h.handleFailed(req, mesg.Rcode, dsReq), statusMiss
+	}
+
+	// the shared answer copied against concurrent modification of Id
+	msg := new(dns.Msg)
+	*msg = *mesg
+
+	msg.Id = req.Id
+
+	if msg, err = h.additionalAnswer(resolverProto, req, msg); err != nil {
+		log.Info("CNAME chain failed", "query", formatQuestion(q), "error", err.Error())
+
+		return setExtendedError(h.handleFailed(req, dns.RcodeServerFailure, dsReq), edeOther, err.Error()), statusMiss
+	}
+
+	msg = h.dns64Answer(resolverProto, req, msg, dsReq, upstream)
+	msg = h.svcbAnswer(resolverProto, req, msg, upstream)
+	msg = minimalAny(req, msg)
+
+	if !dsReq {
+		msg = clearDNSSEC(msg)
+	}
+
+	msg = clearOPT(msg)
+
+	opt.SetDo(dsReq)
+	msg.Extra = append(msg.Extra, opt)
+
+	return h.responsePolicy(proto, req, msg, opt, dsReq, passthru, statusMiss)
+}
+
+// lookup resolves the request and caches the answer of the key, the failed
+// lookups set into the error cache. The answer is shared with the concurrent
+// queries of the key, it not modified after the return. The answers of the
+// no-cache zones never cached.
+func (h *DNSHandler) lookup(proto string, req *dns.Msg, key uint64, upstream string) (*dns.Msg, error) {
+	h.r.Lqueue.Add(key)
+	defer h.r.Lqueue.Done(key)
+
+	noCache := noCacheName(req.Question[0].Name)
+
+	mesg, err := h.resolve(proto, req, upstream)
+	mesg, err = svcbFallback(req, mesg, err)
+	if err != nil {
+		if !noCache {
+			h.r.Ecache.Set(key)
+		}
+
+		return nil, err
+	}
+
+	if mesg.Truncated {
+		return mesg, nil
 	}
 
 	if mesg.Rcode == dns.RcodeSuccess &&
 		len(mesg.Answer) == 0 && len(mesg.Ns) == 0 {
 
-		rr, _ := dns.NewRR(req.Question[0].Name + " " + strconv.Itoa(int(Config.Expire)) +
+		rr, _ := dns.NewRR(req.Question[0].Name + " " + strconv.Itoa(int(Config().Expire)) +
 			" IN HINFO comment \"no answer found on authoritative server\"")
 		mesg.Ns = append(mesg.Ns, rr)
 	}
 
-	//ignore auths TTL for caching, replace with default expire
-	if mesg.Rcode == dns.RcodeNameError {
-		for _, rr := range mesg.Ns {
-			rr.Header().Ttl = Config.Expire
+	if mesg.Rcode != dns.RcodeSuccess &&
+		len(mesg.Answer) == 0 && len(mesg.Ns) == 0 {
+
+		if !noCache {
+			h.r.Ecache.Set(key)
 		}
+
+		return mesg, nil
 	}
 
-	if mesg.Rcode != dns.RcodeSuccess &&
-		len(mesg.Answer) == 0 && len(mesg.Ns) == 0 {
+	if noCache {
+		return mesg, nil
+	}
+
+	h.setCache(key, mesg, upstream)
 
-		h.r.Ecache.Set(key)
+	log.Debug("Set msg into cache", "query", formatQuestion(req.Question[0]))
 
-		return h.handleFailed(req, mesg.Rcode, dsReq)
+	return mesg, nil
+}
+
+// responsePolicy applies the blocked ip ranges, then the response-ip and
+// nsdname rules of the response policy to the answer
+func (h *DNSHandler) responsePolicy(proto string, req, msg *dns.Msg, opt *dns.OPT, dsReq, passthru bool, status string) (*dns.Msg, string) {
+	if ip := blockedAddress(req, msg); ip != nil {
+		return blockAddressReply(req, ip, opt, dsReq), statusBlocked
 	}
 
-	msg := new(dns.Msg)
-	*msg = *mesg
+	if passthru {
+		return msg, status
+	}
 
-	msg = h.additionalAnswer(resolverProto, req, msg)
+	var nsnames []string
+	if ResponsePolicy.HasNSDName() {
+		nsnames = h.r.nsNames(req.Question[0].Name, req.CheckingDisabled)
+	}
+
+	rule := ResponsePolicy.Response(msg, nsnames)
+	if rule == nil || rule.Action == rpz.Passthru || (rule.Action == rpz.TCPOnly && proto != "udp") {
+		return msg, status
+	}
+
+	return policyReply(req, rule, opt, dsReq)
+}
+
+// policyReply returns the answer of the response policy rule, nil for the
+// drop rules
+func policyReply(req *dns.Msg, rule *rpz.Rule, opt *dns.OPT, dsReq bool) (*dns.Msg, string) {
+	metrics.PolicyHits.WithLabelValues(rule.Trigger.String(), rule.Action.String()).Inc()
+
+	log.Debug("Found in response policy", "query", formatQuestion(req.Question[0]), "zone", rule.Zone,
+		"trigger", rule.Trigger.String(), "name", rule.Name, "action", rule.Action.String())
+
+	msg := rule.Reply(req)
+	if msg == nil {
+		return nil, statusPolicy
+	}
+
+	opt.SetDo(dsReq)
+	msg.Extra = append(msg.Extra, opt)
+
+	switch rule.Action {
+	case rpz.Local:
+		msg = setExtendedError(msg, edeForgedAnswer, "")
+	case rpz.NXDomain, rpz.NoData:
+		msg = setExtendedError(msg, edeBlocked, "")
+	}
+
+	return msg, statusPolicy
+}
+
+// setCache stores the answer into the query cache or the negative answer
+// into the negative cache, the entry of the key in the other cache removed.
+// The NXDOMAIN cut of the answer kept in the upstream scope if given.
+func (h *DNSHandler) setCache(key uint64, mesg *dns.Msg, upstream ...string) {
+	cfg := Config()
+
+	minTTL, maxTTL := cfg.MinTTL, cfg.MaxTTL
+
+	// the zone cache policy overrides the ttl bounds
+	var policy *cachePolicy
+	if len(mesg.Question) > 0 {
+		policy = matchCachePolicy(mesg.Question[0].Name)
+	}
+
+	if policy != nil {
+		if policy.noCache {
+			return
+		}
+
+		minTTL, maxTTL = policy.ttl, policy.ttl
+	}
+
+	clampMsgTTL(mesg, minTTL, maxTTL)
+
+	if !cache.IsNegative(mesg) {
+		h.r.Negcache.Remove(key)
+		h.r.Qcache.Set(key, mesg)
+		return
+	}
+
+	ttl, ok := cache.NegativeTTL(mesg)
+	if !ok {
+		ttl = cfg.Expire
+	}
+
+	ttl = clampTTL(ttl, minTTL, maxTTL)
+
+	if policy == nil && cfg.NegativeTTL > 0 && ttl > cfg.NegativeTTL {
+		ttl = cfg.NegativeTTL
+	}
+
+	for _, rr := range mesg.Ns {
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+	}
+
+	h.r.Qcache.Remove(key)
+	h.r.Negcache.Set(key, mesg, ttl)
+
+	scope := ""
+	if len(upstream) > 0 {
+		scope = upstream[0]
+	}
+
+	h.setNXDomainCut(mesg, ttl, scope)
+}
+
+// serveStale returns the expired cache entry of the key when serve-stale
+// enabled and starts a refresh in background
+func (h *DNSHandler) serveStale(proto string, req *dns.Msg, key uint64, opt *dns.OPT, dsReq bool, upstream string) *dns.Msg {
+	if !Config().ServeStale {
+		return nil
+	}
+
+	msg, err := h.r.Qcache.GetStale(key, req, staleTTL)
+	if err != nil {
+		return nil
+	}
+
+	log.Debug("Serving stale answer", "key", key, "query", formatQuestion(req.Question[0]))
+
+	h.refreshes.Add(1)
+	go h.refresh(proto, req.Copy(), key, upstream)
+
+	msg.Id = req.Id
+
+	if ip := blockedAddress(req, msg); ip != nil {
+		return blockAddressReply(req, ip, opt, dsReq)
+	}
+
+	msg = minimalAny(req, msg)
 
 	if !dsReq {
 		msg = clearDNSSEC(msg)
@@ -298,78 +832,211 @@ func (h *DNSHandler) query(proto string, req *dns.Msg) *dns.Msg {
 	opt.SetDo(dsReq)
 	msg.Extra = append(msg.Extra, opt)
 
-	h.r.Qcache.Set(key, mesg)
+	return setExtendedError(msg, edeStaleAnswer, "")
+}
 
-	log.Debug("Set msg into cache", "query", formatQuestion(q))
-	return msg
+// refresh resolves the request again and replaces the cache entry of the key,
+// only one refresh runs for a key at the same time
+func (h *DNSHandler) refresh(proto string, req *dns.Msg, key uint64, upstream string) {
+	defer h.refreshes.Done()
+
+	h.mu.Lock()
+	if _, ok := h.refreshing[key]; ok {
+		h.mu.Unlock()
+		return
+	}
+	h.refreshing[key] = struct{}{}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.refreshing, key)
+		h.mu.Unlock()
+	}()
+
+	mesg, err := h.resolve(proto, req, upstream)
+	if err == nil && mesg.Truncated && proto == "udp" {
+		mesg, err = h.resolve("tcp", req, upstream)
+	}
+
+	if err != nil {
+		log.Debug("Refresh query failed", "query", formatQuestion(req.Question[0]), "error", err.Error())
+		return
+	}
+
+	if mesg.Truncated || (mesg.Rcode != dns.RcodeSuccess && len(mesg.Answer) == 0 && len(mesg.Ns) == 0) {
+		return
+	}
+
+	h.r.Ecache.Remove(key)
+	h.setCache(key, mesg, upstream)
+
+	log.Debug("Refreshed cache entry", "query", formatQuestion(req.Question[0]))
 }
 
-func (h *DNSHandler) additionalAnswer(proto string, req, msg *dns.Msg) *dns.Msg {
-	//check cname response
-	answerFound := false
+// clampMsgTTL clamps the TTLs of the records in all sections, zero values
+// disable the bounds
+func clampMsgTTL(msg *dns.Msg, min, max uint32) {
+	if min == 0 && max == 0 {
+		return
+	}
 
-	cnameReq := new(dns.Msg)
-	cnameReq.SetEdns0(DefaultMsgSize, true)
-	cnameReq.RecursionDesired = true
-	cnameReq.CheckingDisabled = req.CheckingDisabled
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			// OPT TTL field carries the extended rcode and flags
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
 
-	for _, answer := range msg.Answer {
-		if answer.Header().Rrtype == req.Question[0].Qtype &&
-			(req.Question[0].Qtype == dns.TypeA || req.Question[0].Qtype == dns.TypeAAAA) {
-			answerFound = true
+			rr.Header().Ttl = clampTTL(rr.Header().Ttl, min, max)
 		}
+	}
+}
 
-		if answer.Header().Rrtype == dns.TypeCNAME {
-			cr := answer.(*dns.CNAME)
-			cnameReq.SetQuestion(cr.Target, req.Question[0].Qtype)
+func clampTTL(ttl, min, max uint32) uint32 {
+	if min > 0 && ttl < min {
+		ttl = min
+	}
+
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+// resolve resolves the request recursively from the root servers or forwards it
+// to the upstream group when the group given, or to the servers of the matching
+// forward zone. The group down by the health checks or failed on the network
+// falls back to the root servers.
+func (h *DNSHandler) resolve(proto string, req *dns.Msg, upstream string) (*dns.Msg, error) {
+	if upstream != "" {
+		if upstreamDown(upstream) {
+			log.Debug("Upstream group down, resolving from the root servers", "query", formatQuestion(req.Question[0]), "upstream", upstream)
+		} else {
+			resp, err := h.forward(proto, req, upstream)
+			if !upstreamUnreachable(err) {
+				return unvalidated(resp, err)
+			}
+
+			log.Debug("Upstream group unreachable, resolving from the root servers", "query", formatQuestion(req.Question[0]), "upstream", upstream, "error", err.Error())
 		}
 	}
 
-	cnameDepth := 5
+	if f := matchForwardZone(req.Question[0].Name); f != nil {
+		return unvalidated(h.forwardZone(proto, req, f))
+	}
 
-	if !answerFound && len(cnameReq.Question) > 0 {
-	lookup:
-		q := cnameReq.Question[0]
-		child := false
+	depth := Config().Maxdepth
 
-		key := cache.Hash(q, cnameReq.CheckingDisabled)
-		respCname, _, err := h.r.Qcache.Get(key, cnameReq)
-		if err == nil {
-			for _, r := range respCname.Answer {
-				msg.Answer = append(msg.Answer, dns.Copy(r))
-
-				if r.Header().Rrtype == dns.TypeCNAME {
-					cr := r.(*dns.CNAME)
-					cnameReq.Question[0].Name = cr.Target
-					child = true
+	resp, err := h.r.Resolve(proto, req, rootservers, true, depth, 0, false, nil)
+	if err != nil && rootservers.Encrypted() && len(fallbackservers.List) > 0 {
+		log.Debug("Encrypted root servers failed, trying fallback servers", "query", formatQuestion(req.Question[0]), "error", err.Error())
+
+		return h.r.Resolve(proto, req, fallbackservers, false, depth, 0, false, nil)
+	}
+
+	return resp, err
+}
+
+// additionalAnswer follows the CNAME chain of the answer, the targets not in the
+// answer looked up from the cache or resolved again from the root, the chain may
+// leave the zone. Returns an error for a looping or too long chain.
+func (h *DNSHandler) additionalAnswer(proto string, req, msg *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	if q.Qtype == dns.TypeCNAME {
+		return msg, nil
+	}
+
+	maxDepth := Config().MaxCNAMEDepth
+
+	name := strings.ToLower(q.Name)
+	visited := map[string]bool{name: true}
+	depth := 0
+
+	// follow returns the end of the chain in the records
+	follow := func(rrs []dns.RR) (string, bool, error) {
+		for {
+			found := false
+			target := ""
+
+			for _, rr := range rrs {
+				hdr := rr.Header()
+				if strings.ToLower(hdr.Name) != name {
+					continue
 				}
-			}
-		} else {
-			depth := Config.Maxdepth
-			respCname, err := h.r.Resolve(proto, cnameReq, rootservers, true, depth, 0, false, nil)
-			if err == nil && len(respCname.Answer) > 0 {
-				for _, r := range respCname.Answer {
-					msg.Answer = append(msg.Answer, dns.Copy(r))
-
-					if r.Header().Rrtype == dns.TypeCNAME {
-						cr := r.(*dns.CNAME)
-						cnameReq.Question[0].Name = cr.Target
-						child = true
-					}
+
+				if hdr.Rrtype == q.Qtype {
+					found = true
 				}
 
-				h.r.Qcache.Set(key, respCname)
+				if cname, ok := rr.(*dns.CNAME); ok {
+					target = strings.ToLower(cname.Target)
+				}
 			}
-		}
 
-		cnameDepth--
+			if found || target == "" {
+				return name, found, nil
+			}
 
-		if child && cnameDepth > 0 {
-			goto lookup
+			if visited[target] {
+				return "", false, errCNAMELoop
+			}
+
+			depth++
+			if depth > maxDepth {
+				return "", false, errCNAMEDepth
+			}
+
+			visited[target] = true
+			name = target
 		}
 	}
 
-	return msg
+	end, found, err := follow(msg.Answer)
+	if err != nil || found || end == strings.ToLower(q.Name) {
+		return msg, err
+	}
+
+	cnameReq := new(dns.Msg)
+	cnameReq.SetEdns0(DefaultMsgSize, true)
+	cnameReq.RecursionDesired = true
+	cnameReq.CheckingDisabled = req.CheckingDisabled
+
+	for {
+		cnameReq.SetQuestion(end, q.Qtype)
+
+		key := cache.Hash(cnameReq.Question[0], cnameReq.CheckingDisabled)
+
+		respCname, _, err := h.r.Qcache.Get(key, cnameReq)
+		if err != nil {
+			respCname, err = h.resolve(proto, cnameReq, "")
+			if err != nil {
+				return msg, nil
+			}
+
+			h.setCache(key, respCname)
+		}
+
+		if len(respCname.Answer) == 0 {
+			if respCname.Rcode == dns.RcodeNameError {
+				msg.Rcode = dns.RcodeNameError
+			}
+
+			return msg, nil
+		}
+
+		for _, r := range respCname.Answer {
+			msg.Answer = append(msg.Answer, dns.Copy(r))
+		}
+
+		next, found, err := follow(respCname.Answer)
+		if err != nil || found || next == end {
+			return msg, err
+		}
+
+		end = next
+	}
 }
 
 func (h *DNSHandler) handleFailed(msg *dns.Msg, rcode int, dsf bool) *dns.Msg {
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,18 +54,18 @@ func RunLocalUDPServerWithFinChan(laddr string, opts ...func(*dns.Server)) (*dns
 }
 
 func Test_handler(t *testing.T) {
-	var err error
-
-	Config.OutboundIPs, err = findLocalIPAddresses()
+	ips, err := findLocalIPAddresses()
 	assert.NoError(t, err)
 
-	for i, ip := range Config.OutboundIPs {
+	for i, ip := range ips {
 		if ip == "127.0.0.1" {
-			Config.OutboundIPs = append(Config.OutboundIPs[:i], Config.OutboundIPs[i+1:]...)
+			ips = append(ips[:i], ips[i+1:]...)
 			break
 		}
 	}
 
+	setConfig(func(cfg *config) { cfg.OutboundIPs = ips })
+
 	handler := NewHandler()
 
 	dns.HandleFunc(".", handler.UDP)
@@ -126,7 +134,9 @@ func Test_handler(t *testing.T) {
 	m.SetQuestion(".", dns.TypeANY)
 	r, _, err = c.Exchange(m, addrstr)
 	assert.NoError(t, err)
-	assert.Equal(t, r.Rcode, dns.RcodeNotImplemented)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, len(r.Answer), 1)
+	assert.False(t, r.AuthenticatedData)
 
 	m.SetQuestion(".", dns.TypeNS)
 	m.RecursionDesired = false
@@ -155,3 +165,614 @@ func Test_HandlerHINFO(t *testing.T) {
 
 	assert.Equal(t, true, len(resp.Ns) > 0)
 }
+
+func Test_HandlerServeStale(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.ServeStale = true
+		cfg.ServeStaleTTL.Duration = time.Hour
+	})()
+
+	fakeClock := clockwork.NewFakeClock()
+	cache.WallClock = fakeClock
+	defer func() { cache.WallClock = clockwork.NewRealClock() }()
+
+	// the refreshes of the stale answer failed fast and waited
+	defer func(roots, fallbacks *cache.AuthServers) {
+		rootservers, fallbackservers = roots, fallbacks
+	}(rootservers, fallbackservers)
+
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer("127.0.0.1:1")}}
+	fallbackservers = &cache.AuthServers{}
+
+	handler := NewHandler()
+	defer handler.refreshes.Wait()
+
+	req := new(dns.Msg)
+	req.SetQuestion("stale.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, err := dns.NewRR("stale.example.com. 10 IN A 127.0.0.1")
+	assert.NoError(t, err)
+	m.Answer = append(m.Answer, rr)
+
+	key := cache.Hash(req.Question[0], req.CheckingDisabled)
+	handler.r.Qcache.Set(key, m)
+
+	fakeClock.Advance(time.Minute)
+
+	// mark the upstream lookup as failed
+	handler.r.Ecache.Set(key)
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, uint32(staleTTL), resp.Answer[0].Header().Ttl)
+
+	defer setConfig(func(cfg *config) { cfg.ServeStale = false })()
+
+	resp = handler.query("udp", req)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+}
+
+func Test_HandlerNegativeCache(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	cache.WallClock = fakeClock
+	defer func() { cache.WallClock = clockwork.NewRealClock() }()
+
+	var (
+		mu       sync.Mutex
+		calls    int
+		nxdomain = true
+	)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		calls++
+		negative := nxdomain
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		if negative {
+			m.Rcode = dns.RcodeNameError
+
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+			m.Ns = append(m.Ns, soa)
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"negative": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "negative")
+
+	for i := 0; i < 2; i++ {
+		resp := handler.query("udp", req.Copy(), entry)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		assert.Len(t, resp.Ns, 1)
+		assert.Equal(t, uint32(300), resp.Ns[0].Header().Ttl)
+	}
+
+	mu.Lock()
+	assert.Equal(t, 1, calls)
+	nxdomain = false
+	mu.Unlock()
+
+	key := cache.HashScope(cache.Hash(req.Question[0], req.CheckingDisabled), "upstream:negative")
+	assert.Equal(t, 1, handler.r.Negcache.Len())
+
+	fakeClock.Advance(301 * time.Second)
+
+	resp := handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+
+	_, err = handler.r.Negcache.Get(key, req)
+	assert.Error(t, err)
+
+	resp = handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	mu.Lock()
+	assert.Equal(t, 2, calls)
+	mu.Unlock()
+}
+
+func Test_HandlerDNSSECBit(t *testing.T) {
+	var mu sync.Mutex
+	calls, unsigned := 0, 0
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("signed.example.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		calls++
+		if !isDO(req) {
+			unsigned++
+		}
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		rr, _ := dns.NewRR("signed.example.com. 300 IN A 192.0.2.1")
+		sig, _ := dns.NewRR("signed.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl")
+		glue, _ := dns.NewRR("ns1.example.com. 300 IN A 192.0.2.53")
+		glueSig, _ := dns.NewRR("ns1.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl")
+
+		m.Answer = append(m.Answer, rr)
+		m.Extra = append(m.Extra, glue)
+
+		if isDO(req) {
+			m.Answer = append(m.Answer, sig)
+			m.Extra = append(m.Extra, glueSig)
+		}
+
+		m.SetEdns0(DefaultMsgSize, isDO(req))
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"signed": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "signed")
+
+	query := func(do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("signed.example.com.", dns.TypeA)
+		req.RecursionDesired = true
+		req.SetEdns0(DefaultMsgSize, do)
+
+		return handler.query("udp", req, entry)
+	}
+
+	signatures := func(rrs []dns.RR) int {
+		count := 0
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the DO=0 client first, the answer cached with the signatures
+	resp := query(false)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, 0, signatures(resp.Answer))
+	assert.Equal(t, 0, signatures(resp.Extra))
+	assert.False(t, resp.IsEdns0().Do())
+
+	for i := 0; i < 2; i++ {
+		resp = query(true)
+		assert.Equal(t, 1, signatures(resp.Answer))
+		assert.Equal(t, 1, signatures(resp.Extra))
+		assert.True(t, resp.IsEdns0().Do())
+	}
+
+	resp = query(false)
+	assert.Equal(t, 0, signatures(resp.Answer))
+
+	mu.Lock()
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 0, unsigned)
+	mu.Unlock()
+}
+
+func Test_clampMsgTTL(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	low, _ := dns.NewRR("example.com. 1 IN A 192.0.2.1")
+	zero, _ := dns.NewRR("example.com. 0 IN A 192.0.2.2")
+	ns, _ := dns.NewRR("example.com. 604800 IN NS ns1.example.com.")
+	glue, _ := dns.NewRR("ns1.example.com. 604800 IN A 192.0.2.53")
+	msg.Answer = append(msg.Answer, low, zero)
+	msg.Ns = append(msg.Ns, ns)
+	msg.Extra = append(msg.Extra, glue)
+	msg.SetEdns0(DefaultMsgSize, true)
+
+	opt := msg.IsEdns0()
+	optTTL := opt.Hdr.Ttl
+
+	clampMsgTTL(msg, 0, 86400)
+	assert.Equal(t, uint32(1), low.Header().Ttl)
+	assert.Equal(t, uint32(0), zero.Header().Ttl)
+	assert.Equal(t, uint32(86400), ns.Header().Ttl)
+	assert.Equal(t, uint32(86400), glue.Header().Ttl)
+
+	clampMsgTTL(msg, 30, 3600)
+	assert.Equal(t, uint32(30), low.Header().Ttl)
+	assert.Equal(t, uint32(30), zero.Header().Ttl)
+	assert.Equal(t, uint32(3600), ns.Header().Ttl)
+	assert.Equal(t, uint32(3600), glue.Header().Ttl)
+	assert.Equal(t, optTTL, opt.Hdr.Ttl)
+}
+
+func Test_HandlerNegativeTTLClamp(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.MinTTL = 600
+		cfg.MaxTTL = 1800
+	})()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Rcode = dns.RcodeNameError
+
+	// MINIMUM 300 is below the minttl
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	m.Ns = append(m.Ns, soa)
+
+	key := cache.Hash(req.Question[0], req.CheckingDisabled)
+	handler.setCache(key, m)
+	assert.Equal(t, uint32(600), soa.Header().Ttl)
+
+	resp, err := handler.r.Negcache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(600), resp.Ns[0].Header().Ttl)
+
+	m = new(dns.Msg)
+	m.SetReply(req)
+
+	rr, _ := dns.NewRR("missing.example.com. 5 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	handler.setCache(key, m)
+	assert.Equal(t, uint32(600), rr.Header().Ttl)
+
+	_, err = handler.r.Negcache.Get(key, req)
+	assert.Error(t, err)
+
+	resp, _, err = handler.r.Qcache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(600), resp.Answer[0].Header().Ttl)
+}
+
+func Test_HandlerNXDomainCut(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.HardenBelowNXDOMAIN = true })()
+
+	handler := NewHandler()
+
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	nsec, _ := dns.NewRR("example.com. 300 IN NSEC www.example.com. A NS SOA RRSIG NSEC")
+
+	negative := func(name string, rcode int) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = rcode
+		m.Ns = []dns.RR{dns.Copy(soa), dns.Copy(nsec)}
+
+		handler.setCache(cache.Hash(req.Question[0], req.CheckingDisabled), m)
+	}
+
+	negative("nx.example.com.", dns.RcodeNameError)
+	negative("nodata.example.com.", dns.RcodeSuccess)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.b.nx.example.com.", dns.TypeAAAA)
+
+	resp, status := handler.queryStatus("udp", req)
+	assert.Equal(t, statusHit, status)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, "a.b.nx.example.com.", resp.Question[0].Name)
+	assert.Len(t, resp.Ns, 1)
+	assert.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	// the NODATA answers not cut
+	req.SetQuestion("a.nodata.example.com.", dns.TypeA)
+	assert.Nil(t, handler.nxdomainCut(req, ""))
+
+	// the cut scoped by the upstream
+	req.SetQuestion("a.nx.example.com.", dns.TypeA)
+	assert.Nil(t, handler.nxdomainCut(req, "internal"))
+
+	defer setConfig(func(cfg *config) { cfg.HardenBelowNXDOMAIN = false })()
+	assert.Nil(t, handler.nxdomainCut(req, ""))
+}
+
+func Test_HandlerResponsePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_rpz")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.rpz")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`$TTL 300
+$ORIGIN rpz.local.
+@                            SOA localhost. root.localhost. 1 3600 600 86400 60
+bad.example.com              CNAME .
+tcp.example.com              CNAME rpz-tcp-only.
+good.example.com             CNAME rpz-passthru.
+32.1.2.0.192.rpz-ip          CNAME .
+32.1.2.0.10.rpz-client-ip    CNAME rpz-drop.
+ns.evil.example.rpz-nsdname  CNAME *.
+`), 0644))
+
+	assert.NoError(t, ResponsePolicy.Load(file))
+	defer ResponsePolicy.Load()
+
+	handler := NewHandler()
+
+	answer := func(name, addr string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, err := dns.NewRR(name + " 300 IN A " + addr)
+		assert.NoError(t, err)
+		m.Answer = append(m.Answer, rr)
+
+		handler.r.Qcache.Set(cache.Hash(req.Question[0]), m)
+	}
+
+	answer("good.example.com.", "192.0.2.1")
+	answer("hit.example.com.", "192.0.2.1")
+	answer("clean.example.com.", "192.0.2.2")
+	answer("www.example.org.", "192.0.2.3")
+
+	handler.r.Ncache.Set(cache.Hash(dns.Question{Name: "example.org.", Qtype: dns.TypeNS, Qclass: dns.ClassINET}),
+		nil, 300, &cache.AuthServers{}, "ns.evil.example.")
+
+	query := func(proto, name string, client string) (*dns.Msg, string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.RecursionDesired = true
+
+		entry := NewAccessEntry(mustParseCIDR(t, "0.0.0.0/0"), ActionAllow, "")
+		entry.Client = net.ParseIP(client)
+
+		return handler.queryStatus(proto, req, entry)
+	}
+
+	resp, status := query("udp", "bad.example.com.", "127.0.0.1")
+	assert.Equal(t, statusPolicy, status)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Len(t, resp.Ns, 1)
+
+	resp, status = query("udp", "tcp.example.com.", "127.0.0.1")
+	assert.Equal(t, statusPolicy, status)
+	assert.True(t, resp.Truncated)
+
+	resp, status = query("udp", "hit.example.com.", "127.0.0.1")
+	assert.Equal(t, statusPolicy, status)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp, status = query("udp", "good.example.com.", "127.0.0.1")
+	assert.Equal(t, statusHit, status)
+	assert.Len(t, resp.Answer, 1)
+
+	resp, status = query("udp", "clean.example.com.", "127.0.0.1")
+	assert.Equal(t, statusHit, status)
+	assert.Len(t, resp.Answer, 1)
+
+	resp, status = query("udp", "www.example.org.", "127.0.0.1")
+	assert.Equal(t, statusPolicy, status)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+
+	resp, status = query("udp", "clean.example.com.", "10.0.2.1")
+	assert.Equal(t, statusPolicy, status)
+	assert.Nil(t, resp)
+}
+
+func Test_HandlerCNAMEChain(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		name := req.Question[0].Name
+
+		var rr dns.RR
+		switch {
+		case name == "loop1.cname.test.":
+			rr, _ = dns.NewRR(name + " 60 IN CNAME loop2.cname.test.")
+		case name == "loop2.cname.test.":
+			rr, _ = dns.NewRR(name + " 60 IN CNAME LOOP1.cname.test.")
+		case strings.HasPrefix(name, "long"):
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "long"), ".cname.test."))
+			rr, _ = dns.NewRR(name + " 60 IN CNAME long" + strconv.Itoa(n+1) + ".cname.test.")
+		case name == "ext.cname.test.":
+			rr, _ = dns.NewRR(name + " 60 IN CNAME mid.cname.test.")
+			m.Answer = append(m.Answer, rr)
+			rr, _ = dns.NewRR("mid.cname.test. 60 IN CNAME www.other.test.")
+		case name == "www.other.test.":
+			rr, _ = dns.NewRR(name + " 60 IN A 10.0.0.2")
+		}
+
+		if rr != nil {
+			m.Answer = append(m.Answer, rr)
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{
+		{Zone: "cname.test", Servers: []string{addrstr}},
+		{Zone: "other.test", Servers: []string{addrstr}},
+	})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.RecursionDesired = true
+
+		return handler.query("udp", req)
+	}
+
+	resp := query("loop1.cname.test.")
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	resp = query("long1.cname.test.")
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	defer setConfig(func(cfg *config) { cfg.MaxCNAMEDepth = 1 })()
+
+	resp = query("ext.cname.test.")
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	defer setConfig(func(cfg *config) { cfg.MaxCNAMEDepth = 10 })()
+
+	// the cached answer followed again
+	resp = query("ext.cname.test.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	if assert.Len(t, resp.Answer, 3) {
+		assert.Equal(t, "mid.cname.test.", resp.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "www.other.test.", resp.Answer[1].(*dns.CNAME).Target)
+		assert.Equal(t, "10.0.0.2", resp.Answer[2].(*dns.A).A.String())
+	}
+}
+
+func Test_HandlerSharedLookup(t *testing.T) {
+	var queries int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		if req.Question[0].Name == "fail.flight.test." {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0.3")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "flight.test", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	queryAll := func(name string) []*dns.Msg {
+		resps := make([]*dns.Msg, 10)
+
+		var wg sync.WaitGroup
+		for i := range resps {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				req := new(dns.Msg)
+				req.SetQuestion(name, dns.TypeA)
+				req.Id = uint16(i + 1)
+
+				resps[i] = handler.query("udp", req)
+			}(i)
+		}
+		wg.Wait()
+
+		return resps
+	}
+
+	for i, resp := range queryAll("www.flight.test.") {
+		assert.Equal(t, uint16(i+1), resp.Id)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// the waiters get the same failure
+	atomic.StoreInt32(&queries, 0)
+	for _, resp := range queryAll("fail.flight.test.") {
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+	assert.Equal(t, 0, handler.r.Flight.Len())
+}
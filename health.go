@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// healthServers returns the server sets which health checked, by name
+func healthServers() map[string]*cache.AuthServers {
+	sets := map[string]*cache.AuthServers{
+		"rootservers":     rootservers,
+		"fallbackservers": fallbackservers,
+	}
+
+	upstreamGroupsMu.RLock()
+	for name, servers := range upstreamGroups {
+		sets["upstream:"+name] = servers
+	}
+	upstreamGroupsMu.RUnlock()
+
+	// the probe is plain dns
+	forwardZonesMu.RLock()
+	for zone, f := range forwardZones {
+		if f.protocol == forwardPlain {
+			sets["forward:"+zone] = f.servers
+		}
+	}
+	forwardZonesMu.RUnlock()
+
+	return sets
+}
+
+// upstreamHealthy reports at least one of the health checked servers healthy
+func upstreamHealthy() bool {
+	for _, servers := range healthServers() {
+		servers.RLock()
+		for _, server := range servers.List {
+			if server.Healthy() {
+				servers.RUnlock()
+				return true
+			}
+		}
+		servers.RUnlock()
+	}
+
+	return false
+}
+
+// isHealthCheckName reports the name is the configured health check name
+func isHealthCheckName(name string) bool {
+	check := Config().HealthCheckName
+
+	return check != "" && strings.EqualFold(dns.Fqdn(check), name)
+}
+
+// healthCheckReply answers the health check name with the ok TXT record when
+// an upstream healthy, the TTL is zero against the caching on the way
+func healthCheckReply(req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	if !upstreamHealthy() {
+		msg.Rcode = dns.RcodeServerFailure
+		return msg
+	}
+
+	q := req.Question[0]
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: []string{"ok"},
+		})
+	}
+
+	return msg
+}
+
+// runHealthChecks probes the servers which due to a check every second
+func runHealthChecks() {
+	ticker := time.NewTicker(time.Second)
+
+	for range ticker.C {
+		if Config().HealthCheckInterval.Duration <= 0 {
+			continue
+		}
+
+		healthCheck()
+	}
+}
+
+func healthCheck() {
+	cfg := Config()
+
+	var wg sync.WaitGroup
+
+	for _, servers := range healthServers() {
+		servers.RLock()
+		for _, server := range servers.List {
+			if !server.NeedsCheck() {
+				continue
+			}
+
+			wg.Add(1)
+			go func(server *cache.AuthServer) {
+				defer wg.Done()
+				checkServer(server, cfg.HealthCheckInterval.Duration, cfg.HealthCheckFailures)
+			}(server)
+		}
+		servers.RUnlock()
+	}
+
+	wg.Wait()
+}
+
+func checkServer(server *cache.AuthServer, interval time.Duration, failures int) {
+	healthy := server.Healthy()
+
+	rtt, err := probeServer(server)
+	server.RecordCheck(err == nil, rtt, interval, failures)
+
+	if err != nil {
+		log.Debug("Health check failed", "server", server.Host, "error", err.Error())
+	}
+
+	if healthy && !server.Healthy() {
+		log.Warn("Server removed from rotation", "server", server.Host, "failures", server.Health().Failures)
+	} else if !healthy && server.Healthy() {
+		log.Info("Server back in rotation", "server", server.Host)
+	}
+}
+
+// probeServer sends a root NS query to the server
+func probeServer(server *cache.AuthServer) (time.Duration, error) {
+	timeout, connect := upstreamTimeouts("udp")
+
+	c := &dns.Client{
+		Net: "udp",
+		Dialer: &net.Dialer{
+			Timeout: connect,
+		},
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(rootzone, dns.TypeNS)
+	req.RecursionDesired = true
+
+	resp, rtt, err := exchangeUpstream(c, req, server)
+	if err != nil && err != dns.ErrTruncated {
+		return rtt, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return rtt, errHealthRcode
+	}
+
+	return rtt, nil
+}
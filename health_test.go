@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_healthCheck(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"health": {"127.0.0.1:1", addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	servers := upstreamServers("health")
+	assert.Contains(t, healthServers(), "upstream:health")
+
+	for _, server := range servers.List {
+		checkServer(server, time.Minute, 1)
+	}
+
+	assert.False(t, servers.List[0].Healthy())
+	assert.True(t, servers.List[1].Healthy())
+	assert.False(t, servers.List[1].Health().LastCheck.IsZero())
+
+	list := servers.Available()
+	assert.Len(t, list, 1)
+	assert.Equal(t, addrstr, list[0].Host)
+}
+
+func Test_HandlerHealthCheckName(t *testing.T) {
+	defer func(roots, fallbacks *cache.AuthServers) {
+		rootservers, fallbackservers = roots, fallbacks
+	}(rootservers, fallbackservers)
+
+	defer setConfig(func(cfg *config) { cfg.HealthCheckName = "Health.sdns.local" })()
+
+	server := cache.NewAuthServer("127.0.0.1:1")
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{server}}
+	fallbackservers = &cache.AuthServers{}
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("health.SDNS.local.", dns.TypeTXT)
+	req.RecursionDesired = false
+
+	resp, status := handler.queryStatus("udp", req)
+	assert.Equal(t, statusLocal, status)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"ok"}, resp.Answer[0].(*dns.TXT).Txt)
+		assert.Equal(t, uint32(0), resp.Answer[0].Header().Ttl)
+	}
+
+	req.SetQuestion("health.sdns.local.", dns.TypeA)
+	resp, _ = handler.queryStatus("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+
+	server.RecordCheck(false, 0, time.Minute, 1)
+
+	req.SetQuestion("health.sdns.local.", dns.TypeTXT)
+	resp, _ = handler.queryStatus("udp", req)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+
+	// disabled by default
+	defer setConfig(func(cfg *config) { cfg.HealthCheckName = "" })()
+	assert.False(t, isHealthCheckName("health.sdns.local."))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// Hosts holds the local name overrides loaded from a hosts file
+type Hosts struct {
+	mu sync.RWMutex
+
+	names     map[string]*hostAddrs
+	wildcards map[string]*hostAddrs
+
+	// the host names of the reverse names of the addresses, the reverse
+	// names with their ancestors in nodes
+	ptrs  map[string][]string
+	nodes map[string]bool
+}
+
+type hostAddrs struct {
+	v4 []net.IP
+	v6 []net.IP
+}
+
+// NewHosts returns a new empty hosts
+func NewHosts() *Hosts {
+	return &Hosts{
+		names:     make(map[string]*hostAddrs),
+		wildcards: make(map[string]*hostAddrs),
+		ptrs:      make(map[string][]string),
+		nodes:     make(map[string]bool),
+	}
+}
+
+// Load replaces the entries with the given hosts file, empty path clears the entries
+func (h *Hosts) Load(path string) error {
+	loaded, err := loadHosts(path)
+	if err != nil {
+		return err
+	}
+
+	h.set(loaded)
+
+	return nil
+}
+
+// set replaces the entries with the entries of the loaded hosts
+func (h *Hosts) set(loaded *Hosts) {
+	h.mu.Lock()
+	h.names = loaded.names
+	h.wildcards = loaded.wildcards
+	h.ptrs = loaded.ptrs
+	h.nodes = loaded.nodes
+	h.mu.Unlock()
+}
+
+// loadHosts returns the entries of the hosts file, empty for the empty path
+func loadHosts(path string) (*Hosts, error) {
+	loaded := NewHosts()
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("hosts file open failed: %s", err)
+		}
+		defer file.Close()
+
+		if err := parseHosts(file, loaded.names, loaded.wildcards); err != nil {
+			return nil, fmt.Errorf("hosts file parse failed: %s", err)
+		}
+	}
+
+	loaded.ptrs, loaded.nodes = reverseHosts(loaded.names)
+
+	return loaded, nil
+}
+
+func parseHosts(r io.Reader, names, wildcards map[string]*hostAddrs) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			log.Warn("Hosts file entry invalid, skipping...", "ip", fields[0])
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			name = dns.Fqdn(strings.ToLower(name))
+
+			m := names
+			if strings.HasPrefix(name, "*.") {
+				m, name = wildcards, name[2:]
+			}
+
+			addrs, ok := m[name]
+			if !ok {
+				addrs = &hostAddrs{}
+				m[name] = addrs
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				addrs.v4 = append(addrs.v4, ip4)
+			} else {
+				addrs.v6 = append(addrs.v6, ip)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// reverseHosts returns the sorted host names of the reverse names of the
+// addresses and the reverse names with their ancestors, the wildcards have no
+// reverse names
+func reverseHosts(names map[string]*hostAddrs) (map[string][]string, map[string]bool) {
+	ptrs := make(map[string][]string)
+	nodes := make(map[string]bool)
+
+	for name, addrs := range names {
+		for _, ip := range append(append([]net.IP{}, addrs.v4...), addrs.v6...) {
+			rev, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+
+			ptrs[rev] = append(ptrs[rev], name)
+
+			for off, end := 0, false; !end; off, end = dns.NextLabel(rev, off) {
+				nodes[rev[off:]] = true
+			}
+		}
+	}
+
+	for _, list := range ptrs {
+		sort.Strings(list)
+	}
+
+	return ptrs, nodes
+}
+
+// Reverse returns the host names of the reverse name, exists false if the name
+// neither the reverse name of an entry address nor an ancestor of one
+func (h *Hosts) Reverse(name string) (names []string, exists bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	name = strings.ToLower(name)
+
+	return h.ptrs[name], h.nodes[name]
+}
+
+func (h *Hosts) lookup(name string) *hostAddrs {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	name = strings.ToLower(name)
+
+	if addrs, ok := h.names[name]; ok {
+		return addrs
+	}
+
+	// the most specific wildcard wins
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if addrs, ok := h.wildcards[name[off:]]; ok {
+			return addrs
+		}
+	}
+
+	return nil
+}
+
+// Len returns the count of the names and wildcards
+func (h *Hosts) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.names) + len(h.wildcards)
+}
+
+// Answer returns a response for the A and AAAA queries of the names in the hosts,
+// the names without the address of the query type answered with an empty response
+func (h *Hosts) Answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+
+	addrs := h.lookup(q.Name)
+	if addrs == nil {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	rrHeader := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    Config().Expire,
+	}
+
+	if q.Qtype == dns.TypeA {
+		for _, ip := range addrs.v4 {
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: rrHeader, A: ip})
+		}
+	} else {
+		for _, ip := range addrs.v6 {
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: ip})
+		}
+	}
+
+	return msg
+}
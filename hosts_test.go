@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHosts = `# local overrides
+192.168.1.10   web.local   www.web.local
+192.168.1.11   db.local # database
+fd00::10       web.local
+10.0.0.1       *.internal
+10.0.0.2       *.dev.internal
+invalid        bad.local
+`
+
+func Test_Hosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(testHosts)
+	f.Close()
+
+	h := NewHosts()
+	assert.NoError(t, h.Load(f.Name()))
+	assert.Equal(t, 5, h.Len())
+
+	req := new(dns.Msg)
+
+	req.SetQuestion("WEB.local.", dns.TypeA)
+	msg := h.Answer(req)
+	assert.NotNil(t, msg)
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "192.168.1.10", msg.Answer[0].(*dns.A).A.String())
+
+	req.SetQuestion("web.local.", dns.TypeAAAA)
+	msg = h.Answer(req)
+	assert.NotNil(t, msg)
+	assert.Len(t, msg.Answer, 1)
+	assert.Equal(t, "fd00::10", msg.Answer[0].(*dns.AAAA).AAAA.String())
+
+	req.SetQuestion("db.local.", dns.TypeAAAA)
+	msg = h.Answer(req)
+	assert.NotNil(t, msg)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+
+	req.SetQuestion("a.b.internal.", dns.TypeA)
+	msg = h.Answer(req)
+	assert.NotNil(t, msg)
+	assert.Equal(t, "10.0.0.1", msg.Answer[0].(*dns.A).A.String())
+
+	req.SetQuestion("api.dev.internal.", dns.TypeA)
+	msg = h.Answer(req)
+	assert.NotNil(t, msg)
+	assert.Equal(t, "10.0.0.2", msg.Answer[0].(*dns.A).A.String())
+
+	req.SetQuestion("internal.", dns.TypeA)
+	assert.Nil(t, h.Answer(req))
+
+	req.SetQuestion("bad.local.", dns.TypeA)
+	assert.Nil(t, h.Answer(req))
+
+	req.SetQuestion("web.local.", dns.TypeMX)
+	assert.Nil(t, h.Answer(req))
+
+	assert.Error(t, h.Load("/nonexistent/hosts"))
+	assert.Equal(t, 5, h.Len())
+
+	assert.NoError(t, h.Load(""))
+	assert.Equal(t, 0, h.Len())
+}
+
+func Test_HandlerHosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString(testHosts)
+	f.Close()
+
+	assert.NoError(t, LocalHosts.Load(f.Name()))
+	defer LocalHosts.Load("")
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("db.local.", dns.TypeA)
+	req.RecursionDesired = true
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+	assert.False(t, resp.AuthenticatedData)
+	assert.NotNil(t, resp.IsEdns0())
+}
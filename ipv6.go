@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// The IPv6 transport modes of the upstream queries
+const (
+	// ipv6Auto races the IPv6 and IPv4 servers, IPv6 demoted after repeated failures
+	ipv6Auto = "auto"
+	// ipv6Prefer races the IPv6 and IPv4 servers, IPv6 never demoted
+	ipv6Prefer = "prefer"
+	// ipv6Only queries only the IPv6 servers
+	ipv6Only = "only"
+	// ipv6Off queries only the IPv4 servers
+	ipv6Off = "off"
+)
+
+var ipv6Modes = map[string]bool{
+	ipv6Auto:   true,
+	ipv6Prefer: true,
+	ipv6Only:   true,
+	ipv6Off:    true,
+}
+
+const (
+	// happyEyeballsDelay is the head start of the IPv6 servers before the
+	// IPv4 servers queried too (RFC 8305 section 5)
+	happyEyeballsDelay = 100 * time.Millisecond
+
+	// ipv6DemoteFailures is the consecutive IPv6 failures demoting IPv6 in
+	// the auto mode, ipv6DemoteTime is how long it demoted
+	ipv6DemoteFailures = 5
+	ipv6DemoteTime     = 5 * time.Minute
+)
+
+var errNoFamilyServers = errors.New("no servers of the ip family")
+
+// ipv6State follows the IPv6 egress health for the auto mode
+type ipv6State struct {
+	mu sync.Mutex
+
+	failures int
+	until    time.Time
+}
+
+var ipv6Health = &ipv6State{}
+
+// record records an exchange result with an IPv6 server
+func (s *ipv6State) record(ok bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		s.failures = 0
+		s.until = time.Time{}
+		return
+	}
+
+	s.failures++
+
+	if s.failures >= ipv6DemoteFailures && !now.Before(s.until) {
+		if Config().IPv6 == ipv6Auto {
+			log.Warn("IPv6 upstreams failing, IPv6 demoted", "failures", s.failures, "duration", ipv6DemoteTime.String())
+		}
+
+		s.failures = 0
+		s.until = now.Add(ipv6DemoteTime)
+	}
+}
+
+// demoted reports whether IPv6 demoted
+func (s *ipv6State) demoted(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return now.Before(s.until)
+}
+
+// useIPv4 reports whether the IPv4 servers queried
+func useIPv4() bool {
+	return Config().IPv6 != ipv6Only
+}
+
+// useIPv6 reports whether the IPv6 servers queried
+func useIPv6() bool {
+	switch Config().IPv6 {
+	case ipv6Off:
+		return false
+	case ipv6Auto:
+		return !ipv6Health.demoted(time.Now())
+	}
+
+	return true
+}
+
+// serverFamily returns 4 or 6 by the address of the server, zero when the
+// server dialed by hostname
+func serverFamily(s *cache.AuthServer) int {
+	return addrFamily(s.Addr)
+}
+
+// addrFamily returns 4 or 6 by the ip of the host and port, zero for a hostname
+func addrFamily(addr string) int {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0
+	}
+
+	if ip.To4() != nil {
+		return 4
+	}
+
+	return 6
+}
+
+// splitFamilies splits the servers of the enabled families, the servers dialed
+// by hostname kept with the IPv4 servers
+func splitFamilies(list []*cache.AuthServer) (v4, v6 []*cache.AuthServer) {
+	four, six := useIPv4(), useIPv6()
+
+	for _, s := range list {
+		switch serverFamily(s) {
+		case 4:
+			if four {
+				v4 = append(v4, s)
+			}
+		case 6:
+			if six {
+				v6 = append(v6, s)
+			}
+		default:
+			v4 = append(v4, s)
+		}
+	}
+
+	return v4, v6
+}
+
+// race queries the first servers and the second servers after the head start
+// or the failure of the first servers, the first answer returned
+func (r *Resolver) race(c *dns.Client, req *dns.Msg, first, second []*cache.AuthServer) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	ch := make(chan result, 2)
+
+	run := func(c *dns.Client, req *dns.Msg, list []*cache.AuthServer) {
+		resp, err := r.lookupList(c, req, list)
+		ch <- result{resp, err}
+	}
+
+	go run(copyClient(c), req.Copy(), first)
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	pending, started := 1, false
+
+	var last result
+
+	for {
+		select {
+		case res := <-ch:
+			pending--
+
+			if res.err == nil {
+				return res.resp, nil
+			}
+
+			last = res
+
+			if !started {
+				started = true
+				pending++
+
+				go run(copyClient(c), req.Copy(), second)
+
+				continue
+			}
+
+			if pending == 0 {
+				return last.resp, last.err
+			}
+		case <-timer.C:
+			if !started {
+				started = true
+				pending++
+
+				go run(copyClient(c), req.Copy(), second)
+			}
+		}
+	}
+}
+
+// copyClient returns a copy of the client for the parallel exchanges, the
+// exchange may switch the network of the client
+func copyClient(c *dns.Client) *dns.Client {
+	cc := &dns.Client{
+		Net:          c.Net,
+		UDPSize:      c.UDPSize,
+		TLSConfig:    c.TLSConfig,
+		Timeout:      c.Timeout,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		HTTPClient:   c.HTTPClient,
+	}
+
+	if c.Dialer != nil {
+		d := *c.Dialer
+		cc.Dialer = &d
+	}
+
+	return cc
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ipv6State(t *testing.T) {
+	s := &ipv6State{}
+	now := time.Now()
+
+	for i := 0; i < ipv6DemoteFailures-1; i++ {
+		s.record(false, now)
+	}
+	assert.False(t, s.demoted(now))
+
+	s.record(true, now)
+	for i := 0; i < ipv6DemoteFailures-1; i++ {
+		s.record(false, now)
+	}
+	assert.False(t, s.demoted(now))
+
+	s.record(false, now)
+	assert.True(t, s.demoted(now))
+	assert.False(t, s.demoted(now.Add(ipv6DemoteTime)))
+
+	s.record(false, now)
+	s.record(true, now)
+	assert.False(t, s.demoted(now))
+}
+
+func Test_splitFamilies(t *testing.T) {
+	defer func(mode string) { Config().IPv6 = mode }(Config().IPv6)
+
+	list := newAuthServers([]string{"192.0.2.1:53", "[2001:db8::1]:53", "https://dns.example.com/dns-query"})
+
+	tests := []struct {
+		mode   string
+		v4, v6 int
+	}{
+		{ipv6Prefer, 2, 1},
+		{ipv6Only, 1, 1},
+		{ipv6Off, 2, 0},
+	}
+
+	for _, tt := range tests {
+		Config().IPv6 = tt.mode
+
+		v4, v6 := splitFamilies(list)
+		assert.Len(t, v4, tt.v4, tt.mode)
+		assert.Len(t, v6, tt.v6, tt.mode)
+	}
+}
+
+func Test_handlerIPv6Only(t *testing.T) {
+	defer func(mode string) { Config().IPv6 = mode }(Config().IPv6)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"v4": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "v4")
+
+	req := new(dns.Msg)
+	req.SetQuestion("only.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	Config().IPv6 = ipv6Only
+
+	resp := handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	req.SetQuestion("off.example.com.", dns.TypeA)
+
+	Config().IPv6 = ipv6Off
+
+	resp = handler.query("udp", req.Copy(), entry)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func Test_resolverHappyEyeballs(t *testing.T) {
+	defer func(mode string) { Config().IPv6 = mode }(Config().IPv6)
+	Config().IPv6 = ipv6Prefer
+
+	ipv6Health.record(true, time.Now())
+
+	pc, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available")
+	}
+
+	slow := make(chan struct{})
+
+	v6 := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		<-slow
+	})}
+	go v6.ActivateAndServe()
+	defer v6.Shutdown()
+	defer close(slow)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.4")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	v4, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer v4.Shutdown()
+
+	servers := &cache.AuthServers{List: newAuthServers([]string{pc.LocalAddr().String(), addrstr})}
+
+	req := new(dns.Msg)
+	req.SetQuestion("race.example.com.", dns.TypeA)
+
+	r := NewResolver()
+
+	start := time.Now()
+
+	resp, err := r.lookup("udp", req, servers)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Len(t, resp.Answer, 1)
+	}
+
+	// the ipv6 server never answers
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < Config().Timeout.Duration, elapsed.String())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/semihalev/sdns/cache"
+	"github.com/yl2chen/cidranger"
+)
+
+// listener names of the access policies
+const (
+	listenerDNS  = "dns"
+	listenerTLS  = "tls"
+	listenerDOH  = "doh"
+	listenerDOQ  = "doq"
+	listenerGRPC = "grpc"
+)
+
+var listenerNames = map[string]bool{
+	listenerDNS:  true,
+	listenerTLS:  true,
+	listenerDOH:  true,
+	listenerDOQ:  true,
+	listenerGRPC: true,
+}
+
+// listenerConfig is the access list and the client rate limit of a
+// listener overriding the global ones
+type listenerConfig struct {
+	AccessList           []string
+	AccessRules          []accessRule
+	ClientRateLimit      int
+	ClientRateLimitBurst int
+	ClientRateLimitHard  int
+}
+
+// listenerPolicy is the access policy of a listener; the global access list
+// used if access nil, the global rate limiter if limit false
+type listenerPolicy struct {
+	access cidranger.Ranger
+
+	limit   bool
+	limiter *cache.ClientLimiter
+}
+
+var (
+	listenerPolicies   map[string]*listenerPolicy
+	listenerPoliciesMu sync.RWMutex
+)
+
+// newListenerPolicies returns the access policies of the listeners. The
+// listeners without an access list or access rules use the global access
+// list, the ones without a client rate limit the global rate limiter, a
+// negative rate disables the rate limiting of the listener.
+func newListenerPolicies(listeners map[string]listenerConfig, groups map[string][]string) (map[string]*listenerPolicy, error) {
+	policies := make(map[string]*listenerPolicy)
+
+	for name, l := range listeners {
+		if !listenerNames[name] {
+			return nil, fmt.Errorf("listener unknown: %s", name)
+		}
+
+		p := new(listenerPolicy)
+
+		if len(l.AccessList) > 0 || len(l.AccessRules) > 0 {
+			ranger, err := newAccessList(l.AccessList, l.AccessRules, groups)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %s", name, err)
+			}
+
+			p.access = ranger
+		}
+
+		if l.ClientRateLimit != 0 {
+			p.limit = true
+
+			if l.ClientRateLimit > 0 {
+				p.limiter = cache.NewClientLimiter(l.ClientRateLimit, l.ClientRateLimitBurst, l.ClientRateLimitHard, clientLimiterSize)
+			}
+		}
+
+		policies[name] = p
+	}
+
+	return policies, nil
+}
+
+// listenerPolicyOf returns the access policy of the listener, nil for the
+// listeners using the global ones
+func listenerPolicyOf(listener []string) *listenerPolicy {
+	if len(listener) == 0 {
+		return nil
+	}
+
+	listenerPoliciesMu.RLock()
+	defer listenerPoliciesMu.RUnlock()
+
+	return listenerPolicies[listener[0]]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func setListenerPolicies(t *testing.T, listeners map[string]listenerConfig) {
+	policies, err := newListenerPolicies(listeners, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	listenerPoliciesMu.Lock()
+	listenerPolicies = policies
+	listenerPoliciesMu.Unlock()
+}
+
+func Test_newListenerPolicies(t *testing.T) {
+	policies, err := newListenerPolicies(map[string]listenerConfig{
+		listenerDOH: {AccessList: []string{"0.0.0.0/0"}, ClientRateLimit: 10},
+		listenerTLS: {ClientRateLimit: -1},
+		listenerDNS: {},
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NotNil(t, policies[listenerDOH].access)
+	assert.True(t, policies[listenerDOH].limit)
+	assert.NotNil(t, policies[listenerDOH].limiter)
+
+	assert.Nil(t, policies[listenerTLS].access)
+	assert.True(t, policies[listenerTLS].limit)
+	assert.Nil(t, policies[listenerTLS].limiter)
+
+	assert.Nil(t, policies[listenerDNS].access)
+	assert.False(t, policies[listenerDNS].limit)
+
+	_, err = newListenerPolicies(map[string]listenerConfig{"http": {}}, nil)
+	assert.Error(t, err)
+
+	_, err = newListenerPolicies(map[string]listenerConfig{listenerDOQ: {AccessList: []string{"10.0.0.0"}}}, nil)
+	assert.Error(t, err)
+
+	_, err = newListenerPolicies(map[string]listenerConfig{
+		listenerDOQ: {AccessRules: []accessRule{{CIDR: "10.0.0.0/8", Action: "upstream", Upstream: "missing"}}},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func Test_listenerAccess(t *testing.T) {
+	ranger, err := newAccessList([]string{"10.0.0.0/8"}, nil, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+
+		setListenerPolicies(t, nil)
+		setupClientLimiter(&config{})
+	}()
+
+	setListenerPolicies(t, map[string]listenerConfig{
+		listenerDOH: {AccessList: []string{"0.0.0.0/0"}, AccessRules: []accessRule{{CIDR: "10.1.0.0/16", Action: "deny"}}},
+		listenerTLS: {ClientRateLimit: -1},
+		listenerDOQ: {ClientRateLimit: 1, ClientRateLimitHard: 2},
+	})
+
+	// the global list used by the listeners not overridden
+	assert.Nil(t, accessEntry("192.0.2.1"))
+	assert.Nil(t, accessEntry("192.0.2.1", listenerDNS))
+	assert.Nil(t, accessEntry("192.0.2.1", listenerTLS))
+	assert.NotNil(t, accessEntry("10.1.0.1", listenerTLS))
+
+	if entry := accessEntry("192.0.2.1", listenerDOH); assert.NotNil(t, entry) {
+		assert.Equal(t, ActionAllow, entry.Action)
+	}
+
+	if entry := accessEntry("10.1.0.1", listenerDOH); assert.NotNil(t, entry) {
+		assert.Equal(t, ActionDeny, entry.Action)
+	}
+
+	setupClientLimiter(&config{ClientRateLimit: 1, ClientRateLimitHard: 1})
+
+	// the global limiter, disabled and own limiters of the listeners
+	assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.1", listenerDNS))
+	assert.Equal(t, cache.LimitDrop, limitClient("192.0.2.1", listenerDOH))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.1", listenerTLS))
+	}
+
+	assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.1", listenerDOQ))
+	assert.Equal(t, cache.LimitSlip, limitClient("192.0.2.1", listenerDOQ))
+	assert.Equal(t, cache.LimitDrop, limitClient("192.0.2.1", listenerDOQ))
+}
+
+func Test_HandlerListenerAccess(t *testing.T) {
+	defer setSinkhole("192.0.2.10", "", "blocked.mynet.")()
+
+	ranger, err := newAccessList([]string{"10.0.0.0/8"}, nil, nil)
+	assert.NoError(t, err)
+
+	accessListMu.Lock()
+	old := AccessList
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	defer func() {
+		accessListMu.Lock()
+		AccessList = old
+		accessListMu.Unlock()
+
+		setListenerPolicies(t, nil)
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.AccessDeniedMode = accessDeniedRefused })()
+
+	setListenerPolicies(t, map[string]listenerConfig{
+		listenerTLS: {AccessList: []string{"192.0.2.0/24"}},
+		listenerDOH: {AccessList: []string{"198.51.100.0/24"}},
+	})
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("page.blocked.mynet.", dns.TypeA)
+	req.RecursionDesired = true
+
+	query := func(listener string) *dns.Msg {
+		w := &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		handler.handle("tcp", w, req.Copy(), listener)
+
+		return w.msg
+	}
+
+	// the client refused on the plain listener, answered on the tls one
+	if msg := query(listenerDNS); assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+	}
+
+	if msg := query(listenerTLS); assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		assert.Len(t, msg.Answer, 1)
+	}
+
+	data, err := req.Pack()
+	assert.NoError(t, err)
+
+	// the https client address 192.0.2.1 out of the doh list
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	setListenerPolicies(t, map[string]listenerConfig{
+		listenerDOH: {AccessList: []string{"192.0.2.0/24"}},
+	})
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxLocalCNAME is the maximum CNAME chain followed in a local zone
+const maxLocalCNAME = 8
+
+// Zones holds the local zones answered authoritatively
+type Zones struct {
+	mu sync.RWMutex
+
+	zones map[string]*localZone
+}
+
+// localZone is the records of a zone by the lower case owner names and types
+type localZone struct {
+	origin string
+	soa    *dns.SOA
+
+	// records of the owners, the empty non-terminals have no types
+	records map[string]map[uint16][]dns.RR
+}
+
+// NewZones returns a new empty local zones
+func NewZones() *Zones {
+	return &Zones{zones: make(map[string]*localZone)}
+}
+
+// Load replaces the zones with the given zone files by the origins, the old
+// zones kept when any file failed
+func (z *Zones) Load(files map[string]string) error {
+	zones, err := loadLocalZones(files)
+	if err != nil {
+		return err
+	}
+
+	z.set(zones)
+
+	return nil
+}
+
+// set replaces the zones with the loaded ones
+func (z *Zones) set(zones map[string]*localZone) {
+	z.mu.Lock()
+	z.zones = zones
+	z.mu.Unlock()
+}
+
+// loadLocalZones parses the zone files by the origins
+func loadLocalZones(files map[string]string) (map[string]*localZone, error) {
+	zones := make(map[string]*localZone, len(files))
+
+	for origin, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("local zone file open failed: %s", err)
+		}
+
+		lz, err := parseLocalZone(file, origin, path)
+		file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("local zone file parse failed: %s", err)
+		}
+
+		zones[lz.origin] = lz
+	}
+
+	return zones, nil
+}
+
+// Origins returns the sorted origins of the zones
+func (z *Zones) Origins() []string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	origins := make([]string, 0, len(z.zones))
+	for origin := range z.zones {
+		origins = append(origins, origin)
+	}
+
+	sort.Strings(origins)
+
+	return origins
+}
+
+func parseLocalZone(r io.Reader, origin, file string) (*localZone, error) {
+	lz := &localZone{
+		origin:  dns.Fqdn(strings.ToLower(origin)),
+		records: make(map[string]map[uint16][]dns.RR),
+	}
+
+	var err error
+
+	for t := range dns.ParseZone(r, lz.origin, file) {
+		if err != nil {
+			// drains the parser
+			continue
+		}
+
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+
+		err = lz.add(t.RR)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if lz.soa == nil {
+		return nil, fmt.Errorf("%s: zone %s has no SOA record", file, lz.origin)
+	}
+
+	return lz, nil
+}
+
+func (lz *localZone) add(rr dns.RR) error {
+	h := rr.Header()
+	owner := strings.ToLower(h.Name)
+
+	if !dns.IsSubDomain(lz.origin, owner) {
+		return fmt.Errorf("record out of zone %s: %s", lz.origin, h.Name)
+	}
+
+	if h.Class != dns.ClassINET {
+		return nil
+	}
+
+	if soa, ok := rr.(*dns.SOA); ok {
+		if owner != lz.origin {
+			return fmt.Errorf("SOA record not at the zone apex %s: %s", lz.origin, h.Name)
+		}
+
+		lz.soa = soa
+	}
+
+	types, ok := lz.records[owner]
+	if !ok {
+		types = make(map[uint16][]dns.RR)
+		lz.records[owner] = types
+	}
+
+	types[h.Rrtype] = append(types[h.Rrtype], rr)
+
+	// the parents exist as the empty non-terminals
+	for off, end := dns.NextLabel(owner, 0); !end; off, end = dns.NextLabel(owner, off) {
+		parent := owner[off:]
+		if !dns.IsSubDomain(lz.origin, parent) {
+			break
+		}
+
+		if _, ok := lz.records[parent]; !ok {
+			lz.records[parent] = make(map[uint16][]dns.RR)
+		}
+	}
+
+	return nil
+}
+
+// match returns the zone of the longest origin of the name
+func (z *Zones) match(name string) *localZone {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if len(z.zones) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(name)
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if lz, ok := z.zones[name[off:]]; ok {
+			return lz
+		}
+	}
+
+	return z.zones["."]
+}
+
+// Answer returns the authoritative response for the queries of the names in
+// the local zones, nil for the other names
+func (z *Zones) Answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	lz := z.match(q.Name)
+	if lz == nil {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	name := q.Name
+
+	for i := 0; i < maxLocalCNAME; i++ {
+		rrs, exists := lz.lookup(name, q.Qtype)
+		if !exists {
+			// the rcode of the last name in the chain (RFC 6604 section 3)
+			msg.Rcode = dns.RcodeNameError
+			msg.Ns = append(msg.Ns, lz.negativeSOA())
+
+			return msg
+		}
+
+		if len(rrs) > 0 {
+			msg.Answer = append(msg.Answer, rrs...)
+
+			if q.Qtype == dns.TypeNS && strings.ToLower(name) == lz.origin {
+				msg.Extra = append(msg.Extra, lz.glue(rrs)...)
+			}
+
+			return msg
+		}
+
+		cname, _ := lz.lookup(name, dns.TypeCNAME)
+		if q.Qtype == dns.TypeCNAME || len(cname) == 0 {
+			// no data
+			msg.Ns = append(msg.Ns, lz.negativeSOA())
+
+			return msg
+		}
+
+		msg.Answer = append(msg.Answer, cname...)
+
+		target := cname[0].(*dns.CNAME).Target
+		if !dns.IsSubDomain(lz.origin, strings.ToLower(target)) {
+			// the target out of the zone resolved by the client
+			return msg
+		}
+
+		name = target
+	}
+
+	return msg
+}
+
+// lookup returns the records of the name and type with the owner of the
+// query, reports whether the name exists. The wildcard records used for
+// the names not exist.
+func (lz *localZone) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	owner := strings.ToLower(name)
+
+	types, ok := lz.records[owner]
+	if !ok {
+		types, ok = lz.wildcard(owner)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	list := types[qtype]
+	rrs := make([]dns.RR, 0, len(list))
+
+	for _, rr := range list {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, true
+}
+
+// wildcard returns the wildcard records of the closest encloser of the name
+// (RFC 4592 section 3.3.1)
+func (lz *localZone) wildcard(owner string) (map[uint16][]dns.RR, bool) {
+	for off, end := dns.NextLabel(owner, 0); !end; off, end = dns.NextLabel(owner, off) {
+		encloser := owner[off:]
+		if !dns.IsSubDomain(lz.origin, encloser) {
+			break
+		}
+
+		if _, ok := lz.records[encloser]; !ok {
+			continue
+		}
+
+		types, ok := lz.records["*."+encloser]
+
+		return types, ok
+	}
+
+	return nil, false
+}
+
+// negativeSOA returns the SOA record for the negative answers, TTL is the
+// lower of the SOA TTL and its MINIMUM field (RFC 2308 section 3)
+func (lz *localZone) negativeSOA() dns.RR {
+	soa := dns.Copy(lz.soa).(*dns.SOA)
+
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+// glue returns the in zone addresses of the name servers
+func (lz *localZone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+
+	for _, rr := range ns {
+		host := strings.ToLower(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(lz.origin, host) {
+			continue
+		}
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			addrs, _ := lz.lookup(host, qtype)
+			extra = append(extra, addrs...)
+		}
+	}
+
+	return extra
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLocalZone = `$TTL 300
+@         SOA   ns1 hostmaster 1 3600 600 86400 60
+@         NS    ns1
+ns1       A     192.168.1.1
+www       A     192.168.1.10
+www       AAAA  fd00::10
+alias     CNAME www
+external  CNAME www.example.com.
+dangling  CNAME missing
+a.b       TXT   "deep"
+*.wild    A     192.168.1.20
+`
+
+const testSubZone = `$TTL 300
+@         SOA   ns1.home.arpa. hostmaster.home.arpa. 1 3600 600 86400 60
+@         NS    ns1.home.arpa.
+host      A     10.1.0.1
+`
+
+func writeLocalZones(t *testing.T) (string, map[string]string) {
+	dir, err := ioutil.TempDir("", "sdns_localzone")
+	assert.NoError(t, err)
+
+	home := filepath.Join(dir, "home.arpa.zone")
+	lab := filepath.Join(dir, "lab.home.arpa.zone")
+
+	assert.NoError(t, ioutil.WriteFile(home, []byte(testLocalZone), 0644))
+	assert.NoError(t, ioutil.WriteFile(lab, []byte(testSubZone), 0644))
+
+	return dir, map[string]string{"home.arpa": home, "Lab.Home.Arpa.": lab}
+}
+
+func Test_LocalZones(t *testing.T) {
+	dir, files := writeLocalZones(t)
+	defer os.RemoveAll(dir)
+
+	z := NewZones()
+	assert.NoError(t, z.Load(files))
+	assert.Equal(t, []string{"home.arpa.", "lab.home.arpa."}, z.Origins())
+
+	req := new(dns.Msg)
+
+	req.SetQuestion("WWW.home.arpa.", dns.TypeA)
+	msg := z.Answer(req)
+	assert.True(t, msg.Authoritative)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "WWW.home.arpa.", msg.Answer[0].Header().Name)
+		assert.Equal(t, "192.168.1.10", msg.Answer[0].(*dns.A).A.String())
+	}
+
+	req.SetQuestion("home.arpa.", dns.TypeSOA)
+	msg = z.Answer(req)
+	assert.Len(t, msg.Answer, 1)
+	assert.Len(t, msg.Ns, 0)
+
+	req.SetQuestion("home.arpa.", dns.TypeNS)
+	msg = z.Answer(req)
+	assert.Len(t, msg.Answer, 1)
+	if assert.Len(t, msg.Extra, 1) {
+		assert.Equal(t, "192.168.1.1", msg.Extra[0].(*dns.A).A.String())
+	}
+
+	// no data
+	req.SetQuestion("www.home.arpa.", dns.TypeMX)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+	if assert.Len(t, msg.Ns, 1) {
+		assert.Equal(t, dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+		assert.Equal(t, uint32(60), msg.Ns[0].Header().Ttl)
+	}
+
+	// empty non-terminal
+	req.SetQuestion("b.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Ns, 1)
+
+	req.SetQuestion("missing.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Len(t, msg.Ns, 1)
+
+	req.SetQuestion("alias.home.arpa.", dns.TypeAAAA)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	if assert.Len(t, msg.Answer, 2) {
+		assert.Equal(t, dns.TypeCNAME, msg.Answer[0].Header().Rrtype)
+		assert.Equal(t, "fd00::10", msg.Answer[1].(*dns.AAAA).AAAA.String())
+	}
+
+	req.SetQuestion("alias.home.arpa.", dns.TypeCNAME)
+	msg = z.Answer(req)
+	assert.Len(t, msg.Answer, 1)
+
+	req.SetQuestion("external.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Len(t, msg.Answer, 1)
+	assert.Len(t, msg.Ns, 0)
+
+	req.SetQuestion("dangling.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Len(t, msg.Answer, 1)
+
+	req.SetQuestion("x.y.wild.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "x.y.wild.home.arpa.", msg.Answer[0].Header().Name)
+	}
+
+	// the longest origin matches
+	req.SetQuestion("host.lab.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Len(t, msg.Answer, 1)
+
+	req.SetQuestion("www.lab.home.arpa.", dns.TypeA)
+	msg = z.Answer(req)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.Nil(t, z.Answer(req))
+
+	req.SetQuestion("www.home.arpa.", dns.TypeA)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	assert.Nil(t, z.Answer(req))
+
+	assert.Error(t, z.Load(map[string]string{"home.arpa": filepath.Join(dir, "notfound.zone")}))
+	assert.Len(t, z.Origins(), 2)
+
+	assert.NoError(t, z.Load(nil))
+	assert.Len(t, z.Origins(), 0)
+}
+
+func Test_parseLocalZone(t *testing.T) {
+	_, err := parseLocalZone(strings.NewReader("www 300 IN A 192.0.2.1\n"), "example.com", "nosoa.zone")
+	assert.Error(t, err)
+
+	_, err = parseLocalZone(strings.NewReader(testLocalZone+"www.example.com. 300 IN A 192.0.2.1\n"), "home.arpa", "outofzone.zone")
+	assert.Error(t, err)
+
+	_, err = parseLocalZone(strings.NewReader(testLocalZone+"sub 300 IN SOA ns1 hostmaster 1 3600 600 86400 60\n"), "home.arpa", "soa.zone")
+	assert.Error(t, err)
+
+	_, err = parseLocalZone(strings.NewReader("@ 300 IN A 192.0.2.300\n"), "home.arpa", "invalid.zone")
+	assert.Error(t, err)
+}
+
+func Test_HandlerLocalZones(t *testing.T) {
+	dir, files := writeLocalZones(t)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, LocalZones.Load(files))
+	defer LocalZones.Load(nil)
+
+	BlockList.SetManual("www.home.arpa.")
+	defer BlockList.Remove("www.home.arpa.")
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.home.arpa.", dns.TypeA)
+	req.RecursionDesired = true
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.168.1.10", resp.Answer[0].(*dns.A).A.String())
+	}
+	assert.NotNil(t, resp.IsEdns0())
+
+	req.SetQuestion("nothere.home.arpa.", dns.TypeA)
+	resp = handler.query("udp", req)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+}
@@ -1,29 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
 	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/rpz"
 	"github.com/yl2chen/cidranger"
 )
 
 var (
-	// Config is the global configuration
-	Config config
+	// currentConfig holds the active *config, it is swapped atomically on reload
+	currentConfig atomic.Value
 
 	// Version returns the build version of sdns, this should be incremented every new release
 	Version = "0.2.2"
 
 	// ConfigVersion returns the version of sdns, this should be incremented every time the config changes so sdns presents a warning
-	ConfigVersion = "0.2.1"
+	ConfigVersion = "0.2.2"
 
 	// ConfigPath returns the configuration path
 	ConfigPath = flag.String("config", "sdns.toml", "location of the config file, if not found it will be generated")
@@ -34,105 +40,652 @@ var (
 	// AccessList returns created CIDR rangers
 	AccessList cidranger.Ranger
 
+	accessListMu sync.RWMutex
+
 	// BlockList returns BlockCache
 	BlockList = cache.NewBlockCache()
+
+	// TrustList returns the validated chains of trust by zone
+	TrustList = cache.NewTrustCache()
+
+	// NegativeAnchors returns the zones not validated
+	NegativeAnchors = NewNTAs()
+
+	// LocalHosts returns the local name overrides
+	LocalHosts = NewHosts()
+
+	// LocalZones returns the authoritative local zones
+	LocalZones = NewZones()
+
+	// ResponsePolicy returns the response policy zones
+	ResponsePolicy = rpz.New()
 )
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	currentConfig.Store(new(config))
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, "OPTIONS:")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "USAGE:")
 		fmt.Fprintln(os.Stderr, "./sdns -config=sdns.toml")
+		fmt.Fprintln(os.Stderr, "./sdns -config=sdns.toml -check")
+		fmt.Fprintln(os.Stderr, "./sdns -config=sdns.toml -migrate-config")
 		fmt.Fprintln(os.Stderr, "")
 	}
 }
 
-func configSetup(test bool) {
-	if err := LoadConfig(*ConfigPath); err != nil {
-		log.Crit("Config loading failed", "error", err.Error())
+// Config returns the active configuration
+func Config() *config {
+	return currentConfig.Load().(*config)
+}
+
+func newAuthServers(hosts []string) []*cache.AuthServer {
+	list := []*cache.AuthServer{}
+	for _, s := range hosts {
+		list = append(list, cache.NewAuthServer(s))
+	}
+
+	return list
+}
+
+func setAuthServers(servers *cache.AuthServers, list []*cache.AuthServer) {
+	servers.Lock()
+	servers.List = list
+	servers.Unlock()
+}
+
+// configSetup loads and validates the config file, the active config is
+// replaced only when everything is valid.
+func configSetup(test bool) error {
+	cfg, err := LoadConfig(*ConfigPath)
+	if err != nil {
+		return err
 	}
 
 	if test {
-		Config.Bind = ":0"
-		Config.BindTLS = ""
-		Config.BindDOH = ""
-		Config.API = "127.0.0.1:11111"
-		Config.LogLevel = "crit"
-		Config.Timeout.Duration = time.Second
+		cfg.Bind = ":0"
+		cfg.BindTLS = ""
+		cfg.BindDOH = ""
+		cfg.API = "127.0.0.1:11111"
+		cfg.LogLevel = "crit"
+		cfg.Timeout.Duration = time.Second
 	}
 
-	lvl, err := log.LvlFromString(Config.LogLevel)
+	lvl, err := log.LvlFromString(cfg.LogLevel)
 	if err != nil {
-		log.Crit("Log verbosity level unknown")
+		return fmt.Errorf("log verbosity level unknown")
 	}
 
-	log.Root().SetHandler(log.LvlFilterHandler(lvl, log.StdoutHandler))
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		return errs[0]
+	}
+
+	keys, err := parseRootKeys(cfg.RootKeys)
+	if err != nil {
+		return err
+	}
 
-	if len(Config.RootServers) > 0 {
-		rootservers = &cache.AuthServers{}
-		for _, s := range Config.RootServers {
-			rootservers.List = append(rootservers.List, cache.NewAuthServer(s))
+	// the key pair validated before the swap, the listeners restarted on a
+	// reload never left without a certificate
+	if tlsListening(cfg) {
+		if _, err := newCertStore(cfg.TLSCertificate, cfg.TLSPrivateKey); err != nil {
+			return fmt.Errorf("tls certificate invalid: %s", err)
 		}
 	}
 
-	if len(Config.Root6Servers) > 0 {
-		root6servers = &cache.AuthServers{}
-		for _, s := range Config.Root6Servers {
-			root6servers.List = append(root6servers.List, cache.NewAuthServer(s))
+	bootServers, err := parseBootstrapServers(cfg.BootstrapServers)
+	if err != nil {
+		return err
+	}
+
+	ranger, err := newAccessList(cfg.AccessList, cfg.AccessRules, cfg.UpstreamGroups)
+	if err != nil {
+		return err
+	}
+
+	listeners, err := newListenerPolicies(cfg.Listeners, cfg.UpstreamGroups)
+	if err != nil {
+		return err
+	}
+
+	blockRanges, err := newBlockIPRanges(cfg.BlockIPRanges)
+	if err != nil {
+		return err
+	}
+
+	proxies, err := newTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	forwarders, err := newForwardZones(cfg.ForwardZones)
+	if err != nil {
+		return err
+	}
+
+	rewriters, err := newRewriteRules(cfg.RewriteRules)
+	if err != nil {
+		return err
+	}
+
+	chain, err := newQueryChain(cfg.Middleware)
+	if err != nil {
+		return err
+	}
+
+	policies, err := newZoneCachePolicies(cfg.ZoneCachePolicy)
+	if err != nil {
+		return err
+	}
+
+	tcpTypes, err := newForceTCPTypes(cfg.ForceTCPTypes)
+	if err != nil {
+		return err
+	}
+
+	qtypes, err := newQTypeACL(cfg.AllowedQTypes, cfg.DeniedQTypes)
+	if err != nil {
+		return err
+	}
+
+	sorts, err := newSortNets(cfg.SortList)
+	if err != nil {
+		return err
+	}
+
+	sources, err := newOutboundAddrs(cfg.OutboundIPs, cfg.OutboundInterface)
+	if err != nil {
+		return err
+	}
+
+	reverseExcludes, err := newPrivateReverseExcludes(cfg.PrivateReverseExclude)
+	if err != nil {
+		return err
+	}
+
+	dns64State, err := newDNS64State(cfg)
+	if err != nil {
+		return err
+	}
+
+	hosts, err := loadHosts(cfg.HostsFile)
+	if err != nil {
+		return err
+	}
+
+	rpzZones, err := rpz.LoadZones(cfg.RPZFiles...)
+	if err != nil {
+		return err
+	}
+
+	localZones, err := loadLocalZones(cfg.LocalZones)
+	if err != nil {
+		return err
+	}
+
+	ntas, err := parseNTAs(cfg.NegativeTrustAnchors)
+	if err != nil {
+		return err
+	}
+
+	log.Root().SetHandler(log.LvlFilterHandler(lvl, log.StdoutHandler))
+
+	currentConfig.Store(cfg)
+
+	setBootstrapServers(bootServers)
+
+	dns64Mu.Lock()
+	dns64 = dns64State
+	dns64Mu.Unlock()
+
+	LocalHosts.set(hosts)
+
+	ResponsePolicy.Set(rpzZones)
+
+	LocalZones.set(localZones)
+
+	NegativeAnchors.setConfigured(ntas)
+
+	if len(cfg.RootServers) > 0 {
+		setAuthServers(rootservers, newAuthServers(cfg.RootServers))
+	}
+
+	if len(cfg.Root6Servers) > 0 {
+		setAuthServers(root6servers, newAuthServers(cfg.Root6Servers))
+	}
+
+	if len(cfg.FallbackServers) > 0 {
+		setAuthServers(fallbackservers, newAuthServers(cfg.FallbackServers))
+	}
+
+	if len(keys) > 0 && !managedAnchors() {
+		rootkeysMu.Lock()
+		rootkeys = keys
+		rootkeysMu.Unlock()
+	}
+
+	setupDnstap(cfg.DnstapSocket)
+
+	setupQueryLogFile(cfg)
+
+	setupClientLimiter(cfg)
+
+	setupQueryLimiter(cfg)
+
+	cache.RttWeighting = cfg.RttWeighting
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(cfg.UpstreamGroups)
+	upstreamGroupsMu.Unlock()
+
+	metricServersMu.Lock()
+	metricServers = newMetricServers(cfg)
+	metricServersMu.Unlock()
+
+	forwardZonesMu.Lock()
+	forwardZones = forwarders
+	forwardZonesMu.Unlock()
+
+	rewriteRulesMu.Lock()
+	rewriteRules = rewriters
+	rewriteRulesMu.Unlock()
+
+	queryChainMu.Lock()
+	queryChain = chain
+	queryChainMu.Unlock()
+
+	zoneCachePoliciesMu.Lock()
+	zoneCachePolicies = policies
+	zoneCachePoliciesMu.Unlock()
+
+	forceTCPTypesMu.Lock()
+	forceTCPTypes = tcpTypes
+	forceTCPTypesMu.Unlock()
+
+	qtypePolicyMu.Lock()
+	qtypePolicy = qtypes
+	qtypePolicyMu.Unlock()
+
+	sortNetsMu.Lock()
+	sortNets = sorts
+	sortNetsMu.Unlock()
+
+	outboundMu.Lock()
+	outbound = sources
+	outboundMu.Unlock()
+
+	privateReverseExcludesMu.Lock()
+	privateReverseExcludes = reverseExcludes
+	privateReverseExcludesMu.Unlock()
+
+	accessListMu.Lock()
+	AccessList = ranger
+	accessListMu.Unlock()
+
+	listenerPoliciesMu.Lock()
+	listenerPolicies = listeners
+	listenerPoliciesMu.Unlock()
+
+	blockIPRangesMu.Lock()
+	BlockIPRanges = blockRanges
+	blockIPRangesMu.Unlock()
+
+	trustedProxiesMu.Lock()
+	TrustedProxies = proxies
+	trustedProxiesMu.Unlock()
+
+	return nil
+}
+
+// parseRootKeys parses the trust anchors of the root zone
+func parseRootKeys(list []string) ([]dns.RR, error) {
+	keys := []dns.RR{}
+	for _, k := range list {
+		rr, err := dns.NewRR(k)
+		if err != nil {
+			return nil, fmt.Errorf("root keys invalid: %s", err)
 		}
+		keys = append(keys, rr)
 	}
 
-	if len(Config.FallbackServers) > 0 {
-		fallbackservers = &cache.AuthServers{}
-		for _, s := range Config.FallbackServers {
-			fallbackservers.List = append(fallbackservers.List, cache.NewAuthServer(s))
+	return keys, nil
+}
+
+// validateConfig sets the defaults and the bounds of the settings, returns
+// the problems found without touching the active config
+func validateConfig(cfg *config) []error {
+	var errs []error
+
+	for _, host := range append(cfg.RootServers, cfg.FallbackServers...) {
+		if _, err := cache.ParseAuthServer(host); err != nil {
+			errs = append(errs, fmt.Errorf("server address invalid: %s", host))
 		}
 	}
 
-	if len(Config.RootKeys) > 0 {
-		rootkeys = []dns.RR{}
-		for _, k := range Config.RootKeys {
-			rr, err := dns.NewRR(k)
-			if err != nil {
-				log.Crit("Root keys invalid", "error", err.Error())
-			}
-			rootkeys = append(rootkeys, rr)
+	if err := checkBlocklistSources(cfg.BlockListURLs); err != nil {
+		errs = append(errs, err)
+	}
+
+	cfg.DNSSEC = strings.ToLower(cfg.DNSSEC)
+	if cfg.DNSSEC == "" {
+		cfg.DNSSEC = dnssecValidate
+	}
+
+	if !dnssecModes[cfg.DNSSEC] {
+		errs = append(errs, fmt.Errorf("dnssec mode unknown: %s", cfg.DNSSEC))
+	}
+
+	if cfg.Middleware == nil {
+		cfg.Middleware = defaultMiddleware
+	}
+
+	cfg.BlockResponse = strings.ToLower(cfg.BlockResponse)
+	if cfg.BlockResponse == "" {
+		cfg.BlockResponse = blockZeroIP
+	}
+
+	if !blockResponses[cfg.BlockResponse] {
+		errs = append(errs, fmt.Errorf("block response mode unknown: %s", cfg.BlockResponse))
+	}
+
+	cfg.IPv6 = strings.ToLower(cfg.IPv6)
+	if cfg.IPv6 == "" {
+		cfg.IPv6 = ipv6Auto
+	}
+
+	cfg.QueryLogFormat = strings.ToLower(cfg.QueryLogFormat)
+	if cfg.QueryLogFormat == "" {
+		cfg.QueryLogFormat = queryLogText
+	}
+
+	if !queryLogFormats[cfg.QueryLogFormat] {
+		errs = append(errs, fmt.Errorf("query log format unknown: %s", cfg.QueryLogFormat))
+	}
+
+	if cfg.QueryLogMaxSizeMB < 0 {
+		cfg.QueryLogMaxSizeMB = 0
+	}
+
+	if cfg.QueryLogBackups < 0 {
+		cfg.QueryLogBackups = 0
+	}
+
+	if !ipv6Modes[cfg.IPv6] {
+		errs = append(errs, fmt.Errorf("ipv6 mode unknown: %s", cfg.IPv6))
+	}
+
+	cfg.TrustedProxyHeader = strings.ToLower(cfg.TrustedProxyHeader)
+	if cfg.TrustedProxyHeader == "" {
+		cfg.TrustedProxyHeader = proxyHeaderXFF
+	}
+
+	if !proxyHeaders[cfg.TrustedProxyHeader] {
+		errs = append(errs, fmt.Errorf("trusted proxy header unknown: %s", cfg.TrustedProxyHeader))
+	}
+
+	cfg.QnameMinimization = strings.ToLower(cfg.QnameMinimization)
+	if cfg.QnameMinimization != "" && !qnameModes[cfg.QnameMinimization] {
+		errs = append(errs, fmt.Errorf("qname minimization mode unknown: %s", cfg.QnameMinimization))
+	}
+
+	cfg.AccessDeniedMode = strings.ToLower(cfg.AccessDeniedMode)
+	if cfg.AccessDeniedMode != "" && !accessDeniedModes[cfg.AccessDeniedMode] {
+		errs = append(errs, fmt.Errorf("access denied mode unknown: %s", cfg.AccessDeniedMode))
+	}
+
+	cfg.AnyQueryMode = strings.ToLower(cfg.AnyQueryMode)
+	if cfg.AnyQueryMode == "" {
+		cfg.AnyQueryMode = anyRefuse
+	}
+
+	if !anyModes[cfg.AnyQueryMode] {
+		errs = append(errs, fmt.Errorf("any query mode unknown: %s", cfg.AnyQueryMode))
+	}
+
+	if cfg.DNS64Prefix == "" {
+		cfg.DNS64Prefix = DefaultDNS64Prefix
+	}
+
+	if cfg.Timeout.Duration < 250*time.Millisecond {
+		cfg.Timeout.Duration = 250 * time.Millisecond
+	}
+
+	if cfg.ConnectTimeout.Duration < 250*time.Millisecond {
+		cfg.ConnectTimeout.Duration = 250 * time.Millisecond
+	}
+
+	// the unset transport timeouts fall through to the timeouts above
+	for _, d := range []*duration{
+		&cfg.UDPTimeout, &cfg.TCPTimeout, &cfg.TLSTimeout, &cfg.DOHTimeout,
+		&cfg.UDPConnectTimeout, &cfg.TCPConnectTimeout, &cfg.TLSConnectTimeout, &cfg.DOHConnectTimeout,
+	} {
+		if d.Duration > 0 && d.Duration < 250*time.Millisecond {
+			d.Duration = 250 * time.Millisecond
 		}
 	}
 
-	if Config.Timeout.Duration < 250*time.Millisecond {
-		Config.Timeout.Duration = 250 * time.Millisecond
+	if cfg.ShutdownTimeout.Duration <= 0 {
+		cfg.ShutdownTimeout.Duration = 10 * time.Second
+	}
+
+	if cfg.UpstreamMaxConns < 1 {
+		cfg.UpstreamMaxConns = DefaultUpstreamMaxConns
+	}
+
+	if cfg.UpstreamIdleTimeout.Duration <= 0 {
+		cfg.UpstreamIdleTimeout.Duration = DefaultUpstreamIdleTimeout
+	}
+
+	if cfg.MaxConcurrentQueries < 0 {
+		cfg.MaxConcurrentQueries = 0
+	}
+
+	if cfg.ConcurrencyWait.Duration < 0 {
+		cfg.ConcurrencyWait.Duration = 0
+	}
+
+	if cfg.RetryOnServfail == 0 {
+		cfg.RetryOnServfail = DefaultServfailRetries
+	}
+
+	if cfg.PrewarmConcurrency < 1 {
+		cfg.PrewarmConcurrency = DefaultPrewarmConcurrency
+	}
+
+	if cfg.CacheSize < 1024 {
+		cfg.CacheSize = 1024
+	}
+
+	if cfg.CacheShards < 1 {
+		cfg.CacheShards = cache.DefaultShards
+	}
+
+	if cfg.CacheShards&(cfg.CacheShards-1) != 0 {
+		errs = append(errs, fmt.Errorf("cacheshards must be a power of two: %d", cfg.CacheShards))
+	}
+
+	if cfg.CacheMaxBytes < 0 {
+		cfg.CacheMaxBytes = 0
+	}
+
+	cfg.CacheBackend = strings.ToLower(cfg.CacheBackend)
+	if cfg.CacheBackend == "" {
+		cfg.CacheBackend = cacheBackendMemory
+	}
+
+	if !cacheBackends[cfg.CacheBackend] {
+		errs = append(errs, fmt.Errorf("cache backend unknown: %s", cfg.CacheBackend))
+	}
+
+	if cfg.RedisAddr == "" {
+		cfg.RedisAddr = DefaultRedisAddr
+	}
+
+	if cfg.RedisPrefix == "" {
+		cfg.RedisPrefix = DefaultRedisPrefix
+	}
+
+	if cfg.SortListProbePort <= 0 || cfg.SortListProbePort > 65535 {
+		cfg.SortListProbePort = DefaultSortListProbePort
+	}
+
+	if cfg.SortListProbeTTL.Duration <= 0 {
+		cfg.SortListProbeTTL.Duration = DefaultSortListProbeTTL
+	}
+
+	if cfg.RedisDB < 0 {
+		errs = append(errs, fmt.Errorf("redisdb invalid: %d", cfg.RedisDB))
+	}
+
+	if cfg.MaxCNAMEDepth < 1 {
+		cfg.MaxCNAMEDepth = 10
+	}
+
+	if cfg.MaxRecursionDepth < 1 {
+		cfg.MaxRecursionDepth = 64
+	}
+
+	if cfg.HealthCheckFailures < 1 {
+		cfg.HealthCheckFailures = 3
+	}
+
+	if cfg.PaddingBlockSize < 1 {
+		cfg.PaddingBlockSize = DefaultPaddingBlockSize
+	}
+
+	if cfg.UDPMinSize < dns.MinMsgSize {
+		cfg.UDPMinSize = DefaultUDPMinSize
+	}
+
+	if cfg.UDPMaxSize < 1 {
+		cfg.UDPMaxSize = DefaultUDPMaxSize
+	}
+
+	if cfg.UDPMaxSize > dns.MaxMsgSize {
+		cfg.UDPMaxSize = dns.MaxMsgSize
+	}
+
+	if cfg.MaxAnswerRecords < 0 {
+		cfg.MaxAnswerRecords = 0
+	}
+
+	if cfg.UDPMinSize > cfg.UDPMaxSize {
+		errs = append(errs, fmt.Errorf("udpminsize must not be greater than udpmaxsize"))
+	}
+
+	if cfg.UpstreamUDPSize < 1 {
+		cfg.UpstreamUDPSize = DefaultUpstreamUDPSize
+	}
+
+	if cfg.UpstreamUDPSize < dns.MinMsgSize {
+		cfg.UpstreamUDPSize = dns.MinMsgSize
+	}
+
+	if cfg.UpstreamUDPSize > maxUpstreamUDPSize {
+		cfg.UpstreamUDPSize = maxUpstreamUDPSize
 	}
 
-	if Config.ConnectTimeout.Duration < 250*time.Millisecond {
-		Config.ConnectTimeout.Duration = 250 * time.Millisecond
+	cfg.UpstreamTransport = strings.ToLower(cfg.UpstreamTransport)
+	if cfg.UpstreamTransport == "" {
+		cfg.UpstreamTransport = transportAuto
 	}
 
-	if Config.CacheSize < 1024 {
-		Config.CacheSize = 1024
+	if !upstreamTransports[cfg.UpstreamTransport] {
+		errs = append(errs, fmt.Errorf("upstream transport unknown: %s", cfg.UpstreamTransport))
 	}
+
+	if cfg.MaxTTL > 0 && cfg.MinTTL > cfg.MaxTTL {
+		errs = append(errs, fmt.Errorf("minttl must not be greater than maxttl"))
+	}
+
+	if err := checkTLSSettings(cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = 3600
+	}
+
+	if cfg.BlockTTL == 0 {
+		cfg.BlockTTL = 60
+	}
+
+	if cfg.SinkholeTTL == 0 {
+		cfg.SinkholeTTL = DefaultSinkholeTTL
+	}
+
+	if ip := net.ParseIP(cfg.SinkholeIP); cfg.SinkholeIP != "" && (ip == nil || ip.To4() == nil) {
+		errs = append(errs, fmt.Errorf("sinkhole ip invalid: %s", cfg.SinkholeIP))
+	}
+
+	if ip := net.ParseIP(cfg.SinkholeIPv6); cfg.SinkholeIPv6 != "" && (ip == nil || ip.To4() != nil) {
+		errs = append(errs, fmt.Errorf("sinkhole ipv6 invalid: %s", cfg.SinkholeIPv6))
+	}
+
+	if cfg.SinkholeZone != "" {
+		cfg.SinkholeZone = strings.ToLower(dns.Fqdn(cfg.SinkholeZone))
+
+		if _, ok := dns.IsDomainName(cfg.SinkholeZone); !ok || cfg.SinkholeZone == rootzone {
+			errs = append(errs, fmt.Errorf("sinkhole zone invalid: %s", cfg.SinkholeZone))
+		}
+
+		if cfg.SinkholeIP == "" && cfg.SinkholeIPv6 == "" {
+			errs = append(errs, fmt.Errorf("sinkhole zone without a sinkhole ip: %s", cfg.SinkholeZone))
+		}
+	}
+
+	if cfg.ECSPrefix < 1 || cfg.ECSPrefix > 32 {
+		cfg.ECSPrefix = 24
+	}
+
+	if cfg.ECSPrefixv6 < 1 || cfg.ECSPrefixv6 > 128 {
+		cfg.ECSPrefixv6 = 56
+	}
+
+	return errs
 }
 
+// fetchBlocklists loads the blocklists once a second after the start and
+// refreshes them on every blocklistrefresh interval when set
 func fetchBlocklists() {
 	timer := time.NewTimer(time.Second)
+	<-timer.C
 
-	select {
-	case <-timer.C:
-		if err := updateBlocklists(Config.BlockListDir); err != nil {
-			log.Error("Update blocklists failed", "error", err.Error())
-		}
+	refreshBlocklists()
 
-		if err := readBlocklists(Config.BlockListDir); err != nil {
-			log.Error("Read blocklists failed", "dir", Config.BlockListDir, "error", err.Error())
-		}
+	interval := Config().BlockListRefresh.Duration
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Info("Refreshing blocklists", "interval", interval.String())
+		refreshBlocklists()
+	}
+}
+
+func refreshBlocklists() {
+	if err := updateBlocklists(Config().BlockListDir); err != nil {
+		log.Error("Update blocklists failed", "error", err.Error())
+	}
+
+	if err := readBlocklists(Config().BlockListDir); err != nil {
+		log.Error("Read blocklists failed, keeping the old list", "dir", Config().BlockListDir, "error", err.Error())
+	}
+
+	if err := readAllowlists(Config().AllowListDir); err != nil {
+		log.Error("Read allowlists failed", "dir", Config().AllowListDir, "error", err.Error())
 	}
 }
 
-func start() {
+func start() *Server {
 	var err error
 
 	LocalIPs, err = findLocalIPAddresses()
@@ -140,52 +693,109 @@ func start() {
 		log.Crit("Local ip addresses failed", "error", err.Error())
 	}
 
-	AccessList = cidranger.NewPCTrieRanger()
-	for _, cidr := range Config.AccessList {
-		_, ipnet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			log.Crit("Access list parse cidr failed", "error", err.Error())
-		}
-
-		err = AccessList.Insert(cidranger.NewBasicRangerEntry(*ipnet))
-		if err != nil {
-			log.Crit("Access list insert cidr failed", "error", err.Error())
-		}
-	}
+	cfg := Config()
 
 	server := &Server{
-		host:           Config.Bind,
-		tlsHost:        Config.BindTLS,
-		dohHost:        Config.BindDOH,
-		tlsCertificate: Config.TLSCertificate,
-		tlsPrivateKey:  Config.TLSPrivateKey,
+		host:           cfg.Bind,
+		tlsHost:        cfg.BindTLS,
+		dohHost:        cfg.BindDOH,
+		doqHost:        cfg.BindDOQ,
+		grpcHost:       cfg.BindGRPC,
+		tlsCertificate: cfg.TLSCertificate,
+		tlsPrivateKey:  cfg.TLSPrivateKey,
+		tlsOptions:     tlsOptions(cfg),
 		rTimeout:       5 * time.Second,
 		wTimeout:       5 * time.Second,
 	}
 
+	server.Run()
+
 	api := &API{
-		host: Config.API,
+		host:     cfg.API,
+		resolver: server.handler.r,
 	}
 
-	server.Run()
+	loadCache(server.handler.r.Qcache, cfg.CacheDumpPath)
+
+	go prewarmCache(server.handler, cfg.PrewarmFile, cfg.PrewarmConcurrency)
 
 	api.Run()
 
 	go fetchBlocklists()
+
+	go runHealthChecks()
+
+	if cfg.TrustAnchorFile != "" {
+		go runTrustAnchors(server.handler.r, cfg.TrustAnchorFile)
+	}
+
+	return server
+}
+
+func reload(server *Server) {
+	log.Info("Reloading config...", "config", *ConfigPath)
+
+	if err := configSetup(false); err != nil {
+		log.Error("Config reload failed, keeping the old config", "error", err.Error())
+		return
+	}
+
+	server.Rebind(Config())
+
+	log.Info("Config reloaded")
 }
 
 func main() {
 	flag.Parse()
 
+	if *CheckConfig {
+		log.Root().SetHandler(log.DiscardHandler())
+		os.Exit(runCheck(os.Stdout, *ConfigPath))
+	}
+
+	if *MigrateConfig {
+		target, err := writeMigratedConfig(*ConfigPath)
+		if err != nil {
+			log.Crit("Config migration failed", "error", err.Error())
+		}
+
+		log.Info("Migrated config written", "config", target)
+		return
+	}
+
 	log.Info("Starting sdns...", "version", Version)
 
-	configSetup(false)
-	start()
+	if err := configSetup(false); err != nil {
+		log.Crit("Config setup failed", "error", err.Error())
+	}
+
+	server := start()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hup:
+			reload(server)
+		case <-c:
+			log.Info("Stopping sdns...")
 
-	<-c
+			ctx, cancel := context.WithTimeout(context.Background(), Config().ShutdownTimeout.Duration)
+			err := server.Shutdown(ctx)
+			cancel()
 
-	log.Info("Stopping sdns...")
+			closeQueryLogFile()
+
+			if err != nil {
+				log.Error("Shutdown failed", "error", err.Error())
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
 }
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sdns"
+
+var (
+	// Queries counts all client queries
+	Queries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "How many DNS queries received.",
+	})
+
+	// QueriesByType counts client queries by query type
+	QueriesByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_by_type_total",
+		Help:      "How many DNS queries received by query type.",
+	}, []string{"qtype"})
+
+	// CacheHits counts client queries answered from the cache
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "How many DNS queries answered from the cache.",
+	})
+
+	// CacheMisses counts client queries not found in the cache
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "How many DNS queries not found in the cache.",
+	})
+
+	// BlockHits counts client queries matched on the blocklist
+	BlockHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocklist_hits_total",
+		Help:      "How many DNS queries matched on the blocklist.",
+	})
+
+	// PolicyHits counts client queries matched on the response policy zones
+	PolicyHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpz_hits_total",
+		Help:      "How many DNS queries matched on the response policy zones.",
+	}, []string{"trigger", "action"})
+
+	// UpstreamFailures counts failed exchanges with upstream servers
+	UpstreamFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_failures_total",
+		Help:      "How many exchanges failed with upstream servers.",
+	}, []string{"server"})
+
+	// UpstreamDuration observes upstream response latencies
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Upstream server response latencies in seconds.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"server"})
+
+	// DNSSECFailures counts failed DNSSEC validations
+	DNSSECFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dnssec_failures_total",
+		Help:      "How many DNSSEC validations failed.",
+	})
+
+	// RateLimited counts client queries limited by the client rate limit
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ratelimited_total",
+		Help:      "How many DNS queries limited by the client rate limit.",
+	}, []string{"action"})
+
+	// QueryLogDropped counts query log file lines dropped for the slow disk
+	QueryLogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "querylog_dropped_total",
+		Help:      "How many query log file lines dropped when the disk fell behind.",
+	})
+
+	// PinMismatches counts upstream certificates matched none of the pins
+	PinMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_pin_mismatches_total",
+		Help:      "How many upstream certificates matched none of the public key pins.",
+	}, []string{"server"})
+
+	// UpstreamTCPFirst counts upstream queries sent over tcp without trying udp
+	UpstreamTCPFirst = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_tcp_first_total",
+		Help:      "How many upstream queries sent over tcp without trying udp first.",
+	}, []string{"reason"})
+
+	// UpstreamTCPFirstSaved sums the udp roundtrips skipped by the tcp first queries
+	UpstreamTCPFirstSaved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_tcp_first_saved_seconds_total",
+		Help:      "Estimated latency saved in seconds by the upstream queries sent over tcp first, the smoothed rtt of the servers.",
+	})
+
+	// UpstreamTCPFastOpen counts upstream connections opened with the data in the syn
+	UpstreamTCPFastOpen = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_tcp_fastopen_total",
+		Help:      "How many upstream tcp and tls connections opened with the tcp fast open.",
+	})
+
+	// UpstreamTCPFastOpenSaved sums the handshake roundtrips skipped by the tcp fast open
+	UpstreamTCPFastOpenSaved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_tcp_fastopen_saved_seconds_total",
+		Help:      "Estimated latency saved in seconds by the tcp fast open connections, the rtt of the connections.",
+	})
+
+	// QTypeACL counts the query type policy decisions by the query type
+	QTypeACL = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "qtype_acl_total",
+		Help:      "How many queries decided by the query type policy, by the query type and the decision.",
+	}, []string{"qtype", "decision"})
+
+	// UpstreamEDNSFallback counts the upstream queries asked again without the
+	// edns options the server failed on
+	UpstreamEDNSFallback = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_edns_fallback_total",
+		Help:      "How many upstream queries asked again without the cookie or the edns after a FORMERR or NOTIMP answer.",
+	}, []string{"fallback"})
+
+	// UpstreamTruncated counts truncated upstream answers queried again over tcp
+	UpstreamTruncated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_truncated_total",
+		Help:      "How many truncated upstream udp answers queried again over tcp.",
+	})
+
+	// AccessDenied counts queries of the denied clients, the dropped ones too
+	AccessDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "access_denied_total",
+		Help:      "How many queries of the clients denied by the access list, by the answer mode.",
+	}, []string{"mode"})
+
+	// UpstreamServfailRetries counts SERVFAIL upstream answers asked again on another server
+	UpstreamServfailRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_servfail_retries_total",
+		Help:      "How many SERVFAIL upstream answers asked again on another server.",
+	})
+
+	// AnswersLimited counts udp responses cut to the answer record limit
+	AnswersLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "answers_limited_total",
+		Help:      "How many udp responses cut to the answer record limit with the TC bit.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Queries,
+		QueriesByType,
+		CacheHits,
+		CacheMisses,
+		BlockHits,
+		PolicyHits,
+		UpstreamFailures,
+		UpstreamDuration,
+		DNSSECFailures,
+		RateLimited,
+		QueryLogDropped,
+		PinMismatches,
+		UpstreamTCPFirst,
+		UpstreamTCPFirstSaved,
+		UpstreamTCPFastOpen,
+		UpstreamTCPFastOpenSaved,
+		QTypeACL,
+		UpstreamEDNSFallback,
+		UpstreamTruncated,
+		UpstreamServfailRetries,
+		AccessDenied,
+		AnswersLimited,
+	)
+}
+
+// Handler returns the prometheus exposition handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Handler(t *testing.T) {
+	Queries.Inc()
+	QueriesByType.WithLabelValues("A").Inc()
+	UpstreamDuration.WithLabelValues("192.5.5.241:53").Observe(0.02)
+
+	w := httptest.NewRecorder()
+
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	assert.NoError(t, err)
+
+	Handler().ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, err := ioutil.ReadAll(w.Body)
+	assert.NoError(t, err)
+
+	body := string(data)
+
+	assert.True(t, strings.Contains(body, "sdns_queries_total 1"))
+	assert.True(t, strings.Contains(body, `sdns_queries_by_type_total{qtype="A"} 1`))
+	assert.True(t, strings.Contains(body, `sdns_upstream_duration_seconds_count{server="192.5.5.241:53"} 1`))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/metrics"
+	"github.com/semihalev/sdns/middleware"
+	"github.com/semihalev/sdns/rpz"
+)
+
+// passthruKey marks the queries the response rules of the policy not applied
+const passthruKey = "rpz.passthru"
+
+var (
+	// middlewares are the query processing middlewares by the config names
+	middlewares = map[string]middleware.Handler{
+		"blocklist": middleware.HandlerFunc(blocklistMiddleware),
+		"rpz":       middleware.HandlerFunc(policyMiddleware),
+	}
+
+	// defaultMiddleware is the middleware order of the configs without one
+	defaultMiddleware = []string{"blocklist", "rpz"}
+
+	queryChain   = newDefaultChain()
+	queryChainMu sync.RWMutex
+)
+
+// newQueryChain returns the chain of the middlewares in the order of the names
+func newQueryChain(names []string) (*middleware.Chain, error) {
+	handlers := make([]middleware.Handler, 0, len(names))
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		h, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("middleware unknown: %s", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("middleware duplicated: %s", name)
+		}
+		seen[name] = true
+
+		handlers = append(handlers, h)
+	}
+
+	return middleware.New(handlers...), nil
+}
+
+func newDefaultChain() *middleware.Chain {
+	c, _ := newQueryChain(defaultMiddleware)
+	return c
+}
+
+func currentQueryChain() *middleware.Chain {
+	queryChainMu.RLock()
+	defer queryChainMu.RUnlock()
+
+	return queryChain
+}
+
+// blocklistMiddleware answers the blocked names with the block response
+func blocklistMiddleware(ctx context.Context, req *middleware.Request) {
+	q := req.Msg.Question[0]
+
+	d := BlockList.Decide(q.Name)
+	if !d.Blocked {
+		req.Next(ctx)
+		return
+	}
+
+	metrics.BlockHits.Inc()
+	atomic.AddInt64(&stats.blockHits, 1)
+	stats.categoryHits(d.Categories)
+
+	log.Debug("Found in blocklist", "name", q.Name)
+
+	msg := blockResponse(req.Msg)
+
+	req.OPT.SetDo(req.DO)
+	msg.Extra = append(msg.Extra, req.OPT)
+
+	req.Write(setExtendedError(msg, edeBlocked, ""), statusBlocked)
+}
+
+// policyMiddleware applies the qname and client-ip rules of the response
+// policy, the passed through queries marked for the response rules
+func policyMiddleware(ctx context.Context, req *middleware.Request) {
+	rule := ResponsePolicy.Query(req.Client, req.Msg.Question[0].Name)
+
+	switch {
+	case rule == nil:
+	case rule.Action == rpz.Passthru:
+		req.Set(passthruKey, true)
+	case rule.Action == rpz.TCPOnly && req.Proto != "udp":
+	default:
+		req.Write(policyReply(req.Msg, rule, req.OPT, req.DO))
+		return
+	}
+
+	req.Next(ctx)
+}
+
+// policyPassthru reports whether the query passed through by the response policy
+func policyPassthru(req *middleware.Request) bool {
+	v, _ := req.Get(passthruKey)
+	passthru, _ := v.(bool)
+
+	return passthru
+}
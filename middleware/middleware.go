@@ -0,0 +1,124 @@
+// Package middleware is the ordered chain of the query processing steps, each
+// middleware answers the query or passes it to the next one.
+package middleware
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Handler handles the query of the request, the handler short-circuits the
+// chain by writing the response or passes the query through calling Next.
+type Handler interface {
+	ServeDNS(ctx context.Context, req *Request)
+}
+
+// HandlerFunc is the function adapter of the Handler
+type HandlerFunc func(ctx context.Context, req *Request)
+
+// ServeDNS calls f(ctx, req)
+func (f HandlerFunc) ServeDNS(ctx context.Context, req *Request) {
+	f(ctx, req)
+}
+
+// Request is the query passing through the chain
+type Request struct {
+	// Proto is the client protocol, udp, tcp or https
+	Proto string
+
+	// Msg is the query
+	Msg *dns.Msg
+
+	// Client is the ip of the client, nil for the internal queries
+	Client net.IP
+
+	// OPT is the edns0 record of the response, DO is the DNSSEC OK bit asked
+	// by the client
+	OPT *dns.OPT
+	DO  bool
+
+	// Response is the answer written, nil for the dropped queries
+	Response *dns.Msg
+
+	// Status is the cache status of the answer
+	Status string
+
+	written bool
+	values  map[string]interface{}
+
+	handlers []Handler
+	index    int
+	final    Handler
+}
+
+// Write sets the response of the query, the remaining middlewares not run
+// when the response written without calling Next. A nil message drops the query.
+func (r *Request) Write(msg *dns.Msg, status string) {
+	r.Response = msg
+	r.Status = status
+	r.written = true
+}
+
+// Written reports whether the response written
+func (r *Request) Written() bool {
+	return r.written
+}
+
+// Set stores the value of the key for the next middlewares
+func (r *Request) Set(key string, value interface{}) {
+	if r.values == nil {
+		r.values = make(map[string]interface{})
+	}
+
+	r.values[key] = value
+}
+
+// Get returns the value of the key, ok reports whether the key set
+func (r *Request) Get(key string) (value interface{}, ok bool) {
+	value, ok = r.values[key]
+	return
+}
+
+// Next runs the next middleware of the chain, the final handler after the
+// last one
+func (r *Request) Next(ctx context.Context) {
+	if r.index < len(r.handlers) {
+		h := r.handlers[r.index]
+		r.index++
+
+		h.ServeDNS(ctx, r)
+		return
+	}
+
+	if final := r.final; final != nil {
+		r.final = nil
+		final.ServeDNS(ctx, r)
+	}
+}
+
+// Chain is the ordered middlewares
+type Chain struct {
+	handlers []Handler
+}
+
+// New returns the chain of the handlers in order
+func New(handlers ...Handler) *Chain {
+	return &Chain{handlers: handlers}
+}
+
+// Len returns the number of the middlewares
+func (c *Chain) Len() int {
+	return len(c.handlers)
+}
+
+// Serve runs the middlewares in order on the request, the final handler
+// answers the queries passed through all of them
+func (c *Chain) Serve(ctx context.Context, req *Request, final Handler) {
+	req.handlers = c.handlers
+	req.index = 0
+	req.final = final
+
+	req.Next(ctx)
+}
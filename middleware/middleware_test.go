@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func record(order *[]string, name string, pass bool) Handler {
+	return HandlerFunc(func(ctx context.Context, req *Request) {
+		*order = append(*order, name)
+
+		if !pass {
+			m := new(dns.Msg)
+			m.SetRcode(req.Msg, dns.RcodeRefused)
+			req.Write(m, name)
+			return
+		}
+
+		req.Next(ctx)
+	})
+}
+
+func newRequest() *Request {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	return &Request{Proto: "udp", Msg: m}
+}
+
+func Test_ChainOrder(t *testing.T) {
+	var order []string
+
+	c := New(record(&order, "first", true), record(&order, "second", true), record(&order, "third", true))
+	assert.Equal(t, 3, c.Len())
+
+	req := newRequest()
+	c.Serve(context.Background(), req, record(&order, "final", false))
+
+	assert.Equal(t, []string{"first", "second", "third", "final"}, order)
+	assert.True(t, req.Written())
+	assert.Equal(t, "final", req.Status)
+	assert.Equal(t, dns.RcodeRefused, req.Response.Rcode)
+
+	// the request served again from the start
+	order = nil
+	c.Serve(context.Background(), req, record(&order, "final", false))
+	assert.Equal(t, []string{"first", "second", "third", "final"}, order)
+}
+
+func Test_ChainShortCircuit(t *testing.T) {
+	var order []string
+
+	c := New(record(&order, "first", true), record(&order, "second", false), record(&order, "third", true))
+
+	req := newRequest()
+	c.Serve(context.Background(), req, record(&order, "final", false))
+
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, "second", req.Status)
+
+	// the query dropped with a nil response
+	c = New(HandlerFunc(func(ctx context.Context, req *Request) {
+		req.Write(nil, "drop")
+	}))
+
+	req = newRequest()
+	c.Serve(context.Background(), req, record(&order, "final", false))
+	assert.True(t, req.Written())
+	assert.Nil(t, req.Response)
+
+	// the empty chain runs the final handler
+	order = nil
+	req = newRequest()
+	New().Serve(context.Background(), req, record(&order, "final", false))
+	assert.Equal(t, []string{"final"}, order)
+}
+
+func Test_RequestValues(t *testing.T) {
+	req := newRequest()
+
+	_, ok := req.Get("passthru")
+	assert.False(t, ok)
+
+	c := New(HandlerFunc(func(ctx context.Context, req *Request) {
+		req.Set("passthru", true)
+		req.Next(ctx)
+	}))
+
+	c.Serve(context.Background(), req, HandlerFunc(func(ctx context.Context, req *Request) {
+		v, ok := req.Get("passthru")
+		assert.True(t, ok)
+		assert.Equal(t, true, v)
+	}))
+}
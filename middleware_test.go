@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newQueryChain(t *testing.T) {
+	c, err := newQueryChain(defaultMiddleware)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c.Len())
+
+	c, err = newQueryChain([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c.Len())
+
+	_, err = newQueryChain([]string{"blocklist", "unknown"})
+	assert.Error(t, err)
+
+	_, err = newQueryChain([]string{"rpz", "rpz"})
+	assert.Error(t, err)
+}
+
+func Test_queryMiddlewares(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_middleware")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.rpz")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`$TTL 300
+$ORIGIN rpz.local.
+@                    SOA localhost. root.localhost. 1 3600 600 86400 60
+both.example.com     CNAME *.
+good.example.com     CNAME rpz-passthru.
+`), 0644))
+
+	assert.NoError(t, ResponsePolicy.Load(file))
+	defer ResponsePolicy.Load()
+
+	BlockList.Set("both.example.com.")
+	BlockList.Set("blocked.example.com.")
+	defer BlockList.Remove("both.example.com.")
+	defer BlockList.Remove("blocked.example.com.")
+
+	serve := func(names []string, name string) (*middleware.Request, bool) {
+		c, err := newQueryChain(names)
+		assert.NoError(t, err)
+
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+
+		req := &middleware.Request{Proto: "udp", Msg: m, OPT: opt}
+
+		final := false
+		c.Serve(context.Background(), req, middleware.HandlerFunc(func(ctx context.Context, r *middleware.Request) {
+			final = true
+			r.Write(new(dns.Msg), statusMiss)
+		}))
+
+		return req, final
+	}
+
+	// the blocked names short-circuit the chain
+	req, final := serve([]string{"blocklist"}, "blocked.example.com.")
+	assert.False(t, final)
+	assert.Equal(t, statusBlocked, req.Status)
+
+	req, final = serve([]string{"blocklist"}, "clean.example.org.")
+	assert.True(t, final)
+	assert.Equal(t, statusMiss, req.Status)
+
+	// the name matched by both answered by the first one in order
+	req, _ = serve([]string{"blocklist", "rpz"}, "both.example.com.")
+	assert.Equal(t, statusBlocked, req.Status)
+
+	req, final = serve([]string{"rpz", "blocklist"}, "both.example.com.")
+	assert.False(t, final)
+	assert.Equal(t, statusPolicy, req.Status)
+	assert.Equal(t, dns.RcodeSuccess, req.Response.Rcode)
+
+	// the passed through queries marked for the response rules
+	req, final = serve([]string{"rpz"}, "good.example.com.")
+	assert.True(t, final)
+	assert.True(t, policyPassthru(req))
+
+	// the disabled middlewares not applied
+	req, final = serve(nil, "both.example.com.")
+	assert.True(t, final)
+	assert.False(t, policyPassthru(req))
+}
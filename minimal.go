@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// minimalResponse returns the response without the authority and the
+// additional records not needed by the client. The authority kept for the
+// negative answers and the referrals, the glue of the referral name servers
+// and the OPT record kept in additional. The sections shared with the cache,
+// the response copied before the changes.
+func minimalResponse(msg *dns.Msg) *dns.Msg {
+	referral := len(msg.Answer) == 0 && msg.Rcode == dns.RcodeSuccess
+
+	targets := map[string]bool{}
+	if referral {
+		for _, rr := range msg.Ns {
+			if ns, ok := rr.(*dns.NS); ok {
+				targets[strings.ToLower(ns.Ns)] = true
+			}
+		}
+	}
+
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT || targets[strings.ToLower(rr.Header().Name)] {
+			extra = append(extra, rr)
+		}
+	}
+
+	m := new(dns.Msg)
+	*m = *msg
+	m.Extra = extra
+
+	if len(msg.Answer) > 0 {
+		m.Ns = nil
+	}
+
+	return m
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRRs(records ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+func Test_minimalResponse(t *testing.T) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Answer = newRRs(
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 1 example.com. AAAA",
+	)
+	msg.Ns = newRRs("example.com. 300 IN NS ns1.example.com.")
+	msg.Extra = append(newRRs("ns1.example.com. 300 IN A 192.0.2.53"), opt)
+
+	m := minimalResponse(msg)
+	assert.Equal(t, msg.Answer, m.Answer)
+	assert.Len(t, m.Ns, 0)
+	assert.Equal(t, []dns.RR{opt}, m.Extra)
+
+	// the shared sections left as is
+	assert.Len(t, msg.Ns, 1)
+	assert.Len(t, msg.Extra, 2)
+
+	// the glue of the referral kept
+	referral := new(dns.Msg)
+	referral.SetQuestion("www.example.com.", dns.TypeA)
+	referral.Ns = newRRs(
+		"example.com. 300 IN NS NS1.example.com.",
+		"example.com. 300 IN DS 12345 8 2 0000000000000000000000000000000000000000000000000000000000000000",
+	)
+	referral.Extra = newRRs(
+		"ns1.example.com. 300 IN A 192.0.2.53",
+		"ns1.example.com. 300 IN AAAA 2001:db8::53",
+		"other.example.net. 300 IN A 198.51.100.1",
+	)
+
+	m = minimalResponse(referral)
+	assert.Len(t, m.Ns, 2)
+	assert.Len(t, m.Extra, 2)
+
+	// the authority of the negative answer kept
+	nx := new(dns.Msg)
+	nx.SetQuestion("nx.example.com.", dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+	nx.Ns = newRRs(
+		"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300",
+		"example.com. 300 IN RRSIG SOA 8 2 300 20300101000000 20200101000000 1 example.com. AAAA",
+	)
+	nx.Extra = append(newRRs("ns1.example.com. 300 IN A 192.0.2.53"), opt)
+
+	m = minimalResponse(nx)
+	assert.Equal(t, nx.Ns, m.Ns)
+	assert.Equal(t, []dns.RR{opt}, m.Extra)
+}
+
+func Test_HandlerMinimalResponses(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Answer = newRRs(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Ns = newRRs("minimal.internal. 300 IN NS ns1.minimal.internal.")
+		m.Extra = newRRs("ns1.minimal.internal. 300 IN A 192.0.2.53")
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "minimal.internal", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	query := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.minimal.internal.", dns.TypeA)
+		req.SetEdns0(DefaultMsgSize, false)
+
+		return handler.query("udp", req)
+	}
+
+	defer setConfig(func(cfg *config) { cfg.MinimalResponses = false })()
+
+	resp := query()
+	assert.Len(t, resp.Answer, 1)
+	assert.Len(t, resp.Ns, 1)
+	assert.Len(t, resp.Extra, 2)
+
+	// the cached answer trimmed alike
+	defer setConfig(func(cfg *config) { cfg.MinimalResponses = true })()
+
+	resp = query()
+	assert.Len(t, resp.Answer, 1)
+	assert.Len(t, resp.Ns, 0)
+	if assert.Len(t, resp.Extra, 1) {
+		assert.Equal(t, dns.TypeOPT, resp.Extra[0].Header().Rrtype)
+	}
+
+	defer setConfig(func(cfg *config) { cfg.MinimalResponses = false })()
+
+	resp = query()
+	assert.Len(t, resp.Ns, 1)
+}
@@ -130,3 +130,92 @@ func verifyDelegation(delegation string, nsec []dns.RR) error {
 	}
 	return nil
 }
+
+func matchingNSEC3(name string, nsec []dns.RR) *dns.NSEC3 {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC3)
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func coveringNSEC3(name string, nsec []dns.RR) *dns.NSEC3 {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC3)
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// proveNODATA returns the NSEC3 record proves the name exists without the type,
+// names at the delegation points not proven except DS records.
+func proveNODATA(name string, qtype uint16, nsec []dns.RR) ([]*dns.NSEC3, bool) {
+	n := matchingNSEC3(name, nsec)
+	if n == nil {
+		return nil, false
+	}
+
+	if typesSet(n.TypeBitMap, qtype, dns.TypeCNAME) {
+		return nil, false
+	}
+
+	if qtype != dns.TypeDS && typesSet(n.TypeBitMap, dns.TypeNS) && !typesSet(n.TypeBitMap, dns.TypeSOA) {
+		return nil, false
+	}
+
+	return []*dns.NSEC3{n}, true
+}
+
+// proveNameError returns the closest encloser, next closer and wildcard NSEC3
+// records proves the name not exists in the zone. The closest encloser can't be
+// a delegation point and opt-out coverage not accepted as a proof.
+func proveNameError(zone, name string, nsec []dns.RR) ([]*dns.NSEC3, bool) {
+	if matchingNSEC3(name, nsec) != nil {
+		return nil, false
+	}
+
+	labelIndices := dns.Split(name)
+	for i := 1; i <= len(labelIndices); i++ {
+		ce := rootzone
+		if i < len(labelIndices) {
+			ce = name[labelIndices[i]:]
+		}
+
+		if !dns.IsSubDomain(zone, ce) {
+			return nil, false
+		}
+
+		m := matchingNSEC3(ce, nsec)
+		if m == nil {
+			continue
+		}
+
+		if typesSet(m.TypeBitMap, dns.TypeDNAME) ||
+			(typesSet(m.TypeBitMap, dns.TypeNS) && !typesSet(m.TypeBitMap, dns.TypeSOA)) {
+			return nil, false
+		}
+
+		nc := coveringNSEC3(name[labelIndices[i-1]:], nsec)
+		if nc == nil || nc.Flags&1 == 1 {
+			return nil, false
+		}
+
+		wildcard := "*." + ce
+		if ce == rootzone {
+			wildcard = "*."
+		}
+
+		wc := coveringNSEC3(wildcard, nsec)
+		if wc == nil {
+			return nil, false
+		}
+
+		return []*dns.NSEC3{m, nc, wc}, true
+	}
+
+	return nil, false
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
 )
 
 func makeNSEC3(name, next string, optOut bool, types []uint16) *dns.NSEC3 {
@@ -250,3 +253,97 @@ func Test_VerifyDelegation(t *testing.T) {
 		t.Fatalf("verifyDelegation failed with opt out delegation example from RFC5155: %s", err)
 	}
 }
+
+func makeNSEC3Chain(names map[string][]uint16) []dns.RR {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return dns.HashName(sorted[i], dns.SHA1, 0, "") < dns.HashName(sorted[j], dns.SHA1, 0, "")
+	})
+
+	records := []dns.RR{}
+	for i, name := range sorted {
+		next := sorted[(i+1)%len(sorted)]
+		records = append(records, makeNSEC3(name, next, false, names[name]))
+	}
+	return records
+}
+
+func Test_ProveNegative(t *testing.T) {
+	records := makeNSEC3Chain(map[string][]uint16{
+		"com.":         {dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeRRSIG},
+		"example.com.": {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG},
+		"insec.com.":   {dns.TypeNS},
+	})
+
+	proof, ok := proveNameError("com.", "nonexist.com.", records)
+	assert.True(t, ok)
+	assert.Len(t, proof, 3)
+
+	_, ok = proveNameError("com.", "a.example.com.", records)
+	assert.False(t, ok, "closest encloser is a delegation")
+
+	_, ok = proveNameError("com.", "example.com.", records)
+	assert.False(t, ok, "name exists")
+
+	_, ok = proveNODATA("com.", dns.TypeTXT, records)
+	assert.True(t, ok)
+
+	_, ok = proveNODATA("com.", dns.TypeSOA, records)
+	assert.False(t, ok)
+
+	_, ok = proveNODATA("example.com.", dns.TypeA, records)
+	assert.False(t, ok, "delegation point")
+
+	_, ok = proveNODATA("insec.com.", dns.TypeDS, records)
+	assert.True(t, ok)
+
+	_, ok = proveNODATA("example.com.", dns.TypeDS, records)
+	assert.False(t, ok)
+
+	// opt-out coverage not a proof
+	records = []dns.RR{
+		makeNSEC3("com.", "com.", true, []uint16{dns.TypeNS, dns.TypeSOA}),
+	}
+	_, ok = proveNameError("com.", "nonexist.com.", records)
+	assert.False(t, ok)
+}
+
+func Test_synthesizeNegative(t *testing.T) {
+	r := &Resolver{NSEC3cache: cache.NewNSECCache()}
+
+	records := makeNSEC3Chain(map[string][]uint16{
+		"com.":         {dns.TypeNS, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeRRSIG},
+		"example.com.": {dns.TypeNS, dns.TypeDS, dns.TypeRRSIG},
+	})
+	soa, _ := dns.NewRR("com. 900 IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400")
+
+	req := new(dns.Msg)
+	req.SetQuestion("nonexist.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	assert.Nil(t, r.synthesizeNegative(req))
+
+	r.NSEC3cache.Set("com.", records, []dns.RR{soa})
+
+	msg := r.synthesizeNegative(req)
+	assert.NotNil(t, msg)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.True(t, msg.AuthenticatedData)
+	assert.Equal(t, dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+	assert.NotNil(t, msg.IsEdns0())
+
+	req.SetQuestion("com.", dns.TypeTXT)
+	msg = r.synthesizeNegative(req)
+	assert.NotNil(t, msg)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	assert.Nil(t, r.synthesizeNegative(req))
+
+	req.SetQuestion("nonexist.org.", dns.TypeA)
+	assert.Nil(t, r.synthesizeNegative(req))
+}
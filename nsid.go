@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// requestsNSID reports the request asks for the server identifier (RFC 5001),
+// callers must check it before the query, the handler strips the request
+// options
+func requestsNSID(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0NSID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setNSID adds the configured server identifier to the OPT record of the
+// response, the OPT record copied since it shared with the request. The
+// option left out when the identifier unset.
+func setNSID(msg *dns.Msg) *dns.Msg {
+	nsid := Config().NSID
+	if nsid == "" {
+		return msg
+	}
+
+	for i, rr := range msg.Extra {
+		opt, ok := rr.(*dns.OPT)
+		if !ok {
+			continue
+		}
+
+		o := &dns.OPT{Hdr: opt.Hdr}
+		for _, option := range opt.Option {
+			if option.Option() != dns.EDNS0NSID {
+				o.Option = append(o.Option, option)
+			}
+		}
+
+		o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(nsid))})
+
+		extra := make([]dns.RR, len(msg.Extra))
+		copy(extra, msg.Extra)
+		extra[i] = o
+
+		msg.Extra = extra
+	}
+
+	return msg
+}
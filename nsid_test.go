@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func nsidOption(msg *dns.Msg) *dns.EDNS0_NSID {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			return nsid
+		}
+	}
+
+	return nil
+}
+
+func Test_HandlerNSID(t *testing.T) {
+	var forwarded int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		if nsidOption(req) != nil {
+			atomic.AddInt32(&forwarded, 1)
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 10.0.0.4")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "nsid.test", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.NSID = "node1" })()
+
+	handler := NewHandler()
+
+	query := func(nsid bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.nsid.test.", dns.TypeA)
+		req.SetEdns0(DefaultMsgSize, false)
+
+		if nsid {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+
+		return handler.query("udp", req)
+	}
+
+	// the miss and the cache hit
+	for i := 0; i < 2; i++ {
+		resp := query(true)
+		assert.Len(t, resp.Answer, 1)
+
+		if nsid := nsidOption(resp); assert.NotNil(t, nsid) {
+			assert.Equal(t, hex.EncodeToString([]byte("node1")), nsid.Nsid)
+		}
+	}
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	assert.Nil(t, nsidOption(query(false)))
+
+	defer setConfig(func(cfg *config) { cfg.NSID = "" })()
+	resp := query(true)
+	assert.NotNil(t, resp.IsEdns0())
+	assert.Nil(t, nsidOption(resp))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	// ntaDefaultTTL is the lifetime of the runtime anchors added without one
+	ntaDefaultTTL = time.Hour
+
+	// ntaMaxTTL is the longest lifetime of the runtime anchors (RFC 7646)
+	ntaMaxTTL = 7 * 24 * time.Hour
+)
+
+// NTAs holds the negative trust anchors (RFC 7646), the zones which answers
+// not validated. The configured anchors never expire, the runtime anchors
+// added by the API expire after their lifetime.
+type NTAs struct {
+	mu sync.RWMutex
+
+	configured map[string]bool
+	runtime    map[string]time.Time
+}
+
+// NTA is a negative trust anchor, the zero expire never expires
+type NTA struct {
+	Zone   string
+	Expire time.Time
+}
+
+// NewNTAs returns a new empty negative trust anchors
+func NewNTAs() *NTAs {
+	return &NTAs{
+		configured: make(map[string]bool),
+		runtime:    make(map[string]time.Time),
+	}
+}
+
+// parseNTAZone returns the lower case fqdn of the anchor zone; the root zone
+// refused, an anchor there turns all the validation off
+func parseNTAZone(zone string) (string, error) {
+	zone = dns.Fqdn(strings.ToLower(strings.TrimSpace(zone)))
+
+	if _, ok := dns.IsDomainName(zone); !ok || zone == rootzone {
+		return "", fmt.Errorf("negative trust anchor invalid: %q", zone)
+	}
+
+	return zone, nil
+}
+
+// parseNTAs returns the set of the configured anchor zones
+func parseNTAs(zones []string) (map[string]bool, error) {
+	list := make(map[string]bool)
+
+	for _, z := range zones {
+		zone, err := parseNTAZone(z)
+		if err != nil {
+			return nil, err
+		}
+
+		list[zone] = true
+	}
+
+	return list, nil
+}
+
+// Load replaces the configured anchors, the runtime anchors kept
+func (n *NTAs) Load(zones []string) error {
+	list, err := parseNTAs(zones)
+	if err != nil {
+		return err
+	}
+
+	n.setConfigured(list)
+
+	return nil
+}
+
+// setConfigured replaces the configured anchors with the parsed ones
+func (n *NTAs) setConfigured(list map[string]bool) {
+	n.mu.Lock()
+	n.configured = list
+	n.mu.Unlock()
+}
+
+// Set adds a runtime anchor which expires after the ttl
+func (n *NTAs) Set(zone string, ttl time.Duration) error {
+	zone, err := parseNTAZone(zone)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.runtime[zone] = cache.WallClock.Now().Add(ttl)
+	n.mu.Unlock()
+
+	return nil
+}
+
+// Remove removes a runtime anchor, returns false if not exists. The
+// configured anchors only removed from the config.
+func (n *NTAs) Remove(zone string) bool {
+	zone = dns.Fqdn(strings.ToLower(zone))
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.runtime[zone]
+	delete(n.runtime, zone)
+
+	return ok
+}
+
+// List returns the active anchors sorted by zone, the expired anchors removed
+func (n *NTAs) List() []NTA {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := cache.WallClock.Now()
+
+	list := []NTA{}
+	for zone := range n.configured {
+		list = append(list, NTA{Zone: zone})
+	}
+
+	for zone, expire := range n.runtime {
+		if !now.Before(expire) {
+			delete(n.runtime, zone)
+			continue
+		}
+
+		if !n.configured[zone] {
+			list = append(list, NTA{Zone: zone, Expire: expire})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Zone < list[j].Zone })
+
+	return list
+}
+
+// Covers returns the anchor zone of the name, the name itself or the closest
+// ancestor on the label boundaries; the names of the other zones never
+// covered even they end with the anchor zone
+func (n *NTAs) Covers(name string) (string, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if len(n.configured) == 0 && len(n.runtime) == 0 {
+		return "", false
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	now := cache.WallClock.Now()
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+
+		if n.configured[zone] {
+			return zone, true
+		}
+
+		if expire, ok := n.runtime[zone]; ok && now.Before(expire) {
+			return zone, true
+		}
+	}
+
+	return "", false
+}
+
+// validatingName reports whether the responses of the request validated for
+// the name, the names covered by a negative trust anchor not validated
+func validatingName(req *dns.Msg, name string) bool {
+	if !validating(req) {
+		return false
+	}
+
+	_, ok := NegativeAnchors.Covers(name)
+	return !ok
+}
+
+// ntaKey scopes the cache key of the name covered by a negative trust anchor,
+// the unvalidated entries never used once the anchor removed or expired
+func ntaKey(key uint64, name string, cd bool) uint64 {
+	if cd {
+		return key
+	}
+
+	if zone, ok := NegativeAnchors.Covers(name); ok {
+		return cache.HashScope(key, "nta:"+zone)
+	}
+
+	return key
+}
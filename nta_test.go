@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NTAsCovers(t *testing.T) {
+	n := NewNTAs()
+
+	_, ok := n.Covers("example.com.")
+	assert.False(t, ok)
+
+	assert.NoError(t, n.Load([]string{"Example.COM", "broken.example.org."}))
+
+	for name, zone := range map[string]string{
+		"example.com.":            "example.com.",
+		"www.example.com.":        "example.com.",
+		"a.b.EXAMPLE.com.":        "example.com.",
+		"broken.example.org.":     "broken.example.org.",
+		"www.broken.example.org.": "broken.example.org.",
+	} {
+		z, ok := n.Covers(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, zone, z, name)
+	}
+
+	// the same suffix of the other zones never covered
+	for _, name := range []string{"notexample.com.", "com.", "example.org.", "unbroken.example.org.", "example.com.net."} {
+		_, ok := n.Covers(name)
+		assert.False(t, ok, name)
+	}
+
+	assert.Error(t, n.Load([]string{"."}))
+	assert.Error(t, n.Load([]string{"exa..mple.com"}))
+	assert.Error(t, n.Set(".", time.Hour))
+
+	// the failed loads keep the anchors
+	_, ok = n.Covers("www.example.com.")
+	assert.True(t, ok)
+}
+
+func Test_NTAsExpire(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	cache.WallClock = fakeClock
+	defer func() { cache.WallClock = clockwork.NewRealClock() }()
+
+	n := NewNTAs()
+	assert.NoError(t, n.Load([]string{"configured.example."}))
+	assert.NoError(t, n.Set("runtime.example.", time.Hour))
+
+	_, ok := n.Covers("www.runtime.example.")
+	assert.True(t, ok)
+	assert.Len(t, n.List(), 2)
+
+	// the runtime anchors kept on the config reloads
+	assert.NoError(t, n.Load(nil))
+	assert.Len(t, n.List(), 1)
+
+	fakeClock.Advance(time.Hour)
+
+	_, ok = n.Covers("www.runtime.example.")
+	assert.False(t, ok)
+	assert.Len(t, n.List(), 0)
+	assert.False(t, n.Remove("runtime.example."))
+
+	assert.NoError(t, n.Set("runtime.example.", time.Hour))
+	assert.True(t, n.Remove("Runtime.Example"))
+
+	_, ok = n.Covers("runtime.example.")
+	assert.False(t, ok)
+}
+
+func Test_validatingNameNTA(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecValidate })()
+
+	assert.NoError(t, NegativeAnchors.Set("nta.example.", time.Hour))
+	defer NegativeAnchors.Remove("nta.example.")
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.nta.example.", dns.TypeA)
+
+	assert.False(t, validatingName(req, "www.nta.example."))
+	assert.False(t, validatingName(req, "nta.example."))
+	assert.True(t, validatingName(req, "example."))
+	assert.True(t, validatingName(req, "other.example."))
+
+	key := cache.Hash(req.Question[0], false)
+	assert.NotEqual(t, key, ntaKey(key, "www.nta.example.", false))
+	assert.Equal(t, key, ntaKey(key, "www.nta.example.", true))
+	assert.Equal(t, key, ntaKey(key, "other.example.", false))
+
+	// the unvalidated entries not used once the anchor removed
+	scoped := ntaKey(key, "www.nta.example.", false)
+	NegativeAnchors.Remove("nta.example.")
+	assert.NotEqual(t, scoped, ntaKey(key, "www.nta.example.", false))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// nxdomainCutKey returns the negative cache key of the NXDOMAIN answer kept
+// for the name and the names below it, scoped like the query keys
+func nxdomainCutKey(name string, cd bool, upstream string) uint64 {
+	key := ntaKey(cache.Hash(dns.Question{Name: strings.ToLower(name), Qtype: dns.TypeNone, Qclass: dns.ClassINET}, cd), name, cd)
+	if upstream != "" {
+		key = cache.HashScope(key, "upstream:"+upstream)
+	}
+
+	return key
+}
+
+// setNXDomainCut keeps the NXDOMAIN answer of the name for the names below it
+// (RFC 8020), the NODATA answers and the NXDOMAIN answers of the CNAME targets
+// not kept
+func (h *DNSHandler) setNXDomainCut(mesg *dns.Msg, ttl uint32, upstream string) {
+	if !Config().HardenBelowNXDOMAIN || mesg.Rcode != dns.RcodeNameError ||
+		len(mesg.Answer) > 0 || len(mesg.Question) == 0 {
+		return
+	}
+
+	h.r.Negcache.Set(nxdomainCutKey(mesg.Question[0].Name, mesg.CheckingDisabled, upstream), mesg, ttl)
+}
+
+// nxdomainCut returns the NXDOMAIN answer of the query synthesized from the
+// cached NXDOMAIN answer of the name or of an ancestor, nil if none. The
+// denial records of the cached answer not proving the name left out.
+func (h *DNSHandler) nxdomainCut(req *dns.Msg, upstream string) *dns.Msg {
+	if !Config().HardenBelowNXDOMAIN {
+		return nil
+	}
+
+	q := req.Question[0]
+
+	msg, cut, err := h.r.Negcache.Ancestor(strings.ToLower(q.Name), req, func(name string) uint64 {
+		return nxdomainCutKey(name, req.CheckingDisabled, upstream)
+	})
+	if err != nil {
+		return nil
+	}
+
+	ns := msg.Ns[:0]
+	for _, rr := range msg.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		case dns.TypeRRSIG:
+			if covered := rr.(*dns.RRSIG).TypeCovered; covered == dns.TypeNSEC || covered == dns.TypeNSEC3 {
+				continue
+			}
+		}
+
+		ns = append(ns, rr)
+	}
+
+	msg.Ns = ns
+	msg.AuthenticatedData = false
+
+	log.Debug("NXDOMAIN cut hit", "query", formatQuestion(q), "cut", cut)
+
+	return msg
+}
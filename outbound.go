@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+// outboundAddrs holds the source addresses of the upstream queries by the
+// address family of the servers
+type outboundAddrs struct {
+	v4 []net.IP
+	v6 []net.IP
+}
+
+var (
+	outbound   = &outboundAddrs{}
+	outboundMu sync.RWMutex
+)
+
+// newOutboundAddrs returns the source addresses of the outbound ips and the
+// addresses of the outbound interface, split by the family. The link local
+// ipv6 addresses of the interface skipped, unusable without the zone.
+func newOutboundAddrs(ips []string, iface string) (*outboundAddrs, error) {
+	o := &outboundAddrs{}
+
+	add := func(ip net.IP) {
+		if v4 := ip.To4(); v4 != nil {
+			o.v4 = append(o.v4, v4)
+		} else {
+			o.v6 = append(o.v6, ip)
+		}
+	}
+
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.IsUnspecified() {
+			return nil, fmt.Errorf("outbound ip invalid: %s", s)
+		}
+
+		add(ip)
+	}
+
+	if iface == "" {
+		return o, nil
+	}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("outbound interface %s: %s", iface, err)
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("outbound interface %s addresses: %s", iface, err)
+	}
+
+	found := false
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		add(ipnet.IP)
+		found = true
+	}
+
+	if !found {
+		return nil, fmt.Errorf("outbound interface %s has no addresses", iface)
+	}
+
+	return o, nil
+}
+
+// localAddr returns a source address of the family for the network, random if
+// more than one; nil leaves the source address to the system
+func (o *outboundAddrs) localAddr(network string, family int) net.Addr {
+	list := o.v4
+	if family == 6 {
+		list = o.v6
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	ip := list[randInt(0, len(list))]
+
+	switch network {
+	case "tcp", "tcp-tls":
+		return &net.TCPAddr{IP: ip}
+	case "udp":
+		return &net.UDPAddr{IP: ip}
+	}
+
+	return nil
+}
+
+// setLocalAddr sets the outbound source address of the server family on the
+// dialer of the client, the plain servers only; the encrypted servers get the
+// source address on the dial of each address
+func setLocalAddr(c *dns.Client, server *cache.AuthServer) {
+	if c.Dialer == nil || server.Encrypted() {
+		return
+	}
+
+	outboundMu.RLock()
+	o := outbound
+	outboundMu.RUnlock()
+
+	c.Dialer.LocalAddr = o.localAddr(c.Net, serverFamily(server))
+}
+
+// dialOutbound dials the address from the outbound source address of its
+// family, the hostnames dialed from the source address the system chose
+func dialOutbound(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if family := addrFamily(addr); family != 0 {
+		outboundMu.RLock()
+		o := outbound
+		outboundMu.RUnlock()
+
+		if local := o.localAddr(network, family); local != nil {
+			dialer := *d
+			dialer.LocalAddr = local
+			d = &dialer
+		}
+	}
+
+	return d.DialContext(ctx, network, addr)
+}
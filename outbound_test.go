@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newOutboundAddrs(t *testing.T) {
+	o, err := newOutboundAddrs([]string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, "")
+	assert.NoError(t, err)
+	assert.Len(t, o.v4, 2)
+	assert.Len(t, o.v6, 1)
+
+	_, err = newOutboundAddrs([]string{"not an ip"}, "")
+	assert.Error(t, err)
+
+	_, err = newOutboundAddrs([]string{"0.0.0.0"}, "")
+	assert.Error(t, err)
+
+	_, err = newOutboundAddrs(nil, "sdns-missing0")
+	assert.Error(t, err)
+
+	// the loopback interface addresses
+	if ifi, err := loopbackInterface(); err == nil {
+		o, err = newOutboundAddrs(nil, ifi.Name)
+		assert.NoError(t, err)
+		assert.True(t, len(o.v4)+len(o.v6) > 0)
+	}
+}
+
+func loopbackInterface() (*net.Interface, error) {
+	list, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ifi := range list {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return &ifi, nil
+		}
+	}
+
+	return nil, net.UnknownNetworkError("loopback")
+}
+
+func Test_setLocalAddr(t *testing.T) {
+	sources, err := newOutboundAddrs([]string{"192.0.2.1", "2001:db8::1"}, "")
+	assert.NoError(t, err)
+
+	outboundMu.Lock()
+	old := outbound
+	outbound = sources
+	outboundMu.Unlock()
+
+	defer func() {
+		outboundMu.Lock()
+		outbound = old
+		outboundMu.Unlock()
+	}()
+
+	r := NewResolver()
+
+	v4 := cache.NewAuthServer("198.51.100.53:53")
+	v6 := cache.NewAuthServer("[2001:db8::53]:53")
+
+	c := r.newClient("udp")
+	setLocalAddr(c, v4)
+	if addr, ok := c.Dialer.LocalAddr.(*net.UDPAddr); assert.True(t, ok) {
+		assert.Equal(t, "192.0.2.1", addr.IP.String())
+	}
+
+	setLocalAddr(c, v6)
+	if addr, ok := c.Dialer.LocalAddr.(*net.UDPAddr); assert.True(t, ok) {
+		assert.Equal(t, "2001:db8::1", addr.IP.String())
+	}
+
+	c = r.newClient("tcp")
+	setLocalAddr(c, v6)
+	if addr, ok := c.Dialer.LocalAddr.(*net.TCPAddr); assert.True(t, ok) {
+		assert.Equal(t, "2001:db8::1", addr.IP.String())
+	}
+
+	// the family without the addresses left to the system
+	sources, err = newOutboundAddrs([]string{"192.0.2.1"}, "")
+	assert.NoError(t, err)
+
+	outboundMu.Lock()
+	outbound = sources
+	outboundMu.Unlock()
+
+	setLocalAddr(c, v6)
+	assert.Nil(t, c.Dialer.LocalAddr)
+
+	// the encrypted servers get the source address on the dial
+	c = r.newClient("udp")
+	setLocalAddr(c, cache.NewAuthServer("tls://192.0.2.53:853"))
+	assert.Nil(t, c.Dialer.LocalAddr)
+}
+
+func Test_exchangeOutboundIP(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN TXT " + host)
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	sources, err := newOutboundAddrs([]string{"127.0.0.1"}, "")
+	assert.NoError(t, err)
+
+	outboundMu.Lock()
+	old := outbound
+	outbound = sources
+	outboundMu.Unlock()
+
+	defer func() {
+		outboundMu.Lock()
+		outbound = old
+		outboundMu.Unlock()
+	}()
+
+	r := NewResolver()
+
+	req := new(dns.Msg)
+	req.SetQuestion("outbound.example.", dns.TypeTXT)
+
+	c := r.newClient("udp")
+	resp, err := r.exchange(cache.NewAuthServer(addrstr), req, c)
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"127.0.0.1"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	if addr, ok := c.Dialer.LocalAddr.(*net.UDPAddr); assert.True(t, ok) {
+		assert.Equal(t, "127.0.0.1", addr.IP.String())
+	}
+}
+
+func Test_dialOutbound(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	sources, err := newOutboundAddrs([]string{"127.0.0.2", "::1"}, "")
+	assert.NoError(t, err)
+
+	outboundMu.Lock()
+	old := outbound
+	outbound = sources
+	outboundMu.Unlock()
+
+	defer func() {
+		outboundMu.Lock()
+		outbound = old
+		outboundMu.Unlock()
+	}()
+
+	// the encrypted servers dialed from the source address of the family
+	conn, err := bootstrap.dial(context.Background(), &net.Dialer{}, "tcp", ln.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); assert.True(t, ok) {
+		assert.Equal(t, "127.0.0.2", addr.IP.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// DefaultPaddingBlockSize recommended block size for the responses (RFC 8467)
+const DefaultPaddingBlockSize = 468
+
+// paddingWriter pads the responses written to an encrypted stream
+type paddingWriter struct {
+	dns.ResponseWriter
+
+	pad bool
+}
+
+// newPaddingWriter checks the request before the query, the handler strips
+// the request options
+func newPaddingWriter(w dns.ResponseWriter, req *dns.Msg) *paddingWriter {
+	return &paddingWriter{ResponseWriter: w, pad: shouldPad(req)}
+}
+
+// WriteMsg pads the message if requested then writes it
+func (w *paddingWriter) WriteMsg(m *dns.Msg) error {
+	if w.pad {
+		padMsg(m, Config().PaddingBlockSize)
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// shouldPad reports the response padding needed, callers must use it only
+// for the encrypted transports
+func shouldPad(req *dns.Msg) bool {
+	return Config().Padding && requestsPadding(req)
+}
+
+func requestsPadding(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+
+	return false
+}
+
+// padMsg pads the message length to a multiple of the block size
+func padMsg(msg *dns.Msg, block int) {
+	if block <= 0 {
+		block = DefaultPaddingBlockSize
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	// option code and length
+	size := len(packed) + 4
+
+	pad := 0
+	if size%block != 0 {
+		pad = block - size%block
+	}
+
+	if size+pad > dns.MaxMsgSize {
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, pad)})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_padMsg(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, requestsPadding(req))
+
+	req.SetEdns0(DefaultMsgSize, true)
+	assert.False(t, requestsPadding(req))
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	assert.True(t, requestsPadding(req))
+
+	for _, block := range []int{DefaultPaddingBlockSize, 128, 0} {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		rr, _ := dns.NewRR("example.com. 3600 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		msg.SetEdns0(DefaultMsgSize, true)
+
+		padMsg(msg, block)
+		// twice must not grow
+		padMsg(msg, block)
+
+		packed, err := msg.Pack()
+		assert.NoError(t, err)
+
+		if block == 0 {
+			block = DefaultPaddingBlockSize
+		}
+		assert.Equal(t, 0, len(packed)%block)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	padMsg(msg, 32)
+
+	packed, err := msg.Pack()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(packed)%32)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+// lookupParallel queries up to the limit of the servers at once. Each failed
+// server starts the next one while the SERVFAIL retries allow it. The first
+// valid answer is returned without waiting for the other exchanges, their
+// answers are dropped. After all servers failed or the timeout, the last
+// failed answer is returned, the error when no server answered.
+func (r *Resolver) lookupParallel(c *dns.Client, req *dns.Msg, list []*cache.AuthServer, limit int) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	// buffered for the dropped answers
+	ch := make(chan result, len(list))
+
+	next := 0
+	start := func() {
+		server := list[next]
+		next++
+
+		go func(c *dns.Client, req *dns.Msg) {
+			resp, err := r.exchange(server, req, c)
+			ch <- result{resp, err}
+		}(copyClient(c), req.Copy())
+	}
+
+	for next < len(list) && next < limit {
+		start()
+	}
+
+	timer := time.NewTimer(Config().Timeout.Duration)
+	defer timer.Stop()
+
+	var failed *dns.Msg
+	var err error
+
+	retry := newServfailRetry()
+
+	for pending := next; pending > 0; {
+		select {
+		case res := <-ch:
+			pending--
+
+			if res.err == nil && validAnswer(res.resp) {
+				return res.resp, nil
+			}
+
+			if res.err == nil {
+				failed = res.resp
+			} else {
+				err = res.err
+			}
+
+			if next < len(list) && (res.err != nil || retry.next(req, res.resp)) {
+				start()
+				pending++
+			}
+		case <-timer.C:
+			pending = 0
+			err = errTimeout
+		}
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+
+	return nil, err
+}
+
+// validAnswer reports the answer is positive or an authoritative name error,
+// the other servers not asked for it
+func validAnswer(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeSuccess ||
+		(resp.Rcode == dns.RcodeNameError && resp.Authoritative)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// runSlowUpstream runs a udp server answered with the rcode after the delay
+// of the queries picked by slow, the returned func waits for the delayed
+// answers before the shutdown
+func runSlowUpstream(t testing.TB, rcode int, delay time.Duration, slow func(n int32) bool) (string, func()) {
+	var count int32
+
+	// held by the queries being answered
+	var answering sync.RWMutex
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		answering.RLock()
+		defer answering.RUnlock()
+
+		if slow(atomic.AddInt32(&count, 1)) {
+			time.Sleep(delay)
+		}
+
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		m.Authoritative = true
+
+		if rcode == dns.RcodeSuccess {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addrstr, func() {
+		answering.Lock()
+		answering.Unlock()
+
+		s.Shutdown()
+	}
+}
+
+func always(int32) bool { return true }
+func never(int32) bool  { return false }
+
+func Test_lookupParallel(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.ParallelQueries = 2
+		cfg.Timeout.Duration = time.Second
+	})()
+
+	failing, stop := runSlowUpstream(t, dns.RcodeServerFailure, 0, never)
+	defer stop()
+
+	slow, stop := runSlowUpstream(t, dns.RcodeSuccess, 500*time.Millisecond, always)
+	defer stop()
+
+	fast, stop := runSlowUpstream(t, dns.RcodeSuccess, 0, never)
+	defer stop()
+
+	r := NewResolver()
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{Timeout: time.Second}, ReadTimeout: 2 * time.Second}
+
+	req := new(dns.Msg)
+	req.SetQuestion("parallel.example.com.", dns.TypeA)
+
+	// the failed answer not waited, the next server started for it
+	start := time.Now()
+	resp, err := r.lookupList(c, req, newAuthServers([]string{failing, slow, fast}))
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	}
+	assert.True(t, time.Since(start) < 400*time.Millisecond)
+
+	// the failed answer returned after all servers failed
+	resp, err = r.lookupList(c, req, newAuthServers([]string{failing, "127.0.0.1:1"}))
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	}
+
+	// the slow servers cut at the query timeout
+	setConfig(func(cfg *config) { cfg.Timeout.Duration = 100 * time.Millisecond })
+
+	start = time.Now()
+	_, err = r.lookupList(c, req, newAuthServers([]string{slow, slow}))
+	assert.Equal(t, errTimeout, err)
+	assert.True(t, time.Since(start) < 400*time.Millisecond)
+}
+
+// benchmarkSlowUpstream resolves from the servers, each slow for every tenth
+// query in turn, and reports the latency percentiles
+func benchmarkSlowUpstream(b *testing.B, limit int) {
+	defer setConfig(func(cfg *config) { cfg.ParallelQueries = limit })()
+
+	first, stop := runSlowUpstream(b, dns.RcodeSuccess, 20*time.Millisecond, func(n int32) bool { return n%10 == 0 })
+	defer stop()
+
+	second, stop := runSlowUpstream(b, dns.RcodeSuccess, 20*time.Millisecond, func(n int32) bool { return n%10 == 5 })
+	defer stop()
+
+	r := NewResolver()
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{Timeout: time.Second}, ReadTimeout: time.Second}
+	servers := newAuthServers([]string{first, second})
+
+	req := new(dns.Msg)
+	req.SetQuestion("parallel.example.com.", dns.TypeA)
+
+	latencies := make([]time.Duration, 0, b.N)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if _, err := r.lookupList(c, req, servers); err != nil {
+			b.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-us")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+}
+
+func BenchmarkLookupSequential(b *testing.B) {
+	benchmarkSlowUpstream(b, 0)
+}
+
+func BenchmarkLookupParallel(b *testing.B) {
+	benchmarkSlowUpstream(b, 2)
+}
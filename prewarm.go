@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// DefaultPrewarmConcurrency is the prewarm queries resolved at once
+const DefaultPrewarmConcurrency = 4
+
+type prewarmEntry struct {
+	name  string
+	qtype uint16
+}
+
+// parsePrewarm returns the entries of the prewarm list, a name and an
+// optional type on each line, A if the type left out. The invalid lines
+// skipped with a warning.
+func parsePrewarm(r io.Reader) ([]prewarmEntry, error) {
+	var list []prewarmEntry
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := dns.Fqdn(strings.ToLower(fields[0]))
+		if _, ok := dns.IsDomainName(name); !ok || len(fields) > 2 {
+			log.Warn("Prewarm entry invalid, skipping...", "line", line, "entry", text)
+			continue
+		}
+
+		qtype := dns.TypeA
+		if len(fields) == 2 {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				log.Warn("Prewarm entry type unknown, skipping...", "line", line, "type", fields[1])
+				continue
+			}
+		}
+
+		list = append(list, prewarmEntry{name: name, qtype: qtype})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("prewarm file read failed: %s", err)
+	}
+
+	return list, nil
+}
+
+// prewarmCache resolves the names of the prewarm file into the cache like the
+// client queries, at most concurrency queries at once. The failed entries
+// logged; counted with the succeeded ones on the stats.
+func prewarmCache(h *DNSHandler, path string, concurrency int) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Warn("Prewarm file open failed", "path", path, "error", err.Error())
+		return
+	}
+
+	list, err := parsePrewarm(f)
+	f.Close()
+
+	if err != nil {
+		log.Warn("Prewarm file parse failed", "path", path, "error", err.Error())
+		return
+	}
+
+	atomic.StoreInt64(&stats.prewarmEntries, int64(len(list)))
+
+	log.Info("Cache prewarm started", "path", path, "entries", len(list), "concurrency", concurrency)
+
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for _, e := range list {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(e prewarmEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if prewarmEntryResolve(h, e) {
+				atomic.AddInt64(&stats.prewarmSucceeded, 1)
+			} else {
+				atomic.AddInt64(&stats.prewarmFailed, 1)
+			}
+		}(e)
+	}
+
+	wg.Wait()
+
+	log.Info("Cache prewarm done", "path", path, "succeeded", atomic.LoadInt64(&stats.prewarmSucceeded),
+		"failed", atomic.LoadInt64(&stats.prewarmFailed))
+}
+
+// prewarmEntryResolve resolves the entry, the answers and the negative answers
+// count as succeeded
+func prewarmEntryResolve(h *DNSHandler, e prewarmEntry) bool {
+	req := new(dns.Msg)
+	req.SetQuestion(e.name, e.qtype)
+	req.RecursionDesired = true
+	req.SetEdns0(DefaultMsgSize, true)
+
+	q := req.Question[0]
+
+	msg := h.query("udp", req)
+	if msg == nil {
+		log.Warn("Prewarm query dropped", "query", formatQuestion(q))
+		return false
+	}
+
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		log.Warn("Prewarm query failed", "query", formatQuestion(q), "rcode", dns.RcodeToString[msg.Rcode])
+		return false
+	}
+
+	return true
+}
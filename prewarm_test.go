@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parsePrewarm(t *testing.T) {
+	list, err := parsePrewarm(strings.NewReader(`# most queried
+example.com
+Example.ORG aaaa
+example.net MX # mail
+
+bad..name A
+example.info LARGE
+too many fields
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []prewarmEntry{
+		{name: "example.com.", qtype: dns.TypeA},
+		{name: "example.org.", qtype: dns.TypeAAAA},
+		{name: "example.net.", qtype: dns.TypeMX},
+	}, list)
+}
+
+func Test_prewarmCache(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+
+	var inflight, peak int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("prewarm.example.", func(w dns.ResponseWriter, req *dns.Msg) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+
+		mu.Lock()
+		seen[req.Question[0].Name] = true
+		if n > peak {
+			peak = n
+		}
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		if req.Question[0].Name == "fail.prewarm.example." {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "prewarm.example", Servers: []string{addrstr}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	f, err := ioutil.TempFile("", "prewarm")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString("a.prewarm.example\nb.prewarm.example A\nc.prewarm.example\nfail.prewarm.example\n")
+	f.Close()
+
+	defer func() {
+		atomic.StoreInt64(&stats.prewarmEntries, 0)
+		atomic.StoreInt64(&stats.prewarmSucceeded, 0)
+		atomic.StoreInt64(&stats.prewarmFailed, 0)
+	}()
+
+	handler := NewHandler()
+	prewarmCache(handler, f.Name(), 2)
+
+	assert.Equal(t, int64(4), atomic.LoadInt64(&stats.prewarmEntries))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&stats.prewarmSucceeded))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&stats.prewarmFailed))
+
+	mu.Lock()
+	assert.Len(t, seen, 4)
+	assert.True(t, peak <= 2)
+	mu.Unlock()
+
+	// the missing file logged only
+	prewarmCache(handler, f.Name()+".missing", 2)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// privateReverseTTL is the TTL and the negative TTL of the private reverse
+// zone answers (RFC 6303 section 3)
+const privateReverseTTL = 10800
+
+// privateReverseZones are the reverse zones of the private networks answered
+// locally (RFC 6303); the RFC 1918 networks, the unique local and the link
+// local ipv6 networks
+var privateReverseZones = func() map[string]bool {
+	zones := map[string]bool{
+		"10.in-addr.arpa.":      true,
+		"168.192.in-addr.arpa.": true,
+		"c.f.ip6.arpa.":         true,
+		"d.f.ip6.arpa.":         true,
+		"8.e.f.ip6.arpa.":       true,
+		"9.e.f.ip6.arpa.":       true,
+		"a.e.f.ip6.arpa.":       true,
+		"b.e.f.ip6.arpa.":       true,
+	}
+
+	for i := 16; i <= 31; i++ {
+		zones[strconv.Itoa(i)+".172.in-addr.arpa."] = true
+	}
+
+	return zones
+}()
+
+var (
+	privateReverseExcludes   []*net.IPNet
+	privateReverseExcludesMu sync.RWMutex
+)
+
+// newPrivateReverseExcludes returns the networks of the private reverse
+// excludes, the networks delegated elsewhere and resolved as usual
+func newPrivateReverseExcludes(cidrs []string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("private reverse exclude invalid: %s", cidr)
+		}
+
+		list = append(list, ipnet)
+	}
+
+	return list, nil
+}
+
+// matchPrivateReverse returns the private reverse zone of the name, empty if
+// the name not in one
+func matchPrivateReverse(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if privateReverseZones[name[off:]] {
+			return name[off:]
+		}
+	}
+
+	return ""
+}
+
+// reversePrefix returns the network of the reverse name, false for the names
+// not an address prefix of the in-addr.arpa or the ip6.arpa zones
+func reversePrefix(name string) (*net.IPNet, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	var labels []string
+	var size, bits, base int
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		size, bits, base = net.IPv4len, 8, 10
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		size, bits, base = net.IPv6len, 4, 16
+	default:
+		return nil, false
+	}
+
+	if len(labels) == 0 || len(labels)*bits > size*8 {
+		return nil, false
+	}
+
+	ip := make(net.IP, size)
+
+	// the most significant label last
+	for i := range labels {
+		v, err := strconv.ParseUint(labels[len(labels)-1-i], base, bits)
+		if err != nil || (bits == 4 && len(labels[len(labels)-1-i]) != 1) {
+			return nil, false
+		}
+
+		if bits == 8 {
+			ip[i] = byte(v)
+		} else {
+			ip[i/2] |= byte(v) << uint(4*(1-i%2))
+		}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(labels)*bits, size*8)}, true
+}
+
+// excludedReverse reports whether the reverse name in a network of the
+// excludes, the names above the excluded networks still answered locally
+func excludedReverse(name string) bool {
+	privateReverseExcludesMu.RLock()
+	defer privateReverseExcludesMu.RUnlock()
+
+	if len(privateReverseExcludes) == 0 {
+		return false
+	}
+
+	prefix, ok := reversePrefix(name)
+	if !ok {
+		return false
+	}
+
+	ones, _ := prefix.Mask.Size()
+
+	for _, ipnet := range privateReverseExcludes {
+		if n, _ := ipnet.Mask.Size(); ones >= n && ipnet.Contains(prefix.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// privateReverseAnswer answers the query of a private reverse zone without
+// the recursion; the SOA and the NS of the zone at the apex, the PTR records
+// of the hosts file entries if enabled, the name error for the others. The
+// excluded networks and the forward zones below the root not answered.
+func privateReverseAnswer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	zone := matchPrivateReverse(q.Name)
+	if zone == "" || excludedReverse(q.Name) {
+		return nil
+	}
+
+	if f := matchForwardZone(q.Name); f != nil && f.zone != rootzone {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: privateReverseTTL},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  privateReverseTTL,
+	}
+
+	name := strings.ToLower(q.Name)
+
+	if name == zone {
+		switch q.Qtype {
+		case dns.TypeSOA:
+			msg.Answer = append(msg.Answer, soa)
+		case dns.TypeNS:
+			msg.Answer = append(msg.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: privateReverseTTL},
+				Ns:  zone,
+			})
+		default:
+			msg.Ns = append(msg.Ns, soa)
+		}
+
+		return msg
+	}
+
+	if Config().PrivateReverseHosts {
+		if names, exists := LocalHosts.Reverse(name); exists {
+			if q.Qtype == dns.TypePTR {
+				for _, host := range names {
+					msg.Answer = append(msg.Answer, &dns.PTR{
+						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: Config().Expire},
+						Ptr: host,
+					})
+				}
+			}
+
+			if len(msg.Answer) == 0 {
+				msg.Ns = append(msg.Ns, soa)
+			}
+
+			return msg
+		}
+	}
+
+	msg.Rcode = dns.RcodeNameError
+	msg.Ns = append(msg.Ns, soa)
+
+	return msg
+}
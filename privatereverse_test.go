@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_reversePrefix(t *testing.T) {
+	for name, want := range map[string]string{
+		"10.in-addr.arpa.":         "10.0.0.0/8",
+		"5.1.0.10.in-addr.arpa.":   "10.0.1.5/32",
+		"16.172.in-addr.arpa.":     "172.16.0.0/16",
+		"d.f.ip6.arpa.":            "fd00::/8",
+		"2.1.d.f.ip6.arpa.":        "fd12::/16",
+		"8.E.F.ip6.arpa.":          "fe80::/12",
+		"x.10.in-addr.arpa.":       "",
+		"256.10.in-addr.arpa.":     "",
+		"12.d.f.ip6.arpa.":         "",
+		"1.2.3.4.10.in-addr.arpa.": "",
+		"example.com.":             "",
+	} {
+		prefix, ok := reversePrefix(name)
+		if want == "" {
+			assert.False(t, ok, name)
+			continue
+		}
+
+		if assert.True(t, ok, name) {
+			assert.Equal(t, want, prefix.String(), name)
+		}
+	}
+}
+
+func Test_privateReverseAnswer(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString("10.0.1.5 nas.lan printer.lan\n10.0.1.6 *.lan\nfd00::5 nas.lan\n")
+	f.Close()
+
+	assert.NoError(t, LocalHosts.Load(f.Name()))
+
+	excludes, err := newPrivateReverseExcludes([]string{"10.20.0.0/16"})
+	assert.NoError(t, err)
+
+	privateReverseExcludesMu.Lock()
+	privateReverseExcludes = excludes
+	privateReverseExcludesMu.Unlock()
+
+	defer func() {
+		LocalHosts.Load("")
+
+		privateReverseExcludesMu.Lock()
+		privateReverseExcludes = nil
+		privateReverseExcludesMu.Unlock()
+	}()
+
+	_, err = newPrivateReverseExcludes([]string{"10.20.0.0"})
+	assert.Error(t, err)
+
+	answer := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+
+		return privateReverseAnswer(req)
+	}
+
+	// the public and the delegated networks not answered
+	assert.Nil(t, answer("8.8.8.8.in-addr.arpa.", dns.TypePTR))
+	assert.Nil(t, answer("1.0.32.172.in-addr.arpa.", dns.TypePTR))
+	assert.Nil(t, answer("1.0.20.10.in-addr.arpa.", dns.TypePTR))
+	assert.Nil(t, answer("20.10.in-addr.arpa.", dns.TypeNS))
+
+	msg := answer("5.1.0.10.in-addr.arpa.", dns.TypePTR)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+		assert.True(t, msg.Authoritative)
+		if assert.Len(t, msg.Ns, 1) {
+			assert.Equal(t, "10.in-addr.arpa.", msg.Ns[0].Header().Name)
+		}
+	}
+
+	msg = answer("1.0.31.172.in-addr.arpa.", dns.TypePTR)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	}
+
+	msg = answer("168.192.in-addr.arpa.", dns.TypeSOA)
+	if assert.NotNil(t, msg) && assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, dns.TypeSOA, msg.Answer[0].Header().Rrtype)
+	}
+
+	msg = answer("d.f.ip6.arpa.", dns.TypeA)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+		assert.Len(t, msg.Answer, 0)
+		assert.Len(t, msg.Ns, 1)
+	}
+
+	// the hosts file addresses
+	defer setConfig(func(cfg *config) { cfg.PrivateReverseHosts = true })()
+
+	msg = answer("5.1.0.10.in-addr.arpa.", dns.TypePTR)
+	if assert.NotNil(t, msg) && assert.Len(t, msg.Answer, 2) {
+		assert.Equal(t, "nas.lan.", msg.Answer[0].(*dns.PTR).Ptr)
+		assert.Equal(t, "printer.lan.", msg.Answer[1].(*dns.PTR).Ptr)
+	}
+
+	rev, _ := dns.ReverseAddr("fd00::5")
+	msg = answer(rev, dns.TypePTR)
+	if assert.NotNil(t, msg) && assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "nas.lan.", msg.Answer[0].(*dns.PTR).Ptr)
+	}
+
+	// the empty non-terminal and the other types no data
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"1.0.10.in-addr.arpa.", dns.TypePTR}, {"5.1.0.10.in-addr.arpa.", dns.TypeTXT}} {
+		msg = answer(q.name, q.qtype)
+		if assert.NotNil(t, msg) {
+			assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+			assert.Len(t, msg.Answer, 0)
+			assert.Len(t, msg.Ns, 1)
+		}
+	}
+
+	// the wildcards have no reverse names
+	msg = answer("6.1.0.10.in-addr.arpa.", dns.TypePTR)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	}
+}
+
+func Test_HandlerPrivateReverse(t *testing.T) {
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	defer setConfig(func(cfg *config) { cfg.BlockPrivateReverse = true })()
+
+	msg, status := handler.queryStatus("udp", req.Copy())
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, statusLocal, status)
+		assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+		assert.NotNil(t, msg.IsEdns0())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	qnameStrict  = "strict"
+	qnameRelaxed = "relaxed"
+)
+
+var qnameModes = map[string]bool{
+	qnameStrict:  true,
+	qnameRelaxed: true,
+}
+
+// maxMinimiseCount is the maximum number of the minimized queries sent
+// to the servers of a zone before the full name sent (RFC 9156 section 2.3)
+const maxMinimiseCount = 10
+
+// minimize walks down from the zone of the servers by sending the minimal
+// labels of the question until a referral found. It returns the referral, or
+// nil if the full name must be sent to the servers. In strict mode a NXDOMAIN
+// or an error answer to a minimized query is returned for the question,
+// relaxed mode falls back to the full name.
+func (r *Resolver) minimize(Net string, req *dns.Msg, servers *cache.AuthServers, level int) (*dns.Msg, error) {
+	mode := Config().QnameMinimization
+	if mode == "" {
+		return nil, nil
+	}
+
+	q := req.Question[0]
+	labels := dns.CountLabel(q.Name)
+
+	for n, count := level+1, 0; n < labels && count < maxMinimiseCount; n, count = n+1, count+1 {
+		name := minimizedName(q.Name, n)
+
+		mreq := req.Copy()
+		mreq.Question = []dns.Question{{Name: name, Qtype: dns.TypeA, Qclass: q.Qclass}}
+
+		resp, err := r.lookup(Net, mreq, servers)
+		if err != nil {
+			if mode == qnameStrict {
+				return nil, err
+			}
+
+			log.Debug("Minimized query failed, full name will be sent", "query", formatQuestion(q), "name", name, "error", err.Error())
+			return nil, nil
+		}
+
+		if resp.Truncated {
+			return nil, nil
+		}
+
+		if resp.Rcode != dns.RcodeSuccess {
+			if mode == qnameStrict {
+				m := new(dns.Msg)
+				m.SetRcode(req, resp.Rcode)
+				m.RecursionAvailable = true
+				m.Ns = resp.Ns
+				m.Extra = req.Extra
+
+				return m, nil
+			}
+
+			log.Debug("Minimized query answered with error, full name will be sent", "query", formatQuestion(q), "name", name, "rcode", dns.RcodeToString[resp.Rcode])
+			return nil, nil
+		}
+
+		if isReferral(resp, name) {
+			return resp, nil
+		}
+
+		// the name exists or an empty non-terminal in the same zone, go on with the next label
+	}
+
+	return nil, nil
+}
+
+// minimizedName returns the last n labels of the name
+func minimizedName(name string, n int) string {
+	labelIndices := dns.Split(name)
+	if n >= len(labelIndices) {
+		return name
+	}
+
+	return strings.ToLower(name[labelIndices[len(labelIndices)-n]:])
+}
+
+// isReferral returns whether or not the response delegates the name
+func isReferral(resp *dns.Msg, name string) bool {
+	if len(resp.Answer) > 0 {
+		return false
+	}
+
+	var ns bool
+	for _, rr := range resp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			return false
+		case dns.TypeNS:
+			ns = ns || strings.ToLower(rr.Header().Name) == name
+		}
+	}
+
+	return ns
+}
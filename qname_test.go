@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_minimizedName(t *testing.T) {
+	assert.Equal(t, "com.", minimizedName("www.Example.com.", 1))
+	assert.Equal(t, "example.com.", minimizedName("www.Example.com.", 2))
+	assert.Equal(t, "www.Example.com.", minimizedName("www.Example.com.", 3))
+	assert.Equal(t, "www.Example.com.", minimizedName("www.Example.com.", 4))
+}
+
+func Test_minimize(t *testing.T) {
+	var mu sync.Mutex
+	var queried []string
+
+	calls := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		list := queried
+		queried = nil
+		return list
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		mu.Lock()
+		queried = append(queried, q.Name)
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		switch q.Name {
+		case "ent.example.":
+			soa, _ := dns.NewRR("example. 300 IN SOA ns.example. hostmaster.example. 1 7200 3600 1209600 300")
+			m.Ns = append(m.Ns, soa)
+		case "sub.ent.example.":
+			ns, _ := dns.NewRR("sub.ent.example. 300 IN NS ns.sub.ent.example.")
+			m.Ns = append(m.Ns, ns)
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	servers := &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+
+	r := &Resolver{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.sub.ent.example.", dns.TypeA)
+
+	defer setConfig(func(cfg *config) { cfg.QnameMinimization = "" })()
+	resp, err := r.minimize("udp", req, servers, 1)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+	assert.Len(t, calls(), 0)
+
+	defer setConfig(func(cfg *config) { cfg.QnameMinimization = qnameStrict })()
+	resp, err = r.minimize("udp", req, servers, 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, []string{"ent.example.", "sub.ent.example."}, calls())
+	assert.Equal(t, dns.TypeNS, resp.Ns[0].Header().Rrtype)
+
+	req.SetQuestion("www.nxdomain.example.", dns.TypeA)
+	resp, err = r.minimize("udp", req, servers, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, "www.nxdomain.example.", resp.Question[0].Name)
+
+	defer setConfig(func(cfg *config) { cfg.QnameMinimization = qnameRelaxed })()
+	resp, err = r.minimize("udp", req, servers, 1)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/metrics"
+)
+
+const (
+	qtypeAllow  = "allow"
+	qtypeDeny   = "deny"
+	qtypeBypass = "bypass"
+)
+
+// qtypeACL is the query type policy of the clients; the types of the allowed
+// list only if not empty, never the types of the denied list
+type qtypeACL struct {
+	allowed map[uint16]bool
+	denied  map[uint16]bool
+}
+
+var (
+	qtypePolicy   = &qtypeACL{}
+	qtypePolicyMu sync.RWMutex
+)
+
+// newQTypeACL returns the query type policy of the allowed and the denied
+// types
+func newQTypeACL(allowed, denied []string) (*qtypeACL, error) {
+	acl := &qtypeACL{}
+
+	parse := func(types []string) (map[uint16]bool, error) {
+		if len(types) == 0 {
+			return nil, nil
+		}
+
+		list := make(map[uint16]bool)
+		for _, t := range types {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return nil, fmt.Errorf("query type unknown: %s", t)
+			}
+
+			list[qtype] = true
+		}
+
+		return list, nil
+	}
+
+	var err error
+	if acl.allowed, err = parse(allowed); err != nil {
+		return nil, fmt.Errorf("allowed qtypes: %s", err)
+	}
+
+	if acl.denied, err = parse(denied); err != nil {
+		return nil, fmt.Errorf("denied qtypes: %s", err)
+	}
+
+	return acl, nil
+}
+
+// empty reports whether the policy has no types, every type allowed
+func (a *qtypeACL) empty() bool {
+	return len(a.allowed) == 0 && len(a.denied) == 0
+}
+
+// allow reports whether the query type allowed by the policy
+func (a *qtypeACL) allow(qtype uint16) bool {
+	if a.denied[qtype] {
+		return false
+	}
+
+	return len(a.allowed) == 0 || a.allowed[qtype]
+}
+
+// qtypeAllowed reports whether the query type allowed for the client, the
+// clients of the access rules with the noqtypeacl bypass the policy. The
+// decisions counted by the query type if the policy not empty.
+func qtypeAllowed(qtype uint16, entry *AccessEntry) bool {
+	qtypePolicyMu.RLock()
+	acl := qtypePolicy
+	qtypePolicyMu.RUnlock()
+
+	if acl.empty() {
+		return true
+	}
+
+	name := dns.Type(qtype).String()
+
+	if entry != nil && entry.NoQTypeACL {
+		metrics.QTypeACL.WithLabelValues(name, qtypeBypass).Inc()
+		return true
+	}
+
+	if !acl.allow(qtype) {
+		metrics.QTypeACL.WithLabelValues(name, qtypeDeny).Inc()
+		return false
+	}
+
+	metrics.QTypeACL.WithLabelValues(name, qtypeAllow).Inc()
+
+	return true
+}
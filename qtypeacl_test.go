@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newQTypeACL(t *testing.T) {
+	acl, err := newQTypeACL(nil, nil)
+	if assert.NoError(t, err) {
+		assert.True(t, acl.empty())
+		assert.True(t, acl.allow(dns.TypeANY))
+	}
+
+	acl, err = newQTypeACL([]string{"a", "AAAA", "MX"}, []string{"MX"})
+	if assert.NoError(t, err) {
+		assert.False(t, acl.empty())
+		assert.True(t, acl.allow(dns.TypeA))
+		assert.True(t, acl.allow(dns.TypeAAAA))
+		assert.False(t, acl.allow(dns.TypeMX))
+		assert.False(t, acl.allow(dns.TypeTXT))
+	}
+
+	acl, err = newQTypeACL(nil, []string{"ANY"})
+	if assert.NoError(t, err) {
+		assert.True(t, acl.allow(dns.TypeTXT))
+		assert.False(t, acl.allow(dns.TypeANY))
+	}
+
+	_, err = newQTypeACL([]string{"BOGUS"}, nil)
+	assert.Error(t, err)
+
+	_, err = newQTypeACL(nil, []string{"BOGUS"})
+	assert.Error(t, err)
+}
+
+func Test_HandlerQTypeACL(t *testing.T) {
+	defer func() {
+		qtypePolicyMu.Lock()
+		qtypePolicy = &qtypeACL{}
+		qtypePolicyMu.Unlock()
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+
+	acl, err := newQTypeACL(nil, []string{"TXT"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	qtypePolicyMu.Lock()
+	qtypePolicy = acl
+	qtypePolicyMu.Unlock()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	msg, status := handler.queryStatus("udp", req.Copy())
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, statusLocal, status)
+		assert.Equal(t, dns.RcodeRefused, msg.Rcode)
+
+		code, text, ok := extendedError(msg)
+		assert.True(t, ok)
+		assert.Equal(t, uint16(edeProhibited), code)
+		assert.Equal(t, "query type denied", text)
+	}
+
+	// the clients of the access rules with the bypass asked as usual
+	assert.False(t, qtypeAllowed(dns.TypeTXT, &AccessEntry{}))
+	assert.True(t, qtypeAllowed(dns.TypeTXT, &AccessEntry{NoQTypeACL: true}))
+	assert.True(t, qtypeAllowed(dns.TypeA, nil))
+}
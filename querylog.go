@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// queryLogBuffer is the entries waiting for a stream reader, the newer
+	// entries dropped for the slow readers
+	queryLogBuffer = 256
+
+	// maxQueryLogReaders is the concurrent stream readers limit
+	maxQueryLogReaders = 16
+)
+
+// queryLog is a query log stream entry
+type queryLog struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Net     string    `json:"net"`
+	Qname   string    `json:"qname"`
+	Qtype   string    `json:"qtype"`
+	Rcode   string    `json:"rcode"`
+	Status  string    `json:"status"`
+	Latency float64   `json:"latency_ms"`
+	Dropped uint64    `json:"dropped"`
+}
+
+type queryLogReader struct {
+	ch      chan queryLog
+	dropped uint64
+}
+
+// queryLogStream fans out the query logs to the stream readers
+type queryLogStream struct {
+	mu      sync.RWMutex
+	readers map[*queryLogReader]struct{}
+	count   int32
+}
+
+var queryLogs = &queryLogStream{readers: make(map[*queryLogReader]struct{})}
+
+// subscribe returns a new reader, nil when the readers limit reached
+func (s *queryLogStream) subscribe() *queryLogReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.readers) >= maxQueryLogReaders {
+		return nil
+	}
+
+	r := &queryLogReader{ch: make(chan queryLog, queryLogBuffer)}
+	s.readers[r] = struct{}{}
+	atomic.StoreInt32(&s.count, int32(len(s.readers)))
+
+	return r
+}
+
+func (s *queryLogStream) unsubscribe(r *queryLogReader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.readers, r)
+	atomic.StoreInt32(&s.count, int32(len(s.readers)))
+}
+
+// publish never blocks, entries dropped for the readers with a full buffer
+func (s *queryLogStream) publish(e *queryEvent, msg *dns.Msg, status string) {
+	if atomic.LoadInt32(&s.count) == 0 {
+		return
+	}
+
+	l := queryLog{
+		Time:    e.start,
+		Net:     e.proto,
+		Qname:   e.name,
+		Qtype:   dns.Type(e.qtype).String(),
+		Status:  status,
+		Latency: float64(time.Since(e.start)) / float64(time.Millisecond),
+	}
+
+	l.Client, _, _ = net.SplitHostPort(e.client)
+
+	if msg != nil {
+		l.Rcode = dns.RcodeToString[msg.Rcode]
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for r := range s.readers {
+		l.Dropped = atomic.LoadUint64(&r.dropped)
+
+		select {
+		case r.ch <- l:
+		default:
+			atomic.AddUint64(&r.dropped, 1)
+		}
+	}
+}
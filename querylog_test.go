@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_queryLogStream(t *testing.T) {
+	s := &queryLogStream{readers: make(map[*queryLogReader]struct{})}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeAAAA)
+
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeNameError)
+
+	e := &queryEvent{start: time.Now(), proto: "udp", client: "192.0.2.1:5353", name: "example.com.", qtype: dns.TypeAAAA}
+
+	// no readers
+	s.publish(e, msg, statusMiss)
+
+	r := s.subscribe()
+	assert.NotNil(t, r)
+
+	for i := 0; i < queryLogBuffer+10; i++ {
+		s.publish(e, msg, statusHit)
+	}
+
+	l := <-r.ch
+	assert.Equal(t, "192.0.2.1", l.Client)
+	assert.Equal(t, "example.com.", l.Qname)
+	assert.Equal(t, "AAAA", l.Qtype)
+	assert.Equal(t, "NXDOMAIN", l.Rcode)
+	assert.Equal(t, statusHit, l.Status)
+	assert.Equal(t, uint64(0), l.Dropped)
+
+	// the buffer has room for one more
+	s.publish(e, msg, statusHit)
+	for len(r.ch) > 1 {
+		<-r.ch
+	}
+
+	l = <-r.ch
+	assert.Equal(t, uint64(10), l.Dropped)
+
+	s.unsubscribe(r)
+
+	for i := 0; i < maxQueryLogReaders; i++ {
+		assert.NotNil(t, s.subscribe())
+	}
+	assert.Nil(t, s.subscribe())
+}
+
+func Test_HandlerQueryStatus(t *testing.T) {
+	handler := NewHandler()
+
+	BlockList.Set("status.blocked.test.")
+	defer BlockList.Remove("status.blocked.test.")
+
+	req := new(dns.Msg)
+	req.SetQuestion("status.blocked.test.", dns.TypeA)
+	req.RecursionDesired = true
+
+	_, status := handler.queryStatus("udp", req)
+	assert.Equal(t, statusBlocked, status)
+
+	req = new(dns.Msg)
+	req.SetQuestion("status.cached.test.", dns.TypeA)
+	req.RecursionDesired = true
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR("status.cached.test. 60 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	handler.setCache(cache.Hash(req.Question[0], req.CheckingDisabled), m)
+
+	resp, status := handler.queryStatus("udp", req)
+	assert.Equal(t, statusHit, status)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func Test_streamQueryLogs(t *testing.T) {
+	srv := httptest.NewServer(ginr)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/log/stream")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	req := new(dns.Msg)
+	req.SetQuestion("stream.example.com.", dns.TypeA)
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	// wait the reader subscribed
+	for i := 0; i < 100 && atomic.LoadInt32(&queryLogs.count) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	newQueryEvent("udp", "192.0.2.1:5353", req).Done(msg, statusMiss)
+
+	rd := bufio.NewReader(resp.Body)
+	for {
+		line, err := rd.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var l queryLog
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &l))
+		assert.Equal(t, "stream.example.com.", l.Qname)
+		assert.Equal(t, statusMiss, l.Status)
+		assert.Equal(t, "NOERROR", l.Rcode)
+		return
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/accesslog"
+	"github.com/semihalev/sdns/metrics"
+)
+
+// QueryLogFileBufferSize is the maximum count of lines waiting for the disk
+const QueryLogFileBufferSize = 10000
+
+// The query log file formats
+const (
+	queryLogText = "text"
+	queryLogJSON = "json"
+)
+
+var queryLogFormats = map[string]bool{
+	queryLogText: true,
+	queryLogJSON: true,
+}
+
+// queryLogFile is the query log file writer with its settings
+type queryLogFile struct {
+	path    string
+	maxSize int64
+	backups int
+	format  string
+
+	// blockedOnly writes only the blocked queries
+	blockedOnly bool
+
+	writer *accesslog.Writer
+}
+
+var (
+	queryFile   *queryLogFile
+	queryFileMu sync.RWMutex
+)
+
+// queryLine is a line of the query log file
+type queryLine struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Qname    string    `json:"qname"`
+	Qtype    string    `json:"qtype"`
+	Class    string    `json:"class"`
+	Rcode    string    `json:"rcode"`
+	Answers  int       `json:"answers"`
+	Upstream string    `json:"upstream"`
+	Status   string    `json:"status"`
+	List     string    `json:"list,omitempty"`
+}
+
+// setupQueryLogFile opens the query log file of the config, the old file
+// closed when the file settings changed. Empty path disables the file.
+func setupQueryLogFile(cfg *config) {
+	queryFileMu.Lock()
+	defer queryFileMu.Unlock()
+
+	maxSize := int64(cfg.QueryLogMaxSizeMB) * 1024 * 1024
+
+	if queryFile != nil {
+		if queryFile.path == cfg.QueryLogFile && queryFile.maxSize == maxSize && queryFile.backups == cfg.QueryLogBackups {
+			queryFile.format = cfg.QueryLogFormat
+			queryFile.blockedOnly = cfg.LogBlockedOnly
+			return
+		}
+
+		queryFile.writer.Close()
+		queryFile = nil
+	}
+
+	if cfg.QueryLogFile == "" {
+		return
+	}
+
+	w, err := accesslog.NewWriter(cfg.QueryLogFile, maxSize, cfg.QueryLogBackups, QueryLogFileBufferSize)
+	if err != nil {
+		log.Error("Query log file open failed", "path", cfg.QueryLogFile, "error", err.Error())
+		return
+	}
+
+	queryFile = &queryLogFile{
+		path:    cfg.QueryLogFile,
+		maxSize: maxSize,
+		backups: cfg.QueryLogBackups,
+		format:  cfg.QueryLogFormat,
+		writer:  w,
+
+		blockedOnly: cfg.LogBlockedOnly,
+	}
+}
+
+// closeQueryLogFile writes the buffered lines and closes the query log file
+func closeQueryLogFile() {
+	queryFileMu.Lock()
+	defer queryFileMu.Unlock()
+
+	if queryFile != nil {
+		queryFile.writer.Close()
+		queryFile = nil
+	}
+}
+
+// writeQueryLog queues the query line without blocking, the line dropped when
+// the disk falls behind
+func writeQueryLog(e *queryEvent, msg *dns.Msg, status string) {
+	queryFileMu.RLock()
+	defer queryFileMu.RUnlock()
+
+	if queryFile == nil {
+		return
+	}
+
+	blocked := status == statusBlocked || status == statusPolicy
+	if queryFile.blockedOnly && !blocked {
+		return
+	}
+
+	l := queryLine{
+		Time:   e.start,
+		Qname:  e.name,
+		Qtype:  dns.Type(e.qtype).String(),
+		Class:  dns.Class(e.qclass).String(),
+		Rcode:  "-",
+		Status: status,
+	}
+
+	l.Client, _, _ = net.SplitHostPort(e.client)
+
+	if msg != nil {
+		l.Rcode = dns.RcodeToString[msg.Rcode]
+		l.Answers = len(msg.Answer)
+	}
+
+	if status == statusMiss || status == statusStale {
+		l.Upstream = queryRoute(e.entry, e.name)
+	}
+
+	if blocked {
+		l.List = blockedBy(l.Client, e.name, status)
+	}
+
+	if !queryFile.writer.Write(l.format(queryFile.format)) {
+		metrics.QueryLogDropped.Inc()
+	}
+}
+
+// blockedBy returns the list blocked the query of the client; the blocklist
+// source, manual or runtime for the blocklist entries, blockip for the answer
+// addresses and rpz with the policy zone for the response policy rules
+func blockedBy(client, name, status string) string {
+	if status == statusPolicy {
+		if rule := ResponsePolicy.Query(net.ParseIP(client), name); rule != nil {
+			return "rpz:" + rule.Zone
+		}
+
+		return "rpz"
+	}
+
+	d := BlockList.Decide(name)
+
+	switch {
+	case !d.Blocked:
+		return "blockip"
+	case d.Runtime:
+		return "runtime"
+	case d.Source == "":
+		return "manual"
+	}
+
+	return d.Source
+}
+
+// queryRoute returns where the queries of the name resolved for the client
+func queryRoute(entry *AccessEntry, name string) string {
+	if entry != nil && entry.Action == ActionUpstream {
+		return "group:" + entry.Upstream
+	}
+
+	if f := matchForwardZone(name); f != nil {
+		return "forward:" + f.zone
+	}
+
+	return "recursive"
+}
+
+func (l *queryLine) format(format string) []byte {
+	if format == queryLogJSON {
+		data, _ := json.Marshal(l)
+		return append(data, '\n')
+	}
+
+	upstream := l.Upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+
+	buf := make([]byte, 0, 128)
+	buf = l.Time.UTC().AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Client...)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Qname...)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Qtype...)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Class...)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Rcode...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(l.Answers), 10)
+	buf = append(buf, ' ')
+	buf = append(buf, upstream...)
+	buf = append(buf, ' ')
+	buf = append(buf, l.Status...)
+	if l.List != "" {
+		buf = append(buf, ' ')
+		buf = append(buf, l.List...)
+	}
+	buf = append(buf, '\n')
+
+	return buf
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_queryLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_querylog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+
+	cfg := &config{QueryLogFile: path, QueryLogFormat: queryLogText, QueryLogMaxSizeMB: 1, QueryLogBackups: 1}
+	setupQueryLogFile(cfg)
+	defer closeQueryLogFile()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	msg.Answer = append(msg.Answer, rr)
+
+	entry := &AccessEntry{Action: ActionUpstream, Upstream: "internal"}
+
+	newQueryEvent("udp", "192.0.2.1:5353", req, entry).Done(msg, statusMiss)
+	newQueryEvent("udp", "192.0.2.2:5353", req).Done(msg, statusHit)
+
+	// the format changed without reopen
+	cfg.QueryLogFormat = queryLogJSON
+	setupQueryLogFile(cfg)
+
+	newQueryEvent("udp", "192.0.2.3:5353", req).Done(nil, statusPolicy)
+
+	closeQueryLogFile()
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+
+	fields := strings.Fields(lines[0])
+	assert.Equal(t, []string{"192.0.2.1", "example.com.", "A", "IN", "NOERROR", "1", "group:internal", "miss"}, fields[1:])
+
+	fields = strings.Fields(lines[1])
+	assert.Equal(t, []string{"192.0.2.2", "example.com.", "A", "IN", "NOERROR", "1", "-", "hit"}, fields[1:])
+
+	var l queryLine
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &l))
+	assert.Equal(t, "192.0.2.3", l.Client)
+	assert.Equal(t, "-", l.Rcode)
+	assert.Equal(t, statusPolicy, l.Status)
+	assert.Equal(t, "IN", l.Class)
+}
+
+func Test_queryLogFileBlockedOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_querylog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+
+	cfg := &config{QueryLogFile: path, QueryLogFormat: queryLogText, QueryLogMaxSizeMB: 1, LogBlockedOnly: true}
+	setupQueryLogFile(cfg)
+	defer closeQueryLogFile()
+
+	BlockList.SetManual("blocked.example.com.")
+	defer BlockList.Remove("blocked.example.com.")
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return req
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(query("example.com."))
+
+	newQueryEvent("udp", "192.0.2.1:5353", query("example.com.")).Done(msg, statusMiss)
+	newQueryEvent("udp", "192.0.2.1:5353", query("blocked.example.com.")).Done(msg, statusBlocked)
+	newQueryEvent("udp", "192.0.2.1:5353", query("address.example.com.")).Done(msg, statusBlocked)
+	newQueryEvent("udp", "192.0.2.1:5353", query("policy.example.com.")).Done(nil, statusPolicy)
+
+	closeQueryLogFile()
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+
+	fields := strings.Fields(lines[0])
+	assert.Equal(t, []string{"192.0.2.1", "blocked.example.com.", "A", "IN", "NOERROR", "0", "-", "blocked", "manual"}, fields[1:])
+
+	fields = strings.Fields(lines[1])
+	assert.Equal(t, "blockip", fields[len(fields)-1])
+
+	fields = strings.Fields(lines[2])
+	assert.Equal(t, []string{"policy", "rpz"}, fields[len(fields)-2:])
+}
+
+func Test_queryRoute(t *testing.T) {
+	assert.Equal(t, "recursive", queryRoute(nil, "example.com."))
+	assert.Equal(t, "group:internal", queryRoute(&AccessEntry{Action: ActionUpstream, Upstream: "internal"}, "example.com."))
+
+	zones, err := newForwardZones([]forwardZone{{Zone: "corp.internal", Servers: []string{"10.0.0.53:53"}}})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+	}()
+
+	assert.Equal(t, "forward:corp.internal.", queryRoute(nil, "www.corp.internal."))
+}
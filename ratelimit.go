@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+// clientLimiterSize is the maximum number of the clients tracked by the rate limiter
+const clientLimiterSize = 100000
+
+var (
+	clientLimiter   *cache.ClientLimiter
+	clientLimiterMu sync.RWMutex
+)
+
+// setupClientLimiter replaces the client rate limiter, disabled if the rate is 0
+func setupClientLimiter(cfg *config) {
+	var l *cache.ClientLimiter
+	if cfg.ClientRateLimit > 0 {
+		l = cache.NewClientLimiter(cfg.ClientRateLimit, cfg.ClientRateLimitBurst, cfg.ClientRateLimitHard, clientLimiterSize)
+	}
+
+	clientLimiterMu.Lock()
+	clientLimiter = l
+	clientLimiterMu.Unlock()
+}
+
+// limitClient returns the rate limit result of the client, by the rate
+// limiter of the listener if given and overridden
+func limitClient(client string, listener ...string) int {
+	var l *cache.ClientLimiter
+	if p := listenerPolicyOf(listener); p != nil && p.limit {
+		l = p.limiter
+	} else {
+		clientLimiterMu.RLock()
+		l = clientLimiter
+		clientLimiterMu.RUnlock()
+	}
+
+	if l == nil {
+		return cache.LimitAllow
+	}
+
+	return l.Limit(client)
+}
+
+// truncatedReply returns an empty truncated reply, forces the client to retry over tcp
+func truncatedReply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Truncated = true
+	m.RecursionAvailable = true
+
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(DefaultMsgSize, opt.Do())
+	}
+
+	return m
+}
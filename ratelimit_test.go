@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_limitClient(t *testing.T) {
+	defer setupClientLimiter(&config{})
+
+	setupClientLimiter(&config{})
+	assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.1"))
+
+	setupClientLimiter(&config{ClientRateLimit: 1, ClientRateLimitHard: 2})
+	assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.1"))
+	assert.Equal(t, cache.LimitSlip, limitClient("192.0.2.1"))
+	assert.Equal(t, cache.LimitDrop, limitClient("192.0.2.1"))
+	assert.Equal(t, cache.LimitAllow, limitClient("192.0.2.2"))
+}
+
+func Test_truncatedReply(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	m := truncatedReply(req)
+	assert.True(t, m.Truncated)
+	assert.Len(t, m.Answer, 0)
+	assert.True(t, m.IsEdns0().Do())
+}
+
+func Test_accessRuleNoRateLimit(t *testing.T) {
+	rules := []accessRule{{CIDR: "10.0.0.0/8", Action: "allow", NoRateLimit: true}}
+
+	ranger, err := newAccessList([]string{"0.0.0.0/0"}, rules, nil)
+	assert.NoError(t, err)
+
+	entries, err := ranger.ContainingNetworks(mustParseCIDR(t, "10.1.1.1/32").IP)
+	assert.NoError(t, err)
+
+	var found bool
+	for _, e := range entries {
+		if ae := e.(*AccessEntry); ae.NoRateLimit {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/semihalev/sdns/cache"
+)
+
+var (
+	errRecursionDepth = errors.New("maximum recursion depth of the query exceeded")
+	errDelegationLoop = errors.New("delegation loop detected")
+)
+
+// resolvePath is the chain of the delegations followed and the nameserver
+// lookups nested for a query, from the query to the current resolution. The
+// nodes immutable, every branch of the resolution extends its own path.
+type resolvePath struct {
+	parent *resolvePath
+	key    string
+	depth  int
+}
+
+// visit returns the path extended with the key, the key already on the path
+// is a delegation loop
+func (p *resolvePath) visit(key string) (*resolvePath, error) {
+	depth := 1
+
+	if p != nil {
+		for n := p; n != nil; n = n.parent {
+			if n.key == key {
+				return nil, errDelegationLoop
+			}
+		}
+
+		depth = p.depth + 1
+	}
+
+	if depth > Config().MaxRecursionDepth {
+		return nil, errRecursionDepth
+	}
+
+	return &resolvePath{parent: p, key: key, depth: depth}, nil
+}
+
+// delegationKey returns the path key of the zone delegated to the servers
+func delegationKey(zone string, servers *cache.AuthServers) string {
+	servers.RLock()
+	hosts := make([]string, 0, len(servers.List))
+	for _, s := range servers.List {
+		hosts = append(hosts, s.Host)
+	}
+	servers.RUnlock()
+
+	sort.Strings(hosts)
+
+	return "zone:" + strings.ToLower(zone) + " " + strings.Join(hosts, " ")
+}
+
+// recursionGuarded reports the error of the recursion guards, the errors
+// depend on the path and not cached
+func recursionGuarded(err error) bool {
+	return err == errRecursionDepth || err == errDelegationLoop
+}
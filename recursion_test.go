@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resolvePath(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.MaxRecursionDepth = 3 })()
+
+	var path *resolvePath
+
+	path, err := path.visit("ns:ns1.example.com. A")
+	assert.NoError(t, err)
+
+	// the branches extend their own paths
+	branch, err := path.visit("ns:ns2.example.com. A")
+	assert.NoError(t, err)
+
+	_, err = path.visit("ns:ns2.example.com. A")
+	assert.NoError(t, err)
+
+	_, err = branch.visit("ns:ns1.example.com. A")
+	assert.Equal(t, errDelegationLoop, err)
+
+	branch, err = branch.visit("ds:example.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, branch.depth)
+
+	_, err = branch.visit("ds:example.org.")
+	assert.Equal(t, errRecursionDepth, err)
+
+	s1 := &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer("192.0.2.2:53"), cache.NewAuthServer("192.0.2.1:53")}}
+	s2 := &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer("192.0.2.1:53"), cache.NewAuthServer("192.0.2.2:53")}}
+	assert.Equal(t, delegationKey("Example.com.", s1), delegationKey("example.com.", s2))
+}
+
+// runDelegationServer runs a nameserver which refers every name to a
+// nameserver without glue, the nameserver names given by the refer function
+func runDelegationServer(t *testing.T, refer func(name string) (zone, ns string)) (*dns.Server, string) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		zone, ns := refer(req.Question[0].Name)
+		if zone == "" {
+			m.Rcode = dns.RcodeRefused
+		} else {
+			rr, _ := dns.NewRR(zone + " 3600 IN NS " + ns)
+			m.Ns = append(m.Ns, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+
+	return s, addrstr
+}
+
+func Test_HandlerDelegationLoop(t *testing.T) {
+	defer func(roots, fallbacks *cache.AuthServers) {
+		rootservers, fallbackservers = roots, fallbacks
+	}(rootservers, fallbackservers)
+
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+
+	// the zones delegated to the nameservers of each other
+	s, addrstr := runDelegationServer(t, func(name string) (string, string) {
+		switch {
+		case strings.HasSuffix(name, "a.loop.test."):
+			return "a.loop.test.", "ns.b.loop.test."
+		case strings.HasSuffix(name, "b.loop.test."):
+			return "b.loop.test.", "ns.a.loop.test."
+		}
+
+		return "", ""
+	})
+	defer s.Shutdown()
+
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+	fallbackservers = &cache.AuthServers{}
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.a.loop.test.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, false)
+	req.RecursionDesired = true
+
+	_, err := handler.r.Resolve("udp", req, rootservers, true, Config().Maxdepth, 0, false, nil)
+	assert.Equal(t, errDelegationLoop, err)
+
+	resp := handler.query("udp", req)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	code, text, ok := extendedError(resp)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(edeOther), code)
+	assert.Equal(t, errDelegationLoop.Error(), text)
+}
+
+func Test_resolverRecursionDepth(t *testing.T) {
+	defer func(roots, fallbacks *cache.AuthServers) {
+		rootservers, fallbackservers = roots, fallbacks
+	}(rootservers, fallbackservers)
+
+	defer setConfig(func(cfg *config) { cfg.MaxRecursionDepth = 8 })()
+
+	// every nameserver delegated to a deeper nameserver without glue
+	s, addrstr := runDelegationServer(t, func(name string) (string, string) {
+		if !strings.HasSuffix(name, "deep.test.") {
+			return "", ""
+		}
+
+		return name, "ns." + name
+	})
+	defer s.Shutdown()
+
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+	fallbackservers = &cache.AuthServers{}
+
+	r := NewResolver()
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.deep.test.", dns.TypeA)
+	req.RecursionDesired = true
+
+	_, err := r.Resolve("udp", req, rootservers, true, Config().Maxdepth, 0, false, nil)
+	assert.Equal(t, errRecursionDepth, err)
+}
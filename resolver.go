@@ -6,22 +6,34 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
 	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
 )
 
 // Resolver type
 type Resolver struct {
 	config *dns.ClientConfig
 
-	Lqueue *cache.LQueue
-	Qcache *cache.QueryCache
-	Ncache *cache.NSCache
-	Ecache *cache.ErrorCache
+	Lqueue   *cache.LQueue
+	Flight   *cache.Flight
+	Qcache   *cache.QueryCache
+	Ncache   *cache.NSCache
+	Ecache   *cache.ErrorCache
+	Negcache *cache.NegativeCache
+
+	// TCcache holds the questions which upstream answers came truncated
+	TCcache *cache.ErrorCache
+
+	NSEC3cache *cache.NSECCache
+
+	// trace records the steps of the traced resolutions, nil otherwise
+	trace tracer
 }
 
 var (
@@ -29,44 +41,96 @@ var (
 	errParentDetection      = errors.New("parent detection")
 	errRootServersDetection = errors.New("root servers detection")
 	errLoopDetection        = errors.New("loop detection")
+	errCNAMELoop            = errors.New("CNAME loop detected")
+	errCNAMEDepth           = errors.New("maximum CNAME chain depth exceeded")
 	errTimeout              = errors.New("timedout")
 	errResolver             = errors.New("resolv failed")
 	errDSRecords            = errors.New("DS records found on parent zone but no signatures")
+	errNSECVerify           = errors.New("NSEC verify failed")
+	errUpstreamGroup        = errors.New("upstream group has no servers")
+	errHealthRcode          = errors.New("health check answered with error")
+	errNoReachableAuthority = errors.New("nameservers are not reachable")
 
 	rootzone        = "."
 	rootservers     = &cache.AuthServers{}
 	root6servers    = &cache.AuthServers{}
 	fallbackservers = &cache.AuthServers{}
 	rootkeys        = []dns.RR{}
+	rootkeysMu      sync.RWMutex
+
+	upstreamGroups   = map[string]*cache.AuthServers{}
+	upstreamGroupsMu sync.RWMutex
 )
 
 // NewResolver return a resolver
 func NewResolver() *Resolver {
+	cfg := Config()
+
+	var stale time.Duration
+	if cfg.ServeStale {
+		stale = cfg.ServeStaleTTL.Duration
+	}
+
 	r := &Resolver{
 		config: &dns.ClientConfig{},
 
-		Ncache: cache.NewNSCache(),
-		Qcache: cache.NewQueryCache(Config.CacheSize, Config.RateLimit),
-		Ecache: cache.NewErrorCache(Config.CacheSize, Config.Expire),
-		Lqueue: cache.NewLookupQueue(),
+		Ncache:   cache.NewNSCache(),
+		Qcache:   cache.NewQueryCache(cfg.CacheSize, cfg.RateLimit, stale, cfg.CacheShards),
+		Ecache:   cache.NewErrorCache(cfg.CacheSize, cfg.Expire, cfg.CacheShards),
+		Negcache: cache.NewNegativeCache(cfg.CacheSize, cfg.CacheShards),
+		TCcache:  cache.NewErrorCache(cfg.CacheSize, cfg.Expire, cfg.CacheShards),
+		Lqueue:   cache.NewLookupQueue(),
+		Flight:   cache.NewFlight(),
+
+		NSEC3cache: cache.NewNSECCache(),
+	}
+
+	if cfg.CacheMaxBytes > 0 {
+		r.Qcache.SetMaxBytes(cfg.CacheMaxBytes)
+		r.Negcache.SetMaxBytes(cfg.CacheMaxBytes)
 	}
 
-	r.checkPriming()
+	setCacheBackend(r.Qcache, cfg)
 
-	go r.run()
+	if cfg.PrimeRoots {
+		r.checkPriming()
+
+		go r.run()
+	}
 
 	return r
 }
 
 // Resolve will try find nameservers recursively
 func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers, root bool, depth int, level int, nsl bool, parentdsrr []dns.RR, extra ...bool) (*dns.Msg, error) {
+	return r.resolve(Net, req, servers, root, depth, level, nsl, parentdsrr, nil, extra...)
+}
+
+// resolve resolves the query on the path of the delegations and the nested
+// lookups followed before
+func (r *Resolver) resolve(Net string, req *dns.Msg, servers *cache.AuthServers, root bool, depth int, level int, nsl bool, parentdsrr []dns.RR, path *resolvePath, extra ...bool) (*dns.Msg, error) {
 	q := req.Question[0]
 
+	zlevel := level
 	if root && req.Question[0].Qtype != dns.TypeDS {
-		servers, parentdsrr = r.searchCache(q, req.CheckingDisabled)
+		servers, parentdsrr, zlevel = r.searchCache(q, req.CheckingDisabled)
+	}
+
+	if root && Config().AggressiveNSEC && validatingName(req, q.Name) {
+		if msg := r.synthesizeNegative(req); msg != nil {
+			if r.trace != nil {
+				r.trace.cacheHit("nsec3", q)
+			}
+
+			return msg, nil
+		}
+	}
+
+	resp, err := r.minimize(Net, req, servers, zlevel)
+	if err == nil && resp == nil {
+		resp, err = r.lookup(Net, req, servers)
 	}
 
-	resp, err := r.lookup(Net, req, servers)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +138,9 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 	resp.RecursionAvailable = true
 	resp.Authoritative = false
 
+	// only set after the validation
+	resp.AuthenticatedData = false
+
 	if resp.Truncated {
 		return resp, nil
 	}
@@ -90,8 +157,11 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 				if len(nsec3Set) > 0 {
 					err = verifyNameError(&q, nsec3Set)
 					if err != nil {
+						countDNSSECFailure()
 						log.Warn("NSEC3 verify failed (NXDOMAIN)", "query", formatQuestion(q), "error", err.Error())
 						//TODO: after tests return error?
+					} else if Config().AggressiveNSEC && validatingName(req, q.Name) {
+						r.cacheNSEC3(Net, resp, parentdsrr)
 					}
 				} else {
 					nsecSet := extractRRSet(resp.Ns, q.Name, dns.TypeNSEC)
@@ -111,7 +181,7 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 	}
 
 	if len(resp.Answer) > 0 {
-		if !req.CheckingDisabled {
+		if validatingName(req, q.Name) {
 			var signer string
 			var signerFound bool
 
@@ -140,8 +210,8 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 					for len(nsplit)-n > 0 {
 						candidate := dns.Fqdn(strings.Join(nsplit[len(nsplit)-n-1:], "."))
 
-						dsDepth := Config.Maxdepth
-						dsResp, err := r.lookupDS(Net, candidate, dsDepth)
+						dsDepth := Config().Maxdepth
+						dsResp, err := r.lookupDS(Net, candidate, dsDepth, path)
 						if err != nil {
 							return nil, err
 						}
@@ -156,8 +226,8 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 					}
 				} else if dsname != signer {
 					//try lookup DS records
-					dsDepth := Config.Maxdepth
-					dsResp, err := r.lookupDS(Net, signer, dsDepth)
+					dsDepth := Config().Maxdepth
+					dsResp, err := r.lookupDS(Net, signer, dsDepth, path)
 					if err != nil {
 						return nil, err
 					}
@@ -168,20 +238,30 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 
 			if !signerFound && len(parentdsrr) > 0 {
 				err = errDSRecords
-				log.Warn("DNSSEC verify failed (answer)", "query", formatQuestion(q), "error", err.Error())
+				countDNSSECFailure()
+				log.Warn("DNSSEC verify failed (answer)", "query", formatQuestion(q), "mode", Config().DNSSEC, "error", err.Error())
 
-				return nil, err
+				if err = bogus(err); err != nil {
+					return nil, &bogusError{err}
+				}
 			} else if len(parentdsrr) > 0 {
 				ok, err := r.verifyDNSSEC(Net, signer, strings.ToLower(q.Name), resp, parentdsrr)
 
 				if err != nil {
-					log.Warn("DNSSEC verify failed (answer)", "query", formatQuestion(q), "error", err.Error())
+					countDNSSECFailure()
+					log.Warn("DNSSEC verify failed (answer)", "query", formatQuestion(q), "mode", Config().DNSSEC, "error", err.Error())
 
-					return nil, err
+					if err = bogus(err); err != nil {
+						return nil, &bogusError{err}
+					}
 				} else if !ok {
 					log.Warn("DNSSEC cannot verify at the moment (answer)", "query", formatQuestion(q))
 				}
 
+				if ok {
+					atomic.AddInt64(&stats.dnssecSecure, 1)
+				}
+
 				//set ad flag
 				resp.AuthenticatedData = ok
 			}
@@ -190,10 +270,14 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 		resp.Ns = []dns.RR{}
 
 		if len(extra) == 0 {
+			expire := expireOption(resp)
+
 			resp.Extra = []dns.RR{}
 
 			opt := req.IsEdns0()
-			if opt != nil {
+			if opt != nil && expire != nil {
+				resp.Extra = append(resp.Extra, withExpire(opt, expire))
+			} else if opt != nil {
 				resp.Extra = append(resp.Extra, opt)
 			}
 		}
@@ -205,22 +289,28 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 		var nsrr *dns.NS
 
 		nsmap := make(map[string]string)
+		var nsnames []string
 		for _, n := range resp.Ns {
 			if nsrec, ok := n.(*dns.NS); ok {
 				nsrr = nsrec
-				nsmap[strings.ToLower(nsrec.Ns)] = ""
+				name := strings.ToLower(nsrec.Ns)
+				if _, ok := nsmap[name]; !ok {
+					nsnames = append(nsnames, name)
+				}
+				nsmap[name] = ""
 			}
 		}
 
 		if len(nsmap) == 0 {
-			if q.Qtype == dns.TypeDS {
+			if _, nta := NegativeAnchors.Covers(q.Name); q.Qtype == dns.TypeDS && !nta {
 				//TODO: should verify nsec records
 				nsec3Set := extractRRSet(resp.Ns, "", dns.TypeNSEC3)
 				if len(nsec3Set) > 0 {
 					err = verifyNODATA(&resp.Question[0], nsec3Set)
 					if err != nil {
+						countDNSSECFailure()
 						log.Warn("NSEC3 verify failed (NODATA)", "query", formatQuestion(q), "error", err.Error())
-						return nil, err
+						return nil, &bogusError{err}
 					}
 				} else {
 					nsecSet := extractRRSet(resp.Ns, q.Name, dns.TypeNSEC)
@@ -230,6 +320,10 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 				}
 			}
 
+			if Config().AggressiveNSEC && validatingName(req, q.Name) {
+				r.cacheNSEC3(Net, resp, parentdsrr)
+			}
+
 			return resp, nil
 		}
 
@@ -244,7 +338,7 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 
 		q := dns.Question{Name: nsrr.Header().Name, Qtype: nsrr.Header().Rrtype, Qclass: nsrr.Header().Class}
 
-		key := cache.Hash(q, req.CheckingDisabled)
+		key := ntaKey(cache.Hash(q, req.CheckingDisabled), q.Name, req.CheckingDisabled)
 
 		nsCache, err := r.Ncache.Get(key)
 		if err == nil {
@@ -255,42 +349,67 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 
 			log.Debug("Nameserver cache hit", "key", key, "query", formatQuestion(q))
 
+			if r.trace != nil {
+				r.trace.referral(q.Name, serverHosts(nsCache.Servers), true)
+			}
+
 			if depth <= 0 {
 				return nil, errMaxDepth
 			}
 
+			npath, err := path.visit(delegationKey(q.Name, nsCache.Servers))
+			if err != nil {
+				return nil, err
+			}
+
 			depth--
-			return r.Resolve(Net, req, nsCache.Servers, false, depth, nlevel, nsl, nsCache.DSRR)
+			return r.resolve(Net, req, nsCache.Servers, false, depth, nlevel, nsl, nsCache.DSRR, npath)
 		}
 
 		log.Debug("Nameserver cache not found", "key", key, "query", formatQuestion(q), "error", err.Error())
 
+		four, six := useIPv4(), useIPv6()
+		nsmap6 := make(map[string]string)
+
 		for _, a := range resp.Extra {
-			if extra, ok := a.(*dns.A); ok {
+			switch extra := a.(type) {
+			case *dns.A:
 				name := strings.ToLower(extra.Header().Name)
 				if nsl && name == strings.ToLower(req.Question[0].Name) && extra.A.String() != "" {
 					resp.Answer = append(resp.Answer, extra)
 					return resp, nil
 				}
 
-				if _, ok := nsmap[name]; ok {
+				if _, ok := nsmap[name]; ok && four {
 					nsmap[name] = extra.A.String()
 				}
+			case *dns.AAAA:
+				name := strings.ToLower(extra.Header().Name)
+				if _, ok := nsmap[name]; ok && six {
+					nsmap6[name] = extra.AAAA.String()
+				}
 			}
 		}
 
 		nservers := []string{}
+		missing := 0
+
+		var guardErr error
+
+		for name, addr := range nsmap {
+			if addr == "" && nsmap6[name] == "" {
+				missing++
+			}
 
-		for _, addr := range nsmap {
-			if addr != "" {
-				if isLocalIP(addr) {
+			for _, addr := range []string{addr, nsmap6[name]} {
+				if addr == "" || isLocalIP(addr) {
 					continue
 				}
 				nservers = append(nservers, net.JoinHostPort(addr, "53"))
 			}
 		}
 
-		if len(nsmap) > len(nservers) {
+		if missing > 0 {
 			if len(nservers) > 0 {
 				// temprorary cache before lookup
 				authservers := &cache.AuthServers{}
@@ -298,13 +417,20 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 					authservers.List = append(authservers.List, cache.NewAuthServer(s))
 				}
 
-				r.Ncache.Set(key, nil, nsrr.Header().Ttl, authservers)
+				r.Ncache.Set(key, nil, nsrr.Header().Ttl, authservers, nsnames...)
 			}
+			qtype := dns.TypeA
+			if !four {
+				qtype = dns.TypeAAAA
+			}
+
 			//non extra rr for some nameservers, try lookup
 			for k, addr := range nsmap {
-				if addr == "" {
-					addr, err := r.lookupNSAddr(Net, k, q.Name, depth, req.CheckingDisabled)
-					if err == nil {
+				if addr == "" && nsmap6[k] == "" {
+					addr, err := r.lookupNSAddr(Net, k, qtype, depth, req.CheckingDisabled, path)
+					if recursionGuarded(err) {
+						guardErr = err
+					} else if err == nil {
 						if isLocalIP(addr) {
 							continue
 						}
@@ -317,10 +443,18 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 		}
 
 		if len(nservers) == 0 {
-			return nil, errors.New("nameservers are not reachable")
+			if guardErr != nil {
+				return nil, guardErr
+			}
+
+			return nil, errNoReachableAuthority
+		}
+
+		if r.trace != nil {
+			r.trace.referral(q.Name, nservers, false)
 		}
 
-		if !req.CheckingDisabled {
+		if validatingName(req, nsrr.Header().Name) {
 			var signer string
 			var signerFound bool
 
@@ -347,8 +481,8 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 					for len(nsplit)-n > 0 {
 						candidate := dns.Fqdn(strings.Join(nsplit[len(nsplit)-n-1:], "."))
 
-						dsDepth := Config.Maxdepth
-						dsResp, err := r.lookupDS(Net, candidate, dsDepth)
+						dsDepth := Config().Maxdepth
+						dsResp, err := r.lookupDS(Net, candidate, dsDepth, path)
 						if err != nil {
 							return nil, err
 						}
@@ -363,8 +497,8 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 					}
 				} else if dsname != signer {
 					//try lookup DS records
-					dsDepth := Config.Maxdepth
-					dsResp, err := r.lookupDS(Net, signer, dsDepth)
+					dsDepth := Config().Maxdepth
+					dsResp, err := r.lookupDS(Net, signer, dsDepth, path)
 					if err != nil {
 						return nil, err
 					}
@@ -375,43 +509,67 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 
 			if !signerFound && len(parentdsrr) > 0 {
 				err = errDSRecords
-				log.Warn("DNSSEC verify failed (delegation)", "query", formatQuestion(q), "error", err.Error())
+				countDNSSECFailure()
+				log.Warn("DNSSEC verify failed (delegation)", "query", formatQuestion(q), "mode", Config().DNSSEC, "error", err.Error())
 
-				return nil, err
+				if err = bogus(err); err != nil {
+					return nil, &bogusError{err}
+				}
+
+				// the permissive mode goes on insecure
+				parentdsrr = []dns.RR{}
 			} else if len(parentdsrr) > 0 {
 				ok, err := r.verifyDNSSEC(Net, signer, nsrr.Header().Name, resp, parentdsrr)
 				if err != nil {
-					log.Warn("DNSSEC verify failed (delegation)", "query", formatQuestion(q), "signer", signer, "signed", nsrr.Header().Name, "error", err.Error())
-					return nil, err
-				}
-
-				if !ok {
-					log.Warn("DNSSEC cannot verify at the moment (delegation)", "query", formatQuestion(q), "signer", signer, "signed", nsrr.Header().Name)
-					ok = true
-				}
-
-				parentdsrr = extractRRSet(resp.Ns, nsrr.Header().Name, dns.TypeDS)
+					countDNSSECFailure()
+					log.Warn("DNSSEC verify failed (delegation)", "query", formatQuestion(q), "mode", Config().DNSSEC, "signer", signer, "signed", nsrr.Header().Name, "error", err.Error())
 
-				nsec3Set := extractRRSet(resp.Ns, "", dns.TypeNSEC3)
-				if ok && len(nsec3Set) > 0 {
-					err = verifyDelegation(nsrr.Header().Name, nsec3Set)
-					if err != nil {
-						log.Warn("NSEC3 verify failed (delegation)", "query", formatQuestion(q), "error", err.Error())
-						return nil, err
+					if err = bogus(err); err != nil {
+						return nil, &bogusError{err}
 					}
 
+					// the permissive mode goes on insecure
 					parentdsrr = []dns.RR{}
 				} else {
-					nsecSet := extractRRSet(resp.Ns, nsrr.Header().Name, dns.TypeNSEC)
-					if ok && len(nsecSet) > 0 {
-						if !verifyNSEC(&q, nsecSet) {
-							log.Warn("NSEC verify failed (delegation)", "query", formatQuestion(q), "error", err.Error())
-							return nil, fmt.Errorf("NSEC verify failed")
+					if !ok {
+						log.Warn("DNSSEC cannot verify at the moment (delegation)", "query", formatQuestion(q), "signer", signer, "signed", nsrr.Header().Name)
+						ok = true
+					}
+
+					parentdsrr = extractRRSet(resp.Ns, nsrr.Header().Name, dns.TypeDS)
+
+					nsec3Set := extractRRSet(resp.Ns, "", dns.TypeNSEC3)
+					if ok && len(nsec3Set) > 0 {
+						err = verifyDelegation(nsrr.Header().Name, nsec3Set)
+						if err != nil {
+							countDNSSECFailure()
+							log.Warn("NSEC3 verify failed (delegation)", "query", formatQuestion(q), "mode", Config().DNSSEC, "error", err.Error())
+
+							if err = bogus(err); err != nil {
+								return nil, &bogusError{err}
+							}
 						}
+
 						parentdsrr = []dns.RR{}
+					} else {
+						nsecSet := extractRRSet(resp.Ns, nsrr.Header().Name, dns.TypeNSEC)
+						if ok && len(nsecSet) > 0 {
+							if !verifyNSEC(&q, nsecSet) {
+								countDNSSECFailure()
+								log.Warn("NSEC verify failed (delegation)", "query", formatQuestion(q), "mode", Config().DNSSEC)
+
+								if err = bogus(errNSECVerify); err != nil {
+									return nil, &bogusError{err}
+								}
+							}
+							parentdsrr = []dns.RR{}
+						}
 					}
 				}
 			}
+		} else if validating(req) {
+			// the zones of the negative trust anchors go on insecure
+			parentdsrr = []dns.RR{}
 		}
 
 		authservers := &cache.AuthServers{}
@@ -420,15 +578,20 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 		}
 
 		//final cache
-		r.Ncache.Set(key, parentdsrr, nsrr.Header().Ttl, authservers)
+		r.Ncache.Set(key, parentdsrr, nsrr.Header().Ttl, authservers, nsnames...)
 		log.Debug("Nameserver cache insert", "key", key, "query", formatQuestion(q))
 
 		if depth <= 0 {
 			return nil, errMaxDepth
 		}
 
+		npath, err := path.visit(delegationKey(q.Name, authservers))
+		if err != nil {
+			return nil, err
+		}
+
 		depth--
-		return r.Resolve(Net, req, authservers, false, depth, nlevel, nsl, parentdsrr)
+		return r.resolve(Net, req, authservers, false, depth, nlevel, nsl, parentdsrr, npath)
 	}
 
 	// no answer, no authority, create new msg safer, sometimes received broken response
@@ -441,43 +604,75 @@ func (r *Resolver) Resolve(Net string, req *dns.Msg, servers *cache.AuthServers,
 }
 
 func (r *Resolver) lookup(Net string, req *dns.Msg, servers *cache.AuthServers) (resp *dns.Msg, err error) {
+	return r.lookupClient(r.newClient(Net), req, servers)
+}
+
+func (r *Resolver) newClient(Net string) *dns.Client {
+	timeout, connect := upstreamTimeouts(Net)
+
 	c := &dns.Client{
 		Net: Net,
 		Dialer: &net.Dialer{
 			DualStack:     true,
 			FallbackDelay: 100 * time.Millisecond,
-			Timeout:       Config.ConnectTimeout.Duration,
+			Timeout:       connect,
 		},
-		ReadTimeout:  Config.Timeout.Duration,
-		WriteTimeout: Config.Timeout.Duration,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+
+	return c
+}
+
+func (r *Resolver) lookupClient(c *dns.Client, req *dns.Msg, servers *cache.AuthServers) (resp *dns.Msg, err error) {
+	var list []*cache.AuthServer
+	if servers.Weighted() {
+		list = servers.Next()
+	} else {
+		servers.TrySort()
+		list = servers.Available()
 	}
 
-	if len(Config.OutboundIPs) > 0 {
-		index := randInt(0, len(Config.OutboundIPs))
+	// the IPv6 root servers kept apart
+	if servers == rootservers {
+		root6servers.TrySort()
+		list = append(list, root6servers.Available()...)
+	}
 
-		if Net == "tcp" {
-			c.Dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(Config.OutboundIPs[index])}
-		} else if Net == "udp" {
-			c.Dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(Config.OutboundIPs[index])}
-		}
+	v4, v6 := splitFamilies(list)
+
+	switch {
+	case len(v4) == 0 && len(v6) == 0 && len(list) > 0:
+		return nil, errNoFamilyServers
+	case len(v6) == 0:
+		return r.lookupList(c, req, v4)
+	case len(v4) == 0:
+		return r.lookupList(c, req, v6)
 	}
 
-	servers.TrySort()
+	return r.race(c, req, v6, v4)
+}
 
-	servers.RLock()
-	defer servers.RUnlock()
+// lookupList tries the servers in order until an answer, or at once up to the
+// parallel queries limit
+func (r *Resolver) lookupList(c *dns.Client, req *dns.Msg, list []*cache.AuthServer) (resp *dns.Msg, err error) {
+	if limit := Config().ParallelQueries; limit > 1 && len(list) > 1 {
+		return r.lookupParallel(c, req, list, limit)
+	}
+
+	retry := newServfailRetry()
 
-	for index, server := range servers.List {
+	for index, server := range list {
 		resp, err := r.exchange(server, req, c)
 		if err != nil {
-			if len(servers.List)-1 == index {
+			if len(list)-1 == index {
 				return resp, err
 			}
 
 			continue
 		}
 
-		if resp.Rcode != dns.RcodeSuccess && len(servers.List)-1 != index {
+		if resp.Rcode != dns.RcodeSuccess && len(list)-1 != index && retry.next(req, resp) {
 			continue
 		}
 
@@ -490,22 +685,69 @@ func (r *Resolver) lookup(Net string, req *dns.Msg, servers *cache.AuthServers)
 func (r *Resolver) exchange(server *cache.AuthServer, req *dns.Msg, c *dns.Client) (*dns.Msg, error) {
 	q := req.Question[0]
 
+	if c.Net == "udp" && !server.Encrypted() {
+		if reason := r.tcpFirst(req); reason != "" {
+			// the udp roundtrip of the truncated answer saved, udp tried if tcp fails
+			saved := time.Duration(atomic.LoadInt64(&server.Srtt))
+
+			tresp, err := r.exchange(server, req, r.newClient("tcp"))
+			if err == nil {
+				metrics.UpstreamTCPFirst.WithLabelValues(reason).Inc()
+				metrics.UpstreamTCPFirstSaved.Add(saved.Seconds())
+
+				return tresp, nil
+			}
+
+			log.Debug("Query over tcp first failed", "query", formatQuestion(q), "server", server, "reason", reason, "error", err.Error())
+		}
+	}
+
 	var resp *dns.Msg
 	var err error
 
-	rtt := Config.Timeout.Duration
+	rtt := Config().Timeout.Duration
 	defer func() {
 		atomic.AddInt64(&server.Rtt, rtt.Nanoseconds())
 		atomic.AddInt64(&server.Count, 1)
+		server.UpdateRtt(rtt)
+
+		stats.upstream(server.Host, rtt)
 	}()
 
-	resp, rtt, err = c.Exchange(req, server.Host)
+	caps := server.Capabilities()
+
+	sent, randomized := upstreamRequest(req), false
+	if caps&cache.CapNoEDNS != 0 && sent.IsEdns0() != nil {
+		sent = clearOPT(sent.Copy())
+	}
+
+	if !server.Encrypted() {
+		sent, randomized = randomizeQuery(sent, server.Host)
+	}
+
+	// the source address of the server family
+	setLocalAddr(c, server)
+
+	cookies := Config().Cookies && sent.IsEdns0() != nil && !server.Encrypted() && caps&cache.CapNoCookie == 0
+
+	if cookies {
+		resp, rtt, err = exchangeCookie(c, sent, server.Host)
+	} else {
+		resp, rtt, err = exchangeUpstream(c, sent, server)
+	}
+	if serverFamily(server) == 6 {
+		ipv6Health.record(err == nil || err == dns.ErrTruncated, time.Now())
+	}
+
+	if r.trace != nil {
+		r.trace.exchanged(server.Host, c.Net, q, resp, rtt, err)
+	}
+
 	if err != nil && err != dns.ErrTruncated {
-		if strings.Contains(err.Error(), "no route to host") && c.Net == "udp" {
+		metrics.UpstreamFailures.WithLabelValues(upstreamLabel(server.Host)).Inc()
+
+		if strings.Contains(err.Error(), "no route to host") && c.Net == "udp" && !server.Encrypted() {
 			c.Net = "tcp"
-			if len(Config.OutboundIPs) > 0 {
-				c.Dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(Config.OutboundIPs[0])}
-			}
 
 			return r.exchange(server, req, c)
 		}
@@ -515,36 +757,100 @@ func (r *Resolver) exchange(server *cache.AuthServer, req *dns.Msg, c *dns.Clien
 		return nil, err
 	}
 
-	if resp != nil && resp.Rcode == dns.RcodeFormatError && req.IsEdns0() != nil {
-		// try again without edns tags
-		req = clearOPT(req)
+	metrics.UpstreamDuration.WithLabelValues(upstreamLabel(server.Host)).Observe(rtt.Seconds())
+
+	if resp != nil && randomized {
+		normalized, err := checkCase(resp, sent, req, server.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if normalized {
+			// try again without case randomization
+			return r.exchange(server, req, c)
+		}
+	}
+
+	if resp != nil && resp.Truncated && c.Net == "udp" && !server.Encrypted() {
+		metrics.UpstreamTruncated.Inc()
+		if r.TCcache != nil {
+			r.TCcache.Set(truncatedKey(q))
+		}
+
+		// the truncated answer queried again over tcp, kept if tcp fails
+		tresp, err := r.exchange(server, req, r.newClient("tcp"))
+		if err == nil {
+			return tresp, nil
+		}
+
+		log.Debug("Truncated answer query over tcp failed", "query", formatQuestion(q), "server", server, "error", err.Error())
+	}
+
+	// the server failing on the edns asked again without the cookie, then
+	// without the edns; remembered for the next queries of the server
+	if resp != nil && ednsRejected(resp) && sent.IsEdns0() != nil {
+		flag, fallback := cache.CapNoEDNS, "noedns"
+		if cookies {
+			flag, fallback = cache.CapNoCookie, "nocookie"
+		}
+
+		server.SetCapability(flag)
+		metrics.UpstreamEDNSFallback.WithLabelValues(fallback).Inc()
+
+		log.Debug("Upstream edns fallback", "query", formatQuestion(q), "server", server, "rcode", dns.RcodeToString[resp.Rcode], "fallback", fallback)
+
 		return r.exchange(server, req, c)
 	}
 
 	return resp, nil
 }
 
-func (r *Resolver) searchCache(q dns.Question, cd bool) (servers *cache.AuthServers, parentdsrr []dns.RR) {
+// ednsRejected reports whether the answer may be the failure of the server on
+// the edns of the query (RFC 6891 section 7)
+func ednsRejected(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeFormatError || resp.Rcode == dns.RcodeNotImplemented
+}
+
+func (r *Resolver) searchCache(q dns.Question, cd bool) (servers *cache.AuthServers, parentdsrr []dns.RR, level int) {
 	q.Qtype = dns.TypeNS // we should look NS type caches
-	key := cache.Hash(q, cd)
+	key := ntaKey(cache.Hash(q, cd), q.Name, cd)
 
 	ns, err := r.Ncache.Get(key)
 
 	if err == nil {
 		log.Debug("Nameserver cache hit", "key", key, "query", formatQuestion(q))
-		return ns.Servers, ns.DSRR
+
+		if r.trace != nil {
+			r.trace.cacheHit("delegation", q)
+		}
+
+		return ns.Servers, ns.DSRR, dns.CountLabel(q.Name)
 	}
 
 	q.Name = upperName(q.Name)
 
 	if q.Name == "" {
-		return rootservers, nil
+		return rootservers, nil, 0
 	}
 
 	return r.searchCache(q, cd)
 }
 
-func (r *Resolver) lookupDS(Net, qname string, depth int) (msg *dns.Msg, err error) {
+// nsNames returns the name server names of the closest cached zone of the name
+func (r *Resolver) nsNames(name string, cd bool) []string {
+	for name != "" {
+		ns, err := r.Ncache.Get(ntaKey(cache.Hash(dns.Question{Name: name, Qtype: dns.TypeNS, Qclass: dns.ClassINET}, cd), name, cd))
+		if err == nil {
+			return ns.Names
+		}
+
+		name = upperName(name)
+	}
+
+	return nil
+}
+
+func (r *Resolver) lookupDS(Net, qname string, depth int, path *resolvePath) (msg *dns.Msg, err error) {
 	log.Debug("Lookup DS record", "qname", qname)
 
 	dsReq := new(dns.Msg)
@@ -556,6 +862,10 @@ func (r *Resolver) lookupDS(Net, qname string, depth int) (msg *dns.Msg, err err
 
 	dsres, _, err := r.Qcache.Get(key, dsReq)
 	if err == nil {
+		if r.trace != nil {
+			r.trace.cacheHit("ds", dsReq.Question[0])
+		}
+
 		return dsres, nil
 	}
 
@@ -568,16 +878,23 @@ func (r *Resolver) lookupDS(Net, qname string, depth int) (msg *dns.Msg, err err
 		return nil, fmt.Errorf("ds records max depth reach")
 	}
 
+	npath, err := path.visit("ds:" + strings.ToLower(qname))
+	if err != nil {
+		return nil, err
+	}
+
 	depth--
-	dsres, err = r.Resolve(Net, dsReq, rootservers, true, depth, 0, true, nil)
+	dsres, err = r.resolve(Net, dsReq, rootservers, true, depth, 0, true, nil, npath)
 	if err != nil {
-		r.Ecache.Set(key)
+		if !recursionGuarded(err) {
+			r.Ecache.Set(key)
+		}
 		return nil, err
 	}
 
 	if dsres.Truncated && dsres.Rcode == dns.RcodeSuccess {
 		//retrying in TCP mode
-		return r.lookupDS("tcp", qname, depth+1)
+		return r.lookupDS("tcp", qname, depth+1, path)
 	}
 
 	if len(dsres.Answer) == 0 && len(dsres.Ns) == 0 {
@@ -589,18 +906,23 @@ func (r *Resolver) lookupDS(Net, qname string, depth int) (msg *dns.Msg, err err
 	return dsres, nil
 }
 
-func (r *Resolver) lookupNSAddr(Net string, ns, qname string, depth int, cd bool) (addr string, err error) {
-	log.Debug("Lookup NS address", "qname", ns)
+func (r *Resolver) lookupNSAddr(Net string, ns string, qtype uint16, depth int, cd bool, path *resolvePath) (addr string, err error) {
+	log.Debug("Lookup NS address", "qname", ns, "qtype", dns.TypeToString[qtype])
 
 	nsReq := new(dns.Msg)
-	nsReq.SetQuestion(ns, dns.TypeA)
+	nsReq.SetQuestion(ns, qtype)
 	nsReq.SetEdns0(DefaultMsgSize, true)
 	nsReq.RecursionDesired = true
 	nsReq.CheckingDisabled = cd
 
 	q := nsReq.Question[0]
 
-	key := cache.Hash(q, cd)
+	key := ntaKey(cache.Hash(q, cd), q.Name, cd)
+
+	npath, err := path.visit("ns:" + strings.ToLower(ns) + " " + dns.TypeToString[qtype])
+	if err != nil {
+		return "", err
+	}
 
 	if c := r.Lqueue.Get(key); c != nil {
 		return "", fmt.Errorf("nameserver address lookup failed for %s (like loop?)", ns)
@@ -609,6 +931,10 @@ func (r *Resolver) lookupNSAddr(Net string, ns, qname string, depth int, cd bool
 	nsres, _, err := r.Qcache.Get(key, nsReq)
 	if err == nil {
 		if addr, ok := searchAddr(nsres); ok {
+			if r.trace != nil {
+				r.trace.cacheHit("nameserver address", q)
+			}
+
 			return addr, nil
 		}
 	}
@@ -626,7 +952,11 @@ func (r *Resolver) lookupNSAddr(Net string, ns, qname string, depth int, cd bool
 	}
 
 	depth--
-	nsres, err = r.Resolve(Net, nsReq, rootservers, true, depth, 0, true, nil)
+	nsres, err = r.resolve(Net, nsReq, rootservers, true, depth, 0, true, nil, npath)
+	if recursionGuarded(err) {
+		return "", err
+	}
+
 	if err != nil {
 		//try fallback servers
 		if len(fallbackservers.List) > 0 {
@@ -642,7 +972,7 @@ func (r *Resolver) lookupNSAddr(Net string, ns, qname string, depth int, cd bool
 	if nsres.Truncated && nsres.Rcode == dns.RcodeSuccess {
 		//retrying in TCP mode
 		r.Lqueue.Done(key)
-		return r.lookupNSAddr("tcp", ns, qname, depth+1, cd)
+		return r.lookupNSAddr("tcp", ns, qtype, depth+1, cd, path)
 	}
 
 	if len(nsres.Answer) == 0 && len(nsres.Ns) == 0 {
@@ -666,11 +996,13 @@ func (r *Resolver) lookupNSAddr(Net string, ns, qname string, depth int, cd bool
 }
 
 func (r *Resolver) dsRRFromRootKeys() (dsset []dns.RR) {
+	rootkeysMu.RLock()
 	for _, a := range rootkeys {
 		if dnskey, ok := a.(*dns.DNSKEY); ok {
 			dsset = append(dsset, dnskey.ToDS(dns.RSASHA1))
 		}
 	}
+	rootkeysMu.RUnlock()
 
 	if len(dsset) == 0 {
 		panic("root zone dsset empty")
@@ -696,11 +1028,13 @@ func (r *Resolver) verifyRootKeys(msg *dns.Msg) (ok bool) {
 	}
 
 	dsset := []dns.RR{}
+	rootkeysMu.RLock()
 	for _, a := range rootkeys {
 		if dnskey, ok := a.(*dns.DNSKEY); ok {
 			dsset = append(dsset, dnskey.ToDS(dns.RSASHA1))
 		}
 	}
+	rootkeysMu.RUnlock()
 
 	if len(dsset) == 0 {
 		panic("root zone dsset empty")
@@ -718,6 +1052,26 @@ func (r *Resolver) verifyRootKeys(msg *dns.Msg) (ok bool) {
 }
 
 func (r *Resolver) verifyDNSSEC(Net string, signer, signed string, resp *dns.Msg, parentdsRR []dns.RR) (ok bool, err error) {
+	if r.trace != nil {
+		defer func() {
+			r.trace.validated(signer, signed, resp.Question[0], ok, err)
+		}()
+	}
+
+	// the chain of trust validated before
+	if resp.Question[0].Qtype != dns.TypeDNSKEY {
+		if keys := TrustList.Get(signer, parentdsRR); keys != nil {
+			if ok, err = verifyRRSIG(keys, resp); err != nil {
+				TrustList.SetBogus(signer, err)
+				return
+			}
+
+			log.Debug("DNSSEC verified with the trusted keys", "signer", signer, "signed", signed, "query", formatQuestion(resp.Question[0]))
+
+			return ok, nil
+		}
+	}
+
 	keyReq := new(dns.Msg)
 	keyReq.SetQuestion(signer, dns.TypeDNSKEY)
 	keyReq.SetEdns0(DefaultMsgSize, true)
@@ -728,8 +1082,12 @@ func (r *Resolver) verifyDNSSEC(Net string, signer, signed string, resp *dns.Msg
 	cacheKey := cache.Hash(q)
 
 	msg, _, err := r.Qcache.Get(cacheKey, keyReq)
+	if msg != nil && r.trace != nil {
+		r.trace.cacheHit("dnskey", q)
+	}
+
 	if resp.Question[0].Qtype != dns.TypeDNSKEY && msg == nil {
-		depth := Config.Maxdepth
+		depth := Config().Maxdepth
 		msg, err = r.Resolve(Net, keyReq, rootservers, true, depth, 0, false, nil)
 		if err != nil {
 			return
@@ -780,10 +1138,14 @@ func (r *Resolver) verifyDNSSEC(Net string, signer, signed string, resp *dns.Msg
 	err = verifyDS(keys, parentdsRR)
 	if err != nil {
 		log.Debug("DNSSEC DS verify failed", "signer", signer, "signed", signed, "error", err.Error())
+		TrustList.SetBogus(signer, err)
 		return
 	}
 
+	TrustList.Set(signer, keys, parentdsRR)
+
 	if ok, err = verifyRRSIG(keys, resp); err != nil {
+		TrustList.SetBogus(signer, err)
 		return
 	}
 
@@ -829,63 +1191,77 @@ func (r *Resolver) equalServers(s1, s2 *cache.AuthServers) bool {
 	return true
 }
 
+// checkPriming replaces the root servers by the authoritative set, the root
+// name servers and their addresses asked to the current root servers (RFC
+// 8109). The answer validated before accepted if the DNSSEC enabled, the
+// root servers kept as is if the priming fails.
 func (r *Resolver) checkPriming() error {
+	// the configured encrypted root servers kept
+	if rootservers.Encrypted() {
+		return nil
+	}
+
 	req := new(dns.Msg)
 	req.SetQuestion(rootzone, dns.TypeNS)
 	req.SetEdns0(DefaultMsgSize, true)
-	req.RecursionDesired = true
+	req.RecursionDesired = false
+
+	resp, err := r.lookup("udp", req, rootservers)
+	if err == nil && resp.Truncated {
+		//retrying in TCP mode
+		resp, err = r.lookup("tcp", req, rootservers)
+	}
+
+	if err == nil {
+		err = r.verifyPriming(resp)
+	}
 
-	resp, err := r.Resolve("udp", req, rootservers, true, 5, 0, false, nil, true)
 	if err != nil {
 		log.Error("root servers update failed", "error", err.Error())
 
 		return err
 	}
 
-	if resp.Truncated {
-		//retrying in TCP mode
-		resp, err = r.Resolve("tcp", req, rootservers, true, 5, 0, false, nil, true)
-		if err != nil {
-			return err
-		}
+	// only the addresses of the root name servers, the others not trusted
+	names := make(map[string]bool)
+	for _, rr := range extractRRSet(resp.Answer, rootzone, dns.TypeNS) {
+		names[strings.ToLower(rr.(*dns.NS).Ns)] = true
 	}
 
-	if len(resp.Extra) > 0 {
-		var tmpservers, tmp6servers cache.AuthServers
+	var tmpservers, tmp6servers cache.AuthServers
 
-		for _, r := range resp.Extra {
-			if r.Header().Rrtype == dns.TypeA {
-				if v4, ok := r.(*dns.A); ok {
-					host := net.JoinHostPort(v4.A.String(), "53")
-					tmpservers.List = append(tmpservers.List, cache.NewAuthServer(host))
-				}
-			}
-
-			if r.Header().Rrtype == dns.TypeAAAA {
-				if v6, ok := r.(*dns.AAAA); ok {
-					host := net.JoinHostPort(v6.AAAA.String(), "53")
-					tmp6servers.List = append(tmp6servers.List, cache.NewAuthServer(host))
-				}
-			}
+	for _, r := range resp.Extra {
+		if !names[strings.ToLower(r.Header().Name)] {
+			continue
 		}
 
-		if len(tmpservers.List) > 0 {
-			rootservers.Lock()
-			rootservers.List = tmpservers.List
-			rootservers.Unlock()
+		if v4, ok := r.(*dns.A); ok {
+			host := net.JoinHostPort(v4.A.String(), "53")
+			tmpservers.List = append(tmpservers.List, cache.NewAuthServer(host))
 		}
 
-		if len(tmp6servers.List) > 0 {
-			root6servers.Lock()
-			root6servers.List = tmp6servers.List
-			root6servers.Unlock()
+		if v6, ok := r.(*dns.AAAA); ok {
+			host := net.JoinHostPort(v6.AAAA.String(), "53")
+			tmp6servers.List = append(tmp6servers.List, cache.NewAuthServer(host))
 		}
+	}
 
-		if len(tmpservers.List) > 0 || len(tmp6servers.List) > 0 {
-			log.Info("Good! root servers update successful")
+	if len(tmpservers.List) > 0 {
+		rootservers.Lock()
+		rootservers.List = tmpservers.List
+		rootservers.Unlock()
+	}
 
-			return nil
-		}
+	if len(tmp6servers.List) > 0 {
+		root6servers.Lock()
+		root6servers.List = tmp6servers.List
+		root6servers.Unlock()
+	}
+
+	if len(tmpservers.List) > 0 || len(tmp6servers.List) > 0 {
+		log.Info("Good! root servers update successful", "servers", len(tmpservers.List), "servers6", len(tmp6servers.List))
+
+		return nil
 	}
 
 	log.Error("root servers update failed", "error", "no records found")
@@ -893,6 +1269,33 @@ func (r *Resolver) checkPriming() error {
 	return errors.New("no records found")
 }
 
+// verifyPriming checks the priming answer has the root name servers, signed
+// by the root keys if the DNSSEC enabled
+func (r *Resolver) verifyPriming(resp *dns.Msg) error {
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("priming query answered with %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if len(extractRRSet(resp.Answer, rootzone, dns.TypeNS)) == 0 {
+		return errors.New("no records found")
+	}
+
+	if Config().DNSSEC == dnssecOff {
+		return nil
+	}
+
+	ok, err := r.verifyDNSSEC("udp", rootzone, rootzone, resp, r.dsRRFromRootKeys())
+	if err == nil && !ok {
+		err = errNoSignatures
+	}
+
+	if err != nil {
+		return bogus(fmt.Errorf("priming answer not verified: %s", err))
+	}
+
+	return nil
+}
+
 func (r *Resolver) run() {
 	ticker := time.NewTicker(time.Hour)
 
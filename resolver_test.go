@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -238,3 +242,239 @@ func Test_resolverNoAnswer(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func Test_resolverPriming(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: rootzone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 172800},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	assert.NoError(t, err)
+
+	var ns []dns.RR
+	for _, name := range []string{"a.root.test.", "b.root.test."} {
+		rr, _ := dns.NewRR(". 518400 IN NS " + name)
+		ns = append(ns, rr)
+	}
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rootzone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 518400},
+		KeyTag:     key.KeyTag(),
+		SignerName: rootzone,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.NoError(t, sig.Sign(priv.(crypto.Signer), ns))
+
+	var signed int32 = 1
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		m.Answer = append(m.Answer, ns...)
+		if atomic.LoadInt32(&signed) == 1 {
+			m.Answer = append(m.Answer, sig)
+		}
+
+		for _, glue := range []string{
+			"a.root.test. 518400 IN A 192.0.2.1",
+			"b.root.test. 518400 IN A 192.0.2.2",
+			"b.root.test. 518400 IN AAAA 2001:db8::2",
+			"evil.test. 518400 IN A 198.51.100.1",
+		} {
+			rr, _ := dns.NewRR(glue)
+			m.Extra = append(m.Extra, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	oldRoot, oldRoot6 := rootservers, root6servers
+	rootkeysMu.Lock()
+	oldKeys := rootkeys
+	rootkeys = []dns.RR{key}
+	rootkeysMu.Unlock()
+
+	defer func() {
+		rootservers, root6servers = oldRoot, oldRoot6
+
+		rootkeysMu.Lock()
+		rootkeys = oldKeys
+		rootkeysMu.Unlock()
+
+		TrustList.Remove(rootzone)
+	}()
+
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecValidate })()
+
+	reset := func() {
+		rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+		root6servers = &cache.AuthServers{}
+	}
+
+	hosts := func(servers *cache.AuthServers) (list []string) {
+		for _, s := range servers.List {
+			list = append(list, s.Host)
+		}
+		return list
+	}
+
+	keyReq := new(dns.Msg)
+	keyReq.SetQuestion(rootzone, dns.TypeDNSKEY)
+
+	keyResp := new(dns.Msg)
+	keyResp.SetReply(keyReq)
+	keyResp.Answer = []dns.RR{key}
+
+	r := &Resolver{Qcache: cache.NewQueryCache(64, 0, 0)}
+	r.Qcache.Set(cache.Hash(keyReq.Question[0]), keyResp)
+
+	// the glue of the other names not taken
+	reset()
+	assert.NoError(t, r.checkPriming())
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, hosts(rootservers))
+	assert.Equal(t, []string{"[2001:db8::2]:53"}, hosts(root6servers))
+
+	// the unsigned answer refused, the servers kept
+	atomic.StoreInt32(&signed, 0)
+	TrustList.Remove(rootzone)
+
+	reset()
+	assert.Error(t, r.checkPriming())
+	assert.Equal(t, []string{addrstr}, hosts(rootservers))
+	assert.Empty(t, hosts(root6servers))
+
+	// accepted without the validation
+	defer setConfig(func(cfg *config) { cfg.DNSSEC = dnssecOff })()
+
+	reset()
+	assert.NoError(t, r.checkPriming())
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53"}, hosts(rootservers))
+}
+
+// runPickyUpstream runs a udp server answered the rcode to the queries with
+// the cookie option, or with edns at all if noedns set, counting the queries
+func runPickyUpstream(t testing.TB, rcode int, noedns bool) (string, *int32, func()) {
+	var count int32
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&count, 1)
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		opt := req.IsEdns0()
+		if opt != nil && noedns {
+			m.Rcode = rcode
+			w.WriteMsg(m)
+			return
+		}
+
+		if opt != nil {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0COOKIE {
+					m.Rcode = rcode
+					w.WriteMsg(m)
+					return
+				}
+			}
+
+			m.SetEdns0(DefaultMsgSize, opt.Do())
+		}
+
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addrstr, &count, func() { s.Shutdown() }
+}
+
+func Test_exchangeEDNSFallback(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.Cookies = true
+		cfg.CaseRandomization = false
+	})()
+
+	r := NewResolver()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	exchange := func(server *cache.AuthServer) *dns.Msg {
+		resp, err := r.exchange(server, req, r.newClient("udp"))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		return resp
+	}
+
+	// the cookie dropped, kept with the edns
+	addr, count, stop := runPickyUpstream(t, dns.RcodeFormatError, false)
+	defer stop()
+
+	server := cache.NewAuthServer(addr)
+
+	if resp := exchange(server); resp != nil {
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.NotNil(t, resp.IsEdns0())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+	assert.Equal(t, cache.CapNoCookie, server.Capabilities())
+
+	// remembered, not probed again
+	exchange(server)
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+
+	// the edns dropped after the cookie
+	addr, count, stop = runPickyUpstream(t, dns.RcodeNotImplemented, true)
+	defer stop()
+
+	server = cache.NewAuthServer(addr)
+
+	if resp := exchange(server); resp != nil {
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Nil(t, resp.IsEdns0())
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+	assert.Equal(t, cache.CapNoCookie|cache.CapNoEDNS, server.Capabilities())
+
+	exchange(server)
+	assert.Equal(t, int32(4), atomic.LoadInt32(count))
+
+	// the request of the caller left as is
+	assert.NotNil(t, req.IsEdns0())
+
+	// without the cookies the edns dropped at once
+	defer setConfig(func(cfg *config) { cfg.Cookies = false })()
+
+	server = cache.NewAuthServer(addr)
+
+	exchange(server)
+	assert.Equal(t, int32(6), atomic.LoadInt32(count))
+	assert.Equal(t, cache.CapNoEDNS, server.Capabilities())
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// reusePortControl leaves the socket as is, the rebinds to the same address
+// fail on the platforms without the port reuse and the old listener kept
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
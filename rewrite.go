@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// The rewrite rule actions
+const (
+	rewriteName    = "name"
+	rewriteFlatten = "flatten"
+	rewriteIP      = "ip"
+)
+
+// The rewrite rule name matches
+const (
+	rewriteExact  = "exact"
+	rewriteSuffix = "suffix"
+)
+
+var (
+	rewriteRules   []*rewriter
+	rewriteRulesMu sync.RWMutex
+)
+
+type rewriteRule struct {
+	Name   string
+	Match  string
+	Action string
+	Target string
+	CIDR   string
+	IP     string
+}
+
+// rewriter is a parsed rewrite rule
+type rewriter struct {
+	name   string
+	suffix bool
+	action string
+
+	target string
+	ipnet  *net.IPNet
+	ip     net.IP
+}
+
+// newRewriteRules returns the rewriters of the rules in order
+func newRewriteRules(rules []rewriteRule) ([]*rewriter, error) {
+	list := make([]*rewriter, 0, len(rules))
+
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rewrite rule name invalid: %q", rule.Name)
+		}
+
+		r := &rewriter{
+			name:   strings.ToLower(dns.Fqdn(rule.Name)),
+			action: strings.ToLower(rule.Action),
+		}
+
+		switch strings.ToLower(rule.Match) {
+		case "", rewriteExact:
+		case rewriteSuffix:
+			r.suffix = true
+		default:
+			return nil, fmt.Errorf("rewrite rule match unknown: %s", rule.Match)
+		}
+
+		switch r.action {
+		case rewriteName:
+			if rule.Target == "" {
+				return nil, fmt.Errorf("rewrite rule target invalid: %q", rule.Target)
+			}
+
+			r.target = strings.ToLower(dns.Fqdn(rule.Target))
+		case rewriteFlatten:
+		case rewriteIP:
+			_, ipnet, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule cidr invalid: %s", rule.CIDR)
+			}
+
+			ip := net.ParseIP(rule.IP)
+			if ip == nil || (ip.To4() == nil) != (ipnet.IP.To4() == nil) {
+				return nil, fmt.Errorf("rewrite rule ip invalid: %s", rule.IP)
+			}
+
+			r.ipnet, r.ip = ipnet, ip
+		default:
+			return nil, fmt.Errorf("rewrite rule action unknown: %s", rule.Action)
+		}
+
+		list = append(list, r)
+	}
+
+	return list, nil
+}
+
+func (r *rewriter) match(name string) bool {
+	if r.suffix {
+		return dns.IsSubDomain(r.name, name)
+	}
+
+	return name == r.name
+}
+
+// rename replaces the matched name or the matched suffix of the name with the target
+func (r *rewriter) rename(name string) string {
+	return name[:len(name)-len(r.name)] + r.target
+}
+
+// matchRewrites returns the first matching rule of each action for the name
+func matchRewrites(name string) map[string]*rewriter {
+	rewriteRulesMu.RLock()
+	defer rewriteRulesMu.RUnlock()
+
+	if len(rewriteRules) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(name)
+
+	var rules map[string]*rewriter
+	for _, r := range rewriteRules {
+		if _, ok := rules[r.action]; ok || !r.match(name) {
+			continue
+		}
+
+		if rules == nil {
+			rules = make(map[string]*rewriter)
+		}
+
+		rules[r.action] = r
+	}
+
+	return rules
+}
+
+// rewriteQuery resolves the query of the rewritten name then rewrites the
+// answer by the rules of the query name
+func (h *DNSHandler) rewriteQuery(proto string, req *dns.Msg, rules map[string]*rewriter, entry ...*AccessEntry) (*dns.Msg, string) {
+	q := req.Question[0]
+
+	if r := rules[rewriteName]; r != nil {
+		req.Question[0].Name = r.rename(strings.ToLower(q.Name))
+	}
+
+	msg, status := h.lookupStatus(proto, req, entry...)
+
+	resolved := req.Question[0].Name
+	req.Question[0] = q
+
+	if msg == nil {
+		return nil, status
+	}
+
+	// the cached records shared, the sections copied before the changes
+	msg.Answer = copyRRs(msg.Answer)
+
+	if resolved != q.Name {
+		renameAnswer(msg, resolved, q.Name)
+	}
+
+	if rules[rewriteFlatten] != nil {
+		flattenAnswer(msg, q)
+	}
+
+	if r := rules[rewriteIP]; r != nil {
+		r.rewriteIPs(msg)
+	}
+
+	// the question slice shared with the cached message
+	if len(msg.Question) > 0 {
+		msg.Question = []dns.Question{q}
+	}
+
+	return msg, status
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	list := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		list = append(list, dns.Copy(rr))
+	}
+
+	return list
+}
+
+// renameAnswer renames the records of the resolved name to the query name, the
+// signatures not valid anymore
+func renameAnswer(msg *dns.Msg, from, to string) {
+	answer := msg.Answer[:0]
+
+	for _, rr := range msg.Answer {
+		if !strings.EqualFold(rr.Header().Name, from) {
+			answer = append(answer, rr)
+			continue
+		}
+
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+
+		rr.Header().Name = to
+		answer = append(answer, rr)
+	}
+
+	msg.Answer = answer
+	msg.AuthenticatedData = false
+}
+
+// flattenAnswer replaces the cname chain of the query name with the records
+// at the end of the chain owned by the query name, the ttl is the lowest of
+// the chain
+func flattenAnswer(msg *dns.Msg, q dns.Question) {
+	if q.Qtype == dns.TypeCNAME {
+		return
+	}
+
+	name := strings.ToLower(q.Name)
+	ttl := uint32(0)
+	chained := false
+
+	for range msg.Answer {
+		next := ""
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.ToLower(cname.Hdr.Name) == name {
+				next = strings.ToLower(cname.Target)
+				if !chained || cname.Hdr.Ttl < ttl {
+					ttl = cname.Hdr.Ttl
+				}
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		name, chained = next, true
+	}
+
+	if !chained {
+		return
+	}
+
+	var answer []dns.RR
+	for _, rr := range msg.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype != q.Qtype || strings.ToLower(hdr.Name) != name {
+			continue
+		}
+
+		hdr.Name = q.Name
+		if hdr.Ttl > ttl {
+			hdr.Ttl = ttl
+		}
+
+		answer = append(answer, rr)
+	}
+
+	// the chain not resolved to the records kept as is
+	if len(answer) == 0 {
+		return
+	}
+
+	msg.Answer = answer
+	msg.AuthenticatedData = false
+}
+
+// rewriteIPs replaces the addresses in the network of the rule, the
+// signatures of the changed records removed
+func (r *rewriter) rewriteIPs(msg *dns.Msg) {
+	changed := map[uint16]bool{}
+
+	for _, rr := range msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if r.ip.To4() != nil && r.ipnet.Contains(rr.A) {
+				rr.A = r.ip.To4()
+				changed[dns.TypeA] = true
+			}
+		case *dns.AAAA:
+			if r.ip.To4() == nil && r.ipnet.Contains(rr.AAAA) {
+				rr.AAAA = r.ip
+				changed[dns.TypeAAAA] = true
+			}
+		}
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	answer := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && changed[sig.TypeCovered] {
+			continue
+		}
+
+		answer = append(answer, rr)
+	}
+
+	msg.Answer = answer
+	msg.AuthenticatedData = false
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newRewriteRules(t *testing.T) {
+	rules, err := newRewriteRules([]rewriteRule{
+		{Name: "WWW.example.com", Action: "flatten"},
+		{Name: "corp.example.com", Match: "suffix", Action: "name", Target: "corp.internal"},
+		{Name: "example.net", Match: "suffix", Action: "ip", CIDR: "192.0.2.0/24", IP: "10.0.0.1"},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 3) {
+		assert.Equal(t, "www.example.com.", rules[0].name)
+		assert.True(t, rules[0].match("www.example.com."))
+		assert.False(t, rules[0].match("a.www.example.com."))
+
+		assert.True(t, rules[1].match("corp.example.com."))
+		assert.True(t, rules[1].match("host.corp.example.com."))
+		assert.False(t, rules[1].match("xcorp.example.com."))
+		assert.Equal(t, "host.corp.internal.", rules[1].rename("host.corp.example.com."))
+	}
+
+	for _, rule := range []rewriteRule{
+		{Action: "flatten"},
+		{Name: "example.com", Action: "drop"},
+		{Name: "example.com", Match: "regexp", Action: "flatten"},
+		{Name: "example.com", Action: "name"},
+		{Name: "example.com", Action: "ip", CIDR: "192.0.2.0", IP: "10.0.0.1"},
+		{Name: "example.com", Action: "ip", CIDR: "192.0.2.0/24", IP: "2001:db8::1"},
+	} {
+		_, err := newRewriteRules([]rewriteRule{rule})
+		assert.Error(t, err, rule.Name+" "+rule.Action)
+	}
+}
+
+func Test_flattenAnswer(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.AuthenticatedData = true
+
+	for _, s := range []string{
+		"www.example.com. 300 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN CNAME edge.example.org.",
+		"edge.example.org. 600 IN A 192.0.2.1",
+		"edge.example.org. 600 IN A 192.0.2.2",
+		"edge.example.org. 600 IN RRSIG A 8 3 600 20300101000000 20200101000000 1 example.org. AAAA",
+	} {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	flattenAnswer(msg, msg.Question[0])
+	assert.False(t, msg.AuthenticatedData)
+	if assert.Len(t, msg.Answer, 2) {
+		for _, rr := range msg.Answer {
+			assert.Equal(t, "www.example.com.", rr.Header().Name)
+			assert.Equal(t, dns.TypeA, rr.Header().Rrtype)
+			assert.Equal(t, uint32(60), rr.Header().Ttl)
+		}
+	}
+
+	// the unresolved chain kept as is
+	msg.Answer = nil
+	rr, _ := dns.NewRR("www.example.com. 300 IN CNAME cdn.example.net.")
+	msg.Answer = append(msg.Answer, rr)
+
+	flattenAnswer(msg, msg.Question[0])
+	assert.Len(t, msg.Answer, 1)
+}
+
+func Test_rewriteIPs(t *testing.T) {
+	rules, err := newRewriteRules([]rewriteRule{{Name: "example.net", Action: "ip", CIDR: "192.0.2.0/24", IP: "10.0.0.1"}})
+	assert.NoError(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.net.", dns.TypeA)
+
+	for _, s := range []string{
+		"example.net. 300 IN A 192.0.2.1",
+		"example.net. 300 IN A 198.51.100.1",
+		"example.net. 300 IN RRSIG A 8 2 300 20300101000000 20200101000000 1 example.net. AAAA",
+	} {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	rules[0].rewriteIPs(msg)
+	if assert.Len(t, msg.Answer, 2) {
+		assert.Equal(t, "10.0.0.1", msg.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, "198.51.100.1", msg.Answer[1].(*dns.A).A.String())
+	}
+}
+
+func Test_HandlerRewrite(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		var records []string
+		switch q.Name {
+		case "www.rewrite.internal.":
+			records = []string{
+				"www.rewrite.internal. 300 IN CNAME edge.rewrite.internal.",
+				"edge.rewrite.internal. 120 IN A 192.0.2.10",
+			}
+		case "host.target.internal.":
+			records = []string{"host.target.internal. 300 IN A 198.51.100.10"}
+		}
+
+		for _, s := range records {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	zones, err := newForwardZones([]forwardZone{
+		{Zone: "rewrite.internal", Servers: []string{addrstr}},
+		{Zone: "target.internal", Servers: []string{addrstr}},
+	})
+	assert.NoError(t, err)
+
+	rules, err := newRewriteRules([]rewriteRule{
+		{Name: "www.rewrite.internal", Action: "flatten"},
+		{Name: "rewrite.internal", Match: "suffix", Action: "ip", CIDR: "192.0.2.0/24", IP: "10.0.0.10"},
+		{Name: "source.internal", Match: "suffix", Action: "name", Target: "target.internal"},
+	})
+	assert.NoError(t, err)
+
+	forwardZonesMu.Lock()
+	forwardZones = zones
+	forwardZonesMu.Unlock()
+
+	rewriteRulesMu.Lock()
+	rewriteRules = rules
+	rewriteRulesMu.Unlock()
+
+	defer func() {
+		forwardZonesMu.Lock()
+		forwardZones = map[string]*forwarder{}
+		forwardZonesMu.Unlock()
+
+		rewriteRulesMu.Lock()
+		rewriteRules = nil
+		rewriteRulesMu.Unlock()
+	}()
+
+	handler := NewHandler()
+
+	// the miss and the cache hit rewritten alike, the cached answer left as is
+	for _, want := range []string{statusMiss, statusHit} {
+		req := new(dns.Msg)
+		req.SetQuestion("www.rewrite.internal.", dns.TypeA)
+
+		resp, status := handler.queryStatus("udp", req)
+		assert.Equal(t, want, status)
+		assert.Equal(t, "www.rewrite.internal.", resp.Question[0].Name)
+
+		if assert.Len(t, resp.Answer, 1) {
+			a := resp.Answer[0].(*dns.A)
+			assert.Equal(t, "www.rewrite.internal.", a.Hdr.Name)
+			assert.Equal(t, "10.0.0.10", a.A.String())
+			assert.True(t, a.Hdr.Ttl <= 120)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("Host.Source.Internal.", dns.TypeA)
+
+	resp, _ := handler.queryStatus("udp", req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "Host.Source.Internal.", req.Question[0].Name)
+	assert.Equal(t, "Host.Source.Internal.", resp.Question[0].Name)
+
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "Host.Source.Internal.", resp.Answer[0].Header().Name)
+		assert.Equal(t, "198.51.100.10", resp.Answer[0].(*dns.A).A.String())
+	}
+}
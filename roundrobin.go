@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// roundRobinShift is the rotation of the next response, increased on every response
+var roundRobinShift uint32
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+	class  uint16
+}
+
+// roundRobin returns the response with the address records of the answer
+// sets rotated one position more than the previous response. Only the order
+// inside the sets changed, the signatures cover the sets in the canonical
+// order so the validation not affected. The answer section shared with the
+// cache, the response copied before the changes.
+func roundRobin(msg *dns.Msg) *dns.Msg {
+	sets, ok := addressSets(msg)
+	if !ok {
+		return msg
+	}
+
+	shift := atomic.AddUint32(&roundRobinShift, 1) - 1
+
+	answer := make([]dns.RR, len(msg.Answer))
+	copy(answer, msg.Answer)
+
+	for _, set := range sets {
+		n := uint32(len(set))
+		for j, i := range set {
+			answer[i] = msg.Answer[set[(uint32(j)+shift)%n]]
+		}
+	}
+
+	m := new(dns.Msg)
+	*m = *msg
+	m.Answer = answer
+
+	return m
+}
+
+// addressSets returns the positions of the address records of the answer by
+// their sets, false if no set has more than one record
+func addressSets(msg *dns.Msg) (map[rrsetKey][]int, bool) {
+	sets := make(map[rrsetKey][]int)
+
+	for i, rr := range msg.Answer {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA {
+			continue
+		}
+
+		k := rrsetKey{name: strings.ToLower(h.Name), rrtype: h.Rrtype, class: h.Class}
+		sets[k] = append(sets[k], i)
+	}
+
+	for _, set := range sets {
+		if len(set) > 1 {
+			return sets, true
+		}
+	}
+
+	return nil, false
+}
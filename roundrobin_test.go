@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func answerAddrs(msg *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		case *dns.RRSIG:
+			addrs = append(addrs, "rrsig")
+		}
+	}
+
+	return addrs
+}
+
+func Test_roundRobin(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Answer = newRRs(
+		"www.example.com. 300 IN CNAME web.example.com.",
+		"web.example.com. 300 IN A 192.0.2.1",
+		"web.example.com. 300 IN A 192.0.2.2",
+		"web.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 1 example.com. AAAA",
+		"web.example.com. 300 IN A 192.0.2.3",
+	)
+
+	roundRobinShift = 0
+
+	var orders [][]string
+	for i := 0; i < 4; i++ {
+		resp := roundRobin(msg)
+		assert.Equal(t, dns.TypeCNAME, resp.Answer[0].Header().Rrtype)
+		orders = append(orders, answerAddrs(resp))
+	}
+
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "rrsig", "192.0.2.3"}, orders[0])
+	assert.Equal(t, []string{"192.0.2.2", "192.0.2.3", "rrsig", "192.0.2.1"}, orders[1])
+	assert.Equal(t, []string{"192.0.2.3", "192.0.2.1", "rrsig", "192.0.2.2"}, orders[2])
+	assert.Equal(t, orders[0], orders[3])
+
+	// the shared answer left as is
+	assert.Equal(t, orders[0], answerAddrs(msg))
+
+	single := new(dns.Msg)
+	single.Answer = newRRs("www.example.com. 300 IN A 192.0.2.1")
+	assert.True(t, roundRobin(single) == single)
+}
+
+func Test_HandlerRoundRobin(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.RoundRobin = true })()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("rr.example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = newRRs(
+		"rr.example.com. 300 IN A 192.0.2.1",
+		"rr.example.com. 300 IN A 192.0.2.2",
+	)
+
+	key := cache.Hash(req.Question[0], req.CheckingDisabled)
+	handler.r.Qcache.Set(key, m)
+
+	first := answerAddrs(handler.query("udp", req))
+	second := answerAddrs(handler.query("udp", req))
+
+	assert.Len(t, first, 2)
+	assert.NotEqual(t, first, second)
+	assert.ElementsMatch(t, first, second)
+
+	// the cached answer kept canonical
+	cached, _, err := handler.r.Qcache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, answerAddrs(cached))
+}
@@ -0,0 +1,596 @@
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Action is the policy action of a rule
+type Action int
+
+// The policy actions, selected by the CNAME target of the rule
+const (
+	// Passthru answers the query normally, the later rules skipped
+	Passthru Action = iota
+	// NXDomain answers the query with NXDOMAIN
+	NXDomain
+	// NoData answers the query with an empty answer
+	NoData
+	// Drop sends no answer to the client
+	Drop
+	// TCPOnly truncates the udp answers, the client should retry over tcp
+	TCPOnly
+	// Local answers the query with the local data of the rule
+	Local
+)
+
+var actionNames = map[Action]string{
+	Passthru: "passthru",
+	NXDomain: "nxdomain",
+	NoData:   "nodata",
+	Drop:     "drop",
+	TCPOnly:  "tcp-only",
+	Local:    "local",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Trigger is what a rule matches
+type Trigger int
+
+// The policy triggers
+const (
+	// ClientIP matches the client address
+	ClientIP Trigger = iota
+	// QName matches the query name
+	QName
+	// ResponseIP matches the addresses in the answer
+	ResponseIP
+	// NSDName matches the name servers of the answer
+	NSDName
+)
+
+var triggerNames = map[Trigger]string{
+	ClientIP:   "client-ip",
+	QName:      "qname",
+	ResponseIP: "response-ip",
+	NSDName:    "nsdname",
+}
+
+func (t Trigger) String() string {
+	return triggerNames[t]
+}
+
+// The trigger labels of the rule owners and the special CNAME targets
+const (
+	rootzone = "."
+
+	labelClientIP = "rpz-client-ip"
+	labelIP       = "rpz-ip"
+	labelNSDName  = "rpz-nsdname"
+	labelNSIP     = "rpz-nsip"
+
+	targetPassthru = "rpz-passthru."
+	targetDrop     = "rpz-drop."
+	targetTCPOnly  = "rpz-tcp-only."
+)
+
+// Rule is a policy rule of a zone
+type Rule struct {
+	Zone    string
+	Trigger Trigger
+	Name    string
+	Action  Action
+
+	// RRs is the local data of the local rules
+	RRs []dns.RR
+
+	soa *dns.SOA
+}
+
+// Zone is a loaded policy zone
+type Zone struct {
+	Name string
+
+	qnames     map[string]*Rule
+	qwildcards map[string]*Rule
+	nsdnames   map[string]*Rule
+	nswildcard map[string]*Rule
+
+	clientIPs   []*prefixRule
+	responseIPs []*prefixRule
+
+	soa *dns.SOA
+}
+
+type prefixRule struct {
+	ipnet *net.IPNet
+	size  int
+	rule  *Rule
+}
+
+// Policy holds the policy zones in their precedence order
+type Policy struct {
+	mu sync.RWMutex
+
+	zones    []*Zone
+	nsdnames bool
+}
+
+// New returns a new empty policy
+func New() *Policy {
+	return &Policy{}
+}
+
+// Load replaces the policy zones with the zone files, the first file has the
+// highest precedence. The old zones kept on error.
+func (p *Policy) Load(files ...string) error {
+	zones, err := LoadZones(files...)
+	if err != nil {
+		return err
+	}
+
+	p.Set(zones)
+
+	return nil
+}
+
+// LoadZones parses the zone files in the order of the precedence
+func LoadZones(files ...string) ([]*Zone, error) {
+	zones := make([]*Zone, 0, len(files))
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("rpz file open failed: %s", err)
+		}
+
+		z, err := Parse(file, path)
+		file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("rpz file parse failed: %s", err)
+		}
+
+		zones = append(zones, z)
+	}
+
+	return zones, nil
+}
+
+// Set replaces the policy zones with the parsed ones, the first zone has the
+// highest precedence
+func (p *Policy) Set(zones []*Zone) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.zones = zones
+	p.nsdnames = false
+
+	for _, z := range zones {
+		if len(z.nsdnames) > 0 || len(z.nswildcard) > 0 {
+			p.nsdnames = true
+		}
+	}
+}
+
+// Zones returns the names of the loaded zones
+func (p *Policy) Zones() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.zones))
+	for _, z := range p.zones {
+		names = append(names, z.Name)
+	}
+
+	return names
+}
+
+// HasNSDName reports whether any zone has nsdname rules
+func (p *Policy) HasNSDName() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.nsdnames
+}
+
+// Query returns the first rule matching the client address or the query name,
+// the client-ip rules of a zone have precedence over its qname rules
+func (p *Policy) Query(client net.IP, qname string) *Rule {
+	qname = strings.ToLower(dns.Fqdn(qname))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, z := range p.zones {
+		if client != nil {
+			if r := matchIP(z.clientIPs, client); r != nil {
+				return r
+			}
+		}
+
+		if r := matchName(z.qnames, z.qwildcards, qname); r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// Response returns the first rule matching the addresses in the answer or the
+// name servers of the answer, the response-ip rules of a zone have precedence
+// over its nsdname rules
+func (p *Policy) Response(msg *dns.Msg, nsnames []string) *Rule {
+	var ips []net.IP
+
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, z := range p.zones {
+		var best *prefixRule
+
+		for _, ip := range ips {
+			if m := longestPrefix(z.responseIPs, ip); m != nil && (best == nil || m.size > best.size) {
+				best = m
+			}
+		}
+
+		if best != nil {
+			return best.rule
+		}
+
+		for _, name := range nsnames {
+			if r := matchName(z.nsdnames, z.nswildcard, strings.ToLower(name)); r != nil {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reply returns the answer of the rule for the request, the passthru and drop
+// rules have no answer. The answer of the tcp-only rules is truncated.
+func (r *Rule) Reply(req *dns.Msg) *dns.Msg {
+	if r.Action == Passthru || r.Action == Drop {
+		return nil
+	}
+
+	q := req.Question[0]
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = false
+	msg.RecursionAvailable = true
+
+	switch r.Action {
+	case TCPOnly:
+		msg.Truncated = true
+		return msg
+	case NXDomain:
+		msg.Rcode = dns.RcodeNameError
+	}
+
+	if r.Action == Local {
+		for _, rr := range r.RRs {
+			if rr.Header().Rrtype != q.Qtype && rr.Header().Rrtype != dns.TypeCNAME {
+				continue
+			}
+
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+
+	if len(msg.Answer) == 0 && r.soa != nil {
+		soa := dns.Copy(r.soa).(*dns.SOA)
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+
+		msg.Ns = append(msg.Ns, soa)
+	}
+
+	return msg
+}
+
+// Parse reads a policy zone in the zone file format, the zone name is the
+// owner of the SOA record which must be the first record
+func Parse(r io.Reader, file string) (*Zone, error) {
+	z := &Zone{
+		qnames:     make(map[string]*Rule),
+		qwildcards: make(map[string]*Rule),
+		nsdnames:   make(map[string]*Rule),
+		nswildcard: make(map[string]*Rule),
+	}
+
+	var err error
+
+	for t := range dns.ParseZone(r, rootzone, file) {
+		if err != nil {
+			// drains the parser
+			continue
+		}
+
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+
+		if z.soa == nil {
+			soa, ok := t.RR.(*dns.SOA)
+			if !ok {
+				err = fmt.Errorf("%s: zone has no SOA record", file)
+				continue
+			}
+
+			z.Name = strings.ToLower(soa.Hdr.Name)
+			z.soa = soa
+
+			continue
+		}
+
+		err = z.add(t.RR)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: zone has no SOA record", file)
+	}
+
+	return z, nil
+}
+
+// add adds the record to the rule of its owner, the records of the other
+// rules of the same owner ignored
+func (z *Zone) add(rr dns.RR) error {
+	owner := strings.ToLower(rr.Header().Name)
+	if owner == z.Name {
+		// apex records
+		return nil
+	}
+
+	name, ok := relativeName(owner, z.Name)
+	if !ok {
+		return fmt.Errorf("record out of zone %s: %s", z.Name, owner)
+	}
+
+	action := Local
+	if cname, ok := rr.(*dns.CNAME); ok {
+		action = cnameAction(strings.ToLower(cname.Target))
+	}
+
+	rule, err := z.rule(name)
+	if err != nil || rule == nil {
+		return err
+	}
+
+	switch {
+	case rule.Action == Local && action == Local:
+		rule.RRs = append(rule.RRs, rr)
+	case rule.Action == Local && len(rule.RRs) == 0:
+		// a new rule
+		rule.Action = action
+	}
+
+	return nil
+}
+
+// rule returns the rule of the relative owner name, created if not found.
+// The rpz-nsip rules are not supported and skipped.
+func (z *Zone) rule(name string) (*Rule, error) {
+	labels := dns.SplitDomainName(name)
+	last := labels[len(labels)-1]
+
+	switch last {
+	case labelClientIP, labelIP:
+		ipnet, size, err := parsePrefix(labels[:len(labels)-1])
+		if err != nil {
+			return nil, fmt.Errorf("rule %s invalid: %s", name, err)
+		}
+
+		list, trigger := &z.clientIPs, ClientIP
+		if last == labelIP {
+			list, trigger = &z.responseIPs, ResponseIP
+		}
+
+		for _, p := range *list {
+			if p.size == size && p.ipnet.IP.Equal(ipnet.IP) {
+				return p.rule, nil
+			}
+		}
+
+		r := z.newRule(trigger, name)
+		*list = append(*list, &prefixRule{ipnet: ipnet, size: size, rule: r})
+
+		return r, nil
+	case labelNSDName:
+		return z.nameRule(NSDName, strings.TrimSuffix(name, "."+labelNSDName), z.nsdnames, z.nswildcard), nil
+	case labelNSIP:
+		return nil, nil
+	}
+
+	return z.nameRule(QName, name, z.qnames, z.qwildcards), nil
+}
+
+func (z *Zone) nameRule(trigger Trigger, name string, names, wildcards map[string]*Rule) *Rule {
+	list := names
+	if strings.HasPrefix(name, "*.") {
+		list, name = wildcards, name[2:]
+	}
+
+	key := dns.Fqdn(name)
+
+	if r, ok := list[key]; ok {
+		return r
+	}
+
+	r := z.newRule(trigger, dns.Fqdn(name))
+	list[key] = r
+
+	return r
+}
+
+func (z *Zone) newRule(trigger Trigger, name string) *Rule {
+	return &Rule{Zone: z.Name, Trigger: trigger, Name: name, Action: Local, soa: z.soa}
+}
+
+// cnameAction returns the action of the CNAME target
+func cnameAction(target string) Action {
+	switch target {
+	case rootzone:
+		return NXDomain
+	case "*.":
+		return NoData
+	case targetPassthru:
+		return Passthru
+	case targetDrop:
+		return Drop
+	case targetTCPOnly:
+		return TCPOnly
+	}
+
+	return Local
+}
+
+// relativeName returns the owner name without the zone name and the trailing dot
+func relativeName(owner, zone string) (string, bool) {
+	if zone == rootzone {
+		return strings.TrimSuffix(owner, "."), owner != rootzone
+	}
+
+	if !strings.HasSuffix(owner, "."+zone) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(owner, "."+zone), true
+}
+
+// parsePrefix parses the prefix length and the reversed address labels of an
+// ip trigger, the zz label of the IPv6 addresses stands for the ::
+func parsePrefix(labels []string) (*net.IPNet, int, error) {
+	if len(labels) < 2 {
+		return nil, 0, fmt.Errorf("address missing")
+	}
+
+	size, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("prefix length invalid: %s", labels[0])
+	}
+
+	parts := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i > 0; i-- {
+		parts = append(parts, labels[i])
+	}
+
+	bits := 32
+	addr := strings.Join(parts, ".")
+
+	if len(parts) != 4 || net.ParseIP(addr) == nil {
+		bits = 128
+		addr = strings.Join(parts, ":")
+
+		if i := indexOf(parts, "zz"); i >= 0 {
+			addr = strings.Join(parts[:i], ":") + "::" + strings.Join(parts[i+1:], ":")
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("address invalid: %s", addr)
+	}
+
+	if size < 1 || size > bits {
+		return nil, 0, fmt.Errorf("prefix length invalid: %d", size)
+	}
+
+	mask := net.CIDRMask(size, bits)
+
+	if bits == 32 {
+		ip = ip.To4()
+	}
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, size, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// matchName returns the rule of the name or the most specific wildcard rule of
+// its parents
+func matchName(names, wildcards map[string]*Rule, name string) *Rule {
+	if r, ok := names[name]; ok {
+		return r
+	}
+
+	if len(wildcards) == 0 {
+		return nil
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if r, ok := wildcards[name[off:]]; ok {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// matchIP returns the rule of the longest prefix containing the address
+func matchIP(list []*prefixRule, ip net.IP) *Rule {
+	if p := longestPrefix(list, ip); p != nil {
+		return p.rule
+	}
+
+	return nil
+}
+
+func longestPrefix(list []*prefixRule, ip net.IP) *prefixRule {
+	var best *prefixRule
+
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	for _, p := range list {
+		if len(p.ipnet.IP) != len(ip) || !p.ipnet.Contains(ip) {
+			continue
+		}
+
+		if best == nil || p.size > best.size {
+			best = p
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,253 @@
+package rpz
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testZone = `$TTL 300
+$ORIGIN rpz.local.
+@                           SOA localhost. root.localhost. 1 3600 600 86400 60
+@                           NS  localhost.
+bad.example.com             CNAME .
+*.bad.example.com           CNAME .
+empty.example.com           CNAME *.
+good.bad.example.com        CNAME rpz-passthru.
+drop.example.com            CNAME rpz-drop.
+tcp.example.com             CNAME rpz-tcp-only.
+local.example.com           A     192.0.2.10
+local.example.com           AAAA  2001:db8::10
+alias.example.com           CNAME walled.example.net.
+32.1.2.0.192.rpz-ip         CNAME .
+24.0.100.51.198.rpz-ip      CNAME *.
+128.1.zz.db8.2001.rpz-ip    CNAME rpz-drop.
+24.0.2.0.10.rpz-client-ip   CNAME rpz-drop.
+ns.evil.example.rpz-nsdname CNAME .
+*.evil.example.rpz-nsdname  CNAME *.
+10.1.0.0.127.rpz-nsip       CNAME .
+`
+
+func parseTestZone(t *testing.T) *Policy {
+	z, err := Parse(strings.NewReader(testZone), "test.rpz")
+	assert.NoError(t, err)
+
+	p := New()
+	p.zones = []*Zone{z}
+	p.nsdnames = true
+
+	return p
+}
+
+func Test_Parse(t *testing.T) {
+	z, err := Parse(strings.NewReader(testZone), "test.rpz")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "rpz.local.", z.Name)
+	assert.Len(t, z.qnames, 7)
+	assert.Len(t, z.qwildcards, 1)
+	assert.Len(t, z.responseIPs, 3)
+	assert.Len(t, z.clientIPs, 1)
+	assert.Len(t, z.nsdnames, 1)
+	assert.Len(t, z.nswildcard, 1)
+
+	_, err = Parse(strings.NewReader("example.com. 300 IN A 192.0.2.1\n"), "nosoa.rpz")
+	assert.Error(t, err)
+
+	_, err = Parse(strings.NewReader("rpz.local. 300 IN SOA localhost. root.localhost. 1 3600 600 86400 60\n"+
+		"bad.example.com. 300 IN A 192.0.2.1\n"), "outofzone.rpz")
+	assert.Error(t, err)
+
+	_, err = Parse(strings.NewReader("rpz.local. 300 IN SOA localhost. root.localhost. 1 3600 600 86400 60\n"+
+		"33.1.2.0.192.rpz-ip.rpz.local. 300 IN CNAME .\n"), "prefix.rpz")
+	assert.Error(t, err)
+}
+
+func Test_parsePrefix(t *testing.T) {
+	ipnet, size, err := parsePrefix([]string{"24", "0", "2", "0", "192"})
+	assert.NoError(t, err)
+	assert.Equal(t, 24, size)
+	assert.Equal(t, "192.0.2.0/24", ipnet.String())
+
+	ipnet, size, err = parsePrefix([]string{"48", "zz", "db8", "2001"})
+	assert.NoError(t, err)
+	assert.Equal(t, 48, size)
+	assert.Equal(t, "2001:db8::/48", ipnet.String())
+
+	ipnet, _, err = parsePrefix([]string{"128", "1", "zz", "db8", "2001"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1/128", ipnet.String())
+
+	_, _, err = parsePrefix([]string{"24", "0", "2", "0", "300"})
+	assert.Error(t, err)
+
+	_, _, err = parsePrefix([]string{"x", "0", "2", "0", "192"})
+	assert.Error(t, err)
+
+	_, _, err = parsePrefix([]string{"24"})
+	assert.Error(t, err)
+}
+
+func Test_PolicyQuery(t *testing.T) {
+	p := parseTestZone(t)
+
+	tests := []struct {
+		client string
+		qname  string
+		action Action
+		found  bool
+	}{
+		{"", "bad.example.com.", NXDomain, true},
+		{"", "Sub.Bad.Example.com.", NXDomain, true},
+		{"", "good.bad.example.com.", Passthru, true},
+		{"", "empty.example.com.", NoData, true},
+		{"", "drop.example.com.", Drop, true},
+		{"", "tcp.example.com.", TCPOnly, true},
+		{"", "local.example.com.", Local, true},
+		{"", "example.com.", Passthru, false},
+		{"", "sub.local.example.com.", Passthru, false},
+		{"10.0.2.1", "example.com.", Drop, true},
+		{"10.0.3.1", "example.com.", Passthru, false},
+	}
+
+	for _, tt := range tests {
+		r := p.Query(net.ParseIP(tt.client), tt.qname)
+		if !tt.found {
+			assert.Nil(t, r, tt.qname)
+			continue
+		}
+
+		if assert.NotNil(t, r, tt.qname) {
+			assert.Equal(t, tt.action, r.Action, tt.qname)
+			assert.Equal(t, "rpz.local.", r.Zone)
+		}
+	}
+
+	r := p.Query(net.ParseIP("10.0.2.1"), "bad.example.com.")
+	assert.Equal(t, ClientIP, r.Trigger)
+}
+
+func Test_PolicyResponse(t *testing.T) {
+	p := parseTestZone(t)
+
+	answer := func(rrs ...string) *dns.Msg {
+		msg := new(dns.Msg)
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			assert.NoError(t, err)
+			msg.Answer = append(msg.Answer, rr)
+		}
+
+		return msg
+	}
+
+	r := p.Response(answer("example.com. 300 IN A 192.0.2.1"), nil)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, NXDomain, r.Action)
+		assert.Equal(t, ResponseIP, r.Trigger)
+	}
+
+	assert.Nil(t, p.Response(answer("example.com. 300 IN A 192.0.2.2"), nil))
+
+	r = p.Response(answer("example.com. 300 IN A 192.0.2.2", "example.com. 300 IN A 198.51.100.7"), nil)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, NoData, r.Action)
+	}
+
+	r = p.Response(answer("example.com. 300 IN AAAA 2001:db8::1"), nil)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, Drop, r.Action)
+	}
+
+	r = p.Response(answer(), []string{"ns1.example.org.", "NS.evil.example."})
+	if assert.NotNil(t, r) {
+		assert.Equal(t, NXDomain, r.Action)
+		assert.Equal(t, NSDName, r.Trigger)
+	}
+
+	r = p.Response(answer(), []string{"ns2.evil.example."})
+	if assert.NotNil(t, r) {
+		assert.Equal(t, NoData, r.Action)
+	}
+
+	assert.Nil(t, p.Response(answer(), []string{"ns1.example.org."}))
+}
+
+func Test_RuleReply(t *testing.T) {
+	p := parseTestZone(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("bad.example.com.", dns.TypeA)
+
+	msg := p.Query(nil, req.Question[0].Name).Reply(req)
+	assert.Equal(t, dns.RcodeNameError, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+	if assert.Len(t, msg.Ns, 1) {
+		assert.Equal(t, uint32(60), msg.Ns[0].Header().Ttl)
+	}
+
+	req.SetQuestion("local.example.com.", dns.TypeAAAA)
+	msg = p.Query(nil, req.Question[0].Name).Reply(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "local.example.com.", msg.Answer[0].Header().Name)
+		assert.Equal(t, "2001:db8::10", msg.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	req.SetQuestion("local.example.com.", dns.TypeMX)
+	msg = p.Query(nil, req.Question[0].Name).Reply(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+	assert.Len(t, msg.Ns, 1)
+
+	req.SetQuestion("alias.example.com.", dns.TypeA)
+	msg = p.Query(nil, req.Question[0].Name).Reply(req)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "walled.example.net.", msg.Answer[0].(*dns.CNAME).Target)
+	}
+
+	req.SetQuestion("tcp.example.com.", dns.TypeA)
+	msg = p.Query(nil, req.Question[0].Name).Reply(req)
+	assert.True(t, msg.Truncated)
+	assert.Len(t, msg.Ns, 0)
+
+	req.SetQuestion("drop.example.com.", dns.TypeA)
+	assert.Nil(t, p.Query(nil, req.Question[0].Name).Reply(req))
+}
+
+func Test_PolicyLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_rpz")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.rpz")
+	second := filepath.Join(dir, "second.rpz")
+
+	assert.NoError(t, ioutil.WriteFile(first, []byte("$ORIGIN first.rpz.\n"+
+		"@ 300 SOA localhost. root.localhost. 1 3600 600 86400 60\n"+
+		"example.com 300 CNAME rpz-passthru.\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(second, []byte("$ORIGIN second.rpz.\n"+
+		"@ 300 SOA localhost. root.localhost. 1 3600 600 86400 60\n"+
+		"example.com 300 CNAME .\n"+
+		"example.org 300 CNAME .\n"), 0644))
+
+	p := New()
+	assert.NoError(t, p.Load(first, second))
+	assert.Equal(t, []string{"first.rpz.", "second.rpz."}, p.Zones())
+	assert.False(t, p.HasNSDName())
+
+	assert.Equal(t, Passthru, p.Query(nil, "example.com.").Action)
+	assert.Equal(t, NXDomain, p.Query(nil, "example.org.").Action)
+
+	assert.Error(t, p.Load(first, filepath.Join(dir, "notfound.rpz")))
+	assert.Len(t, p.Zones(), 2)
+
+	assert.NoError(t, p.Load())
+	assert.Nil(t, p.Query(nil, "example.org."))
+}
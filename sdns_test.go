@@ -1,9 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
 	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/yl2chen/cidranger"
 )
@@ -26,32 +29,42 @@ var (
 func TestMain(m *testing.M) {
 	log.Root().SetHandler(log.LvlFilterHandler(0, log.StdoutHandler))
 
-	Config.RootServers = []string{"192.5.5.241:53"}
-	Config.RootKeys = []string{
+	Config().RootServers = []string{"192.5.5.241:53"}
+	Config().PrimeRoots = true
+	Config().RootKeys = []string{
 		".			172800	IN	DNSKEY	257 3 8 AwEAAagAIKlVZrpC6Ia7gEzahOR+9W29euxhJhVVLOyQbSEW0O8gcCjFFVQUTf6v58fLjwBd0YI0EzrAcQqBGCzh/RStIoO8g0NfnfL2MTJRkxoXbfDaUeVPQuYEhg37NZWAJQ9VnMVDxP/VHL496M/QZxkjf5/Efucp2gaDX6RS6CXpoY68LsvPVjR0ZSwzz1apAzvN9dlzEheX7ICJBBtuA6G3LQpzW5hOA2hzCTMjJPJ8LbqF6dsV6DoBQzgul0sGIcGOYl7OyQdXfZ57relSQageu+ipAdTTJ25AsRTAoub8ONGcLmqrAmRLKBP1dfwhYB4N7knNnulqQxA+Uk1ihz0=",
 		".			172800	IN	DNSKEY	256 3 8 AwEAAdp440E6Mz7c+Vl4sPd0lTv2Qnc85dTW64j0RDD7sS/zwxWDJ3QRES2VKDO0OXLMqVJSs2YCCSDKuZXpDPuf++YfAu0j7lzYYdWTGwyNZhEaXtMQJIKYB96pW6cRkiG2Dn8S2vvo/PxW9PKQsyLbtd8PcwWglHgReBVp7kEv/Dd+3b3YMukt4jnWgDUddAySg558Zld+c9eGWkgWoOiuhg4rQRkFstMX1pRyOSHcZuH38o1WcsT4y3eT0U/SR6TOSLIB/8Ftirux/h297oS7tCcwSPt0wwry5OFNTlfMo8v7WGurogfk8hPipf7TTKHIi20LWen5RCsvYsQBkYGpF78=",
 	}
-	Config.Maxdepth = 30
-	Config.Expire = 600
-	Config.Timeout.Duration = 2 * time.Second
-	Config.ConnectTimeout.Duration = 2 * time.Second
-	Config.Nullroute = "0.0.0.0"
-	Config.Nullroutev6 = "0:0:0:0:0:0:0:0"
-	Config.Bind = ":0"
-	Config.BindTLS = ""
-	Config.BindDOH = ""
-	Config.API = ""
-
-	if len(Config.RootServers) > 0 {
+	Config().Maxdepth = 30
+	Config().MaxCNAMEDepth = 10
+	Config().MaxRecursionDepth = 64
+	Config().AnyQueryMode = anyRefuse
+	Config().UDPMinSize = DefaultUDPMinSize
+	Config().UDPMaxSize = DefaultUDPMaxSize
+	Config().UpstreamUDPSize = DefaultUpstreamUDPSize
+	Config().Expire = 600
+	Config().Timeout.Duration = 2 * time.Second
+	Config().ConnectTimeout.Duration = 2 * time.Second
+	Config().UpstreamMaxConns = DefaultUpstreamMaxConns
+	Config().UpstreamIdleTimeout.Duration = DefaultUpstreamIdleTimeout
+	Config().RetryOnServfail = DefaultServfailRetries
+	Config().Nullroute = "0.0.0.0"
+	Config().Nullroutev6 = "0:0:0:0:0:0:0:0"
+	Config().Bind = ":0"
+	Config().BindTLS = ""
+	Config().BindDOH = ""
+	Config().API = ""
+
+	if len(Config().RootServers) > 0 {
 		rootservers = &cache.AuthServers{}
-		for _, s := range Config.RootServers {
+		for _, s := range Config().RootServers {
 			rootservers.List = append(rootservers.List, cache.NewAuthServer(s))
 		}
 	}
 
-	if len(Config.RootKeys) > 0 {
+	if len(Config().RootKeys) > 0 {
 		rootkeys = []dns.RR{}
-		for _, k := range Config.RootKeys {
+		for _, k := range Config().RootKeys {
 			rr, err := dns.NewRR(k)
 			if err != nil {
 				log.Crit("Root keys invalid", "error", err.Error())
@@ -75,20 +88,57 @@ func TestMain(m *testing.M) {
 		block.GET("/get/:key", getBlock)
 		block.GET("/remove/:key", removeBlock)
 		block.GET("/set/:key", setBlock)
+		block.GET("/check/:key", checkBlock)
+
+		block.GET("/sources", listBlocklistSources)
+
+		block.GET("", listRuntimeBlocks)
+		block.POST("", addRuntimeBlock)
+		block.DELETE("/:key", removeRuntimeBlock)
+	}
+
+	ginr.GET("/api/v1/health", healthState)
+	ginr.GET("/api/v1/dnssec", listDNSSEC)
+	ginr.GET("/api/v1/dnssec/:zone", getDNSSEC)
+
+	nta := ginr.Group("/api/v1/nta")
+	{
+		nta.GET("", listNTAs)
+		nta.POST("", addNTA)
+		nta.DELETE("/:zone", removeNTA)
 	}
+	ginr.GET("/api/v1/log/stream", streamQueryLogs)
+
+	ginr.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	m.Run()
 }
 
+// setConfig swaps in a copy of the active config changed by set, the queries
+// still running keep reading the config they loaded. The returned func swaps
+// the old config back the same way.
+func setConfig(set func(cfg *config)) func() {
+	old := Config()
+
+	cfg := *old
+	set(&cfg)
+	currentConfig.Store(&cfg)
+
+	return func() { currentConfig.Store(old) }
+}
+
 func Test_Blocklist(t *testing.T) {
 	tempDir := filepath.Join(os.TempDir(), "/sdns_temp")
 
-	Config.Whitelist = append(Config.Whitelist, testDomain)
-	Config.Blocklist = append(Config.Blocklist, testDomain)
+	setConfig(func(cfg *config) {
+		cfg.Whitelist = append(cfg.Whitelist, testDomain)
+		cfg.Blocklist = append(cfg.Blocklist, testDomain)
 
-	Config.BlockLists = []string{}
-	Config.BlockLists = append(Config.BlockLists, "https://raw.githubusercontent.com/quidsup/notrack/master/trackers.txt")
-	Config.BlockLists = append(Config.BlockLists, "https://test.dev/hosts")
+		cfg.BlockLists = []string{
+			"https://raw.githubusercontent.com/quidsup/notrack/master/trackers.txt",
+			"https://test.dev/hosts",
+		}
+	})
 
 	err := updateBlocklists(tempDir)
 	assert.NoError(t, err)
@@ -98,11 +148,84 @@ func Test_Blocklist(t *testing.T) {
 }
 
 func Test_start(t *testing.T) {
-	configSetup(true)
+	err := configSetup(true)
+	assert.NoError(t, err)
+
 	start()
 	time.Sleep(2 * time.Second)
 }
 
+func Test_configReload(t *testing.T) {
+	const configFile = "reload.toml"
+
+	defer func(path string) { *ConfigPath = path }(*ConfigPath)
+	*ConfigPath = configFile
+
+	err := generateConfig(configFile)
+	assert.NoError(t, err)
+	defer os.Remove(configFile)
+
+	err = configSetup(true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(600), Config().Expire)
+
+	old := Config()
+
+	data, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+
+	changed := strings.Replace(string(data), "expire = 600", "expire = 300", 1)
+	err = ioutil.WriteFile(configFile, []byte(changed), 0644)
+	assert.NoError(t, err)
+
+	err = configSetup(true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(300), Config().Expire)
+	assert.Equal(t, uint32(600), old.Expire)
+
+	// the bootstrap servers of the rejected config not applied either
+	bad := strings.Replace(changed, `"0.0.0.0/0"`, `"0.0.0.0/99"`, 1)
+	bad = strings.Replace(bad, "bootstrapservers = []", `bootstrapservers = ["192.0.2.53"]`, 1)
+	err = ioutil.WriteFile(configFile, []byte(bad), 0644)
+	assert.NoError(t, err)
+
+	err = configSetup(true)
+	assert.Error(t, err)
+	assert.Equal(t, uint32(300), Config().Expire)
+	assert.True(t, allowedClient("127.0.0.1"))
+
+	bootstrap.mu.Lock()
+	assert.Empty(t, bootstrap.servers)
+	bootstrap.mu.Unlock()
+
+	// the tls listener without a loadable certificate rejected before the swap
+	badCert := strings.Replace(changed, `# binddoq = ":853"`, `binddoq = "127.0.0.1:0"`+"\n"+`tlscertificate = "missing.cert"`, 1)
+	err = ioutil.WriteFile(configFile, []byte(badCert), 0644)
+	assert.NoError(t, err)
+
+	err = configSetup(true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tls certificate invalid")
+	}
+	assert.Equal(t, "", Config().BindDOQ)
+
+	// the hosts file of the config rejected by a later parse not loaded
+	const hostsFile = "reload.hosts"
+
+	err = ioutil.WriteFile(hostsFile, []byte("192.0.2.1 reload.example.\n"), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(hostsFile)
+
+	badNTA := strings.Replace(changed, `# hostsfile = "/etc/sdns/hosts"`, `hostsfile = "`+hostsFile+`"`, 1)
+	badNTA = strings.Replace(badNTA, "negativetrustanchors = []", `negativetrustanchors = ["."]`, 1)
+	err = ioutil.WriteFile(configFile, []byte(badNTA), 0644)
+	assert.NoError(t, err)
+
+	err = configSetup(true)
+	assert.Error(t, err)
+	assert.Nil(t, LocalHosts.lookup("reload.example."))
+}
+
 func BenchmarkExchange(b *testing.B) {
 	s, addrstr, err := RunLocalUDPServer("127.0.0.1:0")
 	assert.NoError(b, err)
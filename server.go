@@ -2,15 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	l "log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/dnspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Server type
@@ -19,104 +27,571 @@ type Server struct {
 
 	tlsHost        string
 	dohHost        string
+	doqHost        string
+	grpcHost       string
 	tlsCertificate string
 	tlsPrivateKey  string
+	tlsOptions     string
+
+	certs *certStore
 
 	rTimeout time.Duration
 	wTimeout time.Duration
+
+	mu sync.Mutex
+
+	handler *DNSHandler
+
+	udpServer *dns.Server
+	tcpServer *dns.Server
+	tlsServer *dns.Server
+	dohServer *http.Server
+	doqServer *quic.Listener
+	doqConn   net.PacketConn
+
+	grpcServer *grpc.Server
+	grpcAddr   string
 }
 
-// Run starts the server
+// Run starts the server, the listen failures fatal
 func (s *Server) Run() {
-	handler := NewHandler()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handler = NewHandler()
+
+	if err := s.runDNS(s.host); err != nil {
+		log.Crit("DNS listener failed", "net", "dns", "addr", s.host, "error", err.Error())
+	}
+
+	if err := s.runTLS(s.tlsHost); err != nil {
+		log.Crit("DNS listener failed", "net", "tcp-tls", "addr", s.tlsHost, "error", err.Error())
+	}
+
+	if err := s.runDOH(s.dohHost); err != nil {
+		log.Crit("DNS listener failed", "net", "https", "addr", s.dohHost, "error", err.Error())
+	}
+
+	if err := s.runDOQ(s.doqHost); err != nil {
+		log.Crit("DNS listener failed", "net", "quic", "addr", s.doqHost, "error", err.Error())
+	}
+
+	if err := s.runGRPC(s.grpcHost); err != nil {
+		log.Crit("DNS listener failed", "net", "grpc", "addr", s.grpcHost, "error", err.Error())
+	}
+}
+
+// Rebind restarts the listeners which addresses changed on the given config,
+// unchanged listeners keep serving. The new listener bound before the old one
+// closed, the old listener kept serving when the new one fails.
+func (s *Server) Rebind(cfg *config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certChanged := s.tlsCertificate != cfg.TLSCertificate || s.tlsPrivateKey != cfg.TLSPrivateKey ||
+		s.tlsOptions != tlsOptions(cfg)
+
+	switch {
+	case certChanged && s.certs != nil && tlsListening(cfg):
+		// the new files loaded before the old certificate dropped
+		certs, err := newCertStore(cfg.TLSCertificate, cfg.TLSPrivateKey)
+		if err != nil {
+			log.Error("TLS certificate load failed, keeping the old certificate", "cert", cfg.TLSCertificate, "error", err.Error())
+
+			// the listeners kept serving, the files tried again on the next reload
+			certChanged = false
+		} else {
+			s.certs = certs
+			s.tlsCertificate = cfg.TLSCertificate
+			s.tlsPrivateKey = cfg.TLSPrivateKey
+			s.tlsOptions = tlsOptions(cfg)
+		}
+	case certChanged:
+		s.certs = nil
+		s.tlsCertificate = cfg.TLSCertificate
+		s.tlsPrivateKey = cfg.TLSPrivateKey
+		s.tlsOptions = tlsOptions(cfg)
+	case s.certs != nil:
+		// the certificate files reloaded in place, the connections kept
+		if err := s.certs.reload(); err != nil {
+			log.Error("TLS certificate reload failed, keeping the old certificate", "cert", s.tlsCertificate, "error", err.Error())
+		}
+	}
+
+	if s.host != cfg.Bind {
+		if err := s.runDNS(cfg.Bind); err != nil {
+			log.Error("DNS listener rebind failed, keeping the old listener", "net", "dns", "addr", cfg.Bind, "error", err.Error())
+		}
+	}
+
+	if s.tlsHost != cfg.BindTLS || certChanged {
+		if err := s.runTLS(cfg.BindTLS); err != nil {
+			log.Error("DNS listener rebind failed, keeping the old listener", "net", "tcp-tls", "addr", cfg.BindTLS, "error", err.Error())
+		}
+	}
+
+	if s.dohHost != cfg.BindDOH || certChanged {
+		if err := s.runDOH(cfg.BindDOH); err != nil {
+			log.Error("DNS listener rebind failed, keeping the old listener", "net", "https", "addr", cfg.BindDOH, "error", err.Error())
+		}
+	}
+
+	if s.doqHost != cfg.BindDOQ || certChanged {
+		if err := s.runDOQ(cfg.BindDOQ); err != nil {
+			log.Error("DNS listener rebind failed, keeping the old listener", "net", "quic", "addr", cfg.BindDOQ, "error", err.Error())
+		}
+	}
+
+	if s.grpcHost != cfg.BindGRPC || certChanged {
+		if err := s.runGRPC(cfg.BindGRPC); err != nil {
+			log.Error("DNS listener rebind failed, keeping the old listener", "net", "grpc", "addr", cfg.BindGRPC, "error", err.Error())
+		}
+	}
+}
+
+// Shutdown stops the listeners, waits for the active queries until the context
+// done and writes the cache dump. An error returned when the context done
+// before, the remaining connections force closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdownContext(ctx, s.udpServer)
+	s.shutdownContext(ctx, s.tcpServer)
+	s.shutdownContext(ctx, s.tlsServer)
+
+	if s.dohServer != nil {
+		if err := s.dohServer.Shutdown(ctx); err != nil {
+			s.dohServer.Close()
+		}
+
+		log.Info("DNS server stopped", "net", "https", "addr", s.dohServer.Addr)
+	}
+
+	if s.doqServer != nil {
+		addr := s.doqServer.Addr().String()
+		s.closeDOQ()
+
+		log.Info("DNS server stopped", "net", "quic", "addr", addr)
+	}
+
+	if s.grpcServer != nil {
+		done := make(chan struct{})
+		go func(srv *grpc.Server) {
+			srv.GracefulStop()
+			close(done)
+		}(s.grpcServer)
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+		}
+
+		log.Info("DNS server stopped", "net", "grpc", "addr", s.grpcAddr)
+	}
+
+	err := s.handler.wait(ctx)
+
+	if derr := dumpCache(s.handler.r.Qcache, Config().CacheDumpPath); derr != nil {
+		log.Error("Cache dump failed", "path", Config().CacheDumpPath, "error", derr.Error())
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("shutdown deadline exceeded, connections force closed: %s", err)
+	}
+
+	return nil
+}
+
+// runDNS binds the udp and the tcp listeners to the host and starts them,
+// the old listeners stopped after. An empty host listens on the dns port.
+func (s *Server) runDNS(host string) error {
+	addr := host
+	if addr == "" {
+		addr = ":domain"
+	}
+
+	udpConn, err := listenConfig().ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := listenConfig().Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
 
 	tcpHandler := dns.NewServeMux()
-	tcpHandler.HandleFunc(".", handler.TCP)
+	tcpHandler.HandleFunc(".", s.handler.TCP)
 
 	udpHandler := dns.NewServeMux()
-	udpHandler.HandleFunc(".", handler.UDP)
+	udpHandler.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		s.handler.UDP(newTruncateWriter(w, req), req)
+	})
 
 	tcpServer := &dns.Server{
-		Addr:         s.host,
+		Addr:         host,
 		Net:          "tcp",
+		Listener:     tcpListener,
 		Handler:      tcpHandler,
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout,
-		ReusePort:    true,
 	}
 
 	udpServer := &dns.Server{
-		Addr:         s.host,
+		Addr:         host,
 		Net:          "udp",
+		PacketConn:   udpConn,
 		Handler:      udpHandler,
 		UDPSize:      dns.DefaultMsgSize,
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout,
-		ReusePort:    true,
 	}
 
-	go s.start(udpServer)
-	go s.start(tcpServer)
+	if err := s.start(udpServer); err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return err
+	}
 
-	if s.tlsHost != "" {
-		cert, err := tls.LoadX509KeyPair(s.tlsCertificate, s.tlsPrivateKey)
-		if err != nil {
-			log.Crit("TLS certificate load failed", "error", err.Error())
-			return
+	if err := s.start(tcpServer); err != nil {
+		s.shutdown(udpServer)
+		tcpListener.Close()
+		return err
+	}
+
+	s.shutdown(s.udpServer)
+	s.shutdown(s.tcpServer)
+
+	s.host = host
+	s.udpServer = udpServer
+	s.tcpServer = tcpServer
+
+	return nil
+}
+
+// listenConfig returns the listen config of the listener sockets, the port
+// reused for the rebinds to the same address
+func listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: reusePortControl}
+}
+
+// certStore returns the certificate store of the tls listeners, loaded on the
+// first use
+func (s *Server) certStore() (*certStore, error) {
+	if s.certs != nil {
+		return s.certs, nil
+	}
+
+	certs, err := newCertStore(s.tlsCertificate, s.tlsPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("tls certificate load failed: %s", err)
+	}
+
+	s.certs = certs
+
+	return certs, nil
+}
+
+// runTLS binds the DNS-over-TLS listener to the host and starts it, the old
+// listener stopped after. An empty host stops the listener.
+func (s *Server) runTLS(host string) error {
+	if host == "" {
+		s.shutdown(s.tlsServer)
+		s.tlsServer = nil
+		s.tlsHost = host
+
+		return nil
+	}
+
+	certs, err := s.certStore()
+	if err != nil {
+		return err
+	}
+
+	ln, err := listenConfig().Listen(context.Background(), "tcp", host)
+	if err != nil {
+		return err
+	}
+
+	tcpHandler := dns.NewServeMux()
+	tcpHandler.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		s.handler.TLS(newPaddingWriter(w, req), req)
+	})
+
+	tlsConfig := serverTLSConfig(certs, Config().DOTALPN)
+
+	srv := &dns.Server{
+		Addr:         host,
+		Net:          "tcp-tls",
+		Listener:     tls.NewListener(ln, tlsConfig),
+		TLSConfig:    tlsConfig,
+		Handler:      tcpHandler,
+		ReadTimeout:  s.rTimeout,
+		WriteTimeout: s.wTimeout,
+	}
+
+	if err := s.start(srv); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.shutdown(s.tlsServer)
+
+	s.tlsHost = host
+	s.tlsServer = srv
+
+	return nil
+}
+
+// runDOH binds the DNS-over-HTTPS listener to the host and starts it, the old
+// listener closed after. An empty host stops the listener.
+func (s *Server) runDOH(host string) error {
+	if host == "" {
+		if s.dohServer != nil {
+			s.dohServer.Close()
+			s.dohServer = nil
+		}
+
+		s.dohHost = host
+
+		return nil
+	}
+
+	certs, err := s.certStore()
+	if err != nil {
+		return err
+	}
+
+	ln, err := listenConfig().Listen(context.Background(), "tcp", host)
+	if err != nil {
+		return err
+	}
+
+	logReader, logWriter := io.Pipe()
+	go func(rd io.Reader) {
+		buf := bufio.NewReader(rd)
+		for {
+			line, err := buf.ReadBytes('\n')
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				continue
+			}
+
+			parts := strings.SplitN(string(line[:len(line)-1]), " ", 2)
+			if len(parts) > 1 {
+				log.Warn("Client http socket failed", "net", "https", "error", parts[1])
+			}
 		}
+	}(logReader)
+
+	protos := Config().DOHALPN
 
-		tlsServer := &dns.Server{
-			Addr:         s.tlsHost,
-			Net:          "tcp-tls",
-			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
-			Handler:      tcpHandler,
-			ReadTimeout:  s.rTimeout,
-			WriteTimeout: s.wTimeout,
+	srv := &http.Server{
+		Addr:         host,
+		Handler:      s.handler,
+		TLSConfig:    serverTLSConfig(certs, protos),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  30 * time.Second,
+		ErrorLog:     l.New(logWriter, "", 0),
+	}
+
+	if len(protos) > 0 && !hasProto(protos, "h2") {
+		// the http/2 support added by the http server otherwise
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	go func() {
+		log.Info("DNS server listening...", "net", "https", "addr", srv.Addr)
+
+		err := srv.ServeTLS(ln, "", "")
+		logWriter.Close()
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("DNS listener failed", "net", "https", "addr", srv.Addr, "error", err.Error())
 		}
+	}()
 
-		go s.start(tlsServer)
+	if s.dohServer != nil {
+		s.dohServer.Close()
 	}
 
-	if s.dohHost != "" {
-		logReader, logWriter := io.Pipe()
-		go func(rd io.Reader) {
-			buf := bufio.NewReader(rd)
-			for {
-				line, err := buf.ReadBytes('\n')
-				if err != nil {
-					continue
-				}
+	s.dohHost = host
+	s.dohServer = srv
+
+	return nil
+}
+
+// runDOQ binds the DNS-over-QUIC listener to the host and starts it, the old
+// listener closed after. An empty host stops the listener.
+func (s *Server) runDOQ(host string) error {
+	if host == "" {
+		s.closeDOQ()
+		s.doqHost = host
+
+		return nil
+	}
+
+	certs, err := s.certStore()
+	if err != nil {
+		return err
+	}
 
-				parts := strings.SplitN(string(line[:len(line)-1]), " ", 2)
-				if len(parts) > 1 {
-					log.Warn("Client http socket failed", "net", "https", "error", parts[1])
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"doq"},
+		MinVersion:     tls.VersionTLS13,
+	}
+
+	conn, err := listenConfig().ListenPacket(context.Background(), "udp", host)
+	if err != nil {
+		return err
+	}
+
+	ln, err := quic.Listen(conn, tlsConfig, &quic.Config{MaxIdleTimeout: DOQIdleTimeout})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	go func() {
+		log.Info("DNS server listening...", "net", "quic", "addr", ln.Addr().String())
+
+		for {
+			qconn, err := ln.Accept(context.Background())
+			if err != nil {
+				if err != quic.ErrServerClosed {
+					log.Error("DNS listener failed", "net", "quic", "addr", ln.Addr().String(), "error", err.Error())
 				}
+				return
 			}
-		}(logReader)
 
-		srv := &http.Server{
-			Addr:         s.dohHost,
-			Handler:      handler,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			IdleTimeout:  30 * time.Second,
-			ErrorLog:     l.New(logWriter, "", 0),
+			go s.handler.ServeQUIC(qconn)
 		}
+	}()
 
-		go func() {
-			log.Info("DNS server listening...", "net", "https", "addr", s.dohHost)
+	s.closeDOQ()
 
-			if err := srv.ListenAndServeTLS(s.tlsCertificate, s.tlsPrivateKey); err != nil {
-				log.Crit("DNS listener failed", "net", "https", "addr", s.dohHost, "error", err.Error())
-			}
-		}()
+	s.doqHost = host
+	s.doqServer = ln
+	s.doqConn = conn
+
+	return nil
+}
+
+// closeDOQ closes the DNS-over-QUIC listener and its socket, the socket not
+// owned by the listener
+func (s *Server) closeDOQ() {
+	if s.doqServer == nil {
+		return
 	}
+
+	s.doqServer.Close()
+	s.doqConn.Close()
+
+	s.doqServer = nil
+	s.doqConn = nil
 }
 
-func (s *Server) start(ds *dns.Server) {
+// runGRPC binds the gRPC listener to the host and starts it, the old server
+// stopped after. An empty host stops the server.
+func (s *Server) runGRPC(host string) error {
+	if host == "" {
+		if s.grpcServer != nil {
+			s.grpcServer.Stop()
+			s.grpcServer = nil
+		}
+
+		s.grpcHost = host
+
+		return nil
+	}
+
+	certs, err := s.certStore()
+	if err != nil {
+		return err
+	}
+
+	creds := credentials.NewTLS(serverTLSConfig(certs, []string{"h2"}))
+
+	ln, err := listenConfig().Listen(context.Background(), "tcp", host)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.Creds(creds), grpc.MaxConcurrentStreams(GRPCMaxConcurrentStreams))
+	dnspb.RegisterDnsServiceServer(srv, &grpcService{handler: s.handler})
+
+	go func() {
+		log.Info("DNS server listening...", "net", "grpc", "addr", ln.Addr().String())
+
+		if err := srv.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+			log.Error("DNS listener failed", "net", "grpc", "addr", ln.Addr().String(), "error", err.Error())
+		}
+	}()
+
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+
+	s.grpcHost = host
+	s.grpcServer = srv
+	s.grpcAddr = ln.Addr().String()
+
+	return nil
+}
+
+// start serves the bound listener of the dns server, returned when the server
+// started or failed to
+func (s *Server) start(ds *dns.Server) error {
+	started := make(chan struct{})
+	ds.NotifyStartedFunc = func() { close(started) }
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ds.ActivateAndServe()
+	}()
+
+	select {
+	case <-started:
+	case err := <-errc:
+		return err
+	}
+
 	log.Info("DNS server listening...", "net", ds.Net, "addr", ds.Addr)
 
-	if err := ds.ListenAndServe(); err != nil {
-		log.Crit("DNS listener failed", "net", ds.Net, "addr", ds.Addr, "error", err.Error())
+	go func() {
+		if err := <-errc; err != nil {
+			log.Error("DNS listener failed", "net", ds.Net, "addr", ds.Addr, "error", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) shutdown(ds *dns.Server) {
+	s.shutdownContext(context.Background(), ds)
+}
+
+func (s *Server) shutdownContext(ctx context.Context, ds *dns.Server) {
+	if ds == nil {
+		return
 	}
+
+	if err := ds.ShutdownContext(ctx); err != nil {
+		log.Warn("DNS listener shutdown failed", "net", ds.Net, "addr", ds.Addr, "error", err.Error())
+		return
+	}
+
+	log.Info("DNS server stopped", "net", ds.Net, "addr", ds.Addr)
 }
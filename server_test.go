@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,11 +9,15 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -95,6 +100,7 @@ func Test_server(t *testing.T) {
 		host:           ":5553",
 		dohHost:        ":8953",
 		tlsHost:        ":8853",
+		doqHost:        ":8854",
 		tlsCertificate: "test.cert",
 		tlsPrivateKey:  "test.key",
 		rTimeout:       5 * time.Second,
@@ -108,3 +114,162 @@ func Test_server(t *testing.T) {
 	os.Remove("test.cert")
 	os.Remove("test.key")
 }
+
+func Test_serverRebind(t *testing.T) {
+	s := &Server{
+		host:     "127.0.0.1:0",
+		rTimeout: 5 * time.Second,
+		wTimeout: 5 * time.Second,
+	}
+
+	s.Run()
+
+	time.Sleep(100 * time.Millisecond)
+
+	udpServer := s.udpServer
+
+	cfg := *Config()
+	cfg.Bind = "127.0.0.1:0"
+
+	s.Rebind(&cfg)
+	assert.Equal(t, udpServer, s.udpServer)
+
+	cfg.Bind = "127.0.0.1:5554"
+
+	s.Rebind(&cfg)
+	assert.NotEqual(t, udpServer, s.udpServer)
+	assert.Equal(t, "127.0.0.1:5554", s.udpServer.Addr)
+
+	// the busy address not bound, the old listener kept serving
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer busy.Close()
+
+	udpServer = s.udpServer
+	cfg.Bind = busy.LocalAddr().String()
+
+	s.Rebind(&cfg)
+	assert.Equal(t, udpServer, s.udpServer)
+	assert.Equal(t, "127.0.0.1:5554", s.host)
+
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+
+	_, _, err = c.Exchange(req, "127.0.0.1:5554")
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	s.shutdown(s.udpServer)
+	s.shutdown(s.tcpServer)
+}
+
+func Test_serverRebindCertificate(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	assert.NoError(t, ioutil.WriteFile("broken.cert", []byte("-----BEGIN CERTIFICATE-----\nMIIB"), 0644))
+	defer os.Remove("broken.cert")
+
+	s := &Server{
+		tlsHost:        "127.0.0.1:0",
+		tlsCertificate: "test.cert",
+		tlsPrivateKey:  "test.key",
+		rTimeout:       5 * time.Second,
+		wTimeout:       5 * time.Second,
+	}
+
+	cfg := *Config()
+	cfg.BindTLS = s.tlsHost
+	cfg.TLSCertificate = "test.cert"
+	cfg.TLSPrivateKey = "test.key"
+	s.tlsOptions = tlsOptions(&cfg)
+
+	s.Run()
+	defer s.shutdown(s.tlsServer)
+
+	certs, tlsServer := s.certs, s.tlsServer
+	if !assert.NotNil(t, certs) {
+		return
+	}
+
+	// the half written certificate not loaded, the listener kept serving
+	cfg.TLSCertificate = "broken.cert"
+	s.Rebind(&cfg)
+
+	assert.True(t, certs == s.certs)
+	assert.True(t, tlsServer == s.tlsServer)
+	assert.Equal(t, "test.cert", s.tlsCertificate)
+
+	cfg.TLSCertificate = "test.cert"
+	s.Rebind(&cfg)
+	assert.True(t, certs == s.certs)
+
+	// the busy address not bound, the old listener kept serving
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer busy.Close()
+
+	cfg.BindTLS = busy.Addr().String()
+	s.Rebind(&cfg)
+
+	assert.True(t, tlsServer == s.tlsServer)
+	assert.Equal(t, "127.0.0.1:0", s.tlsHost)
+}
+
+func Test_serverShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_shutdown")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.dump")
+
+	defer setConfig(func(cfg *config) { cfg.CacheDumpPath = path })()
+
+	s := &Server{
+		host:     "127.0.0.1:0",
+		rTimeout: 5 * time.Second,
+		wTimeout: 5 * time.Second,
+	}
+
+	s.Run()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// a query in progress until the deadline
+	s.handler.begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.Error(t, s.Shutdown(ctx))
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	s = &Server{
+		host:     "127.0.0.1:0",
+		rTimeout: 5 * time.Second,
+		wTimeout: 5 * time.Second,
+	}
+
+	s.Run()
+
+	time.Sleep(100 * time.Millisecond)
+
+	s.handler.begin()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.handler.end()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, s.Shutdown(ctx))
+}
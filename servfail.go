@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/metrics"
+)
+
+// DefaultServfailRetries is the other servers asked after the SERVFAIL answers
+const DefaultServfailRetries = 2
+
+// servfailRetry counts the other servers asked after the SERVFAIL answers of a
+// lookup, up to the config limit within the query timeout
+type servfailRetry struct {
+	retried  int
+	deadline time.Time
+}
+
+func newServfailRetry() *servfailRetry {
+	return &servfailRetry{deadline: time.Now().Add(Config().Timeout.Duration)}
+}
+
+// next reports whether the next server asked after the answer. The positive
+// and the name error answers final; the SERVFAIL answers asked again up to the
+// limit, never the validation failures reported by the upstream since every
+// validating server answers them the same. The other failed answers always
+// asked the next server.
+func (s *servfailRetry) next(req, resp *dns.Msg) bool {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return false
+	case dns.RcodeServerFailure:
+	default:
+		return true
+	}
+
+	if validationFailed(resp) {
+		log.Debug("Upstream validation failure not retried", "query", formatQuestion(req.Question[0]))
+		return false
+	}
+
+	if s.retried >= Config().RetryOnServfail || !time.Now().Before(s.deadline) {
+		return false
+	}
+
+	s.retried++
+	metrics.UpstreamServfailRetries.Inc()
+
+	return true
+}
+
+// validationFailed reports whether the answer has the extended error of a
+// DNSSEC validation failure, the codes from the indeterminate to the missing
+// NSEC
+func validationFailed(resp *dns.Msg) bool {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != edeOption || len(local.Data) < 2 {
+			continue
+		}
+
+		code := binary.BigEndian.Uint16(local.Data)
+		if code >= edeDNSSECIndeterminate && code <= edeNSECMissing {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// runBogusUpstream runs a udp server answered SERVFAIL with the DNSSEC bogus
+// extended error
+func runBogusUpstream(t testing.TB) (string, func()) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.SetEdns0(DefaultMsgSize, true)
+
+		w.WriteMsg(setExtendedError(m, edeDNSSECBogus, "signature expired"))
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addrstr, func() { s.Shutdown() }
+}
+
+func Test_lookupListServfailRetry(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+
+	failing, stop := runSlowUpstream(t, dns.RcodeServerFailure, 0, never)
+	defer stop()
+
+	nxdomain, stop := runSlowUpstream(t, dns.RcodeNameError, 0, never)
+	defer stop()
+
+	working, stop := runSlowUpstream(t, dns.RcodeSuccess, 0, never)
+	defer stop()
+
+	bogus, stop := runBogusUpstream(t)
+	defer stop()
+
+	r := NewResolver()
+	c := &dns.Client{Net: "udp", Dialer: &net.Dialer{Timeout: time.Second}, ReadTimeout: time.Second}
+
+	req := new(dns.Msg)
+	req.SetQuestion("servfail.example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	lookup := func(servers ...string) int {
+		resp, err := r.lookupList(c, req, newAuthServers(servers))
+		if !assert.NoError(t, err) {
+			return -1
+		}
+
+		return resp.Rcode
+	}
+
+	defer setConfig(func(cfg *config) { cfg.RetryOnServfail = 2 })()
+
+	// the next servers asked up to the limit
+	assert.Equal(t, dns.RcodeSuccess, lookup(failing, failing, working))
+	assert.Equal(t, dns.RcodeServerFailure, lookup(failing, failing, failing, working))
+
+	// the name errors and the upstream validation failures final
+	assert.Equal(t, dns.RcodeNameError, lookup(nxdomain, working))
+	assert.Equal(t, dns.RcodeServerFailure, lookup(bogus, working))
+
+	defer setConfig(func(cfg *config) { cfg.RetryOnServfail = -1 })()
+	assert.Equal(t, dns.RcodeServerFailure, lookup(failing, working))
+
+	// never asked again after the query timeout
+	defer setConfig(func(cfg *config) {
+		cfg.RetryOnServfail = 2
+		cfg.Timeout.Duration = 250 * time.Millisecond
+	})()
+
+	slow, stop := runSlowUpstream(t, dns.RcodeServerFailure, 300*time.Millisecond, always)
+	defer stop()
+
+	assert.Equal(t, dns.RcodeServerFailure, lookup(slow, working))
+}
+
+func Test_validationFailed(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.ExtendedErrors = true })()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, validationFailed(m))
+
+	m.SetEdns0(DefaultMsgSize, true)
+	assert.False(t, validationFailed(m))
+
+	assert.False(t, validationFailed(setExtendedError(m.Copy(), edeNoReachableAuthority, "")))
+	assert.True(t, validationFailed(setExtendedError(m.Copy(), edeDNSSECBogus, "")))
+	assert.True(t, validationFailed(setExtendedError(m.Copy(), edeNSECMissing, "")))
+}
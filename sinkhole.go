@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultSinkholeTTL is the TTL of the sinkhole answers when not given, short
+// for the unblocked names resolved again soon
+const DefaultSinkholeTTL = 10
+
+// sinkholeAddress returns the sinkhole address of the query type, nil if the
+// sinkhole of the family not set
+func sinkholeAddress(qtype uint16) net.IP {
+	cfg := Config()
+
+	switch qtype {
+	case dns.TypeA:
+		if cfg.SinkholeIP != "" {
+			return net.ParseIP(cfg.SinkholeIP)
+		}
+	case dns.TypeAAAA:
+		if cfg.SinkholeIPv6 != "" {
+			return net.ParseIP(cfg.SinkholeIPv6)
+		}
+	}
+
+	return nil
+}
+
+// sinkholeEnabled reports whether a sinkhole address set, the blocked
+// queries answered with the sinkhole instead of the nullroute addresses
+func sinkholeEnabled() bool {
+	cfg := Config()
+	return cfg.SinkholeIP != "" || cfg.SinkholeIPv6 != ""
+}
+
+// sinkholeRR returns the address record of the sinkhole for the name, nil
+// for the other query types and the families without a sinkhole
+func sinkholeRR(name string, qtype uint16, ttl uint32) dns.RR {
+	ip := sinkholeAddress(qtype)
+	if ip == nil {
+		return nil
+	}
+
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+
+	if qtype == dns.TypeA {
+		return &dns.A{Hdr: hdr, A: ip}
+	}
+
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// inSinkholeZone reports whether the name at or below the sinkhole zone
+func inSinkholeZone(name string) bool {
+	zone := Config().SinkholeZone
+	if zone == "" {
+		return false
+	}
+
+	return dns.IsSubDomain(zone, strings.ToLower(dns.Fqdn(name)))
+}
+
+// sinkholeAnswer answers the query of the sinkhole zone without the
+// recursion; the SOA and the NS of the zone at the apex, the sinkhole
+// addresses for every name of the zone and no data for the others. The
+// answers have the short sinkhole TTL for the block pages not kept long in
+// the client caches.
+func sinkholeAnswer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || !inSinkholeZone(q.Name) {
+		return nil
+	}
+
+	cfg := Config()
+	zone := cfg.SinkholeZone
+	ttl := cfg.SinkholeTTL
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+
+	apex := strings.ToLower(q.Name) == zone
+
+	switch {
+	case apex && q.Qtype == dns.TypeSOA:
+		msg.Answer = append(msg.Answer, soa)
+	case apex && q.Qtype == dns.TypeNS:
+		msg.Answer = append(msg.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  zone,
+		})
+	default:
+		if rr := sinkholeRR(q.Name, q.Qtype, ttl); rr != nil {
+			msg.Answer = append(msg.Answer, rr)
+		} else {
+			msg.Ns = append(msg.Ns, soa)
+		}
+	}
+
+	return msg
+}
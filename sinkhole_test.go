@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func setSinkhole(ip, ipv6, zone string) func() {
+	return setConfig(func(cfg *config) {
+		cfg.SinkholeIP, cfg.SinkholeIPv6, cfg.SinkholeZone = ip, ipv6, zone
+		cfg.SinkholeTTL = DefaultSinkholeTTL
+	})
+}
+
+func Test_sinkholeAnswer(t *testing.T) {
+	defer setSinkhole("192.0.2.10", "", "blocked.mynet.")()
+
+	req := new(dns.Msg)
+
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.Nil(t, sinkholeAnswer(req))
+
+	req.SetQuestion("www.Blocked.mynet.", dns.TypeA)
+	msg := sinkholeAnswer(req)
+	if assert.NotNil(t, msg) && assert.Len(t, msg.Answer, 1) {
+		assert.True(t, msg.Authoritative)
+		assert.Equal(t, "192.0.2.10", msg.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(DefaultSinkholeTTL), msg.Answer[0].Header().Ttl)
+	}
+
+	// the apex addressed as well
+	req.SetQuestion("blocked.mynet.", dns.TypeA)
+	assert.Len(t, sinkholeAnswer(req).Answer, 1)
+
+	// the family without a sinkhole answered with no data
+	req.SetQuestion("www.blocked.mynet.", dns.TypeAAAA)
+	msg = sinkholeAnswer(req)
+	assert.Equal(t, dns.RcodeSuccess, msg.Rcode)
+	assert.Len(t, msg.Answer, 0)
+	if assert.Len(t, msg.Ns, 1) {
+		assert.Equal(t, "blocked.mynet.", msg.Ns[0].Header().Name)
+	}
+
+	req.SetQuestion("blocked.mynet.", dns.TypeSOA)
+	msg = sinkholeAnswer(req)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, uint32(DefaultSinkholeTTL), msg.Answer[0].(*dns.SOA).Minttl)
+	}
+
+	req.SetQuestion("blocked.mynet.", dns.TypeNS)
+	msg = sinkholeAnswer(req)
+	if assert.Len(t, msg.Answer, 1) {
+		assert.Equal(t, "blocked.mynet.", msg.Answer[0].(*dns.NS).Ns)
+	}
+
+	// the names below the apex have no SOA or NS of their own
+	req.SetQuestion("www.blocked.mynet.", dns.TypeNS)
+	msg = sinkholeAnswer(req)
+	assert.Len(t, msg.Answer, 0)
+	assert.Len(t, msg.Ns, 1)
+
+	req.SetQuestion("www.blocked.mynet.", dns.TypeA)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	assert.Nil(t, sinkholeAnswer(req))
+}
+
+func Test_blockResponseSinkhole(t *testing.T) {
+	defer setSinkhole("192.0.2.10", "2001:db8::10", "")()
+
+	defer setConfig(func(cfg *config) { cfg.BlockResponse = blockZeroIP })()
+
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.example.com.", dns.TypeA)
+
+	m := blockResponse(req)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.0.2.10", m.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(DefaultSinkholeTTL), m.Answer[0].Header().Ttl)
+	}
+
+	req.SetQuestion("blocked.example.com.", dns.TypeAAAA)
+	m = blockResponse(req)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "2001:db8::10", m.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	defer setConfig(func(cfg *config) { cfg.SinkholeIPv6 = "" })()
+
+	m = blockResponse(req)
+	assert.Len(t, m.Answer, 0)
+	assert.Len(t, m.Ns, 1)
+}
+
+func Test_HandlerSinkhole(t *testing.T) {
+	defer setSinkhole("192.0.2.10", "", "blocked.mynet.")()
+
+	handler := NewHandler()
+
+	req := new(dns.Msg)
+	req.SetQuestion("page.blocked.mynet.", dns.TypeA)
+	req.RecursionDesired = true
+
+	resp, status := handler.queryStatus("udp", req)
+	assert.Equal(t, statusLocal, status)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.0.2.10", resp.Answer[0].(*dns.A).A.String())
+	}
+}
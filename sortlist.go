@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultSortListProbePort is the tcp port of the address probes when
+	// not given
+	DefaultSortListProbePort = 443
+
+	// DefaultSortListProbeTTL is how long a probe result used when not given
+	DefaultSortListProbeTTL = time.Minute
+
+	// sortProbeTimeout is the connect timeout of the probes, the addresses
+	// not connected in time unreachable
+	sortProbeTimeout = time.Second
+
+	// sortProbeSize is the probe results kept at most
+	sortProbeSize = 4096
+
+	// sortProbeConcurrency is the probes running at once
+	sortProbeConcurrency = 16
+)
+
+var (
+	sortNets   []*net.IPNet
+	sortNetsMu sync.RWMutex
+)
+
+// newSortNets returns the networks of the sort list in the order of the
+// preference
+func newSortNets(cidrs []string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("sort list cidr invalid: %s", cidr)
+		}
+
+		list = append(list, ipnet)
+	}
+
+	return list, nil
+}
+
+// probe states of an address, in the order of the preference
+const (
+	probeReachable = iota
+	probeUnknown
+	probeUnreachable
+)
+
+type probeResult struct {
+	rtt       time.Duration
+	reachable bool
+	expire    time.Time
+}
+
+// addrProber measures the connect rtt of the answer addresses from the server
+// in the background, the results kept for the probe ttl. The addresses not
+// probed yet sorted after the measured ones until their probes done.
+type addrProber struct {
+	mu      sync.Mutex
+	results map[string]*probeResult
+	pending map[string]bool
+
+	sem chan struct{}
+}
+
+var sortProber = newAddrProber()
+
+func newAddrProber() *addrProber {
+	return &addrProber{
+		results: make(map[string]*probeResult),
+		pending: make(map[string]bool),
+		sem:     make(chan struct{}, sortProbeConcurrency),
+	}
+}
+
+// state returns the probe state and the rtt of the ip, the probe started if
+// not known
+func (p *addrProber) state(ip net.IP) (int, time.Duration) {
+	key := ip.String()
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if r, ok := p.results[key]; ok && now.Before(r.expire) {
+		if !r.reachable {
+			return probeUnreachable, 0
+		}
+
+		return probeReachable, r.rtt
+	}
+
+	if p.pending[key] || !p.room(now) {
+		return probeUnknown, 0
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return probeUnknown, 0
+	}
+
+	p.pending[key] = true
+
+	cfg := Config()
+	go p.probe(key, net.JoinHostPort(key, strconv.Itoa(cfg.SortListProbePort)), cfg.SortListProbeTTL.Duration)
+
+	return probeUnknown, 0
+}
+
+// room reports whether a new result fits, the expired results removed if
+// full. The lock should be held.
+func (p *addrProber) room(now time.Time) bool {
+	if len(p.results)+len(p.pending) < sortProbeSize {
+		return true
+	}
+
+	for key, r := range p.results {
+		if !now.Before(r.expire) {
+			delete(p.results, key)
+		}
+	}
+
+	return len(p.results)+len(p.pending) < sortProbeSize
+}
+
+func (p *addrProber) probe(key, addr string, ttl time.Duration) {
+	defer func() { <-p.sem }()
+
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", addr, sortProbeTimeout)
+	if err == nil {
+		conn.Close()
+	}
+
+	r := &probeResult{rtt: time.Since(start), reachable: err == nil, expire: time.Now().Add(ttl)}
+
+	p.mu.Lock()
+	p.results[key] = r
+	delete(p.pending, key)
+	p.mu.Unlock()
+}
+
+// sortRank is the order of an address record in its set; the sort list
+// network, then the probe state and the rtt
+type sortRank struct {
+	net   int
+	state int
+	rtt   time.Duration
+}
+
+func (a sortRank) less(b sortRank) bool {
+	if a.net != b.net {
+		return a.net < b.net
+	}
+
+	if a.state != b.state {
+		return a.state < b.state
+	}
+
+	return a.rtt < b.rtt
+}
+
+func rankAddress(rr dns.RR, nets []*net.IPNet, probe bool) sortRank {
+	var ip net.IP
+	switch v := rr.(type) {
+	case *dns.A:
+		ip = v.A
+	case *dns.AAAA:
+		ip = v.AAAA
+	}
+
+	rank := sortRank{net: len(nets), state: probeUnknown}
+
+	for i, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			rank.net = i
+			break
+		}
+	}
+
+	if probe && ip != nil {
+		rank.state, rank.rtt = sortProber.state(ip)
+	}
+
+	return rank
+}
+
+// sortAddresses returns the response with the address records of the answer
+// sets in the order of the sort list networks, the addresses out of them
+// last; by the measured rtt within the same network if the probes enabled.
+// Like the round robin only the order inside the sets changed, the
+// signatures cover the sets in the canonical order so the validation not
+// affected. The cached answer kept in order, the response copied before the
+// changes.
+func sortAddresses(msg *dns.Msg) *dns.Msg {
+	sortNetsMu.RLock()
+	nets := sortNets
+	sortNetsMu.RUnlock()
+
+	probe := Config().SortListProbe
+
+	if len(nets) == 0 && !probe {
+		return msg
+	}
+
+	sets, ok := addressSets(msg)
+	if !ok {
+		return msg
+	}
+
+	answer := make([]dns.RR, len(msg.Answer))
+	copy(answer, msg.Answer)
+
+	for _, set := range sets {
+		if len(set) < 2 {
+			continue
+		}
+
+		type ranked struct {
+			rr   dns.RR
+			rank sortRank
+		}
+
+		list := make([]ranked, len(set))
+		for j, i := range set {
+			list[j] = ranked{rr: msg.Answer[i], rank: rankAddress(msg.Answer[i], nets, probe)}
+		}
+
+		sort.SliceStable(list, func(a, b int) bool {
+			return list[a].rank.less(list[b].rank)
+		})
+
+		for j, i := range set {
+			answer[i] = list[j].rr
+		}
+	}
+
+	m := new(dns.Msg)
+	*m = *msg
+	m.Answer = answer
+
+	return m
+}
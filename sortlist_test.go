@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func setSortNets(t *testing.T, cidrs ...string) {
+	nets, err := newSortNets(cidrs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	sortNetsMu.Lock()
+	sortNets = nets
+	sortNetsMu.Unlock()
+}
+
+func Test_newSortNets(t *testing.T) {
+	nets, err := newSortNets([]string{"192.0.2.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+	assert.Len(t, nets, 2)
+
+	_, err = newSortNets([]string{"192.0.2.0"})
+	assert.Error(t, err)
+}
+
+func Test_sortAddresses(t *testing.T) {
+	defer setSortNets(t)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Answer = newRRs(
+		"www.example.com. 300 IN CNAME web.example.com.",
+		"web.example.com. 300 IN A 203.0.113.1",
+		"web.example.com. 300 IN A 198.51.100.1",
+		"web.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 1 example.com. AAAA",
+		"web.example.com. 300 IN A 192.0.2.1",
+		"web.example.com. 300 IN A 198.51.100.2",
+	)
+
+	// no sort list, the response as is
+	assert.True(t, sortAddresses(msg) == msg)
+
+	setSortNets(t, "192.0.2.0/24", "198.51.100.0/24")
+
+	resp := sortAddresses(msg)
+	assert.Equal(t, dns.TypeCNAME, resp.Answer[0].Header().Rrtype)
+	assert.Equal(t, []string{"192.0.2.1", "198.51.100.1", "rrsig", "198.51.100.2", "203.0.113.1"}, answerAddrs(resp))
+
+	// the shared answer left as is
+	assert.Equal(t, []string{"203.0.113.1", "198.51.100.1", "rrsig", "192.0.2.1", "198.51.100.2"}, answerAddrs(msg))
+
+	// the sets of the families sorted apart
+	mixed := new(dns.Msg)
+	mixed.Answer = newRRs(
+		"www.example.com. 300 IN AAAA 2001:db8:2::1",
+		"www.example.com. 300 IN AAAA 2001:db8:1::1",
+		"www.example.com. 300 IN A 203.0.113.1",
+		"www.example.com. 300 IN A 192.0.2.1",
+	)
+
+	setSortNets(t, "2001:db8:1::/48", "192.0.2.0/24")
+	assert.Equal(t, []string{"2001:db8:1::1", "2001:db8:2::1", "192.0.2.1", "203.0.113.1"}, answerAddrs(sortAddresses(mixed)))
+}
+
+func Test_sortAddressesProbe(t *testing.T) {
+	defer func(prober *addrProber) {
+		sortProber = prober
+	}(sortProber)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	defer setConfig(func(cfg *config) {
+		cfg.SortListProbe = true
+		cfg.SortListProbePort = ln.Addr().(*net.TCPAddr).Port
+		cfg.SortListProbeTTL.Duration = time.Minute
+	})()
+	sortProber = newAddrProber()
+
+	msg := new(dns.Msg)
+	msg.Answer = newRRs(
+		"www.example.com. 300 IN A 127.0.0.2",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 127.0.0.1",
+	)
+
+	// a slow address measured already
+	sortProber.results["192.0.2.1"] = &probeResult{rtt: time.Hour, reachable: true, expire: time.Now().Add(time.Minute)}
+
+	// the measured address first, the others not probed yet kept in order
+	assert.Equal(t, []string{"192.0.2.1", "127.0.0.2", "127.0.0.1"}, answerAddrs(sortAddresses(msg)))
+
+	for i := 0; i < 100; i++ {
+		state, _ := sortProber.state(net.ParseIP("127.0.0.1"))
+		other, _ := sortProber.state(net.ParseIP("127.0.0.2"))
+		if state != probeUnknown && other != probeUnknown {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the faster address first and the refused one last
+	assert.Equal(t, []string{"127.0.0.1", "192.0.2.1", "127.0.0.2"}, answerAddrs(sortAddresses(msg)))
+}
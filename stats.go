@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+)
+
+const (
+	// statsWindow is the seconds of the query rate
+	statsWindow = 60
+
+	// statsMaxUpstreams is the servers counted apart, the rest counted as other
+	statsMaxUpstreams = 1024
+
+	statsOtherUpstream = "other"
+)
+
+var (
+	// metricServers are the hosts of the root, the fallback and the configured
+	// upstream servers, labeled apart in the upstream metrics
+	metricServers   = map[string]bool{}
+	metricServersMu sync.RWMutex
+)
+
+// newMetricServers returns the hosts of the servers of the config labeled
+// apart in the upstream metrics
+func newMetricServers(cfg *config) map[string]bool {
+	hosts := make(map[string]bool)
+
+	add := func(list []string) {
+		for _, host := range list {
+			hosts[cache.NewAuthServer(host).Host] = true
+		}
+	}
+
+	add(cfg.RootServers)
+	add(cfg.Root6Servers)
+	add(cfg.FallbackServers)
+
+	for _, servers := range cfg.UpstreamGroups {
+		add(servers)
+	}
+
+	for _, zone := range cfg.ForwardZones {
+		add(zone.Servers)
+	}
+
+	return hosts
+}
+
+// upstreamLabel returns the server label of the upstream metrics, the
+// authoritative servers met on the recursion counted as other so the label
+// values stay bounded
+func upstreamLabel(host string) string {
+	metricServersMu.RLock()
+	defer metricServersMu.RUnlock()
+
+	if metricServers[host] {
+		return host
+	}
+
+	return statsOtherUpstream
+}
+
+// serverStats keeps the counters of the stats api, all updated atomically
+// so the snapshots never block the queries
+type serverStats struct {
+	start time.Time
+
+	queries      int64
+	cacheHits    int64
+	cacheMisses  int64
+	blockHits    int64
+	dnssecSecure int64
+	dnssecFailed int64
+
+	// inflight is the client queries in progress, overloaded the queries
+	// refused above the concurrency limit
+	inflight   int64
+	overloaded int64
+
+	// the entries of the prewarm file and the results of their queries
+	prewarmEntries   int64
+	prewarmSucceeded int64
+	prewarmFailed    int64
+
+	window [statsWindow]statsBucket
+
+	upstreams     sync.Map
+	upstreamCount int64
+
+	// categories are the blocked queries by the blocklist categories
+	categories sync.Map
+}
+
+type statsBucket struct {
+	sec   int64
+	count int64
+}
+
+type upstreamStats struct {
+	queries int64
+	rtt     int64
+}
+
+// upstreamSnapshot is the query count and the average rtt of a server
+type upstreamSnapshot struct {
+	Server  string
+	Queries int64
+	AvgRtt  time.Duration
+}
+
+var stats = newServerStats()
+
+func newServerStats() *serverStats {
+	return &serverStats{start: time.Now()}
+}
+
+// query counts the client query into the total and the second of the rate
+// window, the counts of a reused bucket may lose the racing queries
+func (s *serverStats) query(now time.Time) {
+	atomic.AddInt64(&s.queries, 1)
+
+	sec := now.Unix()
+	b := &s.window[sec%statsWindow]
+
+	if old := atomic.LoadInt64(&b.sec); old != sec && atomic.CompareAndSwapInt64(&b.sec, old, sec) {
+		atomic.StoreInt64(&b.count, 0)
+	}
+
+	atomic.AddInt64(&b.count, 1)
+}
+
+// qps returns the query rate of the last window
+func (s *serverStats) qps(now time.Time) float64 {
+	sec := now.Unix()
+
+	var count int64
+	for i := range s.window {
+		b := &s.window[i]
+		if t := atomic.LoadInt64(&b.sec); t > sec-statsWindow && t <= sec {
+			count += atomic.LoadInt64(&b.count)
+		}
+	}
+
+	return float64(count) / statsWindow
+}
+
+// upstream counts the exchange with the server
+func (s *serverStats) upstream(host string, rtt time.Duration) {
+	u, ok := s.upstreams.Load(host)
+	if !ok {
+		if atomic.LoadInt64(&s.upstreamCount) >= statsMaxUpstreams {
+			host = statsOtherUpstream
+		}
+
+		var loaded bool
+		if u, loaded = s.upstreams.LoadOrStore(host, &upstreamStats{}); !loaded {
+			atomic.AddInt64(&s.upstreamCount, 1)
+		}
+	}
+
+	us := u.(*upstreamStats)
+	atomic.AddInt64(&us.queries, 1)
+	atomic.AddInt64(&us.rtt, rtt.Nanoseconds())
+}
+
+// categoryHits counts the blocked query into the categories of the matched
+// entry, the categories bounded by the config
+func (s *serverStats) categoryHits(names []string) {
+	for _, name := range names {
+		v, ok := s.categories.Load(name)
+		if !ok {
+			v, _ = s.categories.LoadOrStore(name, new(int64))
+		}
+
+		atomic.AddInt64(v.(*int64), 1)
+	}
+}
+
+// categoryHitCount returns the blocked queries of the category
+func (s *serverStats) categoryHitCount(name string) int64 {
+	if v, ok := s.categories.Load(name); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+
+	return 0
+}
+
+// upstreamList returns the servers by the query count
+func (s *serverStats) upstreamList() []upstreamSnapshot {
+	list := []upstreamSnapshot{}
+
+	s.upstreams.Range(func(k, v interface{}) bool {
+		us := v.(*upstreamStats)
+
+		u := upstreamSnapshot{Server: k.(string), Queries: atomic.LoadInt64(&us.queries)}
+		if u.Queries > 0 {
+			u.AvgRtt = time.Duration(atomic.LoadInt64(&us.rtt) / u.Queries)
+		}
+
+		list = append(list, u)
+
+		return true
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Queries == list[j].Queries {
+			return list[i].Server < list[j].Server
+		}
+
+		return list[i].Queries > list[j].Queries
+	})
+
+	return list
+}
+
+// countDNSSECFailure counts the failed validation on the metrics and the stats
+func countDNSSECFailure() {
+	metrics.DNSSECFailures.Inc()
+	atomic.AddInt64(&stats.dnssecFailed, 1)
+}
+
+func ratio(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(total)
+}
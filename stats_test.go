@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_serverStatsQPS(t *testing.T) {
+	s := newServerStats()
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 120; i++ {
+		s.query(now.Add(time.Duration(i%2) * time.Second))
+	}
+
+	assert.Equal(t, int64(120), s.queries)
+	assert.Equal(t, float64(2), s.qps(now.Add(time.Second)))
+
+	// the reused bucket counts again from zero
+	s.query(now.Add(statsWindow * time.Second))
+	assert.Equal(t, float64(61)/statsWindow, s.qps(now.Add(statsWindow*time.Second)))
+
+	assert.Equal(t, float64(0), s.qps(now.Add(10*statsWindow*time.Second)))
+}
+
+func Test_serverStatsUpstreams(t *testing.T) {
+	s := newServerStats()
+
+	s.upstream("192.0.2.1:53", 10*time.Millisecond)
+	s.upstream("192.0.2.1:53", 30*time.Millisecond)
+	s.upstream("192.0.2.2:53", 5*time.Millisecond)
+
+	list := s.upstreamList()
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, upstreamSnapshot{Server: "192.0.2.1:53", Queries: 2, AvgRtt: 20 * time.Millisecond}, list[0])
+		assert.Equal(t, "192.0.2.2:53", list[1].Server)
+	}
+
+	for i := 0; i < statsMaxUpstreams; i++ {
+		s.upstream("10.0.0.1:"+strconv.Itoa(i), time.Millisecond)
+	}
+
+	list = s.upstreamList()
+	assert.Len(t, list, statsMaxUpstreams+1)
+
+	other := false
+	for _, u := range list {
+		if u.Server == statsOtherUpstream {
+			other = true
+			assert.Equal(t, int64(2), u.Queries)
+		}
+	}
+	assert.True(t, other)
+}
+
+func Test_upstreamLabel(t *testing.T) {
+	servers := newMetricServers(&config{
+		RootServers:     []string{"192.5.5.241:53"},
+		FallbackServers: []string{"8.8.8.8:53"},
+		UpstreamGroups:  map[string][]string{"office": {"tls://192.0.2.53:853|weight=2"}},
+		ForwardZones:    []forwardZone{{Zone: "corp.", Servers: []string{"10.0.0.53:53"}}},
+	})
+
+	metricServersMu.Lock()
+	old := metricServers
+	metricServers = servers
+	metricServersMu.Unlock()
+
+	defer func() {
+		metricServersMu.Lock()
+		metricServers = old
+		metricServersMu.Unlock()
+	}()
+
+	assert.Equal(t, "192.5.5.241:53", upstreamLabel("192.5.5.241:53"))
+	assert.Equal(t, "8.8.8.8:53", upstreamLabel("8.8.8.8:53"))
+	assert.Equal(t, "10.0.0.53:53", upstreamLabel("10.0.0.53:53"))
+
+	host := cache.NewAuthServer("tls://192.0.2.53:853|weight=2").Host
+	assert.Equal(t, host, upstreamLabel(host))
+
+	// the authoritative servers of the recursion under one label
+	assert.Equal(t, statsOtherUpstream, upstreamLabel("198.51.100.1:53"))
+}
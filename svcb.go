@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+)
+
+// The service binding types (RFC 9460), unknown to the dns package so
+// handled in the RFC 3597 form
+const (
+	typeSVCB  uint16 = 64
+	typeHTTPS uint16 = 65
+)
+
+// svcbMaxTargets is the most targets of an answer the addresses added for
+const svcbMaxTargets = 4
+
+func init() {
+	// the type names of the configs, the api and the logs
+	for qtype, name := range map[uint16]string{typeSVCB: "SVCB", typeHTTPS: "HTTPS"} {
+		if _, ok := dns.TypeToString[qtype]; !ok {
+			dns.TypeToString[qtype] = name
+			dns.StringToType[name] = qtype
+		}
+	}
+}
+
+func svcbType(qtype uint16) bool {
+	return qtype == typeSVCB || qtype == typeHTTPS
+}
+
+// svcbTarget returns the priority and the target name of the service binding
+// record, the alias mode records have the zero priority. The root target
+// means the owner name.
+func svcbTarget(rr dns.RR) (priority uint16, target string, ok bool) {
+	generic, ok := rr.(*dns.RFC3597)
+	if !ok || !svcbType(rr.Header().Rrtype) {
+		return 0, "", false
+	}
+
+	rdata, err := hex.DecodeString(generic.Rdata)
+	if err != nil || len(rdata) < 3 {
+		return 0, "", false
+	}
+
+	target, _, err = dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return 0, "", false
+	}
+
+	if target == rootzone {
+		target = rr.Header().Name
+	}
+
+	return binary.BigEndian.Uint16(rdata), strings.ToLower(target), true
+}
+
+// svcbLookup returns the answer of the name from the cache or resolved and
+// cached like the client queries
+func (h *DNSHandler) svcbLookup(proto string, req *dns.Msg, name string, qtype uint16, upstream string) *dns.Msg {
+	lookupReq := new(dns.Msg)
+	lookupReq.SetQuestion(name, qtype)
+	lookupReq.SetEdns0(DefaultMsgSize, true)
+	lookupReq.RecursionDesired = true
+	lookupReq.CheckingDisabled = req.CheckingDisabled
+
+	key := ntaKey(cache.Hash(lookupReq.Question[0], lookupReq.CheckingDisabled), name, lookupReq.CheckingDisabled)
+	if upstream != "" {
+		key = cache.HashScope(key, "upstream:"+upstream)
+	}
+
+	resp, _, err := h.r.Qcache.Get(key, lookupReq)
+	if err == nil {
+		return resp
+	}
+
+	if _, err := h.r.Negcache.Get(key, lookupReq); err == nil {
+		return nil
+	}
+
+	resp, err = h.resolve(proto, lookupReq, upstream)
+	if err != nil {
+		log.Debug("Service binding additional query failed", "query", formatQuestion(lookupReq.Question[0]), "error", err.Error())
+		return nil
+	}
+
+	h.setCache(key, resp, upstream)
+
+	return resp
+}
+
+// svcbAnswer adds the records of the service binding answer targets to the
+// additional section (RFC 9460 section 4.2); the service binding records of
+// the alias mode targets followed, the addresses of the service mode targets
+// added. The records already in the additional section not asked again.
+func (h *DNSHandler) svcbAnswer(proto string, req, msg *dns.Msg, upstream string) *dns.Msg {
+	q := req.Question[0]
+	if !svcbType(q.Qtype) || len(msg.Answer) == 0 {
+		return msg
+	}
+
+	type rrKey struct {
+		name  string
+		qtype uint16
+	}
+
+	present := make(map[rrKey]bool)
+	for _, rr := range msg.Answer {
+		present[rrKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = true
+	}
+	for _, rr := range msg.Extra {
+		present[rrKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = true
+	}
+
+	// the extra records copied, the section shared with the cached answer
+	extra := append([]dns.RR{}, msg.Extra...)
+	added := false
+
+	add := func(resp *dns.Msg, types ...uint16) []dns.RR {
+		set := extractRRSet(resp.Answer, "", append(types, dns.TypeRRSIG)...)
+		for _, rr := range set {
+			if sig, ok := rr.(*dns.RRSIG); ok && !typeIn(sig.TypeCovered, types) {
+				continue
+			}
+
+			extra = append(extra, dns.Copy(rr))
+			added = true
+		}
+
+		return set
+	}
+
+	var targets []string
+	records := msg.Answer
+	depth := 0
+
+	for len(records) > 0 {
+		var aliases []string
+
+		for _, rr := range records {
+			priority, target, ok := svcbTarget(rr)
+			if !ok || rr.Header().Rrtype != q.Qtype {
+				continue
+			}
+
+			if priority == 0 {
+				aliases = append(aliases, target)
+			} else if !present[rrKey{target, dns.TypeA}] || !present[rrKey{target, dns.TypeAAAA}] {
+				targets = append(targets, target)
+			}
+		}
+
+		records = nil
+
+		if depth++; depth > Config().MaxCNAMEDepth {
+			break
+		}
+
+		for _, alias := range aliases {
+			// the alias to itself or to a followed one is a loop
+			if present[rrKey{alias, q.Qtype}] {
+				continue
+			}
+			present[rrKey{alias, q.Qtype}] = true
+
+			if resp := h.svcbLookup(proto, req, alias, q.Qtype, upstream); resp != nil {
+				records = append(records, add(resp, q.Qtype)...)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if seen[target] || len(seen) >= svcbMaxTargets {
+			continue
+		}
+		seen[target] = true
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if present[rrKey{target, qtype}] {
+				continue
+			}
+			present[rrKey{target, qtype}] = true
+
+			if resp := h.svcbLookup(proto, req, target, qtype, upstream); resp != nil {
+				add(resp, qtype)
+			}
+		}
+	}
+
+	if !added {
+		return msg
+	}
+
+	log.Debug("Service binding targets added", "query", formatQuestion(q), "targets", len(seen))
+
+	m := new(dns.Msg)
+	*m = *msg
+	m.Extra = extra
+
+	return m
+}
+
+func typeIn(qtype uint16, types []uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// svcbFallback returns the no data answer of the service binding query the
+// upstream servers refused the type of or dropped, cached like the empty
+// answers; the clients go on with the address queries (RFC 9460 section 3)
+// instead of failing. The validation failures kept.
+func svcbFallback(req, mesg *dns.Msg, err error) (*dns.Msg, error) {
+	q := req.Question[0]
+	if !svcbType(q.Qtype) {
+		return mesg, err
+	}
+
+	if err != nil {
+		if code := resolveErrorCode(err); code != edeNoReachableAuthority && code != edeNetworkError {
+			return mesg, err
+		}
+	} else if len(mesg.Answer) > 0 || (mesg.Rcode != dns.RcodeFormatError && mesg.Rcode != dns.RcodeNotImplemented) {
+		return mesg, err
+	}
+
+	log.Debug("Service binding query unsupported by upstream, answered with no data", "query", formatQuestion(q))
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	return m, nil
+}
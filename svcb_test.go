@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// svcbRR returns the service binding record in the RFC 3597 form, the params
+// ordered by the keys
+func svcbRR(owner string, qtype, priority uint16, target string, params ...[]byte) dns.RR {
+	rdata := make([]byte, 2, 512)
+	binary.BigEndian.PutUint16(rdata, priority)
+
+	name := make([]byte, 256)
+	n, _ := dns.PackDomainName(target, name, 0, nil, false)
+	rdata = append(rdata, name[:n]...)
+
+	for _, p := range params {
+		rdata = append(rdata, p...)
+	}
+
+	return &dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: owner, Rrtype: qtype, Class: dns.ClassINET, Ttl: 300, Rdlength: uint16(len(rdata))},
+		Rdata: hex.EncodeToString(rdata),
+	}
+}
+
+func svcbParam(key uint16, value []byte) []byte {
+	p := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(p, key)
+	binary.BigEndian.PutUint16(p[2:], uint16(len(value)))
+
+	return append(p, value...)
+}
+
+func Test_svcbTarget(t *testing.T) {
+	priority, target, ok := svcbTarget(svcbRR("alias.example.", typeHTTPS, 0, "Svc.Example."))
+	assert.True(t, ok)
+	assert.Equal(t, uint16(0), priority)
+	assert.Equal(t, "svc.example.", target)
+
+	// the root target is the owner
+	priority, target, ok = svcbTarget(svcbRR("svc.example.", typeSVCB, 1, "."))
+	assert.True(t, ok)
+	assert.Equal(t, uint16(1), priority)
+	assert.Equal(t, "svc.example.", target)
+
+	a, _ := dns.NewRR("svc.example. 300 IN A 192.0.2.1")
+	_, _, ok = svcbTarget(a)
+	assert.False(t, ok)
+
+	_, _, ok = svcbTarget(&dns.RFC3597{Hdr: dns.RR_Header{Name: "svc.example.", Rrtype: typeHTTPS}, Rdata: "00"})
+	assert.False(t, ok)
+
+	assert.Equal(t, typeHTTPS, dns.StringToType["HTTPS"])
+	assert.Equal(t, "SVCB", dns.TypeToString[typeSVCB])
+}
+
+func Test_HandlerSVCB(t *testing.T) {
+	// the format errors asked again without the cookie first otherwise
+
+	defer setConfig(func(cfg *config) { cfg.Cookies = false })()
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+
+	// ipv4hint and ipv6hint params of the service
+	hints := [][]byte{
+		svcbParam(1, []byte("\x02h2")),
+		svcbParam(4, net.ParseIP("192.0.2.10").To4()),
+		svcbParam(6, net.ParseIP("2001:db8::10")),
+	}
+	service := svcbRR("svc.example.", typeHTTPS, 1, ".", hints...)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.", func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+
+		mu.Lock()
+		calls[q.Name+" "+dns.TypeToString[q.Qtype]]++
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.RecursionAvailable = true
+
+		switch {
+		case q.Name == "broken.example.":
+			m.Rcode = dns.RcodeFormatError
+		case q.Name == "alias.example." && q.Qtype == typeHTTPS:
+			m.Answer = append(m.Answer, svcbRR(q.Name, typeHTTPS, 0, "svc.example."))
+		case q.Name == "svc.example." && q.Qtype == typeHTTPS:
+			m.Answer = append(m.Answer, service)
+		case q.Name == "svc.example." && q.Qtype == dns.TypeA:
+			rr, _ := dns.NewRR("svc.example. 300 IN A 192.0.2.10")
+			m.Answer = append(m.Answer, rr)
+		case q.Name == "svc.example." && q.Qtype == dns.TypeAAAA:
+			rr, _ := dns.NewRR("svc.example. 300 IN AAAA 2001:db8::10")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	upstreamGroupsMu.Lock()
+	upstreamGroups = newUpstreamGroups(map[string][]string{"svcb": {addrstr}})
+	upstreamGroupsMu.Unlock()
+
+	defer func() {
+		upstreamGroupsMu.Lock()
+		upstreamGroups = map[string]*cache.AuthServers{}
+		upstreamGroupsMu.Unlock()
+	}()
+
+	handler := NewHandler()
+	entry := NewAccessEntry(mustParseCIDR(t, "127.0.0.0/8"), ActionUpstream, "svcb")
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, typeHTTPS)
+		req.RecursionDesired = true
+		req.SetEdns0(DefaultMsgSize, false)
+
+		return handler.query("udp", req, entry)
+	}
+
+	extra := func(msg *dns.Msg, name string, qtype uint16) []dns.RR {
+		return extractRRSet(msg.Extra, name, qtype)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := query("alias.example.")
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+		if assert.Len(t, resp.Answer, 1) {
+			priority, target, _ := svcbTarget(resp.Answer[0])
+			assert.Equal(t, uint16(0), priority)
+			assert.Equal(t, "svc.example.", target)
+		}
+
+		// the alias target followed, the params kept as sent
+		if rrs := extra(resp, "svc.example.", typeHTTPS); assert.Len(t, rrs, 1) {
+			assert.Equal(t, service.(*dns.RFC3597).Rdata, rrs[0].(*dns.RFC3597).Rdata)
+		}
+
+		if rrs := extra(resp, "svc.example.", dns.TypeA); assert.Len(t, rrs, 1) {
+			assert.Equal(t, "192.0.2.10", rrs[0].(*dns.A).A.String())
+		}
+
+		if rrs := extra(resp, "svc.example.", dns.TypeAAAA); assert.Len(t, rrs, 1) {
+			assert.Equal(t, "2001:db8::10", rrs[0].(*dns.AAAA).AAAA.String())
+		}
+	}
+
+	// the service mode addresses of the owner
+	resp := query("svc.example.")
+	assert.Len(t, resp.Answer, 1)
+	assert.Len(t, extra(resp, "svc.example.", dns.TypeA), 1)
+	assert.Len(t, extra(resp, "svc.example.", dns.TypeAAAA), 1)
+	assert.Len(t, extra(resp, "svc.example.", typeHTTPS), 0)
+
+	// the type refused by the upstream answered with no data
+	for i := 0; i < 2; i++ {
+		resp = query("broken.example.")
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 0)
+	}
+
+	mu.Lock()
+	assert.Equal(t, 1, calls["alias.example. HTTPS"])
+	assert.Equal(t, 1, calls["svc.example. HTTPS"])
+	assert.Equal(t, 1, calls["svc.example. A"])
+	assert.Equal(t, 1, calls["svc.example. AAAA"])
+	// the format error asked again without edns, the second query cached
+	assert.Equal(t, 2, calls["broken.example. HTTPS"])
+	mu.Unlock()
+}
+
+func Test_verifyRRSIGHTTPS(t *testing.T) {
+	const zone = "svcb.example."
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	assert.NoError(t, err)
+
+	rr := svcbRR("www."+zone, typeHTTPS, 1, "Svc."+zone, svcbParam(4, net.ParseIP("192.0.2.10").To4()))
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: "www." + zone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	assert.NoError(t, sig.Sign(priv.(crypto.Signer), []dns.RR{rr}))
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("www."+zone, typeHTTPS)
+	resp.Answer = []dns.RR{rr, sig}
+
+	// the records on the wire like an upstream answer
+	buf, err := resp.Pack()
+	assert.NoError(t, err)
+
+	msg := new(dns.Msg)
+	assert.NoError(t, msg.Unpack(buf))
+
+	keys := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+
+	ok, err := verifyRRSIG(keys, msg)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the changed params fail
+	msg.Answer[0] = svcbRR("www."+zone, typeHTTPS, 1, "svc."+zone, svcbParam(4, net.ParseIP("192.0.2.66").To4()))
+
+	_, err = verifyRRSIG(keys, msg)
+	assert.Error(t, err)
+}
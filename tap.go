@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/dnstap"
+)
+
+// DnstapBufferSize is the maximum count of frames waiting for the collector
+const DnstapBufferSize = 10000
+
+var (
+	tapWriter *dnstap.Writer
+	tapSocket string
+	tapMu     sync.RWMutex
+
+	tapIdentity, _ = os.Hostname()
+)
+
+// setupDnstap starts the dnstap writer for the socket, the old writer closed
+// when the socket changed. Sockets with tcp:// prefix are tcp, others unix sockets
+func setupDnstap(socket string) {
+	tapMu.Lock()
+	defer tapMu.Unlock()
+
+	if socket == tapSocket {
+		return
+	}
+
+	if tapWriter != nil {
+		tapWriter.Close()
+		tapWriter = nil
+	}
+
+	tapSocket = socket
+
+	if socket == "" {
+		return
+	}
+
+	network, addr := "unix", strings.TrimPrefix(socket, "unix://")
+	if strings.HasPrefix(socket, "tcp://") {
+		network, addr = "tcp", strings.TrimPrefix(socket, "tcp://")
+	}
+
+	tapWriter = dnstap.NewWriter(network, addr, DnstapBufferSize)
+}
+
+// clientTap holds a client query until its response logged
+type clientTap struct {
+	writer *dnstap.Writer
+
+	protocol dnstap.SocketProtocol
+	address  net.IP
+	port     uint32
+
+	start time.Time
+	query []byte
+}
+
+var tapProtocols = map[string]dnstap.SocketProtocol{
+	"udp":   dnstap.ProtocolUDP,
+	"tcp":   dnstap.ProtocolTCP,
+	"https": dnstap.ProtocolDOH,
+	"quic":  dnstap.ProtocolDOQ,
+}
+
+// newClientTap returns nil when dnstap disabled
+func newClientTap(proto, remoteAddr string, req *dns.Msg) *clientTap {
+	tapMu.RLock()
+	writer := tapWriter
+	tapMu.RUnlock()
+
+	if writer == nil {
+		return nil
+	}
+
+	t := &clientTap{
+		writer:   writer,
+		protocol: tapProtocols[proto],
+		start:    time.Now(),
+	}
+
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err == nil {
+		t.address = net.ParseIP(host)
+
+		p, _ := strconv.Atoi(port)
+		t.port = uint32(p)
+	}
+
+	t.query, _ = req.Pack()
+
+	return t
+}
+
+// Done logs the query and the response messages
+func (t *clientTap) Done(msg *dns.Msg) {
+	if t == nil {
+		return
+	}
+
+	m := &dnstap.Message{
+		Type:         dnstap.MessageClientQuery,
+		Protocol:     t.protocol,
+		QueryAddress: t.address,
+		QueryPort:    t.port,
+		QueryTime:    t.start,
+		QueryMessage: t.query,
+	}
+
+	t.writer.Write(m.Marshal([]byte(tapIdentity), []byte("sdns "+Version)))
+
+	if msg == nil {
+		return
+	}
+
+	m.Type = dnstap.MessageClientResponse
+	m.ResponseTime = time.Now()
+	m.ResponseMessage, _ = msg.Pack()
+
+	t.writer.Write(m.Marshal([]byte(tapIdentity), []byte("sdns "+Version)))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/dnstap"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_clientTap(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	setupDnstap("")
+
+	tap := newClientTap("udp", "127.0.0.1:5353", req)
+	assert.Nil(t, tap)
+	tap.Done(req)
+
+	setupDnstap("tcp://127.0.0.1:1")
+	defer setupDnstap("")
+
+	assert.Equal(t, "tcp://127.0.0.1:1", tapSocket)
+	assert.NotNil(t, tapWriter)
+
+	tap = newClientTap("https", "127.0.0.1:5353", req)
+	assert.NotNil(t, tap)
+	assert.Equal(t, dnstap.ProtocolDOH, tap.protocol)
+	assert.Equal(t, net.ParseIP("127.0.0.1"), tap.address)
+	assert.Equal(t, uint32(5353), tap.port)
+	assert.NotEmpty(t, tap.query)
+
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	tap.Done(msg)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+
+	"github.com/semihalev/sdns/metrics"
+)
+
+// setFastOpen sets the tcp fast open of the dialer when enabled, the dialers
+// of the platforms without it left as is
+func setFastOpen(d *net.Dialer) *net.Dialer {
+	if Config().TCPFastOpen && fastOpenSupported {
+		d.Control = fastOpenControl
+	}
+
+	return d
+}
+
+// countFastOpen counts the upstream connection opened with the data in the
+// syn, the handshake roundtrip saved estimated by the rtt of the connection
+func countFastOpen(conn net.Conn) {
+	if conn == nil || !Config().TCPFastOpen || !fastOpenSupported {
+		return
+	}
+
+	rtt, ok := fastOpenRTT(conn)
+	if !ok {
+		return
+	}
+
+	metrics.UpstreamTCPFastOpen.Inc()
+	metrics.UpstreamTCPFastOpenSaved.Add(rtt.Seconds())
+}
@@ -0,0 +1,28 @@
+//go:build freebsd
+// +build freebsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpFastOpen enables the client side of the tcp fast open since FreeBSD 12
+const tcpFastOpen = 0x401
+
+const fastOpenSupported = true
+
+// fastOpenControl enables the tcp fast open on the socket, the kernels
+// without it connect as usual
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, 1)
+	})
+}
+
+// fastOpenRTT is unknown, the tcp info has no acknowledged syn data option
+func fastOpenRTT(conn net.Conn) (time.Duration, bool) {
+	return 0, false
+}
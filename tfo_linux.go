@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// tcpFastOpenConnect sends the data of the first write in the syn
+	tcpFastOpenConnect = 30
+
+	// tcpiOptSynData is the tcp info option of the syn data acknowledged
+	tcpiOptSynData = 0x20
+)
+
+const fastOpenSupported = true
+
+// fastOpenControl enables the tcp fast open on the socket, the kernels
+// without it connect as usual
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
+
+// fastOpenRTT returns the smoothed rtt of the connection, false if the data
+// of the syn not acknowledged by the server
+func fastOpenRTT(conn net.Conn) (time.Duration, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var info *unix.TCPInfo
+
+	err = raw.Control(func(fd uintptr) {
+		info, _ = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info == nil || info.Options&tcpiOptSynData == 0 {
+		return 0, false
+	}
+
+	return time.Duration(info.Rtt) * time.Microsecond, true
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// fastOpenSupported is false, the tcp fast open of the clients needs the
+// platform specific connect calls
+const fastOpenSupported = false
+
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func fastOpenRTT(conn net.Conn) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setFastOpen(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.TCPFastOpen = false })()
+	assert.Nil(t, setFastOpen(&net.Dialer{}).Control)
+
+	defer setConfig(func(cfg *config) { cfg.TCPFastOpen = true })()
+	assert.Equal(t, fastOpenSupported, setFastOpen(&net.Dialer{}).Control != nil)
+
+	// the plain connections not counted
+	countFastOpen(nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, ok := fastOpenRTT(conn)
+	assert.False(t, ok)
+}
+
+func Test_exchangeTCPFastOpen(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.TCPFastOpen = true })()
+
+	addr, _, stop := runTCPUpstream(t, false, 50)
+	defer stop()
+
+	c := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: time.Second}}
+	server := cache.NewAuthServer(addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	// the servers without the fast open answered as usual
+	for i := 0; i < 2; i++ {
+		resp, _, err := exchangeUpstream(c, req, server)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, resp.Answer, 1)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// DefaultTLSMinVersion is the minimum tls version of the client facing listeners
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the tls version of the name
+func parseTLSVersion(name string) (uint16, error) {
+	if version, ok := tlsVersions[name]; ok {
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("tls version unknown: %s", name)
+}
+
+// parseCipherSuites returns the ids of the cipher suite names, the insecure
+// suites rejected. The tls 1.3 suites are not configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, name) {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("tls cipher suite unknown or insecure: %s", name)
+		}
+	}
+
+	return ids, nil
+}
+
+// http2CipherSuite reports any of the suites allowed by the http/2 clients
+func http2CipherSuite(ids []uint16) bool {
+	for _, id := range ids {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkTLSSettings validates the tls settings of the client facing listeners
+// and sets the default alpn protocols
+func checkTLSSettings(cfg *config) error {
+	if cfg.TLSMinVersion == "" {
+		cfg.TLSMinVersion = DefaultTLSMinVersion
+	}
+
+	if _, err := parseTLSVersion(cfg.TLSMinVersion); err != nil {
+		return err
+	}
+
+	suites, err := parseCipherSuites(cfg.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.DOTALPN) == 0 {
+		cfg.DOTALPN = []string{"dot"}
+	}
+
+	if len(cfg.DOHALPN) == 0 {
+		cfg.DOHALPN = []string{"h2", "http/1.1"}
+	}
+
+	if len(suites) > 0 && hasProto(cfg.DOHALPN, "h2") && !http2CipherSuite(suites) {
+		return fmt.Errorf("tls cipher suites missing the AES_128_GCM_SHA256 suite required by h2")
+	}
+
+	return nil
+}
+
+// serverTLSConfig returns the tls config of the client facing listeners with
+// the certificates of the store, protos are the alpn protocols negotiated. The session
+// tickets resume the sessions of the reconnecting clients unless disabled.
+func serverTLSConfig(certs *certStore, protos []string) *tls.Config {
+	cfg := Config()
+
+	// validated by the config setup
+	version, err := parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		version = tls.VersionTLS12
+	}
+
+	suites, _ := parseCipherSuites(cfg.TLSCipherSuites)
+
+	return &tls.Config{
+		GetCertificate:         certs.GetCertificate,
+		MinVersion:             version,
+		CipherSuites:           suites,
+		NextProtos:             protos,
+		SessionTicketsDisabled: cfg.TLSNoSessionTickets,
+	}
+}
+
+// tlsOptions returns the tls settings of the config, the listeners restarted
+// on the reload when changed
+func tlsOptions(cfg *config) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%t", cfg.TLSMinVersion, strings.Join(cfg.TLSCipherSuites, ","),
+		strings.Join(cfg.DOTALPN, ","), strings.Join(cfg.DOHALPN, ","), cfg.TLSNoSessionTickets)
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkTLSSettings(t *testing.T) {
+	cfg := &config{}
+	assert.NoError(t, checkTLSSettings(cfg))
+	assert.Equal(t, DefaultTLSMinVersion, cfg.TLSMinVersion)
+	assert.Equal(t, []string{"dot"}, cfg.DOTALPN)
+	assert.Equal(t, []string{"h2", "http/1.1"}, cfg.DOHALPN)
+
+	for _, c := range []config{
+		{TLSMinVersion: "1.4"},
+		{TLSCipherSuites: []string{"TLS_UNKNOWN"}},
+		{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		// h2 requires an AES_128_GCM_SHA256 suite
+		{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+	} {
+		c := c
+		assert.Error(t, checkTLSSettings(&c), c.TLSMinVersion, c.TLSCipherSuites)
+	}
+
+	cfg = &config{TLSCipherSuites: []string{"tls_ecdhe_rsa_with_aes_256_gcm_sha384"}, DOHALPN: []string{"http/1.1"}}
+	assert.NoError(t, checkTLSSettings(cfg))
+
+	ids, err := parseCipherSuites(cfg.TLSCipherSuites)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, ids)
+}
+
+func Test_serverTLSConfig(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	certs, err := newCertStore("test.cert", "test.key")
+	assert.NoError(t, err)
+
+	defer setConfig(func(cfg *config) { cfg.TLSMinVersion = "1.2" })()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig(certs, []string{"dot"}))
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			// the session ticket sent after the handshake
+			conn.Write([]byte{0})
+			conn.Close()
+		}
+	}()
+
+	dial := func(cfg *tls.Config) (tls.ConnectionState, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", ln.Addr().String(), cfg)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+
+		conn.Read(make([]byte, 1))
+
+		return conn.ConnectionState(), nil
+	}
+
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"dot"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+
+	state, err := dial(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "dot", state.NegotiatedProtocol)
+	assert.False(t, state.DidResume)
+
+	// the reconnecting client resumes the session
+	state, err = dial(client)
+	assert.NoError(t, err)
+	assert.True(t, state.DidResume)
+
+	// the weak versions rejected
+	_, err = dial(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+}
+
+func Test_serverDOHALPN(t *testing.T) {
+	err := generateCertificate()
+	assert.NoError(t, err)
+
+	defer os.Remove("test.cert")
+	defer os.Remove("test.key")
+
+	for _, tt := range []struct {
+		protos []string
+		major  int
+	}{
+		{[]string{"h2", "http/1.1"}, 2},
+		{[]string{"http/1.1"}, 1},
+	} {
+		defer setConfig(func(cfg *config) { cfg.DOHALPN = tt.protos })()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		s := &Server{
+			dohHost:        addr,
+			tlsCertificate: "test.cert",
+			tlsPrivateKey:  "test.key",
+		}
+
+		s.handler = NewHandler()
+		assert.NoError(t, s.runDOH(s.dohHost))
+
+		client := &http.Client{
+			Timeout: 2 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			},
+		}
+
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			if resp, err = client.Get("https://" + addr + "/dns-query?name=example.com&type=unknown"); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if assert.NoError(t, err) {
+			assert.Equal(t, tt.major, resp.ProtoMajor, tt.protos)
+			resp.Body.Close()
+		}
+
+		s.dohServer.Close()
+	}
+}
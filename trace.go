@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+// traceCacheSize is the size of the caches of the isolated traces
+const traceCacheSize = 1024
+
+// tracer records the steps of a traced resolution. The resolver calls it only
+// when set, the queries of the clients never traced.
+type tracer interface {
+	exchanged(server, network string, q dns.Question, resp *dns.Msg, rtt time.Duration, err error)
+	referral(zone string, servers []string, cached bool)
+	cacheHit(kind string, q dns.Question)
+	validated(signer, signed string, q dns.Question, ok bool, err error)
+}
+
+// traceStep is a step of the resolution trace, the elapsed time from the
+// start of the trace
+type traceStep struct {
+	Step    string   `json:"step"`
+	Elapsed float64  `json:"elapsed_ms"`
+	Query   string   `json:"query,omitempty"`
+	Server  string   `json:"server,omitempty"`
+	Net     string   `json:"net,omitempty"`
+	Rcode   string   `json:"rcode,omitempty"`
+	Answers int      `json:"answers,omitempty"`
+	RTT     float64  `json:"rtt_ms,omitempty"`
+	Zone    string   `json:"zone,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+	Cached  bool     `json:"cached,omitempty"`
+	Kind    string   `json:"kind,omitempty"`
+	Signer  string   `json:"signer,omitempty"`
+	Secure  bool     `json:"secure,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// resolveTrace records the steps in order, the parallel upstream queries
+// recorded concurrently
+type resolveTrace struct {
+	mu sync.Mutex
+
+	start time.Time
+	list  []traceStep
+}
+
+func newResolveTrace() *resolveTrace {
+	return &resolveTrace{start: time.Now()}
+}
+
+func (t *resolveTrace) add(step traceStep) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	step.Elapsed = milliseconds(time.Since(t.start))
+	t.list = append(t.list, step)
+}
+
+// steps returns a copy of the recorded steps
+func (t *resolveTrace) steps() []traceStep {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]traceStep{}, t.list...)
+}
+
+func (t *resolveTrace) exchanged(server, network string, q dns.Question, resp *dns.Msg, rtt time.Duration, err error) {
+	step := traceStep{Step: "upstream", Query: formatQuestion(q), Server: server, Net: network, RTT: milliseconds(rtt)}
+
+	if resp != nil {
+		step.Rcode = dns.RcodeToString[resp.Rcode]
+		step.Answers = len(resp.Answer)
+	}
+
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	t.add(step)
+}
+
+func (t *resolveTrace) referral(zone string, servers []string, cached bool) {
+	t.add(traceStep{Step: "referral", Zone: zone, Servers: servers, Cached: cached})
+}
+
+func (t *resolveTrace) cacheHit(kind string, q dns.Question) {
+	t.add(traceStep{Step: "cache", Kind: kind, Query: formatQuestion(q)})
+}
+
+func (t *resolveTrace) validated(signer, signed string, q dns.Question, ok bool, err error) {
+	step := traceStep{Step: "dnssec", Query: formatQuestion(q), Zone: signed, Signer: signer, Secure: ok && err == nil}
+
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	t.add(step)
+}
+
+// newTraceResolver returns a resolver of the trace; on the caches of the
+// resolver if shared, on the new caches otherwise so the trace learns every
+// delegation and key again. The stop function releases the new caches.
+func newTraceResolver(r *Resolver, t tracer, shared bool) (*Resolver, func()) {
+	if shared {
+		tr := *r
+		tr.trace = t
+
+		return &tr, func() {}
+	}
+
+	cfg := Config()
+
+	tr := &Resolver{
+		config: r.config,
+
+		Ncache:   cache.NewNSCache(),
+		Qcache:   cache.NewQueryCache(traceCacheSize, 0, 0, 1),
+		Ecache:   cache.NewErrorCache(traceCacheSize, cfg.Expire, 1),
+		Negcache: cache.NewNegativeCache(traceCacheSize, 1),
+		TCcache:  cache.NewErrorCache(traceCacheSize, cfg.Expire, 1),
+		Lqueue:   cache.NewLookupQueue(),
+		Flight:   cache.NewFlight(),
+
+		NSEC3cache: cache.NewNSECCache(),
+
+		trace: t,
+	}
+
+	return tr, func() {
+		tr.Ncache.Stop()
+		tr.NSEC3cache.Stop()
+	}
+}
+
+// traceResolve resolves the question from the root servers with every step
+// recorded, again over tcp if the answer truncated. The trusted keys of the
+// validated zones shared with the resolver.
+func traceResolve(r *Resolver, q dns.Question, shared bool) (*dns.Msg, *resolveTrace, error) {
+	t := newResolveTrace()
+
+	tr, stop := newTraceResolver(r, t, shared)
+	defer stop()
+
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.SetEdns0(DefaultMsgSize, true)
+	req.RecursionDesired = true
+
+	depth := Config().Maxdepth
+
+	resp, err := tr.Resolve("udp", req, rootservers, true, depth, 0, false, nil)
+	if err == nil && resp.Truncated {
+		resp, err = tr.Resolve("tcp", req, rootservers, true, depth, 0, false, nil)
+	}
+
+	return resp, t, err
+}
+
+// serverHosts returns the hosts of the servers
+func serverHosts(servers *cache.AuthServers) []string {
+	servers.RLock()
+	defer servers.RUnlock()
+
+	hosts := make([]string, 0, len(servers.List))
+	for _, s := range servers.List {
+		hosts = append(hosts, s.Host)
+	}
+
+	return hosts
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// runTraceRoot runs a root server answered the A query of the name, no data
+// for the others
+func runTraceRoot(t *testing.T, name string) (*dns.Server, string) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+
+		if q := req.Question[0]; q.Name == name && q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = mux
+	})
+	assert.NoError(t, err)
+
+	return s, addrstr
+}
+
+func Test_traceResolve(t *testing.T) {
+	defer func(roots *cache.AuthServers) {
+		rootservers = roots
+	}(rootservers)
+
+	s, addrstr := runTraceRoot(t, "www.trace.test.")
+	defer s.Shutdown()
+
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+
+	r := &Resolver{Ncache: cache.NewNSCache()}
+	q := dns.Question{Name: "www.trace.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	resp, trace, err := traceResolve(r, q, false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	steps := trace.steps()
+	if assert.NotEmpty(t, steps) {
+		last := steps[len(steps)-1]
+		assert.Equal(t, "upstream", last.Step)
+		assert.Equal(t, addrstr, last.Server)
+		assert.Equal(t, "udp", last.Net)
+		assert.Equal(t, "NOERROR", last.Rcode)
+		assert.Equal(t, 1, last.Answers)
+		assert.Empty(t, last.Error)
+
+		for i := 1; i < len(steps); i++ {
+			assert.True(t, steps[i].Elapsed >= steps[i-1].Elapsed)
+		}
+	}
+
+	// the resolver untraced
+	assert.Nil(t, r.trace)
+
+	tr, stop := newTraceResolver(r, trace, true)
+	stop()
+
+	assert.Equal(t, r.Ncache, tr.Ncache)
+	assert.Equal(t, trace, tr.trace)
+
+	tr, stop = newTraceResolver(r, trace, false)
+	stop()
+
+	assert.NotEqual(t, r.Ncache, tr.Ncache)
+}
+
+func Test_TraceAPI(t *testing.T) {
+	defer func(roots *cache.AuthServers) {
+		rootservers = roots
+	}(rootservers)
+
+	s, addrstr := runTraceRoot(t, "www.trace.test.")
+	defer s.Shutdown()
+
+	rootservers = &cache.AuthServers{List: []*cache.AuthServer{cache.NewAuthServer(addrstr)}}
+
+	api := &API{host: "0.0.0.0:8080", resolver: &Resolver{}}
+
+	r := gin.New()
+	r.GET("/trace", api.getTrace)
+
+	serve := func(query, remote string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/trace?"+query, nil)
+		assert.NoError(t, err)
+		request.RemoteAddr = remote
+		r.ServeHTTP(w, request)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, serve("name=www.trace.test", "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("", "127.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("name=www.trace.test&type=BOGUS", "127.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("name=www.trace.test&cache=maybe", "127.0.0.1:1234").Code)
+
+	w := serve("name=www.trace.test&type=a", "127.0.0.1:1234")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var result struct {
+		Name   string
+		Type   string
+		Cache  bool
+		Rcode  string
+		Answer []string
+		Steps  []traceStep
+		Error  string
+	}
+
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "www.trace.test.", result.Name)
+	assert.Equal(t, "A", result.Type)
+	assert.False(t, result.Cache)
+	assert.Equal(t, "NOERROR", result.Rcode)
+	assert.Len(t, result.Answer, 1)
+	assert.NotEmpty(t, result.Steps)
+	assert.Empty(t, result.Error)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+)
+
+const (
+	// transportAuto sends the usually large answers over tcp in the first place
+	transportAuto = "auto"
+
+	// transportUDP always tries udp first, only the truncated answers asked
+	// again over tcp
+	transportUDP = "udp"
+)
+
+var upstreamTransports = map[string]bool{
+	transportAuto: true,
+	transportUDP:  true,
+}
+
+var (
+	forceTCPTypes   = map[uint16]bool{}
+	forceTCPTypesMu sync.RWMutex
+)
+
+// newForceTCPTypes returns the set of the query types sent over tcp first
+func newForceTCPTypes(types []string) (map[uint16]bool, error) {
+	list := make(map[uint16]bool)
+
+	for _, t := range types {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("force tcp type unknown: %s", t)
+		}
+
+		list[qtype] = true
+	}
+
+	return list, nil
+}
+
+// truncatedKey returns the key of the question which upstream answer came
+// truncated over udp
+func truncatedKey(q dns.Question) uint64 {
+	return cache.Hash(dns.Question{Name: strings.ToLower(q.Name), Qtype: q.Qtype, Qclass: q.Qclass})
+}
+
+// tcpFirst returns the reason the upstream query sent over tcp without trying
+// udp first; the query types forced and the questions which answers came
+// truncated recently, empty if udp tried first. The udp transport mode never
+// sends over tcp first.
+func (r *Resolver) tcpFirst(req *dns.Msg) string {
+	if Config().UpstreamTransport == transportUDP || len(req.Question) == 0 {
+		return ""
+	}
+
+	q := req.Question[0]
+
+	forceTCPTypesMu.RLock()
+	forced := forceTCPTypes[q.Qtype]
+	forceTCPTypesMu.RUnlock()
+
+	if forced {
+		return "type"
+	}
+
+	if r.TCcache != nil && r.TCcache.Get(truncatedKey(q)) == nil {
+		return "size"
+	}
+
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newForceTCPTypes(t *testing.T) {
+	types, err := newForceTCPTypes([]string{"txt", "ANY", "DNSKEY"})
+	assert.NoError(t, err)
+	assert.True(t, types[dns.TypeTXT])
+	assert.True(t, types[dns.TypeANY])
+	assert.True(t, types[dns.TypeDNSKEY])
+	assert.False(t, types[dns.TypeA])
+
+	_, err = newForceTCPTypes([]string{"LARGE"})
+	assert.Error(t, err)
+}
+
+func Test_exchangeTCPFirst(t *testing.T) {
+	var udp, tcp int32
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := upstreamReply(req)
+
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.AddInt32(&udp, 1)
+
+			if req.Question[0].Name == "large.example.com." {
+				m.Answer = nil
+				m.Truncated = true
+			}
+		} else {
+			atomic.AddInt32(&tcp, 1)
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = handler
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	// the tcp server on the same port
+	l, err := net.Listen("tcp4", addrstr)
+	if err != nil {
+		t.Skip("tcp listen failed", err)
+	}
+
+	ts := &dns.Server{Listener: l, Handler: handler}
+	go ts.ActivateAndServe()
+	defer ts.Shutdown()
+
+	forceTCPTypesMu.Lock()
+	forceTCPTypes = map[uint16]bool{dns.TypeTXT: true}
+	forceTCPTypesMu.Unlock()
+
+	defer func() {
+		forceTCPTypesMu.Lock()
+		forceTCPTypes = map[uint16]bool{}
+		forceTCPTypesMu.Unlock()
+	}()
+
+	r := NewResolver()
+	server := cache.NewAuthServer(addrstr)
+
+	exchange := func(name string, qtype uint16) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(DefaultMsgSize, true)
+
+		resp, err := r.exchange(server, req, r.newClient("udp"))
+		if assert.NoError(t, err) {
+			assert.False(t, resp.Truncated)
+			assert.Len(t, resp.Answer, 1)
+		}
+	}
+
+	// the forced types never tried over udp
+	exchange("txt.example.com.", dns.TypeTXT)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&udp))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcp))
+
+	exchange("small.example.com.", dns.TypeA)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&udp))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcp))
+
+	// the truncated question asked over tcp first the next time
+	exchange("large.example.com.", dns.TypeA)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&udp))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tcp))
+
+	exchange("LARGE.example.com.", dns.TypeA)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&udp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&tcp))
+
+	// the udp transport always tries udp first
+	defer setConfig(func(cfg *config) { cfg.UpstreamTransport = transportUDP })()
+
+	exchange("txt.example.com.", dns.TypeTXT)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&udp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&tcp))
+
+	// udp tried when tcp fails
+	defer setConfig(func(cfg *config) { cfg.UpstreamTransport = transportAuto })()
+	ts.Shutdown()
+
+	exchange("txt.example.com.", dns.TypeTXT)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&udp))
+}
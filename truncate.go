@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/metrics"
+)
+
+const (
+	// DefaultUDPMinSize is the lowest udp response size for the edns clients
+	DefaultUDPMinSize = dns.MinMsgSize
+
+	// DefaultUDPMaxSize is the highest udp response size, safe from the ip
+	// fragmentation (DNS flag day 2020)
+	DefaultUDPMaxSize = 1232
+)
+
+// truncateWriter truncates the udp responses to the buffer size of the client
+// and to the answer record limit
+type truncateWriter struct {
+	dns.ResponseWriter
+
+	size    int
+	records int
+}
+
+// newTruncateWriter checks the request before the query, the handler replaces
+// the buffer size of the request
+func newTruncateWriter(w dns.ResponseWriter, req *dns.Msg) *truncateWriter {
+	return &truncateWriter{ResponseWriter: w, size: udpSize(req), records: Config().MaxAnswerRecords}
+}
+
+// WriteMsg truncates the message if it is too large then writes it
+func (w *truncateWriter) WriteMsg(m *dns.Msg) error {
+	if limitAnswers(m, w.records) {
+		metrics.AnswersLimited.Inc()
+	}
+
+	truncateMsg(m, w.size)
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// udpSize returns the response size of the request, the advertised edns0
+// buffer size clamped to the config limits, 512 bytes for the clients
+// without edns0
+func udpSize(req *dns.Msg) int {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	cfg := Config()
+
+	size := int(opt.UDPSize())
+	if size < cfg.UDPMinSize {
+		size = cfg.UDPMinSize
+	}
+
+	if size > cfg.UDPMaxSize {
+		size = cfg.UDPMaxSize
+	}
+
+	return size
+}
+
+// truncateMsg removes the records which not fit into the size at a record
+// boundary. The TC bit set if the answer or authority records are removed,
+// the additional records are removed silently (RFC 2181 section 9). The OPT
+// record is always kept.
+func truncateMsg(msg *dns.Msg, size int) {
+	msg.Compress = true
+
+	if msg.Len() <= size {
+		return
+	}
+
+	var opt dns.RR
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opt = rr
+			continue
+		}
+
+		extra = append(extra, rr)
+	}
+
+	answer, ns := msg.Answer, msg.Ns
+
+	msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+	if opt != nil {
+		msg.Extra = []dns.RR{opt}
+	}
+
+	msg.Answer = fit(msg, answer, &msg.Answer, size)
+	if len(msg.Answer) == len(answer) {
+		msg.Ns = fit(msg, ns, &msg.Ns, size)
+	}
+
+	msg.Truncated = len(msg.Answer) < len(answer) || len(msg.Ns) < len(ns)
+
+	if !msg.Truncated {
+		msg.Extra = fit(msg, extra, &msg.Extra, size)
+	}
+}
+
+// fit returns the longest prefix of the records which fits into the size
+// when set to the section of the message
+func fit(msg *dns.Msg, rrs []dns.RR, section *[]dns.RR, size int) []dns.RR {
+	prev := *section
+
+	n := sort.Search(len(rrs)+1, func(i int) bool {
+		*section = append(prev[:len(prev):len(prev)], rrs[:i]...)
+		return msg.Len() > size
+	}) - 1
+
+	if n < 0 {
+		n = 0
+	}
+
+	*section = prev
+
+	return append(prev[:len(prev):len(prev)], rrs[:n]...)
+}
+
+// limitAnswers cuts the answer section to the records with the TC bit, the
+// authority and the additional records removed except the OPT record. The
+// clients query again over tcp, the answer of the large record sets never
+// reflected over udp. Zero records for no limit.
+func limitAnswers(msg *dns.Msg, records int) bool {
+	if records <= 0 || len(msg.Answer) <= records {
+		return false
+	}
+
+	msg.Answer = msg.Answer[:records:records]
+	msg.Ns = nil
+
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	msg.Truncated = true
+
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func truncateTestMsg(t *testing.T, answers, extras int) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.example.com.", dns.TypeA)
+
+	for i := 0; i < answers; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("big.example.com. 300 IN A 192.0.2.%d", i))
+		assert.NoError(t, err)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	for i := 0; i < extras; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("ns%d.example.com. 300 IN AAAA 2001:db8::%d", i, i))
+		assert.NoError(t, err)
+		msg.Extra = append(msg.Extra, rr)
+	}
+
+	msg.SetEdns0(4096, true)
+
+	return msg
+}
+
+func Test_udpSize(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.Equal(t, 512, udpSize(req))
+
+	req.SetEdns0(4096, false)
+	assert.Equal(t, DefaultUDPMaxSize, udpSize(req))
+
+	req.IsEdns0().SetUDPSize(1000)
+	assert.Equal(t, 1000, udpSize(req))
+
+	// the edns0 buffer sizes below 512 are treated as 512 (RFC 6891)
+	req.IsEdns0().SetUDPSize(100)
+	assert.Equal(t, DefaultUDPMinSize, udpSize(req))
+}
+
+func Test_truncateMsg(t *testing.T) {
+	msg := truncateTestMsg(t, 10, 0)
+	truncateMsg(msg, 512)
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 10)
+
+	msg = truncateTestMsg(t, 100, 0)
+	truncateMsg(msg, 512)
+	assert.True(t, msg.Truncated)
+	assert.True(t, len(msg.Answer) > 0 && len(msg.Answer) < 100)
+	assert.NotNil(t, msg.IsEdns0())
+	assert.True(t, msg.Len() <= 512)
+
+	packed, err := msg.Pack()
+	assert.NoError(t, err)
+	assert.True(t, len(packed) <= 512)
+
+	// one more record not fit
+	msg.Answer = append(msg.Answer, truncateTestMsg(t, 1, 0).Answer[0])
+	assert.True(t, msg.Len() > 512)
+
+	// the additional records removed without the TC bit
+	msg = truncateTestMsg(t, 10, 40)
+	truncateMsg(msg, 512)
+	assert.False(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 10)
+	assert.True(t, len(msg.Extra) > 1 && len(msg.Extra) < 41)
+	assert.NotNil(t, msg.IsEdns0())
+	assert.True(t, msg.Len() <= 512)
+
+	// the authority records removed when the answer fits
+	msg = truncateTestMsg(t, 10, 0)
+	for i := 0; i < 40; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("example.com. 300 IN NS ns%d.example.com.", i))
+		msg.Ns = append(msg.Ns, rr)
+	}
+	truncateMsg(msg, 512)
+	assert.True(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 10)
+	assert.True(t, len(msg.Ns) < 40)
+	assert.Len(t, msg.Extra, 1)
+}
+
+func Test_limitAnswers(t *testing.T) {
+	msg := truncateTestMsg(t, 10, 5)
+	assert.False(t, limitAnswers(msg, 0))
+	assert.False(t, limitAnswers(msg, 10))
+	assert.False(t, msg.Truncated)
+
+	assert.True(t, limitAnswers(msg, 4))
+	assert.True(t, msg.Truncated)
+	assert.Len(t, msg.Answer, 4)
+	assert.Len(t, msg.Ns, 0)
+	assert.Len(t, msg.Extra, 1)
+	assert.NotNil(t, msg.IsEdns0())
+
+	defer setConfig(func(cfg *config) { cfg.MaxAnswerRecords = 20 })()
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	// the limit applied before the size of the client
+	w := &testWriter{}
+	tw := newTruncateWriter(w, req)
+
+	assert.NoError(t, tw.WriteMsg(truncateTestMsg(t, 30, 0)))
+	if assert.NotNil(t, w.msg) {
+		assert.True(t, w.msg.Truncated)
+		assert.Len(t, w.msg.Answer, 20)
+	}
+
+	assert.NoError(t, tw.WriteMsg(truncateTestMsg(t, 20, 0)))
+	if assert.NotNil(t, w.msg) {
+		assert.False(t, w.msg.Truncated)
+		assert.Len(t, w.msg.Answer, 20)
+	}
+}
+
+func Test_TruncateRetryTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_truncate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var zone strings.Builder
+	zone.WriteString("$TTL 300\n@ SOA ns1 hostmaster 1 3600 600 86400 60\n@ NS ns1\nns1 A 192.168.1.1\n")
+	for i := 1; i <= 50; i++ {
+		fmt.Fprintf(&zone, "big A 192.168.2.%d\n", i)
+	}
+
+	file := filepath.Join(dir, "trunc.test.zone")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(zone.String()), 0644))
+
+	assert.NoError(t, LocalZones.Load(map[string]string{"trunc.test": file}))
+	defer LocalZones.Load(nil)
+
+	handler := NewHandler()
+
+	udpMux := dns.NewServeMux()
+	udpMux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		handler.UDP(newTruncateWriter(w, req), req)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = udpMux
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	// the tcp server on the same port
+	l, err := net.Listen("tcp4", addrstr)
+	if err != nil {
+		t.Skip("tcp listen failed", err)
+	}
+
+	tcpMux := dns.NewServeMux()
+	tcpMux.HandleFunc(".", handler.TCP)
+
+	started := sync.Mutex{}
+	started.Lock()
+
+	ts := &dns.Server{Listener: l, Handler: tcpMux, ReadTimeout: time.Hour, WriteTimeout: time.Hour, NotifyStartedFunc: started.Unlock}
+	go ts.ActivateAndServe()
+	defer ts.Shutdown()
+
+	started.Lock()
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.trunc.test.", dns.TypeA)
+
+	// well-behaved clients query again over tcp on the TC bit
+	exchange := func(req *dns.Msg) (udp, resp *dns.Msg) {
+		c := new(dns.Client)
+
+		udp, _, err := c.Exchange(req, addrstr)
+		if err != dns.ErrTruncated {
+			assert.NoError(t, err)
+		}
+
+		resp = udp
+		if udp != nil && udp.Truncated {
+			c.Net = "tcp"
+
+			resp, _, err = c.Exchange(req, addrstr)
+			assert.NoError(t, err)
+		}
+
+		return udp, resp
+	}
+
+	udp, resp := exchange(req)
+	if assert.NotNil(t, udp) && assert.NotNil(t, resp) {
+		assert.True(t, udp.Truncated)
+		assert.True(t, len(udp.Answer) < 50)
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, 50)
+	}
+
+	req.SetEdns0(4096, false)
+
+	udp, resp = exchange(req)
+	if assert.NotNil(t, udp) && assert.NotNil(t, resp) {
+		assert.False(t, udp.Truncated)
+		assert.Len(t, udp.Answer, 50)
+	}
+}
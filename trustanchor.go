@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+)
+
+// The trust anchor states of RFC 5011 section 4
+const (
+	anchorAddPend = "addpend"
+	anchorValid   = "valid"
+	anchorMissing = "missing"
+	anchorRevoked = "revoked"
+)
+
+const (
+	// anchorHoldDown is the add and remove hold-down time (RFC 5011 section 2.4.1)
+	anchorHoldDown = 30 * 24 * time.Hour
+
+	// anchorMinRefresh and anchorMaxRefresh limit the active refresh interval
+	anchorMinRefresh = time.Hour
+	anchorMaxRefresh = 15 * 24 * time.Hour
+
+	// anchorRetry is the retry interval of a failed refresh
+	anchorRetry = time.Hour
+)
+
+var errAnchorNotValidated = errors.New("root DNSKEY set not signed by a trust anchor")
+
+// trustAnchor is a root key signing key with its state
+type trustAnchor struct {
+	key   *dns.DNSKEY
+	state string
+	since time.Time
+}
+
+// anchorFile is the persisted state of the trust anchors
+type anchorFile struct {
+	Keys []anchorEntry `json:"keys"`
+}
+
+type anchorEntry struct {
+	Key   string    `json:"key"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+}
+
+// trustAnchors keeps the root trust anchors by RFC 5011
+type trustAnchors struct {
+	mu sync.Mutex
+
+	path    string
+	anchors []*trustAnchor
+}
+
+var (
+	// anchorsManaged reports whether the root keys maintained by the trust
+	// anchor file instead of the config
+	anchorsManaged   bool
+	anchorsManagedMu sync.RWMutex
+)
+
+// newTrustAnchors loads the trust anchors from the file, the root keys of the
+// config used as valid anchors if the file not found
+func newTrustAnchors(path string, rootKeys []dns.RR) (*trustAnchors, error) {
+	t := &trustAnchors{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		now := time.Now()
+		for _, rr := range rootKeys {
+			if k, ok := rr.(*dns.DNSKEY); ok && k.Flags&dns.SEP != 0 {
+				t.anchors = append(t.anchors, &trustAnchor{key: k, state: anchorValid, since: now})
+			}
+		}
+
+		if len(t.anchors) == 0 {
+			return nil, errors.New("root keys have no key signing key")
+		}
+
+		return t, t.save()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f anchorFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	for _, e := range f.Keys {
+		rr, err := dns.NewRR(e.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, errors.New("trust anchor is not a DNSKEY: " + e.Key)
+		}
+
+		t.anchors = append(t.anchors, &trustAnchor{key: k, state: e.State, since: e.Since})
+	}
+
+	if len(t.trusted()) == 0 {
+		return nil, errors.New("trust anchor file has no valid keys")
+	}
+
+	return t, nil
+}
+
+// trusted returns the valid and missing anchors, the missing anchors still
+// trusted until revoked
+func (t *trustAnchors) trusted() []dns.RR {
+	var keys []dns.RR
+
+	for _, a := range t.anchors {
+		if a.state == anchorValid || a.state == anchorMissing {
+			keys = append(keys, a.key)
+		}
+	}
+
+	return keys
+}
+
+// update applies the root DNSKEY response to the anchors, reports whether
+// any anchor changed
+func (t *trustAnchors) update(msg *dns.Msg, now time.Time) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := extractRRSet(msg.Answer, rootzone, dns.TypeDNSKEY)
+	sigs := extractRRSet(msg.Answer, rootzone, dns.TypeRRSIG)
+
+	trusted := make(map[uint16]*dns.DNSKEY)
+	for _, rr := range t.trusted() {
+		k := rr.(*dns.DNSKEY)
+		trusted[k.KeyTag()] = k
+	}
+
+	if !signedBy(keys, sigs, trusted, now) {
+		return false, errAnchorNotValidated
+	}
+
+	changed := false
+	seen := make(map[*trustAnchor]bool)
+
+	for _, rr := range keys {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.SEP == 0 {
+			continue
+		}
+
+		if k.Flags&dns.REVOKE != 0 {
+			a := t.find(k)
+			if a == nil || a.state == anchorRevoked {
+				continue
+			}
+
+			// the revoked key should sign the set itself
+			if !signedBy(keys, sigs, map[uint16]*dns.DNSKEY{k.KeyTag(): k}, now) {
+				continue
+			}
+
+			log.Warn("Root trust anchor revoked", "keytag", a.key.KeyTag())
+
+			a.state, a.since = anchorRevoked, now
+			seen[a] = true
+			changed = true
+
+			continue
+		}
+
+		a := t.find(k)
+		if a == nil {
+			log.Info("New root trust anchor seen, add hold-down started", "keytag", k.KeyTag())
+
+			a = &trustAnchor{key: dns.Copy(k).(*dns.DNSKEY), state: anchorAddPend, since: now}
+			t.anchors = append(t.anchors, a)
+			seen[a] = true
+			changed = true
+
+			continue
+		}
+
+		seen[a] = true
+
+		switch a.state {
+		case anchorAddPend:
+			if now.Sub(a.since) >= anchorHoldDown {
+				log.Info("Root trust anchor add hold-down passed, key trusted", "keytag", a.key.KeyTag())
+
+				a.state, a.since = anchorValid, now
+				changed = true
+			}
+		case anchorMissing:
+			a.state, a.since = anchorValid, now
+			changed = true
+		}
+	}
+
+	anchors := t.anchors[:0]
+	for _, a := range t.anchors {
+		switch {
+		case a.state == anchorAddPend && !seen[a]:
+			// back to the start state
+			changed = true
+			continue
+		case a.state == anchorValid && !seen[a]:
+			a.state, a.since = anchorMissing, now
+			changed = true
+		case a.state == anchorRevoked && now.Sub(a.since) >= anchorHoldDown:
+			// removed after the remove hold-down
+			changed = true
+			continue
+		}
+
+		anchors = append(anchors, a)
+	}
+
+	t.anchors = anchors
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, t.save()
+}
+
+// find returns the anchor of the key, the revoke flag ignored
+func (t *trustAnchors) find(k *dns.DNSKEY) *trustAnchor {
+	for _, a := range t.anchors {
+		if a.key.Algorithm == k.Algorithm && a.key.Protocol == k.Protocol &&
+			a.key.PublicKey == k.PublicKey && a.key.Flags&^dns.REVOKE == k.Flags&^dns.REVOKE {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// save writes the anchors to the file over a temporary file
+func (t *trustAnchors) save() error {
+	var f anchorFile
+	for _, a := range t.anchors {
+		f.Keys = append(f.Keys, anchorEntry{Key: a.key.String(), State: a.state, Since: a.since})
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(t.path), "."+filepath.Base(t.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, t.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// apply sets the trusted anchors as the root keys
+func (t *trustAnchors) apply() {
+	t.mu.Lock()
+	keys := t.trusted()
+	t.mu.Unlock()
+
+	rootkeysMu.Lock()
+	rootkeys = keys
+	rootkeysMu.Unlock()
+}
+
+// signedBy reports whether the key set signed by one of the keys
+func signedBy(keys, sigs []dns.RR, signers map[uint16]*dns.DNSKEY, now time.Time) bool {
+	for _, rr := range sigs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != dns.TypeDNSKEY {
+			continue
+		}
+
+		k, ok := signers[sig.KeyTag]
+		if !ok {
+			continue
+		}
+
+		if sig.Verify(k, keys) == nil && sig.ValidityPeriod(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anchorRefresh returns the active refresh interval (RFC 5011 section 2.3)
+func anchorRefresh(msg *dns.Msg, now time.Time) time.Duration {
+	refresh := anchorMaxRefresh
+
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.DNSKEY:
+			if d := time.Duration(v.Hdr.Ttl) * time.Second / 2; d < refresh {
+				refresh = d
+			}
+		case *dns.RRSIG:
+			if v.TypeCovered != dns.TypeDNSKEY {
+				continue
+			}
+
+			if d := time.Unix(int64(v.Expiration), 0).Sub(now) / 2; d < refresh {
+				refresh = d
+			}
+		}
+	}
+
+	if refresh < anchorMinRefresh {
+		refresh = anchorMinRefresh
+	}
+
+	return refresh
+}
+
+// runTrustAnchors refreshes the root trust anchors in the background
+func runTrustAnchors(r *Resolver, path string) {
+	rootkeysMu.RLock()
+	keys := rootkeys
+	rootkeysMu.RUnlock()
+
+	t, err := newTrustAnchors(path, keys)
+	if err != nil {
+		log.Error("Trust anchors load failed, using the root keys", "path", path, "error", err.Error())
+		return
+	}
+
+	anchorsManagedMu.Lock()
+	anchorsManaged = true
+	anchorsManagedMu.Unlock()
+
+	t.apply()
+
+	log.Info("Trust anchors loaded", "path", path, "keys", len(t.trusted()))
+
+	for {
+		wait := anchorRetry
+
+		req := new(dns.Msg)
+		req.SetQuestion(rootzone, dns.TypeDNSKEY)
+		req.SetEdns0(DefaultMsgSize, true)
+
+		msg, err := r.lookup("tcp", req, rootservers)
+		if err == nil {
+			var changed bool
+			if changed, err = t.update(msg, time.Now()); err == nil {
+				if changed {
+					t.apply()
+					log.Info("Trust anchors updated", "path", path, "keys", len(t.trusted()))
+				}
+
+				wait = anchorRefresh(msg, time.Now())
+			}
+		}
+
+		if err != nil {
+			log.Warn("Trust anchors refresh failed", "error", err.Error())
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+// managedAnchors reports whether the root keys of the config ignored
+func managedAnchors() bool {
+	anchorsManagedMu.RLock()
+	defer anchorsManagedMu.RUnlock()
+
+	return anchorsManaged
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeRootKey(t *testing.T) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: rootzone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 172800},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	assert.NoError(t, err)
+
+	return key, priv.(crypto.Signer)
+}
+
+func makeRootKeySet(t *testing.T, now time.Time, keys []*dns.DNSKEY, signers map[*dns.DNSKEY]crypto.Signer) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(rootzone, dns.TypeDNSKEY)
+
+	var set []dns.RR
+	for _, k := range keys {
+		set = append(set, k)
+	}
+
+	msg.Answer = append(msg.Answer, set...)
+
+	for k, priv := range signers {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: rootzone, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 172800},
+			KeyTag:     k.KeyTag(),
+			SignerName: rootzone,
+			Algorithm:  k.Algorithm,
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(10 * 24 * time.Hour).Unix()),
+		}
+		assert.NoError(t, sig.Sign(priv, set))
+
+		msg.Answer = append(msg.Answer, sig)
+	}
+
+	return msg
+}
+
+func Test_trustAnchors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdns_anchors")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "root.anchors")
+
+	k1, p1 := makeRootKey(t)
+	k2, p2 := makeRootKey(t)
+
+	zsk, _ := dns.NewRR(". 172800 IN DNSKEY 256 3 8 AwEAAdp440E6Mz7c+Vl4sPd0lTv2Qnc85dTW64j0RDD7sS/zwxWDJ3QRES2VKDO0OXLMqVJSs2YCCSDKuZXpDPuf++YfAu0j7lzYYdWTGwyNZhEaXtMQJIKYB96pW6cRkiG2Dn8S2vvo/PxW9PKQsyLbtd8PcwWglHgReBVp7kEv/Dd+3b3YMukt4jnWgDUddAySg558Zld+c9eGWkgWoOiuhg4rQRkFstMX1pRyOSHcZuH38o1WcsT4y3eT0U/SR6TOSLIB/8Ftirux/h297oS7tCcwSPt0wwry5OFNTlfMo8v7WGurogfk8hPipf7TTKHIi20LWen5RCsvYsQBkYGpF78=")
+
+	ta, err := newTrustAnchors(path, []dns.RR{k1, zsk})
+	assert.NoError(t, err)
+	assert.Len(t, ta.trusted(), 1)
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	now := time.Now()
+
+	// new key in add hold-down
+	msg := makeRootKeySet(t, now, []*dns.DNSKEY{k1, k2}, map[*dns.DNSKEY]crypto.Signer{k1: p1})
+	changed, err := ta.update(msg, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, ta.trusted(), 1)
+
+	changed, err = ta.update(msg, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	now = now.Add(anchorHoldDown)
+
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{k1, k2}, map[*dns.DNSKEY]crypto.Signer{k1: p1})
+	changed, err = ta.update(msg, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, ta.trusted(), 2)
+
+	// revoked key signs the set itself
+	revoked := dns.Copy(k1).(*dns.DNSKEY)
+	revoked.Flags |= dns.REVOKE
+
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{revoked, k2}, map[*dns.DNSKEY]crypto.Signer{revoked: p1, k2: p2})
+	changed, err = ta.update(msg, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, ta.trusted(), 1)
+	assert.Equal(t, anchorRevoked, ta.find(k1).state)
+
+	now = now.Add(anchorHoldDown)
+
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{k2}, map[*dns.DNSKEY]crypto.Signer{k2: p2})
+	changed, err = ta.update(msg, now)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Nil(t, ta.find(k1))
+
+	// the persisted state loaded, the root keys ignored
+	ta, err = newTrustAnchors(path, []dns.RR{k1})
+	assert.NoError(t, err)
+	assert.Len(t, ta.trusted(), 1)
+	assert.Equal(t, k2.PublicKey, ta.trusted()[0].(*dns.DNSKEY).PublicKey)
+
+	// not signed by a trust anchor
+	k3, p3 := makeRootKey(t)
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{k3}, map[*dns.DNSKEY]crypto.Signer{k3: p3})
+	_, err = ta.update(msg, now)
+	assert.Equal(t, errAnchorNotValidated, err)
+
+	// missing key still trusted
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{k2, k3}, map[*dns.DNSKEY]crypto.Signer{k2: p2})
+	_, err = ta.update(msg, now)
+	assert.NoError(t, err)
+
+	msg = makeRootKeySet(t, now, []*dns.DNSKEY{k3}, map[*dns.DNSKEY]crypto.Signer{k2: p2, k3: p3})
+	_, err = ta.update(msg, now)
+	assert.NoError(t, err)
+	assert.Equal(t, anchorMissing, ta.find(k2).state)
+	assert.Len(t, ta.trusted(), 1)
+
+	assert.Equal(t, 24*time.Hour, anchorRefresh(msg, now))
+
+	msg.Answer[0].Header().Ttl = 60
+	assert.Equal(t, anchorMinRefresh, anchorRefresh(msg, now))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = newTrustAnchors(path, nil)
+	assert.Error(t, err)
+}
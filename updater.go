@@ -3,19 +3,22 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
 )
 
-var timesSeen = make(map[string]int)
 var whitelist = make(map[string]bool)
 
 func updateBlocklists(path string) error {
@@ -25,12 +28,16 @@ func updateBlocklists(path string) error {
 		}
 	}
 
-	for _, entry := range Config.Whitelist {
+	for _, entry := range Config().Whitelist {
 		whitelist[dns.Fqdn(entry)] = true
 	}
 
-	for _, entry := range Config.Blocklist {
-		BlockList.Set(dns.Fqdn(entry))
+	for _, entry := range Config().Blocklist {
+		BlockList.SetManual(dns.Fqdn(entry))
+	}
+
+	for _, entry := range Config().AllowList {
+		BlockList.Allow(dns.Fqdn(entry))
 	}
 
 	fetchBlocklist(path)
@@ -38,43 +45,147 @@ func updateBlocklists(path string) error {
 	return nil
 }
 
-func downloadBlocklist(uri, path, name string) error {
+// blocklistExt is the extension of the downloaded blocklist files
+const blocklistExt = ".remote"
+
+// blocklistETags keeps the etags of the downloaded blocklists, the file
+// modification times used when missing
+var blocklistETags = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// The retry delays of the failed blocklist downloads, the delay doubled on
+// every failure up to the maximum
+var (
+	blocklistRetryMin = 30 * time.Second
+	blocklistRetryMax = time.Hour
+)
+
+// blocklistState is the download state of a remote blocklist
+type blocklistState struct {
+	LastSuccess time.Time
+	LastAttempt time.Time
+	Failures    int
+	Error       string
+	NextRetry   time.Time
+
+	retry *time.Timer
+}
+
+// blocklistStates keeps the download states of the remote blocklists
+var blocklistStates = struct {
+	sync.Mutex
+	m map[string]*blocklistState
+}{m: make(map[string]*blocklistState)}
+
+// blocklistLoadMu serializes the blocklist loads of the refreshes and the retries
+var blocklistLoadMu sync.Mutex
+
+// blocklistFile returns the file name of a remote blocklist, stable across
+// the refreshes
+func blocklistFile(uri string) string {
+	h := fnv.New32a()
+	h.Write([]byte(uri))
+
+	host := "blocklist"
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	return fmt.Sprintf("%s.%08x%s", host, h.Sum32(), blocklistExt)
+}
+
+// downloadBlocklist downloads the blocklist with a conditional request, an
+// unchanged, failed or unreadable download keeps the existing file
+func downloadBlocklist(uri, path, name string) (bool, error) {
 	filePath := filepath.FromSlash(fmt.Sprintf("%s/%s", path, name))
 
-	output, err := os.Create(filePath)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
 	if err != nil {
-		return fmt.Errorf("error creating file: %s", err)
+		return false, fmt.Errorf("error creating request: %s", err)
+	}
+
+	if fi, err := os.Stat(filePath); err == nil {
+		blocklistETags.Lock()
+		etag := blocklistETags.m[uri]
+		blocklistETags.Unlock()
+
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		req.Header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
 	}
-	defer output.Close()
 
-	response, err := http.Get(uri)
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("error downloading source: %s", err)
+		return false, fmt.Errorf("error downloading source: %s", err)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("error downloading source: %s", response.Status)
+	}
+
+	output, err := ioutil.TempFile(path, name+".part")
+	if err != nil {
+		return false, fmt.Errorf("error creating file: %s", err)
+	}
+
 	if _, err := io.Copy(output, response.Body); err != nil {
-		return fmt.Errorf("error copying output: %s", err)
+		output.Close()
+		os.Remove(output.Name())
+		return false, fmt.Errorf("error copying output: %s", err)
 	}
 
-	return nil
+	output.Close()
+
+	// the download scanned before replacing the last good copy, the
+	// archives decompressed
+	if err := verifyBlocklist(output.Name()); err != nil {
+		os.Remove(output.Name())
+		return false, err
+	}
+
+	if err := os.Rename(output.Name(), filePath); err != nil {
+		os.Remove(output.Name())
+		return false, fmt.Errorf("error renaming file: %s", err)
+	}
+
+	if modified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(filePath, modified, modified)
+	}
+
+	blocklistETags.Lock()
+	blocklistETags.m[uri] = response.Header.Get("ETag")
+	blocklistETags.Unlock()
+
+	return true, nil
 }
 
 func fetchBlocklist(path string) {
 	var wg sync.WaitGroup
 
-	for _, uri := range Config.BlockLists {
+	files := make(map[string]bool)
+
+	for _, source := range blocklistSources() {
 		wg.Add(1)
 
-		u, _ := url.Parse(uri)
-		host := u.Host
-		timesSeen[host] = timesSeen[host] + 1
-		fileName := fmt.Sprintf("%s.%d.tmp", host, timesSeen[host])
+		uri := source.URL
+		fileName := blocklistFile(uri)
+		files[fileName] = true
 
 		go func(uri string, name string) {
 			log.Info("Fetching blacklist", "uri", uri)
-			if err := downloadBlocklist(uri, path, name); err != nil {
+			if changed, err := fetchSource(uri, path, name); err != nil {
 				log.Error("Fetching blacklist", "uri", uri, "error", err.Error())
+			} else if !changed {
+				log.Info("Blacklist not modified", "uri", uri)
 			}
 
 			wg.Done()
@@ -82,9 +193,124 @@ func fetchBlocklist(path string) {
 	}
 
 	wg.Wait()
+
+	// the retries of the lists removed from the config
+	blocklistStates.Lock()
+	for uri, state := range blocklistStates.m {
+		if !files[blocklistFile(uri)] {
+			if state.retry != nil {
+				state.retry.Stop()
+			}
+			delete(blocklistStates.m, uri)
+		}
+	}
+	blocklistStates.Unlock()
+
+	// the lists removed from the config
+	old, _ := filepath.Glob(filepath.Join(path, "*"+blocklistExt))
+	for _, file := range old {
+		if !files[filepath.Base(file)] {
+			os.Remove(file)
+		}
+	}
+}
+
+// fetchSource downloads the blocklist and records the result, a failed
+// download retried in the background with backoff while the last good copy
+// of the list served
+func fetchSource(uri, path, name string) (bool, error) {
+	changed, err := downloadBlocklist(uri, path, name)
+
+	blocklistStates.Lock()
+	defer blocklistStates.Unlock()
+
+	state, ok := blocklistStates.m[uri]
+	if !ok {
+		state = &blocklistState{}
+		blocklistStates.m[uri] = state
+	}
+
+	now := time.Now()
+	state.LastAttempt = now
+
+	if state.retry != nil {
+		state.retry.Stop()
+		state.retry = nil
+	}
+
+	if err == nil {
+		state.LastSuccess = now
+		state.Failures = 0
+		state.Error = ""
+		state.NextRetry = time.Time{}
+
+		return changed, nil
+	}
+
+	state.Failures++
+	state.Error = err.Error()
+
+	delay := blocklistRetryDelay(state.Failures)
+	state.NextRetry = now.Add(delay)
+	state.retry = time.AfterFunc(delay, func() {
+		retryBlocklist(uri, path, name)
+	})
+
+	return false, err
+}
+
+// retryBlocklist downloads the failed blocklist again, the lists reloaded
+// when the download changed
+func retryBlocklist(uri, path, name string) {
+	log.Info("Retrying blacklist", "uri", uri)
+
+	changed, err := fetchSource(uri, path, name)
+	if err != nil {
+		log.Error("Fetching blacklist", "uri", uri, "error", err.Error())
+		return
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := readBlocklists(path); err != nil {
+		log.Error("Read blocklists failed, keeping the old list", "dir", path, "error", err.Error())
+	}
 }
 
+// blocklistRetryDelay returns the delay of the retry after the failures
+func blocklistRetryDelay(failures int) time.Duration {
+	delay := blocklistRetryMin
+	for i := 1; i < failures && delay < blocklistRetryMax; i++ {
+		delay *= 2
+	}
+
+	if delay > blocklistRetryMax {
+		delay = blocklistRetryMax
+	}
+
+	return delay
+}
+
+// blocklistSourceState returns a copy of the download state of the blocklist
+func blocklistSourceState(uri string) blocklistState {
+	blocklistStates.Lock()
+	defer blocklistStates.Unlock()
+
+	if state, ok := blocklistStates.m[uri]; ok {
+		return *state
+	}
+
+	return blocklistState{}
+}
+
+// readBlocklists loads the blocklists into a new list, the current list
+// replaced only when all the files read
 func readBlocklists(dir string) error {
+	blocklistLoadMu.Lock()
+	defer blocklistLoadMu.Unlock()
+
 	log.Info("Loading blocked domains", "dir", dir)
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -92,20 +318,74 @@ func readBlocklists(dir string) error {
 		return nil
 	}
 
-	err := filepath.Walk(dir, func(path string, f os.FileInfo, _ error) error {
+	list := cache.NewBlockCache()
+	limit := Config().BlockListMaxEntries
+
+	sources := make(map[string]blocklistSource)
+	for _, source := range blocklistSources() {
+		sources[blocklistFile(source.URL)] = source
+	}
+
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
 		if !f.IsDir() {
-			file, err := os.Open(filepath.FromSlash(path))
+			// partial downloads
+			if strings.Contains(filepath.Base(path), blocklistExt+".part") {
+				return nil
+			}
+
+			source, ok := sources[filepath.Base(path)]
+			if !ok {
+				source = blocklistSource{URL: path, Format: blocklistHosts}
+			}
+
+			before := list.Size()
+			if limit > 0 && before >= limit {
+				log.Warn("Blocklist entry limit reached, list skipped", "source", source.URL, "limit", limit)
+				return nil
+			}
+
+			file, archived, err := openBlocklist(path)
+			if err == nil && archived {
+				// the malformed archives skipped before adding any entry
+				if err = verifyBlocklist(path); err != nil {
+					file.Close()
+				}
+			}
+
 			if err != nil {
-				return fmt.Errorf("error opening file: %s", err)
+				if archived {
+					log.Warn("Blocklist archive malformed, skipping...", "source", source.URL, "error", err.Error())
+					return nil
+				}
+
+				return err
 			}
 
-			if err = parseHostFile(file); err != nil {
+			list.SetSource(source.URL)
+			if err := list.SetCategory(source.Category); err != nil {
+				file.Close()
+				return err
+			}
+
+			entries, err := parseHostFile(file, source.Format, list, limit)
+			if err != nil {
 				file.Close()
 				return fmt.Errorf("error parsing hostfile %s", err)
 			}
 
 			file.Close()
 
+			log.Info("Blocklist loaded", "source", source.URL, "format", source.Format, "entries", entries,
+				"unique", list.Size()-before)
+
+			if limit > 0 && list.Size() >= limit {
+				log.Warn("Blocklist entry limit reached, remaining entries skipped", "source", source.URL, "limit", limit)
+			}
+
 			if filepath.Ext(path) == ".tmp" {
 				os.Remove(filepath.FromSlash(path))
 			}
@@ -118,12 +398,120 @@ func readBlocklists(dir string) error {
 		return fmt.Errorf("error walking location %s", err)
 	}
 
-	log.Info("Blocked domains loaded", "total", BlockList.Length())
+	added, removed := BlockList.Replace(list)
+
+	log.Info("Blocked domains loaded", "total", BlockList.Length(),
+		"wildcards", BlockList.WildcardLength(), "regexps", BlockList.RegexpLength(),
+		"added", added, "removed", removed)
 
 	return nil
 }
 
-func parseHostFile(file *os.File) error {
+func readAllowlists(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	log.Info("Loading allowed domains", "dir", dir)
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		log.Warn("Path not found, skipping...", "path", dir)
+		return nil
+	}
+
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, _ error) error {
+		if !f.IsDir() {
+			file, err := os.Open(filepath.FromSlash(path))
+			if err != nil {
+				return fmt.Errorf("error opening file: %s", err)
+			}
+
+			if err = scanHostFile(file, allowEntry); err != nil {
+				file.Close()
+				return fmt.Errorf("error parsing allowlist %s", err)
+			}
+
+			file.Close()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("error walking location %s", err)
+	}
+
+	log.Info("Allowed domains loaded", "total", BlockList.AllowLength())
+
+	return nil
+}
+
+// parseHostFile sets the entries of the list format until the list size
+// reaches the limit, zero for no limit. Returns the entries count of the file.
+func parseHostFile(file io.Reader, format string, list *cache.BlockCache, limit int) (int, error) {
+	entries := 0
+
+	err := scanBlocklist(file, format, func(name string, zone bool) {
+		if limit > 0 && list.Size() >= limit {
+			return
+		}
+
+		entries++
+
+		if zone {
+			name = strings.ToLower(name)
+			if !whitelist[name] {
+				list.Set(name)
+				list.SetWildcard(name)
+			}
+			return
+		}
+
+		if pattern, ok := regexpEntry(name); ok {
+			if err := list.SetRegexp(pattern); err != nil {
+				log.Warn("Blocklist regexp invalid, skipping...", "regexp", pattern, "error", err.Error())
+			}
+			return
+		}
+
+		if strings.HasPrefix(name, "*.") {
+			if name = name[2:]; !whitelist[name] {
+				list.SetWildcard(name)
+			}
+			return
+		}
+
+		if !whitelist[name] {
+			list.Set(name)
+		}
+	})
+
+	return entries, err
+}
+
+// allowEntry sets an allow entry, the allow entries cover the subdomains so
+// the wildcard prefix dropped and the regexps are not supported
+func allowEntry(name string) {
+	if pattern, ok := regexpEntry(name); ok {
+		log.Warn("Allowlist regexp not supported, skipping...", "regexp", pattern)
+		return
+	}
+
+	BlockList.Allow(strings.TrimPrefix(name, "*."))
+}
+
+// regexpEntry returns the pattern of a /.../ line
+func regexpEntry(line string) (string, bool) {
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return line[1 : len(line)-1], true
+	}
+
+	return "", false
+}
+
+// scanHostFile calls fn with every domain found in a hosts-file or domain
+// list, the regexp lines passed as they are
+func scanHostFile(file io.Reader, fn func(name string)) error {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -131,6 +519,11 @@ func parseHostFile(file *os.File) error {
 		isComment := strings.HasPrefix(line, "#")
 
 		if !isComment && line != "" {
+			if _, ok := regexpEntry(line); ok {
+				fn(line)
+				continue
+			}
+
 			fields := strings.Fields(line)
 
 			if len(fields) > 1 && !strings.HasPrefix(fields[1], "#") {
@@ -139,11 +532,7 @@ func parseHostFile(file *os.File) error {
 				line = fields[0]
 			}
 
-			line = dns.Fqdn(line)
-
-			if !BlockList.Exists(line) && !whitelist[line] {
-				BlockList.Set(line)
-			}
+			fn(dns.Fqdn(line))
 		}
 	}
 
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/log"
+	"github.com/semihalev/sdns/cache"
+	"github.com/semihalev/sdns/metrics"
+)
+
+const (
+	// DefaultUpstreamMaxConns is the idle connections kept per tcp and tls upstream
+	DefaultUpstreamMaxConns = 4
+
+	// DefaultUpstreamIdleTimeout is how long an idle upstream connection reused
+	DefaultUpstreamIdleTimeout = 10 * time.Second
+
+	// DefaultUpstreamUDPSize is the edns0 buffer size advertised to the upstreams,
+	// safe from the ip fragmentation (DNS flag day 2020)
+	DefaultUpstreamUDPSize = 1232
+
+	// maxUpstreamUDPSize is the ethernet mtu less the ipv6 and udp headers, the
+	// larger answers fragmented on the most links
+	maxUpstreamUDPSize = 1452
+)
+
+var (
+	errPinMismatch = errors.New("upstream certificate public key not pinned")
+	errHTTPStatus  = errors.New("upstream https answered with error status")
+	errHTTPSize    = errors.New("upstream https answer too large")
+)
+
+// upstreamTimeouts returns the query and the connect timeouts of the network,
+// udp, tcp, tcp-tls or https. The global timeouts used for the unset ones.
+func upstreamTimeouts(network string) (query, connect time.Duration) {
+	cfg := Config()
+
+	var q, c duration
+	switch network {
+	case "udp":
+		q, c = cfg.UDPTimeout, cfg.UDPConnectTimeout
+	case "tcp":
+		q, c = cfg.TCPTimeout, cfg.TCPConnectTimeout
+	case "tcp-tls":
+		q, c = cfg.TLSTimeout, cfg.TLSConnectTimeout
+	case "https":
+		q, c = cfg.DOHTimeout, cfg.DOHConnectTimeout
+	}
+
+	query, connect = cfg.Timeout.Duration, cfg.ConnectTimeout.Duration
+
+	if q.Duration > 0 {
+		query = q.Duration
+	}
+
+	if c.Duration > 0 {
+		connect = c.Duration
+	}
+
+	return query, connect
+}
+
+// upstreamRequest returns the request with the edns0 buffer size advertised to
+// the upstreams, the request copied if the size differs. The other edns0 flags
+// like the DO bit kept.
+func upstreamRequest(req *dns.Msg) *dns.Msg {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return req
+	}
+
+	size := uint16(Config().UpstreamUDPSize)
+	if size == 0 {
+		size = DefaultUpstreamUDPSize
+	}
+
+	if opt.UDPSize() == size {
+		return req
+	}
+
+	req = req.Copy()
+	req.IsEdns0().SetUDPSize(size)
+
+	return req
+}
+
+type poolConn struct {
+	*dns.Conn
+
+	// raw is the tcp connection under the tls
+	raw net.Conn
+
+	used time.Time
+	idle time.Duration
+}
+
+// upstreamPool keeps the tcp and tls connections of the upstreams by the
+// server address and the http clients of the https upstreams
+type upstreamPool struct {
+	mu sync.Mutex
+
+	conns   map[string][]*poolConn
+	clients map[string]*http.Client
+}
+
+var upstreams = &upstreamPool{
+	conns:   make(map[string][]*poolConn),
+	clients: make(map[string]*http.Client),
+}
+
+// upstreamTLSConfig verifies the server name of the certificate, or only the
+// public key when the pins given
+func upstreamTLSConfig(server *cache.AuthServer) *tls.Config {
+	cfg := &tls.Config{ServerName: server.ServerName}
+
+	if len(server.Pins) == 0 {
+		return cfg
+	}
+
+	pins := server.Pins
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errPinMismatch
+		}
+
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		spki := base64.StdEncoding.EncodeToString(sum[:])
+
+		for _, pin := range pins {
+			if spki == pin {
+				return nil
+			}
+		}
+
+		pinMismatch(server, spki)
+
+		return errPinMismatch
+	}
+
+	return cfg
+}
+
+// pinMismatch logs the certificate of the server not pinned, possibly an
+// interception. The server taken out of rotation until the health checks
+// pass again, the health checks verify the pins too.
+func pinMismatch(server *cache.AuthServer, spki string) {
+	metrics.PinMismatches.WithLabelValues(upstreamLabel(server.Host)).Inc()
+
+	log.Warn("Upstream certificate pin mismatch, possible interception", "server", server.Host, "addr", server.Addr, "spki", "sha256/"+spki)
+
+	if interval := Config().HealthCheckInterval.Duration; interval > 0 {
+		server.RecordCheck(false, 0, interval, 1)
+	}
+}
+
+// poolKey returns the pool key of the server, the connections verified with
+// the other pins not shared
+func poolKey(server *cache.AuthServer) string {
+	if len(server.Pins) == 0 {
+		return server.Host
+	}
+
+	return server.Host + "|pin=" + strings.Join(server.Pins, "|pin=")
+}
+
+// get returns an idle connection of the server, nil if none
+func (p *upstreamPool) get(server *cache.AuthServer) *poolConn {
+	key := poolKey(server)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for list := p.conns[key]; len(list) > 0; list = p.conns[key] {
+		conn := list[len(list)-1]
+		p.conns[key] = list[:len(list)-1]
+
+		if time.Since(conn.used) < conn.idle {
+			return conn
+		}
+
+		conn.Close()
+	}
+
+	return nil
+}
+
+// put keeps the connection for the reuse until the idle timeout, the server
+// offered keepalive timeout used when lower (RFC 7828)
+func (p *upstreamPool) put(server *cache.AuthServer, conn *poolConn, resp *dns.Msg) {
+	conn.idle = Config().UpstreamIdleTimeout.Duration
+
+	if timeout, ok := tcpKeepalive(resp); ok && timeout < conn.idle {
+		conn.idle = timeout
+	}
+
+	key := poolKey(server)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn.idle <= 0 || len(p.conns[key]) >= Config().UpstreamMaxConns {
+		conn.Close()
+		return
+	}
+
+	conn.used = time.Now()
+	p.conns[key] = append(p.conns[key], conn)
+}
+
+func dialTLS(server *cache.AuthServer, timeout time.Duration) (*poolConn, error) {
+	dialer := setFastOpen(&net.Dialer{Timeout: timeout})
+
+	raw, err := bootstrap.dial(context.Background(), dialer, "tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, upstreamTLSConfig(server))
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &poolConn{Conn: &dns.Conn{Conn: conn}, raw: raw}, nil
+}
+
+// dialTCP dials the plain server with the dialer of the client, the outbound
+// address of the client kept
+func dialTCP(c *dns.Client, server *cache.AuthServer, timeout time.Duration) (*poolConn, error) {
+	dialer := &net.Dialer{}
+	if c.Dialer != nil {
+		*dialer = *c.Dialer
+	}
+
+	// the client may be switched from udp
+	dialer.Timeout = timeout
+	setFastOpen(dialer)
+
+	conn, err := dialer.Dial("tcp", server.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &poolConn{Conn: &dns.Conn{Conn: conn}, raw: conn}, nil
+}
+
+// tcpKeepalive returns the idle timeout of the edns-tcp-keepalive option of
+// the response, false when the server not offered it
+func tcpKeepalive(resp *dns.Msg) (time.Duration, bool) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	// the option unpacked as local option, the timeout in units of 100 milliseconds
+	for _, o := range opt.Option {
+		if ka, ok := o.(*dns.EDNS0_LOCAL); ok && ka.Code == dns.EDNS0TCPKEEPALIVE && len(ka.Data) == 2 {
+			return time.Duration(binary.BigEndian.Uint16(ka.Data)) * 100 * time.Millisecond, true
+		}
+	}
+
+	return 0, false
+}
+
+// keepaliveRequest returns the copy of the request asked for the
+// edns-tcp-keepalive timeout, the requests without edns0 left as is
+func keepaliveRequest(req *dns.Msg) *dns.Msg {
+	if req.IsEdns0() == nil {
+		return req
+	}
+
+	m := req.Copy()
+
+	opt := m.IsEdns0()
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return m
+		}
+	}
+
+	// the keepalive option of the dns package packs its header twice, the
+	// clients send the option without the timeout
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+
+	return m
+}
+
+func (p *upstreamPool) client(server *cache.AuthServer) *http.Client {
+	key := poolKey(server)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c, ok := p.clients[key]; ok {
+		return c
+	}
+
+	timeout, connect := upstreamTimeouts("https")
+
+	dialer := setFastOpen(&net.Dialer{Timeout: connect})
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return bootstrap.dial(ctx, dialer, network, addr)
+			},
+			TLSClientConfig:     upstreamTLSConfig(server),
+			TLSHandshakeTimeout: connect,
+			MaxIdleConnsPerHost: Config().UpstreamMaxConns,
+			IdleConnTimeout:     Config().UpstreamIdleTimeout.Duration,
+		},
+		Timeout: timeout,
+	}
+
+	p.clients[key] = c
+
+	return c
+}
+
+// exchangeUpstream sends the request with the protocol of the server, the
+// client used for the plain servers
+func exchangeUpstream(c *dns.Client, req *dns.Msg, server *cache.AuthServer) (*dns.Msg, time.Duration, error) {
+	switch server.Protocol {
+	case cache.ProtocolTLS:
+		return exchangeTLS(server, req)
+	case cache.ProtocolHTTPS:
+		return exchangeHTTPS(server, req)
+	}
+
+	if c.Net == "tcp" {
+		return exchangeTCP(c, server, req)
+	}
+
+	return c.Exchange(req, server.Host)
+}
+
+// exchangeTLS sends the request over a pooled tls connection
+func exchangeTLS(server *cache.AuthServer, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	timeout, connect := upstreamTimeouts("tcp-tls")
+
+	return exchangePooled(server, req, timeout, func() (*poolConn, error) {
+		return dialTLS(server, connect)
+	})
+}
+
+// exchangeTCP sends the request over a pooled tcp connection of the plain server
+func exchangeTCP(c *dns.Client, server *cache.AuthServer, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	timeout, connect := upstreamTimeouts("tcp")
+
+	return exchangePooled(server, req, timeout, func() (*poolConn, error) {
+		return dialTCP(c, server, connect)
+	})
+}
+
+// exchangePooled sends the request over an idle connection of the server or a
+// dialed one, the connection closed by the server retried once with a new one
+func exchangePooled(server *cache.AuthServer, req *dns.Msg, timeout time.Duration, dial func() (*poolConn, error)) (resp *dns.Msg, rtt time.Duration, err error) {
+	m := keepaliveRequest(req)
+
+	for i := 0; i < 2; i++ {
+		var conn *poolConn
+		if i == 0 {
+			conn = upstreams.get(server)
+		}
+
+		dialed := conn == nil
+		if dialed {
+			if conn, err = dial(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		start := time.Now()
+
+		conn.SetDeadline(start.Add(timeout))
+
+		if err = conn.WriteMsg(m); err == nil {
+			resp, err = conn.ReadMsg()
+		}
+
+		rtt = time.Since(start)
+
+		if err == nil && resp.Id != req.Id {
+			err = dns.ErrId
+		}
+
+		if err != nil {
+			conn.Close()
+
+			// stale pooled connections fail fast, timeouts are not retried
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, rtt, err
+			}
+
+			continue
+		}
+
+		conn.SetDeadline(time.Time{})
+
+		if dialed {
+			countFastOpen(conn.raw)
+		}
+
+		upstreams.put(server, conn, resp)
+
+		return resp, rtt, nil
+	}
+
+	return nil, rtt, err
+}
+
+// exchangeHTTPS posts the request to the https upstream (RFC 8484)
+func exchangeHTTPS(server *cache.AuthServer, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	id := req.Id
+
+	// the id should be zero for the http caches
+	m := req.Copy()
+	m.Id = 0
+
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, server.Addr, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hreq.Header.Set("Content-Type", "application/dns-message")
+	hreq.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+
+	hresp, err := upstreams.client(server).Do(hreq)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer hresp.Body.Close()
+
+	// a byte over the message size read to tell the larger bodies apart
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize+1))
+
+	rtt := time.Since(start)
+
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	if hresp.StatusCode != http.StatusOK {
+		return nil, rtt, errHTTPStatus
+	}
+
+	if len(body) > dns.MaxMsgSize {
+		return nil, rtt, errHTTPSize
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+
+	resp.Id = id
+
+	return resp, rtt, nil
+}
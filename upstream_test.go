@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/semihalev/sdns/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func upstreamReply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+
+	return m
+}
+
+func certificatePin(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func Test_exchangeTLS(t *testing.T) {
+	// borrow the self signed certificate of the test http server
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := hs.TLS.Certificates[0]
+	cert.Leaf = hs.Certificate()
+	hs.Close()
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(upstreamReply(req))
+	})
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: mux}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	addr := ln.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// self signed certificate not trusted by the hostname
+	server := cache.NewAuthServer("tls://" + addr)
+	_, _, err = exchangeTLS(server, req)
+	assert.Error(t, err)
+
+	server = cache.NewAuthServer("tls://127.0.0.1:" + port + "?pin=" + certificatePin(cert))
+	for i := 0; i < 3; i++ {
+		resp, _, err := exchangeTLS(server, req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, req.Id, resp.Id)
+	}
+
+	upstreams.mu.Lock()
+	assert.Len(t, upstreams.conns[poolKey(server)], 1)
+	upstreams.mu.Unlock()
+
+	server = cache.NewAuthServer("tls://" + addr + "?pin=AAAA")
+	_, _, err = exchangeTLS(server, req)
+	assert.Error(t, err)
+}
+
+func Test_exchangeTLSPins(t *testing.T) {
+	hs := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := hs.TLS.Certificates[0]
+	cert.Leaf = hs.Certificate()
+	hs.Close()
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(upstreamReply(req))
+	})
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: mux}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	addr := ln.Addr().String()
+	other := "sha256/" + strings.Repeat("A", 43) + "="
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// the rotated pin matches
+	server, err := cache.ParseAuthServer("tls://" + addr + "|pin=" + other + "|pin=sha256/" + certificatePin(cert))
+	assert.NoError(t, err)
+
+	resp, _, err := exchangeTLS(server, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, resp.Answer, 1)
+
+	defer setConfig(func(cfg *config) { cfg.HealthCheckInterval.Duration = time.Minute })()
+
+	// the mismatch refused, the server out of rotation
+	server, err = cache.ParseAuthServer("tls://" + addr + "|pin=" + other)
+	assert.NoError(t, err)
+
+	_, _, err = exchangeTLS(server, req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), errPinMismatch.Error())
+	assert.False(t, server.Healthy())
+}
+
+func Test_exchangeHTTPS(t *testing.T) {
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(make([]byte, dns.MaxMsgSize+512))
+			return
+		}
+
+		buf, _ := ioutil.ReadAll(r.Body)
+
+		req := new(dns.Msg)
+		if r.Header.Get("Content-Type") != "application/dns-message" || req.Unpack(buf) != nil || req.Id != 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		packed, _ := upstreamReply(req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	defer hs.Close()
+
+	cert := hs.TLS.Certificates[0]
+	cert.Leaf = hs.Certificate()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	server := cache.NewAuthServer(hs.URL + "/dns-query?pin=" + certificatePin(cert))
+	resp, _, err := exchangeHTTPS(server, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, req.Id, resp.Id)
+
+	server = cache.NewAuthServer(hs.URL + "/dns-query")
+	_, _, err = exchangeHTTPS(server, req)
+	assert.Error(t, err)
+
+	// the body over the message size not read
+	server = cache.NewAuthServer(hs.URL + "/large?pin=" + certificatePin(cert))
+	_, _, err = exchangeHTTPS(server, req)
+	assert.Equal(t, errHTTPSize, err)
+}
+
+func Test_upstreamTimeouts(t *testing.T) {
+	defer setConfig(func(cfg *config) {
+		cfg.UDPTimeout.Duration = time.Second
+		cfg.DOHTimeout.Duration = 0
+		cfg.TLSConnectTimeout.Duration = 3 * time.Second
+	})()
+
+	timeout, connect := upstreamTimeouts("udp")
+	assert.Equal(t, time.Second, timeout)
+	assert.Equal(t, Config().ConnectTimeout.Duration, connect)
+
+	// the unset timeouts fall through to the global ones
+	timeout, connect = upstreamTimeouts("https")
+	assert.Equal(t, Config().Timeout.Duration, timeout)
+	assert.Equal(t, Config().ConnectTimeout.Duration, connect)
+
+	timeout, connect = upstreamTimeouts("tcp-tls")
+	assert.Equal(t, Config().Timeout.Duration, timeout)
+	assert.Equal(t, 3*time.Second, connect)
+
+	c := NewResolver().newClient("udp")
+	assert.Equal(t, time.Second, c.ReadTimeout)
+	assert.Equal(t, Config().ConnectTimeout.Duration, c.Dialer.Timeout)
+}
+
+// runTCPUpstream serves the plain tcp queries, the connections counted and
+// closed after the first answer when once set
+func runTCPUpstream(t testing.TB, once bool, keepalive uint16) (string, *int32, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accepts int32
+
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&accepts, 1)
+
+			go func(conn *dns.Conn) {
+				defer conn.Close()
+
+				for {
+					req, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+
+					m := upstreamReply(req)
+					// the keepalive timeout offered to the clients asked for it
+					if keepalive > 0 && req.IsEdns0() != nil && len(req.IsEdns0().Option) == 1 &&
+						req.IsEdns0().Option[0].Option() == dns.EDNS0TCPKEEPALIVE {
+						m.SetEdns0(DefaultMsgSize, false)
+						opt := m.IsEdns0()
+						data := make([]byte, 2)
+						binary.BigEndian.PutUint16(data, keepalive)
+						opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+					}
+
+					if conn.WriteMsg(m) != nil || once {
+						return
+					}
+				}
+			}(&dns.Conn{Conn: raw})
+		}
+	}()
+
+	return ln.Addr().String(), &accepts, func() { ln.Close() }
+}
+
+func Test_exchangeTCP(t *testing.T) {
+	addr, accepts, stop := runTCPUpstream(t, false, 50)
+	defer stop()
+
+	c := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: time.Second}}
+	server := cache.NewAuthServer(addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	for i := 0; i < 3; i++ {
+		resp, _, err := exchangeUpstream(c, req, server)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, req.Id, resp.Id)
+	}
+
+	// the request sent upstream with the keepalive option, not the given one
+	assert.Len(t, req.IsEdns0().Option, 0)
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepts))
+
+	upstreams.mu.Lock()
+	if assert.Len(t, upstreams.conns[server.Host], 1) {
+		assert.Equal(t, 5*time.Second, upstreams.conns[server.Host][0].idle)
+	}
+	upstreams.mu.Unlock()
+}
+
+func Test_exchangeTCPClosed(t *testing.T) {
+	addr, accepts, stop := runTCPUpstream(t, true, 0)
+	defer stop()
+
+	c := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: time.Second}}
+	server := cache.NewAuthServer(addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// the connections closed by the server retried on a new one
+	for i := 0; i < 3; i++ {
+		resp, _, err := exchangeUpstream(c, req, server)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, resp.Answer, 1)
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(accepts))
+}
+
+func benchmarkExchangeTCP(b *testing.B, exchange func(c *dns.Client, req *dns.Msg, server *cache.AuthServer) error) {
+	addr, _, stop := runTCPUpstream(b, false, 0)
+	defer stop()
+
+	c := &dns.Client{Net: "tcp", Dialer: &net.Dialer{Timeout: time.Second}}
+	server := cache.NewAuthServer(addr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := exchange(c, req, server); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExchangeTCPPooled(b *testing.B) {
+	benchmarkExchangeTCP(b, func(c *dns.Client, req *dns.Msg, server *cache.AuthServer) error {
+		_, _, err := exchangeUpstream(c, req, server)
+		return err
+	})
+}
+
+func BenchmarkExchangeTCPDial(b *testing.B) {
+	benchmarkExchangeTCP(b, func(c *dns.Client, req *dns.Msg, server *cache.AuthServer) error {
+		_, _, err := c.Exchange(req, server.Host)
+		return err
+	})
+}
+
+func Test_upstreamRequest(t *testing.T) {
+	defer setConfig(func(cfg *config) { cfg.UpstreamUDPSize = 1400 })()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// the requests without edns0 sent as is
+	assert.True(t, upstreamRequest(req) == req)
+
+	req.SetEdns0(DefaultMsgSize, true)
+
+	sent := upstreamRequest(req)
+	assert.Equal(t, uint16(1400), sent.IsEdns0().UDPSize())
+	assert.True(t, sent.IsEdns0().Do())
+	assert.Equal(t, uint16(DefaultMsgSize), req.IsEdns0().UDPSize())
+
+	assert.True(t, upstreamRequest(sent) == sent)
+}
+
+func Test_exchangeTruncated(t *testing.T) {
+	var size uint32
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := upstreamReply(req)
+
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.StoreUint32(&size, uint32(req.IsEdns0().UDPSize()))
+
+			m.Answer = nil
+			m.Truncated = true
+		}
+
+		w.WriteMsg(m)
+	})
+
+	s, addrstr, _, err := RunLocalUDPServerWithFinChan("127.0.0.1:0", func(srv *dns.Server) {
+		srv.Handler = handler
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	// the tcp server on the same port
+	l, err := net.Listen("tcp4", addrstr)
+	if err != nil {
+		t.Skip("tcp listen failed", err)
+	}
+
+	ts := &dns.Server{Listener: l, Handler: handler}
+	go ts.ActivateAndServe()
+	defer ts.Shutdown()
+
+	r := NewResolver()
+	c := r.newClient("udp")
+	server := cache.NewAuthServer(addrstr)
+
+	req := new(dns.Msg)
+	req.SetQuestion("truncated.example.com.", dns.TypeA)
+	req.SetEdns0(DefaultMsgSize, true)
+
+	// the truncated udp answer queried again over tcp
+	resp, err := r.exchange(server, req, c)
+	if assert.NoError(t, err) {
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, 1)
+	}
+
+	assert.Equal(t, uint32(DefaultUpstreamUDPSize), atomic.LoadUint32(&size))
+
+	// the truncated answer kept when tcp fails
+	ts.Shutdown()
+
+	resp, err = r.exchange(server, req, c)
+	if assert.NoError(t, err) {
+		assert.True(t, resp.Truncated)
+	}
+}
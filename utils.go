@@ -81,6 +81,12 @@ func searchAddr(msg *dns.Msg) (addr string, found bool) {
 			found = true
 			break
 		}
+
+		if aaaa, ok := ans.(*dns.AAAA); ok {
+			addr = aaaa.AAAA.String()
+			found = true
+			break
+		}
 	}
 
 	return
@@ -200,6 +206,8 @@ func clearOPT(msg *dns.Msg) *dns.Msg {
 	return msg
 }
 
+// clearDNSSEC removes the signatures and the denial records of the answer for
+// the clients not asked DNSSEC, the slices of the message copied
 func clearDNSSEC(msg *dns.Msg) *dns.Msg {
 	answer := make([]dns.RR, len(msg.Answer))
 	copy(answer, msg.Answer)
@@ -229,6 +237,20 @@ func clearDNSSEC(msg *dns.Msg) *dns.Msg {
 		}
 	}
 
+	extra := make([]dns.RR, len(msg.Extra))
+	copy(extra, msg.Extra)
+
+	msg.Extra = []dns.RR{}
+
+	for _, rr := range extra {
+		switch rr.(type) {
+		case *dns.RRSIG:
+			continue
+		default:
+			msg.Extra = append(msg.Extra, rr)
+		}
+	}
+
 	return msg
 }
 